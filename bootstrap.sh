@@ -41,6 +41,7 @@ go install launchpad.net/gozk/zookeeper
 # install opts-go
 go get code.google.com/p/opts-go
 go get github.com/golang/glog
+go get github.com/golang/snappy
 
 ln -snf $VTTOP/config $VTROOT/config
 ln -snf $VTTOP/data $VTROOT/data
@@ -6,6 +6,7 @@ package bson
 
 import (
 	"bytes"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -171,9 +172,130 @@ func TestTypes(t *testing.T) {
 	}
 }
 
+func TestTimes(t *testing.T) {
+	testcases := []struct {
+		desc  string
+		in    time.Time
+		mtime int64
+		out   time.Time
+	}{
+		{"epoch", time.Unix(0, 0), 0, time.Unix(0, 0).UTC()},
+		{"zero", time.Time{}, -62135596800000, time.Time{}},
+		{"milliseconds", time.Unix(1136243045, 123e6), 1136243045123, time.Unix(1136243045, 123e6).UTC()},
+		{"truncated", time.Unix(1136243045, 123999999), 1136243045123, time.Unix(1136243045, 123e6).UTC()},
+		{"before 1970", time.Date(1969, 12, 31, 23, 59, 59, 500e6, time.UTC), -500, time.Date(1969, 12, 31, 23, 59, 59, 500e6, time.UTC)},
+		{"truncated before 1970", time.Unix(-1, 999999), -1000, time.Unix(-1, 0).UTC()},
+		{"before 1677", time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC), -30610224000000, time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"after 2262", time.Date(9999, 12, 31, 23, 59, 59, 999e6, time.UTC), 253402300799999, time.Date(9999, 12, 31, 23, 59, 59, 999e6, time.UTC)},
+		{"not UTC", time.Date(2014, 5, 6, 7, 8, 9, 0, time.FixedZone("X", -3600)), 1399363689000, time.Date(2014, 5, 6, 8, 8, 9, 0, time.UTC)},
+	}
+	for _, tcase := range testcases {
+		buf := bytes2.NewChunkedWriter(16)
+		EncodeTime(buf, "", tcase.in)
+		encoded := buf.Bytes()
+		// Skip the kind and the empty key.
+		if mtime := int64(Pack.Uint64(encoded[2:])); mtime != tcase.mtime {
+			t.Errorf("%s: encoded %v, want %v", tcase.desc, mtime, tcase.mtime)
+		}
+		got := DecodeTime(bytes.NewBuffer(encoded[2:]), Datetime)
+		if !reflect.DeepEqual(got, tcase.out) {
+			t.Errorf("%s: decoded %v, want %v", tcase.desc, got, tcase.out)
+		}
+	}
+}
+
 // test that we are calling the right encoding method
 // if we use the reflection code, this will fail as reflection
 // cannot access the non-exported field
+// panicStruct panics with a runtime error when unmarshalled.
+type panicStruct struct{}
+
+func (ps *panicStruct) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	var m map[string]int
+	m["a"] = 1
+}
+
+func TestUnmarshalBsonSafe(t *testing.T) {
+	doc := verifyMarshal(t, alltypes{Bytes: []byte("bytes"), String: "string", Bool: true, Strings: []string{"a"}})
+
+	// a truncated document fails in the field it ends in
+	stringIndex := bytes.Index(doc, []byte("string"))
+	truncated := doc[:stringIndex+3]
+	err := UnmarshalBsonSafe(bytes.NewBuffer(truncated), new(alltypes))
+	// the length of the binary is checked before its subtype
+	want := &BsonError{Message: "binary of 6 bytes is larger than the 4 bytes left", Key: "String", Offset: stringIndex - 1}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("got %#v, want %#v", err, want)
+	}
+	if want := fmt.Sprintf("binary of 6 bytes is larger than the 4 bytes left, in field String at offset %v", stringIndex-1); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	// a field of the wrong type fails before its value
+	mismatched := make([]byte, len(doc))
+	copy(mismatched, doc)
+	boolIndex := bytes.Index(doc, []byte("Bool\x00"))
+	mismatched[boolIndex-1] = Int
+	err = UnmarshalBsonSafe(bytes.NewBuffer(mismatched), new(alltypes))
+	want = &BsonError{Message: "Decode Bool, kind is 16, want 8", Key: "Bool", Offset: boolIndex + 5}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("got %#v, want %#v", err, want)
+	}
+
+	// so do the runtime errors
+	err = UnmarshalBsonSafe(bytes.NewBuffer(doc), new(panicStruct))
+	want = &BsonError{Message: "assignment to entry in nil map", Offset: 0}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("got %#v, want %#v", err, want)
+	}
+
+	// Unmarshal uses it for the custom unmarshalers
+	err = Unmarshal(truncated, new(alltypes))
+	if _, ok := err.(*BsonError); !ok {
+		t.Errorf("got %#v, want a *BsonError", err)
+	}
+}
+
+type keyDoc struct {
+	A int64
+	B struct {
+		C string
+	}
+	D []string
+	E interface{}
+}
+
+func TestKeyAtOffset(t *testing.T) {
+	var in keyDoc
+	in.B.C = "c"
+	in.D = []string{"d0", "d1"}
+	doc := verifyMarshal(t, in)
+	valueStart := func(key string) int {
+		return bytes.Index(doc, []byte(key+"\x00")) + len(key) + 1
+	}
+	testCases := []struct {
+		doc    []byte
+		offset int
+		want   string
+	}{
+		{doc, 2, ""},
+		{doc, valueStart("A"), "A"},
+		{doc, valueStart("A") + 7, "A"},
+		{doc, valueStart("B"), "B"},
+		{doc, valueStart("C") + 4, "B.C"},
+		{doc, valueStart("D") + 4, "D"},
+		{doc, valueStart("1") + 1, "D.1"},
+		{doc, valueStart("E"), "E"},
+		{doc[:valueStart("C")+2], valueStart("C") + 2, "B.C"},
+		{doc[:valueStart("B")], valueStart("B"), "B"},
+	}
+	for _, tc := range testCases {
+		if got := keyAtOffset(tc.doc, tc.offset); got != tc.want {
+			t.Errorf("keyAtOffset(%q, %v): got %q, want %q", tc.doc, tc.offset, got, tc.want)
+		}
+	}
+}
+
 type PrivateStruct struct {
 	veryPrivate uint64
 }
@@ -345,6 +467,84 @@ func TestSkipUnknownFields(t *testing.T) {
 	}
 }
 
+// skipCount counts the elements of the document at the start of buf
+// by skipping them, the way the decoders read them.
+func skipCount(buf *bytes.Buffer) int {
+	ReadDocumentLength(buf)
+	count := 0
+	for kind := NextByte(buf); kind != EOO; kind = NextByte(buf) {
+		ReadCString(buf)
+		Skip(buf, kind)
+		count++
+	}
+	return count
+}
+
+func TestCountElements(t *testing.T) {
+	// the values have bytes that look like lengths, kinds and EOOs
+	nested := map[string]interface{}{
+		"bytes":  []byte("\x00\x03\x05\x00\x00\x00\x00"),
+		"string": "\x04a\x00\xff\xff\xff\x7f",
+		"list":   []interface{}{"\x00", []interface{}{}, map[string]interface{}{"\x03": "\x00\x00"}, nil},
+	}
+	values := []interface{}{
+		1.5, "s", nested, []interface{}{nested, nested}, []byte{}, true,
+		time.Now(), nil, int32(1), int64(2), uint64(3),
+	}
+	doc := make(map[string]interface{})
+	for i, v := range values {
+		doc[fmt.Sprint(i)] = v
+	}
+	encoded := verifyMarshal(t, doc)
+	if got := CountElements(bytes.NewBuffer(encoded)); got != len(values) {
+		t.Errorf("got %v elements, want %v", got, len(values))
+	}
+
+	// a String element, which Marshal doesn't write, with a 0 inside
+	str := "\x17\x00\x00\x00\x02a\x00\x04\x00\x00\x00\x00\x01\x00\x00\x10b\x00\x01\x00\x00\x00\x00"
+	// an array of 1000 nested documents
+	manyValues := make([]interface{}, 1000)
+	for i := range manyValues {
+		manyValues[i] = nested
+	}
+	many := verifyMarshal(t, manyValues)
+
+	testcases := []struct {
+		desc string
+		in   []byte
+		want int
+	}{
+		{"nested", encoded, len(values)},
+		{"string", []byte(str), 2},
+		{"many", many, 1000},
+		{"empty", []byte("\x05\x00\x00\x00\x00"), 0},
+		{"nothing", nil, 0},
+		{"truncated", encoded[:len(encoded)-1], 0},
+		{"short length", []byte("\x04\x00\x00\x00\x00"), 0},
+		// the counting stops at the element it cannot size
+		{"unknown kind", []byte("\x0f\x00\x00\x00\x10a\x00\x01\x00\x00\x00\x7fb\x00\x00"), 1},
+		{"long element", []byte("\x0d\x00\x00\x00\x05a\x00\xff\x00\x00\x00\x00\x00"), 0},
+		{"no key end", []byte("\x08\x00\x00\x00\x0aab\x00"), 0},
+	}
+	for _, tcase := range testcases {
+		buf := bytes.NewBuffer(tcase.in)
+		if got := CountElements(buf); got != tcase.want {
+			t.Errorf("%s: got %v, want %v", tcase.desc, got, tcase.want)
+		}
+		// the buffer isn't read
+		if buf.Len() != len(tcase.in) {
+			t.Errorf("%s: CountElements read %v bytes", tcase.desc, len(tcase.in)-buf.Len())
+		}
+	}
+
+	// on valid documents, it agrees with the decoders
+	for _, in := range [][]byte{encoded, []byte(str), many} {
+		if got, want := CountElements(bytes.NewBuffer(in)), skipCount(bytes.NewBuffer(in)); got != want {
+			t.Errorf("got %v elements, the decoders read %v", got, want)
+		}
+	}
+}
+
 func TestEncodeFieldNil(t *testing.T) {
 	buf := bytes2.NewChunkedWriter(DefaultBufferSize)
 	EncodeField(buf, "Val", nil)
@@ -409,3 +609,43 @@ func verifyUnmarshal(t *testing.T, buf []byte, val interface{}) {
 		t.Errorf("Unmarshal error for %+v: %v\n", val, err)
 	}
 }
+
+func TestDecodeLengths(t *testing.T) {
+	defer func(max int) { MaxDocumentSize = max }(MaxDocumentSize)
+	MaxDocumentSize = 16
+	testCases := []struct {
+		in      string
+		kind    byte
+		decoder func(buf *bytes.Buffer, kind byte)
+		want    string
+	}{
+		{"\x20\x00\x00\x00string", String, func(buf *bytes.Buffer, kind byte) { DecodeString(buf, kind) }, "string of 32 bytes is larger than the maximum of 16 bytes"},
+		{"\x08\x00\x00\x00string", String, func(buf *bytes.Buffer, kind byte) { DecodeString(buf, kind) }, "string of 8 bytes is larger than the 6 bytes left"},
+		{"\x00\x00\x00\x00", String, func(buf *bytes.Buffer, kind byte) { DecodeString(buf, kind) }, "string of 0 bytes, a string has at least its trailing 0"},
+		{"\x07\x00\x00\x00\x00binary", Binary, func(buf *bytes.Buffer, kind byte) { DecodeBinary(buf, kind) }, "binary of 7 bytes is larger than the 7 bytes left"},
+		{"\x20\x00\x00\x00\x00", Array, func(buf *bytes.Buffer, kind byte) { DecodeStringArray(buf, kind) }, "document of 32 bytes is larger than the maximum of 16 bytes"},
+		{"\x03\x00\x00\x00\x00", Object, func(buf *bytes.Buffer, kind byte) { DecodeMap(buf, kind) }, "document of 3 bytes, an empty document is 5 bytes"},
+		{"\x10\x00\x00\x00\x00", Object, Skip, "document of 16 bytes is larger than the 1 bytes left"},
+	}
+	for _, tc := range testCases {
+		func() {
+			defer func() {
+				x := recover()
+				if x == nil {
+					t.Errorf("%q: got no error, want %v", tc.in, tc.want)
+					return
+				}
+				if got := x.(BsonError).Error(); got != tc.want {
+					t.Errorf("%q: got %v, want %v", tc.in, got, tc.want)
+				}
+			}()
+			tc.decoder(bytes.NewBuffer([]byte(tc.in)), tc.kind)
+		}()
+	}
+
+	// a stream doesn't read a document larger than MaxDocumentSize
+	err := UnmarshalFromStream(bytes.NewReader([]byte("\x20\x00\x00\x00")), new(alltypes))
+	if want := "document of 32 bytes is larger than the maximum of 16 bytes"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
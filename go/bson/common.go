@@ -59,14 +59,22 @@ const (
 
 type BsonError struct {
 	Message string
+	// Key and Offset are set by UnmarshalBsonSafe: Key is the path
+	// of the field that failed to decode, like "Session.ShardSessions.0",
+	// and Offset where the decoding stopped in the document.
+	Key    string
+	Offset int
 }
 
 func NewBsonError(format string, args ...interface{}) BsonError {
-	return BsonError{fmt.Sprintf(format, args...)}
+	return BsonError{Message: fmt.Sprintf(format, args...)}
 }
 
 func (err BsonError) Error() string {
-	return err.Message
+	if err.Key == "" {
+		return err.Message
+	}
+	return fmt.Sprintf("%v, in field %v at offset %v", err.Message, err.Key, err.Offset)
 }
 
 func handleError(err *error) {
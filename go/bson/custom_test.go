@@ -10,6 +10,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/youtube/vitess/go/bytes2"
 )
 
 var customUnmarshalCases = []struct {
@@ -402,6 +404,12 @@ var customUnmarshalCases = []struct {
 	Array,
 	func(buf *bytes.Buffer, kind byte) interface{} { return DecodeStringArray(buf, kind) },
 	[]string{"test1", "test2"},
+}, {
+	"Array of String->[]string",
+	"\x1f\x00\x00\x00\x020\x00\x06\x00\x00\x00test1\x00\x021\x00\x06\x00\x00\x00test2\x00\x00",
+	Array,
+	func(buf *bytes.Buffer, kind byte) interface{} { return DecodeStringArray(buf, kind) },
+	[]string{"test1", "test2"},
 }, {
 	"Null->[]string",
 	"",
@@ -519,3 +527,88 @@ func TestCustomUnmarshalFailures(t *testing.T) {
 		}
 	}
 }
+
+// encodeArray returns the bson array of values, without its prefix,
+// each value being written by encode.
+func encodeArray(values []string, encode func(buf *bytes2.ChunkedWriter, key, val string)) []byte {
+	buf := bytes2.NewChunkedWriter(DefaultBufferSize)
+	lenWriter := NewLenWriter(buf)
+	for i, val := range values {
+		encode(buf, Itoa(i), val)
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+	return buf.Bytes()
+}
+
+func encodeStringElement(buf *bytes2.ChunkedWriter, key, val string) {
+	EncodePrefix(buf, String, key)
+	putUint32(buf, uint32(len(val)+1))
+	buf.WriteString(val)
+	buf.WriteByte(0)
+}
+
+func TestStringArrayElementKinds(t *testing.T) {
+	values := []string{"-80", "", "80-\x00\xff"}
+	buf := bytes2.NewChunkedWriter(DefaultBufferSize)
+	EncodeStringArray(buf, "", values)
+	encoded := buf.Bytes()
+	// skip the kind and the empty name
+	if encoded[0] != Array {
+		t.Fatalf("EncodeStringArray wrote kind %v, want Array", encoded[0])
+	}
+	encoded = encoded[2:]
+
+	arrays := map[string][]byte{
+		"EncodeStringArray": encoded,
+		"Binary":            encodeArray(values, EncodeString),
+		"String":            encodeArray(values, encodeStringElement),
+		"mixed": encodeArray(values, func(buf *bytes2.ChunkedWriter, key, val string) {
+			if key == "1" {
+				encodeStringElement(buf, key, val)
+			} else {
+				EncodeString(buf, key, val)
+			}
+		}),
+	}
+	for desc, array := range arrays {
+		in := bytes.NewBuffer(array)
+		got := DecodeStringArray(in, Array)
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("%s: got %q, want %q", desc, got, values)
+		}
+		if in.Len() != 0 {
+			t.Errorf("%s: %d unread bytes", desc, in.Len())
+		}
+	}
+	if !bytes.Equal(arrays["Binary"], encoded) {
+		t.Errorf("EncodeStringArray wrote %q, want %q", encoded, arrays["Binary"])
+	}
+
+	if got := DecodeStringArray(bytes.NewBuffer(nil), Null); got != nil {
+		t.Errorf("got %q for Null, want nil", got)
+	}
+
+	// an element of another kind is rejected, with its index
+	bad := encodeArray([]string{"a", "b"}, func(buf *bytes2.ChunkedWriter, key, val string) {
+		if key == "1" {
+			EncodeInt64(buf, key, 1)
+		} else {
+			EncodeString(buf, key, val)
+		}
+	})
+	want := fmt.Sprintf("unexpected kind %v for element 1 of []string", Long)
+	func() {
+		defer func() {
+			x := recover()
+			if x == nil {
+				t.Errorf("got no error, want %s", want)
+				return
+			}
+			if got := x.(BsonError).Error(); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		}()
+		DecodeStringArray(bytes.NewBuffer(bad), Array)
+	}()
+}
@@ -68,9 +68,13 @@ func canMarshal(val reflect.Value) Marshaler {
 // DefaultBufferSize is the default allocation size for ChunkedWriter.
 const DefaultBufferSize = 1024 * 16
 
+// writerPool holds the buffers of MarshalToStream.
+var writerPool = bytes2.NewChunkedWriterPool(DefaultBufferSize)
+
 // MarshalToStream marshals val into writer.
 func MarshalToStream(writer io.Writer, val interface{}) (err error) {
-	buf := bytes2.NewChunkedWriter(DefaultBufferSize)
+	buf := writerPool.Get()
+	defer writerPool.Put(buf)
 	if err = MarshalToBuffer(buf, val); err != nil {
 		return err
 	}
@@ -270,9 +274,13 @@ func EncodeBool(buf *bytes2.ChunkedWriter, key string, val bool) {
 	}
 }
 
+// EncodeTime encodes val as a Datetime, the number of milliseconds
+// since the epoch. The sub-millisecond part is truncated towards the
+// past, also before 1970. Unlike UnixNano, this doesn't overflow for
+// the zero time.
 func EncodeTime(buf *bytes2.ChunkedWriter, key string, val time.Time) {
 	EncodePrefix(buf, Datetime, key)
-	mtime := val.UnixNano() / 1e6
+	mtime := val.Unix()*1e3 + int64(val.Nanosecond()/1e6)
 	putUint64(buf, uint64(mtime))
 }
 
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -53,6 +54,12 @@ func UnmarshalFromStream(reader io.Reader, val interface{}) (err error) {
 		return io.ErrUnexpectedEOF
 	}
 	length := Pack.Uint32(lenbuf)
+	if int(length) > MaxDocumentSize {
+		return NewBsonError("document of %v bytes is larger than the maximum of %v bytes", length, MaxDocumentSize)
+	}
+	if length < 5 {
+		return NewBsonError("document of %v bytes, an empty document is 5 bytes", length)
+	}
 	b := make([]byte, length)
 	Pack.PutUint32(b, length)
 	n, err = io.ReadFull(reader, b[4:])
@@ -77,8 +84,7 @@ func UnmarshalFromBuffer(buf *bytes.Buffer, val interface{}) (err error) {
 	}
 
 	if unmarshaler, ok := val.(Unmarshaler); ok {
-		unmarshaler.UnmarshalBson(buf, EOO)
-		return nil
+		return UnmarshalBsonSafe(buf, unmarshaler)
 	}
 	sb, err := topLevelBuilder(val)
 	if err != nil {
@@ -89,11 +95,100 @@ func UnmarshalFromBuffer(buf *bytes.Buffer, val interface{}) (err error) {
 	return nil
 }
 
+// UnmarshalBsonSafe unmarshals the document at the start of buf with
+// the custom unmarshaler of val. The custom unmarshalers panic on
+// malformed documents: their panic, even a runtime error, is returned
+// as a *BsonError instead, with the key of the field that failed to
+// decode and its offset.
+func UnmarshalBsonSafe(buf *bytes.Buffer, val Unmarshaler) (err error) {
+	doc := buf.Bytes()
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
+		}
+		bsonErr := &BsonError{Offset: len(doc) - buf.Len()}
+		switch x := x.(type) {
+		case BsonError:
+			bsonErr.Message = x.Message
+		case error:
+			bsonErr.Message = x.Error()
+		default:
+			bsonErr.Message = fmt.Sprint(x)
+		}
+		bsonErr.Key = keyAtOffset(doc, bsonErr.Offset)
+		err = bsonErr
+	}()
+	val.UnmarshalBson(buf, EOO)
+	return nil
+}
+
+// keyAtOffset returns the path of the field of doc that offset is in,
+// descending into the embedded documents and arrays, or "" if offset
+// is not in a field. doc may be truncated or corrupt: the path is then
+// as deep as the fields before offset could be parsed.
+func keyAtOffset(doc []byte, offset int) string {
+	var path []string
+	// skip the length of the document
+	pos := 4
+	for pos < offset && pos < len(doc) && doc[pos] != EOO {
+		kind := doc[pos]
+		end := bytes.IndexByte(doc[pos+1:], 0)
+		if end < 0 {
+			break
+		}
+		name := string(doc[pos+1 : pos+1+end])
+		valueStart := pos + 1 + end + 1
+		l, ok := valueLen(doc[valueStart:], kind)
+		// a field without value, like Null, is the one at its
+		// offset
+		if ok && offset >= valueStart+l && (l != 0 || offset > valueStart) {
+			pos = valueStart + l
+			continue
+		}
+		// offset is in this field, or the field can't be parsed
+		path = append(path, name)
+		if !ok || (kind != Object && kind != Array) || offset < valueStart+4 {
+			break
+		}
+		pos = valueStart + 4
+	}
+	return strings.Join(path, ".")
+}
+
+// valueLen returns the length of the value of a field of kind at the
+// start of b, or false if it can't be parsed.
+func valueLen(b []byte, kind byte) (int, bool) {
+	switch kind {
+	case Number, Datetime, Long, Ulong:
+		return 8, true
+	case Boolean:
+		return 1, true
+	case Int:
+		return 4, true
+	case Null:
+		return 0, true
+	case String, Object, Array, Binary:
+		if len(b) < 4 {
+			return 0, false
+		}
+		l := int(Pack.Uint32(b))
+		switch kind {
+		case String:
+			l += 4
+		case Binary:
+			l += 5
+		}
+		return l, l >= 4
+	}
+	return 0, false
+}
+
 func decodeDocument(buf *bytes.Buffer, builder *valueBuilder, kind byte) {
 	if kind != EOO && kind != Object && kind != Array {
 		panic(NewBsonError("unexpected kind: %v", kind))
 	}
-	Next(buf, 4)
+	ReadDocumentLength(buf)
 	for kind := NextByte(buf); kind != EOO; kind = NextByte(buf) {
 		b2 := builder.initField(ReadCString(buf), kind)
 		if b2 == nil {
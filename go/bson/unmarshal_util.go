@@ -14,6 +14,123 @@ import (
 	"github.com/youtube/vitess/go/hack"
 )
 
+// MaxDocumentSize is the largest document the decoders accept, and the
+// largest string, binary, embedded document or array in a document:
+// a larger declared length is rejected before anything is allocated
+// for it. It is 64MB by default.
+var MaxDocumentSize = 64 * 1024 * 1024
+
+// ReadDocumentLength reads the length at the start of a document or an
+// array, like Next(buf, 4) does, and returns it. It fails if the length
+// is shorter than an empty document, larger than MaxDocumentSize, or
+// larger than what is left in buf.
+func ReadDocumentLength(buf *bytes.Buffer) int {
+	l := int(Pack.Uint32(Next(buf, 4)))
+	if l < 5 {
+		panic(NewBsonError("document of %v bytes, an empty document is 5 bytes", l))
+	}
+	verifyLength(buf, "document", l, l-4)
+	return l
+}
+
+// verifyLength fails if the declared length l of a value is larger
+// than MaxDocumentSize, or if the rest of the value, n bytes, is
+// larger than what is left in buf.
+func verifyLength(buf *bytes.Buffer, what string, l, n int) {
+	if l > MaxDocumentSize {
+		panic(NewBsonError("%v of %v bytes is larger than the maximum of %v bytes", what, l, MaxDocumentSize))
+	}
+	if n > buf.Len() {
+		panic(NewBsonError("%v of %v bytes is larger than the %v bytes left", what, l, buf.Len()))
+	}
+}
+
+// readStringLength reads the length of a String, which includes its
+// trailing 0.
+func readStringLength(buf *bytes.Buffer) int {
+	l := int(Pack.Uint32(Next(buf, 4)))
+	if l < 1 {
+		panic(NewBsonError("string of %v bytes, a string has at least its trailing 0", l))
+	}
+	verifyLength(buf, "string", l, l)
+	return l
+}
+
+// readBinaryLength reads the length of a Binary, which doesn't include
+// its subtype.
+func readBinaryLength(buf *bytes.Buffer) int {
+	l := int(Pack.Uint32(Next(buf, 4)))
+	verifyLength(buf, "binary", l, l+1)
+	return l
+}
+
+// CountElements returns the number of elements of the document or
+// array at the start of buf, without reading it, so that a decoder can
+// allocate its slice at once. It only follows the embedded lengths, and
+// stops counting at the first element it cannot size: the decoder
+// reports the error, if any.
+func CountElements(buf *bytes.Buffer) int {
+	b := buf.Bytes()
+	if len(b) < 5 {
+		return 0
+	}
+	l := int(Pack.Uint32(b))
+	if l < 5 || l > len(b) {
+		return 0
+	}
+	// the elements, without the length and the trailing EOO
+	b = b[4 : l-1]
+	count := 0
+	for len(b) != 0 {
+		kind := b[0]
+		end := bytes.IndexByte(b[1:], 0)
+		if end < 0 {
+			break
+		}
+		b = b[end+2:]
+		size := elementSize(kind, b)
+		if size < 0 || size > len(b) {
+			break
+		}
+		b = b[size:]
+		count++
+	}
+	return count
+}
+
+// elementSize returns the size of the value of kind at the start of b,
+// or -1 if it cannot tell.
+func elementSize(kind byte, b []byte) int {
+	switch kind {
+	case Number, Datetime, Long, Ulong:
+		return 8
+	case Int:
+		return 4
+	case Boolean:
+		return 1
+	case Null:
+		return 0
+	}
+	if len(b) < 4 {
+		return -1
+	}
+	l := int(Pack.Uint32(b))
+	switch kind {
+	case String:
+		// the length doesn't include itself
+		return 4 + l
+	case Binary:
+		// nor the subtype
+		return 5 + l
+	case Object, Array:
+		if l < 5 {
+			return -1
+		}
+		return l
+	}
+	return -1
+}
+
 // VerifyObject verifies kind to make sure it's
 // either a top level document (EOO) or an Object.
 func VerifyObject(kind byte) {
@@ -27,12 +144,12 @@ func VerifyObject(kind byte) {
 func DecodeString(buf *bytes.Buffer, kind byte) string {
 	switch kind {
 	case String:
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readStringLength(buf)
 		s := Next(buf, l-1)
 		NextByte(buf)
 		return string(s)
 	case Binary:
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readBinaryLength(buf)
 		NextByte(buf)
 		return string(Next(buf, l))
 	case Null:
@@ -46,12 +163,12 @@ func DecodeString(buf *bytes.Buffer, kind byte) string {
 func DecodeBinary(buf *bytes.Buffer, kind byte) []byte {
 	switch kind {
 	case String:
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readStringLength(buf)
 		b := Next(buf, l-1)
 		NextByte(buf)
 		return b
 	case Binary:
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readBinaryLength(buf)
 		NextByte(buf)
 		return Next(buf, l)
 	case Null:
@@ -172,13 +289,18 @@ func DecodeBool(buf *bytes.Buffer, kind byte) bool {
 	}
 }
 
-// DecodeBinary decodes a time.Time from buf.
+// DecodeTime decodes a time.Time from buf.
 // Allowed types: Datetime, Null.
 func DecodeTime(buf *bytes.Buffer, kind byte) time.Time {
 	switch kind {
 	case Datetime:
-		ui64 := Pack.Uint64(Next(buf, 8))
-		return time.Unix(0, int64(ui64)*1e6).UTC()
+		mtime := int64(Pack.Uint64(Next(buf, 8)))
+		sec, msec := mtime/1e3, mtime%1e3
+		if msec < 0 {
+			// Before 1970, the remainder is negative.
+			sec, msec = sec-1, msec+1e3
+		}
+		return time.Unix(sec, msec*1e6).UTC()
 	case Null:
 		return time.Time{}
 	}
@@ -229,7 +351,7 @@ func DecodeMap(buf *bytes.Buffer, kind byte) map[string]interface{} {
 	}
 
 	result := make(map[string]interface{})
-	Next(buf, 4)
+	ReadDocumentLength(buf)
 	for kind := NextByte(buf); kind != EOO; kind = NextByte(buf) {
 		key := ReadCString(buf)
 		if kind == Null {
@@ -254,7 +376,7 @@ func DecodeArray(buf *bytes.Buffer, kind byte) []interface{} {
 	}
 
 	result := make([]interface{}, 0, 8)
-	Next(buf, 4)
+	ReadDocumentLength(buf)
 	for kind := NextByte(buf); kind != EOO; kind = NextByte(buf) {
 		ReadCString(buf)
 		if kind == Null {
@@ -266,8 +388,8 @@ func DecodeArray(buf *bytes.Buffer, kind byte) []interface{} {
 	return result
 }
 
-// DecodeMap decodes a []string from buf.
-// Allowed types: Array, Null.
+// DecodeStringArray decodes a []string from buf.
+// Allowed types: Array, Null. The elements can be String or Binary.
 func DecodeStringArray(buf *bytes.Buffer, kind byte) []string {
 	switch kind {
 	case Array:
@@ -279,10 +401,10 @@ func DecodeStringArray(buf *bytes.Buffer, kind byte) []string {
 	}
 
 	result := make([]string, 0, 8)
-	Next(buf, 4)
+	ReadDocumentLength(buf)
 	for kind := NextByte(buf); kind != EOO; kind = NextByte(buf) {
-		if kind != Binary {
-			panic(NewBsonError("unexpected kind %v for string", kind))
+		if kind != Binary && kind != String {
+			panic(NewBsonError("unexpected kind %v for element %v of []string", kind, len(result)))
 		}
 		SkipIndex(buf)
 		result = append(result, DecodeString(buf, kind))
@@ -297,7 +419,7 @@ func Skip(buf *bytes.Buffer, kind byte) {
 		Next(buf, 8)
 	case String:
 		// length of a string includes the 0 at the end, but not the size
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readStringLength(buf)
 		Next(buf, l)
 	case Object, Array:
 		// the encoded length includes the 4 bytes for the size
@@ -305,10 +427,11 @@ func Skip(buf *bytes.Buffer, kind byte) {
 		if l < 4 {
 			panic(NewBsonError("Object or Array should at least be 4 bytes long"))
 		}
+		verifyLength(buf, "document", l, l-4)
 		Next(buf, l-4)
 	case Binary:
 		// length of a binary doesn't include the subtype
-		l := int(Pack.Uint32(Next(buf, 4)))
+		l := readBinaryLength(buf)
 		Next(buf, l+1)
 	case Boolean:
 		buf.ReadByte()
@@ -10,6 +10,7 @@ package bytes2
 import (
 	"fmt"
 	"io"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/youtube/vitess/go/hack"
@@ -20,10 +21,12 @@ import (
 // the caller can directly change.
 type ChunkedWriter struct {
 	bufs [][]byte
+	// free holds the chunks released by Reset, for reuse.
+	free [][]byte
 }
 
 func NewChunkedWriter(chunkSize int) *ChunkedWriter {
-	cw := &ChunkedWriter{make([][]byte, 1)}
+	cw := &ChunkedWriter{bufs: make([][]byte, 1)}
 	cw.bufs[0] = make([]byte, 0, chunkSize)
 	return cw
 }
@@ -48,10 +51,42 @@ func (cw *ChunkedWriter) Len() int {
 	return l
 }
 
+// Reset empties cw. It keeps its chunks so they can be written
+// again without allocating.
 func (cw *ChunkedWriter) Reset() {
-	b := cw.bufs[0][:0]
-	cw.bufs = make([][]byte, 1)
-	cw.bufs[0] = b
+	for _, buf := range cw.bufs[1:] {
+		cw.free = append(cw.free, buf[:0])
+	}
+	cw.bufs[0] = cw.bufs[0][:0]
+	cw.bufs = cw.bufs[:1]
+}
+
+// Grow is a hint that n more bytes are about to be written. It makes
+// room for the chunks they need, so writing them doesn't reallocate
+// the list of chunks.
+func (cw *ChunkedWriter) Grow(n int) {
+	need := len(cw.bufs) + n/cap(cw.bufs[0]) + 1
+	if need <= cap(cw.bufs) {
+		return
+	}
+	bufs := make([][]byte, len(cw.bufs), need)
+	copy(bufs, cw.bufs)
+	cw.bufs = bufs
+}
+
+// newChunk appends an empty chunk to cw, reusing a free one if it
+// can.
+func (cw *ChunkedWriter) newChunk() []byte {
+	var b []byte
+	if n := len(cw.free); n > 0 {
+		b = cw.free[n-1]
+		cw.free[n-1] = nil
+		cw.free = cw.free[:n-1]
+	} else {
+		b = make([]byte, 0, cap(cw.bufs[0]))
+	}
+	cw.bufs = append(cw.bufs, b)
+	return b
 }
 
 func (cw *ChunkedWriter) Truncate(n int) {
@@ -83,8 +118,7 @@ func (cw *ChunkedWriter) WriteString(p string) (n int, err error) {
 		}
 		cw.bufs[len(cw.bufs)-1] = append(lastbuf, p[:available]...)
 		p = p[available:]
-		lastbuf = make([]byte, 0, cap(cw.bufs[0]))
-		cw.bufs = append(cw.bufs, lastbuf)
+		lastbuf = cw.newChunk()
 	}
 }
 
@@ -94,8 +128,8 @@ func (cw *ChunkedWriter) Reserve(n int) (b []byte) {
 	}
 	lastbuf := cw.bufs[len(cw.bufs)-1]
 	if n > cap(lastbuf)-len(lastbuf) {
-		b = make([]byte, n, cap(cw.bufs[0]))
-		cw.bufs = append(cw.bufs, b)
+		b = cw.newChunk()[:n]
+		cw.bufs[len(cw.bufs)-1] = b
 		return b
 	}
 	l := len(lastbuf)
@@ -128,3 +162,43 @@ func (cw *ChunkedWriter) WriteTo(w io.Writer) (n int64, err error) {
 	cw.Reset()
 	return n, nil
 }
+
+// maxPooledChunks is the number of chunks a pooled ChunkedWriter
+// keeps, so one very large write doesn't pin its memory forever.
+const maxPooledChunks = 64
+
+// ChunkedWriterPool is a pool of ChunkedWriters of the same chunk
+// size, to reuse their chunks across writes.
+type ChunkedWriterPool struct {
+	chunkSize int
+	pool      sync.Pool
+}
+
+// NewChunkedWriterPool returns a pool of ChunkedWriters of chunkSize.
+func NewChunkedWriterPool(chunkSize int) *ChunkedWriterPool {
+	return &ChunkedWriterPool{chunkSize: chunkSize}
+}
+
+// Get returns an empty ChunkedWriter.
+func (p *ChunkedWriterPool) Get() *ChunkedWriter {
+	if cw, ok := p.pool.Get().(*ChunkedWriter); ok {
+		return cw
+	}
+	return NewChunkedWriter(p.chunkSize)
+}
+
+// Put resets cw and returns it to the pool. Nothing cw returned,
+// like the result of Bytes, can be used afterwards.
+func (p *ChunkedWriterPool) Put(cw *ChunkedWriter) {
+	if cap(cw.bufs[0]) != p.chunkSize {
+		return
+	}
+	cw.Reset()
+	if len(cw.free) > maxPooledChunks {
+		for i := range cw.free[maxPooledChunks:] {
+			cw.free[maxPooledChunks+i] = nil
+		}
+		cw.free = cw.free[:maxPooledChunks]
+	}
+	p.pool.Put(cw)
+}
@@ -8,6 +8,8 @@
 package bytes2
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -70,3 +72,58 @@ func TestWriteTo(t *testing.T) {
 		t.Errorf("Expecting 123456789, received %s", cw2.Bytes())
 	}
 }
+
+func TestResetReusesChunks(t *testing.T) {
+	cw := NewChunkedWriter(4)
+	cw.WriteString("123456789")
+	cw.Reset()
+	if len(cw.free) != 2 {
+		t.Errorf("Expecting 2 free chunks, received %d", len(cw.free))
+	}
+	cw.WriteString("abcdef")
+	b := cw.Reserve(3)
+	copy(b, "ghi")
+	if string(cw.Bytes()) != "abcdefghi" {
+		t.Errorf("Expecting abcdefghi, received %s", cw.Bytes())
+	}
+	if len(cw.free) != 0 {
+		t.Errorf("Expecting 0 free chunks, received %d", len(cw.free))
+	}
+}
+
+func TestGrow(t *testing.T) {
+	cw := NewChunkedWriter(4)
+	cw.WriteString("12")
+	cw.Grow(10)
+	if cap(cw.bufs) != 4 {
+		t.Errorf("Expecting room for 4 chunks, received %d", cap(cw.bufs))
+	}
+	cw.WriteString("3456789abcde")
+	if string(cw.Bytes()) != "123456789abcde" {
+		t.Errorf("Expecting 123456789abcde, received %s", cw.Bytes())
+	}
+}
+
+func TestChunkedWriterPool(t *testing.T) {
+	pool := NewChunkedWriterPool(4)
+	for i := 0; i < 10; i++ {
+		cw := pool.Get()
+		if cw.Len() != 0 {
+			t.Fatalf("Expecting an empty writer, received %s", cw.Bytes())
+		}
+		// The shorter writes must not show any of the longer ones.
+		want := strings.Repeat(strconv.Itoa(i), 1+(i*7)%20)
+		cw.WriteString(want)
+		if string(cw.Bytes()) != want {
+			t.Errorf("Expecting %s, received %s", want, cw.Bytes())
+		}
+		pool.Put(cw)
+	}
+
+	cw := pool.Get()
+	cw.WriteString(strings.Repeat("x", 4*(maxPooledChunks+10)))
+	pool.Put(cw)
+	if len(cw.free) != maxPooledChunks {
+		t.Errorf("Expecting %d free chunks, received %d", maxPooledChunks, len(cw.free))
+	}
+}
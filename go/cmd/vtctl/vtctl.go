@@ -126,28 +126,52 @@ var commands = []commandGroup{
 		"Shards", []command{
 			command{"CreateShard", commandCreateShard,
 				"[-force] [-parent] <keyspace/shard|zk shard path>",
-				"Creates the given shard"},
+				"Creates the given shard, and its keyspace if it doesn't exist. The shard name is a key range like 80-C0, or 0 for an unsharded keyspace. A shard overlapping the key range of another shard of the keyspace, or that already exists, needs -force."},
 			command{"GetShard", commandGetShard,
 				"<keyspace/shard|zk shard path>",
 				"Outputs the json version of Shard to stdout."},
 			command{"RebuildShardGraph", commandRebuildShardGraph,
 				"[-cells=a,b] <zk shard path> ... (/zk/global/vt/keyspaces/<keyspace>/shards/<shard>)",
 				"Rebuild the replication graph and shard serving data in zk. This may trigger an update to all connected clients."},
+			command{"RefreshShardMasterServing", commandRefreshShardMasterServing,
+				"<keyspace/shard|zk shard path>",
+				"Rewrite the master serving data of the shard in all its cells from the current master tablet record."},
 			command{"ShardExternallyReparented", commandShardExternallyReparented,
 				"[-scrap-stragglers] [-accept-success-percents=80] <keyspace/shard|zk shard path> <tablet alias|zk tablet path>",
 				"Changes metadata to acknowledge a shard master change performed by an external tool."},
 			command{"ValidateShard", commandValidateShard,
 				"[-ping-tablets] <keyspace/shard|zk shard path>",
-				"Validate all nodes reachable from this shard are consistent."},
+				"Cross-checks the shard record, its replication graph and the tablets of its cells, and lists the dangling replication links, the tablets missing from the graph, a wrong master and the cells without replication data. With -ping-tablets, also lists the tablets that don't answer a ping."},
 			command{"ShardReplicationPositions", commandShardReplicationPositions,
 				"<keyspace/shard|zk shard path>",
 				"Show slave status on all machines in the shard graph."},
 			command{"ListShardTablets", commandListShardTablets,
 				"<keyspace/shard|zk shard path>)",
-				"List all tablets in a given shard."},
+				"List all tablets in a given shard. The tablets of the cells that can be read are listed even if some cells can't be."},
+			command{"WaitForShardLockRelease", commandWaitForShardLockRelease,
+				"[-timeout=30s] [-action=<action>] <keyspace/shard|zk shard path>",
+				"Waits until the shard is not locked, or with -action until no action with that name is running or waiting on it. It doesn't lock the shard, and outputs the action in the way on timeout."},
+			command{"GetShardLockHolders", commandGetShardLockHolders,
+				"<keyspace/shard|zk shard path>",
+				"Lists the actions holding or waiting for the shard lock, the one holding it first, with the user, host and pid that started them."},
+			command{"ForceUnlockShard", commandForceUnlockShard,
+				"[-action=<action>] <keyspace/shard|zk shard path>",
+				"Breaks the shard lock, if the process holding it died. With -action, the lock must be held by an action with that name. The broken action is recorded in the shard action log."},
 			command{"SetShardServedTypes", commandSetShardServedTypes,
-				"<keyspace/shard|zk shard path> [<served type1>,<served type2>,...]",
-				"Sets a given shard's served types. Does not rebuild any serving graph."},
+				"[-force] [-rebuild] [-lock_wait_timeout=<duration>] [-try_lock] <keyspace/shard|zk shard path> [<served type1>,<served type2>,...]",
+				"Sets a given shard's served types. Removing master from a shard with a master needs -force. With -rebuild, also rebuilds the serving graph of the shard in each of its cells. The lock of the shard is waited for up to -lock_wait_timeout, or not at all with -try_lock."},
+			command{"SetShardTabletControl", commandSetShardTabletControl,
+				"[-cells=c1,c2,...] [-tables=t1,t2,...] [-disable_query_service] [-remove] <keyspace/shard|zk shard path> <tablet type>",
+				"Sets the blacklisted tables, or disables the query service, of the tablets of a type in a shard, in the given cells or all of them. With -remove, removes that control from the cells instead."},
+			command{"WaitForDrain", commandWaitForDrain,
+				"[-cells=c1,c2,...] [-timeout=<duration>] [-retry_delay=<duration>] [-dwell_time=<duration>] <keyspace/shard|zk shard path> <served type>",
+				"Waits until the tablets of a served type of a shard, in the given cells or all of them, serve no query anymore: their query count has to stay the same for -dwell_time. Use it after removing the type from the served types of the shard, before repurposing the tablets."},
+			command{"SourceShardAdd", commandSourceShardAdd,
+				"[-key_range=<keyrange>] [-tables=t1,t2,...] <keyspace/shard|zk shard path> <uid> <source keyspace/shard|zk shard path>",
+				"Adds the SourceShard record with the provided index. This is meant as an emergency function, to fix a shard left by a failed resharding. The master only picks it up on its next change."},
+			command{"SourceShardDelete", commandSourceShardDelete,
+				"<keyspace/shard|zk shard path> <uid>",
+				"Deletes the SourceShard record with the provided index. This is meant as an emergency cleanup function, to fix a shard left by a failed resharding. The master only picks it up on its next change."},
 			command{"ShardMultiRestore", commandShardMultiRestore,
 				"[-force] [-concurrency=4] [-fetch-concurrency=4] [-insert-table-concurrency=4] [-fetch-retry-count=3] [-strategy=] [-tables=<table1>,<table2>,...] <keyspace/shard|zk shard path> <source zk path>...",
 				"Restore multi-snapshots on all the tablets of a shard."},
@@ -160,12 +184,21 @@ var commands = []commandGroup{
 			command{"ShardReplicationFix", commandShardReplicationFix,
 				"<cell> <keyspace/shard|zk shard path>",
 				"Walks through a ShardReplication object and fixes the first error it encrounters"},
+			command{"AddShardCell", commandAddShardCell,
+				"<keyspace/shard|zk shard path> <cell>",
+				"Adds a known cell to the shard's Cells list, if it is not there yet."},
+			command{"SetShardCells", commandSetShardCells,
+				"[-force] <keyspace/shard|zk shard path> [<cell1>,<cell2>,...]",
+				"Sets the shard's Cells list. The cells must be known, and a cell can only be removed if the shard has no master nor tablets in its replication graph there. The replication and serving graphs of the shard in the removed cells are deleted, as RemoveShardCell does. With -force, a removed cell whose topology server is unreachable is removed anyway."},
 			command{"RemoveShardCell", commandRemoveShardCell,
-				"[-force] <keyspace/shard|zk shard path> <cell>",
-				"Removes the cell in the shard's Cells list."},
+				"[-force] [-dry_run] [-lock_wait_timeout=<duration>] [-try_lock] <keyspace/shard|zk shard path> <cell>",
+				"Removes the cell in the shard's Cells list, and deletes the replication and serving graphs of the shard in the cell. With force, an unreachable cell is removed anyway, and what is left there is logged. With -dry_run, only prints the changes to the topology that would be made. The lock of the shard is waited for up to -lock_wait_timeout, or not at all with -try_lock."},
+			command{"RemoveCellFromShards", commandRemoveCellFromShards,
+				"[-force] [-recursive] [-dry_run] [-concurrency=<n>] <keyspace|zk keyspace path> <cell> [all|<shard> ...]",
+				"Removes the cell in the Cells list of the given shards of the keyspace, or all of them. With -recursive, the tablets of the shards in the cell are deleted first. With -dry_run, only lists what would be done."},
 			command{"DeleteShard", commandDeleteShard,
-				"<keyspace/shard|zk shard path> ...",
-				"Deletes the given shard(s)"},
+				"[-skip_rebuild] [-force] [-recursive] [-even_if_serving] [-dry_run] <keyspace/shard|zk shard path> ...",
+				"Deletes the given shard(s), and rebuilds the keyspace graph in their cells. With -skip_rebuild, the keyspace graph still references the shard(s) until RebuildKeyspaceGraph is run. With -force, the shard(s) are deleted even if some of their cells are unreachable, and the objects left there are listed. With -recursive, their tablets are scrapped and deleted first, except the masters unless -even_if_serving is set. With -dry_run, only prints the changes to the topology that would be made."},
 		},
 	},
 	commandGroup{
@@ -176,6 +209,9 @@ var commands = []commandGroup{
 			command{"SetKeyspaceShardingInfo", commandSetKeyspaceShardingInfo,
 				"[-force] <keyspace name|zk keyspace path> [<column name>] [<column type>]",
 				"Updates the sharding info for a keyspace"},
+			command{"DeleteKeyspace", commandDeleteKeyspace,
+				"[-recursive] [-even_if_serving] [-force] [-dry_run] <keyspace name|zk keyspace path>",
+				"Deletes the given keyspace: its shards, its serving graph in each cell, and its record. It does nothing if a shard still has tablets, unless -recursive is set: they are then scrapped and deleted, except the masters unless -even_if_serving is set. It stops at the first shard or cell that fails, unless -force is set. Prints what was deleted and what wasn't. With -dry_run, only prints the changes to the topology that would be made."},
 			command{"RebuildKeyspaceGraph", commandRebuildKeyspaceGraph,
 				"[-cells=a,b] <zk keyspace path> ... (/zk/global/vt/keyspaces/<keyspace>)",
 				"Rebuild the serving data for all shards in this keyspace. This may trigger an update to all connected clients."},
@@ -184,7 +220,7 @@ var commands = []commandGroup{
 				"Validate all nodes reachable from this keyspace are consistent."},
 			command{"MigrateServedTypes", commandMigrateServedTypes,
 				"[-reverse] <source keyspace/shard|zk source shard path> <served type>",
-				"Migrates a serving type from the source shard to the shards it replicates to. Will also rebuild the serving graph."},
+				"Migrates a serving type from the source shard to the shards it replicates to, which must cover its key range. Will also rebuild the serving graph in the cells of the shards. After a partial failure, run it again to finish the migration."},
 			command{"MigrateServedFrom", commandMigrateServedFrom,
 				"[-reverse] <destination keyspace/shard|zk destination shard path> <served type>",
 				"Makes the destination keyspace/shard serve the given type. Will also rebuild the serving graph."},
@@ -236,8 +272,11 @@ var commands = []commandGroup{
 				"[-force] {-sql=<sql> || -sql-file=<filename>} [-simple] [-new-parent=<zk tablet path>] <keyspace/shard|zk shard path>",
 				"Apply the schema change to the specified shard. If simple is specified, we just apply on the live master. Otherwise we will need to do the shell game. So we will apply the schema change to every single slave. if new_parent is set, we will also reparent (otherwise the master won't be touched at all). Using the force flag will cause a bunch of checks to be ignored, use with care."},
 			command{"ApplySchemaKeyspace", commandApplySchemaKeyspace,
-				"[-force] {-sql=<sql> || -sql-file=<filename>} [-simple] <keyspace|zk keyspace path>",
-				"Apply the schema change to the specified keyspace. If simple is specified, we just apply on the live masters. Otherwise we will need to do the shell game on each shard. So we will apply the schema change to every single slave (running in parallel on all shards, but on one host at a time in a given shard). We will not reparent at the end, so the masters won't be touched at all. Using the force flag will cause a bunch of checks to be ignored, use with care."},
+				"[-force] {-sql=<sql> || -sql-file=<filename>} [-simple] [-wait_slave_timeout=<duration>] [-dry-run] <keyspace|zk keyspace path>",
+				"Apply the schema change to the specified keyspace. If simple is specified, we just apply on the live masters, and wait up to wait_slave_timeout for their slaves to replicate it. Otherwise we will need to do the shell game on each shard. So we will apply the schema change to every single slave (one host at a time in a given shard). We will not reparent at the end, so the masters won't be touched at all. The shards are changed -apply_schema_keyspace_concurrency at a time, and no other shard is started after a failure. The shards that already have the change are skipped, so a partial change can be retried. With dry-run, only the checks run. Using the force flag will cause a bunch of checks to be ignored, use with care."},
+			command{"CopySchemaShard", commandCopySchemaShard,
+				"[-tables=<table1>,<table2>,...] [-exclude_tables=<table1>,<table2>,...] [-include-views] [-wait_slaves] <source tablet alias|zk tablet path> <destination keyspace/shard|zk shard path>",
+				"Copies the schema of the source tablet to the master of the destination shard. The tables the master already has with the same schema are skipped, the copy fails if one has a different schema. With -wait_slaves, waits for the slaves of the shard to replicate it."},
 
 			command{"ValidateVersionShard", commandValidateVersionShard,
 				"<keyspace/shard|zk shard path>",
@@ -354,15 +393,24 @@ func fmtAction(action *actionnode.ActionNode) string {
 	if action.State == actionnode.ACTION_STATE_QUEUED {
 		state = "queued"
 	}
-	return fmt.Sprintf("%v %v %v %v %v", action.Path, action.Action, state, action.ActionGuid, action.Error)
+	return fmt.Sprintf("%v %v %v %v %v %v", action.Path, action.Action, state, action.ActionGuid, action.Initiator(), action.Error)
 }
 
 func listTabletsByShard(ts topo.Server, keyspace, shard string) error {
-	tabletAliases, err := topo.FindAllTabletAliasesInShard(ts, keyspace, shard)
+	tablets, cellErrors, err := wrangler.ListShardTablets(ts, keyspace, shard)
 	if err != nil {
 		return err
 	}
-	return dumpTablets(ts, tabletAliases)
+	for _, ti := range tablets {
+		fmt.Println(fmtTabletAwkable(ti))
+	}
+	if len(cellErrors) > 0 {
+		for _, cellError := range cellErrors {
+			log.Errorf("%v", cellError)
+		}
+		return fmt.Errorf("the tablets of %v cell(s) could not all be listed", len(cellErrors))
+	}
+	return nil
 }
 
 func dumpAllTablets(ts topo.Server, zkVtPath string) error {
@@ -491,13 +539,13 @@ func shardParamToKeyspaceShard(param string) (string, string) {
 		if len(zkPathParts) != 8 || zkPathParts[0] != "" || zkPathParts[1] != "zk" || zkPathParts[2] != "global" || zkPathParts[3] != "vt" || zkPathParts[4] != "keyspaces" || zkPathParts[6] != "shards" {
 			log.Fatalf("Invalid shard path: %v", param)
 		}
-		return zkPathParts[5], zkPathParts[7]
+		return zkPathParts[5], topo.CanonicalShardName(zkPathParts[7])
 	}
 	zkPathParts := strings.Split(param, "/")
 	if len(zkPathParts) != 2 {
 		log.Fatalf("Invalid shard path: %v", param)
 	}
-	return zkPathParts[0], zkPathParts[1]
+	return zkPathParts[0], topo.CanonicalShardName(zkPathParts[1])
 }
 
 // shardParamsToKeyspaceShards builds a list of keyspace/shard pairs.
@@ -985,21 +1033,15 @@ func commandExecuteHook(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []st
 }
 
 func commandCreateShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
-	force := subFlags.Bool("force", false, "will keep going even if the keyspace already exists")
-	parent := subFlags.Bool("parent", false, "creates the parent keyspace if it doesn't exist")
+	force := subFlags.Bool("force", false, "will keep going even if the shard already exists, or overlaps other shards")
+	subFlags.Bool("parent", false, "ignored, the parent keyspace is always created if it doesn't exist")
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
 		log.Fatalf("action CreateShard requires <keyspace/shard|zk shard path>")
 	}
 
 	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
-	if *parent {
-		if err := wr.TopoServer().CreateKeyspace(keyspace, &topo.Keyspace{}); err != nil && err != topo.ErrNodeExists {
-			return "", err
-		}
-	}
-
-	err := topo.CreateShard(wr.TopoServer(), keyspace, shard)
+	err := wr.CreateShard(keyspace, shard, *force)
 	if *force && err == topo.ErrNodeExists {
 		log.Infof("shard %v/%v already exists (ignoring error with -force)", keyspace, shard)
 		err = nil
@@ -1042,6 +1084,26 @@ func commandRebuildShardGraph(wr *wrangler.Wrangler, subFlags *flag.FlagSet, arg
 	return "", nil
 }
 
+func commandRefreshShardMasterServing(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 {
+		log.Fatalf("action RefreshShardMasterServing requires <keyspace/shard|zk shard path>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	results, err := wr.RefreshShardMasterServing(keyspace, shard)
+	for _, result := range results {
+		switch {
+		case result.Error != nil:
+			fmt.Printf("%v: failed: %v\n", result.Cell, result.Error)
+		case result.Updated:
+			fmt.Printf("%v: updated\n", result.Cell)
+		default:
+			fmt.Printf("%v: master not served\n", result.Cell)
+		}
+	}
+	return "", err
+}
+
 func commandShardExternallyReparented(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	scrapStragglers := subFlags.Bool("scrap-stragglers", false, "will scrap the hosts that haven't been reparented")
 	continueOnUnexpectedMaster := subFlags.Bool("continue_on_unexpected_master", false, "if a slave has the wrong master, we'll just log the error and keep going")
@@ -1064,7 +1126,11 @@ func commandValidateShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []
 	}
 
 	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
-	return "", wr.ValidateShard(keyspace, shard, *pingTablets)
+	sv, err := wr.ValidateShard(keyspace, shard, *pingTablets)
+	if sv != nil {
+		fmt.Println(sv)
+	}
+	return "", err
 }
 
 func commandShardReplicationPositions(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
@@ -1094,6 +1160,65 @@ func commandShardReplicationPositions(wr *wrangler.Wrangler, subFlags *flag.Flag
 	return "", nil
 }
 
+func commandWaitForShardLockRelease(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	timeout := subFlags.Duration("timeout", 30*time.Second, "how long to wait for")
+	action := subFlags.String("action", "", "only wait for the actions with this name, e.g. MigrateServedTypes")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 {
+		log.Fatalf("action WaitForShardLockRelease requires <keyspace/shard|zk shard path>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	var err error
+	if *action == "" {
+		err = wr.WaitForShardLockRelease(keyspace, shard, *timeout)
+	} else {
+		err = wr.WaitForShardAction(keyspace, shard, *action, *timeout)
+	}
+	if lockedErr, ok := err.(*wrangler.ShardLockedError); ok {
+		fmt.Print(lockedErr.Node.ToJson())
+	}
+	return "", err
+}
+
+func commandGetShardLockHolders(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 {
+		log.Fatalf("action GetShardLockHolders requires <keyspace/shard|zk shard path>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	holders, err := wr.GetShardLockHolders(keyspace, shard)
+	if err != nil {
+		return "", err
+	}
+	for i, holder := range holders {
+		state := "waiting"
+		if i == 0 {
+			state = "holding"
+		}
+		since := "unknown"
+		if holder.LockTime != 0 {
+			since = time.Unix(holder.LockTime, 0).Format(time.RFC3339)
+		}
+		fmt.Printf("%v %v (%v) of %v since %v\n", state, holder.Action, holder.ActionGuid, holder.Initiator(), since)
+	}
+	return "", nil
+}
+
+func commandForceUnlockShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	action := subFlags.String("action", "", "only break the lock of an action with this name, e.g. MigrateServedTypes")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 {
+		log.Fatalf("action ForceUnlockShard requires <keyspace/shard|zk shard path>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	holder, err := wr.ForceUnlockShard(keyspace, shard, *action)
+	if err != nil {
+		return "", err
+	}
+	fmt.Print(holder.ToJson())
+	return "", nil
+}
+
 func commandListShardTablets(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
@@ -1104,6 +1229,10 @@ func commandListShardTablets(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args
 }
 
 func commandSetShardServedTypes(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	force := subFlags.Bool("force", false, "remove master from the served types even if the shard has a master")
+	rebuild := subFlags.Bool("rebuild", false, "rebuild the serving graph of the shard in each of its cells")
+	lockWaitTimeout := subFlags.Duration("lock_wait_timeout", 0, "time to wait for the lock of the shard, 0 for the -lock-wait-timeout of vtctl")
+	tryLock := subFlags.Bool("try_lock", false, "fail right away if another action holds the lock of the shard")
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 && subFlags.NArg() != 2 {
 		log.Fatalf("action SetShardServedTypes requires <keyspace/shard|zk shard path> [<served type1>,<served type2>,...]")
@@ -1118,7 +1247,93 @@ func commandSetShardServedTypes(wr *wrangler.Wrangler, subFlags *flag.FlagSet, a
 		}
 	}
 
-	return "", wr.SetShardServedTypes(keyspace, shard, servedTypes)
+	lockOptions := &wrangler.ShardLockOptions{Timeout: *lockWaitTimeout, TryLock: *tryLock}
+	return "", wr.SetShardServedTypes(keyspace, shard, servedTypes, *force, *rebuild, lockOptions)
+}
+
+func commandWaitForDrain(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	cells := subFlags.String("cells", "", "comma separated list of cells to wait for, all of them if empty")
+	timeout := subFlags.Duration("timeout", 10*time.Minute, "how long to wait for the tablets to drain")
+	retryDelay := subFlags.Duration("retry_delay", 5*time.Second, "how often to read the query count of the tablets")
+	dwellTime := subFlags.Duration("dwell_time", time.Minute, "how long the query count of each tablet has to stay the same")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 2 {
+		log.Fatalf("action WaitForDrain requires <keyspace/shard|zk shard path> <served type>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	servedType := parseTabletType(subFlags.Arg(1), []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_RDONLY})
+
+	var cellArray []string
+	if *cells != "" {
+		cellArray = strings.Split(*cells, ",")
+	}
+	return "", wr.WaitForDrain(keyspace, shard, servedType, cellArray, *timeout, *retryDelay, *dwellTime)
+}
+
+func commandSetShardTabletControl(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	cells := subFlags.String("cells", "", "comma separated list of cells to update, all of them if empty")
+	tables := subFlags.String("tables", "", "comma separated list of tables not to serve")
+	disableQueryService := subFlags.Bool("disable_query_service", false, "disable the query service of the tablets")
+	remove := subFlags.Bool("remove", false, "remove the control from the cells")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 2 {
+		log.Fatalf("action SetShardTabletControl requires <keyspace/shard|zk shard path> <tablet type>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	tabletType := parseTabletType(subFlags.Arg(1), []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_RDONLY})
+
+	var cellArray []string
+	if *cells != "" {
+		cellArray = strings.Split(*cells, ",")
+	}
+	var tableArray []string
+	if *tables != "" {
+		tableArray = strings.Split(*tables, ",")
+	}
+	return "", wr.SetShardTabletControl(keyspace, shard, tabletType, cellArray, *remove, *disableQueryService, tableArray)
+}
+
+func commandSourceShardAdd(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	keyRange := subFlags.String("key_range", "", "key range to use for the SourceShard, like 80-c0")
+	tables := subFlags.String("tables", "", "comma separated list of tables to replicate (used for vertical split)")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 3 {
+		log.Fatalf("action SourceShardAdd requires <keyspace/shard|zk shard path> <uid> <source keyspace/shard|zk shard path>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	uid, err := strconv.ParseUint(subFlags.Arg(1), 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("bad uid %v: %v", subFlags.Arg(1), err)
+	}
+	sourceKeyspace, sourceShard := shardParamToKeyspaceShard(subFlags.Arg(2))
+	var tableArray []string
+	if *tables != "" {
+		tableArray = strings.Split(*tables, ",")
+	}
+	var kr key.KeyRange
+	if *keyRange != "" {
+		parts := strings.Split(*keyRange, "-")
+		if len(parts) != 2 {
+			return "", fmt.Errorf("bad key range %v, want <start>-<end>", *keyRange)
+		}
+		if kr, err = key.ParseKeyRangeParts(parts[0], parts[1]); err != nil {
+			return "", err
+		}
+	}
+	return "", wr.SourceShardAdd(keyspace, shard, uint32(uid), sourceKeyspace, sourceShard, kr, tableArray)
+}
+
+func commandSourceShardDelete(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	subFlags.Parse(args)
+	if subFlags.NArg() != 2 {
+		log.Fatalf("action SourceShardDelete requires <keyspace/shard|zk shard path> <uid>")
+	}
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	uid, err := strconv.ParseUint(subFlags.Arg(1), 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("bad uid %v: %v", subFlags.Arg(1), err)
+	}
+	return "", wr.SourceShardDelete(keyspace, shard, uint32(uid))
 }
 
 func commandShardMultiRestore(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (status string, err error) {
@@ -1180,26 +1395,100 @@ func commandShardReplicationFix(wr *wrangler.Wrangler, subFlags *flag.FlagSet, a
 	return "", topo.FixShardReplication(wr.TopoServer(), cell, keyspace, shard)
 }
 
+func commandAddShardCell(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	subFlags.Parse(args)
+	if subFlags.NArg() != 2 {
+		log.Fatalf("action AddShardCell requires <keyspace/shard|zk shard path> <cell>")
+	}
+
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	return "", wr.AddShardCell(keyspace, shard, subFlags.Arg(1))
+}
+
+func commandSetShardCells(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	force := subFlags.Bool("force", false, "will keep going even we can't reach the topology server of a removed cell to check for tablets")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 && subFlags.NArg() != 2 {
+		log.Fatalf("action SetShardCells requires <keyspace/shard|zk shard path> [<cell1>,<cell2>,...]")
+	}
+
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
+	var cells []string
+	if subFlags.NArg() == 2 && subFlags.Arg(1) != "" {
+		cells = strings.Split(subFlags.Arg(1), ",")
+	}
+	return "", wr.SetShardCells(keyspace, shard, cells, *force)
+}
+
 func commandRemoveShardCell(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (status string, err error) {
 	force := subFlags.Bool("force", false, "will keep going even we can't reach the cell's topology server to check for tablets")
+	dryRun := subFlags.Bool("dry_run", false, "only print the changes to the topology that would be made")
+	lockWaitTimeout := subFlags.Duration("lock_wait_timeout", 0, "time to wait for the lock of the shard, 0 for the -lock-wait-timeout of vtctl")
+	tryLock := subFlags.Bool("try_lock", false, "fail right away if another action holds the lock of the shard")
 	subFlags.Parse(args)
 	if subFlags.NArg() != 2 {
 		log.Fatalf("action RemoveShardCell requires <keyspace/shard|zk shard path> <cell>")
 	}
 
 	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(0))
-	return "", wr.RemoveShardCell(keyspace, shard, subFlags.Arg(1), *force)
+	lockOptions := &wrangler.ShardLockOptions{Timeout: *lockWaitTimeout, TryLock: *tryLock}
+	if *dryRun {
+		dry, plan := wr.DryRun()
+		err := dry.RemoveShardCell(keyspace, shard, subFlags.Arg(1), *force, lockOptions)
+		fmt.Println(plan.String())
+		return "", err
+	}
+	return "", wr.RemoveShardCell(keyspace, shard, subFlags.Arg(1), *force, lockOptions)
+}
+
+func commandRemoveCellFromShards(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (status string, err error) {
+	force := subFlags.Bool("force", false, "will keep going even we can't reach the cell's topology server to check for tablets")
+	recursive := subFlags.Bool("recursive", false, "scraps and deletes the tablets of the shards in the cell")
+	dryRun := subFlags.Bool("dry_run", false, "only lists the shards that would be updated, and what blocks the others")
+	concurrency := subFlags.Int("concurrency", 8, "how many shards to update simultaneously")
+	subFlags.Parse(args)
+	if subFlags.NArg() < 2 {
+		log.Fatalf("action RemoveCellFromShards requires <keyspace|zk keyspace path> <cell> [all|<shard> ...]")
+	}
+
+	keyspace := keyspaceParamToKeyspace(subFlags.Arg(0))
+	results, err := wr.RemoveCellFromShards(keyspace, subFlags.Arg(1), subFlags.Args()[2:], *force, *recursive, *dryRun, *concurrency)
+	for _, result := range results {
+		fmt.Println(result.String())
+	}
+	return "", err
 }
 
 func commandDeleteShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (status string, err error) {
+	skipRebuild := subFlags.Bool("skip_rebuild", false, "do not rebuild the keyspace graph after deleting the shard(s)")
+	force := subFlags.Bool("force", false, "delete the shard(s) even if some of their cells are unreachable")
+	recursive := subFlags.Bool("recursive", false, "scrap and delete the tablets of the shard(s) first")
+	evenIfServing := subFlags.Bool("even_if_serving", false, "with -recursive, delete the master tablets too")
+	dryRun := subFlags.Bool("dry_run", false, "only print the changes to the topology that would be made")
 	subFlags.Parse(args)
 	if subFlags.NArg() == 0 {
 		log.Fatalf("action DeleteShard requires <keyspace/shard|zk shard path> ...")
 	}
 
 	keyspaceShards := shardParamsToKeyspaceShards(wr, subFlags.Args())
+	var plan *wrangler.DryRunPlan
+	if *dryRun {
+		wr, plan = wr.DryRun()
+		defer func() {
+			fmt.Println(plan.String())
+		}()
+	}
+	options := wrangler.DeleteShardOptions{
+		RebuildKeyspace: !*skipRebuild,
+		Force:           *force,
+		Recursive:       *recursive,
+		EvenIfServing:   *evenIfServing,
+	}
 	for _, ks := range keyspaceShards {
-		err := wr.DeleteShard(ks.Keyspace, ks.Shard)
+		skipped, err := wr.DeleteShard(ks.Keyspace, ks.Shard, options)
+		for _, ssc := range skipped {
+			fmt.Printf("%v/%v: unreachable cell %v\n", ks.Keyspace, ks.Shard, ssc)
+		}
 		switch err {
 		case nil:
 			// keep going
@@ -1273,6 +1562,30 @@ func commandSetKeyspaceShardingInfo(wr *wrangler.Wrangler, subFlags *flag.FlagSe
 	return "", wr.SetKeyspaceShardingInfo(keyspace, columnName, kit, *force)
 }
 
+func commandDeleteKeyspace(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	recursive := subFlags.Bool("recursive", false, "scrap and delete the tablets of the shards first")
+	evenIfServing := subFlags.Bool("even_if_serving", false, "with -recursive, delete the master tablets too")
+	force := subFlags.Bool("force", false, "keep going when a shard or a cell fails, and delete the keyspace anyway")
+	dryRun := subFlags.Bool("dry_run", false, "only print the changes to the topology that would be made")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 1 {
+		log.Fatalf("action DeleteKeyspace requires <keyspace name|zk keyspace path>")
+	}
+
+	keyspace := keyspaceParamToKeyspace(subFlags.Arg(0))
+	if *dryRun {
+		dry, plan := wr.DryRun()
+		_, err := dry.DeleteKeyspace(keyspace, *recursive, *evenIfServing, *force)
+		fmt.Println(plan.String())
+		return "", err
+	}
+	result, err := wr.DeleteKeyspace(keyspace, *recursive, *evenIfServing, *force)
+	if result != nil {
+		fmt.Println(result.String())
+	}
+	return "", err
+}
+
 func commandRebuildKeyspaceGraph(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	cells := subFlags.String("cells", "", "comma separated list of cells to update")
 	subFlags.Parse(args)
@@ -1562,6 +1875,8 @@ func commandApplySchemaKeyspace(wr *wrangler.Wrangler, subFlags *flag.FlagSet, a
 	sql := subFlags.String("sql", "", "sql command")
 	sqlFile := subFlags.String("sql-file", "", "file containing the sql commands")
 	simple := subFlags.Bool("simple", false, "just apply change on master and let replication do the rest")
+	dryRun := subFlags.Bool("dry-run", false, "only check the change can be applied to all shards")
+	waitSlaveTimeout := subFlags.Duration("wait_slave_timeout", 0, "with -simple, time to wait for the slaves to replicate the change, 0 not to wait")
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
 		log.Fatalf("action ApplySchemaKeyspace requires <keyspace|zk keyspace path>")
@@ -1569,13 +1884,35 @@ func commandApplySchemaKeyspace(wr *wrangler.Wrangler, subFlags *flag.FlagSet, a
 
 	keyspace := keyspaceParamToKeyspace(subFlags.Arg(0))
 	change := getFileParam(*sql, *sqlFile, "sql")
-	scr, err := wr.ApplySchemaKeyspace(keyspace, change, *simple, *force)
-	if err == nil {
-		log.Infof(scr.String())
+	result, err := wr.ApplySchemaKeyspace(keyspace, change, *simple, *force, *dryRun, *waitSlaveTimeout)
+	if result != nil {
+		log.Infof("%v", result)
 	}
 	return "", err
 }
 
+func commandCopySchemaShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
+	tables := subFlags.String("tables", "", "comma separated tables to copy, all of them if empty")
+	excludeTables := subFlags.String("exclude_tables", "", "comma separated tables not to copy")
+	includeViews := subFlags.Bool("include-views", false, "copy the views too")
+	waitSlaves := subFlags.Bool("wait_slaves", false, "wait for the slaves of the destination shard to replicate the schema")
+	subFlags.Parse(args)
+	if subFlags.NArg() != 2 {
+		log.Fatalf("action CopySchemaShard requires <source tablet alias|zk tablet path> <destination keyspace/shard|zk shard path>")
+	}
+	tabletAlias := tabletParamToTabletAlias(subFlags.Arg(0))
+	keyspace, shard := shardParamToKeyspaceShard(subFlags.Arg(1))
+	var tableArray, excludeTableArray []string
+	if *tables != "" {
+		tableArray = strings.Split(*tables, ",")
+	}
+	if *excludeTables != "" {
+		excludeTableArray = strings.Split(*excludeTables, ",")
+	}
+
+	return "", wr.CopySchemaShard(tabletAlias, tableArray, excludeTableArray, *includeViews, keyspace, shard, *waitSlaves)
+}
+
 func commandValidateVersionShard(wr *wrangler.Wrangler, subFlags *flag.FlagSet, args []string) (string, error) {
 	subFlags.Parse(args)
 	if subFlags.NArg() != 1 {
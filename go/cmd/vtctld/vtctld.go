@@ -374,7 +374,11 @@ func main() {
 	// shard actions
 	actionRepo.RegisterShardAction("ValidateShard",
 		func(wr *wrangler.Wrangler, keyspace, shard string, r *http.Request) (string, error) {
-			return "", wr.ValidateShard(keyspace, shard, false)
+			sv, err := wr.ValidateShard(keyspace, shard, false)
+			if sv == nil {
+				return "", err
+			}
+			return sv.String(), err
 		})
 
 	actionRepo.RegisterShardAction("ValidateSchemaShard",
@@ -6,6 +6,7 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"time"
 
 	"github.com/youtube/vitess/go/vt/servenv"
@@ -34,6 +35,7 @@ func main() {
 	defer topo.CloseServers()
 
 	rts := vtgate.NewResilientSrvTopoServer(ts)
+	http.Handle("/debug/srv_topo_cache", rts)
 
 	topoReader = NewTopoReader(rts)
 	topo.RegisterTopoReader(topoReader)
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/worker"
 	"github.com/youtube/vitess/go/vt/wrangler"
 )
@@ -71,13 +72,13 @@ func shardParamToKeyspaceShard(param string) (string, string) {
 		if len(zkPathParts) != 8 || zkPathParts[0] != "" || zkPathParts[1] != "zk" || zkPathParts[2] != "global" || zkPathParts[3] != "vt" || zkPathParts[4] != "keyspaces" || zkPathParts[6] != "shards" {
 			log.Fatalf("Invalid shard path: %v", param)
 		}
-		return zkPathParts[5], zkPathParts[7]
+		return zkPathParts[5], topo.CanonicalShardName(zkPathParts[7])
 	}
 	zkPathParts := strings.Split(param, "/")
 	if len(zkPathParts) != 2 {
 		log.Fatalf("Invalid shard path: %v", param)
 	}
-	return zkPathParts[0], zkPathParts[1]
+	return zkPathParts[0], topo.CanonicalShardName(zkPathParts[1])
 }
 
 func commandWorker(wr *wrangler.Wrangler, args []string) worker.Worker {
@@ -0,0 +1,179 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"unsafe"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// DefaultArenaChunkSize is the size in bytes of the buffers of an Arena
+// created with a chunk size of 0.
+const DefaultArenaChunkSize = 64 * 1024
+
+var valueSize = int(unsafe.Sizeof(sqltypes.Value{}))
+
+// Arena stores the cell bytes and the rows of a query result in a
+// small number of large buffers, instead of allocating them one by one.
+// There is no explicit release: a buffer is garbage collected when no
+// value of the result references it anymore. This means a single
+// retained cell keeps its whole buffer alive, so an Arena should only
+// be used for results that are discarded as a whole.
+// An Arena is not safe for concurrent use.
+type Arena struct {
+	chunkSize int
+	bytes     []byte
+	values    []sqltypes.Value
+
+	// row is the scratch space used to decode a row, before its
+	// size is known.
+	row []sqltypes.Value
+}
+
+// NewArena returns an Arena that allocates buffers of chunkSize bytes,
+// or DefaultArenaChunkSize if chunkSize is 0.
+func NewArena(chunkSize int) *Arena {
+	if chunkSize <= 0 {
+		chunkSize = DefaultArenaChunkSize
+	}
+	return &Arena{chunkSize: chunkSize}
+}
+
+// Bytes returns a copy of b stored in the arena. Values larger than a
+// quarter of a chunk get their own buffer, so they don't waste the end
+// of the current one.
+func (a *Arena) Bytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	if len(b) == 0 {
+		return []byte{}
+	}
+	if len(b) > a.chunkSize/4 {
+		result := make([]byte, len(b))
+		copy(result, b)
+		return result
+	}
+	if len(b) > cap(a.bytes)-len(a.bytes) {
+		a.bytes = make([]byte, 0, a.chunkSize)
+	}
+	start := len(a.bytes)
+	a.bytes = append(a.bytes, b...)
+	return a.bytes[start:len(a.bytes):len(a.bytes)]
+}
+
+// Row returns a row of n NULL values stored in the arena.
+func (a *Arena) Row(n int) []sqltypes.Value {
+	perChunk := a.chunkSize / valueSize
+	if n > perChunk/4 {
+		return make([]sqltypes.Value, n)
+	}
+	if n > cap(a.values)-len(a.values) {
+		a.values = make([]sqltypes.Value, 0, perChunk)
+	}
+	start := len(a.values)
+	a.values = a.values[:start+n]
+	return a.values[start : start+n : start+n]
+}
+
+// Value returns a copy of v whose bytes are stored in the arena.
+func (a *Arena) Value(v sqltypes.Value) sqltypes.Value {
+	switch inner := v.Inner.(type) {
+	case sqltypes.Numeric:
+		return sqltypes.MakeNumeric(a.Bytes(inner))
+	case sqltypes.Fractional:
+		return sqltypes.MakeFractional(a.Bytes(inner))
+	case sqltypes.String:
+		return sqltypes.MakeString(a.Bytes(inner))
+	}
+	return v
+}
+
+// CopyRows returns a deep copy of rows stored in the arena.
+func (a *Arena) CopyRows(rows [][]sqltypes.Value) [][]sqltypes.Value {
+	if rows == nil {
+		return nil
+	}
+	result := make([][]sqltypes.Value, len(rows))
+	for i, row := range rows {
+		if row == nil {
+			continue
+		}
+		result[i] = a.Row(len(row))
+		for j, v := range row {
+			result[i][j] = a.Value(v)
+		}
+	}
+	return result
+}
+
+// ArenaQueryResult is a QueryResult that decodes its rows into an
+// Arena. The cell bytes are copied out of the BSON buffer, so it
+// can be released once the result is decoded. Use it for results that
+// are discarded as a whole, see Arena.
+type ArenaQueryResult struct {
+	QueryResult
+}
+
+func (aqr *ArenaQueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	aqr.QueryResult.unmarshalBson(buf, kind, NewArena(0))
+}
+
+// DecodeRowsBsonArena is like DecodeRowsBson, but stores the rows in arena.
+func DecodeRowsBsonArena(buf *bytes.Buffer, kind byte, arena *Arena) [][]sqltypes.Value {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for Query.Rows", kind))
+	}
+
+	rows := make([][]sqltypes.Value, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		bson.SkipIndex(buf)
+		rows = append(rows, decodeRowBsonArena(buf, kind, arena))
+		kind = bson.NextByte(buf)
+	}
+	return rows
+}
+
+func decodeRowBsonArena(buf *bytes.Buffer, kind byte, arena *Arena) []sqltypes.Value {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for Query.Row", kind))
+	}
+
+	bson.ReadDocumentLength(buf)
+	scratch := arena.row[:0]
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		bson.SkipIndex(buf)
+		if kind != bson.Null {
+			scratch = append(scratch, sqltypes.MakeString(arena.Bytes(bson.DecodeBinary(buf, kind))))
+		} else {
+			scratch = append(scratch, sqltypes.Value{})
+		}
+		kind = bson.NextByte(buf)
+	}
+	row := arena.Row(len(scratch))
+	copy(row, scratch)
+	// clear the scratch space, so it doesn't keep the values alive
+	for i := range scratch {
+		scratch[i] = sqltypes.Value{}
+	}
+	arena.row = scratch
+	return row
+}
@@ -0,0 +1,166 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestArenaBytes(t *testing.T) {
+	arena := NewArena(64)
+	if b := arena.Bytes(nil); b != nil {
+		t.Errorf("Bytes(nil): %v, want nil", b)
+	}
+	if b := arena.Bytes([]byte{}); b == nil || len(b) != 0 {
+		t.Errorf("Bytes(empty): %#v, want empty", b)
+	}
+
+	in := [][]byte{[]byte("abc"), []byte("defgh"), bytes.Repeat([]byte("x"), 30), []byte("ij")}
+	var out [][]byte
+	for _, b := range in {
+		out = append(out, arena.Bytes(b))
+	}
+	for i := range in {
+		if !bytes.Equal(in[i], out[i]) {
+			t.Errorf("Bytes(%q): %q", in[i], out[i])
+		}
+		if &in[i][0] == &out[i][0] {
+			t.Errorf("Bytes(%q) was not copied", in[i])
+		}
+	}
+	// appending to a value doesn't overwrite the next one
+	_ = append(out[0], 'z')
+	if string(out[1]) != "defgh" {
+		t.Errorf("append overwrote the next value: %q", out[1])
+	}
+}
+
+func TestArenaRow(t *testing.T) {
+	arena := NewArena(256)
+	rows := [][]sqltypes.Value{arena.Row(3), arena.Row(2), arena.Row(100)}
+	for i, n := range []int{3, 2, 100} {
+		if len(rows[i]) != n || cap(rows[i]) != n {
+			t.Errorf("Row(%v): len %v cap %v", n, len(rows[i]), cap(rows[i]))
+		}
+	}
+	rows[0] = append(rows[0], sqltypes.MakeString([]byte("a")))
+	if !rows[1][0].IsNull() {
+		t.Errorf("append overwrote the next row: %v", rows[1][0])
+	}
+}
+
+func TestArenaCopyRows(t *testing.T) {
+	rows := [][]sqltypes.Value{
+		{sqltypes.MakeString([]byte("abcd")), sqltypes.MakeNumeric([]byte("1234")), sqltypes.MakeFractional([]byte("1.234")), sqltypes.Value{}},
+		nil,
+		{sqltypes.MakeString([]byte(""))},
+	}
+	got := NewArena(0).CopyRows(rows)
+	if !reflect.DeepEqual(got, rows) {
+		t.Errorf("CopyRows: %v, want %v", got, rows)
+	}
+	rows[0][0].Inner.(sqltypes.String)[0] = 'x'
+	if got[0][0].String() != "abcd" {
+		t.Errorf("CopyRows didn't copy the bytes: %v", got[0][0])
+	}
+	if got := NewArena(0).CopyRows(nil); got != nil {
+		t.Errorf("CopyRows(nil): %v", got)
+	}
+}
+
+func TestArenaQueryResult(t *testing.T) {
+	for _, tc := range testcases {
+		encoded, err := bson.Marshal(&tc.qr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// want is decoded from a copy, as it references its buffer
+		var want QueryResult
+		if err := bson.Unmarshal(append([]byte(nil), encoded...), &want); err != nil {
+			t.Fatal(err)
+		}
+		var got ArenaQueryResult
+		if err := bson.Unmarshal(encoded, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.QueryResult, want) {
+			t.Errorf("ArenaQueryResult:\n%#v, want\n%#v", got.QueryResult, want)
+		}
+
+		// the cells don't reference the BSON buffer
+		for i := range encoded {
+			encoded[i] = 0
+		}
+		if !reflect.DeepEqual(got.QueryResult.Rows, want.Rows) {
+			t.Errorf("ArenaQueryResult references the BSON buffer: %v", got.QueryResult.Rows)
+		}
+	}
+}
+
+// The benchmarks below use 1M cells: 100000 rows of 10 numbers.
+
+func BenchmarkDecodeRows(b *testing.B) {
+	encoded := bsonRows(intRows(100000, 10))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(encoded)
+		bson.Next(buf, 4)
+		kind := bson.NextByte(buf)
+		bson.ReadCString(buf)
+		DecodeRowsBson(buf, kind)
+	}
+}
+
+func BenchmarkDecodeRowsArena(b *testing.B) {
+	encoded := bsonRows(intRows(100000, 10))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(encoded)
+		bson.Next(buf, 4)
+		kind := bson.NextByte(buf)
+		bson.ReadCString(buf)
+		DecodeRowsBsonArena(buf, kind, NewArena(0))
+	}
+}
+
+// copyRows copies rows one allocation at a time, as the results
+// were copied before Arena.CopyRows.
+func copyRows(rows [][]sqltypes.Value) [][]sqltypes.Value {
+	result := make([][]sqltypes.Value, len(rows))
+	for i, row := range rows {
+		result[i] = make([]sqltypes.Value, len(row))
+		for j, v := range row {
+			b := make([]byte, len(v.Raw()))
+			copy(b, v.Raw())
+			result[i][j] = sqltypes.MakeString(b)
+		}
+	}
+	return result
+}
+
+func BenchmarkCopyRows(b *testing.B) {
+	rows := intRows(100000, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyRows(rows)
+	}
+}
+
+func BenchmarkCopyRowsArena(b *testing.B) {
+	rows := intRows(100000, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewArena(0).CopyRows(rows)
+	}
+}
@@ -6,9 +6,11 @@ package proto
 
 import (
 	"bytes"
+	"strconv"
 
 	"github.com/youtube/vitess/go/bson"
 	"github.com/youtube/vitess/go/bytes2"
+	"github.com/youtube/vitess/go/hack"
 	"github.com/youtube/vitess/go/sqltypes"
 )
 
@@ -18,13 +20,16 @@ func MarshalFieldBson(field Field, key string, buf *bytes2.ChunkedWriter) {
 
 	bson.EncodeString(buf, "Name", field.Name)
 	bson.EncodeInt64(buf, "Type", field.Type)
+	if field.Flags != 0 {
+		bson.EncodeInt64(buf, "Flags", field.Flags)
+	}
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
 func UnmarshalFieldBson(field *Field, buf *bytes.Buffer) {
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind := bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -34,6 +39,8 @@ func UnmarshalFieldBson(field *Field, buf *bytes.Buffer) {
 			field.Name = bson.DecodeString(buf, kind)
 		case "Type":
 			field.Type = bson.DecodeInt64(buf, kind)
+		case "Flags":
+			field.Flags = bson.DecodeInt64(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -65,15 +72,34 @@ func EncodeFieldsBson(fields []Field, key string, buf *bytes2.ChunkedWriter) {
 }
 
 func EncodeRowsBson(rows [][]sqltypes.Value, key string, buf *bytes2.ChunkedWriter) {
+	if len(rows) > 0 {
+		buf.Grow(len(rows) * rowSizeBson(rows[0]))
+	}
 	bson.EncodePrefix(buf, bson.Array, key)
 	lenWriter := bson.NewLenWriter(buf)
+	// The keys are formatted in the same scratch buffer, as
+	// bson.Itoa allocates the ones of the large results.
+	var index []byte
 	for i, v := range rows {
-		EncodeRowBson(v, bson.Itoa(i), buf)
+		index = strconv.AppendInt(index[:0], int64(i), 10)
+		EncodeRowBson(v, hack.String(index), buf)
 	}
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
+// rowSizeBson returns the approximate encoded size of row, with keys
+// of up to 5 digits.
+func rowSizeBson(row []sqltypes.Value) int {
+	// kind, key and length of the row, and its final EOO
+	size := 1 + 6 + 4 + 1
+	for _, v := range row {
+		// kind, key, length and subtype of the value
+		size += 1 + 6 + 4 + 1 + len(v.Raw())
+	}
+	return size
+}
+
 func EncodeRowBson(row []sqltypes.Value, key string, buf *bytes2.ChunkedWriter) {
 	bson.EncodePrefix(buf, bson.Array, key)
 	lenWriter := bson.NewLenWriter(buf)
@@ -89,8 +115,13 @@ func EncodeRowBson(row []sqltypes.Value, key string, buf *bytes2.ChunkedWriter)
 }
 
 func (qr *QueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	qr.unmarshalBson(buf, kind, nil)
+}
+
+// unmarshalBson decodes qr, storing the rows in arena if it is not nil.
+func (qr *QueryResult) unmarshalBson(buf *bytes.Buffer, kind byte, arena *Arena) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -103,7 +134,11 @@ func (qr *QueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 		case "InsertId":
 			qr.InsertId = bson.DecodeUint64(buf, kind)
 		case "Rows":
-			qr.Rows = DecodeRowsBson(buf, kind)
+			if arena != nil {
+				qr.Rows = DecodeRowsBsonArena(buf, kind, arena)
+			} else {
+				qr.Rows = DecodeRowsBson(buf, kind)
+			}
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -121,8 +156,8 @@ func DecodeFieldsBson(buf *bytes.Buffer, kind byte) []Field {
 		panic(bson.NewBsonError("Unexpected data type %v for Query.Fields", kind))
 	}
 
-	bson.Next(buf, 4)
-	fields := make([]Field, 0, 8)
+	fields := make([]Field, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		if kind != bson.Object {
@@ -147,8 +182,8 @@ func DecodeRowsBson(buf *bytes.Buffer, kind byte) [][]sqltypes.Value {
 		panic(bson.NewBsonError("Unexpected data type %v for Query.Rows", kind))
 	}
 
-	bson.Next(buf, 4)
-	rows := make([][]sqltypes.Value, 0, 8)
+	rows := make([][]sqltypes.Value, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		bson.SkipIndex(buf)
@@ -168,8 +203,8 @@ func DecodeRowBson(buf *bytes.Buffer, kind byte) []sqltypes.Value {
 		panic(bson.NewBsonError("Unexpected data type %v for Query.Row", kind))
 	}
 
-	bson.Next(buf, 4)
-	row := make([]sqltypes.Value, 0, 8)
+	row := make([]sqltypes.Value, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		bson.SkipIndex(buf)
@@ -6,9 +6,11 @@ package proto
 
 import (
 	"bytes"
+	"strconv"
 	"testing"
 
 	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
 	"github.com/youtube/vitess/go/sqltypes"
 )
 
@@ -28,7 +30,7 @@ type extraQueryResult struct {
 func TestQueryResult(t *testing.T) {
 	want := "\x85\x00\x00\x00\x04Fields\x00*\x00\x00\x00\x030\x00\"\x00\x00\x00\x05Name\x00\x04\x00\x00\x00\x00name\x12Type\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00?RowsAffected\x00\x02\x00\x00\x00\x00\x00\x00\x00?InsertId\x00\x03\x00\x00\x00\x00\x00\x00\x00\x04Rows\x00 \x00\x00\x00\x040\x00\x18\x00\x00\x00\x050\x00\x01\x00\x00\x00\x001\x051\x00\x02\x00\x00\x00\x00aa\x00\x00\x00"
 	custom := QueryResult{
-		Fields:       []Field{{"name", 1}},
+		Fields:       []Field{{Name: "name", Type: 1}},
 		RowsAffected: 2,
 		InsertId:     3,
 		Rows: [][]sqltypes.Value{
@@ -77,3 +79,54 @@ func TestQueryResult(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// benchmarkMarshal marshals a result of count rows, into a new
+// writer for each result like before pooling, or into a pooled one.
+func benchmarkMarshal(b *testing.B, count int, pooled bool) {
+	qr := &QueryResult{Rows: intRows(count, 10)}
+	pool := bytes2.NewChunkedWriterPool(bson.DefaultBufferSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf *bytes2.ChunkedWriter
+		if pooled {
+			buf = pool.Get()
+		} else {
+			buf = bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+		}
+		if err := bson.MarshalToBuffer(buf, qr); err != nil {
+			b.Fatal(err)
+		}
+		if pooled {
+			pool.Put(buf)
+		}
+	}
+}
+
+func BenchmarkMarshal1Row(b *testing.B)            { benchmarkMarshal(b, 1, false) }
+func BenchmarkMarshal1RowPooled(b *testing.B)      { benchmarkMarshal(b, 1, true) }
+func BenchmarkMarshal100Rows(b *testing.B)         { benchmarkMarshal(b, 100, false) }
+func BenchmarkMarshal100RowsPooled(b *testing.B)   { benchmarkMarshal(b, 100, true) }
+func BenchmarkMarshal10000Rows(b *testing.B)       { benchmarkMarshal(b, 10000, false) }
+func BenchmarkMarshal10000RowsPooled(b *testing.B) { benchmarkMarshal(b, 10000, true) }
+
+// BenchmarkUnmarshal100000Rows decodes a result of 1M cells, see
+// bson.CountElements for the allocations of its slices.
+func BenchmarkUnmarshal100000Rows(b *testing.B) {
+	qr := &QueryResult{Rows: intRows(100000, 10)}
+	for i := 0; i < 10; i++ {
+		qr.Fields = append(qr.Fields, Field{Name: strconv.Itoa(i), Type: VT_LONGLONG})
+	}
+	encoded, err := bson.Marshal(qr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var got QueryResult
+		if err := bson.Unmarshal(encoded, &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
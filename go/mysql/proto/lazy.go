@@ -0,0 +1,236 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// RawRows are the BSON encoded rows of a query result, one element
+// per row. A nil element is a NULL row. The rows reference the buffer
+// they were decoded from.
+type RawRows [][]byte
+
+// LazyQueryResult is a QueryResult whose rows are only decoded on
+// demand. It is meant for proxies: its MarshalBson writes the rows
+// exactly as they were received, and the rows of several results can
+// be merged without decoding them.
+type LazyQueryResult struct {
+	Fields       []Field
+	RowsAffected uint64
+	InsertId     uint64
+	Rows         RawRows
+}
+
+// NewLazyQueryResult returns a LazyQueryResult with the fields and
+// the encoded rows of qr.
+func NewLazyQueryResult(qr *QueryResult) *LazyQueryResult {
+	lqr := &LazyQueryResult{
+		Fields:       qr.Fields,
+		RowsAffected: qr.RowsAffected,
+		InsertId:     qr.InsertId,
+	}
+	if qr.Rows == nil {
+		return lqr
+	}
+	buf := bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+	offsets := make([]int, len(qr.Rows)+1)
+	for i, row := range qr.Rows {
+		EncodeRowBson(row, "", buf)
+		offsets[i+1] = buf.Len()
+	}
+	encoded := buf.Bytes()
+	lqr.Rows = make(RawRows, len(qr.Rows))
+	for i := range qr.Rows {
+		// the element type and the empty key are not part of the row
+		lqr.Rows[i] = encoded[offsets[i]+2 : offsets[i+1]]
+	}
+	return lqr
+}
+
+func (lqr *LazyQueryResult) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	EncodeFieldsBson(lqr.Fields, "Fields", buf)
+	bson.EncodeUint64(buf, "RowsAffected", lqr.RowsAffected)
+	bson.EncodeUint64(buf, "InsertId", lqr.InsertId)
+	EncodeRawRowsBson(lqr.Rows, "Rows", buf)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func (lqr *LazyQueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.Next(buf, 4)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		key := bson.ReadCString(buf)
+		switch key {
+		case "Fields":
+			lqr.Fields = DecodeFieldsBson(buf, kind)
+		case "RowsAffected":
+			lqr.RowsAffected = bson.DecodeUint64(buf, kind)
+		case "InsertId":
+			lqr.InsertId = bson.DecodeUint64(buf, kind)
+		case "Rows":
+			lqr.Rows = DecodeRawRowsBson(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// QueryResult decodes all the rows of lqr.
+func (lqr *LazyQueryResult) QueryResult() (*QueryResult, error) {
+	rows, err := lqr.Rows.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResult{
+		Fields:       lqr.Fields,
+		RowsAffected: lqr.RowsAffected,
+		InsertId:     lqr.InsertId,
+		Rows:         rows,
+	}, nil
+}
+
+// EncodeRawRowsBson encodes rows like EncodeRowsBson encodes the
+// rows they were decoded from.
+func EncodeRawRowsBson(rows RawRows, key string, buf *bytes2.ChunkedWriter) {
+	bson.EncodePrefix(buf, bson.Array, key)
+	lenWriter := bson.NewLenWriter(buf)
+	for i, row := range rows {
+		if row == nil {
+			bson.EncodePrefix(buf, bson.Null, bson.Itoa(i))
+			continue
+		}
+		bson.EncodePrefix(buf, bson.Array, bson.Itoa(i))
+		buf.Write(row)
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// DecodeRawRowsBson splits the BSON array of rows in buf into RawRows,
+// without decoding the rows.
+func DecodeRawRowsBson(buf *bytes.Buffer, kind byte) RawRows {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for Query.Rows", kind))
+	}
+
+	bson.Next(buf, 4)
+	rows := make(RawRows, 0, 8)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		bson.SkipIndex(buf)
+		switch kind {
+		case bson.Array:
+			// the encoded length includes the 4 bytes for the size
+			raw := buf.Bytes()
+			if len(raw) < 4 {
+				panic(bson.NewBsonError("unexpected EOF"))
+			}
+			l := int(bson.Pack.Uint32(raw))
+			if l < 5 {
+				panic(bson.NewBsonError("Object or Array should at least be 5 bytes long"))
+			}
+			rows = append(rows, bson.Next(buf, l))
+		case bson.Null:
+			rows = append(rows, nil)
+		default:
+			panic(bson.NewBsonError("Unexpected data type %v for Query.Row", kind))
+		}
+		kind = bson.NextByte(buf)
+	}
+	return rows
+}
+
+// Decode decodes all the rows.
+func (rows RawRows) Decode() ([][]sqltypes.Value, error) {
+	if rows == nil {
+		return nil, nil
+	}
+	result := make([][]sqltypes.Value, 0, len(rows))
+	it := rows.Iterator()
+	for it.Next() {
+		result = append(result, it.Row())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Iterator returns a RowIterator over rows.
+func (rows RawRows) Iterator() *RowIterator {
+	return &RowIterator{rows: rows}
+}
+
+// RowIterator decodes RawRows one row at a time:
+//
+//	it := rows.Iterator()
+//	for it.Next() {
+//		row := it.Row()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type RowIterator struct {
+	rows RawRows
+	row  []sqltypes.Value
+	err  error
+}
+
+// Next decodes the next row. It returns false when there are no more
+// rows, or if the row could not be decoded.
+func (it *RowIterator) Next() bool {
+	if it.err != nil || len(it.rows) == 0 {
+		it.row = nil
+		return false
+	}
+	it.row, it.err = decodeRawRow(it.rows[0])
+	it.rows = it.rows[1:]
+	return it.err == nil
+}
+
+// Row returns the row decoded by the last call to Next.
+func (it *RowIterator) Row() []sqltypes.Value {
+	return it.row
+}
+
+// Err returns the decoding error that stopped the iteration, if any.
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+func decodeRawRow(raw []byte) (row []sqltypes.Value, err error) {
+	if raw == nil {
+		return nil, nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			bsonErr, ok := x.(bson.BsonError)
+			if !ok {
+				panic(x)
+			}
+			err = bsonErr
+		}
+	}()
+	return DecodeRowBson(bytes.NewBuffer(raw), bson.Array), nil
+}
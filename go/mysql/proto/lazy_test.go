@@ -0,0 +1,184 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestLazyQueryResult(t *testing.T) {
+	for _, tc := range testcases {
+		encoded, err := bson.Marshal(&tc.qr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var eager QueryResult
+		if err := bson.Unmarshal(encoded, &eager); err != nil {
+			t.Fatal(err)
+		}
+		var lazy LazyQueryResult
+		if err := bson.Unmarshal(encoded, &lazy); err != nil {
+			t.Fatal(err)
+		}
+
+		// re-marshaling is byte-identical to the eager path
+		want, err := bson.Marshal(&eager)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bson.Marshal(&lazy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("Marshal(lazy):\n%q, want\n%q", got, want)
+		}
+
+		// and the rows decode to the same values
+		decoded, err := lazy.QueryResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(eager.Rows) != 0 || len(decoded.Rows) != 0 {
+			if !reflect.DeepEqual(decoded.Rows, eager.Rows) {
+				t.Errorf("lazy rows:\n%#v, want\n%#v", decoded.Rows, eager.Rows)
+			}
+		}
+	}
+}
+
+func TestLazyQueryResultMerge(t *testing.T) {
+	results := []QueryResult{
+		{
+			Fields: []Field{{Name: "id", Type: 3}},
+			Rows:   intRows(3, 1),
+		},
+		{
+			Fields: []Field{{Name: "id", Type: 3}},
+			Rows:   [][]sqltypes.Value{{sqltypes.Value{}}, {}},
+		},
+		{
+			Fields: []Field{{Name: "id", Type: 3}},
+		},
+		{
+			Fields: []Field{{Name: "id", Type: 3}},
+			Rows:   stringRows(2, 1),
+		},
+	}
+
+	eager := QueryResult{Fields: results[0].Fields}
+	lazy := LazyQueryResult{Fields: results[0].Fields}
+	for _, qr := range results {
+		eager.Rows = append(eager.Rows, qr.Rows...)
+
+		encoded, err := bson.Marshal(&qr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var inner LazyQueryResult
+		if err := bson.Unmarshal(encoded, &inner); err != nil {
+			t.Fatal(err)
+		}
+		lazy.Rows = append(lazy.Rows, inner.Rows...)
+	}
+
+	want, err := bson.Marshal(&eager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bson.Marshal(&lazy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("Marshal(merged lazy):\n%q, want\n%q", got, want)
+	}
+}
+
+func TestNewLazyQueryResult(t *testing.T) {
+	for _, tc := range testcases {
+		want, err := bson.Marshal(&tc.qr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bson.Marshal(NewLazyQueryResult(&tc.qr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("Marshal(NewLazyQueryResult(%v)):\n%q, want\n%q", tc.qr, got, want)
+		}
+	}
+}
+
+func TestRowIterator(t *testing.T) {
+	rows := NewLazyQueryResult(&QueryResult{Rows: intRows(3, 2)}).Rows
+	var got [][]sqltypes.Value
+	it := rows.Iterator()
+	for it.Next() {
+		got = append(got, it.Row())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if want := intRows(3, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("rows: %v, want %v", got, want)
+	}
+
+	// a bad row stops the iteration
+	rows[1] = []byte("\x08\x00\x00\x00\x010\x00\x00")
+	it = rows.Iterator()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 1 || it.Err() == nil {
+		t.Errorf("want an error after 1 row, got %v rows, error %v", n, it.Err())
+	}
+	if _, err := rows.Decode(); err == nil {
+		t.Errorf("Decode worked with a bad row")
+	}
+}
+
+func BenchmarkLazyPassThrough(b *testing.B) {
+	encoded, err := bson.Marshal(&QueryResult{Rows: intRows(100000, 10)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var qr LazyQueryResult
+		if err := bson.Unmarshal(encoded, &qr); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := bson.Marshal(&qr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEagerPassThrough(b *testing.B) {
+	encoded, err := bson.Marshal(&QueryResult{Rows: intRows(100000, 10)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var qr QueryResult
+		if err := bson.Unmarshal(encoded, &qr); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := bson.Marshal(&qr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
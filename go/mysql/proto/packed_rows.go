@@ -0,0 +1,101 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// EncodePackedRows serializes rows into a single blob, which is much
+// smaller than their BSON encoding when the values are small. The
+// format is:
+//
+//	uvarint(number of rows)
+//	for each row:
+//	  uvarint(number of values)
+//	  null bitmap, one bit per value, (number of values+7)/8 bytes
+//	  for each value that is not NULL: uvarint(length) value
+func EncodePackedRows(rows [][]sqltypes.Value) []byte {
+	size := binary.MaxVarintLen64
+	for _, row := range rows {
+		size += binary.MaxVarintLen64 + (len(row)+7)/8
+		for _, v := range row {
+			size += binary.MaxVarintLen64 + len(v.Raw())
+		}
+	}
+	buf := make([]byte, size)
+	pos := binary.PutUvarint(buf, uint64(len(rows)))
+	for _, row := range rows {
+		pos += binary.PutUvarint(buf[pos:], uint64(len(row)))
+		bitmap := buf[pos : pos+(len(row)+7)/8]
+		pos += len(bitmap)
+		for i, v := range row {
+			if v.IsNull() {
+				bitmap[i/8] |= 1 << uint(i%8)
+				continue
+			}
+			raw := v.Raw()
+			pos += binary.PutUvarint(buf[pos:], uint64(len(raw)))
+			pos += copy(buf[pos:], raw)
+		}
+	}
+	return buf[:pos]
+}
+
+// DecodePackedRows decodes rows encoded by EncodePackedRows. Like
+// the BSON decoding, it returns all the values as strings. The values
+// share the memory of packed.
+func DecodePackedRows(packed []byte) ([][]sqltypes.Value, error) {
+	pos := 0
+	readUvarint := func() (int, error) {
+		val, n := binary.Uvarint(packed[pos:])
+		if n <= 0 || val > uint64(len(packed)) {
+			return 0, fmt.Errorf("invalid packed rows: bad length at offset %v", pos)
+		}
+		pos += n
+		return int(val), nil
+	}
+
+	rowCount, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([][]sqltypes.Value, rowCount)
+	for r := range rows {
+		valueCount, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		bitmapLen := (valueCount + 7) / 8
+		if pos+bitmapLen > len(packed) {
+			return nil, fmt.Errorf("invalid packed rows: truncated null bitmap at offset %v", pos)
+		}
+		bitmap := packed[pos : pos+bitmapLen]
+		pos += bitmapLen
+		row := make([]sqltypes.Value, valueCount)
+		for i := range row {
+			if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+				continue
+			}
+			length, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if pos+length > len(packed) {
+				return nil, fmt.Errorf("invalid packed rows: truncated value at offset %v", pos)
+			}
+			row[i] = sqltypes.MakeString(packed[pos : pos+length])
+			pos += length
+		}
+		rows[r] = row
+	}
+	if pos != len(packed) {
+		return nil, fmt.Errorf("invalid packed rows: %v extra bytes", len(packed)-pos)
+	}
+	return rows, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestPackedRows(t *testing.T) {
+	rows := [][]sqltypes.Value{
+		{sqltypes.MakeString([]byte("1")), {}, sqltypes.MakeString([]byte("abc"))},
+		{},
+		{{}, {}, {}, {}, {}, {}, {}, {}, sqltypes.MakeString(make([]byte, 300))},
+		{sqltypes.MakeString([]byte(""))},
+	}
+	got, err := DecodePackedRows(EncodePackedRows(rows))
+	if err != nil {
+		t.Fatalf("DecodePackedRows failed: %v", err)
+	}
+	if !reflect.DeepEqual(rows, got) {
+		t.Errorf("want\n%#v, got\n%#v", rows, got)
+	}
+
+	if got, err := DecodePackedRows(EncodePackedRows(nil)); err != nil || len(got) != 0 {
+		t.Errorf("want no rows, got %v %v", got, err)
+	}
+
+	packed := EncodePackedRows(rows)
+	for _, bad := range [][]byte{nil, packed[:len(packed)-1], append(packed, 0)} {
+		if _, err := DecodePackedRows(bad); err == nil {
+			t.Errorf("DecodePackedRows(%q) worked", bad)
+		}
+	}
+}
+
+// intRows returns count rows of width numbers.
+func intRows(count, width int) [][]sqltypes.Value {
+	rows := make([][]sqltypes.Value, count)
+	for i := range rows {
+		rows[i] = make([]sqltypes.Value, width)
+		for j := range rows[i] {
+			rows[i][j] = sqltypes.MakeString([]byte(fmt.Sprintf("%v", i*width+j)))
+		}
+	}
+	return rows
+}
+
+// stringRows returns count rows of width 40 bytes strings.
+func stringRows(count, width int) [][]sqltypes.Value {
+	rows := make([][]sqltypes.Value, count)
+	for i := range rows {
+		rows[i] = make([]sqltypes.Value, width)
+		for j := range rows[i] {
+			rows[i][j] = sqltypes.MakeString(bytes.Repeat([]byte{'a' + byte(j%26)}, 40))
+		}
+	}
+	return rows
+}
+
+func bsonRows(rows [][]sqltypes.Value) []byte {
+	buf := bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+	bson.EncodeOptionalPrefix(buf, bson.Object, "")
+	lenWriter := bson.NewLenWriter(buf)
+	EncodeRowsBson(rows, "Rows", buf)
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+	return buf.Bytes()
+}
+
+func TestPackedRowsSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rows [][]sqltypes.Value
+	}{
+		{"narrow", intRows(1000, 3)},
+		{"wide", stringRows(100, 50)},
+	} {
+		bsonSize := len(bsonRows(tc.rows))
+		packedSize := len(EncodePackedRows(tc.rows))
+		if packedSize >= bsonSize {
+			t.Errorf("%v rows: packed size %v is not smaller than BSON size %v", tc.name, packedSize, bsonSize)
+		}
+		t.Logf("%v rows: BSON %v bytes, packed %v bytes", tc.name, bsonSize, packedSize)
+	}
+}
+
+func benchmarkBsonDecode(b *testing.B, rows [][]sqltypes.Value) {
+	encoded := bsonRows(rows)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(encoded)
+		bson.Next(buf, 4)
+		kind := bson.NextByte(buf)
+		bson.ReadCString(buf)
+		DecodeRowsBson(buf, kind)
+	}
+}
+
+func benchmarkPackedDecode(b *testing.B, rows [][]sqltypes.Value) {
+	encoded := EncodePackedRows(rows)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodePackedRows(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBsonDecodeNarrow(b *testing.B) {
+	benchmarkBsonDecode(b, intRows(1000, 3))
+}
+
+func BenchmarkPackedDecodeNarrow(b *testing.B) {
+	benchmarkPackedDecode(b, intRows(1000, 3))
+}
+
+func BenchmarkBsonDecodeWide(b *testing.B) {
+	benchmarkBsonDecode(b, stringRows(100, 50))
+}
+
+func BenchmarkPackedDecodeWide(b *testing.B) {
+	benchmarkPackedDecode(b, stringRows(100, 50))
+}
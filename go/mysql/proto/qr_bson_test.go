@@ -66,6 +66,19 @@ var testcases = []TestCase{
 		},
 		encoded: "",
 	},
+	// fields with flags
+	{
+		qr: QueryResult{
+			Fields: []Field{
+				{Name: "foo", Type: VT_LONGLONG, Flags: VT_UNSIGNED_FLAG},
+				{Name: "bar", Type: VT_BLOB, Flags: VT_BINARY_FLAG | VT_NOT_NULL_FLAG},
+			},
+			Rows: [][]sqltypes.Value{
+				{sqltypes.MakeNumeric([]byte("18446744073709551615")), sqltypes.MakeString([]byte("abc"))},
+			},
+		},
+		encoded: "",
+	},
 }
 
 func TestRun(t *testing.T) {
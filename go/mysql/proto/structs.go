@@ -41,10 +41,19 @@ const (
 	VT_GEOMETRY    = 255
 )
 
+// These flags should exactly match values defined in mysql_com.h.
+// Only the ones we need to interpret the Field types are listed.
+const (
+	VT_NOT_NULL_FLAG = 1
+	VT_UNSIGNED_FLAG = 32
+	VT_BINARY_FLAG   = 128
+)
+
 // Field described a column returned by mysql
 type Field struct {
-	Name string
-	Type int64
+	Name  string
+	Type  int64
+	Flags int64
 }
 
 // QueryResult is the structure returned by the mysql library.
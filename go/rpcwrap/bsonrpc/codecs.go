@@ -7,8 +7,10 @@ package bsonrpc
 import (
 	"crypto/tls"
 	"io"
+	"net"
 	"time"
 
+	log "github.com/golang/glog"
 	"github.com/youtube/vitess/go/bson"
 	"github.com/youtube/vitess/go/bytes2"
 	rpc "github.com/youtube/vitess/go/rpcplus"
@@ -29,8 +31,13 @@ func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
 
 const DefaultBufferSize = 4096
 
+// writerPool holds the buffers the requests and the responses are
+// marshaled into, so they're not allocated for each of them.
+var writerPool = bytes2.NewChunkedWriterPool(DefaultBufferSize)
+
 func (cc *ClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
-	buf := bytes2.NewChunkedWriter(DefaultBufferSize)
+	buf := writerPool.Get()
+	defer writerPool.Put(buf)
 	if err := bson.MarshalToBuffer(buf, &RequestBson{r}); err != nil {
 		return err
 	}
@@ -55,30 +62,38 @@ func (cc *ClientCodec) Close() error {
 
 type ServerCodec struct {
 	rwc io.ReadWriteCloser
-	cw  *bytes2.ChunkedWriter
 }
 
 func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
-	return &ServerCodec{conn, bytes2.NewChunkedWriter(DefaultBufferSize)}
+	return &ServerCodec{conn}
 }
 
 func (sc *ServerCodec) ReadRequestHeader(r *rpc.Request) error {
 	return bson.UnmarshalFromStream(sc.rwc, &RequestBson{r})
 }
 
+// ReadRequestBody reads the body of a request into body. The malformed
+// bodies are logged, and their error is sent back to the client.
 func (sc *ServerCodec) ReadRequestBody(body interface{}) error {
-	return bson.UnmarshalFromStream(sc.rwc, body)
+	if err := bson.UnmarshalFromStream(sc.rwc, body); err != nil {
+		log.Errorf("bsonrpc: cannot decode %T request from %v: %v", body, remoteAddr(sc.rwc), err)
+		return err
+	}
+	return nil
 }
 
+// WriteResponse marshals the response into a pooled buffer, which is
+// reset before it goes back to the pool, even when marshaling fails.
 func (sc *ServerCodec) WriteResponse(r *rpc.Response, body interface{}, last bool) error {
-	if err := bson.MarshalToBuffer(sc.cw, &ResponseBson{r}); err != nil {
+	buf := writerPool.Get()
+	defer writerPool.Put(buf)
+	if err := bson.MarshalToBuffer(buf, &ResponseBson{r}); err != nil {
 		return err
 	}
-	if err := bson.MarshalToBuffer(sc.cw, body); err != nil {
+	if err := bson.MarshalToBuffer(buf, body); err != nil {
 		return err
 	}
-	_, err := sc.cw.WriteTo(sc.rwc)
-	sc.cw.Reset()
+	_, err := buf.WriteTo(sc.rwc)
 	return err
 }
 
@@ -86,6 +101,18 @@ func (sc *ServerCodec) Close() error {
 	return sc.rwc.Close()
 }
 
+// remoteAddr returns the remote address of conn, if it knows it.
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		if addr := c.RemoteAddr(); addr != nil {
+			return addr.String()
+		}
+	}
+	return "unknown address"
+}
+
 func DialHTTP(network, address string, connectTimeout time.Duration, config *tls.Config) (*rpc.Client, error) {
 	return rpcwrap.DialHTTP(network, address, codecName, NewClientCodec, connectTimeout, config)
 }
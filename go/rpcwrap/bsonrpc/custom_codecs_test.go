@@ -5,6 +5,7 @@
 package bsonrpc
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/youtube/vitess/go/bson"
@@ -133,3 +134,60 @@ func TestResponseBson(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// bufferConn is a connection that reads from and writes to a buffer.
+type bufferConn struct {
+	*bytes.Buffer
+}
+
+func (bufferConn) Close() error {
+	return nil
+}
+
+func TestServerCodecBadBody(t *testing.T) {
+	encoded, err := bson.Marshal(&RequestBson{&rpc.Request{ServiceMethod: "aa", Seq: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ServiceMethod is not a string
+	encoded[4] = bson.Boolean
+	codec := NewServerCodec(bufferConn{bytes.NewBuffer(encoded)})
+	err = codec.ReadRequestBody(&RequestBson{new(rpc.Request)})
+	bsonErr, ok := err.(*bson.BsonError)
+	if !ok || bsonErr.Key != "ServiceMethod" {
+		t.Errorf("want an error for ServiceMethod, got %v", err)
+	}
+}
+
+func TestServerCodecNoLeak(t *testing.T) {
+	conn := bufferConn{new(bytes.Buffer)}
+	codec := NewServerCodec(conn)
+	// A chan can't be marshaled: the response fails half-way.
+	bad := struct {
+		Data string
+		Chan chan int
+	}{"leaked data", nil}
+	if err := codec.WriteResponse(&rpc.Response{ServiceMethod: "bad", Seq: 1}, &bad, false); err == nil {
+		t.Fatalf("want an error for a chan")
+	}
+	if conn.Len() != 0 {
+		t.Errorf("want nothing written, got %q", conn.Bytes())
+	}
+
+	good := struct{ Data string }{"data"}
+	if err := codec.WriteResponse(&rpc.Response{ServiceMethod: "good", Seq: 2}, &good, false); err != nil {
+		t.Fatal(err)
+	}
+	header, err := bson.Marshal(&ResponseBson{&rpc.Response{ServiceMethod: "good", Seq: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := bson.Marshal(&good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(header) + string(body)
+	if got := conn.String(); got != want {
+		t.Errorf("got\n%q, want\n%q", got, want)
+	}
+}
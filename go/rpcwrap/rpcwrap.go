@@ -43,6 +43,15 @@ func NewBufferedConnection(conn io.ReadWriteCloser) *BufferedConnection {
 	return &BufferedConnection{false, bufio.NewReader(conn), conn}
 }
 
+// RemoteAddr returns the remote address of the connection, or nil if
+// it isn't a network connection.
+func (bc *BufferedConnection) RemoteAddr() net.Addr {
+	if conn, ok := bc.WriteCloser.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
 // FIXME(sougou/szopa): Find a better way to track connection count.
 func (bc *BufferedConnection) Close() error {
 	if !bc.isClosed {
@@ -148,6 +157,18 @@ func RegisterAuthenticated(rcvr interface{}) error {
 	return AuthenticatedServer.Register(rcvr)
 }
 
+// connClosedHooks are called when a connection of the rpc servers
+// closes, see OnConnClosed.
+var connClosedHooks []func(context *proto.Context)
+
+// OnConnClosed registers a function that is called with the context
+// of each connection of the rpc servers once it closes, the context
+// its methods were called with. Calls of the connection may still be
+// running. It must be called before the servers start.
+func OnConnClosed(hook func(context *proto.Context)) {
+	connClosedHooks = append(connClosedHooks, hook)
+}
+
 // ServeCodec calls ServeCodec for the appropriate server
 // (authenticated or default).
 func (h *rpcHandler) ServeCodecWithContext(c rpc.ServerCodec, context *proto.Context) {
@@ -182,6 +203,9 @@ func (h *rpcHandler) ServeHTTP(c http.ResponseWriter, req *http.Request) {
 		}
 	}
 	h.ServeCodecWithContext(codec, context)
+	for _, hook := range connClosedHooks {
+		hook(context)
+	}
 }
 
 func GetRpcPath(codecName string, auth bool) string {
@@ -185,7 +185,7 @@ func BuildValue(goval interface{}) (v Value, err error) {
 	case []byte:
 		v = Value{String(bindVal)}
 	case time.Time:
-		v = Value{String([]byte(bindVal.Format("'2006-01-02 15:04:05'")))}
+		v = Value{String(formatTime(bindVal))}
 	case Numeric, Fractional, String:
 		v = Value{bindVal.(InnerValue)}
 	case Value:
@@ -196,6 +196,16 @@ func BuildValue(goval interface{}) (v Value, err error) {
 	return v, nil
 }
 
+// formatTime formats t as a MySQL datetime in UTC. The fractional
+// seconds are truncated to microseconds, the precision of MySQL, and
+// dropped when they're zero. The zero time is the zero datetime.
+func formatTime(t time.Time) []byte {
+	if t.IsZero() {
+		return []byte("0000-00-00 00:00:00")
+	}
+	return []byte(t.UTC().Format("2006-01-02 15:04:05.999999"))
+}
+
 // BuildNumeric builds a Numeric type that represents any whole number.
 // It normalizes the representation to ensure 1:1 mapping between the
 // number and its representation.
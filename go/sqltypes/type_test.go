@@ -243,8 +243,8 @@ func TestBuildValue(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
-	if !v.IsString() || v.String() != "'2012-02-24 23:19:43'" {
-		t.Errorf("Expecting '2012-02-24 23:19:43', received %T: %s", v.Inner, v.String())
+	if !v.IsString() || v.String() != "2012-02-24 23:19:43" {
+		t.Errorf("Expecting 2012-02-24 23:19:43, received %T: %s", v.Inner, v.String())
 	}
 	v, err = BuildValue(Numeric([]byte("123")))
 	if err != nil {
@@ -294,3 +294,32 @@ func TestEncode(t *testing.T) {
 		t.Errorf("Decode fail: %v", SqlDecodeMap[DONTESCAPE])
 	}
 }
+
+func TestTimeEncodeSql(t *testing.T) {
+	testcases := []struct {
+		desc string
+		in   time.Time
+		out  string
+	}{
+		{"seconds", time.Date(2012, 2, 24, 23, 19, 43, 0, time.UTC), "'2012-02-24 23:19:43'"},
+		{"milliseconds", time.Date(2012, 2, 24, 23, 19, 43, 120e6, time.UTC), "'2012-02-24 23:19:43.12'"},
+		{"microseconds", time.Date(2012, 2, 24, 23, 19, 43, 123456e3, time.UTC), "'2012-02-24 23:19:43.123456'"},
+		// Nanoseconds are truncated, not rounded.
+		{"nanoseconds", time.Date(2012, 2, 24, 23, 19, 43, 999999999, time.UTC), "'2012-02-24 23:19:43.999999'"},
+		{"not UTC", time.Date(2012, 2, 24, 23, 19, 43, 0, time.FixedZone("X", 3600)), "'2012-02-24 22:19:43'"},
+		{"before 1970", time.Date(1969, 12, 31, 23, 59, 59, 500e6, time.UTC), "'1969-12-31 23:59:59.5'"},
+		{"zero", time.Time{}, "'0000-00-00 00:00:00'"},
+	}
+	for _, tcase := range testcases {
+		v, err := BuildValue(tcase.in)
+		if err != nil {
+			t.Errorf("%s: %v", tcase.desc, err)
+			continue
+		}
+		b := bytes.NewBuffer(nil)
+		v.EncodeSql(b)
+		if b.String() != tcase.out {
+			t.Errorf("%s: got %s, want %s", tcase.desc, b.String(), tcase.out)
+		}
+	}
+}
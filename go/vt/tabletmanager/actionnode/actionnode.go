@@ -110,6 +110,13 @@ const (
 	SHARD_ACTION_MIGRATE_SERVED_TYPES = "MigrateServedTypes"
 	// Update the Shard object (Cells, ...)
 	SHARD_ACTION_UPDATE_SHARD = "UpdateShard"
+	// Changes the TabletControl of a tablet type inside a shard
+	SHARD_ACTION_SET_TABLET_CONTROL = "SetShardTabletControl"
+	// Adds or removes a SourceShard of a shard
+	SHARD_ACTION_SOURCE_SHARD_ADD    = "SourceShardAdd"
+	SHARD_ACTION_SOURCE_SHARD_DELETE = "SourceShardDelete"
+	// Copies the schema of a tablet to a shard
+	SHARD_ACTION_COPY_SCHEMA = "CopySchemaShard"
 
 	//
 	// Keyspace actions - require very high level locking for consistency.
@@ -120,6 +127,7 @@ const (
 	KEYSPACE_ACTION_APPLY_SCHEMA        = "ApplySchemaKeyspace"
 	KEYSPACE_ACTION_SET_SHARDING_INFO   = "SetKeyspaceShardingInfo"
 	KEYSPACE_ACTION_MIGRATE_SERVED_FROM = "MigrateServedFrom"
+	KEYSPACE_ACTION_CREATE_SHARD        = "CreateShard"
 
 	ACTION_STATE_QUEUED  = ActionState("")        // All actions are queued initially
 	ACTION_STATE_RUNNING = ActionState("Running") // Running inside vtaction process
@@ -139,11 +147,30 @@ type ActionNode struct {
 	State      ActionState
 	Pid        int // only != 0 if State == ACTION_STATE_RUNNING
 
+	// HeartbeatTime is the unix time of the last heartbeat of
+	// a long running action holding a lock, 0 if there was none.
+	HeartbeatTime int64 `json:",omitempty"`
+
+	// LockTime is the unix time the action asked for the shard
+	// lock, 0 for the other actions and the nodes written by older
+	// versions.
+	LockTime int64 `json:",omitempty"`
+
+	// Username, Hostname and ProcessId identify the process that
+	// created the action, see SetGuid. They are empty in the nodes
+	// written by older versions.
+	Username  string `json:",omitempty"`
+	Hostname  string `json:",omitempty"`
+	ProcessId int    `json:",omitempty"`
+
 	// do not serialize the next fields
 	// path in topology server representing this action
 	Path  string      `json:"-"`
 	Args  interface{} `json:"-"`
 	Reply interface{} `json:"-"`
+
+	// time the action started, for the action log
+	StartTime time.Time `json:"-"`
 }
 
 // ActionNodeFromJson interprets the data from JSON.
@@ -221,6 +248,14 @@ func ActionNodeFromJson(data, path string) (*ActionNode, error) {
 	case SHARD_ACTION_MIGRATE_SERVED_TYPES:
 		node.Args = &MigrateServedTypesArgs{}
 	case SHARD_ACTION_UPDATE_SHARD:
+	case SHARD_ACTION_SET_TABLET_CONTROL:
+		node.Args = &SetShardTabletControlArgs{}
+	case SHARD_ACTION_SOURCE_SHARD_ADD:
+		node.Args = &SourceShardAddArgs{}
+	case SHARD_ACTION_SOURCE_SHARD_DELETE:
+		node.Args = &SourceShardDeleteArgs{}
+	case SHARD_ACTION_COPY_SCHEMA:
+		node.Args = &CopySchemaShardArgs{}
 
 	case KEYSPACE_ACTION_REBUILD:
 	case KEYSPACE_ACTION_APPLY_SCHEMA:
@@ -228,6 +263,8 @@ func ActionNodeFromJson(data, path string) (*ActionNode, error) {
 	case KEYSPACE_ACTION_SET_SHARDING_INFO:
 	case KEYSPACE_ACTION_MIGRATE_SERVED_FROM:
 		node.Args = &MigrateServedFromArgs{}
+	case KEYSPACE_ACTION_CREATE_SHARD:
+		node.Args = &CreateShardArgs{}
 
 	case TABLET_ACTION_SET_BLACKLISTED_TABLES, TABLET_ACTION_GET_SCHEMA,
 		TABLET_ACTION_RELOAD_SCHEMA, TABLET_ACTION_GET_PERMISSIONS,
@@ -284,20 +321,107 @@ func (n *ActionNode) ToJson() string {
 	return result
 }
 
-// SetGuid will set the ActionGuid field for the action node
-// and return the action node.
+// SetGuid will set the ActionGuid field for the action node, and the
+// Username, Hostname and ProcessId of the current process, and return
+// the action node.
 func (n *ActionNode) SetGuid() *ActionNode {
 	now := time.Now().Format(time.RFC3339)
-	username := "unknown"
+	username, hostname := currentUserAndHost()
+	n.ActionGuid = fmt.Sprintf("%v-%v-%v", now, username, hostname)
+	n.Username = username
+	n.Hostname = hostname
+	n.ProcessId = os.Getpid()
+	return n
+}
+
+// Initiator returns who created the action, as "user@host pid N", or
+// "unknown" for the nodes written by older versions.
+func (n *ActionNode) Initiator() string {
+	if n.Username == "" && n.Hostname == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%v@%v pid %v", n.Username, n.Hostname, n.ProcessId)
+}
+
+func currentUserAndHost() (username, hostname string) {
+	username = "unknown"
 	if u, err := user.Current(); err == nil {
 		username = u.Username
 	}
-	hostname := "unknown"
+	hostname = "unknown"
 	if h, err := os.Hostname(); err == nil {
 		hostname = h
 	}
-	n.ActionGuid = fmt.Sprintf("%v-%v-%v", now, username, hostname)
-	return n
+	return username, hostname
+}
+
+// maxActionLogParamsLen is the maximum length of the
+// parameters summary in an ActionLogEntry.
+const maxActionLogParamsLen = 256
+
+// ActionLogEntry is the audit record of an action that locked
+// a keyspace or a shard. It is stored in the action log of the
+// keyspace or shard once the action is done.
+type ActionLogEntry struct {
+	Action     string
+	ActionGuid string
+	Params     string
+	State      ActionState
+	Error      string
+	StartTime  time.Time
+	EndTime    time.Time
+	User       string
+	Host       string
+	ProcessId  int `json:",omitempty"`
+}
+
+// LogEntry returns the ActionLogEntry for a finished action,
+// ending now.
+func (n *ActionNode) LogEntry() *ActionLogEntry {
+	params := ""
+	if n.Args != nil {
+		if data, err := json.Marshal(n.Args); err == nil {
+			params = string(data)
+		} else {
+			params = fmt.Sprintf("%v", n.Args)
+		}
+		if len(params) > maxActionLogParamsLen {
+			params = params[:maxActionLogParamsLen-3] + "..."
+		}
+	}
+	// the action was created by this process, unless the node comes
+	// from an older version
+	username, hostname, pid := n.Username, n.Hostname, n.ProcessId
+	if username == "" && hostname == "" {
+		username, hostname = currentUserAndHost()
+		pid = os.Getpid()
+	}
+	return &ActionLogEntry{
+		Action:     n.Action,
+		ActionGuid: n.ActionGuid,
+		Params:     params,
+		State:      n.State,
+		Error:      n.Error,
+		StartTime:  n.StartTime,
+		EndTime:    time.Now(),
+		User:       username,
+		Host:       hostname,
+		ProcessId:  pid,
+	}
+}
+
+// ToJson returns a JSON representation of the object.
+func (e *ActionLogEntry) ToJson() string {
+	return jscfg.ToJson(e)
+}
+
+// ActionLogEntryFromJson interprets the data from JSON.
+func ActionLogEntryFromJson(data string) (*ActionLogEntry, error) {
+	e := &ActionLogEntry{}
+	if err := json.Unmarshal([]byte(data), e); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
 // ActionNodeCanBePurged returns true if that ActionNode can be purged
@@ -0,0 +1,44 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package actionnode
+
+import (
+	"os"
+	"testing"
+)
+
+func TestActionNodeInitiator(t *testing.T) {
+	node := RebuildShard()
+	if node.Username == "" || node.Hostname == "" || node.ProcessId != os.Getpid() {
+		t.Errorf("initiator not set: %+v", node)
+	}
+
+	decoded, err := ActionNodeFromJson(node.ToJson(), "/path")
+	if err != nil {
+		t.Fatalf("ActionNodeFromJson failed: %v", err)
+	}
+	if decoded.Username != node.Username || decoded.Hostname != node.Hostname || decoded.ProcessId != node.ProcessId {
+		t.Errorf("want %+v, got %+v", node, decoded)
+	}
+	if e := decoded.LogEntry(); e.User != node.Username || e.Host != node.Hostname || e.ProcessId != node.ProcessId {
+		t.Errorf("unexpected log entry: %+v", e)
+	}
+
+	// the nodes of older versions still parse
+	old := `{"Action": "RebuildShard", "ActionGuid": "guid", "Error": "", "State": "", "Pid": 0}
+{}
+{}
+`
+	decoded, err = ActionNodeFromJson(old, "/path")
+	if err != nil {
+		t.Fatalf("ActionNodeFromJson(old) failed: %v", err)
+	}
+	if decoded.Action != SHARD_ACTION_REBUILD || decoded.Username != "" || decoded.ProcessId != 0 {
+		t.Errorf("unexpected old node: %+v", decoded)
+	}
+	if got := decoded.Initiator(); got != "unknown" {
+		t.Errorf("want unknown initiator, got %v", got)
+	}
+}
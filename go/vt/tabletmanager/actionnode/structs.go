@@ -118,6 +118,29 @@ type MigrateServedTypesArgs struct {
 	ServedType topo.TabletType
 }
 
+type SetShardTabletControlArgs struct {
+	TabletType          topo.TabletType
+	Cells               []string
+	Remove              bool
+	DisableQueryService bool
+	Tables              []string
+}
+
+type SourceShardAddArgs struct {
+	SourceShard topo.SourceShard
+}
+
+type SourceShardDeleteArgs struct {
+	Uid uint32
+}
+
+type CopySchemaShardArgs struct {
+	SourceTabletAlias topo.TabletAlias
+	Tables            []string
+	ExcludeTables     []string
+	IncludeViews      bool
+}
+
 // keyspace action node structures
 
 type ApplySchemaKeyspaceArgs struct {
@@ -129,6 +152,11 @@ type MigrateServedFromArgs struct {
 	ServedType topo.TabletType
 }
 
+type CreateShardArgs struct {
+	Shard string
+	Force bool
+}
+
 // methods to build the shard action nodes
 
 func ReparentShard(tabletAlias topo.TabletAlias) *ActionNode {
@@ -193,6 +221,49 @@ func MigrateServedTypes(servedType topo.TabletType) *ActionNode {
 	}).SetGuid()
 }
 
+func SetShardTabletControl(tabletType topo.TabletType, cells []string, remove, disableQueryService bool, tables []string) *ActionNode {
+	return (&ActionNode{
+		Action: SHARD_ACTION_SET_TABLET_CONTROL,
+		Args: &SetShardTabletControlArgs{
+			TabletType:          tabletType,
+			Cells:               cells,
+			Remove:              remove,
+			DisableQueryService: disableQueryService,
+			Tables:              tables,
+		},
+	}).SetGuid()
+}
+
+func SourceShardAdd(sourceShard topo.SourceShard) *ActionNode {
+	return (&ActionNode{
+		Action: SHARD_ACTION_SOURCE_SHARD_ADD,
+		Args: &SourceShardAddArgs{
+			SourceShard: sourceShard,
+		},
+	}).SetGuid()
+}
+
+func SourceShardDelete(uid uint32) *ActionNode {
+	return (&ActionNode{
+		Action: SHARD_ACTION_SOURCE_SHARD_DELETE,
+		Args: &SourceShardDeleteArgs{
+			Uid: uid,
+		},
+	}).SetGuid()
+}
+
+func CopySchemaShard(sourceTabletAlias topo.TabletAlias, tables, excludeTables []string, includeViews bool) *ActionNode {
+	return (&ActionNode{
+		Action: SHARD_ACTION_COPY_SCHEMA,
+		Args: &CopySchemaShardArgs{
+			SourceTabletAlias: sourceTabletAlias,
+			Tables:            tables,
+			ExcludeTables:     excludeTables,
+			IncludeViews:      includeViews,
+		},
+	}).SetGuid()
+}
+
 func UpdateShard() *ActionNode {
 	return (&ActionNode{
 		Action: SHARD_ACTION_UPDATE_SHARD,
@@ -231,3 +302,13 @@ func MigrateServedFrom(servedType topo.TabletType) *ActionNode {
 		},
 	}).SetGuid()
 }
+
+func CreateShard(shard string, force bool) *ActionNode {
+	return (&ActionNode{
+		Action: KEYSPACE_ACTION_CREATE_SHARD,
+		Args: &CreateShardArgs{
+			Shard: shard,
+			Force: force,
+		},
+	}).SetGuid()
+}
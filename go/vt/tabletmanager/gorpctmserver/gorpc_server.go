@@ -83,6 +83,40 @@ func (tm *TabletManager) ReloadSchema(context *rpcproto.Context, args *rpc.Unuse
 	})
 }
 
+func (tm *TabletManager) PreflightSchema(context *rpcproto.Context, args *string, reply *myproto.SchemaChangeResult) error {
+	return tm.agent.RpcWrapLockAction(context.RemoteAddr, actionnode.TABLET_ACTION_PREFLIGHT_SCHEMA, args, reply, func() error {
+		// read the tablet to get the dbname
+		tablet, err := tm.agent.TopoServer.GetTablet(tm.agent.TabletAlias)
+		if err != nil {
+			return err
+		}
+
+		// and preflight the change
+		scr, err := tm.agent.Mysqld.PreflightSchemaChange(tablet.DbName(), *args)
+		if err == nil {
+			*reply = *scr
+		}
+		return err
+	})
+}
+
+func (tm *TabletManager) ApplySchema(context *rpcproto.Context, args *myproto.SchemaChange, reply *myproto.SchemaChangeResult) error {
+	return tm.agent.RpcWrapLockActionSchema(context.RemoteAddr, actionnode.TABLET_ACTION_APPLY_SCHEMA, args, reply, func() error {
+		// read the tablet to get the dbname
+		tablet, err := tm.agent.TopoServer.GetTablet(tm.agent.TabletAlias)
+		if err != nil {
+			return err
+		}
+
+		// and apply the change
+		scr, err := tm.agent.Mysqld.ApplySchemaChange(tablet.DbName(), args)
+		if err == nil {
+			*reply = *scr
+		}
+		return err
+	})
+}
+
 //
 // Replication related methods
 //
@@ -42,6 +42,13 @@ type TabletManagerConn interface {
 	// ReloadSchema asks the remote tablet to reload its schema
 	ReloadSchema(tablet *topo.TabletInfo, waitTime time.Duration) error
 
+	// PreflightSchema asks the remote tablet to try a schema change
+	// on a copy of its database
+	PreflightSchema(tablet *topo.TabletInfo, change string, waitTime time.Duration) (*myproto.SchemaChangeResult, error)
+
+	// ApplySchema asks the remote tablet to apply a schema change
+	ApplySchema(tablet *topo.TabletInfo, change *myproto.SchemaChange, waitTime time.Duration) (*myproto.SchemaChangeResult, error)
+
 	//
 	// Replication related methods
 	//
@@ -45,6 +45,7 @@ func (sq *SqlQuery) Execute(context *rpcproto.Context, query *proto.Query, reply
 	return sq.server.Execute(&tabletserver.Context{
 		RemoteAddr: context.RemoteAddr,
 		Username:   context.Username,
+		CallerID:   query.CallerID,
 	}, query, reply)
 }
 
@@ -52,6 +53,7 @@ func (sq *SqlQuery) StreamExecute(context *rpcproto.Context, query *proto.Query,
 	return sq.server.StreamExecute(&tabletserver.Context{
 		RemoteAddr: context.RemoteAddr,
 		Username:   context.Username,
+		CallerID:   query.CallerID,
 	}, query, func(reply *mproto.QueryResult) error {
 		return sendReply(reply)
 	})
@@ -61,6 +63,7 @@ func (sq *SqlQuery) ExecuteBatch(context *rpcproto.Context, queryList *proto.Que
 	return sq.server.ExecuteBatch(&tabletserver.Context{
 		RemoteAddr: context.RemoteAddr,
 		Username:   context.Username,
+		CallerID:   queryList.CallerID,
 	}, queryList, reply)
 }
 
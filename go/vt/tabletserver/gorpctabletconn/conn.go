@@ -82,8 +82,32 @@ func (conn *TabletBson) Execute(context interface{}, query string, bindVars map[
 		BindVariables: bindVars,
 		TransactionId: transactionId,
 		SessionId:     conn.sessionId,
+		CallerID:      tabletconn.CallerID(context),
 	}
-	qr := new(mproto.QueryResult)
+	// vtgate only holds the results until they are merged and
+	// sent, so the rows are decoded into an arena.
+	qr := new(mproto.ArenaQueryResult)
+	if err := conn.rpcClient.Call("SqlQuery.Execute", req, qr); err != nil {
+		return nil, tabletError(err)
+	}
+	return &qr.QueryResult, nil
+}
+
+func (conn *TabletBson) ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.LazyQueryResult, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if conn.rpcClient == nil {
+		return nil, tabletconn.CONN_CLOSED
+	}
+
+	req := &tproto.Query{
+		Sql:           query,
+		BindVariables: bindVars,
+		TransactionId: transactionId,
+		SessionId:     conn.sessionId,
+		CallerID:      tabletconn.CallerID(context),
+	}
+	qr := new(mproto.LazyQueryResult)
 	if err := conn.rpcClient.Call("SqlQuery.Execute", req, qr); err != nil {
 		return nil, tabletError(err)
 	}
@@ -101,6 +125,7 @@ func (conn *TabletBson) ExecuteBatch(context interface{}, queries []tproto.Bound
 		Queries:       queries,
 		TransactionId: transactionId,
 		SessionId:     conn.sessionId,
+		CallerID:      tabletconn.CallerID(context),
 	}
 	qrs := new(tproto.QueryResultList)
 	if err := conn.rpcClient.Call("SqlQuery.ExecuteBatch", req, qrs); err != nil {
@@ -123,6 +148,7 @@ func (conn *TabletBson) StreamExecute(context interface{}, query string, bindVar
 		BindVariables: bindVars,
 		TransactionId: transactionId,
 		SessionId:     conn.sessionId,
+		CallerID:      tabletconn.CallerID(context),
 	}
 	sr := make(chan *mproto.QueryResult, 10)
 	c := conn.rpcClient.StreamGo("SqlQuery.StreamExecute", req, sr)
@@ -0,0 +1,186 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// BindVariableToValue converts a bind variable, as decoded by
+// DecodeBindVariablesBson, into sqltypes values, so the distinction
+// between integers, fractional numbers, strings and NULL can't be lost
+// afterwards: a value becomes a sqltypes.Value, a list a
+// []sqltypes.Value, and a list of tuples a [][]sqltypes.Value.
+// Strings and binary values both become sqltypes.String, booleans the
+// integers 1 and 0.
+func BindVariableToValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []sqltypes.Value, [][]sqltypes.Value:
+		return v, nil
+	}
+	list, ok := listElements(v)
+	if !ok {
+		return scalarToValue(v)
+	}
+	if len(list) == 0 {
+		return []sqltypes.Value{}, nil
+	}
+	if _, isTuple := listElements(list[0]); !isTuple {
+		return listToValues(list)
+	}
+	tuples := make([][]sqltypes.Value, len(list))
+	for i, elem := range list {
+		tuple, ok := listElements(elem)
+		if !ok {
+			return nil, fmt.Errorf("element %v of a list of tuples is not a tuple: %v", i, elem)
+		}
+		values, err := listToValues(tuple)
+		if err != nil {
+			return nil, fmt.Errorf("tuple %v: %v", i, err)
+		}
+		tuples[i] = values
+	}
+	return tuples, nil
+}
+
+// listElements returns the elements of a list bind variable. []byte
+// is a value, not a list.
+func listElements(v interface{}) ([]interface{}, bool) {
+	if list, ok := v.([]interface{}); ok {
+		return list, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || rv.Type() == bytesType {
+		return nil, false
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
+
+func listToValues(list []interface{}) ([]sqltypes.Value, error) {
+	values := make([]sqltypes.Value, len(list))
+	for i, elem := range list {
+		if _, ok := listElements(elem); ok {
+			return nil, fmt.Errorf("element %v is a list, lists can only contain values or tuples of values", i)
+		}
+		value, err := scalarToValue(elem)
+		if err != nil {
+			return nil, fmt.Errorf("element %v: %v", i, err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func scalarToValue(v interface{}) (sqltypes.Value, error) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return sqltypes.MakeNumeric([]byte("1")), nil
+		}
+		return sqltypes.MakeNumeric([]byte("0")), nil
+	}
+	return sqltypes.BuildValue(v)
+}
+
+// BindVariableError is returned by ValidateBindVariables for a bind
+// variable of an unsupported type.
+type BindVariableError struct {
+	Name string
+	// Element is the position of the unsupported value in a list bind
+	// variable, "<i>" or "<i>.<j>" in a list of tuples, or "" if the
+	// bind variable itself is not supported.
+	Element string
+	// Type is the Go type of the unsupported value.
+	Type string
+}
+
+func (e *BindVariableError) Error() string {
+	if e.Element == "" {
+		return fmt.Sprintf("bad bind variable %v: unsupported type %v", e.Name, e.Type)
+	}
+	return fmt.Sprintf("bad bind variable %v: element %v has the unsupported type %v", e.Name, e.Element, e.Type)
+}
+
+// ValidateBindVariables checks the types of bindVars before they are
+// sent, and returns a *BindVariableError for the first unsupported
+// one, by name. The values can be nil, string, []byte, int, int32,
+// int64, uint, uint32, uint64, float64, bool, time.Time or sqltypes
+// values. The lists can be slices of values, or of tuples of values,
+// which are slices too.
+func ValidateBindVariables(bindVars map[string]interface{}) error {
+	names := make([]string, 0, len(bindVars))
+	for name := range bindVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		element, typ := unsupportedBindVariable(bindVars[name])
+		if typ != nil {
+			return &BindVariableError{Name: name, Element: element, Type: fmt.Sprintf("%v", typ)}
+		}
+	}
+	return nil
+}
+
+// unsupportedBindVariable returns the position and type of the first
+// unsupported value of v, following the rules of BindVariableToValue,
+// or a nil type.
+func unsupportedBindVariable(v interface{}) (string, reflect.Type) {
+	switch v.(type) {
+	case []sqltypes.Value, [][]sqltypes.Value:
+		return "", nil
+	}
+	list, ok := listElements(v)
+	if !ok {
+		if !isSupportedValue(v) {
+			return "", reflect.TypeOf(v)
+		}
+		return "", nil
+	}
+	if len(list) == 0 {
+		return "", nil
+	}
+	_, isTuple := listElements(list[0])
+	for i, elem := range list {
+		if !isTuple {
+			if !isSupportedValue(elem) {
+				return strconv.Itoa(i), reflect.TypeOf(elem)
+			}
+			continue
+		}
+		tuple, ok := listElements(elem)
+		if !ok {
+			return strconv.Itoa(i), reflect.TypeOf(elem)
+		}
+		for j, value := range tuple {
+			if !isSupportedValue(value) {
+				return fmt.Sprintf("%v.%v", i, j), reflect.TypeOf(value)
+			}
+		}
+	}
+	return "", nil
+}
+
+// isSupportedValue returns true if v is a value BindVariableToValue
+// can convert.
+func isSupportedValue(v interface{}) bool {
+	switch v.(type) {
+	case nil, string, []byte, int, int32, int64, uint, uint32, uint64, float64, bool, time.Time,
+		sqltypes.Value, sqltypes.Numeric, sqltypes.Fractional, sqltypes.String:
+		return true
+	}
+	return false
+}
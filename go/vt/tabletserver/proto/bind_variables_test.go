@@ -0,0 +1,156 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func numeric(s string) sqltypes.Value {
+	return sqltypes.MakeNumeric([]byte(s))
+}
+
+func fractional(s string) sqltypes.Value {
+	return sqltypes.MakeFractional([]byte(s))
+}
+
+func str(s string) sqltypes.Value {
+	return sqltypes.MakeString([]byte(s))
+}
+
+// bindVariableBson returns the BSON object of a single bind variable,
+// as a client encodes it.
+func bindVariableBson(v interface{}) []byte {
+	buf := bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+	EncodeBindVariablesBson(buf, "", map[string]interface{}{"v": v})
+	// skip the prefix of the map, we only have its content
+	return buf.Bytes()[2:]
+}
+
+func TestBindVariableToValue(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		wire []byte
+		want interface{}
+	}{
+		{"int32", bindVariableBson(int32(-5)), numeric("-5")},
+		{"int64", bindVariableBson(int64(123)), numeric("123")},
+		{"uint64", bindVariableBson(uint64(18446744073709551615)), numeric("18446744073709551615")},
+		{"float64", bindVariableBson(1.5), fractional("1.5")},
+		{"numeric string", bindVariableBson("123"), str("123")},
+		{"binary", bindVariableBson([]byte{0, 1, 255}), sqltypes.MakeString([]byte{0, 1, 255})},
+		// the Go encoder sends strings as binary, other clients
+		// use the BSON string type
+		{"string", []byte("\x10\x00\x00\x00\x02v\x00\x04\x00\x00\x00123\x00\x00"), str("123")},
+		{"bool", bindVariableBson(true), numeric("1")},
+		{"null", bindVariableBson(nil), sqltypes.NULL},
+		{"time", bindVariableBson(time.Date(2014, 5, 6, 7, 8, 9, 0, time.UTC)), str("2014-05-06 07:08:09")},
+		{"list", bindVariableBson([]interface{}{int64(1), "1", nil}), []sqltypes.Value{numeric("1"), str("1"), sqltypes.NULL}},
+		{"empty list", bindVariableBson([]interface{}{}), []sqltypes.Value{}},
+		{"tuples", bindVariableBson([]interface{}{[]interface{}{int64(1), "a"}, []interface{}{int64(2), "b"}}), [][]sqltypes.Value{{numeric("1"), str("a")}, {numeric("2"), str("b")}}},
+		{"value", bindVariableBson(str("123")), str("123")},
+		{"value list", bindVariableBson([]sqltypes.Value{numeric("-1"), fractional("0.25"), str("x"), sqltypes.NULL}), []sqltypes.Value{numeric("-1"), fractional("0.25"), str("x"), sqltypes.NULL}},
+		{"value tuples", bindVariableBson([][]sqltypes.Value{{numeric("1")}, {numeric("18446744073709551615")}}), [][]sqltypes.Value{{numeric("1")}, {numeric("18446744073709551615")}}},
+	} {
+		bindVars := DecodeBindVariablesBson(bytes.NewBuffer(c.wire), bson.Object)
+		got, err := BindVariableToValue(bindVars["v"])
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %#v, want %#v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBindVariableToValueErrors(t *testing.T) {
+	for _, v := range []interface{}{
+		map[string]interface{}{"a": 1},
+		[]interface{}{[]interface{}{1}, 2},
+		[]interface{}{1, []interface{}{2}},
+		[]interface{}{[]interface{}{[]interface{}{1}}},
+	} {
+		if got, err := BindVariableToValue(v); err == nil {
+			t.Errorf("BindVariableToValue(%v) = %v, want an error", v, got)
+		}
+	}
+}
+
+func TestValidateBindVariables(t *testing.T) {
+	valid := map[string]interface{}{
+		"null":         nil,
+		"string":       "a",
+		"binary":       []byte("a"),
+		"int":          1,
+		"int32":        int32(1),
+		"int64":        int64(1),
+		"uint":         uint(1),
+		"uint32":       uint32(1),
+		"uint64":       uint64(1),
+		"float64":      1.5,
+		"bool":         true,
+		"time":         time.Now(),
+		"value":        str("a"),
+		"list":         []interface{}{1, "a", nil},
+		"int64 list":   []int64{1, 2},
+		"empty list":   []interface{}{},
+		"tuples":       []interface{}{[]interface{}{1, "a"}, []interface{}{2, "b"}},
+		"value list":   []sqltypes.Value{numeric("1")},
+		"value tuples": [][]sqltypes.Value{{numeric("1")}},
+	}
+	if err := ValidateBindVariables(valid); err != nil {
+		t.Errorf("ValidateBindVariables: %v", err)
+	}
+	for name, v := range valid {
+		if _, err := BindVariableToValue(v); err != nil {
+			t.Errorf("a valid %v must be converted: %v", name, err)
+		}
+	}
+
+	var nilPointer *int
+	for _, c := range []struct {
+		v       interface{}
+		element string
+		typ     string
+	}{
+		{int8(1), "", "int8"},
+		{int16(1), "", "int16"},
+		{uint8(1), "", "uint8"},
+		{uint16(1), "", "uint16"},
+		{float32(1), "", "float32"},
+		{nilPointer, "", "*int"},
+		{map[string]interface{}{"a": 1}, "", "map[string]interface {}"},
+		{struct{ A int }{1}, "", "struct { A int }"},
+		{make(chan int), "", "chan int"},
+		{func() {}, "", "func()"},
+		{[]interface{}{1, float32(2)}, "1", "float32"},
+		{[]interface{}{1, []interface{}{2}}, "1", "[]interface {}"},
+		{[]interface{}{[]interface{}{1}, 2}, "1", "int"},
+		{[]interface{}{[]interface{}{1, "a"}, []interface{}{2, map[string]int{}}}, "1.1", "map[string]int"},
+		{[]interface{}{[]interface{}{[]interface{}{1}}}, "0.0", "[]interface {}"},
+	} {
+		err := ValidateBindVariables(map[string]interface{}{"ok": 1, "v": c.v})
+		want := &BindVariableError{Name: "v", Element: c.element, Type: c.typ}
+		if !reflect.DeepEqual(err, want) {
+			t.Errorf("ValidateBindVariables(%#v) = %v, want %v", c.v, err, want)
+		}
+		if _, err := BindVariableToValue(c.v); err == nil {
+			t.Errorf("an invalid %#v must not be converted", c.v)
+		}
+	}
+
+	err := ValidateBindVariables(map[string]interface{}{"ids": []interface{}{1, make(chan int)}})
+	if want := "bad bind variable ids: element 1 has the unsupported type chan int"; err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
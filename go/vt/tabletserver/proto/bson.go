@@ -7,12 +7,13 @@ package proto
 import (
 	"bytes"
 	"fmt"
-	"math"
+	"strconv"
 	"time"
 
 	"github.com/youtube/vitess/go/bson"
 	"github.com/youtube/vitess/go/bytes2"
 	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
 )
 
 func (query *Query) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
@@ -23,6 +24,9 @@ func (query *Query) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	EncodeBindVariablesBson(buf, "BindVariables", query.BindVariables)
 	bson.EncodeInt64(buf, "TransactionId", query.TransactionId)
 	bson.EncodeInt64(buf, "SessionId", query.SessionId)
+	if query.CallerID != nil {
+		query.CallerID.MarshalBson(buf, "CallerID")
+	}
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
@@ -32,12 +36,101 @@ func EncodeBindVariablesBson(buf *bytes2.ChunkedWriter, key string, bindVars map
 	bson.EncodePrefix(buf, bson.Object, key)
 	lenWriter := bson.NewLenWriter(buf)
 	for k, v := range bindVars {
-		bson.EncodeField(buf, k, v)
+		encodeBindVariableBson(buf, k, v)
 	}
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
+// encodeBindVariableBson encodes the sqltypes values and lists of
+// values with the BSON type of their kind, and the other bind
+// variables as they are. Times are encoded as Datetimes. Lists are always encoded as arrays, even
+// when they're nil, so they decode back as lists.
+func encodeBindVariableBson(buf *bytes2.ChunkedWriter, key string, v interface{}) {
+	switch v := v.(type) {
+	case sqltypes.Value:
+		encodeValueBson(buf, key, v)
+	case time.Time:
+		bson.EncodeTime(buf, key, v)
+	case []interface{}:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, elem := range v {
+			encodeBindVariableBson(buf, bson.Itoa(i), elem)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	case []int64:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, elem := range v {
+			bson.EncodeInt64(buf, bson.Itoa(i), elem)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	case []string:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, elem := range v {
+			bson.EncodeString(buf, bson.Itoa(i), elem)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	case [][]byte:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, elem := range v {
+			encodeBindVariableBson(buf, bson.Itoa(i), elem)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	case []sqltypes.Value:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, value := range v {
+			encodeValueBson(buf, bson.Itoa(i), value)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	case [][]sqltypes.Value:
+		bson.EncodePrefix(buf, bson.Array, key)
+		lenWriter := bson.NewLenWriter(buf)
+		for i, tuple := range v {
+			encodeBindVariableBson(buf, bson.Itoa(i), tuple)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+	default:
+		bson.EncodeField(buf, key, v)
+	}
+}
+
+// encodeValueBson encodes a Numeric as a Long, or an Ulong if it
+// doesn't fit, a Fractional as a Number, a String as a Binary, and
+// NULL as a Null.
+func encodeValueBson(buf *bytes2.ChunkedWriter, key string, v sqltypes.Value) {
+	switch inner := v.Inner.(type) {
+	case nil:
+		bson.EncodePrefix(buf, bson.Null, key)
+		return
+	case sqltypes.Numeric:
+		if i, err := strconv.ParseInt(string(inner), 10, 64); err == nil {
+			bson.EncodeInt64(buf, key, i)
+			return
+		}
+		if u, err := strconv.ParseUint(string(inner), 10, 64); err == nil {
+			bson.EncodeUint64(buf, key, u)
+			return
+		}
+	case sqltypes.Fractional:
+		if f, err := strconv.ParseFloat(string(inner), 64); err == nil {
+			bson.EncodeFloat64(buf, key, f)
+			return
+		}
+	}
+	bson.EncodeBinary(buf, key, v.Raw())
+}
+
 func (query *Query) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
 	bson.Next(buf, 4)
@@ -54,6 +147,44 @@ func (query *Query) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			query.TransactionId = bson.DecodeInt64(buf, kind)
 		case "SessionId":
 			query.SessionId = bson.DecodeInt64(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				query.CallerID = new(CallerID)
+				query.CallerID.UnmarshalBson(buf, kind)
+			}
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+func (cid *CallerID) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Principal", cid.Principal)
+	bson.EncodeString(buf, "Component", cid.Component)
+	bson.EncodeString(buf, "Subcomponent", cid.Subcomponent)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func (cid *CallerID) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.Next(buf, 4)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		key := bson.ReadCString(buf)
+		switch key {
+		case "Principal":
+			cid.Principal = bson.DecodeString(buf, kind)
+		case "Component":
+			cid.Component = bson.DecodeString(buf, kind)
+		case "Subcomponent":
+			cid.Subcomponent = bson.DecodeString(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -70,41 +201,48 @@ func DecodeBindVariablesBson(buf *bytes.Buffer, kind byte) (bindVars map[string]
 	default:
 		panic(bson.NewBsonError("Unexpected data type %v for Query.BindVariables", kind))
 	}
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 	bindVars = make(map[string]interface{})
 	for kind := bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
 		key := bson.ReadCString(buf)
-		switch kind {
-		case bson.Number:
-			ui64 := bson.Pack.Uint64(buf.Next(8))
-			bindVars[key] = math.Float64frombits(ui64)
-		case bson.String:
-			l := int(bson.Pack.Uint32(buf.Next(4)))
-			bindVars[key] = buf.Next(l - 1)
-			buf.ReadByte()
-		case bson.Binary:
-			l := int(bson.Pack.Uint32(buf.Next(4)))
-			buf.ReadByte()
-			bindVars[key] = buf.Next(l)
-		case bson.Int:
-			bindVars[key] = int32(bson.Pack.Uint32(buf.Next(4)))
-		case bson.Long:
-			bindVars[key] = int64(bson.Pack.Uint64(buf.Next(8)))
-		case bson.Ulong:
-			bindVars[key] = bson.Pack.Uint64(buf.Next(8))
-		case bson.Datetime:
-			i64 := int64(bson.Pack.Uint64(buf.Next(8)))
-			// micro->nano->UTC
-			bindVars[key] = time.Unix(0, i64*1e6).UTC()
-		case bson.Null:
-			bindVars[key] = nil
-		default:
-			panic(bson.NewBsonError("don't know how to handle kind %v yet", kind))
-		}
+		bindVars[key] = decodeBindVariableBson(buf, kind)
 	}
 	return
 }
 
+// decodeBindVariableBson decodes a bind variable. Lists are decoded
+// as []interface{}, and so are the tuples of a list of tuples. An
+// empty list is decoded as an empty []interface{}, never as nil.
+func decodeBindVariableBson(buf *bytes.Buffer, kind byte) interface{} {
+	switch kind {
+	case bson.Number:
+		return bson.DecodeFloat64(buf, kind)
+	case bson.String, bson.Binary:
+		return bson.DecodeBinary(buf, kind)
+	case bson.Boolean:
+		return bson.DecodeBool(buf, kind)
+	case bson.Int:
+		return bson.DecodeInt32(buf, kind)
+	case bson.Long:
+		return bson.DecodeInt64(buf, kind)
+	case bson.Ulong:
+		return bson.DecodeUint64(buf, kind)
+	case bson.Datetime:
+		return bson.DecodeTime(buf, kind)
+	case bson.Null:
+		return nil
+	case bson.Array:
+		bson.ReadDocumentLength(buf)
+		list := make([]interface{}, 0, 8)
+		for kind := bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
+			bson.SkipIndex(buf)
+			list = append(list, decodeBindVariableBson(buf, kind))
+		}
+		return list
+	}
+	panic(bson.NewBsonError("don't know how to handle kind %v yet", kind))
+}
+
 // String prints a readable version of Query, and also truncates
 // data if it's too long
 func (query *Query) String() string {
@@ -232,6 +370,9 @@ func (ql *QueryList) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	EncodeQueriesBson(ql.Queries, "Queries", buf)
 	bson.EncodeInt64(buf, "TransactionId", ql.TransactionId)
 	bson.EncodeInt64(buf, "SessionId", ql.SessionId)
+	if ql.CallerID != nil {
+		ql.CallerID.MarshalBson(buf, "CallerID")
+	}
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
@@ -251,6 +392,11 @@ func (ql *QueryList) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			ql.TransactionId = bson.DecodeInt64(buf, kind)
 		case "SessionId":
 			ql.SessionId = bson.DecodeInt64(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				ql.CallerID = new(CallerID)
+				ql.CallerID.UnmarshalBson(buf, kind)
+			}
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -5,7 +5,11 @@
 package proto
 
 import (
+	"math"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/youtube/vitess/go/bson"
 )
@@ -260,3 +264,205 @@ func TestQueryList(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+type reflectCallerQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	TransactionId int64
+	SessionId     int64
+	CallerID      *CallerID
+}
+
+func TestQueryCallerID(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectCallerQuery{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		CallerID: &CallerID{
+			Principal:    "user",
+			Component:    "app",
+			Subcomponent: "report",
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := Query{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		CallerID: &CallerID{
+			Principal:    "user",
+			Component:    "app",
+			Subcomponent: "report",
+		},
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled Query
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if unmarshalled.CallerID == nil || *unmarshalled.CallerID != *custom.CallerID {
+		t.Errorf("want %#v, got %#v", custom.CallerID, unmarshalled.CallerID)
+	}
+
+	// Servers that predate CallerID skip it.
+	var old reflectQuery
+	err = bson.Unmarshal(encoded, &old)
+	if err != nil {
+		t.Error(err)
+	}
+	if old.Sql != custom.Sql {
+		t.Errorf("want %v, got %v", custom.Sql, old.Sql)
+	}
+
+	// A Query without CallerID doesn't encode it.
+	encoded, err = bson.Marshal(&Query{Sql: "query"})
+	if err != nil {
+		t.Error(err)
+	}
+	unmarshalled = Query{}
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if unmarshalled.CallerID != nil {
+		t.Errorf("want nil, got %#v", unmarshalled.CallerID)
+	}
+}
+
+func TestQueryListCallerID(t *testing.T) {
+	custom := QueryList{
+		Queries: []BoundQuery{{
+			Sql:           "query",
+			BindVariables: map[string]interface{}{"val": int64(1)},
+		}},
+		CallerID: &CallerID{Principal: "user"},
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	var unmarshalled QueryList
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if unmarshalled.CallerID == nil || *unmarshalled.CallerID != *custom.CallerID {
+		t.Errorf("want %#v, got %#v", custom.CallerID, unmarshalled.CallerID)
+	}
+}
+
+func TestBindVariableLists(t *testing.T) {
+	testcases := []struct {
+		desc string
+		in   interface{}
+		out  interface{}
+	}{
+		{"int64s", []int64{1, -2}, []interface{}{int64(1), int64(-2)}},
+		{"strings", []string{"a", ""}, []interface{}{[]byte("a"), []byte("")}},
+		{"binaries", [][]byte{[]byte("a"), nil}, []interface{}{[]byte("a"), nil}},
+		{
+			"mixed",
+			[]interface{}{int64(1), uint64(2), 1.5, "a", []byte("b"), nil, []interface{}{int64(3), nil}},
+			[]interface{}{int64(1), uint64(2), 1.5, []byte("a"), []byte("b"), nil, []interface{}{int64(3), nil}},
+		},
+		{"empty", []interface{}{}, []interface{}{}},
+		{"empty int64s", []int64{}, []interface{}{}},
+		{"nil int64s", []int64(nil), []interface{}{}},
+		{"nil list", []interface{}(nil), []interface{}{}},
+	}
+	for _, tcase := range testcases {
+		encoded, err := bson.Marshal(&BoundQuery{
+			Sql:           "select * from a where id in ::ids",
+			BindVariables: map[string]interface{}{"ids": tcase.in},
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tcase.desc, err)
+			continue
+		}
+		var unmarshalled BoundQuery
+		if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+			t.Errorf("%s: %v", tcase.desc, err)
+			continue
+		}
+		got := unmarshalled.BindVariables["ids"]
+		if !reflect.DeepEqual(got, tcase.out) {
+			t.Errorf("%s: got %#v, want %#v", tcase.desc, got, tcase.out)
+		}
+	}
+}
+
+func TestBindVariableTimes(t *testing.T) {
+	testcases := []struct {
+		desc string
+		in   time.Time
+		out  time.Time
+	}{
+		{"UTC", time.Date(2014, 5, 6, 7, 8, 9, 123e6, time.UTC), time.Date(2014, 5, 6, 7, 8, 9, 123e6, time.UTC)},
+		{"not UTC", time.Date(2014, 5, 6, 7, 8, 9, 0, time.FixedZone("X", 7200)), time.Date(2014, 5, 6, 5, 8, 9, 0, time.UTC)},
+		{"microseconds", time.Date(2014, 5, 6, 7, 8, 9, 123456e3, time.UTC), time.Date(2014, 5, 6, 7, 8, 9, 123e6, time.UTC)},
+		{"before 1970", time.Date(1950, 1, 2, 3, 4, 5, 600e6, time.UTC), time.Date(1950, 1, 2, 3, 4, 5, 600e6, time.UTC)},
+		{"zero", time.Time{}, time.Time{}},
+	}
+	for _, tcase := range testcases {
+		encoded, err := bson.Marshal(&BoundQuery{
+			Sql:           "select * from a where t = :t",
+			BindVariables: map[string]interface{}{"t": tcase.in, "ts": []interface{}{tcase.in}},
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tcase.desc, err)
+			continue
+		}
+		var unmarshalled BoundQuery
+		if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+			t.Errorf("%s: %v", tcase.desc, err)
+			continue
+		}
+		want := map[string]interface{}{"t": tcase.out, "ts": []interface{}{tcase.out}}
+		if !reflect.DeepEqual(unmarshalled.BindVariables, want) {
+			t.Errorf("%s: got %#v, want %#v", tcase.desc, unmarshalled.BindVariables, want)
+		}
+	}
+}
+
+func TestBindVariableUint64s(t *testing.T) {
+	for _, v := range []uint64{0, math.MaxInt64, math.MaxInt64 + 1, math.MaxUint64} {
+		encoded, err := bson.Marshal(&BoundQuery{
+			Sql:           "select * from a where h = :h",
+			BindVariables: map[string]interface{}{"h": v, "hs": []interface{}{v}, "value": numeric(strconv.FormatUint(v, 10))},
+		})
+		if err != nil {
+			t.Errorf("%v: %v", v, err)
+			continue
+		}
+		var unmarshalled BoundQuery
+		if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+			t.Errorf("%v: %v", v, err)
+			continue
+		}
+		if got := unmarshalled.BindVariables["h"]; got != v {
+			t.Errorf("got %#v, want %#v", got, v)
+		}
+		if got, want := unmarshalled.BindVariables["hs"], []interface{}{v}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+		// Numeric values are encoded as Longs when they fit.
+		var want interface{} = v
+		if v <= math.MaxInt64 {
+			want = int64(v)
+		}
+		if got := unmarshalled.BindVariables["value"]; got != want {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+}
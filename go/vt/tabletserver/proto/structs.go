@@ -17,11 +17,22 @@ type SessionInfo struct {
 	SessionId int64
 }
 
+// CallerID names who a query runs for, as reported by the client
+// that sent it to vtgate. It is only used for auditing and throttling,
+// and is not authenticated.
+type CallerID struct {
+	Principal    string
+	Component    string
+	Subcomponent string
+}
+
 type Query struct {
 	Sql           string
 	BindVariables map[string]interface{}
 	SessionId     int64
 	TransactionId int64
+	// CallerID is optional.
+	CallerID *CallerID
 }
 
 type BoundQuery struct {
@@ -33,6 +44,8 @@ type QueryList struct {
 	Queries       []BoundQuery
 	SessionId     int64
 	TransactionId int64
+	// CallerID is optional.
+	CallerID *CallerID
 }
 
 type QueryResultList struct {
@@ -33,6 +33,7 @@ var (
 			<th>Misses</th>
 			<th>Absent</th>
 			<th>Invalidations</th>
+			<th>Caller</th>
 		</tr>
 	`)
 	querylogzTmpl = template.Must(template.New("example").Parse(`
@@ -54,6 +55,7 @@ var (
 			<td>{{.Misses}}</td>
 			<td>{{.Absent}}</td>
 			<td>{{.Invalidations}}</td>
+			<td>{{.CallerID}}</td>
 		</tr>
 	`))
 )
@@ -76,6 +78,7 @@ type querylogzRow struct {
 	Misses        string
 	Absent        string
 	Invalidations string
+	CallerID      string
 	Color         string
 }
 
@@ -97,7 +100,7 @@ func querylogzHandler(w http.ResponseWriter, r *http.Request) {
 		select {
 		case out := <-ch:
 			strs := strings.Split(strings.Trim(out, "\n"), "\t")
-			if len(strs) < 19 {
+			if len(strs) < 20 {
 				querylogzTmpl.Execute(w, &querylogzRow{Method: fmt.Sprintf("Short: %d", len(strs))})
 				continue
 			}
@@ -119,6 +122,7 @@ func querylogzHandler(w http.ResponseWriter, r *http.Request) {
 				Misses:        strs[16],
 				Absent:        strs[17],
 				Invalidations: strs[18],
+				CallerID:      strings.Trim(strs[19], "\""),
 			}
 			duration, _ := strconv.ParseFloat(Value.Duration, 64)
 			if duration < 0.01 {
@@ -51,6 +51,8 @@ var stateName = map[int64]string{
 type Context struct {
 	RemoteAddr string
 	Username   string
+	// CallerID is the caller named by the client of vtgate, or nil.
+	CallerID *proto.CallerID
 }
 
 type SqlQuery struct {
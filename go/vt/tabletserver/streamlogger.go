@@ -147,11 +147,21 @@ func (log *sqlQueryStats) Username() string {
 	return log.context.Username
 }
 
+// CallerID returns the caller the client of vtgate named, as
+// principal/component/subcomponent, or "" if it named none.
+func (log *sqlQueryStats) CallerID() string {
+	cid := log.context.CallerID
+	if cid == nil {
+		return ""
+	}
+	return cid.Principal + "/" + cid.Component + "/" + cid.Subcomponent
+}
+
 // String returns a tab separated list of logged fields.
 func (log *sqlQueryStats) Format(params url.Values) string {
 	_, fullBindParams := params["full"]
 	return fmt.Sprintf(
-		"%v\t%v\t%v\t%v\t%v\t%.6f\t%v\t%q\t%v\t%v\t%q\t%v\t%.6f\t%.6f\t%v\t%v\t%v\t%v\t%v\t\n",
+		"%v\t%v\t%v\t%v\t%v\t%.6f\t%v\t%q\t%v\t%v\t%q\t%v\t%.6f\t%.6f\t%v\t%v\t%v\t%v\t%v\t%q\t\n",
 		log.Method,
 		log.RemoteAddr(),
 		log.Username(),
@@ -170,5 +180,6 @@ func (log *sqlQueryStats) Format(params url.Values) string {
 		log.CacheHits,
 		log.CacheMisses,
 		log.CacheAbsent,
-		log.CacheInvalidations)
+		log.CacheInvalidations,
+		log.CallerID())
 }
@@ -6,6 +6,7 @@ package tabletconn
 
 import (
 	"flag"
+	"fmt"
 	"time"
 
 	log "github.com/golang/glog"
@@ -20,6 +21,15 @@ const (
 	ERR_FATAL
 	ERR_TX_POOL_FULL
 	ERR_NOT_IN_TX
+
+	// ERR_OVERLOADED is only returned by vtgate, for the requests it
+	// rejects without running them to shed load. They can be
+	// retried after backing off.
+	ERR_OVERLOADED
+
+	// ERR_PERMISSION_DENIED is only returned by vtgate, for the
+	// requests its access control rejects, see -access_control_file.
+	ERR_PERMISSION_DENIED
 )
 
 const (
@@ -51,6 +61,44 @@ func (e OperationalError) Error() string { return string(e) }
 // protocol and outgoing protocols support forwarding information, use
 // context.
 
+// RequestContext is the context of the calls made for a request
+// that names its caller or has a deadline: Context is the context of
+// the request, CallerID is sent to vttablet with the queries, and the
+// calls give up at Deadline if it is set.
+type RequestContext struct {
+	Context  interface{}
+	CallerID *tproto.CallerID
+	Deadline time.Time
+}
+
+func (ctx *RequestContext) String() string {
+	s := fmt.Sprintf("%v", ctx.Context)
+	if ctx.CallerID != nil {
+		s += fmt.Sprintf(", caller: %v", *ctx.CallerID)
+	}
+	if !ctx.Deadline.IsZero() {
+		s += fmt.Sprintf(", deadline: %v", ctx.Deadline)
+	}
+	return s
+}
+
+// CallerID returns the caller carried by context, or nil.
+func CallerID(context interface{}) *tproto.CallerID {
+	if ctx, ok := context.(*RequestContext); ok {
+		return ctx.CallerID
+	}
+	return nil
+}
+
+// Deadline returns the deadline carried by context, or the zero
+// time if it has none.
+func Deadline(context interface{}) time.Time {
+	if ctx, ok := context.(*RequestContext); ok {
+		return ctx.Deadline
+	}
+	return time.Time{}
+}
+
 // TabletDialer represents a function that will return a TabletConn object that can communicate with a tablet.
 type TabletDialer func(context interface{}, endPoint topo.EndPoint, keyspace, shard string, timeout time.Duration) (TabletConn, error)
 
@@ -60,6 +108,10 @@ type TabletConn interface {
 	// Execute executes a non-streaming query on vttablet.
 	Execute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.QueryResult, error)
 
+	// ExecuteLazy is like Execute, but doesn't decode the rows of the
+	// result, for callers that only pass them through.
+	ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.LazyQueryResult, error)
+
 	// ExecuteBatch executes a group of queries.
 	ExecuteBatch(context interface{}, queries []tproto.BoundQuery, transactionId int64) (*tproto.QueryResultList, error)
 
@@ -41,6 +41,11 @@ var (
 	// ErrPartialResult is returned by a function that could only
 	// get a subset of its results
 	ErrPartialResult = errors.New("partial result")
+
+	// ErrUnreachable is returned by functions that couldn't reach
+	// the topology server of a cell: the connection failed or timed
+	// out. The other calls to the same cell are likely to fail too.
+	ErrUnreachable = errors.New("topology server unreachable")
 )
 
 // topo.Server is the interface used to talk to a persistent
@@ -90,6 +95,11 @@ type Server interface {
 	// Use with caution.
 	DeleteKeyspaceShards(keyspace string) error
 
+	// DeleteKeyspace deletes the keyspace record, with its locks
+	// and action log. Its shards should be deleted first.
+	// Can return ErrNoNode if the keyspace doesn't exist.
+	DeleteKeyspace(keyspace string) error
+
 	//
 	// Shard management, global.
 	//
@@ -187,7 +197,8 @@ type Server interface {
 	GetShardReplication(cell, keyspace, shard string) (*ShardReplicationInfo, error)
 
 	// DeleteShardReplication deletes the replication data.
-	// Can return ErrNoNode if the object doesn't exist.
+	// Can return ErrNoNode if the object doesn't exist, and
+	// ErrUnreachable if the cell can't be reached.
 	DeleteShardReplication(cell, keyspace, shard string) error
 
 	//
@@ -210,7 +221,7 @@ type Server interface {
 
 	// DeleteSrvTabletType deletes the serving records for a cell,
 	// keyspace, shard, tabletType.
-	// Can return ErrNoNode.
+	// Can return ErrNoNode and ErrUnreachable.
 	DeleteSrvTabletType(cell, keyspace, shard string, tabletType TabletType) error
 
 	// UpdateSrvShard updates the serving records for a cell,
@@ -222,7 +233,7 @@ type Server interface {
 	GetSrvShard(cell, keyspace, shard string) (*SrvShard, error)
 
 	// DeleteSrvShard deletes a SrvShard record.
-	// Can return ErrNoNode.
+	// Can return ErrNoNode and ErrUnreachable.
 	DeleteSrvShard(cell, keyspace, shard string) error
 
 	// UpdateSrvKeyspace updates the serving records for a cell, keyspace.
@@ -232,6 +243,11 @@ type Server interface {
 	// Can return ErrNoNode.
 	GetSrvKeyspace(cell, keyspace string) (*SrvKeyspace, error)
 
+	// DeleteSrvKeyspace deletes a SrvKeyspace record, with the
+	// serving records of its shards that are left in the cell.
+	// Can return ErrNoNode and ErrUnreachable.
+	DeleteSrvKeyspace(cell, keyspace string) error
+
 	// GetSrvKeyspaceNames returns the list of visible Keyspaces
 	// in this cell. They shall be sorted.
 	GetSrvKeyspaceNames(cell string) ([]string, error)
@@ -254,7 +270,9 @@ type Server interface {
 	// Can return ErrTimeout or ErrInterrupted
 	LockKeyspaceForAction(keyspace, contents string, timeout time.Duration, interrupted chan struct{}) (string, error)
 
-	// UnlockKeyspaceForAction unlocks a keyspace.
+	// UnlockKeyspaceForAction unlocks a keyspace, after storing
+	// results, the final contents of the action. It keeps the
+	// lock if the results can't be stored.
 	UnlockKeyspaceForAction(keyspace, lockPath, results string) error
 
 	// LockShardForAction locks the shard in order to
@@ -265,9 +283,51 @@ type Server interface {
 	// Can return ErrTimeout or ErrInterrupted
 	LockShardForAction(keyspace, shard, contents string, timeout time.Duration, interrupted chan struct{}) (string, error)
 
-	// UnlockShardForAction unlocks a shard.
+	// UpdateShardActionLock replaces the contents of the shard
+	// lock held with lockPath, so a long action can report it is
+	// still alive. Can return ErrNoNode if the lock is not held.
+	UpdateShardActionLock(keyspace, shard, lockPath, contents string) error
+
+	// UnlockShardForAction unlocks a shard, after storing results,
+	// the final contents of the action. It keeps the lock if the
+	// results can't be stored.
 	UnlockShardForAction(keyspace, shard, lockPath, results string) error
 
+	// ForceUnlockShard removes the action holding the shard lock
+	// if its contents are still contents, for when the process
+	// holding it died. It returns ErrNoNode if the shard is not
+	// locked, and ErrBadVersion if another action holds the lock.
+	ForceUnlockShard(keyspace, shard, contents string) error
+
+	// GetShardActionNodes returns the contents of the actions
+	// holding or waiting for the shard lock, the one holding it
+	// first. It is empty if the shard is not locked. It doesn't
+	// take the lock.
+	GetShardActionNodes(keyspace, shard string) ([]string, error)
+
+	//
+	// Keyspace and Shard action logs, global. They are bounded,
+	// and kept apart from the results stored by the unlocks.
+	//
+
+	// AppendKeyspaceActionLog adds contents as the most recent
+	// entry of the keyspace action log, then removes the oldest
+	// entries so at most maxEntries are kept (0 means no limit).
+	AppendKeyspaceActionLog(keyspace, contents string, maxEntries int) error
+
+	// GetKeyspaceActionLog returns the keyspace action log
+	// entries, most recent first.
+	GetKeyspaceActionLog(keyspace string) ([]string, error)
+
+	// AppendShardActionLog adds contents as the most recent
+	// entry of the shard action log, then removes the oldest
+	// entries so at most maxEntries are kept (0 means no limit).
+	AppendShardActionLog(keyspace, shard, contents string, maxEntries int) error
+
+	// GetShardActionLog returns the shard action log entries,
+	// most recent first.
+	GetShardActionLog(keyspace, shard string) ([]string, error)
+
 	//
 	// Remote Tablet Actions, local cell.
 	//
@@ -46,6 +46,21 @@ func (source *SourceShard) String() string {
 	return fmt.Sprintf("SourceShard(%v,%v/%v)", source.Uid, source.Keyspace, source.Shard)
 }
 
+// TabletControl tells the tablets of a type in a shard to restrict
+// what they serve, e.g. to stop serving the tables of a vertical split
+// to rdonly clients. It is stored in Shard.TabletControlMap.
+type TabletControl struct {
+	// Cells the control applies to, all the cells if empty.
+	Cells []string
+
+	// DisableQueryService stops the query service of the tablets.
+	DisableQueryService bool
+
+	// BlacklistedTables are not served by the tablets. They can't be
+	// set with DisableQueryService.
+	BlacklistedTables []string
+}
+
 // A pure data struct for information stored in topology server.  This
 // node is used to present a controlled view of the shard, unaware of
 // every management action. It also contains configuration data for a
@@ -71,15 +86,39 @@ type Shard struct {
 	// It is populated at InitTablet time when a tabelt is added
 	// in a cell that is not in the list yet.
 	Cells []string
+
+	// TabletControlMap has the TabletControl of each tablet type
+	// whose tablets don't serve everything, see
+	// ShardInfo.UpdateTabletControl.
+	TabletControlMap map[TabletType]*TabletControl
 }
 
 func newShard() *Shard {
 	return &Shard{}
 }
 
+// CanonicalShardName returns the form of a shard name stored in the
+// topology: surrounding spaces are trimmed, and the hex bounds of key
+// range names are upper case, so "80-c0" is "80-C0". "0" and custom
+// names are returned as is.
+func CanonicalShardName(shard string) string {
+	shard = strings.TrimSpace(shard)
+	parts := strings.Split(shard, "-")
+	if len(parts) != 2 {
+		return shard
+	}
+	for _, part := range parts {
+		if _, err := key.HexKeyspaceId(part).Unhex(); err != nil {
+			return shard
+		}
+	}
+	return strings.ToUpper(shard)
+}
+
 // ValidateShardName takes a shard name and sanitizes it, and also returns
 // the KeyRange.
 func ValidateShardName(shard string) (string, key.KeyRange, error) {
+	shard = strings.TrimSpace(shard)
 	if !strings.Contains(shard, "-") {
 		return shard, key.KeyRange{}, nil
 	}
@@ -98,7 +137,7 @@ func ValidateShardName(shard string) (string, key.KeyRange, error) {
 		return "", key.KeyRange{}, fmt.Errorf("Out of order keys: %v is not strictly smaller than %v", keyRange.Start.Hex(), keyRange.End.Hex())
 	}
 
-	return strings.ToUpper(shard), keyRange, nil
+	return CanonicalShardName(shard), keyRange, nil
 }
 
 // HasCell returns true if the cell is listed in the Cells for the shard.
@@ -129,6 +168,99 @@ func (si *ShardInfo) ShardName() string {
 	return si.shardName
 }
 
+// GetTabletControl returns the TabletControl of tabletType, or nil.
+func (si *ShardInfo) GetTabletControl(tabletType TabletType) *TabletControl {
+	return si.TabletControlMap[tabletType]
+}
+
+// UpdateTabletControl merges a control of tabletType in cells, all
+// the cells if empty, with the existing one: the cells are added to
+// it, the blacklisted tables have to be the same. With remove, the
+// cells are removed from the control instead, and the control is
+// removed once it has no cell left, or if cells is empty.
+// DisableQueryService and blacklisted tables can't be combined.
+func (si *ShardInfo) UpdateTabletControl(tabletType TabletType, cells []string, remove, disableQueryService bool, tables []string) error {
+	tc := si.TabletControlMap[tabletType]
+	if remove {
+		if disableQueryService || len(tables) > 0 {
+			return fmt.Errorf("cannot set the query service or the blacklisted tables when removing the control of %v", tabletType)
+		}
+		if tc == nil {
+			return nil
+		}
+		if len(cells) > 0 && len(tc.Cells) == 0 {
+			return fmt.Errorf("the control of %v applies to all the cells, it can only be removed from all of them", tabletType)
+		}
+		if len(cells) > 0 {
+			tc.Cells = removeCells(tc.Cells, cells)
+		}
+		if len(cells) == 0 || len(tc.Cells) == 0 {
+			delete(si.TabletControlMap, tabletType)
+		}
+		return nil
+	}
+
+	if disableQueryService && len(tables) > 0 {
+		return fmt.Errorf("cannot both disable the query service and blacklist tables of %v", tabletType)
+	}
+	if !disableQueryService && len(tables) == 0 {
+		return fmt.Errorf("nothing to control for %v, use remove to remove its control", tabletType)
+	}
+	if tc == nil {
+		if si.TabletControlMap == nil {
+			si.TabletControlMap = make(map[TabletType]*TabletControl)
+		}
+		si.TabletControlMap[tabletType] = &TabletControl{
+			Cells:               cells,
+			DisableQueryService: disableQueryService,
+			BlacklistedTables:   tables,
+		}
+		return nil
+	}
+	if tc.DisableQueryService != disableQueryService || !sameTables(tc.BlacklistedTables, tables) {
+		return fmt.Errorf("%v already has a different control (query service disabled: %v, blacklisted tables: %v)", tabletType, tc.DisableQueryService, tc.BlacklistedTables)
+	}
+	if len(cells) == 0 || len(tc.Cells) == 0 {
+		tc.Cells = nil
+		return nil
+	}
+	for _, cell := range cells {
+		if !InCellList(cell, tc.Cells) {
+			tc.Cells = append(tc.Cells, cell)
+		}
+	}
+	return nil
+}
+
+// removeCells returns the cells of list that are not in toRemove.
+func removeCells(list, toRemove []string) []string {
+	var result []string
+	for _, cell := range list {
+		if !InCellList(cell, toRemove) {
+			result = append(result, cell)
+		}
+	}
+	return result
+}
+
+// sameTables returns true if both lists have the same tables, in any
+// order.
+func sameTables(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	tables := make(map[string]bool, len(left))
+	for _, table := range left {
+		tables[table] = true
+	}
+	for _, table := range right {
+		if !tables[table] {
+			return false
+		}
+	}
+	return true
+}
+
 // NewShardInfo returns a ShardInfo basing on shard with the
 // keyspace / shard. This function should be only used by Server
 // implementations.
@@ -0,0 +1,154 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package topo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/jscfg"
+)
+
+func TestCanonicalShardName(t *testing.T) {
+	for shard, want := range map[string]string{
+		"0":          "0",
+		" 0\t":       "0",
+		"80-C0":      "80-C0",
+		"80-c0":      "80-C0",
+		" -a0 ":      "-A0",
+		"c0-":        "C0-",
+		"custom":     "custom",
+		"my-shard":   "my-shard",
+		"80-c0-e0":   "80-c0-e0",
+		"abcdef-xyz": "abcdef-xyz",
+	} {
+		if got := CanonicalShardName(shard); got != want {
+			t.Errorf("CanonicalShardName(%q) = %q, want %q", shard, got, want)
+		}
+	}
+
+	name, _, err := ValidateShardName(" 80-c0")
+	if err != nil || name != "80-C0" {
+		t.Errorf("ValidateShardName(\" 80-c0\") = %q, %v", name, err)
+	}
+}
+
+func TestUpdateTabletControl(t *testing.T) {
+	si := NewShardInfo("ks", "0", &Shard{})
+	check := func(want string) {
+		if got := tabletControlString(si); got != want {
+			t.Errorf("want controls %v, got %v", want, got)
+		}
+	}
+
+	for _, c := range []struct {
+		remove, disableQueryService bool
+		tables                      []string
+	}{
+		{false, true, []string{"t1"}},
+		{false, false, nil},
+		{true, true, nil},
+		{true, false, []string{"t1"}},
+	} {
+		if err := si.UpdateTabletControl(TYPE_RDONLY, nil, c.remove, c.disableQueryService, c.tables); err == nil {
+			t.Errorf("UpdateTabletControl(%v, %v, %v) worked", c.remove, c.disableQueryService, c.tables)
+		}
+	}
+	if err := si.UpdateTabletControl(TYPE_RDONLY, []string{"cell1"}, true, false, nil); err != nil {
+		t.Errorf("removing a missing control failed: %v", err)
+	}
+	check("")
+
+	// the cells of the same control are merged
+	if err := si.UpdateTabletControl(TYPE_RDONLY, []string{"cell1"}, false, false, []string{"t1", "t2"}); err != nil {
+		t.Fatalf("UpdateTabletControl failed: %v", err)
+	}
+	if err := si.UpdateTabletControl(TYPE_RDONLY, []string{"cell2", "cell1"}, false, false, []string{"t2", "t1"}); err != nil {
+		t.Fatalf("UpdateTabletControl failed: %v", err)
+	}
+	if err := si.UpdateTabletControl(TYPE_REPLICA, nil, false, true, nil); err != nil {
+		t.Fatalf("UpdateTabletControl failed: %v", err)
+	}
+	check("rdonly:[cell1 cell2]:false:[t1 t2] replica:[]:true:[]")
+
+	// a different control of the same type is refused
+	for _, c := range []struct {
+		tabletType          TabletType
+		disableQueryService bool
+		tables              []string
+	}{
+		{TYPE_RDONLY, false, []string{"t1"}},
+		{TYPE_RDONLY, true, nil},
+		{TYPE_REPLICA, false, []string{"t1"}},
+	} {
+		if err := si.UpdateTabletControl(c.tabletType, []string{"cell3"}, false, c.disableQueryService, c.tables); err == nil || !strings.Contains(err.Error(), "already has a different control") {
+			t.Errorf("UpdateTabletControl(%v, %v, %v) returned %v", c.tabletType, c.disableQueryService, c.tables, err)
+		}
+	}
+	check("rdonly:[cell1 cell2]:false:[t1 t2] replica:[]:true:[]")
+
+	// a control of all the cells is only removed from all of them
+	if err := si.UpdateTabletControl(TYPE_REPLICA, []string{"cell1"}, true, false, nil); err == nil {
+		t.Errorf("removing a control of all the cells from cell1 worked")
+	}
+	if err := si.UpdateTabletControl(TYPE_REPLICA, nil, true, false, nil); err != nil {
+		t.Errorf("UpdateTabletControl failed: %v", err)
+	}
+	if err := si.UpdateTabletControl(TYPE_RDONLY, []string{"cell1"}, true, false, nil); err != nil {
+		t.Errorf("UpdateTabletControl failed: %v", err)
+	}
+	check("rdonly:[cell2]:false:[t1 t2]")
+	if tc := si.GetTabletControl(TYPE_RDONLY); tc == nil || len(tc.Cells) != 1 {
+		t.Errorf("GetTabletControl(rdonly) returned %v", tc)
+	}
+	if err := si.UpdateTabletControl(TYPE_RDONLY, []string{"cell2"}, true, false, nil); err != nil {
+		t.Errorf("UpdateTabletControl failed: %v", err)
+	}
+	check("")
+	if tc := si.GetTabletControl(TYPE_RDONLY); tc != nil {
+		t.Errorf("GetTabletControl(rdonly) returned %v", tc)
+	}
+}
+
+// tabletControlString returns the controls of a shard, sorted by type.
+func tabletControlString(si *ShardInfo) string {
+	var controls []string
+	for tabletType, tc := range si.TabletControlMap {
+		controls = append(controls, fmt.Sprintf("%v:%v:%v:%v", tabletType, tc.Cells, tc.DisableQueryService, tc.BlacklistedTables))
+	}
+	sort.Strings(controls)
+	return strings.Join(controls, " ")
+}
+
+func TestShardTabletControlJson(t *testing.T) {
+	shard := &Shard{
+		ServedTypes: []TabletType{TYPE_MASTER},
+		TabletControlMap: map[TabletType]*TabletControl{
+			TYPE_RDONLY:  {Cells: []string{"cell1"}, BlacklistedTables: []string{"t1"}},
+			TYPE_REPLICA: {DisableQueryService: true},
+		},
+	}
+	data := jscfg.ToJson(shard)
+	got := new(Shard)
+	if err := json.Unmarshal([]byte(data), got); err != nil {
+		t.Fatalf("cannot decode %v: %v", data, err)
+	}
+	if !reflect.DeepEqual(got, shard) {
+		t.Errorf("want %+v, got %+v", shard, got)
+	}
+
+	// the shards written before TabletControlMap have no control
+	got = new(Shard)
+	if err := json.Unmarshal([]byte(`{"ServedTypes": ["master"]}`), got); err != nil {
+		t.Fatalf("cannot decode an old shard: %v", err)
+	}
+	if tc := NewShardInfo("ks", "0", got).GetTabletControl(TYPE_RDONLY); tc != nil {
+		t.Errorf("want no control, got %v", tc)
+	}
+}
@@ -81,4 +81,17 @@ func CheckKeyspace(t *testing.T, ts topo.Server) {
 		ki.ServedFrom[topo.TYPE_REPLICA] != "test_keyspace4" {
 		t.Errorf("GetKeyspace: unexpected keyspace, got %v", *ki)
 	}
+
+	if err := ts.DeleteKeyspace("test_keyspace2"); err != nil {
+		t.Errorf("DeleteKeyspace: %v", err)
+	}
+	if _, err := ts.GetKeyspace("test_keyspace2"); err != topo.ErrNoNode {
+		t.Errorf("GetKeyspace(deleted): %v", err)
+	}
+	if keyspaces, err := ts.GetKeyspaces(); err != nil || len(keyspaces) != 1 || keyspaces[0] != "test_keyspace" {
+		t.Errorf("GetKeyspaces(after DeleteKeyspace): %v %v", keyspaces, err)
+	}
+	if err := ts.DeleteKeyspace("test_keyspace2"); err != topo.ErrNoNode {
+		t.Errorf("DeleteKeyspace(again): %v", err)
+	}
 }
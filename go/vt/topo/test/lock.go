@@ -61,11 +61,20 @@ func CheckShardLock(t *testing.T, ts topo.Server) {
 	}
 
 	interrupted := make(chan struct{}, 1)
+	if nodes, err := ts.GetShardActionNodes("test_keyspace", "10-20"); err != nil || len(nodes) != 0 {
+		t.Errorf("GetShardActionNodes(unlocked): %v %v", nodes, err)
+	}
+
 	lockPath, err := ts.LockShardForAction("test_keyspace", "10-20", "fake-content", 5*time.Second, interrupted)
 	if err != nil {
 		t.Fatalf("LockShardForAction: %v", err)
 	}
 
+	// test we can see who holds the lock
+	if nodes, err := ts.GetShardActionNodes("test_keyspace", "10-20"); err != nil || len(nodes) != 1 || nodes[0] != "fake-content" {
+		t.Errorf("GetShardActionNodes(locked): %v %v", nodes, err)
+	}
+
 	// test we can't take the lock again
 	if _, err := ts.LockShardForAction("test_keyspace", "10-20", "unused-fake-content", time.Second/2, interrupted); err != topo.ErrTimeout {
 		t.Errorf("LockShardForAction(again): %v", err)
@@ -80,18 +89,87 @@ func CheckShardLock(t *testing.T, ts topo.Server) {
 		t.Errorf("LockShardForAction(interrupted): %v", err)
 	}
 
+	// test we can update the lock while we hold it
+	if err := ts.UpdateShardActionLock("test_keyspace", "10-20", lockPath, "updated-fake-content"); err != nil {
+		t.Errorf("UpdateShardActionLock(): %v", err)
+	}
+
 	if err := ts.UnlockShardForAction("test_keyspace", "10-20", lockPath, "fake-results"); err != nil {
 		t.Errorf("UnlockShardForAction(): %v", err)
 	}
 
+	if nodes, err := ts.GetShardActionNodes("test_keyspace", "10-20"); err != nil || len(nodes) != 0 {
+		t.Errorf("GetShardActionNodes(after unlock): %v %v", nodes, err)
+	}
+
+	// test we can't update the lock once released
+	if err := ts.UpdateShardActionLock("test_keyspace", "10-20", lockPath, "updated-fake-content"); err != topo.ErrNoNode {
+		t.Errorf("UpdateShardActionLock(after unlock): %v", err)
+	}
+
 	// test we can't unlock again
 	if err := ts.UnlockShardForAction("test_keyspace", "10-20", lockPath, "fake-results"); err == nil {
 		t.Error("UnlockShardForAction(again) worked")
 	}
 
+	// test the lock can be broken, only by its holder contents
+	if _, err := ts.LockShardForAction("test_keyspace", "10-20", "dead-fake-content", 5*time.Second, make(chan struct{})); err != nil {
+		t.Fatalf("LockShardForAction: %v", err)
+	}
+	if err := ts.ForceUnlockShard("test_keyspace", "10-20", "other-fake-content"); err != topo.ErrBadVersion {
+		t.Errorf("ForceUnlockShard(other contents): %v", err)
+	}
+	if err := ts.ForceUnlockShard("test_keyspace", "10-20", "dead-fake-content"); err != nil {
+		t.Errorf("ForceUnlockShard(): %v", err)
+	}
+	if nodes, err := ts.GetShardActionNodes("test_keyspace", "10-20"); err != nil || len(nodes) != 0 {
+		t.Errorf("GetShardActionNodes(after ForceUnlockShard): %v %v", nodes, err)
+	}
+	if err := ts.ForceUnlockShard("test_keyspace", "10-20", "dead-fake-content"); err != topo.ErrNoNode {
+		t.Errorf("ForceUnlockShard(unlocked): %v", err)
+	}
+
 	// test we can't lock a non-existing shard
 	interrupted = make(chan struct{}, 1)
 	if _, err := ts.LockShardForAction("test_keyspace", "20-30", "fake-content", 5*time.Second, interrupted); err == nil {
 		t.Fatalf("LockShardForAction(test_keyspace/20-30) worked for non-existing shard")
 	}
 }
+
+func CheckActionLog(t *testing.T, ts topo.Server) {
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "10-20"); err != nil {
+		t.Fatalf("CreateShard: %v", err)
+	}
+
+	if entries, err := ts.GetKeyspaceActionLog("test_keyspace"); err != nil || len(entries) != 0 {
+		t.Errorf("GetKeyspaceActionLog(empty): %v %v", entries, err)
+	}
+	if err := ts.AppendKeyspaceActionLog("test_keyspace", "entry1", 0); err != nil {
+		t.Errorf("AppendKeyspaceActionLog: %v", err)
+	}
+	if entries, err := ts.GetKeyspaceActionLog("test_keyspace"); err != nil || len(entries) != 1 || entries[0] != "entry1" {
+		t.Errorf("GetKeyspaceActionLog: %v %v", entries, err)
+	}
+	if err := ts.AppendKeyspaceActionLog("test_keyspace_666", "entry1", 0); err != topo.ErrNoNode {
+		t.Errorf("AppendKeyspaceActionLog(test_keyspace_666): %v", err)
+	}
+
+	for _, entry := range []string{"entry1", "entry2", "entry3", "entry4"} {
+		if err := ts.AppendShardActionLog("test_keyspace", "10-20", entry, 3); err != nil {
+			t.Errorf("AppendShardActionLog(%v): %v", entry, err)
+		}
+	}
+	entries, err := ts.GetShardActionLog("test_keyspace", "10-20")
+	if err != nil {
+		t.Fatalf("GetShardActionLog: %v", err)
+	}
+	if len(entries) != 3 || entries[0] != "entry4" || entries[1] != "entry3" || entries[2] != "entry2" {
+		t.Errorf("GetShardActionLog: want [entry4 entry3 entry2], got %v", entries)
+	}
+	if _, err := ts.GetShardActionLog("test_keyspace", "20-30"); err != topo.ErrNoNode {
+		t.Errorf("GetShardActionLog(20-30): %v", err)
+	}
+}
@@ -132,4 +132,18 @@ func CheckServingGraph(t *testing.T, ts topo.Server) {
 	if k, err := ts.GetSrvKeyspaceNames(cell); err != nil || len(k) != 1 || k[0] != "test_keyspace" {
 		t.Errorf("GetSrvKeyspaceNames(): %v", err)
 	}
+
+	// the serving records of the shards left are deleted too
+	if err := ts.DeleteSrvKeyspace(cell, "test_keyspace"); err != nil {
+		t.Errorf("DeleteSrvKeyspace(): %v", err)
+	}
+	if _, err := ts.GetSrvKeyspace(cell, "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(deleted): %v", err)
+	}
+	if _, err := ts.GetSrvShard(cell, "test_keyspace", "-10"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvShard(deleted keyspace): %v", err)
+	}
+	if err := ts.DeleteSrvKeyspace(cell, "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("DeleteSrvKeyspace(again): %v", err)
+	}
 }
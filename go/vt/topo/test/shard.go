@@ -46,6 +46,15 @@ func CheckShard(t *testing.T, ts topo.Server) {
 			Tables:   []string{"table1", "table2"},
 		},
 	}
+	shardInfo.TabletControlMap = map[topo.TabletType]*topo.TabletControl{
+		topo.TYPE_RDONLY: &topo.TabletControl{
+			Cells:             []string{"c1", "c2"},
+			BlacklistedTables: []string{"black1", "black2"},
+		},
+		topo.TYPE_REPLICA: &topo.TabletControl{
+			DisableQueryService: true,
+		},
+	}
 
 	if err := ts.UpdateShard(shardInfo); err != nil {
 		t.Errorf("UpdateShard: %v", err)
@@ -74,6 +83,14 @@ func CheckShard(t *testing.T, ts topo.Server) {
 		shardInfo.SourceShards[0].Tables[1] != "table2" {
 		t.Errorf("after UpdateShard: shardInfo.SourceShards got %v", shardInfo.SourceShards)
 	}
+	if len(shardInfo.TabletControlMap) != 2 ||
+		len(shardInfo.TabletControlMap[topo.TYPE_RDONLY].Cells) != 2 ||
+		len(shardInfo.TabletControlMap[topo.TYPE_RDONLY].BlacklistedTables) != 2 ||
+		shardInfo.TabletControlMap[topo.TYPE_RDONLY].BlacklistedTables[1] != "black2" ||
+		shardInfo.TabletControlMap[topo.TYPE_RDONLY].DisableQueryService ||
+		!shardInfo.TabletControlMap[topo.TYPE_REPLICA].DisableQueryService {
+		t.Errorf("after UpdateShard: shardInfo.TabletControlMap got %v", shardInfo.TabletControlMap)
+	}
 
 	shards, err := ts.GetShardNames("test_keyspace")
 	if err != nil {
@@ -111,22 +111,23 @@ func ResolveShardWildcard(server WildcardBackend, param string) ([]KeyspaceShard
 				}
 			}
 		} else {
+			shard := CanonicalShardName(parts[1])
 			if keyspaceHasWildcards {
 				// keyspace was a wildcard, shard is not, just try it
-				_, err := server.GetShard(matchedKeyspace, parts[1])
+				_, err := server.GetShard(matchedKeyspace, shard)
 				switch err {
 				case nil:
 					// shard exists, add it
-					result = append(result, KeyspaceShard{matchedKeyspace, parts[1]})
+					result = append(result, KeyspaceShard{matchedKeyspace, shard})
 				case ErrNoNode:
 					// no shard, ignore
 				default:
 					// other error
-					return nil, fmt.Errorf("Cannot read shard %v/%v: %v", matchedKeyspace, parts[1], err)
+					return nil, fmt.Errorf("Cannot read shard %v/%v: %v", matchedKeyspace, shard, err)
 				}
 			} else {
 				// keyspace and shards are not wildcards, just add the value
-				result = append(result, KeyspaceShard{matchedKeyspace, parts[1]})
+				result = append(result, KeyspaceShard{matchedKeyspace, shard})
 			}
 		}
 	}
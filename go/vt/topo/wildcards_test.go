@@ -132,6 +132,12 @@ func TestShardWildcards(t *testing.T) {
 	validateShardWildcard(t, fwb, "ccccc/s0", []KeyspaceShard{
 		KeyspaceShard{"ccccc", "s0"},
 	})
+	validateShardWildcard(t, fwb, "bbbbb/80-c0", []KeyspaceShard{
+		KeyspaceShard{"bbbbb", "80-C0"},
+	})
+	validateShardWildcard(t, fwb, "*/c0- ", []KeyspaceShard{
+		KeyspaceShard{"bbbbb", "C0-"},
+	})
 
 	// error cases
 	fwb = &fakeWildcardBackend{
@@ -136,6 +136,18 @@ func (tee *Tee) DeleteKeyspaceShards(keyspace string) error {
 	return nil
 }
 
+func (tee *Tee) DeleteKeyspace(keyspace string) error {
+	if err := tee.primary.DeleteKeyspace(keyspace); err != nil {
+		return err
+	}
+
+	if err := tee.secondary.DeleteKeyspace(keyspace); err != nil {
+		// not critical enough to fail
+		log.Warningf("secondary.DeleteKeyspace(%v) failed: %v", keyspace, err)
+	}
+	return nil
+}
+
 //
 // Shard management, global.
 //
@@ -448,6 +460,19 @@ func (tee *Tee) DeleteSrvShard(cell, keyspace, shard string) error {
 	return err
 }
 
+func (tee *Tee) DeleteSrvKeyspace(cell, keyspace string) error {
+	err := tee.primary.DeleteSrvKeyspace(cell, keyspace)
+	if err != nil && err != topo.ErrNoNode {
+		return err
+	}
+
+	if err := tee.secondary.DeleteSrvKeyspace(cell, keyspace); err != nil {
+		// not critical enough to fail
+		log.Warningf("secondary.DeleteSrvKeyspace(%v, %v) failed: %v", cell, keyspace, err)
+	}
+	return err
+}
+
 func (tee *Tee) UpdateSrvKeyspace(cell, keyspace string, srvKeyspace *topo.SrvKeyspace) error {
 	if err := tee.primary.UpdateSrvKeyspace(cell, keyspace, srvKeyspace); err != nil {
 		return err
@@ -554,6 +579,23 @@ func (tee *Tee) LockShardForAction(keyspace, shard, contents string, timeout tim
 	return pLockPath, nil
 }
 
+func (tee *Tee) UpdateShardActionLock(keyspace, shard, lockPath, contents string) error {
+	tee.mu.Lock()
+	sLockPath, ok := tee.shardLockPaths[lockPath]
+	tee.mu.Unlock()
+	if !ok {
+		return topo.ErrNoNode
+	}
+
+	if err := tee.lockFirst.UpdateShardActionLock(keyspace, shard, lockPath, contents); err != nil {
+		return err
+	}
+	if err := tee.lockSecond.UpdateShardActionLock(keyspace, shard, sLockPath, contents); err != nil {
+		log.Warningf("Secondary UpdateShardActionLock(%v/%v, %v) failed: %v", keyspace, shard, sLockPath, err)
+	}
+	return nil
+}
+
 func (tee *Tee) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
 	// get from map
 	tee.mu.Lock() // not using defer for unlock, to minimize lock time
@@ -578,6 +620,60 @@ func (tee *Tee) UnlockShardForAction(keyspace, shard, lockPath, results string)
 	return perr
 }
 
+func (tee *Tee) ForceUnlockShard(keyspace, shard, contents string) error {
+	// lockFirst is where the lock queue is decided
+	if err := tee.lockFirst.ForceUnlockShard(keyspace, shard, contents); err != nil {
+		return err
+	}
+	if err := tee.lockSecond.ForceUnlockShard(keyspace, shard, contents); err != nil {
+		log.Warningf("Secondary ForceUnlockShard(%v/%v) failed: %v", keyspace, shard, err)
+	}
+	return nil
+}
+
+func (tee *Tee) GetShardActionNodes(keyspace, shard string) ([]string, error) {
+	// lockFirst is where the lock queue is decided
+	return tee.lockFirst.GetShardActionNodes(keyspace, shard)
+}
+
+//
+// Keyspace and Shard action logs, global.
+//
+
+func (tee *Tee) AppendKeyspaceActionLog(keyspace, contents string, maxEntries int) error {
+	if err := tee.primary.AppendKeyspaceActionLog(keyspace, contents, maxEntries); err != nil {
+		// failed on primary, not updating secondary
+		return err
+	}
+
+	if err := tee.secondary.AppendKeyspaceActionLog(keyspace, contents, maxEntries); err != nil {
+		// not critical enough to fail
+		log.Warningf("secondary.AppendKeyspaceActionLog(%v) failed: %v", keyspace, err)
+	}
+	return nil
+}
+
+func (tee *Tee) GetKeyspaceActionLog(keyspace string) ([]string, error) {
+	return tee.readFrom.GetKeyspaceActionLog(keyspace)
+}
+
+func (tee *Tee) AppendShardActionLog(keyspace, shard, contents string, maxEntries int) error {
+	if err := tee.primary.AppendShardActionLog(keyspace, shard, contents, maxEntries); err != nil {
+		// failed on primary, not updating secondary
+		return err
+	}
+
+	if err := tee.secondary.AppendShardActionLog(keyspace, shard, contents, maxEntries); err != nil {
+		// not critical enough to fail
+		log.Warningf("secondary.AppendShardActionLog(%v,%v) failed: %v", keyspace, shard, err)
+	}
+	return nil
+}
+
+func (tee *Tee) GetShardActionLog(keyspace, shard string) ([]string, error) {
+	return tee.readFrom.GetShardActionLog(keyspace, shard)
+}
+
 //
 // Remote Tablet Actions, local cell.
 // We just send these actions through the primary topo.Server.
@@ -0,0 +1,201 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var accessControlFile = flag.String("access_control_file", "", "JSON file of the callers allowed to query each tablet type of each keyspace, see AccessControlConfig. It is reloaded on SIGHUP. Empty allows everything.")
+
+const (
+	// AccessAllow and AccessDeny are the values of
+	// AccessControlConfig.NoCallerPolicy.
+	AccessAllow = "allow"
+	AccessDeny  = "deny"
+)
+
+// AccessControlConfig is the content of -access_control_file, e.g.
+//
+//	{
+//	  "Keyspaces": {
+//	    "user_data": {"rdonly": ["analytics"]},
+//	    "archive": {"master": []}
+//	  },
+//	  "NoCallerPolicy": "deny"
+//	}
+//
+// Keyspaces maps a keyspace and a tablet type to the callers allowed
+// to query them: only analytics may query the rdonly tablets of
+// user_data, and nobody the master tablets of archive. The tablet
+// types and keyspaces that are not listed are open to everyone.
+// NoCallerPolicy applies to the requests without a caller on listed
+// tablet types, "allow" or "deny", deny by default.
+type AccessControlConfig struct {
+	Keyspaces      map[string]map[topo.TabletType][]string
+	NoCallerPolicy string
+}
+
+// accessRules is the compiled form of an AccessControlConfig.
+type accessRules struct {
+	// callers maps keyspace and tablet type to the allowed callers
+	callers       map[string]map[topo.TabletType]map[string]bool
+	allowNoCaller bool
+}
+
+// parseAccessRules checks and compiles an AccessControlConfig in
+// JSON.
+func parseAccessRules(data []byte) (*accessRules, error) {
+	config := new(AccessControlConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	rules := &accessRules{
+		callers: make(map[string]map[topo.TabletType]map[string]bool, len(config.Keyspaces)),
+	}
+	switch config.NoCallerPolicy {
+	case AccessAllow:
+		rules.allowNoCaller = true
+	case AccessDeny, "":
+	default:
+		return nil, fmt.Errorf("unknown NoCallerPolicy %q, use %v or %v", config.NoCallerPolicy, AccessAllow, AccessDeny)
+	}
+	for keyspace, tabletTypes := range config.Keyspaces {
+		rules.callers[keyspace] = make(map[topo.TabletType]map[string]bool, len(tabletTypes))
+		for tabletType, callers := range tabletTypes {
+			if !topo.IsInServingGraph(tabletType) {
+				return nil, fmt.Errorf("keyspace %v: tablet type %q doesn't serve queries", keyspace, tabletType)
+			}
+			allowed := make(map[string]bool, len(callers))
+			for _, caller := range callers {
+				allowed[caller] = true
+			}
+			rules.callers[keyspace][tabletType] = allowed
+		}
+	}
+	return rules, nil
+}
+
+// PermissionDeniedError is returned for the requests the access
+// control rejects, see -access_control_file. Its error code is
+// tabletconn.ERR_PERMISSION_DENIED.
+type PermissionDeniedError struct {
+	Keyspace   string
+	TabletType topo.TabletType
+	// Caller is empty for the requests without a caller.
+	Caller string
+}
+
+func (e *PermissionDeniedError) Error() string {
+	caller := e.Caller
+	if caller == "" {
+		caller = "a request without caller"
+	}
+	return fmt.Sprintf("vtgate: permission denied: %v can't query the %v tablets of keyspace %v", caller, e.TabletType, e.Keyspace)
+}
+
+// accessControl enforces the access rules of a file, and reloads them
+// when asked to. The requests are checked before any shard is
+// resolved.
+// A nil *accessControl allows everything.
+type accessControl struct {
+	file string
+
+	// denials counts the rejected requests, by
+	// "<keyspace>.<caller>"
+	denials *stats.Counters
+
+	mu    sync.RWMutex
+	rules *accessRules
+}
+
+// newAccessControl creates an accessControl with the rules of file,
+// or returns nil if file is empty. If name is not empty, it exports
+// <name>Denials.
+func newAccessControl(name, file string) (*accessControl, error) {
+	if file == "" {
+		return nil, nil
+	}
+	ac := &accessControl{
+		file:    file,
+		denials: stats.NewCounters(""),
+	}
+	if err := ac.reload(); err != nil {
+		return nil, err
+	}
+	if name != "" {
+		stats.Publish(name+"Denials", ac.denials)
+	}
+	return ac, nil
+}
+
+// reload reads the rules of the file again. The previous rules stay
+// in effect if it fails.
+func (ac *accessControl) reload() error {
+	data, err := ioutil.ReadFile(ac.file)
+	if err != nil {
+		return err
+	}
+	rules, err := parseAccessRules(data)
+	if err != nil {
+		return fmt.Errorf("bad access control file %v: %v", ac.file, err)
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.rules = rules
+	return nil
+}
+
+// reloadOnSignal reloads the rules on each SIGHUP.
+func (ac *accessControl) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			if err := ac.reload(); err != nil {
+				log.Errorf("cannot reload the access control, keeping the previous rules: %v", err)
+				continue
+			}
+			log.Infof("reloaded the access control from %v", ac.file)
+		}
+	}()
+}
+
+// check returns a *PermissionDeniedError if the caller of the request
+// can't query the tablet type of the keyspace, and counts the
+// rejection.
+func (ac *accessControl) check(context interface{}, keyspace string, tabletType topo.TabletType) error {
+	if ac == nil {
+		return nil
+	}
+	caller := callerID(context)
+	ac.mu.RLock()
+	rules := ac.rules
+	ac.mu.RUnlock()
+	allowed, ok := rules.callers[keyspace][tabletType]
+	if !ok {
+		return nil
+	}
+	if caller == "" {
+		if rules.allowNoCaller {
+			return nil
+		}
+	} else if allowed[caller] {
+		return nil
+	}
+	ac.denials.Add(keyspace+"."+callerName(context), 1)
+	return &PermissionDeniedError{Keyspace: keyspace, TabletType: tabletType, Caller: caller}
+}
@@ -0,0 +1,265 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+const testAccessRules = `{
+  "Keyspaces": {
+    "ac_keyspace": {"rdonly": ["analytics"]},
+    "ac_archive": {"master": []}
+  }
+}`
+
+// writeAccessRules writes an access control file in dir.
+func writeAccessRules(t *testing.T, dir, rules string) string {
+	file := path.Join(dir, "access_control.json")
+	if err := ioutil.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return file
+}
+
+func TestParseAccessRules(t *testing.T) {
+	for _, bad := range []string{
+		`{"Keyspaces": `,
+		`{"NoCallerPolicy": "maybe"}`,
+		`{"Keyspaces": {"ks": {"spare": ["alice"]}}}`,
+	} {
+		if _, err := parseAccessRules([]byte(bad)); err == nil {
+			t.Errorf("parseAccessRules(%v) worked", bad)
+		}
+	}
+}
+
+func TestAccessControlCheck(t *testing.T) {
+	// no access control allows everything
+	var nilControl *accessControl
+	if err := nilControl.check(nil, "ac_archive", topo.TYPE_MASTER); err != nil {
+		t.Errorf("nil access control: %v", err)
+	}
+	if ac, err := newAccessControl("", ""); ac != nil || err != nil {
+		t.Errorf("want nil access control, got %v %v", ac, err)
+	}
+
+	dir, err := ioutil.TempDir("", "access_control")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ac, err := newAccessControl("", writeAccessRules(t, dir, testAccessRules))
+	if err != nil {
+		t.Fatalf("newAccessControl failed: %v", err)
+	}
+
+	analytics := &rpcproto.Context{Username: "analytics"}
+	alice := &rpcproto.Context{Username: "alice"}
+	testCases := []struct {
+		context    interface{}
+		keyspace   string
+		tabletType topo.TabletType
+		allowed    bool
+	}{
+		{analytics, "ac_keyspace", topo.TYPE_RDONLY, true},
+		{alice, "ac_keyspace", topo.TYPE_RDONLY, false},
+		{nil, "ac_keyspace", topo.TYPE_RDONLY, false},
+		// tablet types and keyspaces not listed are open
+		{alice, "ac_keyspace", topo.TYPE_REPLICA, true},
+		{nil, "ac_other", topo.TYPE_MASTER, true},
+		// nobody can use an empty list
+		{analytics, "ac_archive", topo.TYPE_MASTER, false},
+	}
+	for _, tc := range testCases {
+		err := ac.check(tc.context, tc.keyspace, tc.tabletType)
+		if tc.allowed != (err == nil) {
+			t.Errorf("check(%v, %v, %v): want allowed %v, got %v", tc.context, tc.keyspace, tc.tabletType, tc.allowed, err)
+		}
+	}
+	want := map[string]int64{"ac_keyspace.alice": 1, "ac_keyspace.unknown": 1, "ac_archive.analytics": 1}
+	for name, count := range want {
+		if got := ac.denials.Counts()[name]; got != count {
+			t.Errorf("want %v denials for %v, got %v", count, name, got)
+		}
+	}
+	err = ac.check(nil, "ac_keyspace", topo.TYPE_RDONLY)
+	if want := "vtgate: permission denied: a request without caller can't query the rdonly tablets of keyspace ac_keyspace"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if code := errorCode(err); code != tabletconn.ERR_PERMISSION_DENIED {
+		t.Errorf("want ERR_PERMISSION_DENIED, got %v", code)
+	}
+
+	// the requests without caller can be allowed
+	writeAccessRules(t, dir, `{"Keyspaces": {"ac_keyspace": {"rdonly": ["analytics"]}}, "NoCallerPolicy": "allow"}`)
+	if err := ac.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if err := ac.check(nil, "ac_keyspace", topo.TYPE_RDONLY); err != nil {
+		t.Errorf("want allowed, got %v", err)
+	}
+	if err := ac.check(alice, "ac_keyspace", topo.TYPE_RDONLY); err == nil {
+		t.Errorf("alice was allowed")
+	}
+}
+
+func TestAccessControlReloadWhileServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_control")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeAccessRules(t, dir, testAccessRules)
+	ac, err := newAccessControl("", file)
+	if err != nil {
+		t.Fatalf("newAccessControl failed: %v", err)
+	}
+
+	// analytics is always allowed, alice only by the new rules
+	analytics := &rpcproto.Context{Username: "analytics"}
+	alice := &rpcproto.Context{Username: "alice"}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := ac.check(analytics, "ac_keyspace", topo.TYPE_RDONLY); err != nil {
+					t.Errorf("analytics was denied: %v", err)
+					return
+				}
+				ac.check(alice, "ac_keyspace", topo.TYPE_RDONLY)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		rules := testAccessRules
+		if i%2 == 0 {
+			rules = `{"Keyspaces": {"ac_keyspace": {"rdonly": ["analytics", "alice"]}}}`
+		}
+		writeAccessRules(t, dir, rules)
+		if err := ac.reload(); err != nil {
+			t.Errorf("reload failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// the last rules deny alice
+	if err := ac.check(alice, "ac_keyspace", topo.TYPE_RDONLY); err == nil {
+		t.Errorf("alice was allowed")
+	}
+	// a bad file keeps the previous rules
+	writeAccessRules(t, dir, `{"Keyspaces": `)
+	if err := ac.reload(); err == nil {
+		t.Errorf("reload of a bad file worked")
+	}
+	if err := ac.check(alice, "ac_keyspace", topo.TYPE_RDONLY); err == nil {
+		t.Errorf("alice was allowed")
+	}
+	if err := ac.check(analytics, "ac_keyspace", topo.TYPE_RDONLY); err != nil {
+		t.Errorf("analytics was denied: %v", err)
+	}
+}
+
+func TestAccessControlHandlers(t *testing.T) {
+	resetSandbox()
+	dir, err := ioutil.TempDir("", "access_control")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ac, err := newAccessControl("", writeAccessRules(t, dir, `{"Keyspaces": {"ac_keyspace": {"rdonly": ["analytics"]}, "TestSharded": {"master": []}}}`))
+	if err != nil {
+		t.Fatalf("newAccessControl failed: %v", err)
+	}
+	RpcVTGate.accessControl = ac
+	defer func() {
+		RpcVTGate.accessControl = nil
+	}()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	alice := &rpcproto.Context{Username: "alice"}
+	want := "vtgate: permission denied: alice can't query the rdonly tablets of keyspace ac_keyspace"
+
+	session := &proto.Session{InTransaction: true}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ac_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_RDONLY,
+		Session:    session,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(alice, &q, qr)
+	if qr.Error != want || qr.ErrorCode != tabletconn.ERR_PERMISSION_DENIED || qr.Session != session {
+		t.Errorf("want permission denied, got %+v", qr)
+	}
+
+	bq := proto.BatchQueryShard{
+		Queries:    []tproto.BoundQuery{{Sql: "query"}},
+		Keyspace:   "ac_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_RDONLY,
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(alice, &bq, qrl)
+	if qrl.Error != want || qrl.ErrorCode != tabletconn.ERR_PERMISSION_DENIED {
+		t.Errorf("want permission denied, got %+v", qrl)
+	}
+
+	q.Session = nil
+	err = RpcVTGate.StreamExecuteShard(alice, streamQueryShard(&q), func(*proto.QueryResult) error {
+		t.Errorf("StreamExecuteShard sent a result")
+		return nil
+	})
+	if _, ok := err.(*PermissionDeniedError); !ok {
+		t.Errorf("want a *PermissionDeniedError, got %v", err)
+	}
+
+	kq := proto.StreamQueryKeyRange{
+		Sql:        "query",
+		Keyspace:   TEST_SHARDED,
+		KeyRange:   "20-40",
+		TabletType: topo.TYPE_MASTER,
+	}
+	err = RpcVTGate.StreamExecuteKeyRange(alice, &kq, func(*proto.QueryResult) error {
+		t.Errorf("StreamExecuteKeyRange sent a result")
+		return nil
+	})
+	if _, ok := err.(*PermissionDeniedError); !ok {
+		t.Errorf("want a *PermissionDeniedError, got %v", err)
+	}
+	if sbc.ExecCount != 0 {
+		t.Errorf("a denied query reached the tablet: %v", sbc.ExecCount)
+	}
+
+	// allowed callers go through
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(&rpcproto.Context{Username: "analytics"}, &q, qr)
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	if sbc.ExecCount != 1 {
+		t.Errorf("want 1 query on the tablet, got %v", sbc.ExecCount)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	maxInFlightRequests = flag.Int("max_inflight_requests", 0, "maximum number of requests vtgate runs at the same time, 0 for no limit")
+	maxQueuedRequests   = flag.Int("max_queued_requests", 0, "maximum number of requests waiting for one of the -max_inflight_requests, the others are rejected as overloaded")
+)
+
+// ErrOverloaded is returned for the requests vtgate rejects without
+// running them, because -max_inflight_requests and
+// -max_queued_requests are reached. Its error code is
+// tabletconn.ERR_OVERLOADED, so clients can back off.
+var ErrOverloaded = errors.New("vtgate: server overloaded, retry later")
+
+// workload classes, in admission order
+const (
+	oltpClass = iota
+	olapClass
+	classCount
+)
+
+var classNames = [classCount]string{proto.WORKLOAD_OLTP, proto.WORKLOAD_OLAP}
+
+// workloadClass returns the class of a request Workload. Everything
+// but WORKLOAD_OLAP is OLTP.
+func workloadClass(workload string) int {
+	if workload == proto.WORKLOAD_OLAP {
+		return olapClass
+	}
+	return oltpClass
+}
+
+// admissionController limits the number of requests in flight. Past
+// maxInFlight, requests wait in a queue for a slot, OLTP requests
+// first. Past maxQueued waiting requests, they're rejected with
+// ErrOverloaded.
+// Begin, Commit, Rollback and Ping are not limited: they're cheap, and
+// rejecting them would leave transactions open.
+type admissionController struct {
+	maxInFlight int
+	maxQueued   int
+
+	queueWaits *stats.Timings
+	rejections *stats.Counters
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	// queues has the waiting requests of each class, in arrival
+	// order. A request is admitted when its channel is closed.
+	queues [classCount][]chan struct{}
+}
+
+// newAdmissionController creates an admissionController, 0 meaning no
+// limit for maxInFlight. If name is not empty, it exports
+// <name>InFlight, <name>Queued, the <name>QueueWaits of each class
+// and the <name>Rejections of each class.
+func newAdmissionController(name string, maxInFlight, maxQueued int) *admissionController {
+	ac := &admissionController{
+		maxInFlight: maxInFlight,
+		maxQueued:   maxQueued,
+		queueWaits:  stats.NewTimings(""),
+		rejections:  stats.NewCounters(""),
+	}
+	if name != "" {
+		stats.Publish(name+"InFlight", stats.IntFunc(ac.InFlight))
+		stats.Publish(name+"Queued", stats.IntFunc(ac.Queued))
+		stats.Publish(name+"QueueWaits", ac.queueWaits)
+		stats.Publish(name+"Rejections", ac.rejections)
+	}
+	return ac
+}
+
+// InFlight returns the number of admitted requests still running.
+func (ac *admissionController) InFlight() int64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return int64(ac.inFlight)
+}
+
+// Queued returns the number of requests waiting to be admitted.
+func (ac *admissionController) Queued() int64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return int64(ac.queued)
+}
+
+// admit waits until the request can run. It returns ErrOverloaded
+// right away if the queue is full. Admitted requests must call
+// release when they're done.
+func (ac *admissionController) admit(workload string) error {
+	class := workloadClass(workload)
+	ac.mu.Lock()
+	if ac.maxInFlight <= 0 || ac.inFlight < ac.maxInFlight {
+		ac.inFlight++
+		ac.mu.Unlock()
+		return nil
+	}
+	if ac.queued >= ac.maxQueued {
+		ac.mu.Unlock()
+		ac.rejections.Add(classNames[class], 1)
+		return ErrOverloaded
+	}
+	admitted := make(chan struct{})
+	ac.queues[class] = append(ac.queues[class], admitted)
+	ac.queued++
+	ac.mu.Unlock()
+
+	start := time.Now()
+	<-admitted
+	ac.queueWaits.Record(classNames[class], start)
+	return nil
+}
+
+// release ends an admitted request. Its slot goes to the first
+// waiting request, OLTP before OLAP.
+func (ac *admissionController) release() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for class, queue := range ac.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		// the slot is handed over, inFlight doesn't change
+		close(queue[0])
+		queue[0] = nil
+		ac.queues[class] = queue[1:]
+		ac.queued--
+		return
+	}
+	ac.inFlight--
+}
@@ -0,0 +1,214 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// waitForQueued waits until n requests are waiting in ac.
+func waitForQueued(t *testing.T, ac *admissionController, n int64) {
+	for start := time.Now(); ac.Queued() != n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("want %v queued requests, got %v", n, ac.Queued())
+		}
+	}
+}
+
+func TestAdmissionNoLimit(t *testing.T) {
+	ac := newAdmissionController("", 0, 0)
+	for i := 0; i < 100; i++ {
+		if err := ac.admit(""); err != nil {
+			t.Fatalf("admit failed: %v", err)
+		}
+	}
+	if n := ac.InFlight(); n != 100 {
+		t.Errorf("want 100 requests in flight, got %v", n)
+	}
+	for i := 0; i < 100; i++ {
+		ac.release()
+	}
+	if n := ac.InFlight(); n != 0 {
+		t.Errorf("want no request in flight, got %v", n)
+	}
+}
+
+func TestAdmissionOverloaded(t *testing.T) {
+	ac := newAdmissionController("", 1, 1)
+	if err := ac.admit(""); err != nil {
+		t.Fatalf("admit failed: %v", err)
+	}
+
+	// the second request waits
+	admitted := make(chan error)
+	go func() {
+		admitted <- ac.admit(proto.WORKLOAD_OLAP)
+	}()
+	waitForQueued(t, ac, 1)
+
+	// the third one is rejected right away
+	if err := ac.admit(proto.WORKLOAD_OLTP); err != ErrOverloaded {
+		t.Errorf("want ErrOverloaded, got %v", err)
+	}
+	if n := ac.rejections.Counts()[proto.WORKLOAD_OLTP]; n != 1 {
+		t.Errorf("want 1 OLTP rejection, got %v", n)
+	}
+
+	ac.release()
+	if err := <-admitted; err != nil {
+		t.Errorf("admit failed: %v", err)
+	}
+	if ac.InFlight() != 1 || ac.Queued() != 0 {
+		t.Errorf("want 1 request in flight and none queued, got %v and %v", ac.InFlight(), ac.Queued())
+	}
+	if n := ac.queueWaits.Counts()[proto.WORKLOAD_OLAP]; n != 1 {
+		t.Errorf("want 1 OLAP queue wait, got %v", n)
+	}
+	ac.release()
+	if n := ac.InFlight(); n != 0 {
+		t.Errorf("want no request in flight, got %v", n)
+	}
+}
+
+func TestAdmissionOLTPFirst(t *testing.T) {
+	ac := newAdmissionController("", 1, 2)
+	if err := ac.admit(""); err != nil {
+		t.Fatalf("admit failed: %v", err)
+	}
+
+	admitted := make(chan string, 2)
+	for i, workload := range []string{proto.WORKLOAD_OLAP, ""} {
+		go func(workload string) {
+			if err := ac.admit(workload); err != nil {
+				t.Errorf("admit failed: %v", err)
+			}
+			admitted <- workload
+		}(workload)
+		waitForQueued(t, ac, int64(i+1))
+	}
+
+	// the OLTP request queued last is admitted first
+	ac.release()
+	if workload := <-admitted; workload != "" {
+		t.Errorf("want the OLTP request admitted first, got %v", workload)
+	}
+	ac.release()
+	if workload := <-admitted; workload != proto.WORKLOAD_OLAP {
+		t.Errorf("want the OLAP request admitted second, got %v", workload)
+	}
+	ac.release()
+}
+
+func TestAdmissionStress(t *testing.T) {
+	const (
+		maxInFlight = 4
+		maxQueued   = 8
+		workers     = 50
+		requests    = 200
+	)
+	ac := newAdmissionController("", maxInFlight, maxQueued)
+
+	var running, admittedCount, rejectedCount int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workload := proto.WORKLOAD_OLTP
+			if i%2 == 1 {
+				workload = proto.WORKLOAD_OLAP
+			}
+			for j := 0; j < requests; j++ {
+				if err := ac.admit(workload); err != nil {
+					if err != ErrOverloaded {
+						t.Errorf("want ErrOverloaded, got %v", err)
+					}
+					atomic.AddInt64(&rejectedCount, 1)
+					continue
+				}
+				atomic.AddInt64(&admittedCount, 1)
+				if n := atomic.AddInt64(&running, 1); n > maxInFlight {
+					t.Errorf("%v requests running, the limit is %v", n, maxInFlight)
+				}
+				if n := ac.Queued(); n > maxQueued {
+					t.Errorf("%v requests queued, the limit is %v", n, maxQueued)
+				}
+				runtime.Gosched()
+				atomic.AddInt64(&running, -1)
+				ac.release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if admittedCount+rejectedCount != workers*requests {
+		t.Errorf("%v admitted + %v rejected requests, want %v", admittedCount, rejectedCount, workers*requests)
+	}
+	counts := ac.rejections.Counts()
+	if n := counts[proto.WORKLOAD_OLTP] + counts[proto.WORKLOAD_OLAP]; n != rejectedCount {
+		t.Errorf("want %v rejections, got %v", rejectedCount, counts)
+	}
+	if ac.InFlight() != 0 || ac.Queued() != 0 {
+		t.Errorf("want no request in flight or queued, got %v and %v", ac.InFlight(), ac.Queued())
+	}
+}
+
+func TestVTGateOverloaded(t *testing.T) {
+	saved := RpcVTGate.admission
+	defer func() {
+		RpcVTGate.admission = saved
+	}()
+	RpcVTGate.admission = newAdmissionController("", 1, 0)
+	if err := RpcVTGate.admission.admit(""); err != nil {
+		t.Fatalf("admit failed: %v", err)
+	}
+
+	session := &proto.Session{InTransaction: true}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "overloaded_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    session,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != ErrOverloaded.Error() || qr.ErrorCode != tabletconn.ERR_OVERLOADED || qr.Session != session {
+		t.Errorf("want overloaded error, got %+v", qr)
+	}
+
+	bq := proto.BatchQueryShard{
+		Keyspace:   "overloaded_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	if qrl.Error != ErrOverloaded.Error() || qrl.ErrorCode != tabletconn.ERR_OVERLOADED {
+		t.Errorf("want overloaded error, got %+v", qrl)
+	}
+
+	q.Session = nil
+	err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(*proto.QueryResult) error {
+		t.Errorf("StreamExecuteShard sent a result")
+		return nil
+	})
+	if err != ErrOverloaded {
+		t.Errorf("want ErrOverloaded, got %v", err)
+	}
+
+	RpcVTGate.admission.release()
+	if n := RpcVTGate.admission.InFlight(); n != 0 {
+		t.Errorf("want no request in flight, got %v", n)
+	}
+}
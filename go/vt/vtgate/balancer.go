@@ -5,8 +5,10 @@
 package vtgate
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,23 +16,116 @@ import (
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+var balancerPolicy = flag.String("balancer_policy", "round_robin", "how vtgate chooses the endpoint of a shard connection among the healthy ones: round_robin, random, least_outstanding, or a registered BalancerPolicy")
+
 type GetEndPointsFunc func() (*topo.EndPoints, error)
 
-// Balancer is a simple round-robin load balancer.
+// EndPointCandidate is a healthy endpoint a BalancerPolicy can choose.
+type EndPointCandidate struct {
+	EndPoint topo.EndPoint
+	// Outstanding is the number of requests running on the endpoint.
+	Outstanding int
+}
+
+// BalancerPolicy chooses the endpoint of a connection among the
+// healthy endpoints of a shard. A Balancer has its own BalancerPolicy,
+// and calls it with its lock held.
+type BalancerPolicy interface {
+	// Choose returns the index of the chosen endpoint in
+	// candidates. candidates is never empty, and is in the same
+	// order between refreshes of the Balancer.
+	Choose(candidates []EndPointCandidate) int
+}
+
+var balancerPolicies = make(map[string]func() BalancerPolicy)
+
+// RegisterBalancerPolicy registers a BalancerPolicy that
+// -balancer_policy can select. newPolicy is called for each Balancer.
+func RegisterBalancerPolicy(name string, newPolicy func() BalancerPolicy) {
+	if _, ok := balancerPolicies[name]; ok {
+		panic(fmt.Sprintf("balancer policy %v is already registered", name))
+	}
+	balancerPolicies[name] = newPolicy
+}
+
+// BalancerPolicyNames returns the sorted names of the registered
+// balancer policies.
+func BalancerPolicyNames() []string {
+	names := make([]string, 0, len(balancerPolicies))
+	for name := range balancerPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roundRobinPolicy chooses the candidates in turn.
+type roundRobinPolicy struct {
+	next int
+}
+
+func (rr *roundRobinPolicy) Choose(candidates []EndPointCandidate) int {
+	index := rr.next % len(candidates)
+	rr.next = index + 1
+	return index
+}
+
+// randomPolicy chooses a random candidate.
+type randomPolicy struct{}
+
+func (randomPolicy) Choose(candidates []EndPointCandidate) int {
+	return rand.Intn(len(candidates))
+}
+
+// leastOutstandingPolicy chooses the candidate with the fewest
+// outstanding requests, at random among the ties.
+type leastOutstandingPolicy struct{}
+
+func (leastOutstandingPolicy) Choose(candidates []EndPointCandidate) int {
+	best := 0
+	ties := 1
+	for i := 1; i < len(candidates); i++ {
+		switch {
+		case candidates[i].Outstanding < candidates[best].Outstanding:
+			best = i
+			ties = 1
+		case candidates[i].Outstanding == candidates[best].Outstanding:
+			// reservoir sampling of the ties
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+func init() {
+	RegisterBalancerPolicy("round_robin", func() BalancerPolicy { return &roundRobinPolicy{} })
+	RegisterBalancerPolicy("random", func() BalancerPolicy { return randomPolicy{} })
+	RegisterBalancerPolicy("least_outstanding", func() BalancerPolicy { return leastOutstandingPolicy{} })
+}
+
+// Balancer is a load balancer, using the BalancerPolicy selected by
+// -balancer_policy.
 // It allows you to temporarily mark down nodes that
 // are non-functional.
 type Balancer struct {
 	mu           sync.Mutex
 	addressNodes []*addressStatus
-	index        int
+	policy       BalancerPolicy
 	getEndPoints GetEndPointsFunc
 	retryDelay   time.Duration
+	// stale is set by Invalidate, the addresses are refreshed by the
+	// next Get
+	stale bool
 }
 
 type addressStatus struct {
-	endPoint  topo.EndPoint
-	timeRetry time.Time
-	balancer  *Balancer
+	endPoint    topo.EndPoint
+	timeRetry   time.Time
+	outstanding int
+	balancer    *Balancer
 }
 
 // NewBalancer creates a Balancer. getAddreses is the function
@@ -39,21 +134,33 @@ type addressStatus struct {
 // retryDelay specifies the minimum time a node will be marked down
 // before it will be cleared for a retry.
 func NewBalancer(getEndPoints GetEndPointsFunc, retryDelay time.Duration) *Balancer {
+	newPolicy, ok := balancerPolicies[*balancerPolicy]
+	if !ok {
+		log.Warningf("unknown balancer policy %v, using round_robin", *balancerPolicy)
+		newPolicy = balancerPolicies["round_robin"]
+	}
 	blc := new(Balancer)
 	blc.getEndPoints = getEndPoints
 	blc.retryDelay = retryDelay
+	blc.policy = newPolicy()
 	return blc
 }
 
-// Get returns a single endpoint that was not recently marked down.
+// Get returns a single endpoint that was not recently marked down,
+// chosen by the BalancerPolicy among those.
 // If it finds an address that was down for longer than retryDelay,
-// it refreshes the list of addresses and returns the next available
-// node. If all addresses are marked down, it waits and retries.
+// it refreshes the list of addresses and chooses among the available
+// nodes. If all addresses are marked down, it waits and retries.
 // If a refresh fails, it returns an error.
 func (blc *Balancer) Get() (endPoint topo.EndPoint, err error) {
 	blc.mu.Lock()
 	defer blc.mu.Unlock()
 
+	if blc.stale {
+		// the current addresses are still used if the refresh fails
+		blc.stale = false
+		blc.refresh()
+	}
 	if len(blc.addressNodes) == 0 {
 		err = blc.refresh()
 		if err != nil {
@@ -63,14 +170,8 @@ func (blc *Balancer) Get() (endPoint topo.EndPoint, err error) {
 
 outer:
 	for {
-		for i := range blc.addressNodes {
-			index := (blc.index + i + 1) % len(blc.addressNodes)
-			addrNode := blc.addressNodes[index]
-			if addrNode.timeRetry.IsZero() {
-				blc.index = index
-				return addrNode.endPoint, nil
-			}
-			if time.Now().Sub(addrNode.timeRetry) > 0 {
+		for _, addrNode := range blc.addressNodes {
+			if !addrNode.timeRetry.IsZero() && time.Now().Sub(addrNode.timeRetry) > 0 {
 				addrNode.timeRetry = time.Time{}
 				err = blc.refresh()
 				if err != nil {
@@ -79,6 +180,17 @@ outer:
 				continue outer
 			}
 		}
+		candidates := make([]EndPointCandidate, 0, len(blc.addressNodes))
+		healthyNodes := make([]*addressStatus, 0, len(blc.addressNodes))
+		for _, addrNode := range blc.addressNodes {
+			if addrNode.timeRetry.IsZero() {
+				candidates = append(candidates, EndPointCandidate{EndPoint: addrNode.endPoint, Outstanding: addrNode.outstanding})
+				healthyNodes = append(healthyNodes, addrNode)
+			}
+		}
+		if len(candidates) != 0 {
+			return healthyNodes[blc.policy.Choose(candidates)].endPoint, nil
+		}
 		// Allow mark downs to happen while sleeping.
 		blc.mu.Unlock()
 		time.Sleep(blc.retryDelay + (1 * time.Millisecond))
@@ -97,6 +209,37 @@ func (blc *Balancer) MarkDown(uid uint32) {
 	}
 }
 
+// Invalidate makes the next Get refresh the list of addresses, after
+// a connection failure that suggests it changed. The nodes that are
+// still in the list stay marked down.
+func (blc *Balancer) Invalidate() {
+	blc.mu.Lock()
+	defer blc.mu.Unlock()
+	blc.stale = true
+}
+
+// StartRequest records a request running on the endpoint, for the
+// policies that balance outstanding requests. It must be followed by
+// EndRequest.
+func (blc *Balancer) StartRequest(uid uint32) {
+	blc.mu.Lock()
+	defer blc.mu.Unlock()
+	if index := findAddrNode(blc.addressNodes, uid); index != -1 {
+		blc.addressNodes[index].outstanding++
+	}
+}
+
+// EndRequest records the end of a request started with StartRequest.
+func (blc *Balancer) EndRequest(uid uint32) {
+	blc.mu.Lock()
+	defer blc.mu.Unlock()
+	// the endpoint may have been refreshed away and back since
+	// StartRequest, with a new count
+	if index := findAddrNode(blc.addressNodes, uid); index != -1 && blc.addressNodes[index].outstanding > 0 {
+		blc.addressNodes[index].outstanding--
+	}
+}
+
 func (blc *Balancer) refresh() error {
 	endPoints, err := blc.getEndPoints()
 	if err != nil {
@@ -6,6 +6,7 @@ package vtgate
 
 import (
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -235,3 +236,126 @@ func TestRefresh(t *testing.T) {
 		t.Errorf("want 12, got %v", port_new)
 	}
 }
+
+func TestInvalidate(t *testing.T) {
+	uids := []uint32{0}
+	getEndPoints := func() (*topo.EndPoints, error) {
+		if uids == nil {
+			return nil, fmt.Errorf("topo error")
+		}
+		endPoints := &topo.EndPoints{}
+		for _, uid := range uids {
+			endPoints.Entries = append(endPoints.Entries, topo.EndPoint{Uid: uid})
+		}
+		return endPoints, nil
+	}
+	b := NewBalancer(getEndPoints, RETRY_DELAY)
+	if addr, _ := b.Get(); addr.Uid != 0 {
+		t.Errorf("want 0, got %v", addr.Uid)
+	}
+	// The addresses are not read again without invalidation.
+	uids = []uint32{1}
+	if addr, _ := b.Get(); addr.Uid != 0 {
+		t.Errorf("want 0, got %v", addr.Uid)
+	}
+	b.Invalidate()
+	if addr, _ := b.Get(); addr.Uid != 1 {
+		t.Errorf("want 1, got %v", addr.Uid)
+	}
+	// The current addresses are kept if they can't be read.
+	uids = nil
+	b.Invalidate()
+	if addr, err := b.Get(); err != nil || addr.Uid != 1 {
+		t.Errorf("want 1, got %v %v", addr.Uid, err)
+	}
+}
+
+func setBalancerPolicy(policy string) func() {
+	saved := *balancerPolicy
+	*balancerPolicy = policy
+	return func() {
+		*balancerPolicy = saved
+	}
+}
+
+// checkBalance checks that each of the uids got about the same share
+// of the selections.
+func checkBalance(t *testing.T, policy string, selections map[uint32]int, uids []uint32, total int) {
+	for _, uid := range uids {
+		share := float64(selections[uid]) / float64(total)
+		want := 1 / float64(len(uids))
+		if share < want*0.9 || share > want*1.1 {
+			t.Errorf("%v: endpoint %v got %v of %v selections: %v", policy, uid, selections[uid], total, selections)
+		}
+	}
+	if len(selections) != len(uids) {
+		t.Errorf("%v: unexpected endpoints selected: %v", policy, selections)
+	}
+}
+
+func TestBalancerPolicyDistribution(t *testing.T) {
+	for _, policy := range BalancerPolicyNames() {
+		restore := setBalancerPolicy(policy)
+		b := NewBalancer(endPoints3, RETRY_DELAY)
+		restore()
+
+		selections := make(map[uint32]int)
+		for i := 0; i < 10000; i++ {
+			endPoint, err := b.Get()
+			if err != nil {
+				t.Fatalf("%v: Get failed: %v", policy, err)
+			}
+			selections[endPoint.Uid]++
+		}
+		checkBalance(t, policy, selections, []uint32{0, 1, 2}, 10000)
+
+		// marked down endpoints are skipped
+		b.MarkDown(1)
+		selections = make(map[uint32]int)
+		for i := 0; i < 10000; i++ {
+			endPoint, _ := b.Get()
+			selections[endPoint.Uid]++
+		}
+		checkBalance(t, policy, selections, []uint32{0, 2}, 10000)
+	}
+}
+
+func TestLeastOutstandingPolicy(t *testing.T) {
+	defer setBalancerPolicy("least_outstanding")()
+	b := NewBalancer(endPoints3, RETRY_DELAY)
+
+	// a busy endpoint isn't chosen
+	b.Get()
+	b.StartRequest(0)
+	b.StartRequest(0)
+	for i := 0; i < 100; i++ {
+		endPoint, _ := b.Get()
+		if endPoint.Uid == 0 {
+			t.Fatalf("the busy endpoint was chosen")
+		}
+	}
+
+	// requests that start on the chosen endpoint, and end in a
+	// random order, stay balanced
+	b.EndRequest(0)
+	b.EndRequest(0)
+	outstanding := []uint32{}
+	selections := make(map[uint32]int)
+	for i := 0; i < 10000; i++ {
+		endPoint, _ := b.Get()
+		selections[endPoint.Uid]++
+		b.StartRequest(endPoint.Uid)
+		outstanding = append(outstanding, endPoint.Uid)
+		if len(outstanding) > 10 {
+			j := rand.Intn(len(outstanding))
+			b.EndRequest(outstanding[j])
+			outstanding = append(outstanding[:j], outstanding[j+1:]...)
+		}
+	}
+	checkBalance(t, "least_outstanding", selections, []uint32{0, 1, 2}, 10000)
+	for _, addrNode := range b.addressNodes {
+		if addrNode.outstanding < 2 || addrNode.outstanding > 5 {
+			t.Errorf("unbalanced outstanding requests: %v on %v", addrNode.outstanding, addrNode.endPoint.Uid)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+
+	"github.com/youtube/vitess/go/stats"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+var (
+	maxBindVariables     = flag.Int("max_bind_variables", 10000, "maximum number of bind variable values in a request, each element of a list counting as one value")
+	maxBindVariablesSize = flag.Int("max_bind_variables_size", 16*1024*1024, "maximum total size in bytes of the bind variables of a request")
+
+	// bindVariablesRejections counts the requests rejected
+	// because of their bind variables, by "<method>.<keyspace>".
+	bindVariablesRejections = stats.NewCounters("VTGateBindVariablesRejections")
+)
+
+// TooManyBindVariablesError is returned for the requests whose bind
+// variables exceed -max_bind_variables or -max_bind_variables_size.
+type TooManyBindVariablesError struct {
+	Count, MaxCount int
+	Size, MaxSize   int
+}
+
+func (e *TooManyBindVariablesError) Error() string {
+	return fmt.Sprintf("vtgate: too many bind variables: %v values in %v bytes, the limits are %v values and %v bytes", e.Count, e.Size, e.MaxCount, e.MaxSize)
+}
+
+// BadBindVariableError is returned for the requests with a bind
+// variable that can't be converted into sqltypes values. Err is a
+// *tproto.BindVariableError, which names the Go type of the value, if
+// the type of the bind variable is not supported.
+type BadBindVariableError struct {
+	Name string
+	Err  error
+}
+
+func (e *BadBindVariableError) Error() string {
+	if _, ok := e.Err.(*tproto.BindVariableError); ok {
+		return fmt.Sprintf("vtgate: %v", e.Err)
+	}
+	return fmt.Sprintf("vtgate: bad bind variable %v: %v", e.Name, e.Err)
+}
+
+// bindVariablesCount returns the number of values of bindVars, the
+// elements of lists counted one by one, and their approximate
+// serialized size.
+func bindVariablesCount(bindVars map[string]interface{}) (count, size int) {
+	for name, v := range bindVars {
+		c, s := valueCount(v)
+		count += c
+		size += len(name) + s
+	}
+	return count, size
+}
+
+func valueCount(v interface{}) (count, size int) {
+	switch v := v.(type) {
+	case nil:
+		return 1, 0
+	case string:
+		return 1, len(v)
+	case []byte:
+		return 1, len(v)
+	case bool:
+		return 1, 1
+	case []interface{}:
+		for _, elem := range v {
+			c, s := valueCount(elem)
+			count += c
+			size += s
+		}
+		return count, size
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		for i := 0; i < rv.Len(); i++ {
+			c, s := valueCount(rv.Index(i).Interface())
+			count += c
+			size += s
+		}
+		return count, size
+	}
+	// numbers, times, ...
+	return 1, 8
+}
+
+// checkBindVariables returns a *TooManyBindVariablesError if count
+// values of size bytes exceed the limits, and counts the rejection.
+func checkBindVariables(method, keyspace string, count, size int) error {
+	if count <= *maxBindVariables && size <= *maxBindVariablesSize {
+		return nil
+	}
+	bindVariablesRejections.Add(method+"."+keyspace, 1)
+	return &TooManyBindVariablesError{
+		Count:    count,
+		MaxCount: *maxBindVariables,
+		Size:     size,
+		MaxSize:  *maxBindVariablesSize,
+	}
+}
+
+// checkBindVariableTypes returns a *BadBindVariableError for the
+// first bind variable of an unsupported type, see
+// tproto.ValidateBindVariables, and counts the rejection.
+func checkBindVariableTypes(method, keyspace string, bindVars map[string]interface{}) error {
+	err := tproto.ValidateBindVariables(bindVars)
+	if err == nil {
+		return nil
+	}
+	bindVariablesRejections.Add(method+"."+keyspace, 1)
+	return &BadBindVariableError{Name: err.(*tproto.BindVariableError).Name, Err: err}
+}
+
+// normalizeBindVariables converts the bind variables of a request
+// into sqltypes values in place, see tproto.BindVariableToValue, so
+// the per-shard queries are built from values whose type can't change
+// on the way to the tablets.
+func normalizeBindVariables(method, keyspace string, bindVars map[string]interface{}) error {
+	if err := checkBindVariableTypes(method, keyspace, bindVars); err != nil {
+		return err
+	}
+	for name, v := range bindVars {
+		value, err := tproto.BindVariableToValue(v)
+		if err != nil {
+			bindVariablesRejections.Add(method+"."+keyspace, 1)
+			return &BadBindVariableError{Name: name, Err: err}
+		}
+		bindVars[name] = value
+	}
+	return nil
+}
+
+// validateBindVariables checks the bind variables of a request
+// against the limits, and normalizes them.
+func validateBindVariables(method, keyspace string, bindVars map[string]interface{}) error {
+	count, size := bindVariablesCount(bindVars)
+	if err := checkBindVariables(method, keyspace, count, size); err != nil {
+		return err
+	}
+	return normalizeBindVariables(method, keyspace, bindVars)
+}
+
+// validateBatchBindVariables checks the bind variables of each query
+// of a batch, and of the whole batch, against the limits, and
+// normalizes them.
+func validateBatchBindVariables(method, keyspace string, queries []tproto.BoundQuery) error {
+	totalCount, totalSize := 0, 0
+	for _, query := range queries {
+		count, size := bindVariablesCount(query.BindVariables)
+		if err := checkBindVariables(method, keyspace, count, size); err != nil {
+			return err
+		}
+		totalCount += count
+		totalSize += size
+	}
+	if err := checkBindVariables(method, keyspace, totalCount, totalSize); err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if err := normalizeBindVariables(method, keyspace, query.BindVariables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
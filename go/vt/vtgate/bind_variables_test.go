@@ -0,0 +1,367 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/sqlparser"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func TestBindVariablesCount(t *testing.T) {
+	count, size := bindVariablesCount(map[string]interface{}{
+		"id":    int64(1),
+		"name":  "abc",
+		"ids":   []interface{}{int64(1), int64(2), int64(3)},
+		"names": []string{"a", "bc"},
+		"null":  nil,
+	})
+	// 1+1+3+2+1 values, 18 bytes of names and 8+3+24+3+0 bytes of values
+	if count != 8 || size != 56 {
+		t.Errorf("want 8 values in 56 bytes, got %v in %v", count, size)
+	}
+}
+
+func setBindVariablesLimits(count, size int) func() {
+	savedCount, savedSize := *maxBindVariables, *maxBindVariablesSize
+	*maxBindVariables, *maxBindVariablesSize = count, size
+	return func() {
+		*maxBindVariables, *maxBindVariablesSize = savedCount, savedSize
+	}
+}
+
+func TestBindVariablesLimits(t *testing.T) {
+	defer setBindVariablesLimits(3, 100)()
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+
+	// too many values
+	q := proto.QueryShard{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"ids": []interface{}{1, 2, 3, 4}},
+		Keyspace:      "bv_keyspace",
+		TabletType:    topo.TYPE_MASTER,
+		Shards:        []string{"0"},
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	want := "vtgate: too many bind variables: 4 values in 35 bytes, the limits are 3 values and 100 bytes"
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+
+	// too big
+	q.BindVariables = map[string]interface{}{"name": make([]byte, 100)}
+	err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(*proto.QueryResult) error { return nil })
+	if _, ok := err.(*TooManyBindVariablesError); !ok {
+		t.Errorf("want *TooManyBindVariablesError, got %v", err)
+	}
+	if sbc.ExecCount != 0 {
+		t.Errorf("rejected queries reached the tablet: %v", sbc.ExecCount)
+	}
+
+	// batches are checked per query and in aggregate
+	bq := proto.BatchQueryShard{
+		Queries: []tproto.BoundQuery{
+			{Sql: "query1", BindVariables: map[string]interface{}{"a": 1, "b": 2}},
+			{Sql: "query2", BindVariables: map[string]interface{}{"a": 1}},
+		},
+		Keyspace:   "bv_keyspace",
+		TabletType: topo.TYPE_MASTER,
+		Shards:     []string{"0"},
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	if qrl.Error != "" {
+		t.Errorf("want no error, got %v", qrl.Error)
+	}
+	bq.Queries[1].BindVariables["b"] = 2
+	qrl = new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	want = "vtgate: too many bind variables: 4 values in 36 bytes, the limits are 3 values and 100 bytes"
+	if qrl.Error != want {
+		t.Errorf("want %v, got %v", want, qrl.Error)
+	}
+
+	counts := bindVariablesRejections.Counts()
+	for _, name := range []string{"ExecuteShard.bv_keyspace", "StreamExecuteShard.bv_keyspace", "ExecuteBatchShard.bv_keyspace"} {
+		if counts[name] != 1 {
+			t.Errorf("want 1 %v rejection, got %v", name, counts[name])
+		}
+	}
+}
+
+func TestBindVariablesNormalized(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+
+	q := proto.QueryShard{
+		Sql: "query",
+		BindVariables: map[string]interface{}{
+			"id":   int64(123),
+			"name": "123",
+			"ids":  []interface{}{int64(1), "2"},
+		},
+		Keyspace:   "bvn_keyspace",
+		TabletType: topo.TYPE_MASTER,
+		Shards:     []string{"0"},
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	want := map[string]interface{}{
+		"id":   sqltypes.MakeNumeric([]byte("123")),
+		"name": sqltypes.MakeString([]byte("123")),
+		"ids":  []sqltypes.Value{sqltypes.MakeNumeric([]byte("1")), sqltypes.MakeString([]byte("2"))},
+	}
+	if !reflect.DeepEqual(q.BindVariables, want) {
+		t.Errorf("got %#v, want %#v", q.BindVariables, want)
+	}
+
+	q.BindVariables = map[string]interface{}{"bad": map[string]interface{}{}}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if !strings.HasPrefix(qr.Error, "vtgate: bad bind variable bad: ") {
+		t.Errorf("want a bad bind variable error, got %v", qr.Error)
+	}
+	if sbc.ExecCount != 1 {
+		t.Errorf("want 1 query on the tablet, got %v", sbc.ExecCount)
+	}
+}
+
+func TestBindVariablesListsPassedThrough(t *testing.T) {
+	resetSandbox()
+	sbc := &bindVarsConn{}
+	testConns[0] = sbc
+
+	encoded, err := bson.Marshal(&proto.QueryShard{
+		Sql: "select * from a where id in ::ids",
+		BindVariables: map[string]interface{}{
+			"ids":   []int64{1, 2},
+			"names": []string{"a", "b"},
+			"empty": []interface{}{},
+		},
+		Keyspace:   "bvl_keyspace",
+		TabletType: topo.TYPE_MASTER,
+		Shards:     []string{"0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q proto.QueryShard
+	if err := bson.Unmarshal(encoded, &q); err != nil {
+		t.Fatal(err)
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" {
+		t.Fatalf("want no error, got %v", qr.Error)
+	}
+
+	// The tablet must receive the same lists, and not a nil for the
+	// empty one.
+	encoded, err = bson.Marshal(&tproto.Query{Sql: q.Sql, BindVariables: sbc.bindVars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tq tproto.Query
+	if err := bson.Unmarshal(encoded, &tq); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"ids":   []interface{}{int64(1), int64(2)},
+		"names": []interface{}{[]byte("a"), []byte("b")},
+		"empty": []interface{}{},
+	}
+	if !reflect.DeepEqual(tq.BindVariables, want) {
+		t.Errorf("got %#v, want %#v", tq.BindVariables, want)
+	}
+}
+
+func TestBindVariablesTime(t *testing.T) {
+	resetSandbox()
+	sbc := &bindVarsConn{}
+	testConns[0] = sbc
+
+	encoded, err := bson.Marshal(&proto.QueryShard{
+		Sql:           "select * from a where t = :t",
+		BindVariables: map[string]interface{}{"t": time.Date(2014, 5, 6, 7, 8, 9, 123456e3, time.FixedZone("X", 3600))},
+		Keyspace:      "bvt_keyspace",
+		TabletType:    topo.TYPE_MASTER,
+		Shards:        []string{"0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q proto.QueryShard
+	if err := bson.Unmarshal(encoded, &q); err != nil {
+		t.Fatal(err)
+	}
+	// bson only keeps milliseconds.
+	if want := time.Date(2014, 5, 6, 6, 8, 9, 123e6, time.UTC); !reflect.DeepEqual(q.BindVariables["t"], want) {
+		t.Errorf("got %#v, want %#v", q.BindVariables["t"], want)
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" {
+		t.Fatalf("want no error, got %v", qr.Error)
+	}
+	want := sqltypes.MakeString([]byte("2014-05-06 06:08:09.123"))
+	if got := sbc.bindVars["t"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestBindVariablesUint64(t *testing.T) {
+	testcases := []struct {
+		in  uint64
+		out string
+	}{
+		{0, "0"},
+		{math.MaxInt64, "9223372036854775807"},
+		{math.MaxInt64 + 1, "9223372036854775808"},
+		{math.MaxUint64, "18446744073709551615"},
+	}
+	resetSandbox()
+	sbc := &bindVarsConn{}
+	testConns[0] = sbc
+	for _, tcase := range testcases {
+		encoded, err := bson.Marshal(&proto.QueryShard{
+			Sql:           "select * from a where h = :h",
+			BindVariables: map[string]interface{}{"h": tcase.in},
+			Keyspace:      "bvu_keyspace",
+			TabletType:    topo.TYPE_MASTER,
+			Shards:        []string{"0"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q proto.QueryShard
+		if err := bson.Unmarshal(encoded, &q); err != nil {
+			t.Fatal(err)
+		}
+		if got := q.BindVariables["h"]; got != tcase.in {
+			t.Errorf("%v: decoded %#v", tcase.in, got)
+		}
+		qr := new(proto.QueryResult)
+		RpcVTGate.ExecuteShard(nil, &q, qr)
+		if qr.Error != "" {
+			t.Fatalf("want no error, got %v", qr.Error)
+		}
+
+		// Send the bind variable to the tablet, and build the
+		// literal the tablet sends to MySQL.
+		encoded, err = bson.Marshal(&tproto.Query{Sql: q.Sql, BindVariables: sbc.bindVars})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tq tproto.Query
+		if err := bson.Unmarshal(encoded, &tq); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := sqlparser.EncodeValue(buf, tq.BindVariables["h"]); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tcase.out {
+			t.Errorf("%v: got literal %s, want %s", tcase.in, buf.String(), tcase.out)
+		}
+	}
+}
+
+func TestBindVariablesUnsupportedTypes(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	mapTestConn("-20", sbc)
+	testConns[0] = sbc
+
+	for _, c := range []struct {
+		v    interface{}
+		want string
+	}{
+		{int8(1), "vtgate: bad bind variable v: unsupported type int8"},
+		{float32(1), "vtgate: bad bind variable v: unsupported type float32"},
+		{&struct{}{}, "vtgate: bad bind variable v: unsupported type *struct {}"},
+		{map[string]interface{}{}, "vtgate: bad bind variable v: unsupported type map[string]interface {}"},
+		{struct{ A int }{}, "vtgate: bad bind variable v: unsupported type struct { A int }"},
+		{make(chan int), "vtgate: bad bind variable v: unsupported type chan int"},
+		{func() {}, "vtgate: bad bind variable v: unsupported type func()"},
+		{[]interface{}{1, []interface{}{2}}, "vtgate: bad bind variable v: element 1 has the unsupported type []interface {}"},
+		{[]interface{}{[]interface{}{1, uint16(2)}}, "vtgate: bad bind variable v: element 0.1 has the unsupported type uint16"},
+	} {
+		bindVars := func() map[string]interface{} {
+			return map[string]interface{}{"id": 1, "v": c.v}
+		}
+		q := proto.QueryShard{
+			Sql:           "query",
+			BindVariables: bindVars(),
+			Keyspace:      "bvut_keyspace",
+			TabletType:    topo.TYPE_MASTER,
+			Shards:        []string{"0"},
+		}
+		qr := new(proto.QueryResult)
+		RpcVTGate.ExecuteShard(nil, &q, qr)
+		if qr.Error != c.want {
+			t.Errorf("ExecuteShard: want %v, got %v", c.want, qr.Error)
+		}
+
+		q.BindVariables = bindVars()
+		err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(*proto.QueryResult) error { return nil })
+		if err == nil || err.Error() != c.want {
+			t.Errorf("StreamExecuteShard: want %v, got %v", c.want, err)
+		}
+
+		bq := proto.BatchQueryShard{
+			Queries: []tproto.BoundQuery{
+				{Sql: "query1", BindVariables: map[string]interface{}{"id": 1}},
+				{Sql: "query2", BindVariables: bindVars()},
+			},
+			Keyspace:   "bvut_keyspace",
+			TabletType: topo.TYPE_MASTER,
+			Shards:     []string{"0"},
+		}
+		qrl := new(proto.QueryResultList)
+		RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+		if qrl.Error != c.want {
+			t.Errorf("ExecuteBatchShard: want %v, got %v", c.want, qrl.Error)
+		}
+
+		// the entity ids are checked too
+		eq := proto.EntityIdsQuery{
+			Sql:               "query",
+			Keyspace:          "ks_entity_ids",
+			EntityColumnName:  "v",
+			EntityKeyspaceIds: []proto.EntityId{{ExternalId: 1, KeyspaceId: "\x10"}, {ExternalId: c.v, KeyspaceId: "\x10"}},
+			TabletType:        topo.TYPE_MASTER,
+		}
+		qr = new(proto.QueryResult)
+		RpcVTGate.ExecuteEntityIds(nil, &eq, qr)
+		if !strings.HasPrefix(qr.Error, "vtgate: bad bind variable v: element 1") {
+			t.Errorf("ExecuteEntityIds: want a bad element 1, got %v", qr.Error)
+		}
+	}
+	if sbc.ExecCount != 0 {
+		t.Errorf("rejected queries reached the tablet: %v", sbc.ExecCount)
+	}
+	if got, want := bindVariablesRejections.Counts()["ExecuteShard.bvut_keyspace"], int64(9); got != want {
+		t.Errorf("want %v ExecuteShard rejections, got %v", want, got)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var compressMinSize = flag.Int("compress_min_size", 64*1024, "size in bytes from which vtgate compresses the results of the clients that accept it, see QueryShard.Compression. 0 disables the compression.")
+
+// resultCompressMinSize returns the CompressMinSize of the results of
+// a request of compression, 0 if they're not compressed.
+func resultCompressMinSize(compression string) int {
+	if compression != proto.COMPRESSION_SNAPPY || *compressMinSize <= 0 {
+		return 0
+	}
+	return *compressMinSize
+}
+
+// compressReplies returns sendReply, setting the CompressMinSize of
+// the replies for a streaming request of compression.
+func compressReplies(compression string, sendReply func(*proto.QueryResult) error) func(*proto.QueryResult) error {
+	minSize := resultCompressMinSize(compression)
+	if minSize == 0 {
+		return sendReply
+	}
+	return func(reply *proto.QueryResult) error {
+		reply.CompressMinSize = minSize
+		return sendReply(reply)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+func TestVTGateCompression(t *testing.T) {
+	saved := *compressMinSize
+	defer func() { *compressMinSize = saved }()
+	*compressMinSize = 10
+
+	resetSandbox()
+	testConns[0] = &sandboxConn{}
+	testcases := []struct {
+		compression string
+		minSize     int
+		want        int
+	}{
+		{"", 10, 0},
+		{proto.COMPRESSION_SNAPPY, 10, 10},
+		// the servers ignore the compressions they don't know of
+		{"gzip", 10, 0},
+		{proto.COMPRESSION_SNAPPY, 0, 0},
+	}
+	for _, tcase := range testcases {
+		*compressMinSize = tcase.minSize
+		q := proto.QueryShard{
+			Sql:         "query",
+			Keyspace:    "compression_keyspace",
+			Shards:      []string{"0"},
+			TabletType:  topo.TYPE_MASTER,
+			Compression: tcase.compression,
+		}
+		qr := new(proto.QueryResult)
+		if err := RpcVTGate.ExecuteShard(nil, &q, qr); err != nil {
+			t.Fatalf("want nil, got %v", err)
+		}
+		if qr.CompressMinSize != tcase.want {
+			t.Errorf("%q, %v: got CompressMinSize %v, want %v", tcase.compression, tcase.minSize, qr.CompressMinSize, tcase.want)
+		}
+
+		sq := proto.StreamQueryShard{
+			Sql:         "query",
+			Keyspace:    "compression_keyspace",
+			Shards:      []string{"0"},
+			TabletType:  topo.TYPE_MASTER,
+			Compression: tcase.compression,
+		}
+		count := 0
+		err := RpcVTGate.StreamExecuteShard(nil, &sq, func(r *proto.QueryResult) error {
+			count++
+			if r.CompressMinSize != tcase.want {
+				t.Errorf("%q, %v: got CompressMinSize %v, want %v", tcase.compression, tcase.minSize, r.CompressMinSize, tcase.want)
+			}
+			return nil
+		})
+		if err != nil || count == 0 {
+			t.Errorf("got %v packets, error %v", count, err)
+		}
+	}
+}
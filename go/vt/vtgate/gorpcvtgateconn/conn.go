@@ -0,0 +1,213 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gorpcvtgateconn provides go rpc connectivity for VTGate.
+package gorpcvtgateconn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/rpcplus"
+	"github.com/youtube/vitess/go/rpcwrap/bsonrpc"
+	"github.com/youtube/vitess/go/vt/rpc"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+	"github.com/youtube/vitess/go/vt/vtgate/vtgateconn"
+)
+
+func init() {
+	vtgateconn.RegisterDialer("gorpc", dial)
+}
+
+// vtgateConn implements a bson rpcplus implementation for VTGateConn
+type vtgateConn struct {
+	mu        sync.RWMutex
+	address   string
+	rpcClient *rpcplus.Client
+}
+
+func dial(context interface{}, address string, timeout time.Duration) (vtgateconn.VTGateConn, error) {
+	rpcClient, err := bsonrpc.DialHTTP("tcp", address, timeout, nil)
+	if err != nil {
+		return nil, vtgateError(err)
+	}
+	return &vtgateConn{address: address, rpcClient: rpcClient}, nil
+}
+
+func (conn *vtgateConn) ExecuteShard(context interface{}, timeout time.Duration, query *proto.QueryShard) (*proto.QueryResult, error) {
+	q := *query
+	q.DeadlineMs = deadlineMs(query.DeadlineMs, timeout)
+	qr := new(proto.QueryResult)
+	if err := conn.call("VTGate.ExecuteShard", timeout, &q, qr); err != nil {
+		return nil, err
+	}
+	if qr.Error != "" {
+		return qr, &vtgateconn.ServerError{Code: qr.ErrorCode, Err: qr.Error}
+	}
+	return qr, nil
+}
+
+func (conn *vtgateConn) ExecuteBatchShard(context interface{}, timeout time.Duration, batchQuery *proto.BatchQueryShard) (*proto.QueryResultList, error) {
+	bq := *batchQuery
+	bq.DeadlineMs = deadlineMs(batchQuery.DeadlineMs, timeout)
+	qrl := new(proto.QueryResultList)
+	if err := conn.call("VTGate.ExecuteBatchShard", timeout, &bq, qrl); err != nil {
+		return nil, err
+	}
+	if qrl.Error != "" {
+		return qrl, &vtgateconn.ServerError{Code: qrl.ErrorCode, Err: qrl.Error}
+	}
+	return qrl, nil
+}
+
+func (conn *vtgateConn) StreamExecuteShard(context interface{}, timeout time.Duration, query *proto.StreamQueryShard) (<-chan *proto.QueryResult, vtgateconn.ErrFunc) {
+	q := *query
+	q.DeadlineMs = deadlineMs(query.DeadlineMs, timeout)
+	return conn.streamExecute("VTGate.StreamExecuteShard", timeout, &q)
+}
+
+func (conn *vtgateConn) StreamExecuteKeyRange(context interface{}, timeout time.Duration, query *proto.StreamQueryKeyRange) (<-chan *proto.QueryResult, vtgateconn.ErrFunc) {
+	q := *query
+	q.DeadlineMs = deadlineMs(query.DeadlineMs, timeout)
+	return conn.streamExecute("VTGate.StreamExecuteKeyRange", timeout, &q)
+}
+
+func (conn *vtgateConn) Begin(context interface{}, timeout time.Duration) (*proto.Session, error) {
+	session := new(proto.Session)
+	if err := conn.call("VTGate.Begin", timeout, "", session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (conn *vtgateConn) Commit(context interface{}, timeout time.Duration, session *proto.Session) error {
+	var noOutput rpc.UnusedResponse
+	return conn.call("VTGate.Commit", timeout, session, &noOutput)
+}
+
+func (conn *vtgateConn) Rollback(context interface{}, timeout time.Duration, session *proto.Session) error {
+	var noOutput rpc.UnusedResponse
+	return conn.call("VTGate.Rollback", timeout, session, &noOutput)
+}
+
+func (conn *vtgateConn) Ping(context interface{}, timeout time.Duration) error {
+	var noOutput rpc.UnusedResponse
+	return conn.call("VTGate.Ping", timeout, "", &noOutput)
+}
+
+func (conn *vtgateConn) Close() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.rpcClient == nil {
+		return
+	}
+
+	rpcClient := conn.rpcClient
+	conn.rpcClient = nil
+	rpcClient.Close()
+}
+
+func (conn *vtgateConn) client() (*rpcplus.Client, error) {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	if conn.rpcClient == nil {
+		return nil, vtgateconn.OperationalError("vtgate: connection closed")
+	}
+	return conn.rpcClient, nil
+}
+
+// call sends a request and waits for its reply for at most timeout,
+// or forever if timeout is 0. On timeout the connection is closed,
+// so it doesn't get reused.
+func (conn *vtgateConn) call(method string, timeout time.Duration, args, reply interface{}) error {
+	rpcClient, err := conn.client()
+	if err != nil {
+		return err
+	}
+	c := rpcClient.Go(method, args, reply, make(chan *rpcplus.Call, 1))
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	select {
+	case <-c.Done:
+		return vtgateError(c.Error)
+	case <-deadline:
+		conn.Close()
+		return timeoutError(method, timeout)
+	}
+}
+
+// streamExecute starts a streaming call. If timeout is set, the
+// stream is aborted and the connection closed when no packet is
+// received for that long.
+func (conn *vtgateConn) streamExecute(method string, timeout time.Duration, query interface{}) (<-chan *proto.QueryResult, vtgateconn.ErrFunc) {
+	rpcClient, err := conn.client()
+	if err != nil {
+		sr := make(chan *proto.QueryResult)
+		close(sr)
+		return sr, func() error { return err }
+	}
+
+	sr := make(chan *proto.QueryResult, 10)
+	c := rpcClient.StreamGo(method, query, sr)
+	if timeout == 0 {
+		return sr, func() error { return vtgateError(c.Error) }
+	}
+
+	out := make(chan *proto.QueryResult, 10)
+	var streamErr error
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case qr, ok := <-sr:
+				if !ok {
+					streamErr = vtgateError(c.Error)
+					return
+				}
+				out <- qr
+			case <-time.After(timeout):
+				streamErr = timeoutError(method, timeout)
+				conn.Close()
+				// Closing the connection terminates the call,
+				// drain what is left so the client can shut down.
+				for _ = range sr {
+				}
+				return
+			}
+		}
+	}()
+	return out, func() error { return streamErr }
+}
+
+// deadlineMs returns the DeadlineMs of a request sent with timeout,
+// so vtgate gives up on it when the client does: timeout rounded up
+// to the millisecond, unless the request already has a shorter
+// deadline.
+func deadlineMs(requestDeadlineMs int64, timeout time.Duration) int64 {
+	if timeout <= 0 {
+		return requestDeadlineMs
+	}
+	ms := int64((timeout + time.Millisecond - 1) / time.Millisecond)
+	if requestDeadlineMs > 0 && requestDeadlineMs < ms {
+		return requestDeadlineMs
+	}
+	return ms
+}
+
+func timeoutError(method string, timeout time.Duration) error {
+	return vtgateconn.OperationalError(fmt.Sprintf("vtgate: %v timed out after %v", method, timeout))
+}
+
+func vtgateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpcplus.ServerError); ok {
+		return &vtgateconn.ServerError{Err: fmt.Sprintf("vtgate: %v", err)}
+	}
+	return vtgateconn.OperationalError(fmt.Sprintf("vtgate: %v", err))
+}
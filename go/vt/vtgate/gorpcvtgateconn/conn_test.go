@@ -0,0 +1,214 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gorpcvtgateconn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/rpcplus"
+	"github.com/youtube/vitess/go/rpcwrap/bsonrpc"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/rpc"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+	"github.com/youtube/vitess/go/vt/vtgate/vtgateconn"
+)
+
+// hungVTGate answers pings, but never answers ExecuteShard, and
+// stops streaming after the first packet. It sends the DeadlineMs of
+// the queries it gets on deadlines.
+type hungVTGate struct {
+	hang      chan struct{}
+	deadlines chan int64
+}
+
+func (vtg *hungVTGate) Ping(noInput *rpc.UnusedRequest, noOutput *rpc.UnusedResponse) error {
+	return nil
+}
+
+func (vtg *hungVTGate) ExecuteShard(query *proto.QueryShard, reply *proto.QueryResult) error {
+	vtg.deadlines <- query.DeadlineMs
+	<-vtg.hang
+	return nil
+}
+
+func (vtg *hungVTGate) StreamExecuteShard(query *proto.StreamQueryShard, sendReply func(interface{}) error) error {
+	vtg.deadlines <- query.DeadlineMs
+	if err := sendReply(&proto.QueryResult{}); err != nil {
+		return err
+	}
+	<-vtg.hang
+	return nil
+}
+
+func newHungConn(t *testing.T) (*vtgateConn, *hungVTGate, func()) {
+	vtg := &hungVTGate{
+		hang:      make(chan struct{}),
+		deadlines: make(chan int64, 10),
+	}
+	server := rpcplus.NewServer()
+	if err := server.RegisterName("VTGate", vtg); err != nil {
+		t.Fatalf("RegisterName failed: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(bsonrpc.NewServerCodec(serverConn))
+	conn := &vtgateConn{
+		address:   "pipe",
+		rpcClient: rpcplus.NewClientWithCodec(bsonrpc.NewClientCodec(clientConn)),
+	}
+	return conn, vtg, func() {
+		close(vtg.hang)
+		conn.Close()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	conn, vtg, done := newHungConn(t)
+	defer done()
+
+	if err := conn.Ping(nil, time.Second); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	start := time.Now()
+	_, err := conn.ExecuteShard(nil, 50*time.Millisecond, &proto.QueryShard{})
+	if _, ok := err.(vtgateconn.OperationalError); !ok {
+		t.Errorf("want OperationalError, got %v", err)
+	}
+	if d := time.Now().Sub(start); d > time.Second {
+		t.Errorf("ExecuteShard took %v, want about 50ms", d)
+	}
+	// vtgate got the timeout as the deadline of the query
+	if deadline := <-vtg.deadlines; deadline != 50 {
+		t.Errorf("want a deadline of 50ms, got %v", deadline)
+	}
+
+	// the connection is not reused after a timeout
+	want := "vtgate: connection closed"
+	if err := conn.Ping(nil, time.Second); err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+func TestDeadlineMs(t *testing.T) {
+	testCases := []struct {
+		requestDeadlineMs int64
+		timeout           time.Duration
+		want              int64
+	}{
+		{0, 0, 0},
+		{20, 0, 20},
+		{0, 50 * time.Millisecond, 50},
+		{0, 1500 * time.Microsecond, 2},
+		{20, 50 * time.Millisecond, 20},
+		{100, 50 * time.Millisecond, 50},
+	}
+	for _, tc := range testCases {
+		if got := deadlineMs(tc.requestDeadlineMs, tc.timeout); got != tc.want {
+			t.Errorf("deadlineMs(%v, %v) = %v, want %v", tc.requestDeadlineMs, tc.timeout, got, tc.want)
+		}
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	conn, vtg, done := newHungConn(t)
+	defer done()
+
+	start := time.Now()
+	sr, errFunc := conn.StreamExecuteShard(nil, 50*time.Millisecond, &proto.StreamQueryShard{})
+	count := 0
+	for _ = range sr {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("want 1 packet, got %v", count)
+	}
+	if _, ok := errFunc().(vtgateconn.OperationalError); !ok {
+		t.Errorf("want OperationalError, got %v", errFunc())
+	}
+	if d := time.Now().Sub(start); d > time.Second {
+		t.Errorf("StreamExecuteShard took %v, want about 50ms", d)
+	}
+	if deadline := <-vtg.deadlines; deadline != 50 {
+		t.Errorf("want a deadline of 50ms, got %v", deadline)
+	}
+	if _, err := conn.client(); err == nil {
+		t.Errorf("want connection closed after a stream timeout")
+	}
+}
+
+// compressingVTGate compresses its results for the clients that
+// accept it, the larger ones only.
+type compressingVTGate struct{}
+
+// compressedResult has enough rows to be compressed.
+var compressedResult = &proto.QueryResult{Rows: [][]sqltypes.Value{
+	{sqltypes.MakeString([]byte("a value that is long enough to be compressed"))},
+	{sqltypes.MakeString([]byte("a value that is long enough to be compressed"))},
+}}
+
+// plainResult is too small to be compressed.
+var plainResult = &proto.QueryResult{Rows: [][]sqltypes.Value{{sqltypes.MakeString([]byte("1"))}}}
+
+func compressedCopy(qr *proto.QueryResult, compression string) *proto.QueryResult {
+	result := *qr
+	if compression == proto.COMPRESSION_SNAPPY {
+		result.CompressMinSize = 100
+	}
+	return &result
+}
+
+func (vtg *compressingVTGate) ExecuteShard(query *proto.QueryShard, reply *proto.QueryResult) error {
+	*reply = *compressedCopy(compressedResult, query.Compression)
+	return nil
+}
+
+func (vtg *compressingVTGate) StreamExecuteShard(query *proto.StreamQueryShard, sendReply func(interface{}) error) error {
+	for _, qr := range []*proto.QueryResult{compressedResult, plainResult, compressedResult} {
+		if err := sendReply(compressedCopy(qr, query.Compression)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompression(t *testing.T) {
+	server := rpcplus.NewServer()
+	if err := server.RegisterName("VTGate", &compressingVTGate{}); err != nil {
+		t.Fatalf("RegisterName failed: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(bsonrpc.NewServerCodec(serverConn))
+	conn := &vtgateConn{
+		address:   "pipe",
+		rpcClient: rpcplus.NewClientWithCodec(bsonrpc.NewClientCodec(clientConn)),
+	}
+	defer conn.Close()
+
+	for _, compression := range []string{"", proto.COMPRESSION_SNAPPY} {
+		qr, err := conn.ExecuteShard(nil, time.Second, &proto.QueryShard{Compression: compression})
+		if err != nil {
+			t.Fatalf("ExecuteShard failed: %v", err)
+		}
+		if !reflect.DeepEqual(qr.Rows, compressedResult.Rows) {
+			t.Errorf("%q: got %v, want %v", compression, qr.Rows, compressedResult.Rows)
+		}
+
+		// the compressed and plain packets of a stream are decoded
+		sr, errFunc := conn.StreamExecuteShard(nil, time.Second, &proto.StreamQueryShard{Compression: compression})
+		var got [][][]sqltypes.Value
+		for qr := range sr {
+			got = append(got, qr.Rows)
+		}
+		if err := errFunc(); err != nil {
+			t.Fatalf("StreamExecuteShard failed: %v", err)
+		}
+		want := [][][]sqltypes.Value{compressedResult.Rows, plainResult.Rows, compressedResult.Rows}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", compression, got, want)
+		}
+	}
+}
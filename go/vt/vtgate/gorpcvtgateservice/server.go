@@ -6,6 +6,8 @@
 package gorpcvtgateservice
 
 import (
+	"time"
+
 	"github.com/youtube/vitess/go/rpcwrap"
 	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
 	"github.com/youtube/vitess/go/vt/rpc"
@@ -21,11 +23,27 @@ func (vtg *VTGate) ExecuteShard(context *rpcproto.Context, query *proto.QuerySha
 	return vtg.server.ExecuteShard(context, query, reply)
 }
 
+func (vtg *VTGate) ExecuteKeyspaceIds(context *rpcproto.Context, query *proto.KeyspaceIdQuery, reply *proto.QueryResult) error {
+	return vtg.server.ExecuteKeyspaceIds(context, query, reply)
+}
+
+func (vtg *VTGate) ExecuteKeyRange(context *rpcproto.Context, query *proto.KeyRangeQuery, reply *proto.QueryResult) error {
+	return vtg.server.ExecuteKeyRange(context, query, reply)
+}
+
+func (vtg *VTGate) ExecuteEntityIds(context *rpcproto.Context, query *proto.EntityIdsQuery, reply *proto.QueryResult) error {
+	return vtg.server.ExecuteEntityIds(context, query, reply)
+}
+
 func (vtg *VTGate) ExecuteBatchShard(context *rpcproto.Context, batchQuery *proto.BatchQueryShard, reply *proto.QueryResultList) error {
 	return vtg.server.ExecuteBatchShard(context, batchQuery, reply)
 }
 
-func (vtg *VTGate) StreamExecuteShard(context *rpcproto.Context, query *proto.QueryShard, sendReply func(interface{}) error) error {
+func (vtg *VTGate) ExecuteBatchKeyspaceIds(context *rpcproto.Context, batchQuery *proto.KeyspaceIdBatchQuery, reply *proto.QueryResultList) error {
+	return vtg.server.ExecuteBatchKeyspaceIds(context, batchQuery, reply)
+}
+
+func (vtg *VTGate) StreamExecuteShard(context *rpcproto.Context, query *proto.StreamQueryShard, sendReply func(interface{}) error) error {
 	return vtg.server.StreamExecuteShard(context, query, func(value *proto.QueryResult) error {
 		return sendReply(value)
 	})
@@ -37,6 +55,12 @@ func (vtg *VTGate) StreamExecuteKeyRange(context *rpcproto.Context, query *proto
 	})
 }
 
+func (vtg *VTGate) StreamExecuteKeyspaceIds(context *rpcproto.Context, query *proto.StreamQueryKeyspaceIds, sendReply func(interface{}) error) error {
+	return vtg.server.StreamExecuteKeyspaceIds(context, query, func(value *proto.QueryResult) error {
+		return sendReply(value)
+	})
+}
+
 func (vtg *VTGate) Begin(context *rpcproto.Context, noInput *rpc.UnusedRequest, outSession *proto.Session) error {
 	return vtg.server.Begin(context, outSession)
 }
@@ -49,8 +73,20 @@ func (vtg *VTGate) Rollback(context *rpcproto.Context, inSession *proto.Session,
 	return vtg.server.Rollback(context, inSession)
 }
 
+func (vtg *VTGate) RollbackOldTransactions(context *rpcproto.Context, request *proto.RollbackOldTransactionsRequest, reply *proto.RollbackOldTransactionsReply) (err error) {
+	reply.RolledBack, err = vtg.server.RollbackOldTransactions(context, time.Duration(request.MinAgeSeconds)*time.Second)
+	return err
+}
+
+func (vtg *VTGate) Ping(context *rpcproto.Context, noInput *rpc.UnusedRequest, noOutput *rpc.UnusedResponse) error {
+	return vtg.server.Ping(context)
+}
+
 func init() {
 	vtgate.RegisterVTGates = append(vtgate.RegisterVTGates, func(vtGate *vtgate.VTGate) {
 		rpcwrap.RegisterAuthenticated(&VTGate{vtGate})
+		rpcwrap.OnConnClosed(func(context *rpcproto.Context) {
+			vtGate.ConnClosed(context)
+		})
 	})
 }
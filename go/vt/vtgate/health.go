@@ -0,0 +1,276 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var (
+	healthCheckInterval = flag.Duration("health_check_interval", 5*time.Second, "how often vtgate checks whether it can serve, see /debug/health")
+	healthTabletTypes   = flag.String("health_tablet_types", "master", "comma separated tablet types each shard of each keyspace of the cell needs end points of for vtgate to be healthy, none if empty")
+	healthMinEndPoints  = flag.Int("health_min_endpoints", 1, "number of end points of each -health_tablet_types each shard needs for vtgate to be healthy")
+)
+
+// srvTopoHealth is implemented by the SrvTopoServers that cache the
+// serving graph, like ResilientSrvTopoServer. The health check reads
+// the topology server behind the cache to know whether it can be
+// reached, and reports when the EndPoints were last read from it.
+type srvTopoHealth interface {
+	PingTopo(cell string) error
+
+	EndPointsRefreshTime(cell, keyspace, shard string, tabletType topo.TabletType) time.Time
+}
+
+// HealthReport is the result of a health check of vtgate. vtgate is
+// healthy if it has no Problems. It can still serve from its cache
+// while the topology server can't be reached.
+type HealthReport struct {
+	Time time.Time
+	// TopoError is set if the topology server can't be reached.
+	TopoError string
+	// Shards are the shards of each tablet type of the serving graph
+	// of the cell, sorted.
+	Shards []ShardHealth
+	// Problems are the reasons vtgate is not healthy.
+	Problems []string
+}
+
+// Healthy returns true if the report has no problems.
+func (report *HealthReport) Healthy() bool {
+	return report != nil && len(report.Problems) == 0
+}
+
+// ShardHealth is a shard of a HealthReport. RefreshTime is when its
+// EndPoints were last read from the topology server, if known.
+type ShardHealth struct {
+	Keyspace    string
+	Shard       string
+	TabletType  topo.TabletType
+	EndPoints   int
+	RefreshTime time.Time
+	Error       string
+}
+
+// healthChecker checks every shard of the serving graph of a cell has
+// minEndPoints end points of each of tabletTypes, and keeps the last
+// report.
+type healthChecker struct {
+	topoServer   SrvTopoServer
+	cell         string
+	tabletTypes  []topo.TabletType
+	minEndPoints int
+
+	mu     sync.Mutex
+	report *HealthReport
+}
+
+// newHealthChecker creates a healthChecker. If name is not empty, it
+// exports <name>Healthy and <name>TopoReachable, 1 or 0, and the
+// <name>EndPoints and <name>EndPointsAge in seconds of each
+// "<keyspace>.<shard>.<tablet type>", as of the last check.
+func newHealthChecker(name string, topoServer SrvTopoServer, cell string, tabletTypes []topo.TabletType, minEndPoints int) *healthChecker {
+	hc := &healthChecker{
+		topoServer:   topoServer,
+		cell:         cell,
+		tabletTypes:  tabletTypes,
+		minEndPoints: minEndPoints,
+	}
+	if name != "" {
+		stats.Publish(name+"Healthy", stats.IntFunc(func() int64 {
+			if hc.lastReport().Healthy() {
+				return 1
+			}
+			return 0
+		}))
+		stats.Publish(name+"TopoReachable", stats.IntFunc(func() int64 {
+			if report := hc.lastReport(); report != nil && report.TopoError == "" {
+				return 1
+			}
+			return 0
+		}))
+		stats.Publish(name+"EndPoints", stats.CountersFunc(func() map[string]int64 {
+			return hc.shardValues(func(shard *ShardHealth) int64 {
+				return int64(shard.EndPoints)
+			})
+		}))
+		stats.Publish(name+"EndPointsAge", stats.CountersFunc(func() map[string]int64 {
+			now := time.Now()
+			return hc.shardValues(func(shard *ShardHealth) int64 {
+				if shard.RefreshTime.IsZero() {
+					return -1
+				}
+				return int64(now.Sub(shard.RefreshTime).Seconds())
+			})
+		}))
+	}
+	return hc
+}
+
+// parseHealthTabletTypes parses -health_tablet_types.
+func parseHealthTabletTypes(value string) ([]topo.TabletType, error) {
+	var tabletTypes []topo.TabletType
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		tabletType := topo.TabletType(name)
+		if err := validateTabletType(tabletType); err != nil {
+			return nil, err
+		}
+		tabletTypes = append(tabletTypes, tabletType)
+	}
+	return tabletTypes, nil
+}
+
+// lastReport returns the report of the last check, or nil.
+func (hc *healthChecker) lastReport() *HealthReport {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.report
+}
+
+// shardValues returns value for each shard of the last report, by
+// "<keyspace>.<shard>.<tablet type>".
+func (hc *healthChecker) shardValues(value func(shard *ShardHealth) int64) map[string]int64 {
+	report := hc.lastReport()
+	if report == nil {
+		return nil
+	}
+	values := make(map[string]int64, len(report.Shards))
+	for i := range report.Shards {
+		shard := &report.Shards[i]
+		values[shard.Keyspace+"."+shard.Shard+"."+string(shard.TabletType)] = value(shard)
+	}
+	return values
+}
+
+// checkLoop checks the health right away, and then every interval,
+// for ever.
+func (hc *healthChecker) checkLoop(interval time.Duration) {
+	hc.check()
+	for _ = range time.Tick(interval) {
+		hc.check()
+	}
+}
+
+// check checks the health of vtgate, and keeps the report.
+func (hc *healthChecker) check() *HealthReport {
+	report := &HealthReport{Time: time.Now()}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+	health, _ := hc.topoServer.(srvTopoHealth)
+	if health != nil {
+		if err := health.PingTopo(hc.cell); err != nil {
+			report.TopoError = err.Error()
+		}
+	}
+
+	keyspaces, err := hc.topoServer.GetSrvKeyspaceNames(hc.cell)
+	if err != nil {
+		if health == nil {
+			report.TopoError = err.Error()
+		}
+		problem("cannot read the keyspaces of cell %v: %v", hc.cell, err)
+	} else if len(keyspaces) == 0 {
+		problem("no keyspace in cell %v", hc.cell)
+	}
+	sort.Strings(keyspaces)
+	for _, keyspace := range keyspaces {
+		srvKeyspace, err := hc.topoServer.GetSrvKeyspace(hc.cell, keyspace)
+		if err != nil {
+			problem("cannot read keyspace %v: %v", keyspace, err)
+			continue
+		}
+		for _, tabletType := range hc.tabletTypes {
+			// the keyspaces served from another one are checked
+			// with it
+			if _, ok := srvKeyspace.Partitions[tabletType]; !ok && srvKeyspace.ServedFrom[tabletType] == "" {
+				problem("no %v shards in keyspace %v", tabletType, keyspace)
+			}
+		}
+		tabletTypes := make([]string, 0, len(srvKeyspace.Partitions))
+		for tabletType := range srvKeyspace.Partitions {
+			tabletTypes = append(tabletTypes, string(tabletType))
+		}
+		sort.Strings(tabletTypes)
+		for _, name := range tabletTypes {
+			tabletType := topo.TabletType(name)
+			partition := srvKeyspace.Partitions[tabletType]
+			if partition == nil {
+				continue
+			}
+			required := topo.IsTypeInList(tabletType, hc.tabletTypes)
+			for _, srvShard := range sortedShards(partition.Shards) {
+				shard := ShardHealth{Keyspace: keyspace, Shard: srvShard.ShardName(), TabletType: tabletType}
+				endPoints, err := hc.topoServer.GetEndPoints(hc.cell, keyspace, shard.Shard, tabletType)
+				if err != nil {
+					shard.Error = err.Error()
+				} else {
+					shard.EndPoints = len(endPoints.Entries)
+				}
+				if health != nil {
+					shard.RefreshTime = health.EndPointsRefreshTime(hc.cell, keyspace, shard.Shard, tabletType)
+				}
+				if required && shard.EndPoints < hc.minEndPoints {
+					problem("shard %v/%v has %v %v end points, want at least %v", keyspace, shard.Shard, shard.EndPoints, tabletType, hc.minEndPoints)
+				}
+				report.Shards = append(report.Shards, shard)
+			}
+		}
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.report = report
+	return report
+}
+
+// ServeHTTP reports the last health check, with the status 200 if
+// vtgate is healthy, 503 otherwise.
+func (hc *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	report := hc.lastReport()
+	if report == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not checked yet\n")
+		return
+	}
+	if report.Healthy() {
+		fmt.Fprintf(w, "healthy")
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not healthy")
+	}
+	fmt.Fprintf(w, ", checked at %v\n", report.Time.Format(time.RFC3339))
+	if report.TopoError != "" {
+		fmt.Fprintf(w, "topology server not reachable: %v\n", report.TopoError)
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintf(w, "problem: %v\n", problem)
+	}
+	now := time.Now()
+	for _, shard := range report.Shards {
+		fmt.Fprintf(w, "%v/%v %v: %v end points", shard.Keyspace, shard.Shard, shard.TabletType, shard.EndPoints)
+		if !shard.RefreshTime.IsZero() {
+			fmt.Fprintf(w, ", refreshed %v ago", now.Sub(shard.RefreshTime))
+		}
+		if shard.Error != "" {
+			fmt.Fprintf(w, ", error: %v", shard.Error)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// healthTopo is a SrvTopoServer serving keyspaces whose shards have
+// a number of end points, that can be changed or broken.
+type healthTopo struct {
+	mu        sync.Mutex
+	keyspaces map[string]*topo.SrvKeyspace
+	// endPoints has the number of end points by
+	// "<keyspace>/<shard>/<tablet type>", 0 by default.
+	endPoints map[string]int
+	fail      bool
+}
+
+func (ht *healthTopo) GetSrvKeyspaceNames(cell string) ([]string, error) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.fail {
+		return nil, fmt.Errorf("topo error")
+	}
+	var names []string
+	for name := range ht.keyspaces {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (ht *healthTopo) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.fail {
+		return nil, fmt.Errorf("topo error")
+	}
+	return ht.keyspaces[keyspace], nil
+}
+
+func (ht *healthTopo) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	if ht.fail {
+		return nil, fmt.Errorf("topo error")
+	}
+	endPoints := &topo.EndPoints{}
+	for i := 0; i < ht.endPoints[keyspace+"/"+shard+"/"+string(tabletType)]; i++ {
+		endPoints.Entries = append(endPoints.Entries, topo.EndPoint{Uid: uint32(i)})
+	}
+	return endPoints, nil
+}
+
+func (ht *healthTopo) setEndPoints(key string, count int) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.endPoints[key] = count
+}
+
+func (ht *healthTopo) setFail(fail bool) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ht.fail = fail
+}
+
+func TestHealthChecker(t *testing.T) {
+	sharded := masterKeyspace("-80", "80-")
+	sharded.Partitions[topo.TYPE_REPLICA] = &topo.KeyspacePartition{Shards: []topo.SrvShard{{}}}
+	ht := &healthTopo{
+		keyspaces: map[string]*topo.SrvKeyspace{
+			"sharded": sharded,
+			"served_from": {
+				Partitions: map[topo.TabletType]*topo.KeyspacePartition{topo.TYPE_REPLICA: {Shards: []topo.SrvShard{{}}}},
+				ServedFrom: map[topo.TabletType]string{topo.TYPE_MASTER: "sharded"},
+			},
+		},
+		endPoints: map[string]int{
+			"sharded/-80/master": 1,
+			"sharded/0/replica":  2,
+		},
+	}
+	server := newResilientSrvTopoServer(ht, "")
+	hc := newHealthChecker("", server, "cell", []topo.TabletType{topo.TYPE_MASTER}, 1)
+	serve := func() (int, string) {
+		w := httptest.NewRecorder()
+		hc.ServeHTTP(w, nil)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("want 503 before the first check, got %v", code)
+	}
+
+	report := hc.check()
+	wantProblems := []string{"shard sharded/80- has 0 master end points, want at least 1"}
+	if !reflect.DeepEqual(report.Problems, wantProblems) {
+		t.Errorf("want problems %v, got %v", wantProblems, report.Problems)
+	}
+	var shards []string
+	for _, shard := range report.Shards {
+		shards = append(shards, fmt.Sprintf("%v/%v/%v:%v", shard.Keyspace, shard.Shard, shard.TabletType, shard.EndPoints))
+		if shard.RefreshTime.IsZero() {
+			t.Errorf("want the refresh time of %+v", shard)
+		}
+	}
+	wantShards := []string{"served_from/0/replica:0", "sharded/-80/master:1", "sharded/80-/master:0", "sharded/0/replica:2"}
+	if !reflect.DeepEqual(shards, wantShards) {
+		t.Errorf("want shards %v, got %v", wantShards, shards)
+	}
+	code, page := serve()
+	if code != http.StatusServiceUnavailable || !strings.Contains(page, "not healthy") || !strings.Contains(page, "sharded/80- master: 0 end points, refreshed ") {
+		t.Errorf("unexpected page %v:\n%v", code, page)
+	}
+
+	// the new end point is read once the cached ones are invalidated
+	ht.setEndPoints("sharded/80-/master", 1)
+	server.InvalidateEndPoints("cell", "sharded", "80-", topo.TYPE_MASTER)
+	report = hc.check()
+	if !report.Healthy() || report.TopoError != "" {
+		t.Errorf("want a healthy report, got %+v", report)
+	}
+	if code, page := serve(); code != http.StatusOK || !strings.HasPrefix(page, "healthy") {
+		t.Errorf("unexpected page %v:\n%v", code, page)
+	}
+
+	// vtgate serves from its cache while the topology server can't be
+	// reached
+	ht.setFail(true)
+	report = hc.check()
+	if !report.Healthy() || !strings.Contains(report.TopoError, "topo error") {
+		t.Errorf("want a healthy report with a topology error, got %+v", report)
+	}
+	if code, page := serve(); code != http.StatusOK || !strings.Contains(page, "topology server not reachable: topo error") {
+		t.Errorf("unexpected page %v:\n%v", code, page)
+	}
+
+	// without cache, nothing can be served
+	ht.setFail(false)
+	ht.mu.Lock()
+	ht.keyspaces["no_master"] = &topo.SrvKeyspace{}
+	ht.mu.Unlock()
+	hc = newHealthChecker("", ht, "cell", []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA}, 2)
+	report = hc.check()
+	wantProblems = []string{
+		"no master shards in keyspace no_master",
+		"no replica shards in keyspace no_master",
+		"shard served_from/0 has 0 replica end points, want at least 2",
+		"shard sharded/-80 has 1 master end points, want at least 2",
+		"shard sharded/80- has 1 master end points, want at least 2",
+	}
+	if !reflect.DeepEqual(report.Problems, wantProblems) {
+		t.Errorf("want problems %v, got %v", wantProblems, report.Problems)
+	}
+	ht.setFail(true)
+	if report = hc.check(); report.Healthy() || report.TopoError != "topo error" {
+		t.Errorf("want an unhealthy report with a topology error, got %+v", report)
+	}
+}
+
+func TestParseHealthTabletTypes(t *testing.T) {
+	tabletTypes, err := parseHealthTabletTypes(" master, replica,")
+	if want := []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA}; err != nil || !reflect.DeepEqual(tabletTypes, want) {
+		t.Errorf("want %v, got %v, %v", want, tabletTypes, err)
+	}
+	if tabletTypes, err := parseHealthTabletTypes(""); err != nil || tabletTypes != nil {
+		t.Errorf("want no tablet types, got %v, %v", tabletTypes, err)
+	}
+	if _, err := parseHealthTabletTypes("master,scrap"); err == nil {
+		t.Errorf("want an error for scrap")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// vtgate answers a few SHOW statements about its serving graph
+// itself, from its topology cache, instead of sending them to a
+// tablet:
+//
+//	show vitess_keyspaces
+//	show vitess_shards from <keyspace>
+//	show vitess_endpoints from <keyspace>/<shard> for <tablet type>
+//
+// The keywords are case insensitive. The columns of their results
+// are stable, tools can rely on them. The other SHOW statements are
+// sent to the tablets.
+
+var (
+	keyspacesFields = []mproto.Field{
+		{Name: "Keyspace", Type: mproto.VT_VAR_STRING},
+	}
+	shardsFields = []mproto.Field{
+		{Name: "Shard", Type: mproto.VT_VAR_STRING},
+		{Name: "KeyRangeStart", Type: mproto.VT_VAR_STRING},
+		{Name: "KeyRangeEnd", Type: mproto.VT_VAR_STRING},
+		{Name: "ServedTypes", Type: mproto.VT_VAR_STRING},
+	}
+	endPointsFields = []mproto.Field{
+		{Name: "Uid", Type: mproto.VT_LONGLONG, Flags: mproto.VT_UNSIGNED_FLAG},
+		{Name: "Host", Type: mproto.VT_VAR_STRING},
+		{Name: "Ports", Type: mproto.VT_VAR_STRING},
+	}
+)
+
+// introspect returns the result of sql if it is one of the SHOW
+// statements vtgate answers, and false otherwise. They are answered
+// like the queries of tabletType: the caller needs to be allowed to
+// query the keyspace of the statement, see accessControl. The tablet
+// type of show vitess_endpoints is the one of the statement, and show
+// vitess_keyspaces has the keyspace of the request.
+func (vtg *VTGate) introspect(context interface{}, sql, keyspace string, tabletType topo.TabletType) (qr *mproto.QueryResult, ok bool, err error) {
+	words := strings.Fields(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if len(words) < 2 || strings.ToLower(words[0]) != "show" {
+		return nil, false, nil
+	}
+	serv, cell := vtg.scatterConn.toposerv, vtg.scatterConn.cell
+	var show func() (*mproto.QueryResult, error)
+	switch strings.ToLower(words[1]) {
+	case "vitess_keyspaces":
+		if len(words) != 2 {
+			return nil, true, fmt.Errorf("vtgate: usage: show vitess_keyspaces")
+		}
+		show = func() (*mproto.QueryResult, error) { return showKeyspaces(serv, cell) }
+	case "vitess_shards":
+		if len(words) != 4 || strings.ToLower(words[2]) != "from" {
+			return nil, true, fmt.Errorf("vtgate: usage: show vitess_shards from <keyspace>")
+		}
+		keyspace = words[3]
+		show = func() (*mproto.QueryResult, error) { return showShards(serv, cell, keyspace) }
+	case "vitess_endpoints":
+		usage := fmt.Errorf("vtgate: usage: show vitess_endpoints from <keyspace>/<shard> for <tablet type>")
+		if len(words) != 6 || strings.ToLower(words[2]) != "from" || strings.ToLower(words[4]) != "for" {
+			return nil, true, usage
+		}
+		parts := strings.Split(words[3], "/")
+		if len(parts) != 2 {
+			return nil, true, usage
+		}
+		keyspace, tabletType = parts[0], topo.TabletType(strings.ToLower(words[5]))
+		shard := topo.CanonicalShardName(parts[1])
+		show = func() (*mproto.QueryResult, error) { return showEndPoints(serv, cell, keyspace, shard, tabletType) }
+	default:
+		return nil, false, nil
+	}
+	if err := vtg.accessControl.check(context, keyspace, tabletType); err != nil {
+		return nil, true, err
+	}
+	qr, err = show()
+	return qr, true, err
+}
+
+func newIntrospectionResult(fields []mproto.Field, rows [][]sqltypes.Value) *mproto.QueryResult {
+	return &mproto.QueryResult{
+		Fields:       fields,
+		RowsAffected: uint64(len(rows)),
+		Rows:         rows,
+	}
+}
+
+func stringValue(s string) sqltypes.Value {
+	return sqltypes.MakeString([]byte(s))
+}
+
+// showKeyspaces lists the keyspaces of the cell, sorted.
+func showKeyspaces(serv SrvTopoServer, cell string) (*mproto.QueryResult, error) {
+	keyspaces, err := serv.GetSrvKeyspaceNames(cell)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keyspaces)
+	rows := make([][]sqltypes.Value, 0, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		rows = append(rows, []sqltypes.Value{stringValue(keyspace)})
+	}
+	return newIntrospectionResult(keyspacesFields, rows), nil
+}
+
+// showShards lists the shards of the serving graph of a keyspace, in
+// key range order, with the hex bounds of their key ranges and their
+// served types, comma separated.
+func showShards(serv SrvTopoServer, cell, keyspace string) (*mproto.QueryResult, error) {
+	srvKeyspace, err := serv.GetSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return nil, err
+	}
+	// a shard is in the partition of each type it serves
+	seen := make(map[string]bool)
+	var shards []topo.SrvShard
+	for _, partition := range srvKeyspace.Partitions {
+		for _, shard := range partition.Shards {
+			if !seen[shard.ShardName()] {
+				seen[shard.ShardName()] = true
+				shards = append(shards, shard)
+			}
+		}
+	}
+	topo.SrvShardArray(shards).Sort()
+	rows := make([][]sqltypes.Value, 0, len(shards))
+	for _, shard := range shards {
+		servedTypes := make([]string, len(shard.ServedTypes))
+		for i, tabletType := range shard.ServedTypes {
+			servedTypes[i] = string(tabletType)
+		}
+		rows = append(rows, []sqltypes.Value{
+			stringValue(shard.ShardName()),
+			stringValue(string(shard.KeyRange.Start.Hex())),
+			stringValue(string(shard.KeyRange.End.Hex())),
+			stringValue(strings.Join(servedTypes, ",")),
+		})
+	}
+	return newIntrospectionResult(shardsFields, rows), nil
+}
+
+// showEndPoints lists the serving endpoints of a shard for a tablet
+// type, by uid, with their ports as "name:port", comma separated and
+// sorted by name.
+func showEndPoints(serv SrvTopoServer, cell, keyspace, shard string, tabletType topo.TabletType) (*mproto.QueryResult, error) {
+	endPoints, err := serv.GetEndPoints(cell, keyspace, shard, tabletType)
+	if err != nil {
+		return nil, err
+	}
+	entries := append([]topo.EndPoint(nil), endPoints.Entries...)
+	sort.Sort(endPointsByUid(entries))
+	rows := make([][]sqltypes.Value, 0, len(entries))
+	for _, endPoint := range entries {
+		ports := make([]string, 0, len(endPoint.NamedPortMap))
+		for name, port := range endPoint.NamedPortMap {
+			ports = append(ports, fmt.Sprintf("%v:%v", name, port))
+		}
+		sort.Strings(ports)
+		rows = append(rows, []sqltypes.Value{
+			sqltypes.MakeNumeric([]byte(strconv.FormatUint(uint64(endPoint.Uid), 10))),
+			stringValue(endPoint.Host),
+			stringValue(strings.Join(ports, ",")),
+		})
+	}
+	return newIntrospectionResult(endPointsFields, rows), nil
+}
+
+type endPointsByUid []topo.EndPoint
+
+func (e endPointsByUid) Len() int           { return len(e) }
+func (e endPointsByUid) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e endPointsByUid) Less(i, j int) bool { return e[i].Uid < e[j].Uid }
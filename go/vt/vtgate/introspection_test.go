@@ -0,0 +1,207 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func executeIntrospection(t *testing.T, sql string) *proto.QueryResult {
+	q := proto.QueryShard{
+		Sql:        sql,
+		Keyspace:   TEST_SHARDED,
+		TabletType: topo.TYPE_MASTER,
+		Session:    new(proto.Session),
+	}
+	qr := new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteShard(nil, &q, qr); err != nil {
+		t.Fatalf("ExecuteShard failed: %v", err)
+	}
+	if qr.Session != q.Session {
+		t.Errorf("%v: want the session back, got %v", sql, qr.Session)
+	}
+	return qr
+}
+
+func stringRow(values ...string) []sqltypes.Value {
+	row := make([]sqltypes.Value, len(values))
+	for i, v := range values {
+		row[i] = sqltypes.MakeString([]byte(v))
+	}
+	return row
+}
+
+func TestShowKeyspaces(t *testing.T) {
+	resetSandbox()
+	qr := executeIntrospection(t, "show vitess_keyspaces")
+	want := &proto.QueryResult{
+		Fields:       []mproto.Field{{Name: "Keyspace", Type: mproto.VT_VAR_STRING}},
+		RowsAffected: 2,
+		Rows: [][]sqltypes.Value{
+			stringRow(TEST_SHARDED),
+			stringRow(TEST_UNSHARDED),
+		},
+		Session: qr.Session,
+	}
+	if !reflect.DeepEqual(qr, want) {
+		t.Errorf("want \n%#v, got \n%#v", want, qr)
+	}
+}
+
+func TestShowShards(t *testing.T) {
+	resetSandbox()
+	qr := executeIntrospection(t, "SHOW Vitess_Shards FROM TestSharded;")
+	wantFields := []mproto.Field{
+		{Name: "Shard", Type: mproto.VT_VAR_STRING},
+		{Name: "KeyRangeStart", Type: mproto.VT_VAR_STRING},
+		{Name: "KeyRangeEnd", Type: mproto.VT_VAR_STRING},
+		{Name: "ServedTypes", Type: mproto.VT_VAR_STRING},
+	}
+	if qr.Error != "" || !reflect.DeepEqual(qr.Fields, wantFields) {
+		t.Fatalf("want fields %v, got %v %v", wantFields, qr.Fields, qr.Error)
+	}
+	if qr.RowsAffected != 8 || len(qr.Rows) != 8 {
+		t.Fatalf("want 8 shards, got %v %v", qr.RowsAffected, qr.Rows)
+	}
+	for i, want := range [][]sqltypes.Value{
+		stringRow("-20", "", "20", "master,replica,rdonly"),
+		stringRow("20-40", "20", "40", "master,replica,rdonly"),
+		stringRow("E0-", "E0", "", "master,replica,rdonly"),
+	} {
+		got := qr.Rows[[]int{0, 1, 7}[i]]
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+
+	// an unsharded keyspace has one shard
+	qr = executeIntrospection(t, "show vitess_shards from TestUnshared")
+	want := [][]sqltypes.Value{stringRow("0", "", "", "master,replica,rdonly")}
+	if !reflect.DeepEqual(qr.Rows, want) {
+		t.Errorf("want %v, got %v", want, qr.Rows)
+	}
+}
+
+func TestShowEndPoints(t *testing.T) {
+	resetSandbox()
+	qr := executeIntrospection(t, "show vitess_endpoints from TestSharded/20-40 for master")
+	want := &proto.QueryResult{
+		Fields: []mproto.Field{
+			{Name: "Uid", Type: mproto.VT_LONGLONG, Flags: mproto.VT_UNSIGNED_FLAG},
+			{Name: "Host", Type: mproto.VT_VAR_STRING},
+			{Name: "Ports", Type: mproto.VT_VAR_STRING},
+		},
+		RowsAffected: 1,
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeNumeric([]byte("1")),
+			sqltypes.MakeString([]byte("20-40")),
+			sqltypes.MakeString([]byte("vt:1")),
+		}},
+		Session: qr.Session,
+	}
+	if !reflect.DeepEqual(qr, want) {
+		t.Errorf("want \n%#v, got \n%#v", want, qr)
+	}
+	if endPointCounter != 1 {
+		t.Errorf("want 1 endpoints read, got %v", endPointCounter)
+	}
+}
+
+func TestIntrospectionErrors(t *testing.T) {
+	resetSandbox()
+	testCases := []struct {
+		sql, want string
+	}{
+		{"show vitess_keyspaces like 'a'", "vtgate: usage: show vitess_keyspaces"},
+		{"show vitess_shards", "vtgate: usage: show vitess_shards from <keyspace>"},
+		{"show vitess_endpoints from TestSharded 20-40 for master", "vtgate: usage: show vitess_endpoints from <keyspace>/<shard> for <tablet type>"},
+		{"show vitess_endpoints from TestSharded/20-40", "vtgate: usage: show vitess_endpoints from <keyspace>/<shard> for <tablet type>"},
+	}
+	for _, tc := range testCases {
+		qr := executeIntrospection(t, tc.sql)
+		if qr.Error != tc.want || qr.Rows != nil {
+			t.Errorf("%v: want %v, got %+v", tc.sql, tc.want, qr)
+		}
+	}
+
+	// the other SHOW statements are sent to the tablets
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	q := proto.QueryShard{
+		Sql:        "show tables",
+		Keyspace:   "ks_introspection",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || sbc.ExecCount != 1 {
+		t.Errorf("want the query sent to the tablet, got %v %v", qr.Error, sbc.ExecCount)
+	}
+}
+
+func TestIntrospectionChecks(t *testing.T) {
+	resetSandbox()
+	dir, err := ioutil.TempDir("", "introspection")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ac, err := newAccessControl("", writeAccessRules(t, dir, `{"Keyspaces": {"TestSharded": {"replica": []}, "TestUnshared": {"master": []}}}`))
+	if err != nil {
+		t.Fatalf("newAccessControl failed: %v", err)
+	}
+	RpcVTGate.accessControl = ac
+	defer func() {
+		RpcVTGate.accessControl = nil
+	}()
+
+	// the keyspace and tablet type of the statement are checked, not
+	// only the ones of the request
+	testCases := []struct {
+		sql, want string
+	}{
+		{"show vitess_keyspaces", ""},
+		{"show vitess_shards from TestSharded", ""},
+		{"show vitess_shards from TestUnshared", "vtgate: permission denied: a request without caller can't query the master tablets of keyspace TestUnshared"},
+		{"show vitess_endpoints from TestSharded/20-40 for master", ""},
+		{"show vitess_endpoints from TestSharded/20-40 for replica", "vtgate: permission denied: a request without caller can't query the replica tablets of keyspace TestSharded"},
+	}
+	for _, tc := range testCases {
+		qr := executeIntrospection(t, tc.sql)
+		if qr.Error != tc.want {
+			t.Errorf("%v: want error %q, got %q", tc.sql, tc.want, qr.Error)
+		}
+		if tc.want != "" && (qr.ErrorCode != tabletconn.ERR_PERMISSION_DENIED || qr.Rows != nil) {
+			t.Errorf("%v: want permission denied, got %+v", tc.sql, qr)
+		}
+	}
+
+	// the SHOW statements are admitted like the other requests
+	saved := RpcVTGate.admission
+	defer func() {
+		RpcVTGate.admission = saved
+	}()
+	RpcVTGate.admission = newAdmissionController("", 1, 0)
+	if err := RpcVTGate.admission.admit(""); err != nil {
+		t.Fatalf("admit failed: %v", err)
+	}
+	qr := executeIntrospection(t, "show vitess_keyspaces")
+	if qr.Error != ErrOverloaded.Error() || qr.ErrorCode != tabletconn.ERR_OVERLOADED || qr.Rows != nil {
+		t.Errorf("want overloaded error, got %+v", qr)
+	}
+	RpcVTGate.admission.release()
+}
@@ -0,0 +1,174 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// streamRowsFiltered counts the rows of StreamExecuteKeyRange that
+// were dropped because they were outside of the requested key range,
+// by keyspace.
+var streamRowsFiltered = stats.NewCounters("VTGateStreamRowsFiltered")
+
+// keyRangeFilter drops the streamed rows whose keyspace id is outside
+// of the requested key ranges. It is used when a shard that serves a
+// StreamExecuteKeyRange covers more than the requested key ranges,
+// like the source shard of a split before the new shards serve.
+// A nil *keyRangeFilter keeps all the rows.
+type keyRangeFilter struct {
+	keyspace  string
+	shard     string
+	keyRanges []key.KeyRange
+	column    string
+	kit       key.KeyspaceIdType
+
+	// index is the position of column in the rows, -1 until the
+	// fields are received
+	index int
+}
+
+// newKeyRangeFilter returns the keyRangeFilter for streaming keyRanges
+// from the shards of a keyspace, or nil if all the rows of the shards
+// are in keyRanges. It fails if the keyspace has no sharding column to
+// filter the rows with.
+func newKeyRangeFilter(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, shards []string, keyRanges []key.KeyRange) (*keyRangeFilter, error) {
+	srvKeyspace, err := topoServer.GetSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return nil, fmt.Errorf("Error in reading the keyspace %v", err)
+	}
+	partition, ok := srvKeyspace.Partitions[tabletType]
+	if !ok {
+		return nil, fmt.Errorf("No shards available for tablet type '%v' in keyspace '%v'", tabletType, keyspace)
+	}
+	merged := mergeKeyRanges(keyRanges)
+	var overflowing []string
+	for _, shard := range shards {
+		var shardKeyRange *key.KeyRange
+		for i := range partition.Shards {
+			if partition.Shards[i].ShardName() == shard {
+				shardKeyRange = &partition.Shards[i].KeyRange
+				break
+			}
+		}
+		if shardKeyRange == nil {
+			return nil, fmt.Errorf("shard %v not found in the %v partition of keyspace %v", shard, tabletType, keyspace)
+		}
+		contained := false
+		for _, kr := range merged {
+			if keyRangeContains(kr, *shardKeyRange) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			overflowing = append(overflowing, shard)
+		}
+	}
+	if len(overflowing) == 0 {
+		return nil, nil
+	}
+
+	shard := strings.Join(overflowing, ",")
+	kit := srvKeyspace.ShardingColumnType
+	if srvKeyspace.ShardingColumnName == "" || (kit != key.KIT_UINT64 && kit != key.KIT_BYTES) {
+		return nil, fmt.Errorf("shard %v of keyspace %v serves more than key range %v, and the keyspace has no sharding column to filter its rows", shard, keyspace, keyRangesName(keyRanges))
+	}
+	return &keyRangeFilter{
+		keyspace:  keyspace,
+		shard:     shard,
+		keyRanges: merged,
+		column:    srvKeyspace.ShardingColumnName,
+		kit:       kit,
+		index:     -1,
+	}, nil
+}
+
+// keyRangeContains returns true if all of inner is in outer.
+func keyRangeContains(outer, inner key.KeyRange) bool {
+	if inner.Start < outer.Start {
+		return false
+	}
+	if outer.End == key.MaxKey {
+		return true
+	}
+	return inner.End != key.MaxKey && inner.End <= outer.End
+}
+
+// filter returns qr without the rows that are outside of the key
+// range. The first result of a stream has the fields, in which the
+// sharding column must be. qr is not modified.
+func (f *keyRangeFilter) filter(qr *mproto.QueryResult) (*mproto.QueryResult, error) {
+	if f == nil {
+		return qr, nil
+	}
+	if len(qr.Fields) != 0 {
+		f.index = -1
+		for i, field := range qr.Fields {
+			if field.Name == f.column {
+				f.index = i
+				break
+			}
+		}
+		if f.index == -1 {
+			return nil, fmt.Errorf("shard %v of keyspace %v serves more than key range %v, the query must return the sharding column %v to filter its rows", f.shard, f.keyspace, keyRangesName(f.keyRanges), f.column)
+		}
+	}
+	if len(qr.Rows) == 0 {
+		return qr, nil
+	}
+	if f.index == -1 {
+		return nil, fmt.Errorf("shard %v of keyspace %v sent rows without fields", f.shard, f.keyspace)
+	}
+
+	rows := make([][]sqltypes.Value, 0, len(qr.Rows))
+	for _, row := range qr.Rows {
+		keyspaceId, err := f.keyspaceId(row)
+		if err != nil {
+			return nil, err
+		}
+		for _, kr := range f.keyRanges {
+			if kr.Contains(keyspaceId) {
+				rows = append(rows, row)
+				break
+			}
+		}
+	}
+	if len(rows) == len(qr.Rows) {
+		return qr, nil
+	}
+	streamRowsFiltered.Add(f.keyspace, int64(len(qr.Rows)-len(rows)))
+	filtered := *qr
+	filtered.Rows = rows
+	return &filtered, nil
+}
+
+// keyspaceId returns the keyspace id of a row.
+func (f *keyRangeFilter) keyspaceId(row []sqltypes.Value) (key.KeyspaceId, error) {
+	if f.index >= len(row) {
+		return "", fmt.Errorf("shard %v of keyspace %v sent a row without sharding column %v", f.shard, f.keyspace, f.column)
+	}
+	value := row[f.index]
+	if value.IsNull() {
+		return "", fmt.Errorf("shard %v of keyspace %v sent a row with a NULL %v", f.shard, f.keyspace, f.column)
+	}
+	if f.kit == key.KIT_BYTES {
+		return key.KeyspaceId(value.Raw()), nil
+	}
+	// the rows decoded from bson only have strings
+	id, err := strconv.ParseUint(value.String(), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("shard %v of keyspace %v sent a row with a bad %v: %v", f.shard, f.keyspace, f.column, err)
+	}
+	return key.Uint64Key(id).KeyspaceId(), nil
+}
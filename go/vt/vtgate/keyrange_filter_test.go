@@ -0,0 +1,304 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+func mustParseKeyRange(t *testing.T, spec string) key.KeyRange {
+	kr, err := parseKeyRange(spec)
+	if err != nil {
+		t.Fatalf("parseKeyRange(%v) failed: %v", spec, err)
+	}
+	return kr
+}
+
+func TestKeyRangeContains(t *testing.T) {
+	testCases := []struct {
+		outer, inner string
+		contains     bool
+	}{
+		{"-", "80-c0", true},
+		{"80-", "80-c0", true},
+		{"80-", "c0-", true},
+		{"80-c0", "80-c0", true},
+		{"80-c0", "80-", false},
+		{"80-c0", "-", false},
+		{"80-c0", "70-a0", false},
+		{"80-c0", "a0-d0", false},
+	}
+	for _, tc := range testCases {
+		if got := keyRangeContains(mustParseKeyRange(t, tc.outer), mustParseKeyRange(t, tc.inner)); got != tc.contains {
+			t.Errorf("keyRangeContains(%v, %v): want %v, got %v", tc.outer, tc.inner, tc.contains, got)
+		}
+	}
+}
+
+func TestNewKeyRangeFilter(t *testing.T) {
+	ts := new(sandboxTopo)
+	// the shard is in the key range
+	filter, err := newKeyRangeFilter(ts, "aa", TEST_SHARDED, topo.TYPE_MASTER, []string{"80-A0"}, []key.KeyRange{mustParseKeyRange(t, "80-a0")})
+	if filter != nil || err != nil {
+		t.Errorf("want no filter, got %v %v", filter, err)
+	}
+	// the shard is larger
+	filter, err = newKeyRangeFilter(ts, "aa", TEST_SPLITTING, topo.TYPE_MASTER, []string{"0"}, []key.KeyRange{mustParseKeyRange(t, "80-c0")})
+	if err != nil {
+		t.Fatalf("newKeyRangeFilter failed: %v", err)
+	}
+	if filter.column != "keyspace_id" || filter.kit != key.KIT_UINT64 {
+		t.Errorf("bad filter: %+v", filter)
+	}
+	// without sharding column, the rows can't be filtered
+	_, err = newKeyRangeFilter(ts, "aa", TEST_UNSHARDED, topo.TYPE_MASTER, []string{"0"}, []key.KeyRange{mustParseKeyRange(t, "80-c0")})
+	want := "shard 0 of keyspace TestUnshared serves more than key range 80-C0, and the keyspace has no sharding column to filter its rows"
+	if err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	// the shards are in the union of the key ranges, even if they
+	// aren't in any one of them
+	krs := []key.KeyRange{mustParseKeyRange(t, "90-a0"), mustParseKeyRange(t, "70-90")}
+	filter, err = newKeyRangeFilter(ts, "aa", TEST_SHARDED, topo.TYPE_MASTER, []string{"80-A0"}, krs)
+	if filter != nil || err != nil {
+		t.Errorf("want no filter, got %v %v", filter, err)
+	}
+	// the rows of any key range are kept
+	krs = []key.KeyRange{mustParseKeyRange(t, "a0-c0"), mustParseKeyRange(t, "80-90")}
+	filter, err = newKeyRangeFilter(ts, "aa", TEST_SPLITTING, topo.TYPE_MASTER, []string{"0"}, krs)
+	if err != nil {
+		t.Fatalf("newKeyRangeFilter failed: %v", err)
+	}
+	if got, want := keyRangesName(filter.keyRanges), "80-90,A0-C0"; got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func uint64Row(id uint64) []sqltypes.Value {
+	return []sqltypes.Value{sqltypes.MakeString([]byte("row")), sqltypes.MakeString([]byte(fmt.Sprintf("%v", id)))}
+}
+
+func bytesRow(id string) []sqltypes.Value {
+	return []sqltypes.Value{sqltypes.MakeString([]byte("row")), sqltypes.MakeString([]byte(id))}
+}
+
+var keyRangeFilterFields = []mproto.Field{{Name: "value", Type: 253}, {Name: "keyspace_id", Type: 8}}
+
+func TestKeyRangeFilterUint64(t *testing.T) {
+	filter := &keyRangeFilter{
+		keyspace:  "ks_filter_uint64",
+		shard:     "0",
+		keyRanges: []key.KeyRange{mustParseKeyRange(t, "80-c0")},
+		column:    "keyspace_id",
+		kit:       key.KIT_UINT64,
+		index:     -1,
+	}
+	// the fields come first in a stream
+	fields := &mproto.QueryResult{Fields: keyRangeFilterFields}
+	if got, err := filter.filter(fields); err != nil || got != fields {
+		t.Errorf("want the fields, got %v %v", got, err)
+	}
+	qr := &mproto.QueryResult{Rows: [][]sqltypes.Value{
+		uint64Row(0x7fffffffffffffff),
+		uint64Row(0x8000000000000000), // start
+		uint64Row(0xa000000000000000),
+		uint64Row(0xbfffffffffffffff),
+		uint64Row(0xc000000000000000), // end
+		uint64Row(0xffffffffffffffff),
+	}}
+	got, err := filter.filter(qr)
+	if err != nil {
+		t.Fatalf("filter failed: %v", err)
+	}
+	want := [][]sqltypes.Value{
+		uint64Row(0x8000000000000000),
+		uint64Row(0xa000000000000000),
+		uint64Row(0xbfffffffffffffff),
+	}
+	if !reflect.DeepEqual(got.Rows, want) {
+		t.Errorf("want %v, got %v", want, got.Rows)
+	}
+	if len(qr.Rows) != 6 {
+		t.Errorf("the result was modified: %v", qr.Rows)
+	}
+	if got := streamRowsFiltered.Counts()["ks_filter_uint64"]; got != 3 {
+		t.Errorf("want 3 filtered rows, got %v", got)
+	}
+
+	// up to the end of the keyspace
+	filter.keyRanges = []key.KeyRange{mustParseKeyRange(t, "c0-")}
+	got, err = filter.filter(qr)
+	if err != nil {
+		t.Fatalf("filter failed: %v", err)
+	}
+	want = [][]sqltypes.Value{
+		uint64Row(0xc000000000000000),
+		uint64Row(0xffffffffffffffff),
+	}
+	if !reflect.DeepEqual(got.Rows, want) {
+		t.Errorf("want %v, got %v", want, got.Rows)
+	}
+}
+
+func TestKeyRangeFilterBytes(t *testing.T) {
+	filter := &keyRangeFilter{
+		keyspace:  "ks_filter_bytes",
+		shard:     "0",
+		keyRanges: []key.KeyRange{mustParseKeyRange(t, "80-c0")},
+		column:    "keyspace_id",
+		kit:       key.KIT_BYTES,
+		index:     -1,
+	}
+	qr := &mproto.QueryResult{
+		Fields: keyRangeFilterFields,
+		Rows: [][]sqltypes.Value{
+			bytesRow("\x7f\xff"),
+			bytesRow("\x80"), // start
+			bytesRow("\xbf\xff\xff"),
+			bytesRow("\xc0"), // end
+			bytesRow("\xc0\x00"),
+		},
+	}
+	got, err := filter.filter(qr)
+	if err != nil {
+		t.Fatalf("filter failed: %v", err)
+	}
+	want := [][]sqltypes.Value{
+		bytesRow("\x80"),
+		bytesRow("\xbf\xff\xff"),
+	}
+	if !reflect.DeepEqual(got.Rows, want) {
+		t.Errorf("want %v, got %v", want, got.Rows)
+	}
+}
+
+func TestKeyRangeFilterErrors(t *testing.T) {
+	newFilter := func() *keyRangeFilter {
+		return &keyRangeFilter{
+			keyspace:  "ks_filter_errors",
+			shard:     "0",
+			keyRanges: []key.KeyRange{mustParseKeyRange(t, "80-c0")},
+			column:    "keyspace_id",
+			kit:       key.KIT_UINT64,
+			index:     -1,
+		}
+	}
+	testCases := []struct {
+		qr   *mproto.QueryResult
+		want string
+	}{
+		{
+			&mproto.QueryResult{Fields: []mproto.Field{{Name: "value", Type: 253}}},
+			"shard 0 of keyspace ks_filter_errors serves more than key range 80-C0, the query must return the sharding column keyspace_id to filter its rows",
+		},
+		{
+			&mproto.QueryResult{Rows: [][]sqltypes.Value{uint64Row(1)}},
+			"shard 0 of keyspace ks_filter_errors sent rows without fields",
+		},
+		{
+			&mproto.QueryResult{Fields: keyRangeFilterFields, Rows: [][]sqltypes.Value{{sqltypes.MakeString([]byte("row")), sqltypes.NULL}}},
+			"shard 0 of keyspace ks_filter_errors sent a row with a NULL keyspace_id",
+		},
+		{
+			&mproto.QueryResult{Fields: keyRangeFilterFields, Rows: [][]sqltypes.Value{bytesRow("abc")}},
+			"shard 0 of keyspace ks_filter_errors sent a row with a bad keyspace_id: strconv.ParseUint: parsing \"abc\": invalid syntax",
+		},
+	}
+	for _, tc := range testCases {
+		_, err := newFilter().filter(tc.qr)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("want %v, got %v", tc.want, err)
+		}
+	}
+
+	// a nil filter keeps everything
+	var filter *keyRangeFilter
+	qr := &mproto.QueryResult{Rows: [][]sqltypes.Value{uint64Row(1)}}
+	if got, err := filter.filter(qr); err != nil || got != qr {
+		t.Errorf("want the same result, got %v %v", got, err)
+	}
+}
+
+// streamRowsConn is a sandboxConn that streams results.
+type streamRowsConn struct {
+	sandboxConn
+	results []*mproto.QueryResult
+}
+
+func (sbc *streamRowsConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	sbc.ExecCount.Add(1)
+	ch := make(chan *mproto.QueryResult, len(sbc.results))
+	for _, qr := range sbc.results {
+		ch <- qr
+	}
+	close(ch)
+	return ch, func() error { return nil }
+}
+
+func TestVTGateStreamExecuteKeyRangeFilter(t *testing.T) {
+	resetSandbox()
+	sbc := &streamRowsConn{results: []*mproto.QueryResult{
+		{Fields: keyRangeFilterFields},
+		{Rows: [][]sqltypes.Value{
+			uint64Row(0x7fffffffffffffff),
+			uint64Row(0x8000000000000000),
+		}},
+		{Rows: [][]sqltypes.Value{
+			uint64Row(0xc000000000000000),
+		}},
+		{Rows: [][]sqltypes.Value{
+			uint64Row(0xbfffffffffffffff),
+		}},
+	}}
+	testConns[0] = sbc
+	sq := proto.StreamQueryKeyRange{
+		Sql:        "query",
+		Keyspace:   TEST_SPLITTING,
+		KeyRange:   "80-c0",
+		TabletType: topo.TYPE_MASTER,
+	}
+	var fields []mproto.Field
+	var rows [][]sqltypes.Value
+	err := RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
+		fields = append(fields, r.Fields...)
+		rows = append(rows, r.Rows...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamExecuteKeyRange failed: %v", err)
+	}
+	if !reflect.DeepEqual(fields, keyRangeFilterFields) {
+		t.Errorf("want %v, got %v", keyRangeFilterFields, fields)
+	}
+	want := [][]sqltypes.Value{
+		uint64Row(0x8000000000000000),
+		uint64Row(0xbfffffffffffffff),
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v, got %v", want, rows)
+	}
+
+	// the rows can't be filtered without the sharding column
+	sbc.results = []*mproto.QueryResult{singleRowResult}
+	err = RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
+		t.Errorf("StreamExecuteKeyRange sent a result: %v", r)
+		return nil
+	})
+	wantErr := "shard 0 of keyspace TestSplitting serves more than key range 80-C0, the query must return the sharding column keyspace_id to filter its rows"
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("want %v, got %v", wantErr, err)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+var (
+	maxResultRows = flag.Uint64("max_result_rows", 0, "maximum number of rows of the result of a non-streaming query, 0 for no limit. vtgate fails the queries that return more instead of merging them. Requests can only lower it.")
+
+	// tooManyRows counts the queries that failed because their
+	// shards returned more rows than their limit, by keyspace.
+	tooManyRows = stats.NewCounters("VTGateTooManyRows")
+)
+
+// TooManyRowsError is returned for the queries whose shards returned
+// more rows than their limit, see resultMaxRows. Rows is the number
+// of rows vtgate had received when it gave up.
+type TooManyRowsError struct {
+	Rows, MaxRows uint64
+}
+
+func (e *TooManyRowsError) Error() string {
+	return fmt.Sprintf("vtgate: too many rows: %v rows received, the limit is %v rows", e.Rows, e.MaxRows)
+}
+
+// resultMaxRows returns the maximum number of rows of the result of
+// a non-streaming request, 0 for no limit. The request can only
+// lower -max_result_rows.
+func resultMaxRows(requestMax uint64) uint64 {
+	switch {
+	case requestMax == 0:
+		return *maxResultRows
+	case *maxResultRows == 0 || requestMax < *maxResultRows:
+		return requestMax
+	}
+	return *maxResultRows
+}
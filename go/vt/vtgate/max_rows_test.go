@@ -0,0 +1,36 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"testing"
+)
+
+func setMaxResultRows(max uint64) func() {
+	saved := *maxResultRows
+	*maxResultRows = max
+	return func() {
+		*maxResultRows = saved
+	}
+}
+
+func TestResultMaxRows(t *testing.T) {
+	for _, tc := range []struct {
+		flag, request, want uint64
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{500, 0, 500},
+		{500, 100, 100},
+		// requests can't raise the limit
+		{500, 1000, 500},
+	} {
+		restore := setMaxResultRows(tc.flag)
+		if got := resultMaxRows(tc.request); got != tc.want {
+			t.Errorf("resultMaxRows(%v) with -max_result_rows=%v: %v, want %v", tc.request, tc.flag, got, tc.want)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,668 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+// The compatibility tests pin the wire format of the vtgate requests
+// and replies, so that old clients keep talking to new servers and
+// the other way around:
+// - the golden bson of each type, marshalled at the current version,
+// must still unmarshal to the same value.
+// - the current bson of each type must still be the golden one, field
+// by field.
+// - the current bson must still decode with a decoder that only knows
+// the keys of the first version of the type, which skips the others.
+// When a field is added to one of these types, its golden bson is
+// regenerated with the new field set, and the legacy types are left
+// alone.
+
+// bsonMessage is the hand-written bson of the vtgate types.
+type bsonMessage interface {
+	MarshalBson(buf *bytes2.ChunkedWriter, key string)
+	UnmarshalBson(buf *bytes.Buffer, kind byte)
+}
+
+var compatSession = &Session{
+	InTransaction: true,
+	ShardSessions: []*ShardSession{{
+		Keyspace:      "ks",
+		Shard:         "-80",
+		TabletType:    "master",
+		TransactionId: 1,
+	}},
+	SessionId:            2,
+	TransactionStartTime: 3,
+	MustRollback:         true,
+	TabletAffinity:       true,
+	TabletPins: []*TabletPin{{
+		Keyspace:   "ks",
+		Shard:      "80-",
+		TabletType: "replica",
+		Uid:        4,
+	}},
+}
+
+var compatCallerID = &CallerID{
+	Principal:    "principal",
+	Component:    "component",
+	Subcomponent: "subcomponent",
+}
+
+var compatFields = []mproto.Field{{Name: "id", Type: 8, Flags: 1}}
+
+var compatRows = [][]sqltypes.Value{{sqltypes.MakeString([]byte("1"))}}
+
+// compatCases are the values of the types at the current version,
+// with all their fields set, and their golden bson in hex.
+var compatCases = []struct {
+	value  bsonMessage
+	golden string
+	// legacy is the value as decoded by a decoder that only knows
+	// the keys of the first version of the type.
+	legacy interface{}
+}{{
+	value: compatSession,
+	golden: "2e01000008496e5472616e73616374696f6e000104536861726453657373696f" +
+		"6e73005b00000003300053000000054b657973706163650002000000006b7305" +
+		"53686172640003000000002d3830055461626c6574547970650006000000006d" +
+		"6173746572125472616e73616374696f6e496400010000000000000000001253" +
+		"657373696f6e4964000200000000000000125472616e73616374696f6e537461" +
+		"727454696d65000300000000000000084d757374526f6c6c6261636b00010854" +
+		"61626c6574416666696e6974790001045461626c657450696e73005200000003" +
+		"30004a000000054b657973706163650002000000006b73055368617264000300" +
+		"00000038302d055461626c6574547970650007000000007265706c6963613f55" +
+		"6964000400000000000000000000",
+	legacy: &legacySession{
+		InTransaction: true,
+		ShardSessions: []*legacyShardSession{{
+			Keyspace:      "ks",
+			Shard:         "-80",
+			TabletType:    "master",
+			TransactionId: 1,
+		}},
+	},
+}, {
+	value: compatSession.ShardSessions[0],
+	golden: "53000000054b657973706163650002000000006b730553686172640003000000" +
+		"002d3830055461626c6574547970650006000000006d6173746572125472616e" +
+		"73616374696f6e496400010000000000000000",
+	legacy: &legacyShardSession{
+		Keyspace:      "ks",
+		Shard:         "-80",
+		TabletType:    "master",
+		TransactionId: 1,
+	},
+}, {
+	value: &QueryShard{
+		Sql:                 "select id from t",
+		BindVariables:       map[string]interface{}{"id": int64(1)},
+		Keyspace:            "ks",
+		Shards:              []string{"-80", "80-"},
+		TabletType:          "master",
+		Session:             compatSession,
+		IncludeLag:          true,
+		PackedRows:          true,
+		MaxShardSessions:    4,
+		Workload:            "batch",
+		NotInTransaction:    true,
+		CallerID:            compatCallerID,
+		DeadlineMs:          5,
+		MaxRows:             6,
+		Compression:         "snappy",
+		AllowPartialResults: true,
+	},
+	golden: "cf0200000553716c00100000000073656c6563742069642066726f6d20740342" +
+		"696e645661726961626c6573001100000012696400010000000000000000054b" +
+		"657973706163650002000000006b7304536861726473001b0000000530000300" +
+		"0000002d3830053100030000000038302d00055461626c657454797065000600" +
+		"0000006d61737465720353657373696f6e002e01000008496e5472616e736163" +
+		"74696f6e000104536861726453657373696f6e73005b00000003300053000000" +
+		"054b657973706163650002000000006b730553686172640003000000002d3830" +
+		"055461626c6574547970650006000000006d6173746572125472616e73616374" +
+		"696f6e496400010000000000000000001253657373696f6e4964000200000000" +
+		"000000125472616e73616374696f6e537461727454696d650003000000000000" +
+		"00084d757374526f6c6c6261636b0001085461626c6574416666696e69747900" +
+		"01045461626c657450696e7300520000000330004a000000054b657973706163" +
+		"650002000000006b7305536861726400030000000038302d055461626c657454" +
+		"7970650007000000007265706c6963613f556964000400000000000000000000" +
+		"08496e636c7564654c61670001085061636b6564526f77730001124d61785368" +
+		"61726453657373696f6e7300040000000000000005576f726b6c6f6164000500" +
+		"0000006261746368084e6f74496e5472616e73616374696f6e00010343616c6c" +
+		"657249440056000000055072696e636970616c0009000000007072696e636970" +
+		"616c05436f6d706f6e656e74000900000000636f6d706f6e656e740553756263" +
+		"6f6d706f6e656e74000c00000000737562636f6d706f6e656e74001244656164" +
+		"6c696e654d730005000000000000003f4d6178526f7773000600000000000000" +
+		"05436f6d7072657373696f6e000600000000736e6170707908416c6c6f775061" +
+		"727469616c526573756c7473000100",
+	legacy: &legacyQueryShard{
+		Sql:           "select id from t",
+		BindVariables: map[string]interface{}{"id": int64(1)},
+		Keyspace:      "ks",
+		Shards:        []string{"-80", "80-"},
+		TabletType:    "master",
+		Session:       compatLegacySession,
+	},
+}, {
+	value: &BatchQueryShard{
+		Queries: []tproto.BoundQuery{{
+			Sql:           "select id from t",
+			BindVariables: map[string]interface{}{"id": int64(1)},
+		}},
+		Keyspace:         "ks",
+		Shards:           []string{"-80", "80-"},
+		TabletType:       "master",
+		Session:          compatSession,
+		MaxShardSessions: 4,
+		Workload:         "batch",
+		CallerID:         compatCallerID,
+		DeadlineMs:       5,
+	},
+	golden: "79020000045175657269657300470000000330003f0000000553716c00100000" +
+		"000073656c6563742069642066726f6d20740342696e645661726961626c6573" +
+		"0011000000126964000100000000000000000000054b65797370616365000200" +
+		"0000006b7304536861726473001b00000005300003000000002d383005310003" +
+		"0000000038302d00055461626c6574547970650006000000006d617374657203" +
+		"53657373696f6e002e01000008496e5472616e73616374696f6e000104536861" +
+		"726453657373696f6e73005b00000003300053000000054b6579737061636500" +
+		"02000000006b730553686172640003000000002d3830055461626c6574547970" +
+		"650006000000006d6173746572125472616e73616374696f6e49640001000000" +
+		"0000000000001253657373696f6e4964000200000000000000125472616e7361" +
+		"6374696f6e537461727454696d65000300000000000000084d757374526f6c6c" +
+		"6261636b0001085461626c6574416666696e6974790001045461626c65745069" +
+		"6e7300520000000330004a000000054b657973706163650002000000006b7305" +
+		"536861726400030000000038302d055461626c65745479706500070000000072" +
+		"65706c6963613f556964000400000000000000000000124d6178536861726453" +
+		"657373696f6e7300040000000000000005576f726b6c6f616400050000000062" +
+		"617463680343616c6c657249440056000000055072696e636970616c00090000" +
+		"00007072696e636970616c05436f6d706f6e656e74000900000000636f6d706f" +
+		"6e656e7405537562636f6d706f6e656e74000c00000000737562636f6d706f6e" +
+		"656e740012446561646c696e654d7300050000000000000000",
+	legacy: &legacyBatchQueryShard{
+		Queries: []legacyBoundQuery{{
+			Sql:           "select id from t",
+			BindVariables: map[string]interface{}{"id": int64(1)},
+		}},
+		Keyspace:   "ks",
+		Shards:     []string{"-80", "80-"},
+		TabletType: "master",
+		Session:    compatLegacySession,
+	},
+}, {
+	value: &QueryResult{
+		Fields:       compatFields,
+		RowsAffected: 1,
+		InsertId:     2,
+		Rows:         compatRows,
+		Session:      compatSession,
+		Error:        "error",
+		ErrorCode:    3,
+		Err:          &RpcError{Code: 3, Message: "error"},
+		ShardLag:     map[string]int64{"-80": 4},
+		Partial:      true,
+	},
+	golden: "34020000044669656c647300370000000330002f000000054e616d6500020000" +
+		"00006964125479706500080000000000000012466c6167730001000000000000" +
+		"0000003f526f777341666665637465640001000000000000003f496e73657274" +
+		"496400020000000000000004526f777300160000000430000e00000005300001" +
+		"000000003100000353657373696f6e002e01000008496e5472616e7361637469" +
+		"6f6e000104536861726453657373696f6e73005b00000003300053000000054b" +
+		"657973706163650002000000006b730553686172640003000000002d38300554" +
+		"61626c6574547970650006000000006d6173746572125472616e73616374696f" +
+		"6e496400010000000000000000001253657373696f6e49640002000000000000" +
+		"00125472616e73616374696f6e537461727454696d6500030000000000000008" +
+		"4d757374526f6c6c6261636b0001085461626c6574416666696e697479000104" +
+		"5461626c657450696e7300520000000330004a000000054b6579737061636500" +
+		"02000000006b7305536861726400030000000038302d055461626c6574547970" +
+		"650007000000007265706c6963613f5569640004000000000000000000000545" +
+		"72726f720005000000006572726f72124572726f72436f646500030000000000" +
+		"000003457272002600000012436f6465000300000000000000054d6573736167" +
+		"650005000000006572726f72000353686172644c61670012000000122d383000" +
+		"040000000000000000085061727469616c000100",
+	legacy: &legacyQueryResult{
+		Fields:       []legacyField{{Name: "id", Type: 8}},
+		RowsAffected: 1,
+		InsertId:     2,
+		Rows:         [][][]byte{{[]byte("1")}},
+		Session:      compatLegacySession,
+		Error:        "error",
+	},
+}, {
+	value: &QueryResultList{
+		List: []mproto.QueryResult{{
+			Fields:       compatFields,
+			RowsAffected: 1,
+			InsertId:     2,
+			Rows:         compatRows,
+		}},
+		Session:   compatSession,
+		Error:     "error",
+		ErrorCode: 3,
+		Err:       &RpcError{Code: 3, Message: "error"},
+		ShardErrors: []ShardError{{
+			Keyspace: "ks",
+			Shard:    "-80",
+			Error:    "error",
+		}},
+	},
+	golden: "6c020000044c697374009000000003300088000000044669656c647300370000" +
+		"000330002f000000054e616d6500020000000069641254797065000800000000" +
+		"00000012466c61677300010000000000000000003f526f777341666665637465" +
+		"640001000000000000003f496e73657274496400020000000000000004526f77" +
+		"7300160000000430000e00000005300001000000003100000000035365737369" +
+		"6f6e002e01000008496e5472616e73616374696f6e0001045368617264536573" +
+		"73696f6e73005b00000003300053000000054b65797370616365000200000000" +
+		"6b730553686172640003000000002d3830055461626c65745479706500060000" +
+		"00006d6173746572125472616e73616374696f6e496400010000000000000000" +
+		"001253657373696f6e4964000200000000000000125472616e73616374696f6e" +
+		"537461727454696d65000300000000000000084d757374526f6c6c6261636b00" +
+		"01085461626c6574416666696e6974790001045461626c657450696e73005200" +
+		"00000330004a000000054b657973706163650002000000006b73055368617264" +
+		"00030000000038302d055461626c6574547970650007000000007265706c6963" +
+		"613f556964000400000000000000000000054572726f72000500000000657272" +
+		"6f72124572726f72436f64650003000000000000000345727200260000001243" +
+		"6f6465000300000000000000054d6573736167650005000000006572726f7200" +
+		"0453686172644572726f7273003e00000003300036000000054b657973706163" +
+		"650002000000006b730553686172640003000000002d3830054572726f720005" +
+		"000000006572726f72000000",
+	legacy: &legacyQueryResultList{
+		List: []legacyMysqlResult{{
+			Fields:       []legacyField{{Name: "id", Type: 8}},
+			RowsAffected: 1,
+			InsertId:     2,
+			Rows:         [][][]byte{{[]byte("1")}},
+		}},
+		Session: compatLegacySession,
+		Error:   "error",
+	},
+}, {
+	value: &StreamQueryKeyRange{
+		Sql:              "select id from t",
+		BindVariables:    map[string]interface{}{"id": int64(1)},
+		Keyspace:         "ks",
+		KeyRange:         "-80",
+		KeyRanges:        []string{"-40", "40-80"},
+		TabletType:       "master",
+		Session:          compatSession,
+		IncludeLag:       true,
+		PackedRows:       true,
+		Workload:         "batch",
+		MaxRowsPerSecond: 4,
+		CallerID:         compatCallerID,
+		DeadlineMs:       5,
+		Compression:      "snappy",
+	},
+	golden: "ac0200000553716c00100000000073656c6563742069642066726f6d20740342" +
+		"696e645661726961626c6573001100000012696400010000000000000000054b" +
+		"657973706163650002000000006b73054b657952616e67650003000000002d38" +
+		"30055461626c6574547970650006000000006d6173746572044b657952616e67" +
+		"6573001d00000005300003000000002d3430053100050000000034302d383000" +
+		"0353657373696f6e002e01000008496e5472616e73616374696f6e0001045368" +
+		"61726453657373696f6e73005b00000003300053000000054b65797370616365" +
+		"0002000000006b730553686172640003000000002d3830055461626c65745479" +
+		"70650006000000006d6173746572125472616e73616374696f6e496400010000" +
+		"000000000000001253657373696f6e4964000200000000000000125472616e73" +
+		"616374696f6e537461727454696d65000300000000000000084d757374526f6c" +
+		"6c6261636b0001085461626c6574416666696e6974790001045461626c657450" +
+		"696e7300520000000330004a000000054b657973706163650002000000006b73" +
+		"05536861726400030000000038302d055461626c657454797065000700000000" +
+		"7265706c6963613f55696400040000000000000000000008496e636c7564654c" +
+		"61670001085061636b6564526f7773000105576f726b6c6f6164000500000000" +
+		"6261746368124d6178526f77735065725365636f6e6400040000000000000003" +
+		"43616c6c657249440056000000055072696e636970616c000900000000707269" +
+		"6e636970616c05436f6d706f6e656e74000900000000636f6d706f6e656e7405" +
+		"537562636f6d706f6e656e74000c00000000737562636f6d706f6e656e740012" +
+		"446561646c696e654d7300050000000000000005436f6d7072657373696f6e00" +
+		"0600000000736e6170707900",
+	legacy: &legacyStreamQueryKeyRange{
+		Sql:           "select id from t",
+		BindVariables: map[string]interface{}{"id": int64(1)},
+		Keyspace:      "ks",
+		KeyRange:      "-80",
+		TabletType:    "master",
+		Session:       compatLegacySession,
+	},
+}}
+
+// The legacy types have the keys of the first version of each type,
+// and are decoded by reflection, which skips the unknown keys like the
+// hand-written decoders of the old clients and servers do.
+
+type legacySession struct {
+	InTransaction bool
+	ShardSessions []*legacyShardSession
+}
+
+var compatLegacySession = &legacySession{
+	InTransaction: true,
+	ShardSessions: []*legacyShardSession{{
+		Keyspace:      "ks",
+		Shard:         "-80",
+		TabletType:    "master",
+		TransactionId: 1,
+	}},
+}
+
+type legacyShardSession struct {
+	Keyspace      string
+	Shard         string
+	TabletType    string
+	TransactionId int64
+}
+
+type legacyQueryShard struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	Shards        []string
+	TabletType    string
+	Session       *legacySession
+}
+
+type legacyBoundQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
+}
+
+type legacyBatchQueryShard struct {
+	Queries    []legacyBoundQuery
+	Keyspace   string
+	Shards     []string
+	TabletType string
+	Session    *legacySession
+}
+
+type legacyField struct {
+	Name string
+	Type int64
+}
+
+type legacyMysqlResult struct {
+	Fields       []legacyField
+	RowsAffected uint64
+	InsertId     uint64
+	Rows         [][][]byte
+}
+
+type legacyQueryResult struct {
+	Fields       []legacyField
+	RowsAffected uint64
+	InsertId     uint64
+	Rows         [][][]byte
+	Session      *legacySession
+	Error        string
+}
+
+type legacyQueryResultList struct {
+	List    []legacyMysqlResult
+	Session *legacySession
+	Error   string
+}
+
+type legacyStreamQueryKeyRange struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyRange      string
+	TabletType    string
+	Session       *legacySession
+}
+
+func TestCompatGoldenUnmarshal(t *testing.T) {
+	for _, tc := range compatCases {
+		golden, err := hex.DecodeString(tc.golden)
+		if err != nil {
+			t.Fatalf("%T: bad golden bson: %v", tc.value, err)
+		}
+		got := reflect.New(reflect.TypeOf(tc.value).Elem()).Interface()
+		if err := bson.Unmarshal(golden, got); err != nil {
+			t.Errorf("%T: unmarshal of the golden bson failed: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.value) {
+			t.Errorf("%T: the golden bson unmarshalled to \n%#v, want \n%#v", tc.value, got, tc.value)
+		}
+	}
+}
+
+func TestCompatGoldenMarshal(t *testing.T) {
+	for _, tc := range compatCases {
+		golden, err := hex.DecodeString(tc.golden)
+		if err != nil {
+			t.Fatalf("%T: bad golden bson: %v", tc.value, err)
+		}
+		encoded, err := bson.Marshal(tc.value)
+		if err != nil {
+			t.Errorf("%T: marshal failed: %v", tc.value, err)
+			continue
+		}
+		diffs, err := diffBson(golden, encoded)
+		if err != nil {
+			t.Errorf("%T: %v", tc.value, err)
+			continue
+		}
+		for _, diff := range diffs {
+			t.Errorf("%T: the bson differs from the golden one: %v", tc.value, diff)
+		}
+		if len(diffs) != 0 {
+			t.Logf("%T: the current bson is %v", tc.value, hex.EncodeToString(encoded))
+		}
+	}
+}
+
+func TestCompatLegacyDecoder(t *testing.T) {
+	for _, tc := range compatCases {
+		encoded, err := bson.Marshal(tc.value)
+		if err != nil {
+			t.Errorf("%T: marshal failed: %v", tc.value, err)
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(tc.legacy).Elem()).Interface()
+		if err := bson.Unmarshal(encoded, got); err != nil {
+			t.Errorf("%T: the legacy decoder failed: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.legacy) {
+			t.Errorf("%T: the legacy decoder got \n%#v, want \n%#v", tc.value, got, tc.legacy)
+		}
+	}
+}
+
+func TestDiffBson(t *testing.T) {
+	want, err := bson.Marshal(map[string]interface{}{
+		"Same":    "a",
+		"Changed": int64(1),
+		"Missing": true,
+		"Nested":  map[string]interface{}{"List": []interface{}{int64(1), int64(2)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bson.Marshal(map[string]interface{}{
+		"Same":    "a",
+		"Changed": int64(2),
+		"Extra":   true,
+		"Nested":  map[string]interface{}{"List": []interface{}{int64(1), int64(3), int64(4)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := diffBson(want, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiffs := []string{
+		"Changed: want 1, got 2",
+		"Extra: unexpected field, got true",
+		"Missing: missing field, want true",
+		"Nested.List: want 2 elements, got 3",
+		"Nested.List[1]: want 2, got 3",
+	}
+	if !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("want \n%v, got \n%v", strings.Join(wantDiffs, "\n"), strings.Join(diffs, "\n"))
+	}
+	if _, err := diffBson([]byte("bad"), got); err == nil {
+		t.Errorf("diffBson of bad bson worked")
+	}
+}
+
+// diffBson returns the differences between two bson documents, one
+// per field, in the order of the field names.
+func diffBson(want, got []byte) ([]string, error) {
+	var wantDoc, gotDoc map[string]interface{}
+	if err := bson.Unmarshal(want, &wantDoc); err != nil {
+		return nil, fmt.Errorf("bad bson %x: %v", want, err)
+	}
+	if err := bson.Unmarshal(got, &gotDoc); err != nil {
+		return nil, fmt.Errorf("bad bson %x: %v", got, err)
+	}
+	return diffBsonValues("", wantDoc, gotDoc), nil
+}
+
+// diffBsonValues returns the differences between two decoded bson
+// values, whose path is name.
+func diffBsonValues(name string, want, got interface{}) []string {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		got, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(want)+len(got))
+		for k := range want {
+			keys = append(keys, k)
+		}
+		for k := range got {
+			if _, ok := want[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, k := range keys {
+			field := k
+			if name != "" {
+				field = name + "." + k
+			}
+			wantValue, inWant := want[k]
+			gotValue, inGot := got[k]
+			switch {
+			case !inGot:
+				diffs = append(diffs, fmt.Sprintf("%v: missing field, want %#v", field, wantValue))
+			case !inWant:
+				diffs = append(diffs, fmt.Sprintf("%v: unexpected field, got %#v", field, gotValue))
+			default:
+				diffs = append(diffs, diffBsonValues(field, wantValue, gotValue)...)
+			}
+		}
+		return diffs
+	case []interface{}:
+		got, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		var diffs []string
+		if len(want) != len(got) {
+			diffs = append(diffs, fmt.Sprintf("%v: want %v elements, got %v", name, len(want), len(got)))
+		}
+		for i := 0; i < len(want) && i < len(got); i++ {
+			diffs = append(diffs, diffBsonValues(fmt.Sprintf("%v[%v]", name, i), want[i], got[i])...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(want, got) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%v: want %#v, got %#v", name, want, got)}
+}
+
+// bsonField is a field of a bson document.
+type bsonField struct {
+	name string
+	kind byte
+	// pos is the offset of the kind of the field, start and end the
+	// ones of its value.
+	pos, start, end int
+}
+
+// bsonFields returns the top level fields of a bson document.
+func bsonFields(doc []byte) []bsonField {
+	var fields []bsonField
+	buf := bytes.NewBuffer(doc)
+	bson.Next(buf, 4)
+	for kind := bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
+		field := bsonField{kind: kind, pos: len(doc) - buf.Len() - 1}
+		field.name = bson.ReadCString(buf)
+		field.start = len(doc) - buf.Len()
+		bson.Skip(buf, kind)
+		field.end = len(doc) - buf.Len()
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestUnmarshalBsonErrors(t *testing.T) {
+	for _, tc := range compatCases {
+		encoded, err := bson.Marshal(tc.value)
+		if err != nil {
+			t.Fatalf("%T: marshal failed: %v", tc.value, err)
+		}
+		for _, field := range bsonFields(encoded) {
+			// a document truncated in the middle of the field,
+			// with the length of what is left
+			truncated := make([]byte, field.start+(field.end-field.start)/2)
+			copy(truncated, encoded)
+			bson.Pack.PutUint32(truncated, uint32(len(truncated)))
+			val := reflect.New(reflect.TypeOf(tc.value).Elem()).Interface().(bsonMessage)
+			err := bson.UnmarshalBsonSafe(bytes.NewBuffer(truncated), val)
+			bsonErr, ok := err.(*bson.BsonError)
+			if !ok || (bsonErr.Key != field.name && !strings.HasPrefix(bsonErr.Key, field.name+".")) || !strings.Contains(err.Error(), field.name) {
+				t.Errorf("%T truncated in %v: want an error in %v, got %#v", tc.value, field.name, field.name, err)
+			}
+
+			// a field of the wrong type
+			mismatched := make([]byte, len(encoded))
+			copy(mismatched, encoded)
+			if field.kind == bson.Object || field.kind == bson.Array {
+				mismatched[field.pos] = bson.Boolean
+			} else {
+				mismatched[field.pos] = bson.Object
+			}
+			val = reflect.New(reflect.TypeOf(tc.value).Elem()).Interface().(bsonMessage)
+			err = bson.UnmarshalBsonSafe(bytes.NewBuffer(mismatched), val)
+			bsonErr, ok = err.(*bson.BsonError)
+			if !ok || bsonErr.Key != field.name || bsonErr.Offset != field.start {
+				t.Errorf("%T with a mismatched %v: want an error in %v at %v, got %#v", tc.value, field.name, field.name, field.start, err)
+			}
+		}
+	}
+
+	// the errors of the embedded documents have their whole path
+	encoded, err := bson.Marshal(compatSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := bytes.Index(encoded, []byte("TransactionId\x00"))
+	encoded[index-1] = bson.Object
+	err = bson.UnmarshalBsonSafe(bytes.NewBuffer(encoded), new(Session))
+	want := "unexpected kind 3 for int64, in field ShardSessions.0.TransactionId at offset 116"
+	if err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+// The JSON form of the requests and the results is meant for
+// debugging: it can be read, and pasted back into a test. The []byte
+// values are in base64, like encoding/json does. The rows are
+// decoded as strings, like with bson. The bind variables keep their
+// type, see jsonBindVariable.
+
+// jsonBindVariable is the JSON form of a bind variable, a nil bind
+// variable being null. Exactly one of its fields is set. The lists
+// of other types than []interface{}, []sqltypes.Value and
+// [][]sqltypes.Value become Lists, like with bson.
+type jsonBindVariable struct {
+	Int32   *int32               `json:",omitempty"`
+	Int64   *int64               `json:",omitempty"`
+	Uint64  *uint64              `json:",omitempty"`
+	Float64 *float64             `json:",omitempty"`
+	String  *string              `json:",omitempty"`
+	Bytes   *[]byte              `json:",omitempty"`
+	Bool    *bool                `json:",omitempty"`
+	Time    *time.Time           `json:",omitempty"`
+	List    *[]*jsonBindVariable `json:",omitempty"`
+	Value   *jsonValue           `json:",omitempty"`
+	Values  *[]jsonValue         `json:",omitempty"`
+	Tuples  *[][]jsonValue       `json:",omitempty"`
+}
+
+// jsonValue is the JSON form of a sqltypes.Value bind variable, with
+// its type.
+type jsonValue struct {
+	Numeric    *string `json:",omitempty"`
+	Fractional *string `json:",omitempty"`
+	String     *[]byte `json:",omitempty"`
+}
+
+func newJSONValue(v sqltypes.Value) jsonValue {
+	raw := v.Raw()
+	switch {
+	case v.IsNull():
+		return jsonValue{}
+	case v.IsNumeric():
+		s := string(raw)
+		return jsonValue{Numeric: &s}
+	case v.IsFractional():
+		s := string(raw)
+		return jsonValue{Fractional: &s}
+	}
+	return jsonValue{String: &raw}
+}
+
+func (jv jsonValue) value() sqltypes.Value {
+	switch {
+	case jv.Numeric != nil:
+		return sqltypes.MakeNumeric([]byte(*jv.Numeric))
+	case jv.Fractional != nil:
+		return sqltypes.MakeFractional([]byte(*jv.Fractional))
+	case jv.String != nil:
+		return sqltypes.MakeString(*jv.String)
+	}
+	return sqltypes.NULL
+}
+
+func newJSONValues(values []sqltypes.Value) []jsonValue {
+	jvs := make([]jsonValue, len(values))
+	for i, v := range values {
+		jvs[i] = newJSONValue(v)
+	}
+	return jvs
+}
+
+func jsonValuesToValues(jvs []jsonValue) []sqltypes.Value {
+	values := make([]sqltypes.Value, len(jvs))
+	for i, jv := range jvs {
+		values[i] = jv.value()
+	}
+	return values
+}
+
+// newJSONBindVariable returns the JSON form of v, nil for nil.
+func newJSONBindVariable(v interface{}) (*jsonBindVariable, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case int:
+		i := int64(v)
+		return &jsonBindVariable{Int64: &i}, nil
+	case int32:
+		return &jsonBindVariable{Int32: &v}, nil
+	case int64:
+		return &jsonBindVariable{Int64: &v}, nil
+	case uint:
+		u := uint64(v)
+		return &jsonBindVariable{Uint64: &u}, nil
+	case uint32:
+		u := uint64(v)
+		return &jsonBindVariable{Uint64: &u}, nil
+	case uint64:
+		return &jsonBindVariable{Uint64: &v}, nil
+	case float64:
+		return &jsonBindVariable{Float64: &v}, nil
+	case string:
+		return &jsonBindVariable{String: &v}, nil
+	case []byte:
+		return &jsonBindVariable{Bytes: &v}, nil
+	case bool:
+		return &jsonBindVariable{Bool: &v}, nil
+	case time.Time:
+		return &jsonBindVariable{Time: &v}, nil
+	case sqltypes.Value:
+		jv := newJSONValue(v)
+		return &jsonBindVariable{Value: &jv}, nil
+	case []sqltypes.Value:
+		jvs := newJSONValues(v)
+		return &jsonBindVariable{Values: &jvs}, nil
+	case [][]sqltypes.Value:
+		tuples := make([][]jsonValue, len(v))
+		for i, tuple := range v {
+			tuples[i] = newJSONValues(tuple)
+		}
+		return &jsonBindVariable{Tuples: &tuples}, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("unsupported bind variable type %T", v)
+	}
+	list := make([]*jsonBindVariable, rv.Len())
+	for i := range list {
+		elem, err := newJSONBindVariable(rv.Index(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("element %v: %v", i, err)
+		}
+		list[i] = elem
+	}
+	return &jsonBindVariable{List: &list}, nil
+}
+
+// value returns the bind variable of jbv.
+func (jbv *jsonBindVariable) value() (interface{}, error) {
+	switch {
+	case jbv == nil:
+		return nil, nil
+	case jbv.Int32 != nil:
+		return *jbv.Int32, nil
+	case jbv.Int64 != nil:
+		return *jbv.Int64, nil
+	case jbv.Uint64 != nil:
+		return *jbv.Uint64, nil
+	case jbv.Float64 != nil:
+		return *jbv.Float64, nil
+	case jbv.String != nil:
+		return *jbv.String, nil
+	case jbv.Bytes != nil:
+		return *jbv.Bytes, nil
+	case jbv.Bool != nil:
+		return *jbv.Bool, nil
+	case jbv.Time != nil:
+		return *jbv.Time, nil
+	case jbv.Value != nil:
+		return jbv.Value.value(), nil
+	case jbv.Values != nil:
+		return jsonValuesToValues(*jbv.Values), nil
+	case jbv.Tuples != nil:
+		tuples := make([][]sqltypes.Value, len(*jbv.Tuples))
+		for i, tuple := range *jbv.Tuples {
+			tuples[i] = jsonValuesToValues(tuple)
+		}
+		return tuples, nil
+	case jbv.List != nil:
+		list := make([]interface{}, len(*jbv.List))
+		for i, elem := range *jbv.List {
+			v, err := elem.value()
+			if err != nil {
+				return nil, fmt.Errorf("element %v: %v", i, err)
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("bind variable without a type")
+}
+
+func newJSONBindVariables(bindVars map[string]interface{}) (map[string]*jsonBindVariable, error) {
+	if bindVars == nil {
+		return nil, nil
+	}
+	jbvs := make(map[string]*jsonBindVariable, len(bindVars))
+	for name, v := range bindVars {
+		jbv, err := newJSONBindVariable(v)
+		if err != nil {
+			return nil, fmt.Errorf("bind variable %v: %v", name, err)
+		}
+		jbvs[name] = jbv
+	}
+	return jbvs, nil
+}
+
+func jsonToBindVariables(jbvs map[string]*jsonBindVariable) (map[string]interface{}, error) {
+	if jbvs == nil {
+		return nil, nil
+	}
+	bindVars := make(map[string]interface{}, len(jbvs))
+	for name, jbv := range jbvs {
+		v, err := jbv.value()
+		if err != nil {
+			return nil, fmt.Errorf("bind variable %v: %v", name, err)
+		}
+		bindVars[name] = v
+	}
+	return bindVars, nil
+}
+
+// jsonBoundQuery is the JSON form of a tproto.BoundQuery.
+type jsonBoundQuery struct {
+	Sql           string
+	BindVariables map[string]*jsonBindVariable
+}
+
+// jsonRowValue is the JSON form of a value of a row: its bytes, or
+// null for NULL.
+type jsonRowValue sqltypes.Value
+
+func (v jsonRowValue) MarshalJSON() ([]byte, error) {
+	if sqltypes.Value(v).IsNull() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(sqltypes.Value(v).Raw())
+}
+
+func (v *jsonRowValue) UnmarshalJSON(data []byte) error {
+	var b *[]byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	if b == nil {
+		*v = jsonRowValue(sqltypes.NULL)
+		return nil
+	}
+	*v = jsonRowValue(sqltypes.MakeString(*b))
+	return nil
+}
+
+func newJSONRows(rows [][]sqltypes.Value) [][]jsonRowValue {
+	if rows == nil {
+		return nil
+	}
+	jrows := make([][]jsonRowValue, len(rows))
+	for i, row := range rows {
+		jrows[i] = make([]jsonRowValue, len(row))
+		for j, v := range row {
+			jrows[i][j] = jsonRowValue(v)
+		}
+	}
+	return jrows
+}
+
+func jsonToRows(jrows [][]jsonRowValue) [][]sqltypes.Value {
+	if jrows == nil {
+		return nil
+	}
+	rows := make([][]sqltypes.Value, len(jrows))
+	for i, jrow := range jrows {
+		rows[i] = make([]sqltypes.Value, len(jrow))
+		for j, v := range jrow {
+			rows[i][j] = sqltypes.Value(v)
+		}
+	}
+	return rows
+}
+
+// jsonResult is the JSON form of an mproto.QueryResult.
+type jsonResult struct {
+	Fields       []mproto.Field
+	RowsAffected uint64
+	InsertId     uint64
+	Rows         [][]jsonRowValue
+}
+
+// MarshalJSON marshals QueryShard with the types of its bind
+// variables.
+func (qrs *QueryShard) MarshalJSON() ([]byte, error) {
+	type queryShard QueryShard
+	bindVars, err := newJSONBindVariables(qrs.BindVariables)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&struct {
+		*queryShard
+		BindVariables map[string]*jsonBindVariable
+	}{(*queryShard)(qrs), bindVars})
+}
+
+// UnmarshalJSON unmarshals QueryShard, see MarshalJSON.
+func (qrs *QueryShard) UnmarshalJSON(data []byte) error {
+	type queryShard QueryShard
+	jqrs := struct {
+		*queryShard
+		BindVariables map[string]*jsonBindVariable
+	}{queryShard: (*queryShard)(qrs)}
+	if err := json.Unmarshal(data, &jqrs); err != nil {
+		return err
+	}
+	bindVars, err := jsonToBindVariables(jqrs.BindVariables)
+	if err != nil {
+		return err
+	}
+	qrs.BindVariables = bindVars
+	return nil
+}
+
+// MarshalJSON marshals BatchQueryShard with the types of the bind
+// variables of its queries.
+func (bqs *BatchQueryShard) MarshalJSON() ([]byte, error) {
+	type batchQueryShard BatchQueryShard
+	var queries []jsonBoundQuery
+	if bqs.Queries != nil {
+		queries = make([]jsonBoundQuery, len(bqs.Queries))
+	}
+	for i, query := range bqs.Queries {
+		bindVars, err := newJSONBindVariables(query.BindVariables)
+		if err != nil {
+			return nil, fmt.Errorf("query %v: %v", i, err)
+		}
+		queries[i] = jsonBoundQuery{Sql: query.Sql, BindVariables: bindVars}
+	}
+	return json.Marshal(&struct {
+		*batchQueryShard
+		Queries []jsonBoundQuery
+	}{(*batchQueryShard)(bqs), queries})
+}
+
+// UnmarshalJSON unmarshals BatchQueryShard, see MarshalJSON.
+func (bqs *BatchQueryShard) UnmarshalJSON(data []byte) error {
+	type batchQueryShard BatchQueryShard
+	jbqs := struct {
+		*batchQueryShard
+		Queries []jsonBoundQuery
+	}{batchQueryShard: (*batchQueryShard)(bqs)}
+	if err := json.Unmarshal(data, &jbqs); err != nil {
+		return err
+	}
+	bqs.Queries = nil
+	if jbqs.Queries != nil {
+		bqs.Queries = make([]tproto.BoundQuery, len(jbqs.Queries))
+	}
+	for i, query := range jbqs.Queries {
+		bindVars, err := jsonToBindVariables(query.BindVariables)
+		if err != nil {
+			return fmt.Errorf("query %v: %v", i, err)
+		}
+		bqs.Queries[i] = tproto.BoundQuery{Sql: query.Sql, BindVariables: bindVars}
+	}
+	return nil
+}
+
+// MarshalJSON marshals QueryResult, with its RawRows decoded into
+// its Rows.
+func (qr *QueryResult) MarshalJSON() ([]byte, error) {
+	type queryResult QueryResult
+	rows := qr.Rows
+	if qr.RawRows != nil {
+		var err error
+		if rows, err = qr.RawRows.Decode(); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&struct {
+		*queryResult
+		Rows [][]jsonRowValue
+	}{(*queryResult)(qr), newJSONRows(rows)})
+}
+
+// UnmarshalJSON unmarshals QueryResult, see MarshalJSON.
+func (qr *QueryResult) UnmarshalJSON(data []byte) error {
+	type queryResult QueryResult
+	jqr := struct {
+		*queryResult
+		Rows [][]jsonRowValue
+	}{queryResult: (*queryResult)(qr)}
+	if err := json.Unmarshal(data, &jqr); err != nil {
+		return err
+	}
+	qr.Rows = jsonToRows(jqr.Rows)
+	return nil
+}
+
+// MarshalJSON marshals QueryResultList, see QueryResult.MarshalJSON.
+func (qrl *QueryResultList) MarshalJSON() ([]byte, error) {
+	type queryResultList QueryResultList
+	var list []jsonResult
+	if qrl.List != nil {
+		list = make([]jsonResult, len(qrl.List))
+	}
+	for i, qr := range qrl.List {
+		list[i] = jsonResult{
+			Fields:       qr.Fields,
+			RowsAffected: qr.RowsAffected,
+			InsertId:     qr.InsertId,
+			Rows:         newJSONRows(qr.Rows),
+		}
+	}
+	return json.Marshal(&struct {
+		*queryResultList
+		List []jsonResult
+	}{(*queryResultList)(qrl), list})
+}
+
+// UnmarshalJSON unmarshals QueryResultList, see MarshalJSON.
+func (qrl *QueryResultList) UnmarshalJSON(data []byte) error {
+	type queryResultList QueryResultList
+	jqrl := struct {
+		*queryResultList
+		List []jsonResult
+	}{queryResultList: (*queryResultList)(qrl)}
+	if err := json.Unmarshal(data, &jqrl); err != nil {
+		return err
+	}
+	qrl.List = nil
+	if jqrl.List != nil {
+		qrl.List = make([]mproto.QueryResult, len(jqrl.List))
+	}
+	for i, qr := range jqrl.List {
+		qrl.List[i] = mproto.QueryResult{
+			Fields:       qr.Fields,
+			RowsAffected: qr.RowsAffected,
+			InsertId:     qr.InsertId,
+			Rows:         jsonToRows(qr.Rows),
+		}
+	}
+	return nil
+}
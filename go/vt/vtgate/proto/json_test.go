@@ -0,0 +1,238 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// jsonBindVars has a bind variable of each type, with the values
+// they decode to.
+var jsonBindVars = map[string]interface{}{
+	"nil":        nil,
+	"int32":      int32(-32),
+	"int64":      int64(math.MinInt64),
+	"uint64":     uint64(math.MaxUint64),
+	"float64":    1.0,
+	"string":     "a\x00'\"",
+	"bytes":      []byte{0, 1, 255},
+	"empty":      []byte{},
+	"bool":       true,
+	"time":       time.Date(2014, 5, 6, 7, 8, 9, 123456789, time.UTC),
+	"list":       []interface{}{int64(1), "a", nil, []interface{}{}},
+	"value":      sqltypes.MakeNumeric([]byte("18446744073709551615")),
+	"null value": sqltypes.NULL,
+	"values":     []sqltypes.Value{sqltypes.MakeFractional([]byte("1.5")), sqltypes.MakeString([]byte{255}), sqltypes.NULL},
+	"tuples":     [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1"))}, {}},
+}
+
+func TestQueryShardJSON(t *testing.T) {
+	qrs := &QueryShard{
+		Sql:           "select * from a where id = :id",
+		BindVariables: jsonBindVars,
+		Keyspace:      "ks",
+		Shards:        []string{"-80", "80-"},
+		TabletType:    topo.TYPE_MASTER,
+		Session: &Session{
+			InTransaction: true,
+			ShardSessions: []*ShardSession{{Keyspace: "ks", Shard: "-80", TabletType: topo.TYPE_MASTER, TransactionId: 1}},
+			SessionId:     2,
+		},
+		CallerID:   &CallerID{Principal: "user"},
+		DeadlineMs: 3,
+		MaxRows:    4,
+	}
+	encoded, err := json.Marshal(qrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got QueryShard
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, qrs) {
+		t.Errorf("got\n%#v, want\n%#v\nfrom %s", &got, qrs, encoded)
+	}
+
+	// the other lists become []interface{}, like with bson
+	encoded, err = json.Marshal(&QueryShard{BindVariables: map[string]interface{}{"ids": []int64{1, 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(1), int64(2)}; !reflect.DeepEqual(got.BindVariables["ids"], want) {
+		t.Errorf("got %#v, want %#v", got.BindVariables["ids"], want)
+	}
+
+	_, err = json.Marshal(&QueryShard{BindVariables: map[string]interface{}{"bad": struct{}{}}})
+	if err == nil || !strings.Contains(err.Error(), "bind variable bad: unsupported bind variable type struct {}") {
+		t.Errorf("want an unsupported type error, got %v", err)
+	}
+}
+
+// TestQueryShardJSONPasted decodes a request written by hand.
+func TestQueryShardJSONPasted(t *testing.T) {
+	pasted := `{
+		"Sql": "select * from a where id in ::ids and name = :name",
+		"BindVariables": {
+			"ids": {"List": [{"Int64": 1}, {"Uint64": 18446744073709551615}]},
+			"name": {"Bytes": "bmFtZQ=="},
+			"none": null
+		},
+		"Keyspace": "ks",
+		"Shards": ["0"],
+		"TabletType": "master"
+	}`
+	var got QueryShard
+	if err := json.Unmarshal([]byte(pasted), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := QueryShard{
+		Sql: "select * from a where id in ::ids and name = :name",
+		BindVariables: map[string]interface{}{
+			"ids":  []interface{}{int64(1), uint64(math.MaxUint64)},
+			"name": []byte("name"),
+			"none": nil,
+		},
+		Keyspace:   "ks",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%#v, want\n%#v", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"BindVariables": {"bad": {}}}`), &got); err == nil || err.Error() != "bind variable bad: bind variable without a type" {
+		t.Errorf("want a missing type error, got %v", err)
+	}
+}
+
+func TestBatchQueryShardJSON(t *testing.T) {
+	bqs := &BatchQueryShard{
+		Queries: []tproto.BoundQuery{
+			{Sql: "query1", BindVariables: jsonBindVars},
+			{Sql: "query2"},
+		},
+		Keyspace:   "ks",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_REPLICA,
+		Session:    &Session{},
+		Workload:   "batch",
+	}
+	encoded, err := json.Marshal(bqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got BatchQueryShard
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, bqs) {
+		t.Errorf("got\n%#v, want\n%#v\nfrom %s", &got, bqs, encoded)
+	}
+}
+
+func TestSessionJSON(t *testing.T) {
+	session := &Session{
+		InTransaction: true,
+		ShardSessions: []*ShardSession{
+			{Keyspace: "ks", Shard: "-80", TabletType: topo.TYPE_MASTER, TransactionId: 1},
+			{Keyspace: "ks", Shard: "80-", TabletType: topo.TYPE_MASTER, TransactionId: 2},
+		},
+		SessionId:            3,
+		TransactionStartTime: 4,
+	}
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Session
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, session) {
+		t.Errorf("got\n%#v, want\n%#v", &got, session)
+	}
+}
+
+// jsonRows have a NULL, an empty string and binary data. They're
+// strings, like the rows decoded from bson.
+var jsonRows = [][]sqltypes.Value{
+	{sqltypes.MakeString([]byte("1")), sqltypes.NULL},
+	{sqltypes.MakeString([]byte{}), sqltypes.MakeString([]byte{0, 255})},
+}
+
+func TestQueryResultJSON(t *testing.T) {
+	qr := &QueryResult{
+		Fields:       []mproto.Field{{Name: "a", Type: mproto.VT_LONG}, {Name: "b", Type: mproto.VT_BLOB}},
+		RowsAffected: 2,
+		Rows:         jsonRows,
+		Session:      &Session{SessionId: 1},
+		Error:        "err",
+		Err:          &RpcError{Code: 1, Message: "err"},
+		ShardLag:     map[string]int64{"ks/0": 2},
+		Partial:      true,
+	}
+	encoded, err := json.Marshal(qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got QueryResult
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, qr) {
+		t.Errorf("got\n%#v, want\n%#v\nfrom %s", &got, qr, encoded)
+	}
+
+	// RawRows are marshaled as Rows
+	lazy := new(QueryResult)
+	PopulateLazyQueryResult(mproto.NewLazyQueryResult(&mproto.QueryResult{Rows: jsonRows}), lazy)
+	encoded, err = json.Marshal(lazy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = QueryResult{}
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Rows, jsonRows) {
+		t.Errorf("got %#v, want %#v", got.Rows, jsonRows)
+	}
+}
+
+func TestQueryResultListJSON(t *testing.T) {
+	qrl := &QueryResultList{
+		List: []mproto.QueryResult{
+			{Fields: []mproto.Field{{Name: "a", Type: mproto.VT_LONG}}, RowsAffected: 2, Rows: jsonRows},
+			{RowsAffected: 1, InsertId: 2},
+		},
+		Session:     &Session{SessionId: 1},
+		ShardErrors: []ShardError{{Keyspace: "ks", Shard: "0", Error: "err"}},
+	}
+	encoded, err := json.Marshal(qrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got QueryResultList
+	if err := json.Unmarshal(encoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, qrl) {
+		t.Errorf("got\n%#v, want\n%#v\nfrom %s", &got, qrl, encoded)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
+	"github.com/youtube/vitess/go/vt/key"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+// marshalRules are the rules of the bson of each type, see the top of
+// vtgate_proto.go.
+var marshalRules = []struct {
+	zero bsonMessage
+	// always are the fields written even when they're zero, the
+	// fields of the first version of the type.
+	always []string
+	// full has all the fields set, for the types that aren't in
+	// compatCases.
+	full bsonMessage
+}{{
+	zero:   &Session{},
+	always: []string{"InTransaction", "ShardSessions"},
+}, {
+	zero:   &ShardSession{},
+	always: []string{"Keyspace", "Shard", "TabletType", "TransactionId"},
+}, {
+	zero:   &TabletPin{},
+	always: []string{"Keyspace", "Shard", "TabletType", "Uid"},
+	full:   compatSession.TabletPins[0],
+}, {
+	zero:   &CallerID{},
+	always: []string{"Principal", "Component", "Subcomponent"},
+	full:   compatCallerID,
+}, {
+	zero:   &QueryShard{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "Shards", "TabletType"},
+}, {
+	zero:   &StreamQueryShard{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "Shards", "TabletType"},
+	full: &StreamQueryShard{
+		Sql:              "select id from t",
+		BindVariables:    map[string]interface{}{"id": int64(1)},
+		Keyspace:         "ks",
+		Shards:           []string{"-80", "80-"},
+		TabletType:       "replica",
+		Session:          compatSession,
+		IncludeLag:       true,
+		PackedRows:       true,
+		Workload:         "batch",
+		MaxRowsPerSecond: 2,
+		CallerID:         compatCallerID,
+		DeadlineMs:       3,
+		Compression:      COMPRESSION_SNAPPY,
+	},
+}, {
+	zero:   &KeyspaceIdQuery{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "KeyspaceIds", "TabletType"},
+	full: &KeyspaceIdQuery{
+		Sql:              "select id from t",
+		BindVariables:    map[string]interface{}{"id": int64(1)},
+		Keyspace:         "ks",
+		KeyspaceIds:      []key.KeyspaceId{"\x10", "\x90"},
+		TabletType:       "master",
+		Session:          compatSession,
+		NotInTransaction: true,
+		CallerID:         compatCallerID,
+	},
+}, {
+	zero:   &RpcError{},
+	always: []string{"Code", "Message"},
+	full:   &RpcError{Code: ERR_RETRY, Message: "err"},
+}, {
+	zero:   &QueryResult{},
+	always: []string{"Fields", "RowsAffected", "InsertId", "Rows"},
+}, {
+	zero:   &BatchQueryShard{},
+	always: []string{"Queries", "Keyspace", "Shards", "TabletType"},
+}, {
+	zero:   &KeyspaceIdBatchQuery{},
+	always: []string{"Queries", "Keyspace", "KeyspaceIds", "TabletType"},
+	full: &KeyspaceIdBatchQuery{
+		Queries:     []tproto.BoundQuery{{Sql: "select id from t", BindVariables: map[string]interface{}{"id": int64(1)}}},
+		Keyspace:    "ks",
+		KeyspaceIds: []key.KeyspaceId{"\x10"},
+		TabletType:  "master",
+		Session:     compatSession,
+		CallerID:    compatCallerID,
+	},
+}, {
+	zero:   &QueryResultList{},
+	always: []string{"List"},
+}, {
+	zero:   &ShardError{},
+	always: []string{"Keyspace", "Shard", "Error"},
+	full:   &ShardError{Keyspace: "ks", Shard: "0", Error: "err"},
+}, {
+	zero:   &KeyRangeQuery{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "KeyRange", "TabletType"},
+	full: &KeyRangeQuery{
+		Sql:              "select id from t",
+		BindVariables:    map[string]interface{}{"id": int64(1)},
+		Keyspace:         "ks",
+		KeyRange:         "-80",
+		TabletType:       "master",
+		Session:          compatSession,
+		NotInTransaction: true,
+		CallerID:         compatCallerID,
+	},
+}, {
+	zero:   &EntityId{},
+	always: []string{"ExternalId", "KeyspaceId"},
+	full:   &EntityId{ExternalId: int64(1), KeyspaceId: "\x10"},
+}, {
+	zero:   &EntityIdsQuery{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "EntityColumnName", "EntityKeyspaceIds", "TabletType"},
+	full: &EntityIdsQuery{
+		Sql:               "select id from t",
+		BindVariables:     map[string]interface{}{"id": int64(1)},
+		Keyspace:          "ks",
+		EntityColumnName:  "user_id",
+		EntityKeyspaceIds: []EntityId{{ExternalId: int64(1), KeyspaceId: "\x10"}, {ExternalId: "a", KeyspaceId: "\x90"}},
+		TabletType:        "master",
+		Session:           compatSession,
+		CallerID:          compatCallerID,
+	},
+}, {
+	zero:   &StreamQueryKeyRange{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "KeyRange", "TabletType"},
+}, {
+	zero:   &StreamQueryKeyspaceIds{},
+	always: []string{"Sql", "BindVariables", "Keyspace", "KeyspaceIds", "TabletType"},
+	full: &StreamQueryKeyspaceIds{
+		Sql:           "select id from t",
+		BindVariables: map[string]interface{}{"id": int64(1)},
+		Keyspace:      "ks",
+		KeyspaceIds:   []key.KeyspaceId{"\x10"},
+		TabletType:    "replica",
+		Session:       compatSession,
+		CallerID:      compatCallerID,
+		DeadlineMs:    1,
+	},
+}, {
+	zero:   &RollbackOldTransactionsRequest{},
+	always: []string{"MinAgeSeconds"},
+	full:   &RollbackOldTransactionsRequest{MinAgeSeconds: 1},
+}, {
+	zero:   &RollbackOldTransactionsReply{},
+	always: []string{"RolledBack"},
+	full:   &RollbackOldTransactionsReply{RolledBack: 1},
+}}
+
+// fullValues returns a value of each type with all its fields set.
+func fullValues(t *testing.T) []bsonMessage {
+	full := make(map[reflect.Type]bsonMessage)
+	for _, tc := range compatCases {
+		full[reflect.TypeOf(tc.value)] = tc.value
+	}
+	var values []bsonMessage
+	for _, rule := range marshalRules {
+		if rule.full != nil {
+			full[reflect.TypeOf(rule.full)] = rule.full
+		}
+		value, ok := full[reflect.TypeOf(rule.zero)]
+		if !ok {
+			t.Errorf("%T: no value with all the fields set", rule.zero)
+			continue
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// fieldNames returns the names of the top level fields of a bson
+// document, in order.
+func fieldNames(doc []byte) []string {
+	var names []string
+	for _, field := range bsonFields(doc) {
+		names = append(names, field.name)
+	}
+	return names
+}
+
+// sentFields returns the names of the fields of a struct that are
+// sent, in order.
+func sentFields(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("bson") == "-" {
+			continue
+		}
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+// withEmpty returns a copy of val with its nil slices and maps set to
+// empty ones, and its nil pointers to zero values if pointers is set.
+func withEmpty(val bsonMessage, pointers bool) bsonMessage {
+	copied := reflect.New(reflect.TypeOf(val).Elem())
+	copied.Elem().Set(reflect.ValueOf(val).Elem())
+	for i := 0; i < copied.Elem().NumField(); i++ {
+		field := copied.Elem().Field(i)
+		if !field.CanSet() || copied.Elem().Type().Field(i).Tag.Get("bson") == "-" {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Slice:
+			if field.IsNil() {
+				field.Set(reflect.MakeSlice(field.Type(), 0, 0))
+			}
+		case reflect.Map:
+			if field.IsNil() {
+				field.Set(reflect.MakeMap(field.Type()))
+			}
+		case reflect.Ptr:
+			if pointers && field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+		}
+	}
+	return copied.Interface().(bsonMessage)
+}
+
+// diffBsonBytes returns the differences between two bson documents
+// that aren't byte for byte the same: the differences of their fields,
+// see diffBson, or of the order of their fields.
+func diffBsonBytes(want, got []byte) []string {
+	if bytes.Equal(want, got) {
+		return nil
+	}
+	diffs, err := diffBson(want, got)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if len(diffs) != 0 {
+		return diffs
+	}
+	wantNames, gotNames := fieldNames(want), fieldNames(got)
+	if !reflect.DeepEqual(wantNames, gotNames) {
+		return []string{fmt.Sprintf("the fields are in another order: want %v, got %v", wantNames, gotNames)}
+	}
+	return []string{"the fields of the embedded documents are in another order"}
+}
+
+func TestDiffBsonBytes(t *testing.T) {
+	encode := func(names ...string) []byte {
+		buf := bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+		lenWriter := bson.NewLenWriter(buf)
+		for _, name := range names {
+			bson.EncodeString(buf, name, name)
+		}
+		buf.WriteByte(0)
+		lenWriter.RecordLen()
+		return buf.Bytes()
+	}
+	testcases := []struct {
+		want, got []byte
+		diffs     []string
+	}{
+		{encode("a", "b"), encode("a", "b"), nil},
+		{encode("a", "b"), encode("a"), []string{"b: missing field, want []byte{0x62}"}},
+		{encode("a", "b"), encode("b", "a"), []string{"the fields are in another order: want [a b], got [b a]"}},
+	}
+	for _, tc := range testcases {
+		if diffs := diffBsonBytes(tc.want, tc.got); !reflect.DeepEqual(diffs, tc.diffs) {
+			t.Errorf("diffBsonBytes(%v, %v): got %q, want %q", fieldNames(tc.want), fieldNames(tc.got), diffs, tc.diffs)
+		}
+	}
+}
+
+func TestMarshalAlwaysWritten(t *testing.T) {
+	for _, rule := range marshalRules {
+		for _, val := range []bsonMessage{rule.zero, withEmpty(rule.zero, false)} {
+			encoded, err := bson.Marshal(val)
+			if err != nil {
+				t.Errorf("%T: marshal failed: %v", val, err)
+				continue
+			}
+			if got := fieldNames(encoded); !reflect.DeepEqual(got, rule.always) {
+				t.Errorf("%#v: got fields %v, want %v", val, got, rule.always)
+			}
+		}
+	}
+}
+
+func TestMarshalFieldOrder(t *testing.T) {
+	for _, val := range fullValues(t) {
+		encoded, err := bson.Marshal(val)
+		if err != nil {
+			t.Errorf("%T: marshal failed: %v", val, err)
+			continue
+		}
+		want := sentFields(reflect.TypeOf(val).Elem())
+		if got := fieldNames(encoded); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T: got fields\n%v, want\n%v", val, got, want)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	var values []bsonMessage
+	for _, rule := range marshalRules {
+		values = append(values, rule.zero, withEmpty(rule.zero, false), withEmpty(rule.zero, true))
+	}
+	values = append(values, fullValues(t)...)
+	for _, val := range values {
+		encoded, err := bson.Marshal(val)
+		if err != nil {
+			t.Errorf("%#v: marshal failed: %v", val, err)
+			continue
+		}
+		decoded := reflect.New(reflect.TypeOf(val).Elem()).Interface()
+		if err := bson.Unmarshal(encoded, decoded); err != nil {
+			t.Errorf("%#v: unmarshal failed: %v", val, err)
+			continue
+		}
+		again, err := bson.Marshal(decoded)
+		if err != nil {
+			t.Errorf("%#v: marshal of the decoded value failed: %v", decoded, err)
+			continue
+		}
+		if diffs := diffBsonBytes(encoded, again); len(diffs) != 0 {
+			t.Errorf("%#v: marshal, unmarshal and marshal changed the bson:\n%v", val, strings.Join(diffs, "\n"))
+		}
+	}
+}
@@ -7,21 +7,56 @@ package proto
 import (
 	"bytes"
 	"fmt"
+	"sort"
 
+	"github.com/golang/snappy"
 	"github.com/youtube/vitess/go/bson"
 	"github.com/youtube/vitess/go/bytes2"
 	mproto "github.com/youtube/vitess/go/mysql/proto"
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+// The bson of the vtgate types follows the same rules for all of
+// them, so that a value has a single encoding, and marshal, unmarshal
+// and marshal again gives the same bytes:
+// - the fields are written in the order of the struct.
+// - the fields of the first version of a type are always written, so
+// that the old decoders find them, even when they're zero. Their nil
+// slices are written as they always were: null for the Shards,
+// KeyspaceIds and EntityKeyspaceIds of the requests, which are never
+// empty in a valid request, and empty arrays for the others.
+// - the fields added since are only written when set: not false, 0,
+// "", nil or empty.
+// - the fields tagged bson:"-" are not sent, they only change how the
+// others are written.
+// The fields always written by each type are listed in the tests.
+
 // Session represents the session state. It keeps track of
 // the shards on which transactions are in progress, along
 // with the corresponding tranaction ids.
+// SessionId and TransactionStartTime (in Unix nanoseconds) are set by
+// the Begin of vtgate, which checks the SessionId on Commit and
+// Rollback, see the -session_max_age flag of vtgate. They are 0 for
+// the sessions of old servers, which are not checked.
+// MustRollback is set when a query of the transaction failed on some
+// of its shards but not on the others: vtgate fails the next queries
+// and the Commit of the transaction, which can only be rolled back.
+// TabletAffinity makes the reads of the session that are not on a
+// master nor in a transaction stick to a tablet of each shard, so
+// they don't see the replication lag of several tablets, see the
+// -tablet_affinity flag of vtgate. TabletPins are the tablets they
+// stick to, set by vtgate.
 type Session struct {
-	InTransaction bool
-	ShardSessions []*ShardSession
+	InTransaction        bool
+	ShardSessions        []*ShardSession
+	SessionId            int64
+	TransactionStartTime int64
+	MustRollback         bool
+	TabletAffinity       bool
+	TabletPins           []*TabletPin
 }
 
 // ShardSession represents the session state for a shard.
@@ -32,6 +67,15 @@ type ShardSession struct {
 	TransactionId int64
 }
 
+// TabletPin is the tablet, by uid, a Session reads from for a shard
+// and tablet type, see Session.TabletAffinity.
+type TabletPin struct {
+	Keyspace   string
+	Shard      string
+	TabletType topo.TabletType
+	Uid        uint32
+}
+
 // MarshalBson marshals Session into buf.
 func (session *Session) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeOptionalPrefix(buf, bson.Object, key)
@@ -40,12 +84,35 @@ func (session *Session) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeBool(buf, "InTransaction", session.InTransaction)
 	encodeShardSessionsBson(session.ShardSessions, "ShardSessions", buf)
 
+	if session.SessionId != 0 {
+		bson.EncodeInt64(buf, "SessionId", session.SessionId)
+	}
+
+	if session.TransactionStartTime != 0 {
+		bson.EncodeInt64(buf, "TransactionStartTime", session.TransactionStartTime)
+	}
+
+	if session.MustRollback {
+		bson.EncodeBool(buf, "MustRollback", session.MustRollback)
+	}
+
+	if session.TabletAffinity {
+		bson.EncodeBool(buf, "TabletAffinity", session.TabletAffinity)
+	}
+
+	if len(session.TabletPins) != 0 {
+		encodeTabletPinsBson(session.TabletPins, "TabletPins", buf)
+	}
+
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
 func (session *Session) String() string {
-	return fmt.Sprintf("InTransaction: %v, ShardSession: %+v", session.InTransaction, session.ShardSessions)
+	if session.SessionId == 0 {
+		return fmt.Sprintf("InTransaction: %v, ShardSession: %+v", session.InTransaction, session.ShardSessions)
+	}
+	return fmt.Sprintf("InTransaction: %v, ShardSession: %+v, SessionId: %v", session.InTransaction, session.ShardSessions, session.SessionId)
 }
 
 func encodeShardSessionsBson(shardSessions []*ShardSession, key string, buf *bytes2.ChunkedWriter) {
@@ -58,6 +125,16 @@ func encodeShardSessionsBson(shardSessions []*ShardSession, key string, buf *byt
 	lenWriter.RecordLen()
 }
 
+func encodeTabletPinsBson(tabletPins []*TabletPin, key string, buf *bytes2.ChunkedWriter) {
+	bson.EncodePrefix(buf, bson.Array, key)
+	lenWriter := bson.NewLenWriter(buf)
+	for i, v := range tabletPins {
+		v.MarshalBson(buf, bson.Itoa(i))
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
 // MarshalBson marshals ShardSession into buf.
 func (shardSession *ShardSession) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeOptionalPrefix(buf, bson.Object, key)
@@ -75,7 +152,7 @@ func (shardSession *ShardSession) MarshalBson(buf *bytes2.ChunkedWriter, key str
 // UnmarshalBson unmarshals Session from buf.
 func (session *Session) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -85,6 +162,16 @@ func (session *Session) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			session.InTransaction = bson.DecodeBool(buf, kind)
 		case "ShardSessions":
 			session.ShardSessions = decodeShardSessionsBson(buf, kind)
+		case "SessionId":
+			session.SessionId = bson.DecodeInt64(buf, kind)
+		case "TransactionStartTime":
+			session.TransactionStartTime = bson.DecodeInt64(buf, kind)
+		case "MustRollback":
+			session.MustRollback = bson.DecodeBool(buf, kind)
+		case "TabletAffinity":
+			session.TabletAffinity = bson.DecodeBool(buf, kind)
+		case "TabletPins":
+			session.TabletPins = decodeTabletPinsBson(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -102,8 +189,8 @@ func decodeShardSessionsBson(buf *bytes.Buffer, kind byte) []*ShardSession {
 		panic(bson.NewBsonError("Unexpected data type %v for ShardSessions", kind))
 	}
 
-	bson.Next(buf, 4)
-	shardSessions := make([]*ShardSession, 0, 8)
+	shardSessions := make([]*ShardSession, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		if kind != bson.Object {
@@ -121,7 +208,7 @@ func decodeShardSessionsBson(buf *bytes.Buffer, kind byte) []*ShardSession {
 // UnmarshalBson unmarshals ShardSession from buf.
 func (shardSession *ShardSession) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -142,15 +229,169 @@ func (shardSession *ShardSession) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	}
 }
 
+// MarshalBson marshals TabletPin into buf.
+func (tabletPin *TabletPin) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Keyspace", tabletPin.Keyspace)
+	bson.EncodeString(buf, "Shard", tabletPin.Shard)
+	bson.EncodeString(buf, "TabletType", string(tabletPin.TabletType))
+	bson.EncodeUint32(buf, "Uid", tabletPin.Uid)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func decodeTabletPinsBson(buf *bytes.Buffer, kind byte) []*TabletPin {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for TabletPins", kind))
+	}
+
+	tabletPins := make([]*TabletPin, 0, bson.CountElements(buf))
+	bson.ReadDocumentLength(buf)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		if kind != bson.Object {
+			panic(bson.NewBsonError("Unexpected data type %v for TabletPin", kind))
+		}
+		bson.SkipIndex(buf)
+		tabletPin := new(TabletPin)
+		tabletPin.UnmarshalBson(buf, kind)
+		tabletPins = append(tabletPins, tabletPin)
+		kind = bson.NextByte(buf)
+	}
+	return tabletPins
+}
+
+// UnmarshalBson unmarshals TabletPin from buf.
+func (tabletPin *TabletPin) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Keyspace":
+			tabletPin.Keyspace = bson.DecodeString(buf, kind)
+		case "Shard":
+			tabletPin.Shard = bson.DecodeString(buf, kind)
+		case "TabletType":
+			tabletPin.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Uid":
+			tabletPin.Uid = bson.DecodeUint32(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// The workloads of the requests, see QueryShard.Workload.
+const (
+	WORKLOAD_OLTP = "oltp"
+	WORKLOAD_OLAP = "olap"
+)
+
+// COMPRESSION_SNAPPY is the compression of the replies a client can
+// accept, see QueryShard.Compression.
+const COMPRESSION_SNAPPY = "snappy"
+
+// CallerID names who a request runs for: the user, the application,
+// and the part of the application that sent it. vtgate passes it to
+// the tablets, which log it with the queries. It is reported by the
+// client and is not authenticated.
+type CallerID struct {
+	Principal    string
+	Component    string
+	Subcomponent string
+}
+
+// MarshalBson marshals CallerID into buf.
+func (cid *CallerID) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Principal", cid.Principal)
+	bson.EncodeString(buf, "Component", cid.Component)
+	bson.EncodeString(buf, "Subcomponent", cid.Subcomponent)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals CallerID from buf.
+func (cid *CallerID) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Principal":
+			cid.Principal = bson.DecodeString(buf, kind)
+		case "Component":
+			cid.Component = bson.DecodeString(buf, kind)
+		case "Subcomponent":
+			cid.Subcomponent = bson.DecodeString(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
 // QueryShard represents a query request for the
 // specified list of shards.
+// If IncludeLag is set, the result has the replication
+// lag of each shard, see QueryResult.ShardLag.
+// If PackedRows is set, the rows of the result are sent with
+// the packed encoding, see QueryResult.PackRows.
+// If MaxShardSessions is set, it lowers the maximum number of
+// shards the transaction of the Session may span.
+// Workload is WORKLOAD_OLTP (the default if empty) or WORKLOAD_OLAP.
+// When vtgate is overloaded, it admits the OLTP requests first.
+// If NotInTransaction is set, the query runs outside of the
+// transaction of the Session, if any: the Session doesn't get
+// ShardSessions for it.
+// CallerID is optional, all the query requests have it.
+// If DeadlineMs is set, vtgate gives up on the query that many
+// milliseconds after it received it, and returns a deadline exceeded
+// error: it doesn't retry past the deadline, and the calls to the
+// tablets time out with it. 0 uses the timeouts of vtgate.
+// If MaxRows is set, vtgate fails the query instead of merging more
+// rows than that, see the -max_result_rows flag of vtgate, which it
+// can only lower. The transaction of the Session goes on.
+// If Compression is COMPRESSION_SNAPPY, vtgate may compress the
+// result, see QueryResult.CompressMinSize. The servers that don't
+// know of it ignore it, and send the result as it is.
+// If AllowPartialResults is set and the query fails on some of its
+// shards, the result still has the rows of the others, with Error
+// naming the shards that failed and Partial set.
 type QueryShard struct {
-	Sql           string
-	BindVariables map[string]interface{}
-	Keyspace      string
-	Shards        []string
-	TabletType    topo.TabletType
-	Session       *Session
+	Sql                 string
+	BindVariables       map[string]interface{}
+	Keyspace            string
+	Shards              []string
+	TabletType          topo.TabletType
+	Session             *Session
+	IncludeLag          bool
+	PackedRows          bool
+	MaxShardSessions    int
+	Workload            string
+	NotInTransaction    bool
+	CallerID            *CallerID
+	DeadlineMs          int64
+	MaxRows             uint64
+	Compression         string
+	AllowPartialResults bool
 }
 
 // MarshalBson marshals QueryShard into buf.
@@ -168,6 +409,46 @@ func (qrs *QueryShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 		qrs.Session.MarshalBson(buf, "Session")
 	}
 
+	if qrs.IncludeLag {
+		bson.EncodeBool(buf, "IncludeLag", qrs.IncludeLag)
+	}
+
+	if qrs.PackedRows {
+		bson.EncodeBool(buf, "PackedRows", qrs.PackedRows)
+	}
+
+	if qrs.MaxShardSessions != 0 {
+		bson.EncodeInt(buf, "MaxShardSessions", qrs.MaxShardSessions)
+	}
+
+	if qrs.Workload != "" {
+		bson.EncodeString(buf, "Workload", qrs.Workload)
+	}
+
+	if qrs.NotInTransaction {
+		bson.EncodeBool(buf, "NotInTransaction", qrs.NotInTransaction)
+	}
+
+	if qrs.CallerID != nil {
+		qrs.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	if qrs.DeadlineMs != 0 {
+		bson.EncodeInt64(buf, "DeadlineMs", qrs.DeadlineMs)
+	}
+
+	if qrs.MaxRows != 0 {
+		bson.EncodeUint64(buf, "MaxRows", qrs.MaxRows)
+	}
+
+	if qrs.Compression != "" {
+		bson.EncodeString(buf, "Compression", qrs.Compression)
+	}
+
+	if qrs.AllowPartialResults {
+		bson.EncodeBool(buf, "AllowPartialResults", qrs.AllowPartialResults)
+	}
+
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
@@ -175,7 +456,7 @@ func (qrs *QueryShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 // UnmarshalBson unmarshals QueryShard from buf.
 func (qrs *QueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -196,6 +477,29 @@ func (qrs *QueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 				qrs.Session = new(Session)
 				qrs.Session.UnmarshalBson(buf, kind)
 			}
+		case "IncludeLag":
+			qrs.IncludeLag = bson.DecodeBool(buf, kind)
+		case "PackedRows":
+			qrs.PackedRows = bson.DecodeBool(buf, kind)
+		case "MaxShardSessions":
+			qrs.MaxShardSessions = bson.DecodeInt(buf, kind)
+		case "Workload":
+			qrs.Workload = bson.DecodeString(buf, kind)
+		case "NotInTransaction":
+			qrs.NotInTransaction = bson.DecodeBool(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				qrs.CallerID = new(CallerID)
+				qrs.CallerID.UnmarshalBson(buf, kind)
+			}
+		case "DeadlineMs":
+			qrs.DeadlineMs = bson.DecodeInt64(buf, kind)
+		case "MaxRows":
+			qrs.MaxRows = bson.DecodeUint64(buf, kind)
+		case "Compression":
+			qrs.Compression = bson.DecodeString(buf, kind)
+		case "AllowPartialResults":
+			qrs.AllowPartialResults = bson.DecodeBool(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -203,69 +507,122 @@ func (qrs *QueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	}
 }
 
-// QueryResult is mproto.QueryResult+Session (for now).
-type QueryResult struct {
-	Fields       []mproto.Field
-	RowsAffected uint64
-	InsertId     uint64
-	Rows         [][]sqltypes.Value
-	Session      *Session
-	Error        string
-}
-
-func PopulateQueryResult(in *mproto.QueryResult, out *QueryResult) {
-	out.Fields = in.Fields
-	out.RowsAffected = in.RowsAffected
-	out.InsertId = in.InsertId
-	out.Rows = in.Rows
+// StreamQueryShard represents a streaming query request for the
+// specified list of shards. Its Session must not be in a transaction:
+// vtgate rejects such requests without running them.
+// The results of the shards are interleaved, the first result of
+// each shard only has its Fields. The stream ends with an error as
+// soon as a shard fails.
+// IncludeLag, PackedRows, Workload and Compression are the options of
+// QueryShard, Compression applying to each result of the stream.
+// If MaxRowsPerSecond is set, vtgate paces the results to that many
+// rows per second, at most.
+// If DeadlineMs is set, the stream ends with a deadline exceeded
+// error once it passed, see QueryShard.
+type StreamQueryShard struct {
+	Sql              string
+	BindVariables    map[string]interface{}
+	Keyspace         string
+	Shards           []string
+	TabletType       topo.TabletType
+	Session          *Session
+	IncludeLag       bool
+	PackedRows       bool
+	Workload         string
+	MaxRowsPerSecond int
+	CallerID         *CallerID
+	DeadlineMs       int64
+	Compression      string
 }
 
-// MarshalBson marshals QueryResult into buf.
-func (qr *QueryResult) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+// MarshalBson marshals StreamQueryShard into buf.
+func (sqs *StreamQueryShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeOptionalPrefix(buf, bson.Object, key)
 	lenWriter := bson.NewLenWriter(buf)
 
-	mproto.EncodeFieldsBson(qr.Fields, "Fields", buf)
-	bson.EncodeUint64(buf, "RowsAffected", qr.RowsAffected)
-	bson.EncodeUint64(buf, "InsertId", qr.InsertId)
-	mproto.EncodeRowsBson(qr.Rows, "Rows", buf)
+	bson.EncodeString(buf, "Sql", sqs.Sql)
+	tproto.EncodeBindVariablesBson(buf, "BindVariables", sqs.BindVariables)
+	bson.EncodeString(buf, "Keyspace", sqs.Keyspace)
+	bson.EncodeStringArray(buf, "Shards", sqs.Shards)
+	bson.EncodeString(buf, "TabletType", string(sqs.TabletType))
 
-	if qr.Session != nil {
-		qr.Session.MarshalBson(buf, "Session")
+	if sqs.Session != nil {
+		sqs.Session.MarshalBson(buf, "Session")
 	}
 
-	if qr.Error != "" {
-		bson.EncodeString(buf, "Error", qr.Error)
+	if sqs.IncludeLag {
+		bson.EncodeBool(buf, "IncludeLag", sqs.IncludeLag)
+	}
+
+	if sqs.PackedRows {
+		bson.EncodeBool(buf, "PackedRows", sqs.PackedRows)
+	}
+
+	if sqs.Workload != "" {
+		bson.EncodeString(buf, "Workload", sqs.Workload)
+	}
+
+	if sqs.MaxRowsPerSecond != 0 {
+		bson.EncodeInt(buf, "MaxRowsPerSecond", sqs.MaxRowsPerSecond)
+	}
+
+	if sqs.CallerID != nil {
+		sqs.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	if sqs.DeadlineMs != 0 {
+		bson.EncodeInt64(buf, "DeadlineMs", sqs.DeadlineMs)
+	}
+
+	if sqs.Compression != "" {
+		bson.EncodeString(buf, "Compression", sqs.Compression)
 	}
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
-// UnmarshalBson unmarshals QueryResult from buf.
-func (qr *QueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+// UnmarshalBson unmarshals StreamQueryShard from buf.
+func (sqs *StreamQueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		keyName := bson.ReadCString(buf)
 		switch keyName {
-		case "Fields":
-			qr.Fields = mproto.DecodeFieldsBson(buf, kind)
-		case "RowsAffected":
-			qr.RowsAffected = bson.DecodeUint64(buf, kind)
-		case "InsertId":
-			qr.InsertId = bson.DecodeUint64(buf, kind)
-		case "Rows":
-			qr.Rows = mproto.DecodeRowsBson(buf, kind)
+		case "Sql":
+			sqs.Sql = bson.DecodeString(buf, kind)
+		case "BindVariables":
+			sqs.BindVariables = tproto.DecodeBindVariablesBson(buf, kind)
+		case "Keyspace":
+			sqs.Keyspace = bson.DecodeString(buf, kind)
+		case "Shards":
+			sqs.Shards = bson.DecodeStringArray(buf, kind)
+		case "TabletType":
+			sqs.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
 		case "Session":
 			if kind != bson.Null {
-				qr.Session = new(Session)
-				qr.Session.UnmarshalBson(buf, kind)
+				sqs.Session = new(Session)
+				sqs.Session.UnmarshalBson(buf, kind)
 			}
-		case "Error":
-			qr.Error = bson.DecodeString(buf, kind)
+		case "IncludeLag":
+			sqs.IncludeLag = bson.DecodeBool(buf, kind)
+		case "PackedRows":
+			sqs.PackedRows = bson.DecodeBool(buf, kind)
+		case "Workload":
+			sqs.Workload = bson.DecodeString(buf, kind)
+		case "MaxRowsPerSecond":
+			sqs.MaxRowsPerSecond = bson.DecodeInt(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				sqs.CallerID = new(CallerID)
+				sqs.CallerID.UnmarshalBson(buf, kind)
+			}
+		case "DeadlineMs":
+			sqs.DeadlineMs = bson.DecodeInt64(buf, kind)
+		case "Compression":
+			sqs.Compression = bson.DecodeString(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -273,55 +630,79 @@ func (qr *QueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	}
 }
 
-// BatchQueryShard represents a batch query request
-// for the specified shards.
-type BatchQueryShard struct {
-	Queries    []tproto.BoundQuery
-	Keyspace   string
-	Shards     []string
-	TabletType topo.TabletType
-	Session    *Session
+// KeyspaceIdQuery represents a query request for the shards
+// that serve the given keyspace ids. vtgate sends the query once
+// to each of those shards, even if several keyspace ids map to
+// the same shard. KeyspaceIds must not be empty.
+// NotInTransaction is the same as in QueryShard.
+type KeyspaceIdQuery struct {
+	Sql              string
+	BindVariables    map[string]interface{}
+	Keyspace         string
+	KeyspaceIds      []key.KeyspaceId
+	TabletType       topo.TabletType
+	Session          *Session
+	NotInTransaction bool
+	CallerID         *CallerID
 }
 
-// MarshalBson marshals BatchQueryShard into buf.
-func (bqs *BatchQueryShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+// MarshalBson marshals KeyspaceIdQuery into buf.
+func (kiq *KeyspaceIdQuery) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
 	bson.EncodeOptionalPrefix(buf, bson.Object, key)
 	lenWriter := bson.NewLenWriter(buf)
 
-	tproto.EncodeQueriesBson(bqs.Queries, "Queries", buf)
-	bson.EncodeString(buf, "Keyspace", bqs.Keyspace)
-	bson.EncodeStringArray(buf, "Shards", bqs.Shards)
-	bson.EncodeString(buf, "TabletType", string(bqs.TabletType))
+	bson.EncodeString(buf, "Sql", kiq.Sql)
+	tproto.EncodeBindVariablesBson(buf, "BindVariables", kiq.BindVariables)
+	bson.EncodeString(buf, "Keyspace", kiq.Keyspace)
+	encodeKeyspaceIdArray(buf, "KeyspaceIds", kiq.KeyspaceIds)
+	bson.EncodeString(buf, "TabletType", string(kiq.TabletType))
 
-	if bqs.Session != nil {
-		bqs.Session.MarshalBson(buf, "Session")
+	if kiq.Session != nil {
+		kiq.Session.MarshalBson(buf, "Session")
+	}
+
+	if kiq.NotInTransaction {
+		bson.EncodeBool(buf, "NotInTransaction", kiq.NotInTransaction)
+	}
+
+	if kiq.CallerID != nil {
+		kiq.CallerID.MarshalBson(buf, "CallerID")
 	}
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
-// UnmarshalBson unmarshals BatchQueryShard from buf.
-func (bqs *BatchQueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+// UnmarshalBson unmarshals KeyspaceIdQuery from buf.
+func (kiq *KeyspaceIdQuery) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		keyName := bson.ReadCString(buf)
 		switch keyName {
-		case "Queries":
-			bqs.Queries = tproto.DecodeQueriesBson(buf, kind)
+		case "Sql":
+			kiq.Sql = bson.DecodeString(buf, kind)
+		case "BindVariables":
+			kiq.BindVariables = tproto.DecodeBindVariablesBson(buf, kind)
 		case "Keyspace":
-			bqs.Keyspace = bson.DecodeString(buf, kind)
-		case "Shards":
-			bqs.Shards = bson.DecodeStringArray(buf, kind)
+			kiq.Keyspace = bson.DecodeString(buf, kind)
+		case "KeyspaceIds":
+			kiq.KeyspaceIds = decodeKeyspaceIdArray(buf, kind)
 		case "TabletType":
-			bqs.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+			kiq.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
 		case "Session":
 			if kind != bson.Null {
-				bqs.Session = new(Session)
-				bqs.Session.UnmarshalBson(buf, kind)
+				kiq.Session = new(Session)
+				kiq.Session.UnmarshalBson(buf, kind)
+			}
+		case "NotInTransaction":
+			kiq.NotInTransaction = bson.DecodeBool(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				kiq.CallerID = new(CallerID)
+				kiq.CallerID.UnmarshalBson(buf, kind)
 			}
 		default:
 			bson.Skip(buf, kind)
@@ -330,42 +711,652 @@ func (bqs *BatchQueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	}
 }
 
-// QueryResultList is mproto.QueryResultList+Session
-type QueryResultList struct {
-	List    []mproto.QueryResult
-	Session *Session
-	Error   string
+func encodeKeyspaceIdArray(buf *bytes2.ChunkedWriter, name string, values []key.KeyspaceId) {
+	if values == nil {
+		bson.EncodePrefix(buf, bson.Null, name)
+		return
+	}
+	bson.EncodePrefix(buf, bson.Array, name)
+	lenWriter := bson.NewLenWriter(buf)
+	for i, val := range values {
+		bson.EncodeString(buf, bson.Itoa(i), string(val))
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
 }
 
-// MarshalBson marshals QueryResultList into buf.
-func (qrl *QueryResultList) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
-	bson.EncodeOptionalPrefix(buf, bson.Object, key)
-	lenWriter := bson.NewLenWriter(buf)
+func decodeKeyspaceIdArray(buf *bytes.Buffer, kind byte) []key.KeyspaceId {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("unexpected kind %v for KeyspaceIds", kind))
+	}
+	values := make([]key.KeyspaceId, 0, 8)
+	bson.ReadDocumentLength(buf)
+	for kind := bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
+		if kind != bson.Binary {
+			panic(bson.NewBsonError("unexpected kind %v for KeyspaceId", kind))
+		}
+		bson.SkipIndex(buf)
+		values = append(values, key.KeyspaceId(bson.DecodeString(buf, kind)))
+	}
+	return values
+}
 
-	tproto.EncodeResultsBson(qrl.List, "List", buf)
+// The codes of RpcError. Unlike the error strings, they don't change
+// with the wording of the tablets or of MySQL.
+const (
+	// ERR_SUCCESS is the code of the requests that worked.
+	ERR_SUCCESS = iota
+	// ERR_RETRY is for the requests that can be sent again,
+	// after backing off.
+	ERR_RETRY
+	// ERR_FATAL is for the requests that failed because the
+	// tablets of a shard can't serve, like during a reparent.
+	ERR_FATAL
+	// ERR_TX_POOL_FULL is for the requests that couldn't begin a
+	// transaction on a tablet.
+	ERR_TX_POOL_FULL
+	// ERR_NOT_IN_TX is for the requests whose transaction was
+	// rolled back by a tablet: it must be started again.
+	ERR_NOT_IN_TX
+	// ERR_INTEGRITY_ERROR is for the statements that violate a
+	// constraint, like a duplicate key. Sending them again fails
+	// the same way.
+	ERR_INTEGRITY_ERROR
+	// ERR_NORMAL is for the other errors, like bad queries or
+	// rejected requests.
+	ERR_NORMAL
+)
 
-	if qrl.Session != nil {
-		qrl.Session.MarshalBson(buf, "Session")
-	}
+// RpcError is the error of a vtgate request, with a code from the
+// list above so clients don't parse Message.
+type RpcError struct {
+	Code    int
+	Message string
+}
 
-	if qrl.Error != "" {
-		bson.EncodeString(buf, "Error", qrl.Error)
-	}
+// MarshalBson marshals RpcError into buf.
+func (re *RpcError) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeInt(buf, "Code", re.Code)
+	bson.EncodeString(buf, "Message", re.Message)
 
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
-// UnmarshalBson unmarshals QueryResultList from buf.
-func (qrl *QueryResultList) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+// UnmarshalBson unmarshals RpcError from buf.
+func (re *RpcError) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
 		keyName := bson.ReadCString(buf)
 		switch keyName {
-		case "List":
+		case "Code":
+			re.Code = bson.DecodeInt(buf, kind)
+		case "Message":
+			re.Message = bson.DecodeString(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// QueryResult is mproto.QueryResult+Session (for now).
+// ShardLag is only set if the query asked for it with IncludeLag:
+// it has the replication lag in seconds of the tablet that served
+// each shard, 0 for masters and -1 if the lag is unknown. When
+// streaming, it is sent with the last result.
+// If PackRows is set, Rows are sent as a single "PackedRows" blob
+// (see mproto.EncodePackedRows), which is smaller than their BSON
+// encoding. vtgate sets it for the clients that ask for it, and
+// UnmarshalBson decodes both encodings, so old servers that ignore
+// the request still work.
+// If RawRows is set instead of Rows, they are sent as they were
+// received from the tablets, without decoding them.
+// Partial is set on the last result of a key range query that only ran
+// on part of its key range, see the -allow_partial_keyrange flag of
+// vtgate, and on the result of a QueryShard with AllowPartialResults
+// that failed on some of its shards.
+// Err is set with Error, for the clients that want its RpcError
+// code. Error and ErrorCode are kept for the older clients.
+// If CompressMinSize is set, a result whose BSON encoding is at least
+// that many bytes is sent as a single "Snappy" blob, the
+// snappy-compressed encoding. vtgate sets it for the clients that ask
+// for it, and UnmarshalBson decodes both forms.
+type QueryResult struct {
+	Fields       []mproto.Field
+	RowsAffected uint64
+	InsertId     uint64
+	Rows         [][]sqltypes.Value
+	Session      *Session
+	Error        string
+	// ErrorCode is the tablet error code of Error
+	// (tabletconn.ERR_*), the most severe one if several
+	// shards failed.
+	ErrorCode int
+	Err       *RpcError
+	ShardLag  map[string]int64
+	Partial   bool
+	PackRows  bool           `bson:"-" json:"-"`
+	RawRows   mproto.RawRows `bson:"-" json:"-"`
+	// CompressMinSize is not sent, see above.
+	CompressMinSize int `bson:"-" json:"-"`
+}
+
+// PopulateQueryResult fills out with a deep copy of in. The tablet
+// connections may reuse the buffers of in for the next result, while
+// out is still being sent to the client. out is discarded once sent,
+// so its rows are copied into an mproto.Arena.
+func PopulateQueryResult(in *mproto.QueryResult, out *QueryResult) {
+	out.Fields = copyFields(in.Fields)
+	out.RowsAffected = in.RowsAffected
+	out.InsertId = in.InsertId
+	out.Rows = mproto.NewArena(0).CopyRows(in.Rows)
+}
+
+// PopulateLazyQueryResult fills out with in. Unlike
+// PopulateQueryResult, it doesn't copy the rows: out.RawRows shares
+// them with in.
+func PopulateLazyQueryResult(in *mproto.LazyQueryResult, out *QueryResult) {
+	out.Fields = copyFields(in.Fields)
+	out.RowsAffected = in.RowsAffected
+	out.InsertId = in.InsertId
+	out.RawRows = in.Rows
+}
+
+// CopyQueryResult returns a deep copy of qr, see PopulateQueryResult.
+func CopyQueryResult(qr *mproto.QueryResult) mproto.QueryResult {
+	return mproto.QueryResult{
+		Fields:       copyFields(qr.Fields),
+		RowsAffected: qr.RowsAffected,
+		InsertId:     qr.InsertId,
+		Rows:         mproto.NewArena(0).CopyRows(qr.Rows),
+	}
+}
+
+func copyFields(fields []mproto.Field) []mproto.Field {
+	if fields == nil {
+		return nil
+	}
+	result := make([]mproto.Field, len(fields))
+	copy(result, fields)
+	return result
+}
+
+// MarshalBson marshals QueryResult into buf.
+func (qr *QueryResult) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	if qr.CompressMinSize > 0 {
+		qr.marshalCompressedBson(buf, key)
+		return
+	}
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	mproto.EncodeFieldsBson(qr.Fields, "Fields", buf)
+	bson.EncodeUint64(buf, "RowsAffected", qr.RowsAffected)
+	bson.EncodeUint64(buf, "InsertId", qr.InsertId)
+	if qr.PackRows {
+		bson.EncodeBinary(buf, "PackedRows", mproto.EncodePackedRows(qr.Rows))
+	} else if qr.RawRows != nil {
+		mproto.EncodeRawRowsBson(qr.RawRows, "Rows", buf)
+	} else {
+		mproto.EncodeRowsBson(qr.Rows, "Rows", buf)
+	}
+
+	if qr.Session != nil {
+		qr.Session.MarshalBson(buf, "Session")
+	}
+
+	if qr.Error != "" {
+		bson.EncodeString(buf, "Error", qr.Error)
+	}
+
+	if qr.ErrorCode != 0 {
+		bson.EncodeInt(buf, "ErrorCode", qr.ErrorCode)
+	}
+
+	if qr.Err != nil {
+		qr.Err.MarshalBson(buf, "Err")
+	}
+
+	if len(qr.ShardLag) != 0 {
+		encodeShardLagBson(buf, "ShardLag", qr.ShardLag)
+	}
+
+	if qr.Partial {
+		bson.EncodeBool(buf, "Partial", qr.Partial)
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// marshalCompressedBson marshals QueryResult into buf, compressed if
+// it is at least CompressMinSize bytes.
+func (qr *QueryResult) marshalCompressedBson(buf *bytes2.ChunkedWriter, key string) {
+	plain := *qr
+	plain.CompressMinSize = 0
+	encoded := bytes2.NewChunkedWriter(bson.DefaultBufferSize)
+	plain.MarshalBson(encoded, "")
+
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	if encoded.Len() < qr.CompressMinSize {
+		encoded.WriteTo(buf)
+		return
+	}
+	lenWriter := bson.NewLenWriter(buf)
+	bson.EncodeBinary(buf, "Snappy", snappy.Encode(nil, encoded.Bytes()))
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals QueryResult from buf.
+func (qr *QueryResult) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Fields":
+			qr.Fields = mproto.DecodeFieldsBson(buf, kind)
+		case "RowsAffected":
+			qr.RowsAffected = bson.DecodeUint64(buf, kind)
+		case "InsertId":
+			qr.InsertId = bson.DecodeUint64(buf, kind)
+		case "Rows":
+			qr.Rows = mproto.DecodeRowsBson(buf, kind)
+		case "PackedRows":
+			rows, err := mproto.DecodePackedRows(bson.DecodeBinary(buf, kind))
+			if err != nil {
+				panic(bson.NewBsonError("%v", err))
+			}
+			qr.Rows = rows
+		case "Snappy":
+			qr.UnmarshalBson(bytes.NewBuffer(decodeSnappy(bson.DecodeBinary(buf, kind))), bson.EOO)
+		case "Session":
+			if kind != bson.Null {
+				qr.Session = new(Session)
+				qr.Session.UnmarshalBson(buf, kind)
+			}
+		case "Error":
+			qr.Error = bson.DecodeString(buf, kind)
+		case "ErrorCode":
+			qr.ErrorCode = bson.DecodeInt(buf, kind)
+		case "Err":
+			if kind != bson.Null {
+				qr.Err = new(RpcError)
+				qr.Err.UnmarshalBson(buf, kind)
+			}
+		case "ShardLag":
+			qr.ShardLag = decodeShardLagBson(buf, kind)
+		case "Partial":
+			qr.Partial = bson.DecodeBool(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// decodeSnappy decompresses a "Snappy" result, which must not be
+// larger than bson.MaxDocumentSize.
+func decodeSnappy(compressed []byte) []byte {
+	l, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		panic(bson.NewBsonError("cannot decompress the result: %v", err))
+	}
+	if l > bson.MaxDocumentSize {
+		panic(bson.NewBsonError("compressed result of %v bytes is larger than the maximum of %v bytes", l, bson.MaxDocumentSize))
+	}
+	encoded, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		panic(bson.NewBsonError("cannot decompress the result: %v", err))
+	}
+	return encoded
+}
+
+func encodeShardLagBson(buf *bytes2.ChunkedWriter, key string, shardLag map[string]int64) {
+	bson.EncodePrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+	shards := make([]string, 0, len(shardLag))
+	for shard := range shardLag {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	for _, shard := range shards {
+		bson.EncodeInt64(buf, shard, shardLag[shard])
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func decodeShardLagBson(buf *bytes.Buffer, kind byte) map[string]int64 {
+	switch kind {
+	case bson.Object:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for ShardLag", kind))
+	}
+
+	bson.ReadDocumentLength(buf)
+	shardLag := make(map[string]int64)
+	for kind := bson.NextByte(buf); kind != bson.EOO; kind = bson.NextByte(buf) {
+		shard := bson.ReadCString(buf)
+		shardLag[shard] = bson.DecodeInt64(buf, kind)
+	}
+	return shardLag
+}
+
+// BatchQueryShard represents a batch query request
+// for the specified shards.
+// If MaxShardSessions is set, it lowers the maximum number of
+// shards the transaction of the Session may span.
+// Workload is the workload of the request, see QueryShard.
+// DeadlineMs is the same as in QueryShard.
+type BatchQueryShard struct {
+	Queries          []tproto.BoundQuery
+	Keyspace         string
+	Shards           []string
+	TabletType       topo.TabletType
+	Session          *Session
+	MaxShardSessions int
+	Workload         string
+	CallerID         *CallerID
+	DeadlineMs       int64
+}
+
+// MarshalBson marshals BatchQueryShard into buf.
+func (bqs *BatchQueryShard) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	tproto.EncodeQueriesBson(bqs.Queries, "Queries", buf)
+	bson.EncodeString(buf, "Keyspace", bqs.Keyspace)
+	bson.EncodeStringArray(buf, "Shards", bqs.Shards)
+	bson.EncodeString(buf, "TabletType", string(bqs.TabletType))
+
+	if bqs.Session != nil {
+		bqs.Session.MarshalBson(buf, "Session")
+	}
+
+	if bqs.MaxShardSessions != 0 {
+		bson.EncodeInt(buf, "MaxShardSessions", bqs.MaxShardSessions)
+	}
+
+	if bqs.Workload != "" {
+		bson.EncodeString(buf, "Workload", bqs.Workload)
+	}
+
+	if bqs.CallerID != nil {
+		bqs.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	if bqs.DeadlineMs != 0 {
+		bson.EncodeInt64(buf, "DeadlineMs", bqs.DeadlineMs)
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals BatchQueryShard from buf.
+func (bqs *BatchQueryShard) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Queries":
+			bqs.Queries = tproto.DecodeQueriesBson(buf, kind)
+		case "Keyspace":
+			bqs.Keyspace = bson.DecodeString(buf, kind)
+		case "Shards":
+			bqs.Shards = bson.DecodeStringArray(buf, kind)
+		case "TabletType":
+			bqs.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Session":
+			if kind != bson.Null {
+				bqs.Session = new(Session)
+				bqs.Session.UnmarshalBson(buf, kind)
+			}
+		case "MaxShardSessions":
+			bqs.MaxShardSessions = bson.DecodeInt(buf, kind)
+		case "Workload":
+			bqs.Workload = bson.DecodeString(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				bqs.CallerID = new(CallerID)
+				bqs.CallerID.UnmarshalBson(buf, kind)
+			}
+		case "DeadlineMs":
+			bqs.DeadlineMs = bson.DecodeInt64(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// KeyspaceIdBatchQuery represents a batch query request for the
+// shards that serve the given keyspace ids. vtgate sends the batch
+// once to each of those shards, even if several keyspace ids map to
+// the same shard. KeyspaceIds must not be empty.
+type KeyspaceIdBatchQuery struct {
+	Queries     []tproto.BoundQuery
+	Keyspace    string
+	KeyspaceIds []key.KeyspaceId
+	TabletType  topo.TabletType
+	Session     *Session
+	CallerID    *CallerID
+}
+
+// MarshalBson marshals KeyspaceIdBatchQuery into buf.
+func (kbq *KeyspaceIdBatchQuery) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	tproto.EncodeQueriesBson(kbq.Queries, "Queries", buf)
+	bson.EncodeString(buf, "Keyspace", kbq.Keyspace)
+	encodeKeyspaceIdArray(buf, "KeyspaceIds", kbq.KeyspaceIds)
+	bson.EncodeString(buf, "TabletType", string(kbq.TabletType))
+
+	if kbq.Session != nil {
+		kbq.Session.MarshalBson(buf, "Session")
+	}
+
+	if kbq.CallerID != nil {
+		kbq.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals KeyspaceIdBatchQuery from buf.
+func (kbq *KeyspaceIdBatchQuery) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Queries":
+			kbq.Queries = tproto.DecodeQueriesBson(buf, kind)
+		case "Keyspace":
+			kbq.Keyspace = bson.DecodeString(buf, kind)
+		case "KeyspaceIds":
+			kbq.KeyspaceIds = decodeKeyspaceIdArray(buf, kind)
+		case "TabletType":
+			kbq.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Session":
+			if kind != bson.Null {
+				kbq.Session = new(Session)
+				kbq.Session.UnmarshalBson(buf, kind)
+			}
+		case "CallerID":
+			if kind != bson.Null {
+				kbq.CallerID = new(CallerID)
+				kbq.CallerID.UnmarshalBson(buf, kind)
+			}
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// QueryResultList is mproto.QueryResultList+Session
+type QueryResultList struct {
+	List    []mproto.QueryResult
+	Session *Session
+	Error   string
+	// ErrorCode is the tablet error code of Error, see QueryResult.
+	ErrorCode int
+	// Err is the RpcError of Error, see QueryResult.
+	Err *RpcError
+	// ShardErrors are the errors of the shards that failed. List
+	// still has the results of the other shards, and Error is set:
+	// the failed shards can be retried alone.
+	ShardErrors []ShardError
+}
+
+// ShardError is the error of a shard of a batch, see
+// QueryResultList.ShardErrors.
+type ShardError struct {
+	Keyspace string
+	Shard    string
+	Error    string
+}
+
+// MarshalBson marshals ShardError into buf.
+func (se *ShardError) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Keyspace", se.Keyspace)
+	bson.EncodeString(buf, "Shard", se.Shard)
+	bson.EncodeString(buf, "Error", se.Error)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals ShardError from buf.
+func (se *ShardError) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Keyspace":
+			se.Keyspace = bson.DecodeString(buf, kind)
+		case "Shard":
+			se.Shard = bson.DecodeString(buf, kind)
+		case "Error":
+			se.Error = bson.DecodeString(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+func encodeShardErrorsBson(shardErrors []ShardError, key string, buf *bytes2.ChunkedWriter) {
+	bson.EncodePrefix(buf, bson.Array, key)
+	lenWriter := bson.NewLenWriter(buf)
+	for i := range shardErrors {
+		shardErrors[i].MarshalBson(buf, bson.Itoa(i))
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func decodeShardErrorsBson(buf *bytes.Buffer, kind byte) []ShardError {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for ShardErrors", kind))
+	}
+
+	bson.ReadDocumentLength(buf)
+	shardErrors := make([]ShardError, 0, 8)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		if kind != bson.Object {
+			panic(bson.NewBsonError("Unexpected data type %v for ShardError", kind))
+		}
+		bson.SkipIndex(buf)
+		var shardError ShardError
+		shardError.UnmarshalBson(buf, kind)
+		shardErrors = append(shardErrors, shardError)
+		kind = bson.NextByte(buf)
+	}
+	return shardErrors
+}
+
+// MarshalBson marshals QueryResultList into buf.
+func (qrl *QueryResultList) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	tproto.EncodeResultsBson(qrl.List, "List", buf)
+
+	if qrl.Session != nil {
+		qrl.Session.MarshalBson(buf, "Session")
+	}
+
+	if qrl.Error != "" {
+		bson.EncodeString(buf, "Error", qrl.Error)
+	}
+
+	if qrl.ErrorCode != 0 {
+		bson.EncodeInt(buf, "ErrorCode", qrl.ErrorCode)
+	}
+
+	if qrl.Err != nil {
+		qrl.Err.MarshalBson(buf, "Err")
+	}
+
+	if len(qrl.ShardErrors) != 0 {
+		encodeShardErrorsBson(qrl.ShardErrors, "ShardErrors", buf)
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals QueryResultList from buf.
+func (qrl *QueryResultList) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "List":
 			qrl.List = tproto.DecodeResultsBson(buf, kind)
 		case "Session":
 			if kind != bson.Null {
@@ -374,6 +1365,228 @@ func (qrl *QueryResultList) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			}
 		case "Error":
 			qrl.Error = bson.DecodeString(buf, kind)
+		case "ErrorCode":
+			qrl.ErrorCode = bson.DecodeInt(buf, kind)
+		case "Err":
+			if kind != bson.Null {
+				qrl.Err = new(RpcError)
+				qrl.Err.UnmarshalBson(buf, kind)
+			}
+		case "ShardErrors":
+			qrl.ShardErrors = decodeShardErrorsBson(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// KeyRangeQuery represents a non-streaming query request for the
+// shards that serve KeyRange, "<start>-<end>" in hex like the key
+// range shard names. Unlike StreamQueryKeyRange, it may span several
+// shards and its Session may be in a transaction.
+// NotInTransaction is the same as in QueryShard.
+type KeyRangeQuery struct {
+	Sql              string
+	BindVariables    map[string]interface{}
+	Keyspace         string
+	KeyRange         string
+	TabletType       topo.TabletType
+	Session          *Session
+	NotInTransaction bool
+	CallerID         *CallerID
+}
+
+// MarshalBson marshals KeyRangeQuery into buf.
+func (krq *KeyRangeQuery) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Sql", krq.Sql)
+	tproto.EncodeBindVariablesBson(buf, "BindVariables", krq.BindVariables)
+	bson.EncodeString(buf, "Keyspace", krq.Keyspace)
+	bson.EncodeString(buf, "KeyRange", krq.KeyRange)
+	bson.EncodeString(buf, "TabletType", string(krq.TabletType))
+
+	if krq.Session != nil {
+		krq.Session.MarshalBson(buf, "Session")
+	}
+
+	if krq.NotInTransaction {
+		bson.EncodeBool(buf, "NotInTransaction", krq.NotInTransaction)
+	}
+
+	if krq.CallerID != nil {
+		krq.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals KeyRangeQuery from buf.
+func (krq *KeyRangeQuery) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Sql":
+			krq.Sql = bson.DecodeString(buf, kind)
+		case "BindVariables":
+			krq.BindVariables = tproto.DecodeBindVariablesBson(buf, kind)
+		case "Keyspace":
+			krq.Keyspace = bson.DecodeString(buf, kind)
+		case "KeyRange":
+			krq.KeyRange = bson.DecodeString(buf, kind)
+		case "TabletType":
+			krq.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Session":
+			if kind != bson.Null {
+				krq.Session = new(Session)
+				krq.Session.UnmarshalBson(buf, kind)
+			}
+		case "NotInTransaction":
+			krq.NotInTransaction = bson.DecodeBool(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				krq.CallerID = new(CallerID)
+				krq.CallerID.UnmarshalBson(buf, kind)
+			}
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// EntityId is the value of an entity column, like a user id, and the
+// keyspace id of its rows.
+type EntityId struct {
+	ExternalId interface{}
+	KeyspaceId key.KeyspaceId
+}
+
+// MarshalBson marshals EntityId into buf.
+func (eid *EntityId) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeField(buf, "ExternalId", eid.ExternalId)
+	bson.EncodeString(buf, "KeyspaceId", string(eid.KeyspaceId))
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals EntityId from buf.
+func (eid *EntityId) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "ExternalId":
+			eid.ExternalId = bson.DecodeInterface(buf, kind)
+		case "KeyspaceId":
+			eid.KeyspaceId = key.KeyspaceId(bson.DecodeString(buf, kind))
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// EntityIdsQuery represents a query request for the rows of a list
+// of entities, whose keyspace ids are known, but whose entity column
+// is not the sharding column. Sql must use the list bind variable
+// named after EntityColumnName, as in
+// "select ... where user_id in (:user_id)": vtgate sets it for each
+// shard to the entity ids that live on that shard.
+type EntityIdsQuery struct {
+	Sql               string
+	BindVariables     map[string]interface{}
+	Keyspace          string
+	EntityColumnName  string
+	EntityKeyspaceIds []EntityId
+	TabletType        topo.TabletType
+	Session           *Session
+	CallerID          *CallerID
+}
+
+// MarshalBson marshals EntityIdsQuery into buf.
+func (eiq *EntityIdsQuery) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Sql", eiq.Sql)
+	tproto.EncodeBindVariablesBson(buf, "BindVariables", eiq.BindVariables)
+	bson.EncodeString(buf, "Keyspace", eiq.Keyspace)
+	bson.EncodeString(buf, "EntityColumnName", eiq.EntityColumnName)
+	encodeEntityIdsBson(eiq.EntityKeyspaceIds, "EntityKeyspaceIds", buf)
+	bson.EncodeString(buf, "TabletType", string(eiq.TabletType))
+
+	if eiq.Session != nil {
+		eiq.Session.MarshalBson(buf, "Session")
+	}
+
+	if eiq.CallerID != nil {
+		eiq.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func encodeEntityIdsBson(entityIds []EntityId, key string, buf *bytes2.ChunkedWriter) {
+	if entityIds == nil {
+		bson.EncodePrefix(buf, bson.Null, key)
+		return
+	}
+	bson.EncodePrefix(buf, bson.Array, key)
+	lenWriter := bson.NewLenWriter(buf)
+	for i := range entityIds {
+		entityIds[i].MarshalBson(buf, bson.Itoa(i))
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals EntityIdsQuery from buf.
+func (eiq *EntityIdsQuery) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Sql":
+			eiq.Sql = bson.DecodeString(buf, kind)
+		case "BindVariables":
+			eiq.BindVariables = tproto.DecodeBindVariablesBson(buf, kind)
+		case "Keyspace":
+			eiq.Keyspace = bson.DecodeString(buf, kind)
+		case "EntityColumnName":
+			eiq.EntityColumnName = bson.DecodeString(buf, kind)
+		case "EntityKeyspaceIds":
+			eiq.EntityKeyspaceIds = decodeEntityIdsBson(buf, kind)
+		case "TabletType":
+			eiq.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Session":
+			if kind != bson.Null {
+				eiq.Session = new(Session)
+				eiq.Session.UnmarshalBson(buf, kind)
+			}
+		case "CallerID":
+			if kind != bson.Null {
+				eiq.CallerID = new(CallerID)
+				eiq.CallerID.UnmarshalBson(buf, kind)
+			}
 		default:
 			bson.Skip(buf, kind)
 		}
@@ -381,13 +1594,58 @@ func (qrl *QueryResultList) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	}
 }
 
+func decodeEntityIdsBson(buf *bytes.Buffer, kind byte) []EntityId {
+	switch kind {
+	case bson.Array:
+		// valid
+	case bson.Null:
+		return nil
+	default:
+		panic(bson.NewBsonError("Unexpected data type %v for EntityKeyspaceIds", kind))
+	}
+
+	bson.ReadDocumentLength(buf)
+	entityIds := make([]EntityId, 0, 8)
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		if kind != bson.Object {
+			panic(bson.NewBsonError("Unexpected data type %v for EntityId", kind))
+		}
+		bson.SkipIndex(buf)
+		var entityId EntityId
+		entityId.UnmarshalBson(buf, kind)
+		entityIds = append(entityIds, entityId)
+		kind = bson.NextByte(buf)
+	}
+	return entityIds
+}
+
+// StreamQueryKeyRange represents a streaming query request
+// for the shard that serves KeyRange. Its Session must not be in a
+// transaction: vtgate rejects such requests without running them.
+// KeyRanges asks for several key ranges at once, each of which must
+// map to one shard: vtgate streams from each of their shards once,
+// even if several key ranges map to the same shard. KeyRange is only
+// used if KeyRanges is empty, see AllKeyRanges.
+// Workload and MaxRowsPerSecond are the workload and row rate of the
+// request, and Compression the compression its results accept, see
+// QueryShard.
+// DeadlineMs is the same as in StreamQueryShard.
 type StreamQueryKeyRange struct {
-	Sql           string
-	BindVariables map[string]interface{}
-	Keyspace      string
-	KeyRange      string
-	TabletType    topo.TabletType
-	Session       *Session
+	Sql              string
+	BindVariables    map[string]interface{}
+	Keyspace         string
+	KeyRange         string
+	TabletType       topo.TabletType
+	KeyRanges        []string
+	Session          *Session
+	IncludeLag       bool
+	PackedRows       bool
+	Workload         string
+	MaxRowsPerSecond int
+	CallerID         *CallerID
+	DeadlineMs       int64
+	Compression      string
 }
 
 func (sqs *StreamQueryKeyRange) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
@@ -400,17 +1658,49 @@ func (sqs *StreamQueryKeyRange) MarshalBson(buf *bytes2.ChunkedWriter, key strin
 	bson.EncodeString(buf, "KeyRange", sqs.KeyRange)
 	bson.EncodeString(buf, "TabletType", string(sqs.TabletType))
 
+	if len(sqs.KeyRanges) != 0 {
+		bson.EncodeStringArray(buf, "KeyRanges", sqs.KeyRanges)
+	}
+
 	if sqs.Session != nil {
 		sqs.Session.MarshalBson(buf, "Session")
 	}
 
+	if sqs.IncludeLag {
+		bson.EncodeBool(buf, "IncludeLag", sqs.IncludeLag)
+	}
+
+	if sqs.PackedRows {
+		bson.EncodeBool(buf, "PackedRows", sqs.PackedRows)
+	}
+
+	if sqs.Workload != "" {
+		bson.EncodeString(buf, "Workload", sqs.Workload)
+	}
+
+	if sqs.MaxRowsPerSecond != 0 {
+		bson.EncodeInt(buf, "MaxRowsPerSecond", sqs.MaxRowsPerSecond)
+	}
+
+	if sqs.CallerID != nil {
+		sqs.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	if sqs.DeadlineMs != 0 {
+		bson.EncodeInt64(buf, "DeadlineMs", sqs.DeadlineMs)
+	}
+
+	if sqs.Compression != "" {
+		bson.EncodeString(buf, "Compression", sqs.Compression)
+	}
+
 	buf.WriteByte(0)
 	lenWriter.RecordLen()
 }
 
 func (sqs *StreamQueryKeyRange) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 	bson.VerifyObject(kind)
-	bson.Next(buf, 4)
+	bson.ReadDocumentLength(buf)
 
 	kind = bson.NextByte(buf)
 	for kind != bson.EOO {
@@ -424,6 +1714,8 @@ func (sqs *StreamQueryKeyRange) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 			sqs.Keyspace = bson.DecodeString(buf, kind)
 		case "KeyRange":
 			sqs.KeyRange = bson.DecodeString(buf, kind)
+		case "KeyRanges":
+			sqs.KeyRanges = bson.DecodeStringArray(buf, kind)
 		case "TabletType":
 			sqs.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
 		case "Session":
@@ -431,6 +1723,185 @@ func (sqs *StreamQueryKeyRange) UnmarshalBson(buf *bytes.Buffer, kind byte) {
 				sqs.Session = new(Session)
 				sqs.Session.UnmarshalBson(buf, kind)
 			}
+		case "IncludeLag":
+			sqs.IncludeLag = bson.DecodeBool(buf, kind)
+		case "PackedRows":
+			sqs.PackedRows = bson.DecodeBool(buf, kind)
+		case "Workload":
+			sqs.Workload = bson.DecodeString(buf, kind)
+		case "MaxRowsPerSecond":
+			sqs.MaxRowsPerSecond = bson.DecodeInt(buf, kind)
+		case "CallerID":
+			if kind != bson.Null {
+				sqs.CallerID = new(CallerID)
+				sqs.CallerID.UnmarshalBson(buf, kind)
+			}
+		case "DeadlineMs":
+			sqs.DeadlineMs = bson.DecodeInt64(buf, kind)
+		case "Compression":
+			sqs.Compression = bson.DecodeString(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// AllKeyRanges returns the key ranges of the request: KeyRanges, or
+// KeyRange alone for the clients that don't set KeyRanges.
+func (sqs *StreamQueryKeyRange) AllKeyRanges() []string {
+	if len(sqs.KeyRanges) != 0 {
+		return sqs.KeyRanges
+	}
+	return []string{sqs.KeyRange}
+}
+
+// StreamQueryKeyspaceIds represents a streaming query request for
+// the shards that serve the given keyspace ids. vtgate streams from
+// each of those shards once, even if several keyspace ids map to the
+// same shard. KeyspaceIds must not be empty, and the Session must not
+// be in a transaction.
+// DeadlineMs is the same as in StreamQueryShard.
+type StreamQueryKeyspaceIds struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	TabletType    topo.TabletType
+	Session       *Session
+	CallerID      *CallerID
+	DeadlineMs    int64
+}
+
+// MarshalBson marshals StreamQueryKeyspaceIds into buf.
+func (sqk *StreamQueryKeyspaceIds) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeString(buf, "Sql", sqk.Sql)
+	tproto.EncodeBindVariablesBson(buf, "BindVariables", sqk.BindVariables)
+	bson.EncodeString(buf, "Keyspace", sqk.Keyspace)
+	encodeKeyspaceIdArray(buf, "KeyspaceIds", sqk.KeyspaceIds)
+	bson.EncodeString(buf, "TabletType", string(sqk.TabletType))
+
+	if sqk.Session != nil {
+		sqk.Session.MarshalBson(buf, "Session")
+	}
+
+	if sqk.CallerID != nil {
+		sqk.CallerID.MarshalBson(buf, "CallerID")
+	}
+
+	if sqk.DeadlineMs != 0 {
+		bson.EncodeInt64(buf, "DeadlineMs", sqk.DeadlineMs)
+	}
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals StreamQueryKeyspaceIds from buf.
+func (sqk *StreamQueryKeyspaceIds) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "Sql":
+			sqk.Sql = bson.DecodeString(buf, kind)
+		case "BindVariables":
+			sqk.BindVariables = tproto.DecodeBindVariablesBson(buf, kind)
+		case "Keyspace":
+			sqk.Keyspace = bson.DecodeString(buf, kind)
+		case "KeyspaceIds":
+			sqk.KeyspaceIds = decodeKeyspaceIdArray(buf, kind)
+		case "TabletType":
+			sqk.TabletType = topo.TabletType(bson.DecodeString(buf, kind))
+		case "Session":
+			if kind != bson.Null {
+				sqk.Session = new(Session)
+				sqk.Session.UnmarshalBson(buf, kind)
+			}
+		case "CallerID":
+			if kind != bson.Null {
+				sqk.CallerID = new(CallerID)
+				sqk.CallerID.UnmarshalBson(buf, kind)
+			}
+		case "DeadlineMs":
+			sqk.DeadlineMs = bson.DecodeInt64(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// RollbackOldTransactionsRequest asks vtgate to roll back the shard
+// transactions it began more than MinAgeSeconds ago, and that are
+// still in its transaction registry.
+type RollbackOldTransactionsRequest struct {
+	MinAgeSeconds int64
+}
+
+// MarshalBson marshals RollbackOldTransactionsRequest into buf.
+func (req *RollbackOldTransactionsRequest) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeInt64(buf, "MinAgeSeconds", req.MinAgeSeconds)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals RollbackOldTransactionsRequest from buf.
+func (req *RollbackOldTransactionsRequest) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "MinAgeSeconds":
+			req.MinAgeSeconds = bson.DecodeInt64(buf, kind)
+		default:
+			bson.Skip(buf, kind)
+		}
+		kind = bson.NextByte(buf)
+	}
+}
+
+// RollbackOldTransactionsReply is the number of shard transactions
+// vtgate rolled back for a RollbackOldTransactionsRequest.
+type RollbackOldTransactionsReply struct {
+	RolledBack int
+}
+
+// MarshalBson marshals RollbackOldTransactionsReply into buf.
+func (reply *RollbackOldTransactionsReply) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodeOptionalPrefix(buf, bson.Object, key)
+	lenWriter := bson.NewLenWriter(buf)
+
+	bson.EncodeInt(buf, "RolledBack", reply.RolledBack)
+
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+// UnmarshalBson unmarshals RollbackOldTransactionsReply from buf.
+func (reply *RollbackOldTransactionsReply) UnmarshalBson(buf *bytes.Buffer, kind byte) {
+	bson.VerifyObject(kind)
+	bson.ReadDocumentLength(buf)
+
+	kind = bson.NextByte(buf)
+	for kind != bson.EOO {
+		keyName := bson.ReadCString(buf)
+		switch keyName {
+		case "RolledBack":
+			reply.RolledBack = bson.DecodeInt(buf, kind)
 		default:
 			bson.Skip(buf, kind)
 		}
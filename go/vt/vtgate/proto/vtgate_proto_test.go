@@ -5,12 +5,18 @@
 package proto
 
 import (
+	"bytes"
+	"encoding/binary"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/youtube/vitess/go/bson"
+	"github.com/youtube/vitess/go/bytes2"
 	mproto "github.com/youtube/vitess/go/mysql/proto"
 	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
 	"github.com/youtube/vitess/go/vt/topo"
 )
@@ -90,6 +96,40 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestSessionId(t *testing.T) {
+	session := Session{
+		InTransaction: true,
+		ShardSessions: []*ShardSession{{
+			Keyspace:      "a",
+			Shard:         "0",
+			TabletType:    topo.TabletType("master"),
+			TransactionId: 1,
+		}},
+		SessionId:            2,
+		TransactionStartTime: 3,
+	}
+	encoded, err := bson.Marshal(&session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled Session
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(session, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", session, unmarshalled)
+	}
+
+	// old servers skip them
+	var old reflectSession
+	if err := bson.Unmarshal(encoded, &old); err != nil {
+		t.Fatal(err)
+	}
+	if !old.InTransaction || len(old.ShardSessions) != 1 {
+		t.Errorf("want the session, got %#v", old)
+	}
+}
+
 type reflectQueryShard struct {
 	Sql           string
 	BindVariables map[string]interface{}
@@ -159,48 +199,29 @@ func TestQueryShard(t *testing.T) {
 	}
 }
 
-func TestQueryResult(t *testing.T) {
-	// We can't do the reflection test because bson
-	// doesn't do it correctly for embedded fields.
-	want := "o\x01\x00\x00" +
-		"\x04Fields\x00*\x00\x00\x00" +
-		"\x030\x00\"\x00\x00\x00" +
-		"\x05Name\x00\x04\x00\x00\x00\x00name" +
-		"\x12Type\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
-		"?RowsAffected\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
-		"?InsertId\x00\x03\x00\x00\x00\x00\x00\x00\x00" +
-		"\x04Rows\x00 \x00\x00\x00" +
-		"\x040\x00\x18\x00\x00\x00" +
-		"\x050\x00\x01\x00\x00\x00" +
-		"\x001\x051\x00\x02\x00\x00\x00\x00aa" +
-		"\x00\x00" +
-		"\x03Session\x00\xd0\x00\x00\x00" +
-		"\bInTransaction\x00\x01" +
-		"\x04ShardSessions\x00\xac\x00\x00\x00" +
-		"\x030\x00Q\x00\x00\x00" +
-		"\x05Keyspace\x00\x01\x00\x00\x00\x00a" +
-		"\x05Shard\x00\x01\x00\x00\x00\x000" +
-		"\x05TabletType\x00\a\x00\x00\x00\x00replica" +
-		"\x12TransactionId\x00\x01\x00\x00\x00\x00\x00\x00\x00" +
-		"\x00" +
-		"\x031\x00P\x00\x00\x00" +
-		"\x05Keyspace\x00\x01\x00\x00\x00\x00b" +
-		"\x05Shard\x00\x01\x00\x00\x00\x001" +
-		"\x05TabletType\x00\x06\x00\x00\x00\x00master" +
-		"\x12TransactionId\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
-		"\x00\x00\x00" +
-		"\x05Error\x00\x05\x00\x00\x00\x00error" +
-		"\x00"
+func TestStreamQueryShard(t *testing.T) {
+	// the fields StreamQueryShard shares with QueryShard are
+	// encoded the same way
+	reflected, err := bson.Marshal(&reflectQueryShard{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		Shards:        []string{"shard1", "shard2"},
+		TabletType:    topo.TabletType("replica"),
+		Session:       &commonSession,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
 
-	custom := QueryResult{
-		Fields:       []mproto.Field{{"name", 1}},
-		RowsAffected: 2,
-		InsertId:     3,
-		Rows: [][]sqltypes.Value{
-			{{sqltypes.String("1")}, {sqltypes.String("aa")}},
-		},
-		Session: &commonSession,
-		Error:   "error",
+	custom := StreamQueryShard{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		Shards:        []string{"shard1", "shard2"},
+		TabletType:    topo.TabletType("replica"),
+		Session:       &commonSession,
 	}
 	encoded, err := bson.Marshal(&custom)
 	if err != nil {
@@ -211,7 +232,7 @@ func TestQueryResult(t *testing.T) {
 		t.Errorf("want\n%#v, got\n%#v", want, got)
 	}
 
-	var unmarshalled QueryResult
+	var unmarshalled StreamQueryShard
 	err = bson.Unmarshal(encoded, &unmarshalled)
 	if err != nil {
 		t.Error(err)
@@ -219,65 +240,57 @@ func TestQueryResult(t *testing.T) {
 	if !reflect.DeepEqual(custom, unmarshalled) {
 		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
 	}
+
+	extra, err := bson.Marshal(&extraQueryShard{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
 }
 
-type reflectBoundQuery struct {
+type reflectKeyspaceIdQuery struct {
 	Sql           string
 	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	TabletType    topo.TabletType
+	Session       *Session
 }
 
-type reflectBatchQueryShard struct {
-	Queries    []reflectBoundQuery
-	Keyspace   string
-	Shards     []string
-	TabletType topo.TabletType
-	Session    *Session
-}
-
-type extraBatchQueryShard struct {
-	Extra      int
-	Queries    []reflectBoundQuery
-	Keyspace   string
-	Shards     []string
-	TabletType topo.TabletType
-	Session    *Session
+type extraKeyspaceIdQuery struct {
+	Extra         int
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	TabletType    topo.TabletType
+	Session       *Session
 }
 
-func TestBatchQueryShard(t *testing.T) {
-	reflected, err := bson.Marshal(&reflectBatchQueryShard{
-		Queries: []reflectBoundQuery{{
-			Sql:           "query",
-			BindVariables: map[string]interface{}{"val": int64(1)},
-		}},
-		Keyspace: "keyspace",
-		Shards:   []string{"shard1", "shard2"},
-		Session: &Session{InTransaction: true,
-			ShardSessions: []*ShardSession{{
-				Keyspace:      "a",
-				Shard:         "0",
-				TabletType:    topo.TabletType("replica"),
-				TransactionId: 1,
-			}, {
-				Keyspace:      "b",
-				Shard:         "1",
-				TabletType:    topo.TabletType("master"),
-				TransactionId: 2,
-			}},
-		},
+func TestKeyspaceIdQuery(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectKeyspaceIdQuery{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyspaceIds:   []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:    topo.TabletType("replica"),
+		Session:       &commonSession,
 	})
 	if err != nil {
 		t.Error(err)
 	}
 	want := string(reflected)
 
-	custom := BatchQueryShard{
-		Queries: []tproto.BoundQuery{{
-			Sql:           "query",
-			BindVariables: map[string]interface{}{"val": int64(1)},
-		}},
-		Keyspace: "keyspace",
-		Shards:   []string{"shard1", "shard2"},
-		Session:  &commonSession,
+	custom := KeyspaceIdQuery{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyspaceIds:   []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:    topo.TabletType("replica"),
+		Session:       &commonSession,
 	}
 	encoded, err := bson.Marshal(&custom)
 	if err != nil {
@@ -288,7 +301,7 @@ func TestBatchQueryShard(t *testing.T) {
 		t.Errorf("want\n%#v, got\n%#v", want, got)
 	}
 
-	var unmarshalled BatchQueryShard
+	var unmarshalled KeyspaceIdQuery
 	err = bson.Unmarshal(encoded, &unmarshalled)
 	if err != nil {
 		t.Error(err)
@@ -297,7 +310,7 @@ func TestBatchQueryShard(t *testing.T) {
 		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
 	}
 
-	extra, err := bson.Marshal(&extraBatchQueryShard{})
+	extra, err := bson.Marshal(&extraKeyspaceIdQuery{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -307,69 +320,46 @@ func TestBatchQueryShard(t *testing.T) {
 	}
 }
 
-type badTypeBatchQueryShard struct {
-	Queries    string
-	Keyspace   string
-	Shards     []string
-	TabletType topo.TabletType
-	Session    *Session
-}
-
-func TestBatchQueryShardBadType(t *testing.T) {
-	unexpected, err := bson.Marshal(&badTypeBatchQueryShard{})
-	if err != nil {
-		t.Error(err)
-	}
-	var unmarshalled BatchQueryShard
-	err = bson.Unmarshal(unexpected, &unmarshalled)
-	want := "Unexpected data type 5 for Queries"
-	if err == nil || want != err.Error() {
-		t.Errorf("want %v, got %v", want, err)
-	}
-}
-
-type reflectQueryResultList struct {
-	List    []mproto.QueryResult
-	Session *Session
-	Error   string
+type reflectStreamQueryKeyspaceIds struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	TabletType    topo.TabletType
+	Session       *Session
 }
 
-type extraQueryResultList struct {
-	Extra   int
-	List    []mproto.QueryResult
-	Session *Session
-	Error   string
+type extraStreamQueryKeyspaceIds struct {
+	Extra         int
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyspaceIds   []key.KeyspaceId
+	TabletType    topo.TabletType
+	Session       *Session
 }
 
-func TestQueryResultList(t *testing.T) {
-	reflected, err := bson.Marshal(&reflectQueryResultList{
-		List: []mproto.QueryResult{{
-			Fields:       []mproto.Field{{"name", 1}},
-			RowsAffected: 2,
-			InsertId:     3,
-			Rows: [][]sqltypes.Value{
-				{{sqltypes.String("1")}, {sqltypes.String("aa")}},
-			},
-		}},
-		Session: &commonSession,
-		Error:   "error",
+func TestStreamQueryKeyspaceIds(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectStreamQueryKeyspaceIds{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyspaceIds:   []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:    topo.TabletType("rdonly"),
+		Session:       &commonSession,
 	})
 	if err != nil {
 		t.Error(err)
 	}
 	want := string(reflected)
 
-	custom := QueryResultList{
-		List: []mproto.QueryResult{{
-			Fields:       []mproto.Field{{"name", 1}},
-			RowsAffected: 2,
-			InsertId:     3,
-			Rows: [][]sqltypes.Value{
-				{{sqltypes.String("1")}, {sqltypes.String("aa")}},
-			},
-		}},
-		Session: &commonSession,
-		Error:   "error",
+	custom := StreamQueryKeyspaceIds{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyspaceIds:   []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:    topo.TabletType("rdonly"),
+		Session:       &commonSession,
 	}
 	encoded, err := bson.Marshal(&custom)
 	if err != nil {
@@ -380,7 +370,7 @@ func TestQueryResultList(t *testing.T) {
 		t.Errorf("want\n%#v, got\n%#v", want, got)
 	}
 
-	var unmarshalled QueryResultList
+	var unmarshalled StreamQueryKeyspaceIds
 	err = bson.Unmarshal(encoded, &unmarshalled)
 	if err != nil {
 		t.Error(err)
@@ -389,7 +379,7 @@ func TestQueryResultList(t *testing.T) {
 		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
 	}
 
-	extra, err := bson.Marshal(&extraQueryResultList{})
+	extra, err := bson.Marshal(&extraStreamQueryKeyspaceIds{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -399,7 +389,7 @@ func TestQueryResultList(t *testing.T) {
 	}
 }
 
-type reflectStreamQueryKeyRange struct {
+type reflectKeyRangeQuery struct {
 	Sql           string
 	BindVariables map[string]interface{}
 	Keyspace      string
@@ -408,7 +398,7 @@ type reflectStreamQueryKeyRange struct {
 	Session       *Session
 }
 
-type extraStreamQueryKeyRange struct {
+type extraKeyRangeQuery struct {
 	Extra         int
 	Sql           string
 	BindVariables map[string]interface{}
@@ -418,27 +408,26 @@ type extraStreamQueryKeyRange struct {
 	Session       *Session
 }
 
-func TestStreamQueryKeyRange(t *testing.T) {
-	reflected, err := bson.Marshal(&reflectStreamQueryKeyRange{
+func TestKeyRangeQuery(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectKeyRangeQuery{
 		Sql:           "query",
 		BindVariables: map[string]interface{}{"val": int64(1)},
 		Keyspace:      "keyspace",
 		KeyRange:      "10-18",
-		TabletType:    "replica",
+		TabletType:    topo.TabletType("replica"),
 		Session:       &commonSession,
 	})
-
 	if err != nil {
 		t.Error(err)
 	}
 	want := string(reflected)
 
-	custom := StreamQueryKeyRange{
+	custom := KeyRangeQuery{
 		Sql:           "query",
 		BindVariables: map[string]interface{}{"val": int64(1)},
 		Keyspace:      "keyspace",
 		KeyRange:      "10-18",
-		TabletType:    "replica",
+		TabletType:    topo.TabletType("replica"),
 		Session:       &commonSession,
 	}
 	encoded, err := bson.Marshal(&custom)
@@ -450,7 +439,7 @@ func TestStreamQueryKeyRange(t *testing.T) {
 		t.Errorf("want\n%#v, got\n%#v", want, got)
 	}
 
-	var unmarshalled StreamQueryKeyRange
+	var unmarshalled KeyRangeQuery
 	err = bson.Unmarshal(encoded, &unmarshalled)
 	if err != nil {
 		t.Error(err)
@@ -459,7 +448,7 @@ func TestStreamQueryKeyRange(t *testing.T) {
 		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
 	}
 
-	extra, err := bson.Marshal(&extraStreamQueryKeyRange{})
+	extra, err := bson.Marshal(&extraKeyRangeQuery{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -468,3 +457,1277 @@ func TestStreamQueryKeyRange(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+type reflectEntityId struct {
+	ExternalId interface{}
+	KeyspaceId key.KeyspaceId
+}
+
+type reflectEntityIdsQuery struct {
+	Sql               string
+	BindVariables     map[string]interface{}
+	Keyspace          string
+	EntityColumnName  string
+	EntityKeyspaceIds []reflectEntityId
+	TabletType        topo.TabletType
+	Session           *Session
+}
+
+type extraEntityIdsQuery struct {
+	Extra             int
+	Sql               string
+	BindVariables     map[string]interface{}
+	Keyspace          string
+	EntityColumnName  string
+	EntityKeyspaceIds []reflectEntityId
+	TabletType        topo.TabletType
+	Session           *Session
+}
+
+func TestEntityIdsQuery(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectEntityIdsQuery{
+		Sql:              "query",
+		BindVariables:    map[string]interface{}{"val": int64(1)},
+		Keyspace:         "keyspace",
+		EntityColumnName: "user_id",
+		EntityKeyspaceIds: []reflectEntityId{
+			{ExternalId: int64(12), KeyspaceId: "\x10"},
+			{ExternalId: []byte("name"), KeyspaceId: "\x80"},
+		},
+		TabletType: topo.TabletType("replica"),
+		Session:    &commonSession,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := EntityIdsQuery{
+		Sql:              "query",
+		BindVariables:    map[string]interface{}{"val": int64(1)},
+		Keyspace:         "keyspace",
+		EntityColumnName: "user_id",
+		EntityKeyspaceIds: []EntityId{
+			{ExternalId: int64(12), KeyspaceId: "\x10"},
+			{ExternalId: []byte("name"), KeyspaceId: "\x80"},
+		},
+		TabletType: topo.TabletType("replica"),
+		Session:    &commonSession,
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled EntityIdsQuery
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	extra, err := bson.Marshal(&extraEntityIdsQuery{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryResult(t *testing.T) {
+	// We can't do the reflection test because bson
+	// doesn't do it correctly for embedded fields.
+	want := "\x82\x01\x00\x00" +
+		"\x04Fields\x00*\x00\x00\x00" +
+		"\x030\x00\"\x00\x00\x00" +
+		"\x05Name\x00\x04\x00\x00\x00\x00name" +
+		"\x12Type\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"?RowsAffected\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
+		"?InsertId\x00\x03\x00\x00\x00\x00\x00\x00\x00" +
+		"\x04Rows\x00 \x00\x00\x00" +
+		"\x040\x00\x18\x00\x00\x00" +
+		"\x050\x00\x01\x00\x00\x00" +
+		"\x001\x051\x00\x02\x00\x00\x00\x00aa" +
+		"\x00\x00" +
+		"\x03Session\x00\xd0\x00\x00\x00" +
+		"\bInTransaction\x00\x01" +
+		"\x04ShardSessions\x00\xac\x00\x00\x00" +
+		"\x030\x00Q\x00\x00\x00" +
+		"\x05Keyspace\x00\x01\x00\x00\x00\x00a" +
+		"\x05Shard\x00\x01\x00\x00\x00\x000" +
+		"\x05TabletType\x00\a\x00\x00\x00\x00replica" +
+		"\x12TransactionId\x00\x01\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00" +
+		"\x031\x00P\x00\x00\x00" +
+		"\x05Keyspace\x00\x01\x00\x00\x00\x00b" +
+		"\x05Shard\x00\x01\x00\x00\x00\x001" +
+		"\x05TabletType\x00\x06\x00\x00\x00\x00master" +
+		"\x12TransactionId\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00\x00\x00" +
+		"\x05Error\x00\x05\x00\x00\x00\x00error" +
+		"\x12ErrorCode\x00\x02\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00"
+
+	custom := QueryResult{
+		Fields:       []mproto.Field{{Name: "name", Type: 1}},
+		RowsAffected: 2,
+		InsertId:     3,
+		Rows: [][]sqltypes.Value{
+			{{sqltypes.String("1")}, {sqltypes.String("aa")}},
+		},
+		Session:   &commonSession,
+		Error:     "error",
+		ErrorCode: 2,
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled QueryResult
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+}
+
+type reflectRpcError struct {
+	Code    int
+	Message string
+}
+
+type extraRpcError struct {
+	Extra   int
+	Code    int
+	Message string
+}
+
+func TestQueryResultHugeRows(t *testing.T) {
+	encoded, err := bson.Marshal(&QueryResult{Rows: [][]sqltypes.Value{{sqltypes.MakeString([]byte("1"))}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the Rows array claims to be 2GB
+	index := bytes.Index(encoded, []byte("Rows\x00")) + 5
+	bson.Pack.PutUint32(encoded[index:], 1<<31)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = bson.Unmarshal(encoded, new(QueryResult))
+	runtime.ReadMemStats(&after)
+	want := "document of 2147483648 bytes is larger than the maximum of 67108864 bytes, in field Rows"
+	if err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%v bytes were allocated to reject the rows", allocated)
+	}
+
+	// a stream doesn't read a document that claims to be 2GB either
+	bson.Pack.PutUint32(encoded, 1<<31)
+	runtime.ReadMemStats(&before)
+	err = bson.UnmarshalFromStream(bytes.NewReader(encoded), new(QueryResult))
+	runtime.ReadMemStats(&after)
+	want = "document of 2147483648 bytes is larger than the maximum of 67108864 bytes"
+	if err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%v bytes were allocated to reject the document", allocated)
+	}
+}
+
+func TestQueryResultCompression(t *testing.T) {
+	rows := make([][]sqltypes.Value, 1000)
+	for i := range rows {
+		rows[i] = []sqltypes.Value{sqltypes.MakeString([]byte("a repetitive value")), sqltypes.NULL}
+	}
+	qr := QueryResult{
+		Fields:       []mproto.Field{{Name: "a", Type: mproto.VT_VAR_STRING}, {Name: "b", Type: mproto.VT_LONG}},
+		RowsAffected: 1000,
+		Rows:         rows,
+		Session:      &commonSession,
+		ShardLag:     map[string]int64{"ks/0": 1},
+	}
+	plain, err := bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// below CompressMinSize, the result is sent as it is
+	qr.CompressMinSize = len(plain) + 1
+	encoded, err := bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, plain) {
+		t.Errorf("got\n%q, want\n%q", encoded, plain)
+	}
+
+	qr.CompressMinSize = len(plain)
+	compressed, err := bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(compressed, []byte("\x05Snappy\x00")) || len(compressed) >= len(plain)/4 {
+		t.Errorf("the result of %v bytes is not compressed: %v bytes", len(plain), len(compressed))
+	}
+
+	want := qr
+	want.CompressMinSize = 0
+	for _, in := range [][]byte{plain, compressed} {
+		var got QueryResult
+		if err := bson.Unmarshal(in, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got\n%#v, want\n%#v", got, want)
+		}
+	}
+
+	// the compression of an embedded result
+	embedded, err := bson.Marshal(&struct{ Result *QueryResult }{&qr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotEmbedded struct{ Result *QueryResult }
+	if err := bson.Unmarshal(embedded, &gotEmbedded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotEmbedded.Result, &want) {
+		t.Errorf("got\n%#v, want\n%#v", gotEmbedded.Result, &want)
+	}
+
+	// the compressed results that are too large are rejected
+	saved := bson.MaxDocumentSize
+	bson.MaxDocumentSize = len(plain) - 1
+	defer func() { bson.MaxDocumentSize = saved }()
+	err = bson.Unmarshal(compressed, new(QueryResult))
+	if err == nil || !strings.Contains(err.Error(), "is larger than the maximum") {
+		t.Errorf("want a too large error, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	requests := []interface{}{
+		&QueryShard{Sql: "query", BindVariables: map[string]interface{}{}, Compression: COMPRESSION_SNAPPY},
+		&StreamQueryShard{Sql: "query", BindVariables: map[string]interface{}{}, Compression: COMPRESSION_SNAPPY},
+		&StreamQueryKeyRange{Sql: "query", BindVariables: map[string]interface{}{}, Compression: COMPRESSION_SNAPPY},
+	}
+	for _, request := range requests {
+		encoded, err := bson.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reflect.New(reflect.TypeOf(request).Elem()).Interface()
+		if err := bson.Unmarshal(encoded, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, request) {
+			t.Errorf("got %#v, want %#v", got, request)
+		}
+	}
+}
+
+func TestRpcError(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectRpcError{
+		Code:    ERR_INTEGRITY_ERROR,
+		Message: "duplicate entry",
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := RpcError{
+		Code:    ERR_INTEGRITY_ERROR,
+		Message: "duplicate entry",
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled RpcError
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	extra, err := bson.Marshal(&extraRpcError{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// oldClientResult is how the clients that predate RpcError decode
+// QueryResult and QueryResultList errors.
+type oldClientResult struct {
+	Error     string
+	ErrorCode int
+}
+
+// newClientResult is how the clients that only use RpcError decode
+// them.
+type newClientResult struct {
+	Err *reflectRpcError
+}
+
+func TestRpcErrorCompatibility(t *testing.T) {
+	rpcErr := &RpcError{Code: ERR_TX_POOL_FULL, Message: "tx_pool_full: err"}
+	for _, result := range []interface{}{
+		&QueryResult{Error: "tx_pool_full: err", ErrorCode: 3, Err: rpcErr},
+		&QueryResultList{Error: "tx_pool_full: err", ErrorCode: 3, Err: rpcErr},
+	} {
+		encoded, err := bson.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var old oldClientResult
+		if err := bson.Unmarshal(encoded, &old); err != nil {
+			t.Errorf("old client: %v", err)
+		}
+		if want := (oldClientResult{Error: "tx_pool_full: err", ErrorCode: 3}); old != want {
+			t.Errorf("old client: want %#v, got %#v", want, old)
+		}
+		var current newClientResult
+		if err := bson.Unmarshal(encoded, &current); err != nil {
+			t.Errorf("new client: %v", err)
+		}
+		if current.Err == nil || current.Err.Code != ERR_TX_POOL_FULL || current.Err.Message != "tx_pool_full: err" {
+			t.Errorf("new client: want %#v, got %#v", rpcErr, current.Err)
+		}
+	}
+
+	// the results of old servers have no RpcError
+	encoded, err := bson.Marshal(&oldClientResult{Error: "error", ErrorCode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qr QueryResult
+	if err := bson.Unmarshal(encoded, &qr); err != nil {
+		t.Fatal(err)
+	}
+	if qr.Error != "error" || qr.ErrorCode != 2 || qr.Err != nil {
+		t.Errorf("want the legacy error only, got %#v", qr)
+	}
+	var qrl QueryResultList
+	if err := bson.Unmarshal(encoded, &qrl); err != nil {
+		t.Fatal(err)
+	}
+	if qrl.Error != "error" || qrl.ErrorCode != 2 || qrl.Err != nil {
+		t.Errorf("want the legacy error only, got %#v", qrl)
+	}
+}
+
+type reflectBoundQuery struct {
+	Sql           string
+	BindVariables map[string]interface{}
+}
+
+type reflectBatchQueryShard struct {
+	Queries    []reflectBoundQuery
+	Keyspace   string
+	Shards     []string
+	TabletType topo.TabletType
+	Session    *Session
+}
+
+type extraBatchQueryShard struct {
+	Extra      int
+	Queries    []reflectBoundQuery
+	Keyspace   string
+	Shards     []string
+	TabletType topo.TabletType
+	Session    *Session
+}
+
+func TestBatchQueryShard(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectBatchQueryShard{
+		Queries: []reflectBoundQuery{{
+			Sql:           "query",
+			BindVariables: map[string]interface{}{"val": int64(1)},
+		}},
+		Keyspace: "keyspace",
+		Shards:   []string{"shard1", "shard2"},
+		Session: &Session{InTransaction: true,
+			ShardSessions: []*ShardSession{{
+				Keyspace:      "a",
+				Shard:         "0",
+				TabletType:    topo.TabletType("replica"),
+				TransactionId: 1,
+			}, {
+				Keyspace:      "b",
+				Shard:         "1",
+				TabletType:    topo.TabletType("master"),
+				TransactionId: 2,
+			}},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := BatchQueryShard{
+		Queries: []tproto.BoundQuery{{
+			Sql:           "query",
+			BindVariables: map[string]interface{}{"val": int64(1)},
+		}},
+		Keyspace: "keyspace",
+		Shards:   []string{"shard1", "shard2"},
+		Session:  &commonSession,
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled BatchQueryShard
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	extra, err := bson.Marshal(&extraBatchQueryShard{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type reflectKeyspaceIdBatchQuery struct {
+	Queries     []reflectBoundQuery
+	Keyspace    string
+	KeyspaceIds []key.KeyspaceId
+	TabletType  topo.TabletType
+	Session     *Session
+}
+
+type extraKeyspaceIdBatchQuery struct {
+	Extra       int
+	Queries     []reflectBoundQuery
+	Keyspace    string
+	KeyspaceIds []key.KeyspaceId
+	TabletType  topo.TabletType
+	Session     *Session
+}
+
+func TestKeyspaceIdBatchQuery(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectKeyspaceIdBatchQuery{
+		Queries: []reflectBoundQuery{{
+			Sql:           "query",
+			BindVariables: map[string]interface{}{"val": int64(1)},
+		}},
+		Keyspace:    "keyspace",
+		KeyspaceIds: []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:  topo.TabletType("master"),
+		Session:     &commonSession,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := KeyspaceIdBatchQuery{
+		Queries: []tproto.BoundQuery{{
+			Sql:           "query",
+			BindVariables: map[string]interface{}{"val": int64(1)},
+		}},
+		Keyspace:    "keyspace",
+		KeyspaceIds: []key.KeyspaceId{"\x10\x00", "\x80\xff"},
+		TabletType:  topo.TabletType("master"),
+		Session:     &commonSession,
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled KeyspaceIdBatchQuery
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	// unknown fields are skipped
+	extra, err := bson.Marshal(&extraKeyspaceIdBatchQuery{
+		Extra:       12,
+		Keyspace:    "keyspace",
+		KeyspaceIds: []key.KeyspaceId{"\x10\x00"},
+		TabletType:  topo.TabletType("master"),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	var unmarshalledExtra KeyspaceIdBatchQuery
+	err = bson.Unmarshal(extra, &unmarshalledExtra)
+	if err != nil {
+		t.Error(err)
+	}
+	wantExtra := KeyspaceIdBatchQuery{
+		Keyspace:    "keyspace",
+		KeyspaceIds: []key.KeyspaceId{"\x10\x00"},
+		TabletType:  topo.TabletType("master"),
+	}
+	if !reflect.DeepEqual(wantExtra, unmarshalledExtra) {
+		t.Errorf("want \n%#v, got \n%#v", wantExtra, unmarshalledExtra)
+	}
+}
+
+type badTypeBatchQueryShard struct {
+	Queries    string
+	Keyspace   string
+	Shards     []string
+	TabletType topo.TabletType
+	Session    *Session
+}
+
+func TestBatchQueryShardBadType(t *testing.T) {
+	unexpected, err := bson.Marshal(&badTypeBatchQueryShard{})
+	if err != nil {
+		t.Error(err)
+	}
+	var unmarshalled BatchQueryShard
+	err = bson.Unmarshal(unexpected, &unmarshalled)
+	want := "Unexpected data type 5 for Queries, in field Queries at offset 13"
+	if err == nil || want != err.Error() {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+type reflectQueryResultList struct {
+	List    []mproto.QueryResult
+	Session *Session
+	Error   string
+}
+
+type extraQueryResultList struct {
+	Extra   int
+	List    []mproto.QueryResult
+	Session *Session
+	Error   string
+}
+
+func TestQueryResultList(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectQueryResultList{
+		List: []mproto.QueryResult{{
+			Fields:       []mproto.Field{{Name: "name", Type: 1}},
+			RowsAffected: 2,
+			InsertId:     3,
+			Rows: [][]sqltypes.Value{
+				{{sqltypes.String("1")}, {sqltypes.String("aa")}},
+			},
+		}},
+		Session: &commonSession,
+		Error:   "error",
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := QueryResultList{
+		List: []mproto.QueryResult{{
+			Fields:       []mproto.Field{{Name: "name", Type: 1}},
+			RowsAffected: 2,
+			InsertId:     3,
+			Rows: [][]sqltypes.Value{
+				{{sqltypes.String("1")}, {sqltypes.String("aa")}},
+			},
+		}},
+		Session: &commonSession,
+		Error:   "error",
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled QueryResultList
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	extra, err := bson.Marshal(&extraQueryResultList{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type reflectShardErrorsResultList struct {
+	List        []mproto.QueryResult
+	Error       string
+	ShardErrors []ShardError
+}
+
+func TestQueryResultListShardErrors(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectShardErrorsResultList{
+		List: []mproto.QueryResult{{
+			Fields:       []mproto.Field{},
+			RowsAffected: 1,
+			Rows:         [][]sqltypes.Value{},
+		}},
+		Error: "shard 1: error: err",
+		ShardErrors: []ShardError{
+			{Keyspace: "ks", Shard: "1", Error: "error: err"},
+			{Keyspace: "ks", Shard: "2", Error: "fatal: err"},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := QueryResultList{
+		List: []mproto.QueryResult{{
+			Fields:       []mproto.Field{},
+			RowsAffected: 1,
+			Rows:         [][]sqltypes.Value{},
+		}},
+		Error: "shard 1: error: err",
+		ShardErrors: []ShardError{
+			{Keyspace: "ks", Shard: "1", Error: "error: err"},
+			{Keyspace: "ks", Shard: "2", Error: "fatal: err"},
+		},
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled QueryResultList
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	// old clients still see the error
+	var old oldClientResult
+	if err := bson.Unmarshal(encoded, &old); err != nil {
+		t.Error(err)
+	}
+	if old.Error != custom.Error {
+		t.Errorf("want %v, got %v", custom.Error, old.Error)
+	}
+}
+
+type reflectStreamQueryKeyRange struct {
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyRange      string
+	TabletType    topo.TabletType
+	Session       *Session
+}
+
+type extraStreamQueryKeyRange struct {
+	Extra         int
+	Sql           string
+	BindVariables map[string]interface{}
+	Keyspace      string
+	KeyRange      string
+	TabletType    topo.TabletType
+	Session       *Session
+}
+
+func TestStreamQueryKeyRange(t *testing.T) {
+	reflected, err := bson.Marshal(&reflectStreamQueryKeyRange{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyRange:      "10-18",
+		TabletType:    "replica",
+		Session:       &commonSession,
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+	want := string(reflected)
+
+	custom := StreamQueryKeyRange{
+		Sql:           "query",
+		BindVariables: map[string]interface{}{"val": int64(1)},
+		Keyspace:      "keyspace",
+		KeyRange:      "10-18",
+		TabletType:    "replica",
+		Session:       &commonSession,
+	}
+	encoded, err := bson.Marshal(&custom)
+	if err != nil {
+		t.Error(err)
+	}
+	got := string(encoded)
+	if want != got {
+		t.Errorf("want\n%#v, got\n%#v", want, got)
+	}
+
+	var unmarshalled StreamQueryKeyRange
+	err = bson.Unmarshal(encoded, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(custom, unmarshalled) {
+		t.Errorf("want \n%#v, got \n%#v", custom, unmarshalled)
+	}
+
+	extra, err := bson.Marshal(&extraStreamQueryKeyRange{})
+	if err != nil {
+		t.Error(err)
+	}
+	err = bson.Unmarshal(extra, &unmarshalled)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPopulateQueryResult(t *testing.T) {
+	in := &mproto.QueryResult{
+		Fields:       []mproto.Field{{Name: "id", Type: 3}, {Name: "name", Type: 253}},
+		RowsAffected: 1,
+		InsertId:     2,
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeNumeric([]byte("1")),
+			sqltypes.MakeString([]byte("foo")),
+		}, {
+			sqltypes.MakeFractional([]byte("1.5")),
+			{},
+		}},
+	}
+	want := &QueryResult{
+		Fields:       []mproto.Field{{Name: "id", Type: 3}, {Name: "name", Type: 253}},
+		RowsAffected: 1,
+		InsertId:     2,
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeNumeric([]byte("1")),
+			sqltypes.MakeString([]byte("foo")),
+		}, {
+			sqltypes.MakeFractional([]byte("1.5")),
+			{},
+		}},
+	}
+	out := new(QueryResult)
+	PopulateQueryResult(in, out)
+	wantList := CopyQueryResult(in)
+
+	// reuse the buffers of in, out must not change
+	in.Fields[0].Name = "changed"
+	in.Rows[0][0].Inner.(sqltypes.Numeric)[0] = '9'
+	in.Rows[0][1].Inner.(sqltypes.String)[0] = 'g'
+	in.Rows[1][0] = sqltypes.MakeString([]byte("bar"))
+	if !reflect.DeepEqual(want, out) {
+		t.Errorf("want \n%#v, got \n%#v", want, out)
+	}
+	if !reflect.DeepEqual(want.Rows, wantList.Rows) || !reflect.DeepEqual(want.Fields, wantList.Fields) {
+		t.Errorf("CopyQueryResult: want \n%#v, got \n%#v", want, wantList)
+	}
+}
+
+func TestShardLag(t *testing.T) {
+	qs := QueryShard{
+		Sql:        "query",
+		Shards:     []string{"-80", "80-"},
+		TabletType: topo.TYPE_RDONLY,
+		IncludeLag: true,
+	}
+	encoded, err := bson.Marshal(&qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledQuery QueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledQuery); err != nil {
+		t.Fatal(err)
+	}
+	if !unmarshalledQuery.IncludeLag {
+		t.Errorf("IncludeLag was not unmarshalled: %#v", unmarshalledQuery)
+	}
+
+	qr := QueryResult{
+		RowsAffected: 1,
+		ShardLag:     map[string]int64{"-80": 12, "80-": -1},
+	}
+	encoded, err = bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled QueryResult
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalled.RowsAffected != 1 || !reflect.DeepEqual(qr.ShardLag, unmarshalled.ShardLag) {
+		t.Errorf("want \n%#v, got \n%#v", qr, unmarshalled)
+	}
+
+	// ShardLag is only encoded when set
+	encoded, err = bson.Marshal(&QueryResult{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, []byte("ShardLag")) {
+		t.Errorf("unexpected ShardLag in %q", encoded)
+	}
+}
+
+func TestQueryResultPartial(t *testing.T) {
+	encoded, err := bson.Marshal(&QueryResult{Partial: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled QueryResult
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if !unmarshalled.Partial {
+		t.Errorf("Partial was not unmarshalled: %#v", unmarshalled)
+	}
+
+	// Partial is only encoded when set
+	encoded, err = bson.Marshal(&QueryResult{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, []byte("Partial")) {
+		t.Errorf("unexpected Partial in %q", encoded)
+	}
+}
+
+func TestQueryResultPackedRows(t *testing.T) {
+	qr := QueryResult{
+		Fields:       []mproto.Field{{Name: "id", Type: 3}},
+		RowsAffected: 2,
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeString([]byte("1"))},
+			{{}},
+		},
+		PackRows: true,
+	}
+	packed, err := bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(packed, []byte("PackedRows")) {
+		t.Errorf("PackedRows not used: %q", packed)
+	}
+	qr.PackRows = false
+	unpacked, err := bson.Marshal(&qr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clients decode both encodings the same way
+	for _, encoded := range [][]byte{packed, unpacked} {
+		var got QueryResult
+		if err := bson.Unmarshal(encoded, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(qr, got) {
+			t.Errorf("want \n%#v, got \n%#v", qr, got)
+		}
+	}
+}
+
+func TestMaxShardSessions(t *testing.T) {
+	qs := QueryShard{
+		Sql:              "query",
+		Shards:           []string{"0"},
+		Session:          &Session{InTransaction: true},
+		MaxShardSessions: 4,
+	}
+	encoded, err := bson.Marshal(&qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledQuery QueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledQuery); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledQuery.MaxShardSessions != 4 {
+		t.Errorf("MaxShardSessions was not unmarshalled: %#v", unmarshalledQuery)
+	}
+
+	bqs := BatchQueryShard{
+		Shards:           []string{"0"},
+		Session:          &Session{InTransaction: true},
+		MaxShardSessions: 2,
+	}
+	encoded, err = bson.Marshal(&bqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledBatch BatchQueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledBatch); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledBatch.MaxShardSessions != 2 {
+		t.Errorf("MaxShardSessions was not unmarshalled: %#v", unmarshalledBatch)
+	}
+}
+
+func TestWorkload(t *testing.T) {
+	qs := QueryShard{Sql: "query", Workload: WORKLOAD_OLAP}
+	encoded, err := bson.Marshal(&qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledQuery QueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledQuery); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledQuery.Workload != WORKLOAD_OLAP {
+		t.Errorf("Workload was not unmarshalled: %#v", unmarshalledQuery)
+	}
+
+	bqs := BatchQueryShard{Workload: WORKLOAD_OLAP}
+	encoded, err = bson.Marshal(&bqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledBatch BatchQueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledBatch); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledBatch.Workload != WORKLOAD_OLAP {
+		t.Errorf("Workload was not unmarshalled: %#v", unmarshalledBatch)
+	}
+
+	sqs := StreamQueryKeyRange{Sql: "query", Workload: WORKLOAD_OLAP}
+	encoded, err = bson.Marshal(&sqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledStream StreamQueryKeyRange
+	if err := bson.Unmarshal(encoded, &unmarshalledStream); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledStream.Workload != WORKLOAD_OLAP {
+		t.Errorf("Workload was not unmarshalled: %#v", unmarshalledStream)
+	}
+}
+
+func TestNotInTransaction(t *testing.T) {
+	session := &commonSession
+	bindVars := map[string]interface{}{"val": int64(1)}
+	queries := []interface{}{
+		&QueryShard{Sql: "query", BindVariables: bindVars, Session: session, NotInTransaction: true},
+		&KeyspaceIdQuery{Sql: "query", BindVariables: bindVars, Session: session, NotInTransaction: true},
+		&KeyRangeQuery{Sql: "query", BindVariables: bindVars, Session: session, NotInTransaction: true},
+	}
+	unmarshalled := []interface{}{
+		new(QueryShard),
+		new(KeyspaceIdQuery),
+		new(KeyRangeQuery),
+	}
+	for i, query := range queries {
+		encoded, err := bson.Marshal(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bson.Unmarshal(encoded, unmarshalled[i]); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(query, unmarshalled[i]) {
+			t.Errorf("want \n%#v, got \n%#v", query, unmarshalled[i])
+		}
+	}
+}
+
+func TestCallerID(t *testing.T) {
+	callerID := &CallerID{
+		Principal:    "user",
+		Component:    "app",
+		Subcomponent: "report",
+	}
+	bindVars := map[string]interface{}{"val": int64(1)}
+	batch := []tproto.BoundQuery{{Sql: "query", BindVariables: bindVars}}
+	queries := []interface{}{
+		&QueryShard{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&StreamQueryShard{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&KeyspaceIdQuery{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&KeyRangeQuery{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&EntityIdsQuery{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&StreamQueryKeyRange{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&StreamQueryKeyspaceIds{Sql: "query", BindVariables: bindVars, CallerID: callerID},
+		&BatchQueryShard{Queries: batch, CallerID: callerID},
+		&KeyspaceIdBatchQuery{Queries: batch, CallerID: callerID},
+	}
+	unmarshalled := []interface{}{
+		new(QueryShard),
+		new(StreamQueryShard),
+		new(KeyspaceIdQuery),
+		new(KeyRangeQuery),
+		new(EntityIdsQuery),
+		new(StreamQueryKeyRange),
+		new(StreamQueryKeyspaceIds),
+		new(BatchQueryShard),
+		new(KeyspaceIdBatchQuery),
+	}
+	for i, query := range queries {
+		encoded, err := bson.Marshal(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bson.Unmarshal(encoded, unmarshalled[i]); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(query, unmarshalled[i]) {
+			t.Errorf("want \n%#v, got \n%#v", query, unmarshalled[i])
+		}
+	}
+
+	// Servers that predate CallerID skip it.
+	encoded, err := bson.Marshal(queries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old reflectQueryShard
+	if err := bson.Unmarshal(encoded, &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.Sql != "query" {
+		t.Errorf("want query, got %#v", old)
+	}
+}
+
+func TestDeadlineMs(t *testing.T) {
+	bindVars := map[string]interface{}{"val": int64(1)}
+	batch := []tproto.BoundQuery{{Sql: "query", BindVariables: bindVars}}
+	queries := []interface{}{
+		&QueryShard{Sql: "query", BindVariables: bindVars, DeadlineMs: 1500},
+		&BatchQueryShard{Queries: batch, DeadlineMs: 1500},
+		&StreamQueryShard{Sql: "query", BindVariables: bindVars, DeadlineMs: 1500},
+		&StreamQueryKeyRange{Sql: "query", BindVariables: bindVars, DeadlineMs: 1500},
+		&StreamQueryKeyspaceIds{Sql: "query", BindVariables: bindVars, DeadlineMs: 1500},
+	}
+	unmarshalled := []interface{}{
+		new(QueryShard),
+		new(BatchQueryShard),
+		new(StreamQueryShard),
+		new(StreamQueryKeyRange),
+		new(StreamQueryKeyspaceIds),
+	}
+	for i, query := range queries {
+		encoded, err := bson.Marshal(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bson.Unmarshal(encoded, unmarshalled[i]); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(query, unmarshalled[i]) {
+			t.Errorf("want \n%#v, got \n%#v", query, unmarshalled[i])
+		}
+	}
+}
+
+func TestMaxRowsPerSecond(t *testing.T) {
+	qs := StreamQueryShard{Sql: "query", MaxRowsPerSecond: 1000}
+	encoded, err := bson.Marshal(&qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledQuery StreamQueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalledQuery); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledQuery.MaxRowsPerSecond != 1000 {
+		t.Errorf("MaxRowsPerSecond was not unmarshalled: %#v", unmarshalledQuery)
+	}
+
+	sqs := StreamQueryKeyRange{Sql: "query", MaxRowsPerSecond: 1000}
+	encoded, err = bson.Marshal(&sqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledStream StreamQueryKeyRange
+	if err := bson.Unmarshal(encoded, &unmarshalledStream); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledStream.MaxRowsPerSecond != 1000 {
+		t.Errorf("MaxRowsPerSecond was not unmarshalled: %#v", unmarshalledStream)
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	qs := QueryShard{Sql: "query", MaxRows: 1000}
+	encoded, err := bson.Marshal(&qs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled QueryShard
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalled.MaxRows != 1000 {
+		t.Errorf("MaxRows was not unmarshalled: %#v", unmarshalled)
+	}
+}
+
+func TestKeyRanges(t *testing.T) {
+	sqs := StreamQueryKeyRange{Sql: "query", KeyRanges: []string{"10-18", "18-28"}}
+	encoded, err := bson.Marshal(&sqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled StreamQueryKeyRange
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unmarshalled.KeyRanges, sqs.KeyRanges) {
+		t.Errorf("want %v, got %v", sqs.KeyRanges, unmarshalled.KeyRanges)
+	}
+	if got := unmarshalled.AllKeyRanges(); !reflect.DeepEqual(got, sqs.KeyRanges) {
+		t.Errorf("want %v, got %v", sqs.KeyRanges, got)
+	}
+
+	// the clients that only know of KeyRange send a single key range
+	sqs = StreamQueryKeyRange{Sql: "query", KeyRange: "10-18"}
+	encoded, err = bson.Marshal(&sqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshalled = StreamQueryKeyRange{}
+	if err := bson.Unmarshal(encoded, &unmarshalled); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalled.KeyRanges != nil {
+		t.Errorf("want no KeyRanges, got %v", unmarshalled.KeyRanges)
+	}
+	if got, want := unmarshalled.AllKeyRanges(), []string{"10-18"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// stringElements is a []string marshaled with String elements, like
+// some clients do, instead of the Binary elements of
+// bson.EncodeStringArray.
+type stringElements []string
+
+func (se stringElements) MarshalBson(buf *bytes2.ChunkedWriter, key string) {
+	bson.EncodePrefix(buf, bson.Array, key)
+	lenWriter := bson.NewLenWriter(buf)
+	for i, val := range se {
+		bson.EncodePrefix(buf, bson.String, bson.Itoa(i))
+		// the length of a String counts its final 0
+		binary.LittleEndian.PutUint32(buf.Reserve(4), uint32(len(val)+1))
+		buf.WriteString(val)
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0)
+	lenWriter.RecordLen()
+}
+
+func TestStringElements(t *testing.T) {
+	encoded, err := bson.Marshal(&struct {
+		Sql       string
+		Shards    stringElements
+		KeyRanges stringElements
+	}{"query", stringElements{"-80", "80-"}, stringElements{"10-18"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qrs QueryShard
+	if err := bson.Unmarshal(encoded, &qrs); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-80", "80-"}; !reflect.DeepEqual(qrs.Shards, want) {
+		t.Errorf("want %v, got %v", want, qrs.Shards)
+	}
+	var sqs StreamQueryKeyRange
+	if err := bson.Unmarshal(encoded, &sqs); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10-18"}; !reflect.DeepEqual(sqs.KeyRanges, want) {
+		t.Errorf("want %v, got %v", want, sqs.KeyRanges)
+	}
+}
+
+func TestRollbackOldTransactions(t *testing.T) {
+	req := RollbackOldTransactionsRequest{MinAgeSeconds: 600}
+	encoded, err := bson.Marshal(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledReq RollbackOldTransactionsRequest
+	if err := bson.Unmarshal(encoded, &unmarshalledReq); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledReq != req {
+		t.Errorf("want %#v, got %#v", req, unmarshalledReq)
+	}
+
+	reply := RollbackOldTransactionsReply{RolledBack: 3}
+	encoded, err = bson.Marshal(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalledReply RollbackOldTransactionsReply
+	if err := bson.Unmarshal(encoded, &unmarshalledReply); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshalledReply != reply {
+		t.Errorf("want %#v, got %#v", reply, unmarshalledReply)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/streamlog"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// QueryLogger streams the Execute, ExecuteBatch and StreamExecute
+// requests of vtgate to the subscribers of /debug/querylog, as
+// QueryLogEntries. It never blocks the requests: the entries that
+// don't fit in its buffer, or in the one of a subscriber, are dropped
+// and counted in StreamlogDroppedMessages.
+var QueryLogger = streamlog.New("VTGateQuery", 50)
+
+var queryLogRedactBindValues = flag.Bool("querylog_redact_bind_values", false, "replace the values of the bind variables by nil in the query log, see /debug/querylog")
+
+// QueryLogEntry is a request of the query log. It is formatted as a
+// line of tab separated fields, or of JSON with the format=json
+// parameter.
+type QueryLogEntry struct {
+	Method string
+	// Caller is the CallerID of the request, or the remote address
+	// of its client if it has none.
+	Caller     string
+	StartTime  time.Time
+	EndTime    time.Time
+	Keyspace   string
+	TabletType topo.TabletType
+	// Queries has a query, or the ones of the batch. The values of
+	// their bind variables are nil with -querylog_redact_bind_values.
+	Queries []tproto.BoundQuery
+	// Rows is the number of rows returned, or affected.
+	Rows  int
+	Error string
+	// Shards are the calls to the shards, in the order they
+	// finished. They are protected by mu while the request runs.
+	Shards []QueryLogShard
+
+	mu sync.Mutex
+}
+
+// QueryLogShard is the call to a shard of a QueryLogEntry. Its Time
+// includes the retries.
+type QueryLogShard struct {
+	Keyspace string
+	Shard    string
+	Time     time.Duration
+	Error    string
+}
+
+// newQueryLogEntry starts the entry of a request.
+func newQueryLogEntry(context interface{}, method, keyspace string, tabletType topo.TabletType, queries ...tproto.BoundQuery) *QueryLogEntry {
+	if *queryLogRedactBindValues {
+		redacted := make([]tproto.BoundQuery, len(queries))
+		for i, query := range queries {
+			redacted[i] = tproto.BoundQuery{Sql: query.Sql, BindVariables: scrubBindVariables(query.BindVariables)}
+		}
+		queries = redacted
+	}
+	return &QueryLogEntry{
+		Method:     method,
+		Caller:     queryLogCaller(context),
+		StartTime:  time.Now(),
+		Keyspace:   keyspace,
+		TabletType: tabletType,
+		Queries:    queries,
+	}
+}
+
+// queryLogCaller returns the CallerID of context as
+// principal/component/subcomponent, or the remote address of the
+// client if it has none.
+func queryLogCaller(context interface{}) string {
+	if cid := tabletconn.CallerID(context); cid != nil {
+		return cid.Principal + "/" + cid.Component + "/" + cid.Subcomponent
+	}
+	if ctx, ok := context.(*tabletconn.RequestContext); ok {
+		context = ctx.Context
+	}
+	if ctx, ok := context.(*rpcproto.Context); ok {
+		return ctx.RemoteAddr
+	}
+	return ""
+}
+
+// session returns the SafeSession of the calls of the request, which
+// records them in entry, see recordShardCall.
+func (entry *QueryLogEntry) session(session *proto.Session) *SafeSession {
+	return &SafeSession{Session: session, logEntry: entry}
+}
+
+// recordShardCall records a call to a shard begun at startTime, that
+// failed with err if it is not nil.
+func (entry *QueryLogEntry) recordShardCall(keyspace, shard string, startTime time.Time, err error) {
+	call := QueryLogShard{Keyspace: keyspace, Shard: shard, Time: time.Now().Sub(startTime)}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.Shards = append(entry.Shards, call)
+}
+
+// send ends the request, which returned rows or failed with errStr,
+// and sends its entry to QueryLogger.
+func (entry *QueryLogEntry) send(rows int, errStr string) {
+	entry.mu.Lock()
+	entry.EndTime = time.Now()
+	entry.Rows = rows
+	entry.Error = errStr
+	entry.mu.Unlock()
+	QueryLogger.Send(entry)
+}
+
+// Format returns the entry as a line of JSON with the format=json
+// parameter, or of tab separated fields: the method, the caller, the
+// start and end times, the total time in seconds, the keyspace, the
+// tablet type, the queries, the number of bind variables, the calls
+// to the shards as keyspace/shard:seconds, the rows and the error.
+func (entry *QueryLogEntry) Format(params url.Values) string {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if params.Get("format") == "json" {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			log.Warningf("cannot format the query log entry of %v: %v", entry.Method, err)
+			return ""
+		}
+		return string(encoded) + "\n"
+	}
+
+	sqls := make([]string, len(entry.Queries))
+	bindVariables := 0
+	for i, query := range entry.Queries {
+		sqls[i] = query.Sql
+		bindVariables += len(query.BindVariables)
+	}
+	shards := make([]string, len(entry.Shards))
+	for i, call := range entry.Shards {
+		shards[i] = fmt.Sprintf("%v/%v:%.6f", call.Keyspace, call.Shard, call.Time.Seconds())
+	}
+	return fmt.Sprintf(
+		"%v\t%v\t%v\t%v\t%.6f\t%v\t%v\t%q\t%v\t%v\t%v\t%q\n",
+		entry.Method,
+		entry.Caller,
+		entry.StartTime.Format(time.StampMicro),
+		entry.EndTime.Format(time.StampMicro),
+		entry.EndTime.Sub(entry.StartTime).Seconds(),
+		entry.Keyspace,
+		entry.TabletType,
+		strings.Join(sqls, "; "),
+		bindVariables,
+		strings.Join(shards, ","),
+		entry.Rows,
+		entry.Error)
+}
+
+// resultListRows returns the number of rows returned, or affected, by
+// the queries of a batch.
+func resultListRows(reply *proto.QueryResultList) int {
+	rows := 0
+	for _, qr := range reply.List {
+		rows += int(qr.RowsAffected)
+	}
+	return rows
+}
+
+// errorString returns the message of err, or "" if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,171 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/stats"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+// nextQueryLogEntry returns the next entry of ch whose first query is
+// sql, the other ones are skipped.
+func nextQueryLogEntry(t *testing.T, ch chan string, sql string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-ch:
+			if strings.Contains(line, sql) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("no query log entry for %v", sql)
+		}
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	resetSandbox()
+	for _, shard := range []string{"-20", "20-40"} {
+		mapTestConn(shard, &sandboxConn{})
+	}
+	failing := &sandboxConn{mustFailServer: 1}
+	mapTestConn("40-60", failing)
+	ch := QueryLogger.Subscribe(url.Values{"format": {"json"}})
+	defer QueryLogger.Unsubscribe(ch)
+	decode := func(line string) *QueryLogEntry {
+		entry := new(QueryLogEntry)
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			t.Fatalf("cannot decode %q: %v", line, err)
+		}
+		sort.Sort(queryLogShardsByName(entry.Shards))
+		return entry
+	}
+	context := &rpcproto.Context{RemoteAddr: "client:1"}
+
+	query := &proto.QueryShard{
+		Sql:           "query log execute",
+		BindVariables: map[string]interface{}{"id": 1},
+		Keyspace:      "ks",
+		Shards:        []string{"-20", "20-40"},
+		TabletType:    topo.TYPE_REPLICA,
+		CallerID:      &proto.CallerID{Principal: "user", Component: "app"},
+	}
+	RpcVTGate.ExecuteShard(context, query, new(proto.QueryResult))
+	entry := decode(nextQueryLogEntry(t, ch, query.Sql))
+	if entry.Method != "ExecuteShard" || entry.Caller != "user/app/" || entry.Keyspace != "ks" || entry.TabletType != topo.TYPE_REPLICA || entry.Rows != 2 || entry.Error != "" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if want := []tproto.BoundQuery{{Sql: query.Sql, BindVariables: map[string]interface{}{"id": float64(1)}}}; !reflect.DeepEqual(entry.Queries, want) {
+		t.Errorf("want queries %v, got %v", want, entry.Queries)
+	}
+	if len(entry.Shards) != 2 || entry.Shards[0].Shard != "-20" || entry.Shards[1].Shard != "20-40" || entry.Shards[0].Keyspace != "ks" {
+		t.Errorf("want the calls to -20 and 20-40, got %+v", entry.Shards)
+	}
+	if entry.EndTime.Before(entry.StartTime) {
+		t.Errorf("want an end time after %v, got %v", entry.StartTime, entry.EndTime)
+	}
+
+	// without CallerID, the caller is the client, the errors of the
+	// shards are logged
+	batchQuery := &proto.BatchQueryShard{
+		Queries:    []tproto.BoundQuery{{Sql: "query log batch"}, {Sql: "query log batch 2"}},
+		Keyspace:   "ks",
+		Shards:     []string{"20-40", "40-60"},
+		TabletType: topo.TYPE_REPLICA,
+	}
+	RpcVTGate.ExecuteBatchShard(context, batchQuery, new(proto.QueryResultList))
+	entry = decode(nextQueryLogEntry(t, ch, "query log batch"))
+	if entry.Method != "ExecuteBatchShard" || entry.Caller != "client:1" || len(entry.Queries) != 2 || entry.Error == "" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if len(entry.Shards) != 2 || entry.Shards[0].Error != "" || !strings.Contains(entry.Shards[1].Error, "err") {
+		t.Errorf("want an error on 40-60, got %+v", entry.Shards)
+	}
+
+	streamQuery := &proto.StreamQueryShard{
+		Sql:        "query log stream",
+		Keyspace:   "ks",
+		Shards:     []string{"-20", "20-40"},
+		TabletType: topo.TYPE_REPLICA,
+	}
+	RpcVTGate.StreamExecuteShard(context, streamQuery, func(*proto.QueryResult) error { return nil })
+	entry = decode(nextQueryLogEntry(t, ch, streamQuery.Sql))
+	if entry.Method != "StreamExecuteShard" || entry.Rows != 2 || len(entry.Shards) != 2 || entry.Error != "" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+// queryLogShardsByName sorts the calls of an entry by shard.
+type queryLogShardsByName []QueryLogShard
+
+func (s queryLogShardsByName) Len() int           { return len(s) }
+func (s queryLogShardsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s queryLogShardsByName) Less(i, j int) bool { return s[i].Shard < s[j].Shard }
+
+func TestQueryLogFormat(t *testing.T) {
+	*queryLogRedactBindValues = true
+	defer func() { *queryLogRedactBindValues = false }()
+	startTime := time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)
+	entry := newQueryLogEntry(nil, "ExecuteKeyspaceIds", "ks", topo.TYPE_MASTER, tproto.BoundQuery{
+		Sql:           "select * from t where id = :id and name = :name",
+		BindVariables: map[string]interface{}{"id": 1, "name": "secret"},
+	})
+	entry.StartTime = startTime
+	entry.recordShardCall("ks", "-80", startTime, nil)
+	entry.Shards[0].Time = 1500 * time.Millisecond
+	entry.EndTime = startTime.Add(2 * time.Second)
+	entry.Rows = 3
+	entry.Error = "error"
+
+	want := "ExecuteKeyspaceIds\t\tOct  1 12:00:00.000000\tOct  1 12:00:02.000000\t2.000000\tks\tmaster\t\"select * from t where id = :id and name = :name\"\t2\tks/-80:1.500000\t3\t\"error\"\n"
+	if got := entry.Format(nil); got != want {
+		t.Errorf("want\n%q, got\n%q", want, got)
+	}
+	got := entry.Format(url.Values{"format": {"json"}})
+	if strings.Contains(got, "secret") || !strings.Contains(got, `"BindVariables":{"id":null,"name":null}`) {
+		t.Errorf("want redacted bind variables, got %v", got)
+	}
+}
+
+func TestQueryLogDrops(t *testing.T) {
+	// the subscriber doesn't read: the entries are dropped, the
+	// requests are not blocked
+	ch := QueryLogger.Subscribe(nil)
+	defer QueryLogger.Unsubscribe(ch)
+	dropped := expvar.Get("StreamlogDroppedMessages").(*stats.Counters)
+	before := dropped.Counts()["VTGateQuery"]
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			newQueryLogEntry(nil, "ExecuteShard", "ks", topo.TYPE_MASTER).send(0, "")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the query log blocked the requests")
+	}
+	for i := 0; i < 100 && dropped.Counts()["VTGateQuery"] == before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if dropped.Counts()["VTGateQuery"] == before {
+		t.Errorf("want dropped entries")
+	}
+}
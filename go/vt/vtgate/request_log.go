@@ -0,0 +1,151 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	requestLogSize       = flag.Int("request_log_size", 0, "number of the last ExecuteShard and ExecuteBatchShard requests vtgate keeps, in their JSON form, see /debug/vtgate/requests. 0 disables the log.")
+	requestLogBindValues = flag.Bool("request_log_bind_values", false, "keep the values of the bind variables in the request log, not only their names")
+)
+
+// RequestLogEntry is a request kept by the requestLog. Request is
+// its JSON form, which can be unmarshaled back into the request.
+type RequestLogEntry struct {
+	Time    time.Time
+	Method  string
+	Caller  string
+	Request json.RawMessage
+}
+
+// requestLog keeps the last maxSize requests, in their JSON form, so
+// they can be looked at or replayed in a test. The values of their
+// bind variables are replaced by nil unless bindValues is set.
+// A nil *requestLog doesn't record anything.
+type requestLog struct {
+	maxSize    int
+	bindValues bool
+
+	mu sync.Mutex
+	// entries is a ring, next is the position of the next entry
+	entries []RequestLogEntry
+	next    int
+}
+
+// newRequestLog creates a requestLog, or returns nil if maxSize is 0.
+func newRequestLog(maxSize int, bindValues bool) *requestLog {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &requestLog{
+		maxSize:    maxSize,
+		bindValues: bindValues,
+		entries:    make([]RequestLogEntry, 0, maxSize),
+	}
+}
+
+// recordQueryShard records an ExecuteShard request.
+func (rl *requestLog) recordQueryShard(context interface{}, query *proto.QueryShard) {
+	if rl == nil {
+		return
+	}
+	if !rl.bindValues {
+		scrubbed := *query
+		scrubbed.BindVariables = scrubBindVariables(query.BindVariables)
+		query = &scrubbed
+	}
+	rl.record(context, "ExecuteShard", query)
+}
+
+// recordBatchQueryShard records an ExecuteBatchShard request.
+func (rl *requestLog) recordBatchQueryShard(context interface{}, batchQuery *proto.BatchQueryShard) {
+	if rl == nil {
+		return
+	}
+	if !rl.bindValues {
+		scrubbed := *batchQuery
+		scrubbed.Queries = make([]tproto.BoundQuery, len(batchQuery.Queries))
+		for i, query := range batchQuery.Queries {
+			scrubbed.Queries[i] = tproto.BoundQuery{Sql: query.Sql, BindVariables: scrubBindVariables(query.BindVariables)}
+		}
+		batchQuery = &scrubbed
+	}
+	rl.record(context, "ExecuteBatchShard", batchQuery)
+}
+
+// record marshals request right away: vtgate changes the requests
+// while it executes them.
+func (rl *requestLog) record(context interface{}, method string, request interface{}) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		log.Warningf("cannot log %v request: %v", method, err)
+		return
+	}
+	entry := RequestLogEntry{
+		Time:    time.Now(),
+		Method:  method,
+		Caller:  callerName(context),
+		Request: encoded,
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if len(rl.entries) < rl.maxSize {
+		rl.entries = append(rl.entries, entry)
+	} else {
+		rl.entries[rl.next] = entry
+	}
+	rl.next = (rl.next + 1) % rl.maxSize
+}
+
+// list returns the entries, newest first.
+func (rl *requestLog) list() []RequestLogEntry {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	entries := make([]RequestLogEntry, 0, len(rl.entries))
+	for i := 1; i <= len(rl.entries); i++ {
+		entries = append(entries, rl.entries[(rl.next-i+len(rl.entries))%len(rl.entries)])
+	}
+	return entries
+}
+
+// scrubBindVariables returns bindVars with nil values.
+func scrubBindVariables(bindVars map[string]interface{}) map[string]interface{} {
+	if bindVars == nil {
+		return nil
+	}
+	scrubbed := make(map[string]interface{}, len(bindVars))
+	for name := range bindVars {
+		scrubbed[name] = nil
+	}
+	return scrubbed
+}
+
+// ServeHTTP lists the requests of the log in JSON, newest first.
+func (rl *requestLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rl == nil {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "the request log is disabled, see -request_log_size\n")
+		return
+	}
+	encoded, err := json.MarshalIndent(rl.list(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
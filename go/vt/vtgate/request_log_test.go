@@ -0,0 +1,114 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+func TestRequestLogRing(t *testing.T) {
+	rl := newRequestLog(2, true)
+	for _, sql := range []string{"q1", "q2", "q3"} {
+		rl.recordQueryShard(nil, &proto.QueryShard{Sql: sql})
+	}
+	var sqls []string
+	for _, entry := range rl.list() {
+		var q proto.QueryShard
+		if err := json.Unmarshal(entry.Request, &q); err != nil {
+			t.Fatal(err)
+		}
+		sqls = append(sqls, q.Sql)
+	}
+	if want := []string{"q3", "q2"}; !reflect.DeepEqual(sqls, want) {
+		t.Errorf("got %v, want %v", sqls, want)
+	}
+}
+
+func TestRequestLogScrubs(t *testing.T) {
+	rl := newRequestLog(2, false)
+	query := &proto.QueryShard{Sql: "q", BindVariables: map[string]interface{}{"id": int64(1)}}
+	rl.recordQueryShard(nil, query)
+	batchQuery := &proto.BatchQueryShard{Queries: []tproto.BoundQuery{{Sql: "q", BindVariables: map[string]interface{}{"id": int64(1)}}}}
+	rl.recordBatchQueryShard(nil, batchQuery)
+	// the requests themselves are not changed
+	if query.BindVariables["id"] != int64(1) || batchQuery.Queries[0].BindVariables["id"] != int64(1) {
+		t.Errorf("the requests were changed: %v, %v", query, batchQuery)
+	}
+
+	entries := rl.list()
+	var gotBatch proto.BatchQueryShard
+	if err := json.Unmarshal(entries[0].Request, &gotBatch); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"id": nil}; !reflect.DeepEqual(gotBatch.Queries[0].BindVariables, want) {
+		t.Errorf("got %v, want %v", gotBatch.Queries[0].BindVariables, want)
+	}
+	var got proto.QueryShard
+	if err := json.Unmarshal(entries[1].Request, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"id": nil}; !reflect.DeepEqual(got.BindVariables, want) {
+		t.Errorf("got %v, want %v", got.BindVariables, want)
+	}
+	if entries[0].Method != "ExecuteBatchShard" || entries[1].Method != "ExecuteShard" {
+		t.Errorf("got methods %v and %v", entries[0].Method, entries[1].Method)
+	}
+}
+
+func TestRequestLogServeHTTP(t *testing.T) {
+	rl := newRequestLog(2, true)
+	query := &proto.QueryShard{
+		Sql:           "select * from a where id = :id",
+		BindVariables: map[string]interface{}{"id": uint64(1)},
+		Keyspace:      "ks",
+		Shards:        []string{"0"},
+		TabletType:    topo.TYPE_MASTER,
+		CallerID:      &proto.CallerID{Principal: "user"},
+	}
+	rl.recordQueryShard(requestContext(&rpcproto.Context{Username: "user"}, query.CallerID, 0), query)
+
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, nil)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var entries []RequestLogEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("cannot decode %s: %v", w.Body.Bytes(), err)
+	}
+	if len(entries) != 1 || entries[0].Caller != "user" {
+		t.Fatalf("got %+v", entries)
+	}
+	var got proto.QueryShard
+	if err := json.Unmarshal(entries[0].Request, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, query) {
+		t.Errorf("got %#v, want %#v", &got, query)
+	}
+}
+
+func TestRequestLogDisabled(t *testing.T) {
+	var rl *requestLog
+	if rl = newRequestLog(0, true); rl != nil {
+		t.Fatalf("want a nil log, got %v", rl)
+	}
+	rl.recordQueryShard(nil, &proto.QueryShard{})
+	rl.recordBatchQueryShard(nil, &proto.BatchQueryShard{})
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, nil)
+	if !strings.Contains(w.Body.String(), "disabled") {
+		t.Errorf("got %q", w.Body.String())
+	}
+}
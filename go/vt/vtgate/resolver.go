@@ -0,0 +1,158 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// Resolver maps the keyspace ids and key ranges of a keyspace to the
+// shards that serve them, from the serving graph of a cell. It keeps
+// the partitions of the keyspaces it read for ttl, sorted by key
+// range, or until they are invalidated. It is safe for concurrent use.
+type Resolver struct {
+	topoServer SrvTopoServer
+	cell       string
+	ttl        time.Duration
+
+	// mu protects the map, the entries are not modified once
+	// created.
+	mu      sync.Mutex
+	entries map[string]*resolverEntry
+}
+
+// resolverEntry is the serving graph of a keyspace, as read at
+// readTime.
+type resolverEntry struct {
+	readTime   time.Time
+	servedFrom map[topo.TabletType]string
+	// partitions are the shards of each tablet type, sorted by key
+	// range.
+	partitions map[topo.TabletType][]topo.SrvShard
+}
+
+// NewResolver creates a Resolver for the serving graph of cell, that
+// reads the SrvKeyspace of a keyspace again once it is older than ttl,
+// or as soon as it changes if topoServer notifies the changes, see
+// ResilientSrvTopoServer.NotifySrvKeyspaceChanges.
+func NewResolver(topoServer SrvTopoServer, cell string, ttl time.Duration) *Resolver {
+	res := &Resolver{
+		topoServer: topoServer,
+		cell:       cell,
+		ttl:        ttl,
+		entries:    make(map[string]*resolverEntry),
+	}
+	if notifier, ok := topoServer.(srvKeyspaceNotifier); ok {
+		notifier.NotifySrvKeyspaceChanges(func(cell, keyspace string) {
+			if cell == res.cell {
+				res.Invalidate(keyspace)
+			}
+		})
+	}
+	return res
+}
+
+// GetShardForKeyspaceId returns the shard of keyspace that serves
+// keyspaceId for tabletType. The shards of a keyspace served from
+// another one are the ones of that other keyspace. An unsharded
+// keyspace has a single shard, "0", that serves all the keyspace ids.
+// It returns a KeyspaceIdNotCoveredError if keyspaceId falls in a gap
+// between the shards.
+func (res *Resolver) GetShardForKeyspaceId(keyspace string, tabletType topo.TabletType, keyspaceId key.KeyspaceId) (string, error) {
+	alias, shards, err := res.getPartition(keyspace, tabletType)
+	if err != nil {
+		return "", err
+	}
+	return getKeyspaceIdShard(alias, tabletType, shards, keyspaceId)
+}
+
+// GetShardsForKeyRange returns the shards of keyspace that serve part
+// of kr for tabletType, in key range order. It returns a
+// KeyRangeNotCoveredError if some of kr is not served by any shard.
+func (res *Resolver) GetShardsForKeyRange(keyspace string, tabletType topo.TabletType, kr key.KeyRange) ([]string, error) {
+	alias, shards, err := res.getPartition(keyspace, tabletType)
+	if err != nil {
+		return nil, err
+	}
+	names, uncovered := coverKeyRange(shards, kr)
+	if len(uncovered) != 0 {
+		return nil, &KeyRangeNotCoveredError{
+			Keyspace:   alias,
+			TabletType: tabletType,
+			KeyRange:   kr,
+			Uncovered:  uncovered,
+			Shards:     names,
+		}
+	}
+	return names, nil
+}
+
+// Invalidate drops the partitions of keyspace, they are read again by
+// the next call, e.g. after its shards changed.
+func (res *Resolver) Invalidate(keyspace string) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	delete(res.entries, keyspace)
+}
+
+// getPartition returns the keyspace that serves tabletType for
+// keyspace, see getServingPartition, and its sorted shards.
+func (res *Resolver) getPartition(keyspace string, tabletType topo.TabletType) (string, []topo.SrvShard, error) {
+	entry, err := res.getEntry(keyspace)
+	if err != nil {
+		return "", nil, err
+	}
+	alias := keyspace
+	if servedFrom, ok := entry.servedFrom[tabletType]; ok {
+		alias = servedFrom
+		if entry, err = res.getEntry(alias); err != nil {
+			return "", nil, err
+		}
+	}
+	shards, ok := entry.partitions[tabletType]
+	if !ok {
+		return "", nil, fmt.Errorf("vtgate: no %v shards in keyspace %v", tabletType, alias)
+	}
+	return alias, shards, nil
+}
+
+// getEntry returns the entry of keyspace, read again if it is older
+// than the ttl. The old entry is still used if that fails.
+func (res *Resolver) getEntry(keyspace string) (*resolverEntry, error) {
+	res.mu.Lock()
+	entry := res.entries[keyspace]
+	res.mu.Unlock()
+	if entry != nil && time.Now().Sub(entry.readTime) < res.ttl {
+		return entry, nil
+	}
+
+	srvKeyspace, err := res.topoServer.GetSrvKeyspace(res.cell, keyspace)
+	if err != nil {
+		if entry == nil {
+			return nil, fmt.Errorf("vtgate: cannot read keyspace %v: %v", keyspace, err)
+		}
+		log.Warningf("cannot read keyspace %v: %v (using the one read at %v)", keyspace, err, entry.readTime)
+		return entry, nil
+	}
+	entry = &resolverEntry{
+		readTime:   time.Now(),
+		servedFrom: srvKeyspace.ServedFrom,
+		partitions: make(map[topo.TabletType][]topo.SrvShard, len(srvKeyspace.Partitions)),
+	}
+	for tabletType, partition := range srvKeyspace.Partitions {
+		entry.partitions[tabletType] = sortedShards(partition.Shards)
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	res.entries[keyspace] = entry
+	return entry, nil
+}
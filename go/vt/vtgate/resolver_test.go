@@ -0,0 +1,243 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// keyspaceTopo is a SrvTopoServer serving SrvKeyspaces that can be
+// changed or broken.
+type keyspaceTopo struct {
+	sandboxTopo
+
+	mu        sync.Mutex
+	keyspaces map[string]*topo.SrvKeyspace
+	fail      bool
+	getCount  int
+}
+
+func (kt *keyspaceTopo) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	kt.getCount++
+	if kt.fail {
+		return nil, fmt.Errorf("topo error")
+	}
+	srvKeyspace, ok := kt.keyspaces[keyspace]
+	if !ok {
+		return nil, fmt.Errorf("no keyspace %v", keyspace)
+	}
+	return srvKeyspace, nil
+}
+
+func (kt *keyspaceTopo) set(keyspace string, srvKeyspace *topo.SrvKeyspace, fail bool) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	kt.keyspaces[keyspace] = srvKeyspace
+	kt.fail = fail
+}
+
+func (kt *keyspaceTopo) gets() int {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	return kt.getCount
+}
+
+// masterKeyspace returns a SrvKeyspace whose master shards have the
+// key ranges of specs, in that order, "" being the whole key space.
+func masterKeyspace(specs ...string) *topo.SrvKeyspace {
+	partition := &topo.KeyspacePartition{}
+	for _, spec := range specs {
+		kr := key.KeyRange{}
+		if spec != "" {
+			var err error
+			if kr, err = parseKeyRange(spec); err != nil {
+				panic(err)
+			}
+		}
+		partition.Shards = append(partition.Shards, topo.SrvShard{KeyRange: kr})
+	}
+	return &topo.SrvKeyspace{Partitions: map[topo.TabletType]*topo.KeyspacePartition{topo.TYPE_MASTER: partition}}
+}
+
+func newKeyspaceTopo() *keyspaceTopo {
+	return &keyspaceTopo{keyspaces: map[string]*topo.SrvKeyspace{
+		// not sorted, and adjacent
+		"adjacent": masterKeyspace("80-", "-40", "40-80"),
+		// 40-80 is also served by -c0
+		"overlapping": masterKeyspace("40-80", "c0-", "-c0"),
+		// no shard serves 40-60 and a0-c0
+		"gaps":      masterKeyspace("c0-", "-40", "60-a0"),
+		"unsharded": masterKeyspace(""),
+		"served_from": &topo.SrvKeyspace{
+			Partitions: map[topo.TabletType]*topo.KeyspacePartition{topo.TYPE_MASTER: {Shards: []topo.SrvShard{{}}}},
+			ServedFrom: map[topo.TabletType]string{topo.TYPE_RDONLY: "adjacent"},
+		},
+	}}
+}
+
+func TestResolverGetShardForKeyspaceId(t *testing.T) {
+	res := NewResolver(newKeyspaceTopo(), "cell", time.Hour)
+	testcases := []struct {
+		keyspace   string
+		tabletType topo.TabletType
+		keyspaceId key.KeyspaceId
+		shard      string
+		err        string
+	}{
+		{"adjacent", topo.TYPE_MASTER, "", "-40", ""},
+		{"adjacent", topo.TYPE_MASTER, "\x3f\xff", "-40", ""},
+		{"adjacent", topo.TYPE_MASTER, "\x40", "40-80", ""},
+		{"adjacent", topo.TYPE_MASTER, "\x80", "80-", ""},
+		{"adjacent", topo.TYPE_MASTER, "\xff\xff", "80-", ""},
+		{"overlapping", topo.TYPE_MASTER, "\x50", "-C0", ""},
+		{"overlapping", topo.TYPE_MASTER, "\xc0", "C0-", ""},
+		{"gaps", topo.TYPE_MASTER, "\x30", "-40", ""},
+		{"gaps", topo.TYPE_MASTER, "\x40", "", "vtgate: keyspace id 40 of keyspace gaps is not covered by the master shards, it falls in the gap 40-60 between them"},
+		{"gaps", topo.TYPE_MASTER, "\xb0", "", "vtgate: keyspace id B0 of keyspace gaps is not covered by the master shards, it falls in the gap A0-C0 between them"},
+		{"gaps", topo.TYPE_MASTER, "\xc0", "C0-", ""},
+		{"unsharded", topo.TYPE_MASTER, "\x50", "0", ""},
+		{"unsharded", topo.TYPE_REPLICA, "\x50", "", "vtgate: no replica shards in keyspace unsharded"},
+		{"served_from", topo.TYPE_MASTER, "\x50", "0", ""},
+		{"served_from", topo.TYPE_RDONLY, "\x50", "", "vtgate: no rdonly shards in keyspace adjacent"},
+		{"unknown", topo.TYPE_MASTER, "\x50", "", "vtgate: cannot read keyspace unknown: no keyspace unknown"},
+	}
+	for _, tc := range testcases {
+		shard, err := res.GetShardForKeyspaceId(tc.keyspace, tc.tabletType, tc.keyspaceId)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%v %v %x: want error %q, got %v, %v", tc.keyspace, tc.tabletType, tc.keyspaceId, tc.err, shard, err)
+			}
+			continue
+		}
+		if err != nil || shard != tc.shard {
+			t.Errorf("%v %v %x: want %v, got %v, %v", tc.keyspace, tc.tabletType, tc.keyspaceId, tc.shard, shard, err)
+		}
+	}
+
+	_, err := res.GetShardForKeyspaceId("gaps", topo.TYPE_MASTER, "\x40")
+	want := &KeyspaceIdNotCoveredError{Keyspace: "gaps", TabletType: topo.TYPE_MASTER, KeyspaceId: "\x40", Gap: key.KeyRange{Start: "\x40", End: "\x60"}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("want %#v, got %#v", want, err)
+	}
+}
+
+func TestResolverGetShardsForKeyRange(t *testing.T) {
+	res := NewResolver(newKeyspaceTopo(), "cell", time.Hour)
+	testcases := []struct {
+		keyspace string
+		keyRange string
+		shards   []string
+		err      string
+	}{
+		{"adjacent", "-", []string{"-40", "40-80", "80-"}, ""},
+		{"adjacent", "30-50", []string{"-40", "40-80"}, ""},
+		{"adjacent", "40-80", []string{"40-80"}, ""},
+		{"overlapping", "50-60", []string{"-C0", "40-80"}, ""},
+		{"overlapping", "-", []string{"-C0", "40-80", "C0-"}, ""},
+		{"gaps", "-40", []string{"-40"}, ""},
+		{"gaps", "60-", []string{"60-A0", "C0-"}, "vtgate: key range 60- of keyspace gaps is not covered by the master shards, missing A0-C0, shards considered [60-A0 C0-]"},
+		{"gaps", "-", nil, "vtgate: key range - of keyspace gaps is not covered by the master shards, missing 40-60, A0-C0, shards considered [-40 60-A0 C0-]"},
+		{"unsharded", "40-80", []string{"0"}, ""},
+	}
+	for _, tc := range testcases {
+		kr, err := parseKeyRange(tc.keyRange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards, err := res.GetShardsForKeyRange(tc.keyspace, topo.TYPE_MASTER, kr)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%v %v: want error %q, got %v, %v", tc.keyspace, tc.keyRange, tc.err, shards, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(shards, tc.shards) {
+			t.Errorf("%v %v: want %v, got %v, %v", tc.keyspace, tc.keyRange, tc.shards, shards, err)
+		}
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	kt := newKeyspaceTopo()
+	res := NewResolver(kt, "cell", time.Hour)
+	getShard := func() string {
+		shard, err := res.GetShardForKeyspaceId("adjacent", topo.TYPE_MASTER, "\x50")
+		if err != nil {
+			t.Fatalf("GetShardForKeyspaceId failed: %v", err)
+		}
+		return shard
+	}
+	getShard()
+	getShard()
+	if got := kt.gets(); got != 1 {
+		t.Errorf("want 1 read of the topology, got %v", got)
+	}
+
+	// the cached partition is used until it is invalidated
+	kt.set("adjacent", masterKeyspace("-"), false)
+	if shard := getShard(); shard != "40-80" {
+		t.Errorf("want the cached shard 40-80, got %v", shard)
+	}
+	res.Invalidate("adjacent")
+	if shard := getShard(); shard != "0" {
+		t.Errorf("want shard 0, got %v", shard)
+	}
+
+	// the last read partition is used without topology
+	kt.set("adjacent", masterKeyspace("-40", "40-"), true)
+	res = NewResolver(kt, "cell", 0)
+	if _, err := res.GetShardForKeyspaceId("adjacent", topo.TYPE_MASTER, "\x50"); err == nil {
+		t.Errorf("want an error without topology and cache")
+	}
+	kt.set("adjacent", masterKeyspace("-40", "40-"), false)
+	if shard := getShard(); shard != "40-" {
+		t.Errorf("want shard 40-, got %v", shard)
+	}
+	kt.set("adjacent", masterKeyspace("-"), true)
+	if shard := getShard(); shard != "40-" {
+		t.Errorf("want the last read shard 40-, got %v", shard)
+	}
+	// without ttl, the topology is read every time
+	before := kt.gets()
+	getShard()
+	getShard()
+	if got := kt.gets() - before; got != 2 {
+		t.Errorf("want 2 reads of the topology, got %v", got)
+	}
+}
+
+// TestResolverConcurrent is meant for the race detector.
+func TestResolverConcurrent(t *testing.T) {
+	kt := newKeyspaceTopo()
+	res := NewResolver(kt, "cell", time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := res.GetShardForKeyspaceId("adjacent", topo.TYPE_MASTER, key.KeyspaceId([]byte{byte(j)})); err != nil {
+					t.Errorf("GetShardForKeyspaceId failed: %v", err)
+				}
+				if _, err := res.GetShardsForKeyRange("adjacent", topo.TYPE_MASTER, key.KeyRange{}); err != nil {
+					t.Errorf("GetShardsForKeyRange failed: %v", err)
+				}
+				if j%10 == i {
+					res.Invalidate("adjacent")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+)
+
+var (
+	maxStreamRowsPerSecond = flag.Int("max_stream_rows_per_second", 0, "maximum number of rows per second of a streaming query, 0 for no limit. Requests can only lower it.")
+
+	// throttledStreams is the number of running streaming queries
+	// that have been slowed down by their row rate limit.
+	throttledStreams = stats.NewInt("VTGateThrottledStreams")
+
+	// streamDelaySeconds is the total time streaming queries have
+	// been paused for by their row rate limit.
+	streamDelaySeconds = stats.NewFloat("VTGateStreamDelaySeconds")
+)
+
+// streamRowsPerSecond returns the maximum row rate of a streaming
+// request, 0 for no limit. The request can only lower
+// -max_stream_rows_per_second.
+func streamRowsPerSecond(requestMax int) int {
+	switch {
+	case requestMax <= 0:
+		return *maxStreamRowsPerSecond
+	case *maxStreamRowsPerSecond <= 0 || requestMax < *maxStreamRowsPerSecond:
+		return requestMax
+	}
+	return *maxStreamRowsPerSecond
+}
+
+// rowRateLimiter paces the results of a streaming query. It is used
+// by the single loop that forwards the results of all the shards to
+// the client: while it waits, the shards block on the results
+// channel, in arrival order, so the rate is shared fairly between
+// them and the backpressure reaches the tablets.
+// A nil *rowRateLimiter doesn't limit anything.
+type rowRateLimiter struct {
+	rowsPerSecond int
+	// next is when the rows sent so far are paid for, at the rate
+	next      time.Time
+	throttled bool
+}
+
+// newRowRateLimiter returns a rowRateLimiter for rowsPerSecond, or
+// nil if rowsPerSecond is 0.
+func newRowRateLimiter(rowsPerSecond int) *rowRateLimiter {
+	if rowsPerSecond <= 0 {
+		return nil
+	}
+	return &rowRateLimiter{rowsPerSecond: rowsPerSecond}
+}
+
+// wait is called before sending rows to the client. It sleeps until
+// the previous rows are paid for, so it returns right away as long
+// as the stream is under its limit.
+func (rl *rowRateLimiter) wait(rows int) {
+	if rl == nil {
+		return
+	}
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	delay := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(rows) * time.Second / time.Duration(rl.rowsPerSecond))
+	if delay <= 0 {
+		return
+	}
+	if !rl.throttled {
+		rl.throttled = true
+		throttledStreams.Add(1)
+	}
+	streamDelaySeconds.Add(delay.Seconds())
+	time.Sleep(delay)
+}
+
+// done is called when the stream is over.
+func (rl *rowRateLimiter) done() {
+	if rl != nil && rl.throttled {
+		throttledStreams.Add(-1)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func setMaxStreamRowsPerSecond(max int) func() {
+	saved := *maxStreamRowsPerSecond
+	*maxStreamRowsPerSecond = max
+	return func() {
+		*maxStreamRowsPerSecond = saved
+	}
+}
+
+func TestStreamRowsPerSecond(t *testing.T) {
+	for _, tc := range []struct {
+		flag, request, want int
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{500, 0, 500},
+		{500, 100, 100},
+		// requests can't raise the limit
+		{500, 1000, 500},
+	} {
+		restore := setMaxStreamRowsPerSecond(tc.flag)
+		if got := streamRowsPerSecond(tc.request); got != tc.want {
+			t.Errorf("streamRowsPerSecond(%v) with -max_stream_rows_per_second=%v: %v, want %v", tc.request, tc.flag, got, tc.want)
+		}
+		restore()
+	}
+}
+
+func TestRowRateLimiter(t *testing.T) {
+	var nilLimiter *rowRateLimiter
+	nilLimiter.wait(1000)
+	nilLimiter.done()
+	if newRowRateLimiter(0) != nil {
+		t.Errorf("newRowRateLimiter(0) should not limit anything")
+	}
+
+	// the first rows don't wait, the next ones wait for them
+	rl := newRowRateLimiter(100)
+	start := time.Now()
+	rl.wait(10)
+	if elapsed := time.Now().Sub(start); elapsed > 50*time.Millisecond {
+		t.Errorf("first wait took %v", elapsed)
+	}
+	rl.wait(10)
+	if elapsed := time.Now().Sub(start); elapsed < 90*time.Millisecond {
+		t.Errorf("second wait took %v, want 100ms", elapsed)
+	}
+	if throttledStreams.Get() != 1 {
+		t.Errorf("want 1 throttled stream, got %v", throttledStreams.Get())
+	}
+	rl.done()
+	if throttledStreams.Get() != 0 {
+		t.Errorf("want 0 throttled stream, got %v", throttledStreams.Get())
+	}
+
+	// a slow stream doesn't wait
+	rl = newRowRateLimiter(100)
+	rl.wait(1)
+	time.Sleep(20 * time.Millisecond)
+	start = time.Now()
+	rl.wait(1)
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Millisecond {
+		t.Errorf("wait under the limit took %v", elapsed)
+	}
+	rl.done()
+}
+
+func TestStreamExecuteRowRate(t *testing.T) {
+	resetSandbox()
+	for i := 0; i < 4; i++ {
+		testConns[uint32(i)] = &sandboxConn{}
+	}
+	delay := streamDelaySeconds.Get()
+
+	// each shard streams one row
+	q := proto.StreamQueryShard{
+		Sql:              "query",
+		Keyspace:         "rr_keyspace",
+		Shards:           []string{"0", "1", "2", "3"},
+		TabletType:       topo.TYPE_MASTER,
+		MaxRowsPerSecond: 20,
+	}
+	rows := 0
+	start := time.Now()
+	err := RpcVTGate.StreamExecuteShard(nil, &q, func(r *proto.QueryResult) error {
+		rows += len(r.Rows)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamExecuteShard failed: %v", err)
+	}
+	if rows != 4 {
+		t.Errorf("want 4 rows, got %v", rows)
+	}
+	if elapsed := time.Now().Sub(start); elapsed < 140*time.Millisecond {
+		t.Errorf("4 rows at 20 rows/s took %v, want 150ms", elapsed)
+	}
+	if got := streamDelaySeconds.Get() - delay; got < 0.14 {
+		t.Errorf("want 0.15s of delay, got %v", got)
+	}
+	if throttledStreams.Get() != 0 {
+		t.Errorf("want 0 throttled stream, got %v", throttledStreams.Get())
+	}
+}
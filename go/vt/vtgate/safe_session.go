@@ -6,6 +6,7 @@ package vtgate
 
 import (
 	"sync"
+	"time"
 
 	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
@@ -14,6 +15,10 @@ import (
 type SafeSession struct {
 	mu sync.Mutex
 	*proto.Session
+
+	// logEntry is the query log entry of the request, if any, see
+	// QueryLogEntry.session.
+	logEntry *QueryLogEntry
 }
 
 func NewSafeSession(sessn *proto.Session) *SafeSession {
@@ -43,15 +48,95 @@ func (session *SafeSession) Find(keyspace, shard string, tabletType topo.TabletT
 	return 0
 }
 
+// recordShardCall records a call to a shard in the query log entry of
+// the request, if any.
+func (session *SafeSession) recordShardCall(keyspace, shard string, startTime time.Time, err error) {
+	if session == nil || session.logEntry == nil {
+		return
+	}
+	session.logEntry.recordShardCall(keyspace, shard, startTime, err)
+}
+
 func (session *SafeSession) Append(shardSession *proto.ShardSession) {
 	session.mu.Lock()
 	defer session.mu.Unlock()
 	session.ShardSessions = append(session.ShardSessions, shardSession)
 }
 
+// MustRollback returns true if the transaction of the session can
+// only be rolled back, see proto.Session.
+func (session *SafeSession) MustRollback() bool {
+	if session == nil || session.Session == nil {
+		return false
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.Session.MustRollback
+}
+
+func (session *SafeSession) SetMustRollback() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.Session.MustRollback = true
+}
+
+// TabletAffinity returns true if the reads of the session stick to a
+// tablet of each shard, see proto.Session.
+func (session *SafeSession) TabletAffinity() bool {
+	if session == nil || session.Session == nil {
+		return false
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.Session.TabletAffinity
+}
+
+// TabletPin returns the uid of the tablet the session reads from for
+// a shard and tablet type, and false if it has none.
+func (session *SafeSession) TabletPin(keyspace, shard string, tabletType topo.TabletType) (uint32, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for _, tabletPin := range session.TabletPins {
+		if keyspace == tabletPin.Keyspace && tabletType == tabletPin.TabletType && shard == tabletPin.Shard {
+			return tabletPin.Uid, true
+		}
+	}
+	return 0, false
+}
+
+// SetTabletPin pins the session to the tablet uid for a shard and
+// tablet type, in place of the previous one.
+func (session *SafeSession) SetTabletPin(keyspace, shard string, tabletType topo.TabletType, uid uint32) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for _, tabletPin := range session.TabletPins {
+		if keyspace == tabletPin.Keyspace && tabletType == tabletPin.TabletType && shard == tabletPin.Shard {
+			tabletPin.Uid = uid
+			return
+		}
+	}
+	session.TabletPins = append(session.TabletPins, &proto.TabletPin{Keyspace: keyspace, Shard: shard, TabletType: tabletType, Uid: uid})
+}
+
+// ClearTabletPin drops the pin of a shard and tablet type if it's
+// still the tablet uid.
+func (session *SafeSession) ClearTabletPin(keyspace, shard string, tabletType topo.TabletType, uid uint32) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for i, tabletPin := range session.TabletPins {
+		if keyspace == tabletPin.Keyspace && tabletType == tabletPin.TabletType && shard == tabletPin.Shard {
+			if tabletPin.Uid == uid {
+				session.TabletPins = append(session.TabletPins[:i], session.TabletPins[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
 func (session *SafeSession) Reset() {
 	session.mu.Lock()
 	defer session.mu.Unlock()
 	session.Session.InTransaction = false
+	session.Session.MustRollback = false
 	session.ShardSessions = nil
 }
@@ -53,6 +53,7 @@ const (
 	TEST_SHARDED               = "TestSharded"
 	TEST_UNSHARDED             = "TestUnshared"
 	TEST_UNSHARDED_SERVED_FROM = "TestUnshardedServedFrom"
+	TEST_SPLITTING             = "TestSplitting"
 )
 
 func resetSandbox() {
@@ -126,7 +127,9 @@ func createShardedSrvKeyspace() (*topo.SrvKeyspace, error) {
 				Shards: shards,
 			},
 		},
-		TabletTypes: allTabletTypes,
+		TabletTypes:        allTabletTypes,
+		ShardingColumnName: "keyspace_id",
+		ShardingColumnType: key.KIT_UINT64,
 	}
 	return shardedSrvKeyspace, nil
 }
@@ -173,6 +176,15 @@ func (sct *sandboxTopo) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace
 		return servedFromKeyspace, nil
 	case TEST_UNSHARDED:
 		return createUnshardedKeyspace()
+	case TEST_SPLITTING:
+		// an unsharded keyspace that is being split on keyspace_id
+		splittingSrvKeyspace, err := createUnshardedKeyspace()
+		if err != nil {
+			return nil, err
+		}
+		splittingSrvKeyspace.ShardingColumnName = "keyspace_id"
+		splittingSrvKeyspace.ShardingColumnType = key.KIT_UINT64
+		return splittingSrvKeyspace, nil
 	}
 
 	return createShardedSrvKeyspace()
@@ -209,7 +221,9 @@ func sandboxDialer(context interface{}, endPoint topo.EndPoint, keyspace, shard
 	if tconn == nil {
 		panic(fmt.Sprintf("can't find conn %v", endPoint.Uid))
 	}
-	tconn.(*sandboxConn).endPoint = endPoint
+	if sbc, ok := tconn.(*sandboxConn); ok {
+		sbc.endPoint = endPoint
+	}
 	return tconn, nil
 }
 
@@ -280,6 +294,14 @@ func (sbc *sandboxConn) Execute(context interface{}, query string, bindVars map[
 	return singleRowResult, nil
 }
 
+func (sbc *sandboxConn) ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.LazyQueryResult, error) {
+	qr, err := sbc.Execute(context, query, bindVars, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	return mproto.NewLazyQueryResult(qr), nil
+}
+
 func (sbc *sandboxConn) ExecuteBatch(context interface{}, queries []tproto.BoundQuery, transactionId int64) (*tproto.QueryResultList, error) {
 	sbc.ExecCount.Add(1)
 	if sbc.mustDelay != 0 {
@@ -345,13 +367,16 @@ func (sbc *sandboxConn) Close() {
 }
 
 func (sbc *sandboxConn) EndPoint() topo.EndPoint {
+	// the end point is set by sandboxDialer
+	sandmu.Lock()
+	defer sandmu.Unlock()
 	return sbc.endPoint
 }
 
 var singleRowResult = &mproto.QueryResult{
 	Fields: []mproto.Field{
-		{"id", 3},
-		{"value", 253}},
+		{Name: "id", Type: 3},
+		{Name: "value", Type: 253}},
 	RowsAffected: 1,
 	InsertId:     0,
 	Rows: [][]sqltypes.Value{{
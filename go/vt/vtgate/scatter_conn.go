@@ -5,21 +5,44 @@
 package vtgate
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	log "github.com/golang/glog"
 	mproto "github.com/youtube/vitess/go/mysql/proto"
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/stats"
 	"github.com/youtube/vitess/go/sync2"
 	"github.com/youtube/vitess/go/vt/concurrency"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
 	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
 
 var idGen sync2.AtomicInt64
 
+var scatterConcurrency = flag.Int("scatter_concurrency", 0, "maximum number of shards a query runs on at once, the others wait for their turn. 0 is no limit.")
+
+// ErrMustRollback is returned by the queries and the Commit of a
+// transaction whose Session has MustRollback set: a query of the
+// transaction failed on some of its shards but not on the others.
+var ErrMustRollback = errors.New("vtgate: a query of the transaction failed on some of its shards, it must be rolled back")
+
+// ErrClientDisconnected ends the streams whose client connection
+// closed, see ScatterConn.ConnClosed.
+var ErrClientDisconnected = errors.New("vtgate: the client disconnected")
+
+// streamsCancelled counts the streams cancelled before their shards
+// were done, by reason: "send" when a reply couldn't be sent,
+// "deadline" and "disconnect".
+var streamsCancelled = stats.NewCounters("VTGateStreamsCancelled")
+
 // ScatterConn is used for executing queries across
 // multiple ShardConn connections.
 type ScatterConn struct {
@@ -29,8 +52,42 @@ type ScatterConn struct {
 	retryCount int
 	timeout    time.Duration
 
+	// concurrency is the maximum number of shards a query runs on
+	// at once, 0 for no limit.
+	concurrency int
+
+	// txRegistry records the shard transactions begun by this
+	// ScatterConn, it is nil if disabled.
+	txRegistry *txRegistry
+
+	// tabletTypePolicy has the fallback tablet types of the
+	// keyspaces, it is nil if there are none.
+	tabletTypePolicy *tabletTypePolicy
+
 	mu         sync.Mutex
 	shardConns map[string]*ShardConn
+
+	// streamsMu protects streams, the running StreamExecute calls
+	// of each client connection.
+	streamsMu sync.Mutex
+	streams   map[*rpcproto.Context]map[*clientStream]bool
+}
+
+// clientStream is a running StreamExecute, done is closed once it's
+// cancelled.
+type clientStream struct {
+	conn *rpcproto.Context
+	once sync.Once
+	done chan struct{}
+}
+
+// cancel closes done and counts the stream as cancelled for reason,
+// the first time it's called.
+func (cs *clientStream) cancel(reason string) {
+	cs.once.Do(func() {
+		streamsCancelled.Add(reason, 1)
+		close(cs.done)
+	})
 }
 
 // shardActionFunc defines the contract for a shard action. Every such function
@@ -50,10 +107,20 @@ func NewScatterConn(serv SrvTopoServer, cell string, retryDelay time.Duration, r
 		retryCount: retryCount,
 		timeout:    timeout,
 		shardConns: make(map[string]*ShardConn),
+		streams:    make(map[*rpcproto.Context]map[*clientStream]bool),
 	}
 }
 
 // Execute executes a non-streaming query on the specified shards.
+// All the shards are sent the same query string, it is not copied
+// for each of them.
+// If maxRows is set and the shards return more rows, the query fails
+// with a *TooManyRowsError: the rows received so far are dropped, and
+// the shards that didn't start yet are skipped. The transaction of
+// the session, if any, goes on.
+// If some shards fail, the result has the rows of the others, and err
+// is a *ScatterConnError with the errors of the failed shards. The
+// result is nil if all the shards failed.
 func (stc *ScatterConn) Execute(
 	context interface{},
 	query string,
@@ -62,7 +129,10 @@ func (stc *ScatterConn) Execute(
 	shards []string,
 	tabletType topo.TabletType,
 	session *SafeSession,
+	maxRows uint64,
 ) (*mproto.QueryResult, error) {
+	// done is closed when the result has too many rows
+	done := make(chan struct{})
 	results, allErrors := stc.multiGo(
 		context,
 		keyspace,
@@ -70,6 +140,9 @@ func (stc *ScatterConn) Execute(
 		tabletType,
 		session,
 		func(sdc *ShardConn, transactionId int64, sResults chan<- interface{}) error {
+			if isDone(done) {
+				return nil
+			}
 			innerqr, err := sdc.Execute(context, query, bindVars, transactionId)
 			if err != nil {
 				return err
@@ -79,17 +152,161 @@ func (stc *ScatterConn) Execute(
 		})
 
 	qr := new(mproto.QueryResult)
+	var rowsErr error
+	// received is the number of shards that sent their result
+	received := 0
 	for innerqr := range results {
+		received++
+		if rowsErr != nil {
+			continue
+		}
 		innerqr := innerqr.(*mproto.QueryResult)
 		appendResult(qr, innerqr)
+		if rowsErr = checkMaxRows(keyspace, uint64(len(qr.Rows)), maxRows); rowsErr != nil {
+			qr.Rows = nil
+			close(done)
+		}
+	}
+	if allErrors.HasErrors() {
+		if rowsErr != nil || received == 0 {
+			return nil, allErrors.AggrError(aggregateShardErrors)
+		}
+		return qr, allErrors.AggrError(aggregateShardErrors)
+	}
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	return qr, nil
+}
+
+// ExecuteLazy is like Execute, but doesn't decode the rows: the
+// rows of all the shards are concatenated as they were received.
+// Its partial results are the same as the ones of Execute.
+func (stc *ScatterConn) ExecuteLazy(
+	context interface{},
+	query string,
+	bindVars map[string]interface{},
+	keyspace string,
+	shards []string,
+	tabletType topo.TabletType,
+	session *SafeSession,
+	maxRows uint64,
+) (*mproto.LazyQueryResult, error) {
+	// done is closed when the result has too many rows
+	done := make(chan struct{})
+	results, allErrors := stc.multiGo(
+		context,
+		keyspace,
+		shards,
+		tabletType,
+		session,
+		func(sdc *ShardConn, transactionId int64, sResults chan<- interface{}) error {
+			if isDone(done) {
+				return nil
+			}
+			innerqr, err := sdc.ExecuteLazy(context, query, bindVars, transactionId)
+			if err != nil {
+				return err
+			}
+			sResults <- innerqr
+			return nil
+		})
+
+	qr := new(mproto.LazyQueryResult)
+	var rowsErr error
+	// received is the number of shards that sent their result
+	received := 0
+	for innerqr := range results {
+		received++
+		if rowsErr != nil {
+			continue
+		}
+		innerqr := innerqr.(*mproto.LazyQueryResult)
+		appendLazyResult(qr, innerqr)
+		if rowsErr = checkMaxRows(keyspace, uint64(len(qr.Rows)), maxRows); rowsErr != nil {
+			qr.Rows = nil
+			close(done)
+		}
 	}
 	if allErrors.HasErrors() {
-		return nil, allErrors.Error()
+		if rowsErr != nil || received == 0 {
+			return nil, allErrors.AggrError(aggregateShardErrors)
+		}
+		return qr, allErrors.AggrError(aggregateShardErrors)
+	}
+	if rowsErr != nil {
+		return nil, rowsErr
+	}
+	return qr, nil
+}
+
+// ExecuteEntityIds is like ExecuteLazy, but each shard has its own
+// bind variables: the query runs on the shards of shardBindVars.
+// maxRows is the same as in Execute.
+func (stc *ScatterConn) ExecuteEntityIds(
+	context interface{},
+	query string,
+	shardBindVars map[string]map[string]interface{},
+	keyspace string,
+	tabletType topo.TabletType,
+	session *SafeSession,
+	maxRows uint64,
+) (*mproto.LazyQueryResult, error) {
+	// done is closed when the result has too many rows
+	done := make(chan struct{})
+	shards := make([]string, 0, len(shardBindVars))
+	for shard := range shardBindVars {
+		shards = append(shards, shard)
+	}
+	results, allErrors := stc.multiGo(
+		context,
+		keyspace,
+		shards,
+		tabletType,
+		session,
+		func(sdc *ShardConn, transactionId int64, sResults chan<- interface{}) error {
+			if isDone(done) {
+				return nil
+			}
+			innerqr, err := sdc.ExecuteLazy(context, query, shardBindVars[sdc.shard], transactionId)
+			if err != nil {
+				return err
+			}
+			sResults <- innerqr
+			return nil
+		})
+
+	qr := new(mproto.LazyQueryResult)
+	var rowsErr error
+	// received is the number of shards that sent their result
+	received := 0
+	for innerqr := range results {
+		received++
+		if rowsErr != nil {
+			continue
+		}
+		innerqr := innerqr.(*mproto.LazyQueryResult)
+		appendLazyResult(qr, innerqr)
+		if rowsErr = checkMaxRows(keyspace, uint64(len(qr.Rows)), maxRows); rowsErr != nil {
+			qr.Rows = nil
+			close(done)
+		}
+	}
+	if allErrors.HasErrors() {
+		if rowsErr != nil || received == 0 {
+			return nil, allErrors.AggrError(aggregateShardErrors)
+		}
+		return qr, allErrors.AggrError(aggregateShardErrors)
+	}
+	if rowsErr != nil {
+		return nil, rowsErr
 	}
 	return qr, nil
 }
 
 // ExecuteBatch executes a batch of non-streaming queries on the specified shards.
+// If some shards fail, qrs still has the results of the others, and
+// err is a *ScatterConnError with the errors of the failed shards.
 func (stc *ScatterConn) ExecuteBatch(
 	context interface{},
 	queries []tproto.BoundQuery,
@@ -122,12 +339,25 @@ func (stc *ScatterConn) ExecuteBatch(
 		}
 	}
 	if allErrors.HasErrors() {
-		return nil, allErrors.Error()
+		return qrs, allErrors.AggrError(aggregateShardErrors)
 	}
 	return qrs, nil
 }
 
 // StreamExecute executes a streaming query on vttablet. The retry rules are the same.
+// The replies belong to the tablet connections, sendReply must copy
+// what it keeps after it returns.
+// The replies of the shards are interleaved. As soon as a shard fails,
+// the replies of the other shards are dropped: the stream ends with
+// the error. The tablets can't be interrupted, so StreamExecute only
+// returns once the other shards are done.
+// If sendReply fails, the client is gone: the stream is cancelled.
+// The shards that didn't start their stream yet don't, and the others
+// are aborted, see ShardConn.StreamExecute, without waiting for
+// StreamExecute to read the rest of their replies. The stream is
+// cancelled the same way at the deadline of context, if it has one,
+// and when the client connection closes, see ConnClosed, with
+// ErrDeadlineExceeded and ErrClientDisconnected.
 func (stc *ScatterConn) StreamExecute(
 	context interface{},
 	query string,
@@ -138,6 +368,9 @@ func (stc *ScatterConn) StreamExecute(
 	session *SafeSession,
 	sendReply func(reply *mproto.QueryResult) error,
 ) error {
+	var failed sync2.AtomicInt32
+	stream := stc.startStream(context)
+	defer stc.endStream(stream)
 	results, allErrors := stc.multiGo(
 		context,
 		keyspace,
@@ -145,44 +378,245 @@ func (stc *ScatterConn) StreamExecute(
 		tabletType,
 		session,
 		func(sdc *ShardConn, transactionId int64, sResults chan<- interface{}) error {
-			sr, errFunc := sdc.StreamExecute(context, query, bindVars, transactionId)
-			for qr := range sr {
-				sResults <- qr
+			if isDone(stream.done) {
+				return nil
+			}
+			sr, errFunc, cancel := sdc.StreamExecute(context, query, bindVars, transactionId)
+			rows, ended := forwardStream(sr, sResults, stream.done)
+			sdc.recordRows(rows)
+			if !ended {
+				cancel()
+				return nil
+			}
+			err := errFunc()
+			// the errors of a moved keyspace may be retried
+			if err != nil && !shouldResolveKeyspace(err, transactionId) {
+				failed.Set(1)
 			}
-			return errFunc()
+			return err
 		})
+	// the stream ends with ErrDeadlineExceeded at the deadline of the
+	// request, if it has one
+	var expired <-chan time.Time
+	if deadline := tabletconn.Deadline(context); !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	cancelled := stream.done
 	var replyErr error
-	for innerqr := range results {
-		// We still need to finish pumping
-		if replyErr != nil {
-			continue
+	for results != nil {
+		select {
+		case innerqr, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			// We still need to finish pumping
+			if replyErr != nil || failed.Get() != 0 {
+				continue
+			}
+			if replyErr = sendReply(innerqr.(*mproto.QueryResult)); replyErr != nil {
+				stream.cancel("send")
+			}
+		case <-expired:
+			expired = nil
+			if replyErr == nil {
+				replyErr = ErrDeadlineExceeded
+				stream.cancel("deadline")
+			}
+		case <-cancelled:
+			// only ConnClosed cancels the stream before replyErr is set
+			cancelled = nil
+			if replyErr == nil {
+				replyErr = ErrClientDisconnected
+			}
 		}
-		replyErr = sendReply(innerqr.(*mproto.QueryResult))
 	}
 	if replyErr != nil {
 		allErrors.RecordError(replyErr)
 	}
-	return allErrors.Error()
+	return allErrors.AggrError(aggregateShardErrors)
+}
+
+// startStream records a StreamExecute of the client connection of
+// context, if it has one.
+func (stc *ScatterConn) startStream(context interface{}) *clientStream {
+	stream := &clientStream{conn: clientConn(context), done: make(chan struct{})}
+	if stream.conn == nil {
+		return stream
+	}
+	stc.streamsMu.Lock()
+	defer stc.streamsMu.Unlock()
+	if stc.streams[stream.conn] == nil {
+		stc.streams[stream.conn] = make(map[*clientStream]bool)
+	}
+	stc.streams[stream.conn][stream] = true
+	return stream
+}
+
+// endStream forgets a stream recorded by startStream.
+func (stc *ScatterConn) endStream(stream *clientStream) {
+	if stream.conn == nil {
+		return
+	}
+	stc.streamsMu.Lock()
+	defer stc.streamsMu.Unlock()
+	delete(stc.streams[stream.conn], stream)
+	if len(stc.streams[stream.conn]) == 0 {
+		delete(stc.streams, stream.conn)
+	}
+}
+
+// ConnClosed cancels the running StreamExecute calls of a client
+// connection that closed.
+func (stc *ScatterConn) ConnClosed(conn *rpcproto.Context) {
+	stc.streamsMu.Lock()
+	defer stc.streamsMu.Unlock()
+	for stream := range stc.streams[conn] {
+		stream.cancel("disconnect")
+	}
+}
+
+// isDone returns true if done is closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkMaxRows returns a *TooManyRowsError if rows exceeds maxRows,
+// and counts it. A maxRows of 0 is no limit.
+func checkMaxRows(keyspace string, rows, maxRows uint64) error {
+	if maxRows == 0 || rows <= maxRows {
+		return nil
+	}
+	tooManyRows.Add(keyspace, 1)
+	return &TooManyRowsError{Rows: rows, MaxRows: maxRows}
+}
+
+// forwardStream sends the results of sr to sResults until sr ends,
+// and returns the number of rows it sent, and true. If done is closed
+// first, the rest of sr is read in the background, so the shard
+// stream ends without being waited for once it's cancelled, and it
+// returns false.
+func forwardStream(sr <-chan *mproto.QueryResult, sResults chan<- interface{}, done <-chan struct{}) (rows int, ended bool) {
+	for {
+		select {
+		case qr, ok := <-sr:
+			if !ok {
+				return rows, true
+			}
+			select {
+			case sResults <- qr:
+				rows += len(qr.Rows)
+			case <-done:
+				go drainStream(sr)
+				return rows, false
+			}
+		case <-done:
+			go drainStream(sr)
+			return rows, false
+		}
+	}
+}
+
+// drainStream reads sr until it ends.
+func drainStream(sr <-chan *mproto.QueryResult) {
+	for _ = range sr {
+	}
 }
 
 // Commit commits the current transaction. There are no retries on this operation.
-func (stc *ScatterConn) Commit(context interface{}, session *SafeSession) (err error) {
+// A transaction whose session has MustRollback set is rolled back
+// instead, and Commit returns ErrMustRollback. If a shard fails to
+// commit, the shards after it are rolled back, and Commit returns a
+// *CommitError that says which shards committed. Either way the
+// session has no ShardSessions left.
+func (stc *ScatterConn) Commit(context interface{}, session *SafeSession) error {
 	if !session.InTransaction() {
 		return fmt.Errorf("cannot commit: not in transaction")
 	}
-	committing := true
-	for _, shardSession := range session.ShardSessions {
+	if session.MustRollback() {
+		stc.Rollback(context, session)
+		return ErrMustRollback
+	}
+	shardSessions := make([]*proto.ShardSession, len(session.ShardSessions))
+	copy(shardSessions, session.ShardSessions)
+	sort.Sort(shardSessionsByShard(shardSessions))
+	defer session.Reset()
+	for i, shardSession := range shardSessions {
 		sdc := stc.getConnection(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType)
-		if !committing {
-			go sdc.Rollback(context, shardSession.TransactionId)
+		err := sdc.Commit(context, shardSession.TransactionId)
+		stc.txRegistry.remove(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType, shardSession.TransactionId)
+		if err == nil {
 			continue
 		}
-		if err = sdc.Commit(context, shardSession.TransactionId); err != nil {
-			committing = false
+		commitErr := &CommitError{Failed: shardSessionName(shardSession), Err: err}
+		for _, committed := range shardSessions[:i] {
+			commitErr.Committed = append(commitErr.Committed, shardSessionName(committed))
 		}
+		remaining := shardSessions[i+1:]
+		for _, rolledBack := range remaining {
+			commitErr.RolledBack = append(commitErr.RolledBack, shardSessionName(rolledBack))
+		}
+		if err := stc.RollbackShardSessions(context, remaining); err != nil {
+			log.Warningf("cannot roll back the shards of a failed commit: %v", err)
+		}
+		return commitErr
 	}
-	session.Reset()
-	return err
+	return nil
+}
+
+// CommitError is returned by Commit when a shard fails to commit. The
+// shards are committed one at a time, sorted by keyspace, shard and
+// tablet type, and the first failure stops the commit: Committed are
+// the shards committed before Failed, which failed with Err, and
+// RolledBack the ones that were not committed, rolled back instead.
+// The shards are named "<keyspace>/<shard> (<tablet type>)".
+type CommitError struct {
+	Committed  []string
+	Failed     string
+	Err        error
+	RolledBack []string
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("vtgate: commit failed on shard %v: %v; committed: %v; rolled back: %v", e.Failed, e.Err, shardList(e.Committed), shardList(e.RolledBack))
+}
+
+// shardList returns the names of shards separated by commas, or
+// "none".
+func shardList(shards []string) string {
+	if len(shards) == 0 {
+		return "none"
+	}
+	return strings.Join(shards, ", ")
+}
+
+// shardSessionName returns the name of the shard of a ShardSession,
+// as "<keyspace>/<shard> (<tablet type>)".
+func shardSessionName(shardSession *proto.ShardSession) string {
+	return fmt.Sprintf("%v/%v (%v)", shardSession.Keyspace, shardSession.Shard, shardSession.TabletType)
+}
+
+// shardSessionsByShard sorts ShardSessions by keyspace, shard and
+// tablet type, the order of the commits.
+type shardSessionsByShard []*proto.ShardSession
+
+func (ss shardSessionsByShard) Len() int      { return len(ss) }
+func (ss shardSessionsByShard) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+func (ss shardSessionsByShard) Less(i, j int) bool {
+	if ss[i].Keyspace != ss[j].Keyspace {
+		return ss[i].Keyspace < ss[j].Keyspace
+	}
+	if ss[i].Shard != ss[j].Shard {
+		return ss[i].Shard < ss[j].Shard
+	}
+	return ss[i].TabletType < ss[j].TabletType
 }
 
 // Rollback rolls back the current transaction. There are no retries on this operation.
@@ -190,11 +624,59 @@ func (stc *ScatterConn) Rollback(context interface{}, session *SafeSession) (err
 	for _, shardSession := range session.ShardSessions {
 		sdc := stc.getConnection(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType)
 		go sdc.Rollback(context, shardSession.TransactionId)
+		stc.txRegistry.remove(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType, shardSession.TransactionId)
 	}
 	session.Reset()
 	return nil
 }
 
+// RollbackShardSessions rolls back shardSessions, all at once, and
+// waits for it. It's used for the transactions vtgate finishes itself,
+// see sessionRegistry.
+func (stc *ScatterConn) RollbackShardSessions(context interface{}, shardSessions []*proto.ShardSession) error {
+	allErrors := new(concurrency.AllErrorRecorder)
+	var wg sync.WaitGroup
+	for _, shardSession := range shardSessions {
+		wg.Add(1)
+		go func(shardSession *proto.ShardSession) {
+			defer wg.Done()
+			sdc := stc.getConnection(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType)
+			if err := sdc.Rollback(context, shardSession.TransactionId); err != nil {
+				allErrors.RecordError(err)
+			}
+			stc.txRegistry.remove(shardSession.Keyspace, shardSession.Shard, shardSession.TabletType, shardSession.TransactionId)
+		}(shardSession)
+	}
+	wg.Wait()
+	return allErrors.AggrError(aggregateShardErrors)
+}
+
+// RollbackOldTransactions rolls back the shard transactions of the
+// transaction registry that were begun more than minAge ago. The
+// clients of these transactions will get not_in_tx errors. It returns
+// the number of transactions rolled back.
+func (stc *ScatterConn) RollbackOldTransactions(context interface{}, minAge time.Duration) (int, error) {
+	if stc.txRegistry == nil {
+		return 0, fmt.Errorf("the transaction registry is disabled, see -tx_registry_size")
+	}
+	entries := stc.txRegistry.removeOlderThan(time.Now().Add(-minAge))
+	allErrors := new(concurrency.AllErrorRecorder)
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		log.Warningf("Rolling back transaction %v on %v/%v %v, begun at %v by %v", entry.TransactionId, entry.Keyspace, entry.Shard, entry.TabletType, entry.StartTime, entry.Caller)
+		wg.Add(1)
+		go func(entry TxEntry) {
+			defer wg.Done()
+			sdc := stc.getConnection(entry.Keyspace, entry.Shard, entry.TabletType)
+			if err := sdc.Rollback(context, entry.TransactionId); err != nil {
+				allErrors.RecordError(err)
+			}
+		}(entry)
+	}
+	wg.Wait()
+	return len(entries), allErrors.Error()
+}
+
 // Close closes the underlying ShardConn connections.
 func (stc *ScatterConn) Close() error {
 	stc.mu.Lock()
@@ -212,7 +694,11 @@ func (stc *ScatterConn) Close() error {
 // and updates the Session with the transaction id. If the session already
 // contains a transaction id for the shard, it reuses it.
 // If there are any unrecoverable errors during a transaction, multiGo
-// rolls back the transaction for all shards.
+// rolls back the transaction for all shards. If the action fails on
+// some of the shards but not on the others, the session is marked
+// MustRollback: the transaction is in a state the client didn't ask
+// for, and its next queries fail with ErrMustRollback.
+// At most stc.concurrency shards run the action at once, if set.
 // The action function must match the shardActionFunc signature.
 func (stc *ScatterConn) multiGo(
 	context interface{},
@@ -224,12 +710,27 @@ func (stc *ScatterConn) multiGo(
 ) (rResults <-chan interface{}, allErrors *concurrency.AllErrorRecorder) {
 	allErrors = new(concurrency.AllErrorRecorder)
 	results := make(chan interface{}, len(shards))
+	if session.MustRollback() {
+		allErrors.RecordError(ErrMustRollback)
+		close(results)
+		return results, allErrors
+	}
+	// slots limits the number of shards running at once
+	var slots chan struct{}
+	if stc.concurrency > 0 {
+		slots = make(chan struct{}, stc.concurrency)
+	}
 	var wg sync.WaitGroup
 	// We need the shards to be unique.
-	for shard := range unique(shards) {
+	uniqueShards := unique(shards)
+	for shard := range uniqueShards {
 		wg.Add(1)
 		go func(shard string) {
 			defer wg.Done()
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
 			stc.execShardAction(context, keyspace, shard, tabletType, session, action, allErrors, results)
 		}(shard)
 	}
@@ -243,6 +744,8 @@ func (stc *ScatterConn) multiGo(
 				// We cannot recover from these errors
 				if strings.Contains(errstr, "tx_pool_full") || strings.Contains(errstr, "not_in_tx") {
 					stc.Rollback(context, session)
+				} else if len(allErrors.Errors) < len(uniqueShards) {
+					session.SetMustRollback()
 				}
 			}
 		}
@@ -265,14 +768,23 @@ func (stc *ScatterConn) execShardAction(
 	allErrors *concurrency.AllErrorRecorder,
 	results chan interface{},
 ) {
+	startTime := time.Now()
+	tabletType = stc.tabletTypePolicy.fallbackTabletType(stc.toposerv, stc.cell, keyspace, shard, tabletType, session.InTransaction())
 	for {
 		sdc := stc.getConnection(keyspace, shard, tabletType)
 		transactionId, err := stc.updateSession(context, sdc, keyspace, shard, tabletType, session)
 		if err != nil {
 			allErrors.RecordError(err)
+			session.recordShardCall(keyspace, shard, startTime, err)
 			return
 		}
-		err = action(sdc, transactionId, results)
+		conn, pinnedUid := stc.pinnedConnection(context, sdc, keyspace, shard, tabletType, transactionId, session)
+		err = action(conn, transactionId, results)
+		if conn != sdc && isTabletError(err) {
+			// the next read pins another tablet
+			session.ClearTabletPin(keyspace, shard, tabletType, pinnedUid)
+			sdc.pinFailed(pinnedUid)
+		}
 		// Determine whether keyspace can be re-resolved
 		if shouldResolveKeyspace(err, transactionId) {
 			newKeyspace, err := getKeyspaceAlias(stc.toposerv, stc.cell, keyspace, tabletType)
@@ -285,10 +797,12 @@ func (stc *ScatterConn) execShardAction(
 		}
 		if err != nil {
 			allErrors.RecordError(err)
+			session.recordShardCall(keyspace, shard, startTime, err)
 			return
 		}
 		break
 	}
+	session.recordShardCall(keyspace, shard, startTime, nil)
 }
 
 func (stc *ScatterConn) cleanupShardConn(keyspace, shard string, tabletType topo.TabletType) {
@@ -334,6 +848,14 @@ func (stc *ScatterConn) updateSession(
 	if err != nil {
 		return 0, err
 	}
+	stc.txRegistry.add(&TxEntry{
+		Keyspace:      keyspace,
+		Shard:         shard,
+		TabletType:    tabletType,
+		TransactionId: transactionId,
+		Caller:        callerName(context),
+		StartTime:     time.Now(),
+	})
 	session.Append(&proto.ShardSession{
 		Keyspace:      keyspace,
 		TabletType:    tabletType,
@@ -343,6 +865,9 @@ func (stc *ScatterConn) updateSession(
 	return transactionId, nil
 }
 
+// appendResult merges innerqr into qr. qr shares the Fields and the
+// row values of innerqr, which belong to the tablet connection:
+// qr must be copied before it is handed out.
 func appendResult(qr, innerqr *mproto.QueryResult) {
 	if qr.Fields == nil {
 		qr.Fields = innerqr.Fields
@@ -354,6 +879,17 @@ func appendResult(qr, innerqr *mproto.QueryResult) {
 	qr.Rows = append(qr.Rows, innerqr.Rows...)
 }
 
+func appendLazyResult(qr, innerqr *mproto.LazyQueryResult) {
+	if qr.Fields == nil {
+		qr.Fields = innerqr.Fields
+	}
+	qr.RowsAffected += innerqr.RowsAffected
+	if innerqr.InsertId != 0 {
+		qr.InsertId = innerqr.InsertId
+	}
+	qr.Rows = append(qr.Rows, innerqr.Rows...)
+}
+
 func unique(in []string) map[string]struct{} {
 	out := make(map[string]struct{}, len(in))
 	for _, v := range in {
@@ -371,3 +907,127 @@ func shouldResolveKeyspace(err error, transactionId int64) bool {
 	}
 	return false
 }
+
+// ScatterConnError is the error of a query sent to one or more
+// shards. Its message lists the error of each shard, in shard order,
+// for instance "shard ks/-80: ...; shard ks/80-: ...".
+type ScatterConnError struct {
+	// Code is the most severe of the tablet error codes of the
+	// shards, see errorSeverity.
+	Code int
+
+	// Errs are the errors of the shards, usually *ShardConnError,
+	// with the full detail of what each shard said.
+	Errs []error
+}
+
+func (e *ScatterConnError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		if shardConnErr, ok := err.(*ShardConnError); ok {
+			msgs[i] = fmt.Sprintf("shard %v: %v", shardName(shardConnErr.Keyspace, shardConnErr.Shard), shardConnErr.Err)
+		} else {
+			msgs[i] = err.Error()
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// shardName returns keyspace/shard, or shard if keyspace is empty.
+func shardName(keyspace, shard string) string {
+	if keyspace == "" {
+		return shard
+	}
+	return keyspace + "/" + shard
+}
+
+// RpcCode returns the proto.RpcError code of the error: the one of
+// Code, or ERR_INTEGRITY_ERROR if Code is ERR_NORMAL and a shard
+// failed on a constraint.
+func (e *ScatterConnError) RpcCode() int {
+	code := rpcErrorCode(e.Code, "")
+	if code != proto.ERR_NORMAL {
+		return code
+	}
+	for _, err := range e.Errs {
+		if rpcErrorCode(tabletconn.ERR_NORMAL, err.Error()) == proto.ERR_INTEGRITY_ERROR {
+			return proto.ERR_INTEGRITY_ERROR
+		}
+	}
+	return code
+}
+
+// integrityErrnos are the MySQL errors of the statements that violate
+// a constraint, as the tablets write them in their error strings:
+// duplicate key, foreign keys and NOT NULL columns.
+var integrityErrnos = []string{"(errno 1062)", "(errno 1451)", "(errno 1452)", "(errno 1048)"}
+
+// rpcErrorCode returns the proto.RpcError code of a tablet error, from
+// its tablet error code and its message.
+func rpcErrorCode(code int, msg string) int {
+	switch code {
+	case tabletconn.ERR_RETRY, tabletconn.ERR_OVERLOADED:
+		return proto.ERR_RETRY
+	case tabletconn.ERR_FATAL:
+		return proto.ERR_FATAL
+	case tabletconn.ERR_TX_POOL_FULL:
+		return proto.ERR_TX_POOL_FULL
+	case tabletconn.ERR_NOT_IN_TX:
+		return proto.ERR_NOT_IN_TX
+	}
+	for _, errno := range integrityErrnos {
+		if strings.Contains(msg, errno) {
+			return proto.ERR_INTEGRITY_ERROR
+		}
+	}
+	return proto.ERR_NORMAL
+}
+
+// errorSeverity ranks the tablet error codes. A query can only be
+// retried as a whole if all its shards said so, so the retryable
+// codes are the least severe.
+var errorSeverity = map[int]int{
+	tabletconn.ERR_RETRY:        0,
+	tabletconn.ERR_TX_POOL_FULL: 1,
+	tabletconn.ERR_NORMAL:       2,
+	tabletconn.ERR_NOT_IN_TX:    3,
+	tabletconn.ERR_FATAL:        4,
+}
+
+// aggregateShardErrors is a concurrency.AllErrorAggregator that
+// merges the errors of the shards into a *ScatterConnError.
+// Errors that don't come from a shard are treated as ERR_NORMAL.
+func aggregateShardErrors(errors []error) error {
+	errs := make([]error, len(errors))
+	copy(errs, errors)
+	sort.Stable(byShard(errs))
+	code := tabletconn.ERR_RETRY
+	for _, err := range errs {
+		errCode := tabletconn.ERR_NORMAL
+		if shardConnErr, ok := err.(*ShardConnError); ok {
+			errCode = shardConnErr.Code
+		}
+		if errorSeverity[errCode] > errorSeverity[code] {
+			code = errCode
+		}
+	}
+	return &ScatterConnError{Code: code, Errs: errs}
+}
+
+// byShard sorts errors by keyspace and shard, with the errors that
+// don't come from a shard last.
+type byShard []error
+
+func (bs byShard) Len() int      { return len(bs) }
+func (bs byShard) Swap(i, j int) { bs[i], bs[j] = bs[j], bs[i] }
+func (bs byShard) Less(i, j int) bool {
+	ei, iok := bs[i].(*ShardConnError)
+	ej, jok := bs[j].(*ShardConnError)
+	if !iok || !jok {
+		return iok && !jok
+	}
+	if ei.Keyspace != ej.Keyspace {
+		return ei.Keyspace < ej.Keyspace
+	}
+	return ei.Shard < ej.Shard
+}
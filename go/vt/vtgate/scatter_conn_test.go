@@ -7,11 +7,16 @@ package vtgate
 import (
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	mproto "github.com/youtube/vitess/go/mysql/proto"
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/sync2"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
 
@@ -20,7 +25,7 @@ import (
 func TestScatterConnExecute(t *testing.T) {
 	testScatterConnGeneric(t, func(shards []string) (*mproto.QueryResult, error) {
 		stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
-		return stc.Execute(nil, "query", nil, "", shards, "", nil)
+		return stc.Execute(nil, "query", nil, "", shards, "", nil, 0)
 	})
 }
 
@@ -64,7 +69,7 @@ func testScatterConnGeneric(t *testing.T, f func(shards []string) (*mproto.Query
 	sbc := &sandboxConn{mustFailServer: 1}
 	testConns[0] = sbc
 	qr, err = f([]string{"0"})
-	want := "error: err, shard, host: .0., {Uid:0 Host:0 NamedPortMap:map[vt:1]}"
+	want := "shard 0: error: err"
 	// Verify server error string.
 	if err == nil || err.Error() != want {
 		t.Errorf("want %s, got %v", want, err)
@@ -82,7 +87,7 @@ func testScatterConnGeneric(t *testing.T, f func(shards []string) (*mproto.Query
 	testConns[1] = sbc1
 	_, err = f([]string{"0", "1"})
 	// Verify server errors are consolidated.
-	want = "error: err, shard, host: .0., {Uid:0 Host:0 NamedPortMap:map[vt:1]}\nerror: err, shard, host: .1., {Uid:1 Host:1 NamedPortMap:map[vt:1]}"
+	want = "shard 0: error: err; shard 1: error: err"
 	if err == nil || err.Error() != want {
 		t.Errorf("\nwant\n%s\ngot\n%v", want, err)
 	}
@@ -143,6 +148,330 @@ func TestScatterConnStreamExecuteSendError(t *testing.T) {
 	}
 }
 
+// delayedStreamConn is a streamRowsConn that only streams once start
+// is closed.
+type delayedStreamConn struct {
+	streamRowsConn
+	start chan struct{}
+}
+
+func (sbc *delayedStreamConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	<-sbc.start
+	return sbc.streamRowsConn.StreamExecute(context, query, bindVars, transactionId)
+}
+
+func TestScatterConnErrorRpcCode(t *testing.T) {
+	dupKey := &ShardConnError{Code: tabletconn.ERR_NORMAL, Shard: "0", Err: "error: Duplicate entry '1' for key 'PRIMARY' (errno 1062)"}
+	badQuery := &ShardConnError{Code: tabletconn.ERR_NORMAL, Shard: "1", Err: "error: syntax error (errno 1064)"}
+	notInTx := &ShardConnError{Code: tabletconn.ERR_NOT_IN_TX, Shard: "2", Err: "not_in_tx: err"}
+	testCases := []struct {
+		errs []error
+		want int
+	}{
+		{[]error{dupKey}, proto.ERR_INTEGRITY_ERROR},
+		{[]error{badQuery}, proto.ERR_NORMAL},
+		{[]error{badQuery, dupKey}, proto.ERR_INTEGRITY_ERROR},
+		// a more severe error wins
+		{[]error{dupKey, notInTx}, proto.ERR_NOT_IN_TX},
+		{[]error{&ShardConnError{Code: tabletconn.ERR_RETRY, Err: "retry: err"}}, proto.ERR_RETRY},
+		{[]error{&ShardConnError{Code: tabletconn.ERR_FATAL, Err: "fatal: err"}}, proto.ERR_FATAL},
+		{[]error{&ShardConnError{Code: tabletconn.ERR_TX_POOL_FULL, Err: "tx_pool_full: err"}}, proto.ERR_TX_POOL_FULL},
+		{[]error{fmt.Errorf("not from a shard")}, proto.ERR_NORMAL},
+	}
+	for _, tc := range testCases {
+		err := aggregateShardErrors(tc.errs).(*ScatterConnError)
+		if got := err.RpcCode(); got != tc.want {
+			t.Errorf("%v: want %v, got %v", err, tc.want, got)
+		}
+	}
+}
+
+func TestScatterConnStreamExecuteShardFailure(t *testing.T) {
+	resetSandbox()
+	sbc0 := &sandboxConn{mustFailServer: 1}
+	testConns[0] = sbc0
+	sbc1 := &delayedStreamConn{start: make(chan struct{})}
+	sbc1.results = []*mproto.QueryResult{singleRowResult, singleRowResult}
+	testConns[1] = sbc1
+	go func() {
+		// shard 1 streams once shard 0 failed
+		for sbc0.ExecCount.Get() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(sbc1.start)
+	}()
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+	replies := 0
+	err := stc.StreamExecute(nil, "query", nil, "", []string{"0", "1"}, "", nil, func(*mproto.QueryResult) error {
+		replies++
+		return nil
+	})
+	if want := "shard 0: error: err"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if replies != 0 {
+		t.Errorf("want no replies after the failure, got %v", replies)
+	}
+}
+
+// slowStreamConn streams count results without buffering them, and
+// closes drained once they were all read.
+type slowStreamConn struct {
+	sandboxConn
+	count   int
+	drained chan struct{}
+}
+
+func (sbc *slowStreamConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	sbc.ExecCount.Add(1)
+	ch := make(chan *mproto.QueryResult)
+	go func() {
+		for i := 0; i < sbc.count; i++ {
+			ch <- singleRowResult
+		}
+		close(ch)
+		close(sbc.drained)
+	}()
+	return ch, func() error { return nil }
+}
+
+func TestScatterConnStreamExecuteReplyFailure(t *testing.T) {
+	resetSandbox()
+	sbc0 := &slowStreamConn{count: 100, drained: make(chan struct{})}
+	testConns[0] = sbc0
+	sbc1 := &slowStreamConn{count: 100, drained: make(chan struct{})}
+	testConns[1] = sbc1
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+	replies := 0
+	err := stc.StreamExecute(nil, "query", nil, "", []string{"0", "1"}, "", nil, func(*mproto.QueryResult) error {
+		replies++
+		return fmt.Errorf("client is gone")
+	})
+	if want := "client is gone"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if replies != 1 {
+		t.Errorf("want 1 reply, got %v", replies)
+	}
+	// the shards don't wait for a reader that is gone
+	for i, sbc := range []*slowStreamConn{sbc0, sbc1} {
+		select {
+		case <-sbc.drained:
+		case <-time.After(5 * time.Second):
+			t.Errorf("the stream of shard %v was not drained", i)
+		}
+	}
+}
+
+// stalledStreamConn streams nothing until release is closed.
+type stalledStreamConn struct {
+	sandboxConn
+	release chan struct{}
+}
+
+func (sbc *stalledStreamConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	sbc.ExecCount.Add(1)
+	ch := make(chan *mproto.QueryResult)
+	go func() {
+		<-sbc.release
+		ch <- singleRowResult
+		close(ch)
+	}()
+	return ch, func() error { return nil }
+}
+
+func TestScatterConnStreamExecuteDeadline(t *testing.T) {
+	resetSandbox()
+	sbc := &stalledStreamConn{release: make(chan struct{})}
+	defer close(sbc.release)
+	testConns[0] = sbc
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	context := &tabletconn.RequestContext{Deadline: time.Now().Add(1 * time.Millisecond)}
+	err := stc.StreamExecute(context, "query", nil, "", []string{"0"}, "", nil, func(*mproto.QueryResult) error {
+		return nil
+	})
+	if want := "vtgate: deadline exceeded"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+// closableStreamConn streams a result every 10ms for a second, its
+// streams end when it's closed. running counts the running streams.
+type closableStreamConn struct {
+	sandboxConn
+	running   *sync.WaitGroup
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newClosableStreamConn(running *sync.WaitGroup) *closableStreamConn {
+	return &closableStreamConn{running: running, closed: make(chan struct{})}
+}
+
+func (sbc *closableStreamConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	sbc.ExecCount.Add(1)
+	sbc.running.Add(1)
+	ch := make(chan *mproto.QueryResult)
+	go func() {
+		defer sbc.running.Done()
+		defer close(ch)
+		for i := 0; i < 100; i++ {
+			select {
+			case ch <- singleRowResult:
+			case <-sbc.closed:
+				return
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-sbc.closed:
+				return
+			}
+		}
+	}()
+	return ch, func() error { return nil }
+}
+
+func (sbc *closableStreamConn) Close() {
+	sbc.CloseCount.Add(1)
+	sbc.closeOnce.Do(func() { close(sbc.closed) })
+}
+
+// waitStreams fails t if the streams of running don't end within
+// 200ms, a fifth of the time they take when they're not cancelled.
+func waitStreams(t *testing.T, running *sync.WaitGroup) {
+	ended := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(200 * time.Millisecond):
+		t.Errorf("the shard streams were not cancelled")
+	}
+}
+
+func TestScatterConnStreamExecuteCancel(t *testing.T) {
+	resetSandbox()
+	var running sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		testConns[uint32(i)] = newClosableStreamConn(&running)
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	before := streamsCancelled.Counts()["send"]
+	replies := 0
+	err := stc.StreamExecute(nil, "query", nil, "", []string{"0", "1", "2"}, "", nil, func(*mproto.QueryResult) error {
+		replies++
+		return fmt.Errorf("client is gone")
+	})
+	if want := "client is gone"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if replies != 1 {
+		t.Errorf("want 1 reply, got %v", replies)
+	}
+	waitStreams(t, &running)
+	if got := streamsCancelled.Counts()["send"] - before; got != 1 {
+		t.Errorf("want 1 cancelled stream, got %v", got)
+	}
+}
+
+func TestScatterConnStreamExecuteConnClosed(t *testing.T) {
+	resetSandbox()
+	var running sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		testConns[uint32(i)] = newClosableStreamConn(&running)
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	before := streamsCancelled.Counts()["disconnect"]
+	conn := &rpcproto.Context{RemoteAddr: "client"}
+	firstReply := make(chan struct{})
+	var once sync.Once
+	errs := make(chan error)
+	go func() {
+		errs <- stc.StreamExecute(conn, "query", nil, "", []string{"0", "1", "2"}, "", nil, func(*mproto.QueryResult) error {
+			once.Do(func() { close(firstReply) })
+			return nil
+		})
+	}()
+	<-firstReply
+	// the other connections are not affected
+	stc.ConnClosed(&rpcproto.Context{RemoteAddr: "other"})
+	stc.ConnClosed(conn)
+	select {
+	case err := <-errs:
+		if err == nil || err.Error() != ErrClientDisconnected.Error() {
+			t.Errorf("want %v, got %v", ErrClientDisconnected, err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("the stream was not cancelled")
+	}
+	waitStreams(t, &running)
+	if got := streamsCancelled.Counts()["disconnect"] - before; got != 1 {
+		t.Errorf("want 1 cancelled stream, got %v", got)
+	}
+	if len(stc.streams) != 0 {
+		t.Errorf("want no running streams, got %v", stc.streams)
+	}
+}
+
+func TestScatterConnErrors(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		conns []*sandboxConn
+		want  string
+		code  int
+	}{{
+		desc:  "single failure",
+		conns: []*sandboxConn{{}, {mustFailServer: 1}},
+		want:  "shard 1: error: err",
+		code:  tabletconn.ERR_NORMAL,
+	}, {
+		desc:  "multiple failures",
+		conns: []*sandboxConn{{mustFailServer: 1}, {mustFailServer: 1}, {mustFailServer: 1}},
+		want:  "shard 0: error: err; shard 1: error: err; shard 2: error: err",
+		code:  tabletconn.ERR_NORMAL,
+	}, {
+		desc:  "all retryable",
+		conns: []*sandboxConn{{mustFailRetry: 10}, {mustFailTxPool: 10}},
+		want:  "shard 0: retry: err; shard 1: tx_pool_full: err",
+		code:  tabletconn.ERR_TX_POOL_FULL,
+	}, {
+		desc:  "mixed categories",
+		conns: []*sandboxConn{{mustFailRetry: 10}, {mustFailFatal: 10}, {mustFailServer: 1}},
+		want:  "shard 0: retry: err; shard 1: fatal: err; shard 2: error: err",
+		code:  tabletconn.ERR_FATAL,
+	}}
+	for _, tc := range testCases {
+		resetSandbox()
+		var shards []string
+		for i, sbc := range tc.conns {
+			testConns[uint32(i)] = sbc
+			shards = append(shards, fmt.Sprintf("%v", i))
+		}
+		stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+		_, err := stc.Execute(nil, "query", nil, "", shards, "", nil, 0)
+		scatterConnErr, ok := err.(*ScatterConnError)
+		if !ok {
+			t.Errorf("%v: want *ScatterConnError, got %#v", tc.desc, err)
+			continue
+		}
+		if got := scatterConnErr.Error(); got != tc.want {
+			t.Errorf("%v: want %v, got %v", tc.desc, tc.want, got)
+		}
+		if scatterConnErr.Code != tc.code {
+			t.Errorf("%v: want code %v, got %v", tc.desc, tc.code, scatterConnErr.Code)
+		}
+		// the per-shard errors keep the full detail
+		for _, e := range scatterConnErr.Errs {
+			if shardConnErr, ok := e.(*ShardConnError); !ok || shardConnErr.ShardIdentifier == "" {
+				t.Errorf("%v: unexpected shard error %#v", tc.desc, e)
+			}
+		}
+	}
+}
+
 func TestScatterConnCommitSuccess(t *testing.T) {
 	resetSandbox()
 	sbc0 := &sandboxConn{}
@@ -153,7 +482,7 @@ func TestScatterConnCommitSuccess(t *testing.T) {
 
 	// Sequence the executes to ensure commit order
 	session := NewSafeSession(&proto.Session{InTransaction: true})
-	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", session)
+	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", session, 0)
 	wantSession := proto.Session{
 		InTransaction: true,
 		ShardSessions: []*proto.ShardSession{{
@@ -166,7 +495,7 @@ func TestScatterConnCommitSuccess(t *testing.T) {
 	if !reflect.DeepEqual(wantSession, *session.Session) {
 		t.Errorf("want\n%#v, got\n%#v", wantSession, *session.Session)
 	}
-	stc.Execute(nil, "query1", nil, "", []string{"0", "1"}, "", session)
+	stc.Execute(nil, "query1", nil, "", []string{"0", "1"}, "", session, 0)
 	wantSession = proto.Session{
 		InTransaction: true,
 		ShardSessions: []*proto.ShardSession{{
@@ -205,6 +534,62 @@ func TestScatterConnCommitSuccess(t *testing.T) {
 	*/
 }
 
+func TestScatterConnCommitOrder(t *testing.T) {
+	resetSandbox()
+	sbcs := []*sandboxConn{{}, {}, {}}
+	for i, sbc := range sbcs {
+		testConns[uint32(i)] = sbc
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+
+	// the shards are committed in order, not in the order the
+	// transaction reached them
+	session := NewSafeSession(&proto.Session{InTransaction: true})
+	for _, shard := range []string{"2", "0", "1"} {
+		if _, err := stc.Execute(nil, "query", nil, "ks", []string{shard}, "master", session, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sbcs[1].mustFailServer = 1
+	err := stc.Commit(nil, session)
+	commitErr, ok := err.(*CommitError)
+	if !ok {
+		t.Fatalf("want *CommitError, got %v", err)
+	}
+	if want := []string{"ks/0 (master)"}; !reflect.DeepEqual(commitErr.Committed, want) {
+		t.Errorf("want committed %v, got %v", want, commitErr.Committed)
+	}
+	if want := "ks/1 (master)"; commitErr.Failed != want {
+		t.Errorf("want failed %v, got %v", want, commitErr.Failed)
+	}
+	if want := []string{"ks/2 (master)"}; !reflect.DeepEqual(commitErr.RolledBack, want) {
+		t.Errorf("want rolled back %v, got %v", want, commitErr.RolledBack)
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "vtgate: commit failed on shard ks/1 (master): error: err") || !strings.HasSuffix(msg, "; committed: ks/0 (master); rolled back: ks/2 (master)") {
+		t.Errorf("unexpected error %v", msg)
+	}
+	for i, counts := range [][2]int64{{1, 0}, {1, 0}, {0, 1}} {
+		if got := [2]int64{sbcs[i].CommitCount.Get(), sbcs[i].RollbackCount.Get()}; got != counts {
+			t.Errorf("shard %v: want %v commits and rollbacks, got %v", i, counts, got)
+		}
+	}
+	if !reflect.DeepEqual(*session.Session, proto.Session{}) {
+		t.Errorf("want no ShardSessions left, got %#v", *session.Session)
+	}
+
+	// without failure, everything is committed
+	session = NewSafeSession(&proto.Session{InTransaction: true})
+	if _, err := stc.Execute(nil, "query", nil, "ks", []string{"0", "1"}, "master", session, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := stc.Commit(nil, session); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if got := sbcs[1].CommitCount.Get(); got != 2 {
+		t.Errorf("want 2 commits on shard 1, got %v", got)
+	}
+}
+
 func TestScatterConnRollback(t *testing.T) {
 	resetSandbox()
 	sbc0 := &sandboxConn{}
@@ -215,8 +600,8 @@ func TestScatterConnRollback(t *testing.T) {
 
 	// Sequence the executes to ensure commit order
 	session := NewSafeSession(&proto.Session{InTransaction: true})
-	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", session)
-	stc.Execute(nil, "query1", nil, "", []string{"0", "1"}, "", session)
+	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", session, 0)
+	stc.Execute(nil, "query1", nil, "", []string{"0", "1"}, "", session, 0)
 	err := stc.Rollback(nil, session)
 	if err != nil {
 		t.Errorf("want nil, got %v", err)
@@ -242,7 +627,7 @@ func TestScatterConnClose(t *testing.T) {
 	sbc := &sandboxConn{}
 	testConns[0] = sbc
 	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
-	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", nil)
+	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", nil, 0)
 	stc.Close()
 	/*
 		// Flaky: This test should be run manually.
@@ -252,3 +637,181 @@ func TestScatterConnClose(t *testing.T) {
 		}
 	*/
 }
+
+func TestScatterConnExecuteMaxRows(t *testing.T) {
+	resetSandbox()
+	for i := 0; i < 3; i++ {
+		testConns[uint32(i)] = &sandboxConn{}
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+	shards := []string{"0", "1", "2"}
+	qr, err := stc.ExecuteLazy(nil, "query", nil, "", shards, "", nil, 3)
+	if err != nil || len(qr.Rows) != 3 {
+		t.Errorf("want 3 rows, got %v, %v", qr, err)
+	}
+	_, err = stc.Execute(nil, "query", nil, "", shards, "", nil, 1)
+	if tooMany, ok := err.(*TooManyRowsError); !ok || tooMany.MaxRows != 1 || tooMany.Rows < 2 {
+		t.Errorf("want *TooManyRowsError, got %#v", err)
+	}
+}
+
+func TestScatterConnExecutePartialResults(t *testing.T) {
+	resetSandbox()
+	// shard 0 works, shard 1 fails and shard 2 doesn't answer before
+	// the deadline
+	testConns[0] = &sandboxConn{}
+	testConns[1] = &sandboxConn{mustFailServer: 1}
+	testConns[2] = &sandboxConn{mustDelay: time.Second}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	context := &tabletconn.RequestContext{Deadline: time.Now().Add(50 * time.Millisecond)}
+	start := time.Now()
+	qr, err := stc.Execute(context, "query", nil, "", []string{"0", "1", "2"}, "", nil, 0)
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Execute waited for the hanging shard: %v", elapsed)
+	}
+	if qr == nil || len(qr.Rows) != 1 {
+		t.Errorf("want the row of shard 0, got %v", qr)
+	}
+	scatterErr, ok := err.(*ScatterConnError)
+	if !ok || len(scatterErr.Errs) != 2 {
+		t.Fatalf("want the errors of shards 1 and 2, got %#v", err)
+	}
+	if want := "shard 1: error: err; shard 2: vtgate: deadline exceeded"; err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	// all the shards fail
+	resetSandbox()
+	testConns[0] = &sandboxConn{mustFailServer: 1}
+	testConns[1] = &sandboxConn{mustFailServer: 1}
+	stc = NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	lazyqr, err := stc.ExecuteLazy(nil, "query", nil, "", []string{"0", "1"}, "", nil, 0)
+	if lazyqr != nil || err == nil {
+		t.Errorf("want no result and an error, got %v, %v", lazyqr, err)
+	}
+}
+
+// countingConn records the number of its executes running at once,
+// which it makes last a while.
+type countingConn struct {
+	sandboxConn
+	running *sync2.AtomicInt32
+	max     *sync2.AtomicInt32
+}
+
+func (sbc *countingConn) Execute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.QueryResult, error) {
+	running := sbc.running.Add(1)
+	defer sbc.running.Add(-1)
+	for {
+		max := sbc.max.Get()
+		if running <= max || sbc.max.CompareAndSwap(max, running) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return sbc.sandboxConn.Execute(context, query, bindVars, transactionId)
+}
+
+func TestScatterConnConcurrency(t *testing.T) {
+	resetSandbox()
+	var running, max sync2.AtomicInt32
+	shards := []string{"0", "1", "2", "3", "4"}
+	for i := range shards {
+		testConns[uint32(i)] = &countingConn{running: &running, max: &max}
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	stc.concurrency = 2
+	qr, err := stc.Execute(nil, "query", nil, "", shards, "", nil, 0)
+	if err != nil || len(qr.Rows) != 5 {
+		t.Errorf("want 5 rows, got %v, %v", qr, err)
+	}
+	if got := max.Get(); got != 2 {
+		t.Errorf("want 2 shards at most at once, got %v", got)
+	}
+}
+
+func TestScatterConnMustRollback(t *testing.T) {
+	resetSandbox()
+	sbc0 := &sandboxConn{}
+	testConns[0] = sbc0
+	sbc1 := &sandboxConn{mustFailServer: 1}
+	testConns[1] = sbc1
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+
+	// a failure on a single shard leaves the transaction as it was
+	session := NewSafeSession(&proto.Session{InTransaction: true})
+	if _, err := stc.Execute(nil, "query1", nil, "", []string{"1"}, "", session, 0); err == nil {
+		t.Errorf("want an error, got nil")
+	}
+	if session.MustRollback() {
+		t.Errorf("want a transaction that can go on")
+	}
+
+	// a query of the transaction fails on shard 1 only
+	sbc1.mustFailServer = 1
+	qr, err := stc.Execute(nil, "query1", nil, "", []string{"0", "1"}, "", session, 0)
+	if want := "shard 1: error: err"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if qr == nil || len(qr.Rows) != 1 {
+		t.Errorf("want the row of shard 0, got %v", qr)
+	}
+	if !session.MustRollback() {
+		t.Fatalf("want a transaction that must be rolled back")
+	}
+
+	// its next queries fail without reaching the shards
+	execCount := sbc0.ExecCount.Get()
+	qr, err = stc.Execute(nil, "query2", nil, "", []string{"0"}, "", session, 0)
+	if qr != nil || err == nil || err.Error() != ErrMustRollback.Error() {
+		t.Errorf("want %v, got %v, %v", ErrMustRollback, qr, err)
+	}
+	if got := sbc0.ExecCount.Get(); got != execCount {
+		t.Errorf("want %v executes, got %v", execCount, got)
+	}
+
+	// and so does its commit, which rolls it back
+	if err := stc.Commit(nil, session); err != ErrMustRollback {
+		t.Errorf("want %v, got %v", ErrMustRollback, err)
+	}
+	if wantSession := (proto.Session{}); !reflect.DeepEqual(wantSession, *session.Session) {
+		t.Errorf("want\n%#v, got\n%#v", wantSession, *session.Session)
+	}
+	if sbc0.CommitCount.Get() != 0 || sbc1.CommitCount.Get() != 0 {
+		t.Errorf("want no commit, got %v and %v", sbc0.CommitCount.Get(), sbc1.CommitCount.Get())
+	}
+}
+
+func TestScatterConnRetryInTransaction(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+	session := NewSafeSession(&proto.Session{InTransaction: true})
+	stc.Execute(nil, "query1", nil, "", []string{"0"}, "", session, 0)
+	wantSession := proto.Session{
+		InTransaction: true,
+		ShardSessions: []*proto.ShardSession{{Shard: "0", TransactionId: 1}},
+	}
+	if !reflect.DeepEqual(wantSession, *session.Session) {
+		t.Fatalf("want\n%#v, got\n%#v", wantSession, *session.Session)
+	}
+
+	// the query of a transaction that hit a tablet going away is not
+	// retried, and its shard transaction is not begun again behind
+	// the back of the client
+	sbc.mustFailRetry = 1
+	if _, err := stc.Execute(nil, "query2", nil, "", []string{"0"}, "", session, 0); err == nil {
+		t.Errorf("want an error, got nil")
+	}
+	// the begin and the two executes
+	if got := sbc.ExecCount.Get(); got != 3 {
+		t.Errorf("want 3 calls, got %v", got)
+	}
+	if got := sbc.BeginCount.Get(); got != 1 {
+		t.Errorf("want 1 begin, got %v", got)
+	}
+	if !reflect.DeepEqual(wantSession, *session.Session) {
+		t.Errorf("want\n%#v, got\n%#v", wantSession, *session.Session)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"container/list"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	sessionMaxAge               = flag.Duration("session_max_age", time.Hour, "time after which vtgate forgets a session it began, and fails its Commit and Rollback with a session not found error. The sessions must then be finished through the vtgate that began them. 0 disables the session checks.")
+	sessionIdleTimeout          = flag.Duration("session_idle_timeout", 0, "time after which vtgate rolls back the transaction of a session it began that saw no request, and forgets the session. 0 never does it. It needs -session_max_age.")
+	sessionRollbackOnDisconnect = flag.Bool("session_rollback_on_disconnect", true, "roll back the transactions of the sessions whose client connection closed, and forget the sessions. It needs -session_max_age.")
+)
+
+// ErrSessionNotFound is returned by Commit and Rollback for a Session
+// this vtgate didn't begin, or already finished, or that is older
+// than -session_max_age. Nothing is committed: a Commit that timed out
+// and is retried gets it if the first one went through.
+var ErrSessionNotFound = errors.New("vtgate: session not found")
+
+type sessionEntry struct {
+	sessionId int64
+	startTime time.Time
+
+	// conn is the client connection of the last request of the
+	// session, nil if it has none
+	conn *rpcproto.Context
+	// lastUsed is the time the last request of the session ended
+	lastUsed time.Time
+	// inUse is the number of requests of the session running
+	inUse int
+	// disconnected is set when conn closed while requests of the
+	// session were running: the last one rolls it back
+	disconnected bool
+	// shardSessions are the ShardSessions of the session after its
+	// last request
+	shardSessions []*proto.ShardSession
+}
+
+// sessionRegistry keeps track of the Sessions this vtgate began,
+// until they're committed or rolled back, or older than maxAge.
+// The Sessions begun before the registry existed, and those of old
+// clients, have no SessionId: they are not checked.
+// The transactions of the sessions idle for idleTimeout, if set, or
+// whose client connection closed, if rollbackOnDisconnect is set, are
+// rolled back with rollback, and the sessions forgotten: their client
+// is likely gone, and they hold locks on the tablets.
+// A nil *sessionRegistry doesn't check anything.
+type sessionRegistry struct {
+	maxAge               time.Duration
+	idleTimeout          time.Duration
+	rollbackOnDisconnect bool
+	rollback             func(shardSessions []*proto.ShardSession)
+
+	// expired counts the sessions dropped because of their age
+	expired *stats.Int
+	// reaped counts the sessions rolled back by the registry, by
+	// "idle" or "disconnect"
+	reaped *stats.Counters
+
+	mu sync.Mutex
+	// lastId is the last SessionId given out. It starts at the
+	// time the registry was created, so the ids of a previous
+	// process are not reused.
+	lastId int64
+	// entries has the *sessionEntry, oldest first
+	entries *list.List
+	byId    map[int64]*list.Element
+}
+
+// newSessionRegistry creates a sessionRegistry, or returns nil if
+// maxAge is 0. If name is not empty, it exports <name>Size,
+// <name>Expired and <name>Reaped.
+func newSessionRegistry(name string, maxAge, idleTimeout time.Duration, rollbackOnDisconnect bool, rollback func(shardSessions []*proto.ShardSession)) *sessionRegistry {
+	if maxAge <= 0 {
+		return nil
+	}
+	sr := &sessionRegistry{
+		maxAge:               maxAge,
+		idleTimeout:          idleTimeout,
+		rollbackOnDisconnect: rollbackOnDisconnect,
+		rollback:             rollback,
+		expired:              new(stats.Int),
+		reaped:               stats.NewCounters(""),
+		lastId:               time.Now().UnixNano(),
+		entries:              list.New(),
+		byId:                 make(map[int64]*list.Element),
+	}
+	if name != "" {
+		stats.Publish(name+"Size", stats.IntFunc(sr.Size))
+		stats.Publish(name+"Expired", sr.expired)
+		stats.Publish(name+"Reaped", sr.reaped)
+	}
+	return sr
+}
+
+// clientConn returns the client connection of a request, nil if it
+// has none.
+func clientConn(context interface{}) *rpcproto.Context {
+	if ctx, ok := context.(*tabletconn.RequestContext); ok {
+		context = ctx.Context
+	}
+	conn, _ := context.(*rpcproto.Context)
+	return conn
+}
+
+// Size returns the number of sessions.
+func (sr *sessionRegistry) Size() int64 {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return int64(sr.entries.Len())
+}
+
+// begin gives session a SessionId and a TransactionStartTime, and
+// records it.
+func (sr *sessionRegistry) begin(context interface{}, session *proto.Session) {
+	if sr == nil {
+		return
+	}
+	now := time.Now()
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.expireLocked(now)
+	sr.lastId++
+	entry := &sessionEntry{
+		sessionId: sr.lastId,
+		startTime: now,
+		conn:      clientConn(context),
+		lastUsed:  now,
+	}
+	sr.byId[entry.sessionId] = sr.entries.PushBack(entry)
+	session.SessionId = entry.sessionId
+	session.TransactionStartTime = now.UnixNano()
+}
+
+// end forgets session, which is being committed or rolled back. It
+// returns ErrSessionNotFound if session is not in the registry.
+// Sessions without SessionId are not checked.
+func (sr *sessionRegistry) end(session *proto.Session) error {
+	if sr == nil || session == nil || session.SessionId == 0 {
+		return nil
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.expireLocked(time.Now())
+	element, ok := sr.byId[session.SessionId]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	sr.removeLocked(element)
+	return nil
+}
+
+// use records a request of session that is starting, and returns the
+// function to call once it's done, which records the ShardSessions of
+// session. The sessions in use are not reaped.
+func (sr *sessionRegistry) use(context interface{}, session *proto.Session) (done func()) {
+	if sr == nil || session == nil || session.SessionId == 0 {
+		return func() {}
+	}
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	element, ok := sr.byId[session.SessionId]
+	if !ok {
+		return func() {}
+	}
+	entry := element.Value.(*sessionEntry)
+	entry.inUse++
+	if conn := clientConn(context); conn != nil {
+		entry.conn = conn
+	}
+	return func() {
+		sr.mu.Lock()
+		entry.inUse--
+		entry.lastUsed = time.Now()
+		entry.shardSessions = append([]*proto.ShardSession(nil), session.ShardSessions...)
+		element, ok := sr.byId[entry.sessionId]
+		disconnected := ok && element.Value == entry && entry.disconnected && entry.inUse == 0
+		if disconnected {
+			sr.removeLocked(element)
+		}
+		sr.mu.Unlock()
+		if disconnected {
+			sr.rollbackEntry(entry, "disconnect")
+		}
+	}
+}
+
+// reap rolls back the sessions idle for idleTimeout at now, and forgets
+// them.
+func (sr *sessionRegistry) reap(now time.Time) {
+	if sr == nil || sr.idleTimeout <= 0 {
+		return
+	}
+	var idle []*sessionEntry
+	sr.mu.Lock()
+	sr.expireLocked(now)
+	for element := sr.entries.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*sessionEntry)
+		if entry.inUse == 0 && now.Sub(entry.lastUsed) >= sr.idleTimeout {
+			sr.removeLocked(element)
+			idle = append(idle, entry)
+		}
+		element = next
+	}
+	sr.mu.Unlock()
+	for _, entry := range idle {
+		sr.rollbackEntry(entry, "idle")
+	}
+}
+
+// reapLoop reaps the idle sessions, for ever.
+func (sr *sessionRegistry) reapLoop() {
+	if sr == nil || sr.idleTimeout <= 0 {
+		return
+	}
+	for now := range time.Tick(sr.idleTimeout / 2) {
+		sr.reap(now)
+	}
+}
+
+// connClosed rolls back the sessions whose last request came through
+// conn, which closed, and forgets them. The ones with requests still
+// running are rolled back by the last one.
+func (sr *sessionRegistry) connClosed(conn *rpcproto.Context) {
+	if sr == nil || !sr.rollbackOnDisconnect || conn == nil {
+		return
+	}
+	var closed []*sessionEntry
+	sr.mu.Lock()
+	for element := sr.entries.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*sessionEntry)
+		if entry.conn == conn {
+			if entry.inUse == 0 {
+				sr.removeLocked(element)
+				closed = append(closed, entry)
+			} else {
+				entry.disconnected = true
+			}
+		}
+		element = next
+	}
+	sr.mu.Unlock()
+	for _, entry := range closed {
+		sr.rollbackEntry(entry, "disconnect")
+	}
+}
+
+// rollbackEntry rolls back the transaction of a session the registry
+// forgot, and counts it.
+func (sr *sessionRegistry) rollbackEntry(entry *sessionEntry, reason string) {
+	log.Infof("rolling back session %v, %v shard sessions: %v", entry.sessionId, len(entry.shardSessions), reason)
+	sr.reaped.Add(reason, 1)
+	if len(entry.shardSessions) != 0 {
+		sr.rollback(entry.shardSessions)
+	}
+}
+
+// expireLocked drops the sessions older than maxAge.
+func (sr *sessionRegistry) expireLocked(now time.Time) {
+	for element := sr.entries.Front(); element != nil; element = sr.entries.Front() {
+		if now.Sub(element.Value.(*sessionEntry).startTime) < sr.maxAge {
+			return
+		}
+		sr.removeLocked(element)
+		sr.expired.Add(1)
+	}
+}
+
+func (sr *sessionRegistry) removeLocked(element *list.Element) {
+	delete(sr.byId, element.Value.(*sessionEntry).sessionId)
+	sr.entries.Remove(element)
+}
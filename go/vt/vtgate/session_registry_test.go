@@ -0,0 +1,276 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func TestSessionRegistry(t *testing.T) {
+	var disabled *sessionRegistry
+	if newSessionRegistry("", 0, 0, false, nil) != disabled {
+		t.Errorf("a registry of max age 0 should be disabled")
+	}
+	session := new(proto.Session)
+	disabled.begin(nil, session)
+	if session.SessionId != 0 {
+		t.Errorf("the disabled registry gave out SessionId %v", session.SessionId)
+	}
+	if err := disabled.end(&proto.Session{SessionId: 1}); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+
+	sr := newSessionRegistry("", time.Hour, 0, false, nil)
+	first, second := new(proto.Session), new(proto.Session)
+	sr.begin(nil, first)
+	sr.begin(nil, second)
+	if first.SessionId == 0 || second.SessionId <= first.SessionId {
+		t.Errorf("want increasing SessionIds, got %v and %v", first.SessionId, second.SessionId)
+	}
+	if first.TransactionStartTime == 0 {
+		t.Errorf("want a TransactionStartTime, got 0")
+	}
+	if err := sr.end(first); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	// a session can only be finished once
+	if err := sr.end(first); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if err := sr.end(&proto.Session{SessionId: second.SessionId + 1}); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	// the sessions without SessionId are not checked
+	if err := sr.end(&proto.Session{InTransaction: true}); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if err := sr.end(nil); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if sr.Size() != 1 {
+		t.Errorf("want 1 session, got %v", sr.Size())
+	}
+
+	// the old sessions expire
+	sr = newSessionRegistry("", time.Millisecond, 0, false, nil)
+	sr.begin(nil, first)
+	time.Sleep(5 * time.Millisecond)
+	if err := sr.end(first); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if sr.expired.Get() != 1 {
+		t.Errorf("want 1 expired session, got %v", sr.expired.Get())
+	}
+}
+
+// rollbackRecorder records the shard sessions rolled back by a
+// sessionRegistry.
+type rollbackRecorder struct {
+	rolledBack [][]*proto.ShardSession
+}
+
+func (rr *rollbackRecorder) rollback(shardSessions []*proto.ShardSession) {
+	rr.rolledBack = append(rr.rolledBack, shardSessions)
+}
+
+func (rr *rollbackRecorder) check(t *testing.T, what string, want ...*proto.Session) {
+	var wantRolledBack [][]*proto.ShardSession
+	for _, session := range want {
+		wantRolledBack = append(wantRolledBack, session.ShardSessions)
+	}
+	if !reflect.DeepEqual(rr.rolledBack, wantRolledBack) {
+		t.Errorf("%v: want %v rolled back, got %v", what, wantRolledBack, rr.rolledBack)
+	}
+	rr.rolledBack = nil
+}
+
+func TestSessionRegistryReap(t *testing.T) {
+	rr := new(rollbackRecorder)
+	sr := newSessionRegistry("", time.Hour, time.Minute, true, rr.rollback)
+	idle, busy, empty := new(proto.Session), new(proto.Session), new(proto.Session)
+	for i, session := range []*proto.Session{idle, busy, empty} {
+		sr.begin(nil, session)
+		if session != empty {
+			session.ShardSessions = []*proto.ShardSession{{Keyspace: "ks", Shard: "0", TransactionId: int64(i + 1)}}
+			sr.use(nil, session)()
+		}
+	}
+	done := sr.use(nil, busy)
+
+	sr.reap(time.Now())
+	rr.check(t, "no idle session")
+
+	// the session without shard sessions has nothing to roll back
+	later := time.Now().Add(2 * time.Minute)
+	sr.reap(later)
+	rr.check(t, "idle sessions", idle)
+	if err := sr.end(empty); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if got := sr.reaped.Counts()["idle"]; got != 2 {
+		t.Errorf("want 2 reaped sessions, got %v", got)
+	}
+
+	// the sessions in use are idle from the end of their request
+	done()
+	sr.reap(time.Now())
+	rr.check(t, "the session just used")
+	sr.reap(time.Now().Add(2 * time.Minute))
+	rr.check(t, "the session once idle", busy)
+	sr.reap(time.Now().Add(2 * time.Minute))
+	rr.check(t, "the sessions already rolled back")
+	if sr.Size() != 0 {
+		t.Errorf("want no sessions, got %v", sr.Size())
+	}
+
+	// without idle timeout, nothing is reaped
+	sr = newSessionRegistry("", time.Hour, 0, true, rr.rollback)
+	sr.begin(nil, idle)
+	sr.use(nil, idle)()
+	sr.reap(time.Now().Add(2 * time.Minute))
+	rr.check(t, "no idle timeout")
+}
+
+func TestSessionRegistryConnClosed(t *testing.T) {
+	rr := new(rollbackRecorder)
+	sr := newSessionRegistry("", time.Hour, 0, true, rr.rollback)
+	conn1, conn2 := &rpcproto.Context{RemoteAddr: "1"}, &rpcproto.Context{RemoteAddr: "2"}
+	first, second, third := new(proto.Session), new(proto.Session), new(proto.Session)
+	for i, session := range []*proto.Session{first, second, third} {
+		sr.begin(conn1, session)
+		session.ShardSessions = []*proto.ShardSession{{Keyspace: "ks", Shard: "0", TransactionId: int64(i + 1)}}
+	}
+	sr.use(conn1, first)()
+	// the sessions follow the connection of their last request
+	sr.use(&tabletconn.RequestContext{Context: conn2}, second)()
+	sr.use(conn2, third)()
+
+	sr.connClosed(conn1)
+	rr.check(t, "conn1 closed", first)
+
+	// the sessions in use are rolled back by their last request
+	done := sr.use(conn2, third)
+	sr.connClosed(conn2)
+	rr.check(t, "conn2 closed", second)
+	done()
+	rr.check(t, "the last request done", third)
+	if got := sr.reaped.Counts()["disconnect"]; got != 3 {
+		t.Errorf("want 3 rolled back sessions, got %v", got)
+	}
+	if sr.Size() != 0 {
+		t.Errorf("want no sessions, got %v", sr.Size())
+	}
+
+	// unless it's disabled
+	sr = newSessionRegistry("", time.Hour, 0, false, rr.rollback)
+	sr.begin(conn1, first)
+	sr.use(conn1, first)()
+	sr.connClosed(conn1)
+	rr.check(t, "rollback on disconnect disabled")
+}
+
+func TestVTGateReapIdleSession(t *testing.T) {
+	resetSandbox()
+	sbc0, sbc1 := &sandboxConn{}, &sandboxConn{}
+	mapTestConn("-20", sbc0)
+	mapTestConn("20-40", sbc1)
+	conn := &rpcproto.Context{RemoteAddr: "client"}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_reap_idle",
+		Shards:     []string{"-20", "20-40"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    new(proto.Session),
+	}
+	RpcVTGate.Begin(conn, q.Session)
+	RpcVTGate.ExecuteShard(conn, &q, new(proto.QueryResult))
+	if len(q.Session.ShardSessions) != 2 {
+		t.Fatalf("want 2 shard sessions, got %v", q.Session.ShardSessions)
+	}
+
+	defer func(idleTimeout time.Duration) { RpcVTGate.sessions.idleTimeout = idleTimeout }(RpcVTGate.sessions.idleTimeout)
+	RpcVTGate.sessions.idleTimeout = time.Minute
+	for i := 0; i < 2; i++ {
+		RpcVTGate.sessions.reap(time.Now().Add(2 * time.Minute))
+	}
+	RpcVTGate.ConnClosed(conn)
+	// each shard session is rolled back once
+	for i, sbc := range []*sandboxConn{sbc0, sbc1} {
+		if got := sbc.RollbackCount.Get(); got != 1 {
+			t.Errorf("shard %v: want 1 rollback, got %v", i, got)
+		}
+	}
+	if err := RpcVTGate.Commit(conn, q.Session); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if got := sbc0.CommitCount.Get() + sbc1.CommitCount.Get(); got != 0 {
+		t.Errorf("want no commit, got %v", got)
+	}
+}
+
+func TestVTGateConnClosed(t *testing.T) {
+	resetSandbox()
+	sbc0, sbc1 := &sandboxConn{}, &sandboxConn{}
+	mapTestConn("-20", sbc0)
+	mapTestConn("20-40", sbc1)
+	conn := &rpcproto.Context{RemoteAddr: "client"}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_conn_closed",
+		Shards:     []string{"-20", "20-40"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    new(proto.Session),
+	}
+	RpcVTGate.Begin(conn, q.Session)
+	RpcVTGate.ExecuteShard(conn, &q, new(proto.QueryResult))
+	RpcVTGate.ConnClosed(conn)
+	RpcVTGate.ConnClosed(conn)
+	for i, sbc := range []*sandboxConn{sbc0, sbc1} {
+		if got := sbc.RollbackCount.Get(); got != 1 {
+			t.Errorf("shard %v: want 1 rollback, got %v", i, got)
+		}
+	}
+	if err := RpcVTGate.Rollback(conn, q.Session); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+}
+
+func TestVTGateCommitTwice(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	mapTestConn("-20", sbc)
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_commit_twice",
+		Shards:     []string{"-20"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    new(proto.Session),
+	}
+	RpcVTGate.Begin(nil, q.Session)
+	RpcVTGate.ExecuteShard(nil, &q, new(proto.QueryResult))
+	session := *q.Session
+	if err := RpcVTGate.Commit(nil, q.Session); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	// the retry of a commit that went through doesn't start over
+	if err := RpcVTGate.Commit(nil, &session); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if err := RpcVTGate.Rollback(nil, &session); err != ErrSessionNotFound {
+		t.Errorf("want %v, got %v", ErrSessionNotFound, err)
+	}
+	if got := sbc.CommitCount.Get(); got != 1 {
+		t.Errorf("want 1 commit, got %v", got)
+	}
+}
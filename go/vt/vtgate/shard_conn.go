@@ -5,16 +5,41 @@
 package vtgate
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"sync"
 	"time"
 
 	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/stats"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
 	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+var retryTimeout = flag.Duration("retry_timeout", 0, "maximum time vtgate spends retrying a call to a shard, after which the call fails with its last error. 0 is no limit other than -retry-count.")
+
+// endPointInvalidations counts the retryable errors that
+// invalidated the endpoints of a shard, by
+// "<keyspace>.<shard>.<tablet type>".
+var endPointInvalidations = stats.NewCounters("VTGateEndPointInvalidations")
+
+// shardRetries counts the calls to a shard that were tried again, by
+// "<keyspace>.<shard>.<tablet type>".
+var shardRetries = stats.NewCounters("VTGateShardRetries")
+
+// ErrDeadlineExceeded is returned for the calls to a shard that
+// didn't finish before the deadline of their request, see
+// tabletconn.RequestContext. They are not retried.
+var ErrDeadlineExceeded = errors.New("vtgate: deadline exceeded")
+
+// endPointsInvalidator is implemented by the SrvTopoServers that cache
+// the EndPoints, like ResilientSrvTopoServer.
+type endPointsInvalidator interface {
+	InvalidateEndPoints(cell, keyspace, shard string, tabletType topo.TabletType)
+}
+
 // ShardConn represents a load balanced connection to a group
 // of vttablets that belong to the same shard. ShardConn can
 // be concurrently used across goroutines. Such requests are
@@ -25,12 +50,21 @@ type ShardConn struct {
 	tabletType topo.TabletType
 	retryDelay time.Duration
 	retryCount int
-	timeout    time.Duration
-	balancer   *Balancer
+	// retryTimeout is the maximum time a call is retried for, 0 for
+	// no limit, see the -retry_timeout flag
+	retryTimeout time.Duration
+	timeout      time.Duration
+	balancer     *Balancer
+	// invalidateEndPoints drops the cached EndPoints of the shard
+	// in the SrvTopoServer, if it caches them
+	invalidateEndPoints func()
 
 	// conn needs a mutex because it can change during the lifetime of ShardConn.
 	mu   sync.Mutex
 	conn tabletconn.TabletConn
+	// pinnedConns are the ShardConns of the end points the sessions
+	// are pinned to, by uid, see pinned.
+	pinnedConns map[uint32]*ShardConn
 }
 
 // NewShardConn creates a new ShardConn. It creates a Balancer using
@@ -44,89 +78,162 @@ func NewShardConn(serv SrvTopoServer, cell, keyspace, shard string, tabletType t
 		}
 		return endpoints, nil
 	}
+	invalidateEndPoints := func() {}
+	if invalidator, ok := serv.(endPointsInvalidator); ok {
+		invalidateEndPoints = func() {
+			invalidator.InvalidateEndPoints(cell, keyspace, shard, tabletType)
+		}
+	}
 	blc := NewBalancer(getAddresses, retryDelay)
 	return &ShardConn{
-		keyspace:   keyspace,
-		shard:      shard,
-		tabletType: tabletType,
-		retryDelay: retryDelay,
-		retryCount: retryCount,
-		timeout:    timeout,
-		balancer:   blc,
+		keyspace:            keyspace,
+		shard:               shard,
+		tabletType:          tabletType,
+		retryDelay:          retryDelay,
+		retryCount:          retryCount,
+		retryTimeout:        *retryTimeout,
+		timeout:             timeout,
+		balancer:            blc,
+		invalidateEndPoints: invalidateEndPoints,
 	}
 }
 
 type ShardConnError struct {
 	Code            int
+	Keyspace        string
+	Shard           string
 	ShardIdentifier string
 	topoReResolve   bool
 	Err             string
+	// class is the class of the error in the stats, see errorClass
+	class string
 }
 
 func (e *ShardConnError) Error() string {
 	return fmt.Sprintf("%v, shard, host: %s", e.Err, e.ShardIdentifier)
 }
 
-// Execute executes a non-streaming query on vttablet. If there are connection errors,
-// it retries retryCount times before failing. It does not retry if the connection is in
-// the middle of a transaction.
+// Execute executes a non-streaming query on vttablet. If there are retryable
+// errors, see isRetryableError, it retries retryCount times before failing,
+// on the endpoints read again from the serving graph. It does not retry if
+// the connection is in the middle of a transaction: the transaction of the
+// shard is lost, and the client has to start over.
 func (sdc *ShardConn) Execute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (qr *mproto.QueryResult, err error) {
-	err = sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
-		var innerErr error
-		qr, innerErr = conn.Execute(context, query, bindVars, transactionId)
-		return innerErr
+	startTime := time.Now()
+	result, err := sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return conn.Execute(context, query, bindVars, transactionId)
 	}, transactionId, false)
-	return qr, err
+	if err != nil {
+		sdc.recordCall("Execute", startTime, 0, err)
+		return nil, err
+	}
+	qr = result.(*mproto.QueryResult)
+	sdc.recordCall("Execute", startTime, len(qr.Rows), nil)
+	return qr, nil
+}
+
+// ExecuteLazy executes a non-streaming query on vttablet, without
+// decoding the rows of the result. The retry rules are the same as Execute.
+func (sdc *ShardConn) ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (qr *mproto.LazyQueryResult, err error) {
+	startTime := time.Now()
+	result, err := sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return conn.ExecuteLazy(context, query, bindVars, transactionId)
+	}, transactionId, false)
+	if err != nil {
+		sdc.recordCall("Execute", startTime, 0, err)
+		return nil, err
+	}
+	qr = result.(*mproto.LazyQueryResult)
+	sdc.recordCall("Execute", startTime, len(qr.Rows), nil)
+	return qr, nil
 }
 
 // ExecuteBatch executes a group of queries. The retry rules are the same as Execute.
 func (sdc *ShardConn) ExecuteBatch(context interface{}, queries []tproto.BoundQuery, transactionId int64) (qrs *tproto.QueryResultList, err error) {
-	err = sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
-		var innerErr error
-		qrs, innerErr = conn.ExecuteBatch(context, queries, transactionId)
-		return innerErr
+	startTime := time.Now()
+	result, err := sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return conn.ExecuteBatch(context, queries, transactionId)
 	}, transactionId, false)
-	return qrs, err
+	if err != nil {
+		sdc.recordCall("ExecuteBatch", startTime, 0, err)
+		return nil, err
+	}
+	qrs = result.(*tproto.QueryResultList)
+	rows := 0
+	for _, qr := range qrs.List {
+		rows += len(qr.Rows)
+	}
+	sdc.recordCall("ExecuteBatch", startTime, rows, nil)
+	return qrs, nil
 }
 
 // StreamExecute executes a streaming query on vttablet. The retry rules are the same as Execute.
-func (sdc *ShardConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (results <-chan *mproto.QueryResult, errFunc tabletconn.ErrFunc) {
+// cancel aborts the stream, whose results must still be read until
+// they end: the tablets can't interrupt a stream, so it closes the
+// tablet connection of the stream, see closeConn.
+// The call is recorded in the stats once errFunc or cancel is called,
+// the caller records the rows it read, see recordRows.
+func (sdc *ShardConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (results <-chan *mproto.QueryResult, errFunc tabletconn.ErrFunc, cancel func()) {
+	startTime := time.Now()
+	var recordOnce sync.Once
+	record := func(err error) {
+		recordOnce.Do(func() { sdc.recordCall("StreamExecute", startTime, 0, err) })
+	}
 	var usedConn tabletconn.TabletConn
 	var erFunc tabletconn.ErrFunc
-	err := sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
+	_, err := sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
 		results, erFunc = conn.StreamExecute(context, query, bindVars, transactionId)
 		usedConn = conn
-		return erFunc()
+		return nil, erFunc()
 	}, transactionId, true)
 	if err != nil {
-		return results, func() error { return err }
+		record(err)
+		return results, func() error { return err }, func() {}
 	}
 	inTransaction := (transactionId != 0)
-	return results, func() error { return sdc.WrapError(erFunc(), usedConn, inTransaction) }
+	errFunc = func() error {
+		err := sdc.WrapError(erFunc(), usedConn, inTransaction)
+		record(err)
+		return err
+	}
+	cancel = func() {
+		record(nil)
+		sdc.closeConn(usedConn)
+	}
+	return results, errFunc, cancel
 }
 
 // Begin begins a transaction. The retry rules are the same as Execute.
 func (sdc *ShardConn) Begin(context interface{}) (transactionId int64, err error) {
-	err = sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
-		var innerErr error
-		transactionId, innerErr = conn.Begin(context)
-		return innerErr
+	startTime := time.Now()
+	result, err := sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return conn.Begin(context)
 	}, 0, false)
-	return transactionId, err
+	sdc.recordCall("Begin", startTime, 0, err)
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
 }
 
 // Commit commits the current transaction. The retry rules are the same as Execute.
 func (sdc *ShardConn) Commit(context interface{}, transactionId int64) (err error) {
-	return sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
-		return conn.Commit(context, transactionId)
+	startTime := time.Now()
+	_, err = sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return nil, conn.Commit(context, transactionId)
 	}, transactionId, false)
+	sdc.recordCall("Commit", startTime, 0, err)
+	return err
 }
 
 // Rollback rolls back the current transaction. The retry rules are the same as Execute.
 func (sdc *ShardConn) Rollback(context interface{}, transactionId int64) (err error) {
-	return sdc.withRetry(context, func(conn tabletconn.TabletConn) error {
-		return conn.Rollback(context, transactionId)
+	startTime := time.Now()
+	_, err = sdc.withRetry(context, func(conn tabletconn.TabletConn) (interface{}, error) {
+		return nil, conn.Rollback(context, transactionId)
 	}, transactionId, false)
+	sdc.recordCall("Rollback", startTime, 0, err)
+	return err
 }
 
 // Close closes the underlying TabletConn. ShardConn can be
@@ -134,6 +241,9 @@ func (sdc *ShardConn) Rollback(context interface{}, transactionId int64) (err er
 func (sdc *ShardConn) Close() {
 	sdc.mu.Lock()
 	defer sdc.mu.Unlock()
+	for _, pinned := range sdc.pinnedConns {
+		pinned.Close()
+	}
 	if sdc.conn == nil {
 		return
 	}
@@ -141,55 +251,123 @@ func (sdc *ShardConn) Close() {
 	sdc.conn = nil
 }
 
-// withRetry sets up the connection and executes the action. If there are connection errors,
-// it retries retryCount times before failing. It does not retry if the connection is in
-// the middle of a transaction. While returning the error check if it maybe a result of
+// withRetry sets up the connection and executes the action. If there are retryable errors,
+// it retries retryCount times before failing, for retryTimeout at most if set. It does not
+// retry if the connection is in the middle of a transaction. While returning the error check if it maybe a result of
 // a resharding event, and set the re-resolve bit and let the upper layers
 // re-resolve and retry.
-func (sdc *ShardConn) withRetry(context interface{}, action func(conn tabletconn.TabletConn) error, transactionId int64, isStreaming bool) error {
+// Retryable errors also invalidate the endpoints of the shard, see
+// endPointsFailed: the first one outside of a transaction is retried
+// on the refreshed endpoints, even if retryCount is 0. That's how a
+// query that hit the old master of a reparented shard finds the new
+// one.
+// If context has a deadline, the action is not tried once it passed,
+// and non-streaming actions time out at the deadline if it comes
+// before timeout.
+func (sdc *ShardConn) withRetry(context interface{}, action func(conn tabletconn.TabletConn) (interface{}, error), transactionId int64, isStreaming bool) (interface{}, error) {
+	var result interface{}
 	var conn tabletconn.TabletConn
 	var err error
 	var retry bool
 	inTransaction := (transactionId != 0)
+	attempts := sdc.retryCount + 1
+	invalidated := false
+	deadline := tabletconn.Deadline(context)
+	start := time.Now()
+	// endPointsFailed invalidates the endpoints, and makes sure the
+	// action is retried on the new ones if it can be
+	endPointsFailed := func(i int) {
+		sdc.endPointsFailed()
+		if !invalidated && !inTransaction && i == attempts-1 {
+			attempts++
+		}
+		invalidated = true
+	}
 	// execute the action at least once even without retrying
-	for i := 0; i < sdc.retryCount+1; i++ {
-		conn, err, retry = sdc.getConn(context)
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if sdc.retryTimeout > 0 && time.Now().Sub(start) >= sdc.retryTimeout {
+				break
+			}
+			shardRetries.Add(sdc.statsKey(), 1)
+		}
+		timeout := sdc.timeout
+		deadlineTimeout := false
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				return nil, sdc.WrapError(ErrDeadlineExceeded, conn, inTransaction)
+			}
+			if remaining < timeout {
+				timeout = remaining
+				deadlineTimeout = true
+			}
+		}
+		conn, err, retry = sdc.getConn(context, timeout)
 		if err != nil {
 			if retry {
+				endPointsFailed(i)
 				continue
 			}
-			return sdc.WrapError(err, conn, inTransaction)
+			return nil, sdc.WrapError(err, conn, inTransaction)
 		}
+		uid := conn.EndPoint().Uid
+		sdc.balancer.StartRequest(uid)
 		// no timeout for streaming query
 		if isStreaming {
-			err = action(conn)
+			result, err = action(conn)
+			sdc.balancer.EndRequest(uid)
 		} else {
-			timer := time.After(sdc.timeout)
+			timer := time.After(timeout)
 			done := make(chan int)
+			// the results of the action are only read once it's
+			// done, it may still be running after a timeout
+			var resultAction interface{}
 			var errAction error
 			go func() {
-				errAction = action(conn)
+				resultAction, errAction = action(conn)
+				// the request is outstanding until it's done,
+				// even after a timeout
+				sdc.balancer.EndRequest(uid)
 				close(done)
 			}()
 			select {
 			case <-timer:
+				if deadlineTimeout {
+					// the tablet is fine, the client gave up
+					return nil, sdc.WrapError(ErrDeadlineExceeded, conn, inTransaction)
+				}
 				err = tabletconn.OperationalError("vttablet: call timeout")
 			case <-done:
-				err = errAction
+				result, err = resultAction, errAction
 			}
 		}
+		if isRetryableError(err) {
+			endPointsFailed(i)
+		}
 		if sdc.canRetry(err, transactionId, conn) {
 			continue
 		}
-		return sdc.WrapError(err, conn, inTransaction)
+		return result, sdc.WrapError(err, conn, inTransaction)
 	}
-	return sdc.WrapError(err, conn, inTransaction)
+	return nil, sdc.WrapError(err, conn, inTransaction)
+}
+
+// endPointsFailed is called after a retryable error. The endpoint
+// may have been replaced: the cached EndPoints of the shard are
+// invalidated and read again, and the balancer chooses among the new
+// ones for the next connection.
+func (sdc *ShardConn) endPointsFailed() {
+	endPointInvalidations.Add(sdc.statsKey(), 1)
+	sdc.invalidateEndPoints()
+	sdc.balancer.Invalidate()
 }
 
 // getConn reuses an existing connection if possible. Otherwise
-// it returns a connection which it will save for future reuse.
+// it returns a connection which it will save for future reuse,
+// dialed with timeout.
 // If it returns an error,  retry will tell you if getConn can be retried.
-func (sdc *ShardConn) getConn(context interface{}) (conn tabletconn.TabletConn, err error, retry bool) {
+func (sdc *ShardConn) getConn(context interface{}, timeout time.Duration) (conn tabletconn.TabletConn, err error, retry bool) {
 	sdc.mu.Lock()
 	defer sdc.mu.Unlock()
 	if sdc.conn != nil {
@@ -200,7 +378,7 @@ func (sdc *ShardConn) getConn(context interface{}) (conn tabletconn.TabletConn,
 	if err != nil {
 		return nil, err, false
 	}
-	conn, err = tabletconn.GetDialer()(context, endPoint, sdc.keyspace, sdc.shard, sdc.timeout)
+	conn, err = tabletconn.GetDialer()(context, endPoint, sdc.keyspace, sdc.shard, timeout)
 	if err != nil {
 		sdc.balancer.MarkDown(endPoint.Uid)
 		return nil, err, true
@@ -209,27 +387,38 @@ func (sdc *ShardConn) getConn(context interface{}) (conn tabletconn.TabletConn,
 	return sdc.conn, nil, false
 }
 
+// isRetryableError returns true for the errors of a call that may
+// work on another try, on the same tablet or another one of the shard:
+// the connection errors, and the retry and fatal errors of the tablets,
+// like the ones of a tablet that is NOT_SERVING, or of an old master
+// after a reparent. The other errors of the tablets, like the ones of
+// the queries themselves, would only happen again.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if serverError, ok := err.(*tabletconn.ServerError); ok {
+		return serverError.Code == tabletconn.ERR_RETRY || serverError.Code == tabletconn.ERR_FATAL
+	}
+	return true
+}
+
 // canRetry determines whether a query can be retried or not.
-// OperationalErrors like retry/fatal cause a reconnect and retry if query is not in a txn.
+// Retryable errors cause a reconnect and retry if query is not in a txn.
 // TxPoolFull causes a retry and all other errors are non-retry.
 func (sdc *ShardConn) canRetry(err error, transactionId int64, conn tabletconn.TabletConn) bool {
 	if err == nil {
 		return false
 	}
-	if serverError, ok := err.(*tabletconn.ServerError); ok {
-		switch serverError.Code {
-		case tabletconn.ERR_TX_POOL_FULL:
-			// Retry without reconnecting.
-			time.Sleep(sdc.retryDelay)
-			return true
-		case tabletconn.ERR_RETRY, tabletconn.ERR_FATAL:
-			// No-op: treat these errors as operational by breaking out of this switch
-		default:
-			// Should not retry for normal server errors.
-			return false
-		}
+	if serverError, ok := err.(*tabletconn.ServerError); ok && serverError.Code == tabletconn.ERR_TX_POOL_FULL {
+		// Retry without reconnecting.
+		time.Sleep(sdc.retryDelay)
+		return true
 	}
-	// Non-server errors or fatal/retry errors. Retry if we're not in a transaction.
+	if !isRetryableError(err) {
+		return false
+	}
+	// Retry if we're not in a transaction.
 	inTransaction := (transactionId != 0)
 	sdc.markDown(conn)
 	return !inTransaction
@@ -263,6 +452,20 @@ func (sdc *ShardConn) markDown(conn tabletconn.TabletConn) {
 	sdc.conn = nil
 }
 
+// closeConn closes conn if it's still the connection of sdc, the next
+// call dials again. Unlike markDown, the end point stays usable. The
+// other calls running on conn fail with a connection error, and are
+// retried outside of a transaction.
+func (sdc *ShardConn) closeConn(conn tabletconn.TabletConn) {
+	sdc.mu.Lock()
+	defer sdc.mu.Unlock()
+	if conn != sdc.conn {
+		return
+	}
+	go sdc.conn.Close()
+	sdc.conn = nil
+}
+
 // WrapError returns ShardConnError which preserves the original error code if possible,
 // adds the connection context
 // and adds a bit to determine whether the keyspace/shard needs to be
@@ -285,9 +488,12 @@ func (sdc *ShardConn) WrapError(in error, conn tabletconn.TabletConn, inTransact
 	topoReResolve := shouldResolveTopo(in, inTransaction)
 
 	shardConnErr := &ShardConnError{Code: code,
+		Keyspace:        sdc.keyspace,
+		Shard:           sdc.shard,
 		ShardIdentifier: shardIdentifier,
 		topoReResolve:   topoReResolve,
 		Err:             in.Error(),
+		class:           wrappedErrorClass(in),
 	}
 	return shardConnErr
 }
@@ -5,10 +5,16 @@
 package vtgate
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sync2"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
 )
 
 // This file uses the sandbox_test framework.
@@ -44,12 +50,12 @@ func TestShardConnExecuteBatch(t *testing.T) {
 func TestShardConnExecuteStream(t *testing.T) {
 	testShardConnGeneric(t, func() error {
 		sdc := NewShardConn(new(sandboxTopo), "aa", "", "0", "", 1*time.Millisecond, 3, 1*time.Millisecond)
-		_, errfunc := sdc.StreamExecute(nil, "query", nil, 0)
+		_, errfunc, _ := sdc.StreamExecute(nil, "query", nil, 0)
 		return errfunc()
 	})
 	testShardConnTransact(t, func() error {
 		sdc := NewShardConn(new(sandboxTopo), "aa", "", "0", "", 1*time.Millisecond, 3, 1*time.Millisecond)
-		_, errfunc := sdc.StreamExecute(nil, "query", nil, 1)
+		_, errfunc, _ := sdc.StreamExecute(nil, "query", nil, 1)
 		return errfunc()
 	})
 }
@@ -76,6 +82,199 @@ func TestShardConnRollback(t *testing.T) {
 	})
 }
 
+func TestShardConnDeadline(t *testing.T) {
+	resetSandbox()
+	key := "ks_deadline.0."
+	start := endPointInvalidations.Counts()[key]
+
+	// a slow tablet times out at the deadline, long before the
+	// timeout of vtgate
+	sbc := &sandboxConn{mustDelay: 1 * time.Second}
+	testConns[0] = sbc
+	sdc := NewShardConn(new(sandboxTopo), "aa", "ks_deadline", "0", "", 1*time.Millisecond, 3, 10*time.Second)
+	context := &tabletconn.RequestContext{Deadline: time.Now().Add(1 * time.Millisecond)}
+	startTime := time.Now()
+	_, err := sdc.Execute(context, "query", nil, 0)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Now().Sub(startTime); elapsed > 500*time.Millisecond {
+		t.Errorf("the call took %v", elapsed)
+	}
+	// it isn't retried, and the tablet isn't blamed
+	if got := sbc.ExecCount.Get(); got != 1 {
+		t.Errorf("want 1, got %v", got)
+	}
+	if got := endPointInvalidations.Counts()[key] - start; got != 0 {
+		t.Errorf("want no invalidation, got %v", got)
+	}
+
+	// nothing is tried past the deadline
+	resetSandbox()
+	sbc = &sandboxConn{}
+	testConns[0] = sbc
+	sdc = NewShardConn(new(sandboxTopo), "aa", "ks_deadline", "0", "", 1*time.Millisecond, 3, 10*time.Second)
+	context = &tabletconn.RequestContext{Deadline: time.Now().Add(-1 * time.Millisecond)}
+	if _, err := sdc.Execute(context, "query", nil, 0); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("want deadline exceeded, got %v", err)
+	}
+	if got := sbc.ExecCount.Get(); got != 0 {
+		t.Errorf("want 0, got %v", got)
+	}
+}
+
+func TestShardConnInvalidateEndPoints(t *testing.T) {
+	resetSandbox()
+	key := "ks_invalidate.0."
+	start := endPointInvalidations.Counts()[key]
+
+	// a connection error is retried once on fresh endpoints, even
+	// without retries
+	sbc := &sandboxConn{mustFailConn: 1}
+	testConns[0] = sbc
+	sdc := NewShardConn(new(sandboxTopo), "aa", "ks_invalidate", "0", "", 1*time.Millisecond, 0, 1*time.Millisecond)
+	if _, err := sdc.Execute(nil, "query", nil, 0); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if sbc.ExecCount != 2 {
+		t.Errorf("want 2, got %v", sbc.ExecCount)
+	}
+	// the endpoints were read again after the invalidation, and once
+	// the endpoint that failed could be retried
+	if endPointCounter != 3 {
+		t.Errorf("want 3, got %v", endPointCounter)
+	}
+	if got := endPointInvalidations.Counts()[key] - start; got != 1 {
+		t.Errorf("want 1 invalidation, got %v", got)
+	}
+
+	// server errors don't invalidate anything
+	resetSandbox()
+	sbc = &sandboxConn{mustFailServer: 1}
+	testConns[0] = sbc
+	sdc = NewShardConn(new(sandboxTopo), "aa", "ks_invalidate", "0", "", 1*time.Millisecond, 0, 1*time.Millisecond)
+	if _, err := sdc.Execute(nil, "query", nil, 0); err == nil {
+		t.Errorf("want error, got nil")
+	}
+	if endPointCounter != 1 {
+		t.Errorf("want 1, got %v", endPointCounter)
+	}
+
+	// transactions are not retried, but the endpoints are still
+	// invalidated
+	resetSandbox()
+	sbc = &sandboxConn{mustFailConn: 1}
+	testConns[0] = sbc
+	sdc = NewShardConn(new(sandboxTopo), "aa", "ks_invalidate", "0", "", 1*time.Millisecond, 0, 1*time.Millisecond)
+	if _, err := sdc.Execute(nil, "query", nil, 1); err == nil {
+		t.Errorf("want error, got nil")
+	}
+	if sbc.ExecCount != 1 {
+		t.Errorf("want 1, got %v", sbc.ExecCount)
+	}
+	if got := endPointInvalidations.Counts()[key] - start; got != 2 {
+		t.Errorf("want 2 invalidations, got %v", got)
+	}
+	if _, err := sdc.Execute(nil, "query", nil, 0); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if endPointCounter < 2 {
+		t.Errorf("want the endpoints read again, got %v reads", endPointCounter)
+	}
+}
+
+// reparentTopo serves the endpoint of the master of a shard, which
+// changes on reparent.
+type reparentTopo struct {
+	sandboxTopo
+	master sync2.AtomicUint32
+}
+
+func (rt *reparentTopo) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	uid := rt.master.Get()
+	return &topo.EndPoints{Entries: []topo.EndPoint{
+		{Uid: uid, Host: fmt.Sprintf("%v", uid), NamedPortMap: map[string]int{"vt": 1}},
+	}}, nil
+}
+
+// oldMasterConn is the connection to a master that is reparented
+// away by its first call, which it then fails like a tablet that is
+// not serving anymore.
+type oldMasterConn struct {
+	sandboxConn
+	topo      *reparentTopo
+	newMaster uint32
+}
+
+func (sbc *oldMasterConn) Execute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.QueryResult, error) {
+	sbc.ExecCount.Add(1)
+	sbc.topo.master.Set(sbc.newMaster)
+	return nil, &tabletconn.ServerError{Code: tabletconn.ERR_RETRY, Err: "retry: operation not allowed in state NOT_SERVING"}
+}
+
+func TestShardConnReparent(t *testing.T) {
+	for _, inTransaction := range []bool{false, true} {
+		resetSandbox()
+		rt := &reparentTopo{}
+		rt.master.Set(1)
+		oldMaster := &oldMasterConn{topo: rt, newMaster: 2}
+		testConns[1] = oldMaster
+		newMaster := &sandboxConn{}
+		testConns[2] = newMaster
+		// the retry delay would be waited for if the endpoints of the
+		// shard weren't read again
+		sdc := NewShardConn(rt, "aa", "ks_reparent", "0", topo.TYPE_MASTER, 1*time.Second, 0, 10*time.Second)
+		var transactionId int64
+		if inTransaction {
+			transactionId = 1
+		}
+		start := time.Now()
+		qr, err := sdc.Execute(nil, "query", nil, transactionId)
+		if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+			t.Errorf("in transaction %v: the call took %v", inTransaction, elapsed)
+		}
+		if got := oldMaster.ExecCount.Get(); got != 1 {
+			t.Errorf("in transaction %v: want 1 execute on the old master, got %v", inTransaction, got)
+		}
+		if inTransaction {
+			// the transaction was on the old master
+			want := "retry: operation not allowed in state NOT_SERVING"
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("want %v, got %v", want, err)
+			}
+			if got := newMaster.ExecCount.Get(); got != 0 {
+				t.Errorf("want no execute on the new master, got %v", got)
+			}
+			continue
+		}
+		if err != nil || qr == nil {
+			t.Errorf("want a result from the new master, got %v, %v", qr, err)
+		}
+		if got := newMaster.ExecCount.Get(); got != 1 {
+			t.Errorf("want 1 execute on the new master, got %v", got)
+		}
+	}
+}
+
+func TestShardConnRetryTimeout(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{mustFailRetry: 100}
+	testConns[0] = sbc
+	sdc := NewShardConn(new(sandboxTopo), "aa", "ks_retry_timeout", "0", "", 10*time.Millisecond, 100, 10*time.Second)
+	sdc.retryTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := sdc.Execute(nil, "query", nil, 0)
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the retries took %v", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "retry: err") {
+		t.Errorf("want the last retry error, got %v", err)
+	}
+	if got := sbc.ExecCount.Get(); got < 2 || got >= 100 {
+		t.Errorf("want a few executes, got %v", got)
+	}
+}
+
 func testShardConnGeneric(t *testing.T, f func() error) {
 	// Topo failure
 	resetSandbox()
@@ -139,7 +338,7 @@ func testShardConnGeneric(t *testing.T, f func() error) {
 
 	// fatal error (one failure)
 	resetSandbox()
-	sbc = &sandboxConn{mustFailRetry: 1}
+	sbc = &sandboxConn{mustFailFatal: 1}
 	testConns[0] = sbc
 	err = f()
 	if err != nil {
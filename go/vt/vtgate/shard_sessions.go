@@ -0,0 +1,123 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	maxShardSessions = flag.Int("max_shard_sessions", 0, "maximum number of shards a transaction may span, 0 for no limit. Requests can only lower it.")
+
+	// shardSessionsRejections counts the statements rejected
+	// because their transaction would span too many shards, by
+	// "<keyspace>.<caller>".
+	shardSessionsRejections = stats.NewCounters("VTGateShardSessionsRejections")
+)
+
+func init() {
+	// the limit goes along with its rejections
+	stats.Publish("VTGateMaxShardSessions", stats.IntFunc(func() int64 {
+		return int64(*maxShardSessions)
+	}))
+}
+
+// TooManyShardSessionsError is returned for the statements that would
+// make their transaction span more shards than allowed, see
+// -max_shard_sessions. The shards the transaction already spans are
+// left alone, for the client to roll them back. Shards names them, as
+// "<keyspace>/<shard> (<tablet type>)", sorted.
+type TooManyShardSessionsError struct {
+	Count, MaxCount int
+	Shards          []string
+}
+
+func (e *TooManyShardSessionsError) Error() string {
+	return fmt.Sprintf("vtgate: transaction spans too many shards: %v shards, the limit is %v, it already spans %v", e.Count, e.MaxCount, strings.Join(e.Shards, ", "))
+}
+
+// shardSessionsLimit returns the maximum number of ShardSessions of a
+// request, 0 for no limit. The request can only lower -max_shard_sessions.
+func shardSessionsLimit(requestMax int) int {
+	switch {
+	case requestMax <= 0:
+		return *maxShardSessions
+	case *maxShardSessions <= 0 || requestMax < *maxShardSessions:
+		return requestMax
+	}
+	return *maxShardSessions
+}
+
+// callerID returns the name of the user that sent the request, or ""
+// if the request has none.
+func callerID(context interface{}) string {
+	if ctx, ok := context.(*tabletconn.RequestContext); ok {
+		context = ctx.Context
+	}
+	if ctx, ok := context.(*rpcproto.Context); ok {
+		return ctx.Username
+	}
+	return ""
+}
+
+// callerName returns the name of the user that sent the request,
+// or "unknown".
+func callerName(context interface{}) string {
+	if caller := callerID(context); caller != "" {
+		return caller
+	}
+	return "unknown"
+}
+
+// validateShardSessions checks that running a statement on shards
+// doesn't make the transaction of session span more than the
+// ShardSessions limit, before it begins on any new shard. It counts
+// the rejections.
+func validateShardSessions(context interface{}, session *proto.Session, keyspace string, shards []string, tabletType topo.TabletType, requestMax int) error {
+	if session == nil || !session.InTransaction {
+		return nil
+	}
+	limit := shardSessionsLimit(requestMax)
+	if limit <= 0 {
+		return nil
+	}
+	safeSession := NewSafeSession(session)
+	count := len(session.ShardSessions)
+	for shard := range unique(shards) {
+		if safeSession.Find(keyspace, shard, tabletType) == 0 {
+			count++
+		}
+	}
+	if count <= limit {
+		return nil
+	}
+	shardSessionsRejections.Add(keyspace+"."+callerName(context), 1)
+	inTransaction := make([]string, len(session.ShardSessions))
+	for i, shardSession := range session.ShardSessions {
+		inTransaction[i] = shardSessionName(shardSession)
+	}
+	sort.Strings(inTransaction)
+	return &TooManyShardSessionsError{Count: count, MaxCount: limit, Shards: inTransaction}
+}
+
+// querySession returns the session a query joins: none if the query
+// runs outside of the transaction of session, see
+// QueryShard.NotInTransaction. The Session of the reply is still
+// session, without ShardSessions for such queries.
+func querySession(session *proto.Session, notInTransaction bool) *proto.Session {
+	if notInTransaction {
+		return nil
+	}
+	return session
+}
@@ -0,0 +1,150 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"expvar"
+	"testing"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func setMaxShardSessions(max int) func() {
+	saved := *maxShardSessions
+	*maxShardSessions = max
+	return func() {
+		*maxShardSessions = saved
+	}
+}
+
+func TestShardSessionsLimit(t *testing.T) {
+	for _, tc := range []struct {
+		flag, request, want int
+	}{
+		{0, 0, 0},
+		{0, 3, 3},
+		{5, 0, 5},
+		{5, 3, 3},
+		// requests can't raise the limit
+		{5, 8, 5},
+	} {
+		restore := setMaxShardSessions(tc.flag)
+		if got := shardSessionsLimit(tc.request); got != tc.want {
+			t.Errorf("shardSessionsLimit(%v) with -max_shard_sessions=%v: %v, want %v", tc.request, tc.flag, got, tc.want)
+		}
+		restore()
+	}
+}
+
+func TestMaxShardSessions(t *testing.T) {
+	defer setMaxShardSessions(2)()
+	resetSandbox()
+	sbcs := []*sandboxConn{{}, {}, {}}
+	for i, sbc := range sbcs {
+		testConns[uint32(i)] = sbc
+	}
+	context := &rpcproto.Context{Username: "alice"}
+
+	session := new(proto.Session)
+	RpcVTGate.Begin(context, session)
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ss_keyspace",
+		Shards:     []string{"0", "1"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    session,
+	}
+	// exactly at the limit
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(context, &q, qr)
+	if qr.Error != "" {
+		t.Fatalf("want no error, got %v", qr.Error)
+	}
+	if len(session.ShardSessions) != 2 {
+		t.Fatalf("want 2 shard sessions, got %+v", session.ShardSessions)
+	}
+	// the shards of the transaction can still be used
+	q.Shards = []string{"1"}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(context, &q, qr)
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+
+	// a third shard fails the statement, but leaves the
+	// transaction alone
+	q.Shards = []string{"1", "2"}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(context, &q, qr)
+	want := "vtgate: transaction spans too many shards: 3 shards, the limit is 2, it already spans ss_keyspace/0 (master), ss_keyspace/1 (master)"
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+	if qr.Session != session || !session.InTransaction || len(session.ShardSessions) != 2 {
+		t.Errorf("want the 2 shard sessions, got %+v", qr.Session)
+	}
+	if sbcs[2].ExecCount != 0 {
+		t.Errorf("the rejected statement reached the tablet: %v", sbcs[2].ExecCount)
+	}
+	for i, sbc := range sbcs {
+		if sbc.RollbackCount != 0 {
+			t.Errorf("shard %v was rolled back", i)
+		}
+	}
+
+	// the same shard with another tablet type is another shard session
+	bq := proto.BatchQueryShard{
+		Queries:    []tproto.BoundQuery{{Sql: "query"}},
+		Keyspace:   "ss_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_REPLICA,
+		Session:    session,
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(context, &bq, qrl)
+	if qrl.Error != want {
+		t.Errorf("want too many shards error, got %v", qrl.Error)
+	}
+
+	// a request can lower the limit, but not raise it
+	q.Shards = []string{"0"}
+	q.MaxShardSessions = 1
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(context, &q, qr)
+	if qr.Error != "vtgate: transaction spans too many shards: 2 shards, the limit is 1, it already spans ss_keyspace/0 (master), ss_keyspace/1 (master)" {
+		t.Errorf("want too many shards error, got %v", qr.Error)
+	}
+	q.Shards = []string{"2"}
+	q.MaxShardSessions = 10
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(context, &q, qr)
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+
+	if n := shardSessionsRejections.Counts()["ss_keyspace.alice"]; n != 4 {
+		t.Errorf("want 4 rejections, got %v", n)
+	}
+	// along with the limit
+	if got := expvar.Get("VTGateMaxShardSessions").String(); got != "2" {
+		t.Errorf("want a limit of 2 in the vars, got %v", got)
+	}
+
+	// the limit only applies to transactions
+	RpcVTGate.Rollback(context, session)
+	q.Shards = []string{"0", "1", "2"}
+	q.Session = nil
+	q.MaxShardSessions = 0
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+)
+
+var (
+	// shardCalls has the time and the count of the calls to the
+	// shards, by "<keyspace>.<shard>.<tablet type>.<operation>", the
+	// operations being Execute, ExecuteBatch, StreamExecute, Begin,
+	// Commit and Rollback. The time of a call includes its retries,
+	// the one of a StreamExecute lasts until its last result.
+	shardCalls = stats.NewTimings("VTGateShardCalls")
+
+	// shardCallErrors counts the calls to the shards that failed, by
+	// "<keyspace>.<shard>.<tablet type>.<error class>", see
+	// errorClass.
+	shardCallErrors = stats.NewCounters("VTGateShardCallErrors")
+
+	// shardRows counts the rows returned by the shards, by
+	// "<keyspace>.<shard>.<tablet type>".
+	shardRows = stats.NewCounters("VTGateShardRows")
+)
+
+// statsKey is the key of the shard of sdc in the stats,
+// "<keyspace>.<shard>.<tablet type>".
+func (sdc *ShardConn) statsKey() string {
+	return sdc.keyspace + "." + sdc.shard + "." + string(sdc.tabletType)
+}
+
+// recordCall records a call to the shard begun at startTime, that
+// returned rows, or failed with err.
+func (sdc *ShardConn) recordCall(operation string, startTime time.Time, rows int, err error) {
+	key := sdc.statsKey()
+	shardCalls.Record(key+"."+operation, startTime)
+	if rows != 0 {
+		shardRows.Add(key, int64(rows))
+	}
+	if err != nil {
+		shardCallErrors.Add(key+"."+errorClass(err), 1)
+	}
+}
+
+// recordRows records rows returned by a streaming call to the shard.
+func (sdc *ShardConn) recordRows(rows int) {
+	if rows != 0 {
+		shardRows.Add(sdc.statsKey(), int64(rows))
+	}
+}
+
+// errorClass returns the class of an error returned by a ShardConn:
+// Normal, Retry, Fatal, TxPoolFull and NotInTx for the errors of
+// vttablet, Connection when vttablet couldn't be reached, and
+// Deadline for the calls that didn't finish before the deadline of
+// their request.
+func errorClass(err error) string {
+	if shardConnErr, ok := err.(*ShardConnError); ok {
+		return shardConnErr.class
+	}
+	return wrappedErrorClass(err)
+}
+
+// wrappedErrorClass returns the class of an error before it's
+// wrapped in a ShardConnError.
+func wrappedErrorClass(err error) string {
+	if err == ErrDeadlineExceeded {
+		return "Deadline"
+	}
+	serverError, ok := err.(*tabletconn.ServerError)
+	if !ok {
+		return "Connection"
+	}
+	switch serverError.Code {
+	case tabletconn.ERR_RETRY:
+		return "Retry"
+	case tabletconn.ERR_FATAL:
+		return "Fatal"
+	case tabletconn.ERR_TX_POOL_FULL:
+		return "TxPoolFull"
+	case tabletconn.ERR_NOT_IN_TX:
+		return "NotInTx"
+	}
+	return "Normal"
+}
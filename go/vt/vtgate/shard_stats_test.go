@@ -0,0 +1,123 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// This file uses the sandbox_test framework.
+
+func TestShardStats(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 0, 10*time.Second)
+	sdc := stc.getConnection("stats_ks", "0", topo.TYPE_MASTER)
+	const key = "stats_ks.0.master"
+
+	if _, err := sdc.Execute(nil, "query", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdc.ExecuteLazy(nil, "query", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	queries := []tproto.BoundQuery{{Sql: "query"}, {Sql: "query"}}
+	if _, err := sdc.ExecuteBatch(nil, queries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := stc.StreamExecute(nil, "query", nil, "stats_ks", []string{"0"}, topo.TYPE_MASTER, nil, func(*mproto.QueryResult) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	transactionId, err := sdc.Begin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sdc.Commit(nil, transactionId); err != nil {
+		t.Fatal(err)
+	}
+	sbc.mustFailServer = 1
+	sdc.Execute(nil, "query", nil, 0)
+	sbc.mustFailTxPool = 1
+	sdc.Begin(nil)
+	sbc.mustFailConn = 1
+	sdc.Rollback(nil, 1)
+
+	// the stats are only kept by the calls of this test
+	wantCalls := map[string]int64{
+		key + ".Execute":       3,
+		key + ".ExecuteBatch":  1,
+		key + ".StreamExecute": 1,
+		key + ".Begin":         2,
+		key + ".Commit":        1,
+		key + ".Rollback":      1,
+	}
+	gotCalls := make(map[string]int64)
+	for name, histogram := range shardCalls.Histograms() {
+		if strings.HasPrefix(name, key+".") {
+			gotCalls[name] = histogram.Count()
+		}
+	}
+	if !reflect.DeepEqual(gotCalls, wantCalls) {
+		t.Errorf("want calls %v, got %v", wantCalls, gotCalls)
+	}
+	if got := shardCalls.Histograms()[key+".Execute"].Total(); got <= 0 {
+		t.Errorf("want the time of the Execute calls, got %v", got)
+	}
+	wantErrors := map[string]int64{
+		key + ".Normal":     1,
+		key + ".TxPoolFull": 1,
+		key + ".Connection": 1,
+	}
+	gotErrors := make(map[string]int64)
+	for name, count := range shardCallErrors.Counts() {
+		if strings.HasPrefix(name, key+".") {
+			gotErrors[name] = count
+		}
+	}
+	if !reflect.DeepEqual(gotErrors, wantErrors) {
+		t.Errorf("want errors %v, got %v", wantErrors, gotErrors)
+	}
+	// one row for each query, and the stream
+	if got := shardRows.Counts()[key]; got != 5 {
+		t.Errorf("want 5 rows, got %v", got)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	testCases := []struct {
+		conn *sandboxConn
+		want string
+	}{
+		{&sandboxConn{mustFailServer: 1}, "Normal"},
+		{&sandboxConn{mustFailRetry: 1}, "Retry"},
+		{&sandboxConn{mustFailFatal: 1}, "Fatal"},
+		{&sandboxConn{mustFailTxPool: 1}, "TxPoolFull"},
+		{&sandboxConn{mustFailNotTx: 1}, "NotInTx"},
+		{&sandboxConn{mustFailConn: 1}, "Connection"},
+	}
+	for _, tc := range testCases {
+		resetSandbox()
+		testConns[0] = tc.conn
+		sdc := NewShardConn(new(sandboxTopo), "aa", "", "0", "", 1*time.Millisecond, 0, 10*time.Second)
+		// in a transaction, the errors are not retried
+		_, err := sdc.Execute(nil, "query", nil, 1)
+		if got := errorClass(err); got != tc.want {
+			t.Errorf("%v: want class %v, got %v", err, tc.want, got)
+		}
+	}
+	if got := errorClass(ErrDeadlineExceeded); got != "Deadline" {
+		t.Errorf("want class Deadline, got %v", got)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/youtube/vitess/go/stats"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+)
+
+var (
+	maxSqlSize = flag.Int("max_sql_size", 16*1024*1024, "maximum size in bytes of the sql of a request, for batches of each query and of the whole batch")
+
+	// sqlSizes is the histogram of the sizes of the statements
+	// vtgate receives, rejected or not.
+	sqlSizes = stats.NewHistogram("VTGateSqlSizes", []int64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216})
+
+	// sqlSizeRejections counts the requests rejected because of
+	// the size of their sql, by "<method>.<keyspace>".
+	sqlSizeRejections = stats.NewCounters("VTGateSqlSizeRejections")
+)
+
+// SqlTooLargeError is returned for the requests whose sql exceeds
+// -max_sql_size.
+type SqlTooLargeError struct {
+	Size, MaxSize int
+}
+
+func (e *SqlTooLargeError) Error() string {
+	return fmt.Sprintf("vtgate: statement too large: %v bytes, the limit is %v bytes", e.Size, e.MaxSize)
+}
+
+// checkSqlSize returns a *SqlTooLargeError if size exceeds the limit,
+// and counts the rejection.
+func checkSqlSize(method, keyspace string, size int) error {
+	if size <= *maxSqlSize {
+		return nil
+	}
+	sqlSizeRejections.Add(method+"."+keyspace, 1)
+	return &SqlTooLargeError{Size: size, MaxSize: *maxSqlSize}
+}
+
+// validateSqlSize checks the sql of a request against the limit.
+func validateSqlSize(method, keyspace, sql string) error {
+	sqlSizes.Add(int64(len(sql)))
+	return checkSqlSize(method, keyspace, len(sql))
+}
+
+// validateBatchSqlSize checks the sql of each query of a batch, and
+// of the whole batch, against the limit.
+func validateBatchSqlSize(method, keyspace string, queries []tproto.BoundQuery) error {
+	totalSize := 0
+	for _, query := range queries {
+		sqlSizes.Add(int64(len(query.Sql)))
+		totalSize += len(query.Sql)
+	}
+	for _, query := range queries {
+		if err := checkSqlSize(method, keyspace, len(query.Sql)); err != nil {
+			return err
+		}
+	}
+	return checkSqlSize(method, keyspace, totalSize)
+}
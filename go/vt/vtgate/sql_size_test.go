@@ -0,0 +1,86 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"strings"
+	"testing"
+
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func setMaxSqlSize(size int) func() {
+	saved := *maxSqlSize
+	*maxSqlSize = size
+	return func() {
+		*maxSqlSize = saved
+	}
+}
+
+func TestSqlSizeLimit(t *testing.T) {
+	defer setMaxSqlSize(10)()
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	sizes := sqlSizes.Count()
+
+	q := proto.QueryShard{
+		Sql:        strings.Repeat("a", 11),
+		Keyspace:   "sqlsize_keyspace",
+		TabletType: topo.TYPE_MASTER,
+		Shards:     []string{"0"},
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	want := "vtgate: statement too large: 11 bytes, the limit is 10 bytes"
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+
+	err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(*proto.QueryResult) error { return nil })
+	if _, ok := err.(*SqlTooLargeError); !ok {
+		t.Errorf("want *SqlTooLargeError, got %v", err)
+	}
+	if sbc.ExecCount != 0 {
+		t.Errorf("rejected queries reached the tablet: %v", sbc.ExecCount)
+	}
+
+	// batches are checked per query and in aggregate
+	bq := proto.BatchQueryShard{
+		Queries: []tproto.BoundQuery{
+			{Sql: "query1"},
+			{Sql: "q2"},
+		},
+		Keyspace:   "sqlsize_keyspace",
+		TabletType: topo.TYPE_MASTER,
+		Shards:     []string{"0"},
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	if qrl.Error != "" {
+		t.Errorf("want no error, got %v", qrl.Error)
+	}
+	bq.Queries[1].Sql = "query2"
+	qrl = new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	want = "vtgate: statement too large: 12 bytes, the limit is 10 bytes"
+	if qrl.Error != want {
+		t.Errorf("want %v, got %v", want, qrl.Error)
+	}
+
+	counts := sqlSizeRejections.Counts()
+	for _, name := range []string{"ExecuteShard.sqlsize_keyspace", "StreamExecuteShard.sqlsize_keyspace", "ExecuteBatchShard.sqlsize_keyspace"} {
+		if counts[name] != 1 {
+			t.Errorf("want 1 %v rejection, got %v", name, counts[name])
+		}
+	}
+	if n := sqlSizes.Count() - sizes; n != 6 {
+		t.Errorf("want 6 statement sizes, got %v", n)
+	}
+}
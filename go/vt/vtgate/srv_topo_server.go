@@ -6,6 +6,9 @@ package vtgate
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,9 +23,11 @@ var (
 )
 
 const (
-	queryCategory  = "query"
-	cachedCategory = "cached"
-	errorCategory  = "error"
+	queryCategory       = "query"
+	cachedCategory      = "cached"
+	errorCategory       = "error"
+	invalidatedCategory = "invalidated"
+	changedCategory     = "changed"
 )
 
 // SrvTopoServer is a subset of topo.Server that only contains the serving
@@ -43,12 +48,22 @@ type ResilientSrvTopoServer struct {
 	topoServer SrvTopoServer
 	counts     *stats.Counters
 
+	// endPointsRefreshes records how long it took to get fresh
+	// EndPoints after they were invalidated, by
+	// "<keyspace>.<shard>.<tablet type>".
+	endPointsRefreshes *stats.Timings
+
 	// mu protects the cache map itself, not the individual values
 	// in the cache.
 	mutex                 sync.Mutex
 	srvKeyspaceNamesCache map[string]*srvKeyspaceNamesEntry
 	srvKeyspaceCache      map[string]*srvKeyspaceEntry
 	endPointsCache        map[string]*endPointsEntry
+
+	// srvKeyspaceListeners are called after each change of a
+	// SrvKeyspace, see NotifySrvKeyspaceChanges. They are protected
+	// by mutex.
+	srvKeyspaceListeners []func(cell, keyspace string)
 }
 
 type srvKeyspaceNamesEntry struct {
@@ -65,6 +80,12 @@ type srvKeyspaceEntry struct {
 
 	insertionTime time.Time
 	value         *topo.SrvKeyspace
+	// watchTime is set while the topology server watches the value,
+	// see srvTopoWatcher.
+	watchTime time.Time
+	// invalidationTime is set when the value changed, until a fresh
+	// one is read. The value is still used if that fails.
+	invalidationTime time.Time
 }
 
 type endPointsEntry struct {
@@ -73,14 +94,48 @@ type endPointsEntry struct {
 
 	insertionTime time.Time
 	value         *topo.EndPoints
+	// invalidationTime is set when the value was invalidated, until
+	// a fresh one is read. The value is still used if that fails.
+	invalidationTime time.Time
+	// watchTime is set while the topology server watches the value,
+	// see srvTopoWatcher.
+	watchTime time.Time
+}
+
+// isFresh returns true if a cached value read at insertionTime can be
+// used: it was not invalidated since, and it is younger than
+// -srv_topo_cache_ttl or the topology server watches it since before
+// it was read, see srvTopoWatcher.
+func isFresh(insertionTime, watchTime, invalidationTime time.Time) bool {
+	if !invalidationTime.IsZero() {
+		return false
+	}
+	if !watchTime.IsZero() && !insertionTime.Before(watchTime) {
+		return true
+	}
+	return time.Now().Sub(insertionTime) < *srvTopoCacheTTL
 }
 
 // NewResilientSrvTopoServer creates a new ResilientSrvTopoServer
 // based on the provided SrvTopoServer.
 func NewResilientSrvTopoServer(base SrvTopoServer) *ResilientSrvTopoServer {
+	return newResilientSrvTopoServer(base, "ResilientSrvTopoServer")
+}
+
+// newResilientSrvTopoServer creates a ResilientSrvTopoServer whose
+// variables are published with the prefix statsName, or not at all
+// if it is empty.
+func newResilientSrvTopoServer(base SrvTopoServer, statsName string) *ResilientSrvTopoServer {
+	countsName, refreshesName := "", ""
+	if statsName != "" {
+		countsName = statsName + "Counts"
+		refreshesName = statsName + "EndPointsRefreshes"
+	}
 	return &ResilientSrvTopoServer{
 		topoServer: base,
-		counts:     stats.NewCounters("ResilientSrvTopoServerCounts"),
+		counts:     stats.NewCounters(countsName),
+
+		endPointsRefreshes: stats.NewTimings(refreshesName),
 
 		srvKeyspaceNamesCache: make(map[string]*srvKeyspaceNamesEntry),
 		srvKeyspaceCache:      make(map[string]*srvKeyspaceEntry),
@@ -135,15 +190,7 @@ func (server *ResilientSrvTopoServer) GetSrvKeyspaceNames(cell string) ([]string
 func (server *ResilientSrvTopoServer) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
 	server.counts.Add(queryCategory, 1)
 
-	// find the entry in the cache, add it if not there
-	key := cell + ":" + keyspace
-	server.mutex.Lock()
-	entry, ok := server.srvKeyspaceCache[key]
-	if !ok {
-		entry = &srvKeyspaceEntry{}
-		server.srvKeyspaceCache[key] = entry
-	}
-	server.mutex.Unlock()
+	entry := server.getSrvKeyspaceEntry(cell, keyspace)
 
 	// Lock the entry, and do everything holding the lock.  This
 	// means two concurrent requests will only issue one
@@ -152,11 +199,11 @@ func (server *ResilientSrvTopoServer) GetSrvKeyspace(cell, keyspace string) (*to
 	defer entry.mutex.Unlock()
 
 	// If the entry is fresh enough, return it
-	if time.Now().Sub(entry.insertionTime) < *srvTopoCacheTTL {
+	if isFresh(entry.insertionTime, entry.watchTime, entry.invalidationTime) {
 		return entry.value, nil
 	}
 
-	// not in cache or too old, get the real value
+	// not in cache, too old or changed, get the real value
 	result, err := server.topoServer.GetSrvKeyspace(cell, keyspace)
 	if err != nil {
 		if entry.insertionTime.IsZero() {
@@ -171,23 +218,33 @@ func (server *ResilientSrvTopoServer) GetSrvKeyspace(cell, keyspace string) (*to
 	}
 
 	// save the value we got and the current time in the cache
+	entry.invalidationTime = time.Time{}
 	entry.insertionTime = time.Now()
 	entry.value = result
 	return result, nil
 }
 
-func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
-	server.counts.Add(queryCategory, 1)
-
-	// find the entry in the cache, add it if not there
-	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
+// getSrvKeyspaceEntry finds the entry of a SrvKeyspace in the cache,
+// and adds it if not there.
+func (server *ResilientSrvTopoServer) getSrvKeyspaceEntry(cell, keyspace string) *srvKeyspaceEntry {
+	key := cell + ":" + keyspace
 	server.mutex.Lock()
-	entry, ok := server.endPointsCache[key]
+	defer server.mutex.Unlock()
+	entry, ok := server.srvKeyspaceCache[key]
 	if !ok {
-		entry = &endPointsEntry{}
-		server.endPointsCache[key] = entry
+		entry = &srvKeyspaceEntry{}
+		server.srvKeyspaceCache[key] = entry
+		if watcher, ok := server.topoServer.(srvTopoWatcher); ok {
+			go server.watchSrvKeyspace(watcher, cell, keyspace, entry)
+		}
 	}
-	server.mutex.Unlock()
+	return entry
+}
+
+func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	server.counts.Add(queryCategory, 1)
+
+	entry := server.getEndPointsEntry(cell, keyspace, shard, tabletType)
 
 	// Lock the entry, and do everything holding the lock.  This
 	// means two concurrent requests will only issue one
@@ -196,11 +253,11 @@ func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string,
 	defer entry.mutex.Unlock()
 
 	// If the entry is fresh enough, return it
-	if time.Now().Sub(entry.insertionTime) < *srvTopoCacheTTL {
+	if isFresh(entry.insertionTime, entry.watchTime, entry.invalidationTime) {
 		return entry.value, nil
 	}
 
-	// not in cache or too old, get the real value
+	// not in cache, too old or invalidated, get the real value
 	result, err := server.topoServer.GetEndPoints(cell, keyspace, shard, tabletType)
 	if err != nil {
 		if entry.insertionTime.IsZero() {
@@ -215,7 +272,136 @@ func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string,
 	}
 
 	// save the value we got and the current time in the cache
+	if !entry.invalidationTime.IsZero() {
+		server.endPointsRefreshes.Record(keyspace+"."+shard+"."+string(tabletType), entry.invalidationTime)
+		entry.invalidationTime = time.Time{}
+	}
 	entry.insertionTime = time.Now()
 	entry.value = result
 	return result, nil
 }
+
+// getEndPointsEntry finds the entry of the EndPoints of a shard in the
+// cache, and adds it if not there.
+func (server *ResilientSrvTopoServer) getEndPointsEntry(cell, keyspace, shard string, tabletType topo.TabletType) *endPointsEntry {
+	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	entry, ok := server.endPointsCache[key]
+	if !ok {
+		entry = &endPointsEntry{}
+		server.endPointsCache[key] = entry
+		if watcher, ok := server.topoServer.(srvTopoWatcher); ok {
+			go server.watchEndPoints(watcher, cell, keyspace, shard, tabletType, entry)
+		}
+	}
+	return entry
+}
+
+// PingTopo reads the keyspace names of cell from the topology server,
+// bypassing the cache, to check it can be reached.
+func (server *ResilientSrvTopoServer) PingTopo(cell string) error {
+	_, err := server.topoServer.GetSrvKeyspaceNames(cell)
+	return err
+}
+
+// EndPointsRefreshTime returns when the cached EndPoints of a shard
+// were last read from the topology server, or the zero time if they
+// never were.
+func (server *ResilientSrvTopoServer) EndPointsRefreshTime(cell, keyspace, shard string, tabletType topo.TabletType) time.Time {
+	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
+	server.mutex.Lock()
+	entry, ok := server.endPointsCache[key]
+	server.mutex.Unlock()
+	if !ok {
+		return time.Time{}
+	}
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	return entry.insertionTime
+}
+
+// InvalidateEndPoints drops the cached EndPoints of a shard, after a
+// connection to one of them failed, and reads them again in the
+// background. The invalidated EndPoints are still returned if the
+// topology server can't be reached.
+func (server *ResilientSrvTopoServer) InvalidateEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) {
+	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
+	server.mutex.Lock()
+	entry, ok := server.endPointsCache[key]
+	server.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	entry.mutex.Lock()
+	if entry.invalidationTime.IsZero() {
+		entry.invalidationTime = time.Now()
+	}
+	entry.mutex.Unlock()
+	server.counts.Add(invalidatedCategory, 1)
+
+	go server.GetEndPoints(cell, keyspace, shard, tabletType)
+}
+
+// ServeHTTP lists the entries of the cache, sorted by kind and key,
+// with their age and whether they are watched or read again after
+// -srv_topo_cache_ttl.
+func (server *ResilientSrvTopoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	server.mutex.Lock()
+	srvKeyspaceNamesCache := make(map[string]*srvKeyspaceNamesEntry, len(server.srvKeyspaceNamesCache))
+	for key, entry := range server.srvKeyspaceNamesCache {
+		srvKeyspaceNamesCache[key] = entry
+	}
+	srvKeyspaceCache := make(map[string]*srvKeyspaceEntry, len(server.srvKeyspaceCache))
+	for key, entry := range server.srvKeyspaceCache {
+		srvKeyspaceCache[key] = entry
+	}
+	endPointsCache := make(map[string]*endPointsEntry, len(server.endPointsCache))
+	for key, entry := range server.endPointsCache {
+		endPointsCache[key] = entry
+	}
+	server.mutex.Unlock()
+
+	var lines []string
+	for key, entry := range srvKeyspaceNamesCache {
+		entry.mutex.Lock()
+		lines = append(lines, cacheEntryLine("SrvKeyspaceNames", key, entry.insertionTime, time.Time{}, time.Time{}))
+		entry.mutex.Unlock()
+	}
+	for key, entry := range srvKeyspaceCache {
+		entry.mutex.Lock()
+		lines = append(lines, cacheEntryLine("SrvKeyspace", key, entry.insertionTime, entry.watchTime, entry.invalidationTime))
+		entry.mutex.Unlock()
+	}
+	for key, entry := range endPointsCache {
+		entry.mutex.Lock()
+		lines = append(lines, cacheEntryLine("EndPoints", key, entry.insertionTime, entry.watchTime, entry.invalidationTime))
+		entry.mutex.Unlock()
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// cacheEntryLine describes a cache entry for ServeHTTP.
+func cacheEntryLine(kind, key string, insertionTime, watchTime, invalidationTime time.Time) string {
+	now := time.Now()
+	line := kind + " " + key
+	if insertionTime.IsZero() {
+		line += " never read"
+	} else {
+		line += fmt.Sprintf(" age %v", now.Sub(insertionTime))
+	}
+	if watchTime.IsZero() {
+		line += fmt.Sprintf(" polled every %v", *srvTopoCacheTTL)
+	} else {
+		line += fmt.Sprintf(" watched since %v", watchTime.Format(time.RFC3339))
+	}
+	if !invalidationTime.IsZero() {
+		line += fmt.Sprintf(" invalidated %v ago", now.Sub(invalidationTime))
+	}
+	return line
+}
@@ -0,0 +1,105 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// endPointsTopo is a SrvTopoServer serving the EndPoints of one
+// shard, that can be changed or broken.
+type endPointsTopo struct {
+	sandboxTopo
+
+	mu       sync.Mutex
+	uid      uint32
+	fail     bool
+	getCount int
+}
+
+func (et *endPointsTopo) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	et.getCount++
+	if et.fail {
+		return nil, fmt.Errorf("topo error")
+	}
+	return &topo.EndPoints{Entries: []topo.EndPoint{{Uid: et.uid}}}, nil
+}
+
+func (et *endPointsTopo) set(uid uint32, fail bool) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	et.uid = uid
+	et.fail = fail
+}
+
+func (et *endPointsTopo) gets() int {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	return et.getCount
+}
+
+// NewResilientSrvTopoServer publishes its variables, so there is only
+// one in the tests.
+func TestResilientSrvTopoServerInvalidateEndPoints(t *testing.T) {
+	et := &endPointsTopo{uid: 1}
+	server := NewResilientSrvTopoServer(et)
+	getUid := func() uint32 {
+		endPoints, err := server.GetEndPoints("cell", "ks", "0", topo.TYPE_MASTER)
+		if err != nil {
+			t.Fatalf("GetEndPoints failed: %v", err)
+		}
+		return endPoints.Entries[0].Uid
+	}
+
+	// invalidating an unknown shard does nothing
+	server.InvalidateEndPoints("cell", "ks", "0", topo.TYPE_MASTER)
+	if got := server.counts.Counts()[invalidatedCategory]; got != 0 {
+		t.Errorf("want 0 invalidations, got %v", got)
+	}
+
+	// the cached value is used until it is invalidated
+	if uid := getUid(); uid != 1 {
+		t.Errorf("want uid 1, got %v", uid)
+	}
+	et.set(2, false)
+	if uid := getUid(); uid != 1 {
+		t.Errorf("want the cached uid 1, got %v", uid)
+	}
+	server.InvalidateEndPoints("cell", "ks", "0", topo.TYPE_MASTER)
+	if uid := getUid(); uid != 2 {
+		t.Errorf("want uid 2 after the invalidation, got %v", uid)
+	}
+	// the background refresh and getUid shared one read
+	if got := et.gets(); got != 2 {
+		t.Errorf("want 2 reads of the topology, got %v", got)
+	}
+	if got := server.counts.Counts()[invalidatedCategory]; got != 1 {
+		t.Errorf("want 1 invalidation, got %v", got)
+	}
+	if got := server.endPointsRefreshes.Counts()["ks.0.master"]; got != 1 {
+		t.Errorf("want 1 refresh, got %v", got)
+	}
+
+	// the invalidated value is still used without topology
+	et.set(3, true)
+	server.InvalidateEndPoints("cell", "ks", "0", topo.TYPE_MASTER)
+	if uid := getUid(); uid != 2 {
+		t.Errorf("want the cached uid 2, got %v", uid)
+	}
+	// and it is read again when the topology is back
+	et.set(3, false)
+	if uid := getUid(); uid != 3 {
+		t.Errorf("want uid 3, got %v", uid)
+	}
+	if got := server.endPointsRefreshes.Counts()["ks.0.master"]; got != 2 {
+		t.Errorf("want 2 refreshes, got %v", got)
+	}
+}
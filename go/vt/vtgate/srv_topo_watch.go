@@ -0,0 +1,127 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// srvTopoWatcher is implemented by the SrvTopoServers that can notify
+// the changes of the serving graph. A value is sent on the returned
+// channel after each change of the watched object, and the channel is
+// closed when the watch ends. ResilientSrvTopoServer uses the cached
+// objects it watches until they change, instead of reading them again
+// after -srv_topo_cache_ttl. It falls back to that if the watch fails
+// or ends, and with the SrvTopoServers that can't watch.
+type srvTopoWatcher interface {
+	WatchSrvKeyspace(cell, keyspace string) (<-chan struct{}, error)
+
+	WatchEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (<-chan struct{}, error)
+}
+
+// srvKeyspaceNotifier is implemented by the SrvTopoServers that
+// notify the changes of the SrvKeyspaces they cache, see
+// ResilientSrvTopoServer.NotifySrvKeyspaceChanges. Resolver uses it to
+// drop the partitions of a keyspace as soon as it changes.
+type srvKeyspaceNotifier interface {
+	NotifySrvKeyspaceChanges(listener func(cell, keyspace string))
+}
+
+// NotifySrvKeyspaceChanges registers listener, which is called after
+// each change of a SrvKeyspace of the cache, once the new one is read,
+// see RefreshSrvKeyspace.
+func (server *ResilientSrvTopoServer) NotifySrvKeyspaceChanges(listener func(cell, keyspace string)) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.srvKeyspaceListeners = append(server.srvKeyspaceListeners, listener)
+}
+
+// RefreshSrvKeyspace reads the SrvKeyspace of keyspace in cell again,
+// e.g. after it changed, and notifies the listeners registered with
+// NotifySrvKeyspaceChanges. It is called for each change of the
+// watched SrvKeyspaces. If the read fails, the cached SrvKeyspace is
+// still used, and read again by the next GetSrvKeyspace.
+func (server *ResilientSrvTopoServer) RefreshSrvKeyspace(cell, keyspace string) error {
+	entry := server.getSrvKeyspaceEntry(cell, keyspace)
+	entry.mutex.Lock()
+	result, err := server.topoServer.GetSrvKeyspace(cell, keyspace)
+	if err != nil {
+		if entry.invalidationTime.IsZero() {
+			entry.invalidationTime = time.Now()
+		}
+		server.counts.Add(errorCategory, 1)
+	} else {
+		entry.invalidationTime = time.Time{}
+		entry.insertionTime = time.Now()
+		entry.value = result
+	}
+	entry.mutex.Unlock()
+
+	server.mutex.Lock()
+	listeners := server.srvKeyspaceListeners
+	server.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(cell, keyspace)
+	}
+	return err
+}
+
+// watchSrvKeyspace refreshes the SrvKeyspace of entry after each of
+// its changes, until its watch ends.
+func (server *ResilientSrvTopoServer) watchSrvKeyspace(watcher srvTopoWatcher, cell, keyspace string, entry *srvKeyspaceEntry) {
+	changes, err := watcher.WatchSrvKeyspace(cell, keyspace)
+	if err != nil {
+		log.Warningf("WatchSrvKeyspace(%v, %v) failed: %v (reading it every %v)", cell, keyspace, err, *srvTopoCacheTTL)
+		return
+	}
+	// the value read before the watch is read again
+	entry.mutex.Lock()
+	entry.watchTime = time.Now()
+	entry.mutex.Unlock()
+
+	for _ = range changes {
+		server.counts.Add(changedCategory, 1)
+		if err := server.RefreshSrvKeyspace(cell, keyspace); err != nil {
+			log.Warningf("GetSrvKeyspace(%v, %v) failed after a change: %v (returning cached value)", cell, keyspace, err)
+		}
+	}
+
+	entry.mutex.Lock()
+	entry.watchTime = time.Time{}
+	entry.mutex.Unlock()
+	log.Warningf("the watch of SrvKeyspace(%v, %v) ended (reading it every %v)", cell, keyspace, *srvTopoCacheTTL)
+}
+
+// watchEndPoints reads the EndPoints of entry again after each of
+// their changes, until their watch ends.
+func (server *ResilientSrvTopoServer) watchEndPoints(watcher srvTopoWatcher, cell, keyspace, shard string, tabletType topo.TabletType, entry *endPointsEntry) {
+	changes, err := watcher.WatchEndPoints(cell, keyspace, shard, tabletType)
+	if err != nil {
+		log.Warningf("WatchEndPoints(%v, %v, %v, %v) failed: %v (reading them every %v)", cell, keyspace, shard, tabletType, err, *srvTopoCacheTTL)
+		return
+	}
+	// the value read before the watch is read again
+	entry.mutex.Lock()
+	entry.watchTime = time.Now()
+	entry.mutex.Unlock()
+
+	for _ = range changes {
+		server.counts.Add(changedCategory, 1)
+		entry.mutex.Lock()
+		if entry.invalidationTime.IsZero() {
+			entry.invalidationTime = time.Now()
+		}
+		entry.mutex.Unlock()
+		server.GetEndPoints(cell, keyspace, shard, tabletType)
+	}
+
+	entry.mutex.Lock()
+	entry.watchTime = time.Time{}
+	entry.mutex.Unlock()
+	log.Warningf("the watch of EndPoints(%v, %v, %v, %v) ended (reading them every %v)", cell, keyspace, shard, tabletType, *srvTopoCacheTTL)
+}
@@ -0,0 +1,243 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// watchingTopo is a SrvTopoServer that can watch the objects of
+// another one, and fires their changes on demand.
+type watchingTopo struct {
+	SrvTopoServer
+
+	mu      sync.Mutex
+	fail    bool
+	watches int
+	changes map[string]chan struct{}
+}
+
+func newWatchingTopo(base SrvTopoServer) *watchingTopo {
+	return &watchingTopo{SrvTopoServer: base, changes: make(map[string]chan struct{})}
+}
+
+func (wt *watchingTopo) watch(key string) (<-chan struct{}, error) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	wt.watches++
+	if wt.fail {
+		return nil, fmt.Errorf("cannot watch %v", key)
+	}
+	changes := make(chan struct{})
+	wt.changes[key] = changes
+	return changes, nil
+}
+
+func (wt *watchingTopo) WatchSrvKeyspace(cell, keyspace string) (<-chan struct{}, error) {
+	return wt.watch(cell + ":" + keyspace)
+}
+
+func (wt *watchingTopo) WatchEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (<-chan struct{}, error) {
+	return wt.watch(cell + ":" + keyspace + ":" + shard + ":" + string(tabletType))
+}
+
+func (wt *watchingTopo) watchCount() int {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return wt.watches
+}
+
+// change fires a change of the watched object key, and returns once it
+// is received.
+func (wt *watchingTopo) change(key string) {
+	wt.mu.Lock()
+	changes := wt.changes[key]
+	wt.mu.Unlock()
+	changes <- struct{}{}
+}
+
+// end ends the watch of the object key.
+func (wt *watchingTopo) end(key string) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	close(wt.changes[key])
+	delete(wt.changes, key)
+}
+
+// waitCache waits until the /debug page of server has a line that
+// starts with prefix and contains state.
+func waitCache(t *testing.T, server *ResilientSrvTopoServer, prefix, state string) {
+	var page string
+	for i := 0; i < 200; i++ {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, nil)
+		page = w.Body.String()
+		for _, line := range strings.Split(page, "\n") {
+			if strings.HasPrefix(line, prefix) && strings.Contains(line, state) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("want %v %v in the cache, got:\n%v", prefix, state, page)
+}
+
+func TestResilientSrvTopoServerWatchSrvKeyspace(t *testing.T) {
+	kt := newKeyspaceTopo()
+	wt := newWatchingTopo(kt)
+	server := newResilientSrvTopoServer(wt, "")
+	// the partitions of the resolver only expire after a change
+	res := NewResolver(server, "cell", time.Hour)
+	getShard := func() string {
+		shard, err := res.GetShardForKeyspaceId("adjacent", topo.TYPE_MASTER, "\x50")
+		if err != nil {
+			t.Fatalf("GetShardForKeyspaceId failed: %v", err)
+		}
+		return shard
+	}
+	if shard := getShard(); shard != "40-80" {
+		t.Errorf("want shard 40-80, got %v", shard)
+	}
+	waitCache(t, server, "SrvKeyspace cell:adjacent ", "watched")
+
+	// each change is read once, and the resolver returns its shards
+	// right away
+	changes := []struct {
+		srvKeyspace *topo.SrvKeyspace
+		shard       string
+	}{
+		{masterKeyspace("-"), "0"},
+		{masterKeyspace("-80", "80-"), "-80"},
+	}
+	for i, change := range changes {
+		kt.set("adjacent", change.srvKeyspace, false)
+		before := kt.gets()
+		wt.change("cell:adjacent")
+		want := change.shard
+		var shard string
+		for j := 0; j < 200; j++ {
+			if shard = getShard(); shard == want {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if shard != want {
+			t.Errorf("change %v: want shard %v, got %v", i, want, shard)
+		}
+		if got := kt.gets() - before; got != 1 {
+			t.Errorf("change %v: want 1 read of the topology, got %v", i, got)
+		}
+	}
+	if got := server.counts.Counts()[changedCategory]; got != 2 {
+		t.Errorf("want 2 changes, got %v", got)
+	}
+
+	// the last value is used if the topology can't be read after a
+	// change
+	kt.set("adjacent", masterKeyspace("-"), true)
+	if err := server.RefreshSrvKeyspace("cell", "adjacent"); err == nil {
+		t.Errorf("want an error without topology")
+	}
+	waitCache(t, server, "SrvKeyspace cell:adjacent ", "invalidated")
+	if shard := getShard(); shard != "-80" {
+		t.Errorf("want the last read shard -80, got %v", shard)
+	}
+
+	// once the watch ends, the SrvKeyspace is polled again
+	wt.end("cell:adjacent")
+	waitCache(t, server, "SrvKeyspace cell:adjacent ", "polled")
+
+	// and so are the ones that can't be watched
+	kt.set("adjacent", masterKeyspace("-80", "80-"), false)
+	wt.mu.Lock()
+	wt.fail = true
+	wt.mu.Unlock()
+	before := wt.watchCount()
+	if _, err := server.GetSrvKeyspace("cell", "unsharded"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200 && wt.watchCount() == before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if wt.watchCount() == before {
+		t.Fatalf("want a watch of unsharded")
+	}
+	waitCache(t, server, "SrvKeyspace cell:unsharded ", "polled")
+}
+
+func TestResilientSrvTopoServerWatchEndPoints(t *testing.T) {
+	et := &endPointsTopo{uid: 1}
+	wt := newWatchingTopo(et)
+	server := newResilientSrvTopoServer(wt, "")
+	getUid := func() uint32 {
+		endPoints, err := server.GetEndPoints("cell", "ks", "0", topo.TYPE_MASTER)
+		if err != nil {
+			t.Fatalf("GetEndPoints failed: %v", err)
+		}
+		return endPoints.Entries[0].Uid
+	}
+	getUid()
+	waitCache(t, server, "EndPoints cell:ks:0:master ", "watched")
+
+	et.set(2, false)
+	wt.change("cell:ks:0:master")
+	var uid uint32
+	for i := 0; i < 200; i++ {
+		if uid = getUid(); uid == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if uid != 2 {
+		t.Errorf("want uid 2 after the change, got %v", uid)
+	}
+	wt.end("cell:ks:0:master")
+}
+
+// TestRefreshSrvKeyspace refreshes a SrvKeyspace that is not watched.
+func TestRefreshSrvKeyspace(t *testing.T) {
+	kt := newKeyspaceTopo()
+	server := newResilientSrvTopoServer(kt, "")
+	res := NewResolver(server, "cell", time.Hour)
+	other := NewResolver(server, "other_cell", time.Hour)
+	getShard := func(res *Resolver) string {
+		shard, err := res.GetShardForKeyspaceId("adjacent", topo.TYPE_MASTER, "\x50")
+		if err != nil {
+			t.Fatalf("GetShardForKeyspaceId failed: %v", err)
+		}
+		return shard
+	}
+	getShard(res)
+	getShard(other)
+
+	kt.set("adjacent", masterKeyspace("-"), false)
+	if err := server.RefreshSrvKeyspace("cell", "adjacent"); err != nil {
+		t.Fatal(err)
+	}
+	if shard := getShard(res); shard != "0" {
+		t.Errorf("want shard 0 after the refresh, got %v", shard)
+	}
+	// the resolvers of the other cells are not affected
+	if shard := getShard(other); shard != "40-80" {
+		t.Errorf("want the cached shard 40-80 in the other cell, got %v", shard)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, nil)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "SrvKeyspace cell:adjacent age ") || !strings.HasPrefix(lines[1], "SrvKeyspace other_cell:adjacent age ") {
+		t.Errorf("unexpected cache page:\n%v", w.Body.String())
+	}
+	if !strings.Contains(lines[0], " polled every ") {
+		t.Errorf("want a polled entry, got %v", lines[0])
+	}
+}
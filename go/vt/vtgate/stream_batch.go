@@ -0,0 +1,132 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	streamBatchRows    = flag.Int("stream_batch_rows", 0, "number of rows vtgate accumulates before sending them to a streaming client, 0 for no row target. With no row and no byte target, the packets of the tablets are forwarded as they are.")
+	streamBatchBytes   = flag.Int("stream_batch_bytes", 0, "size in bytes of the rows vtgate accumulates before sending them to a streaming client, 0 for no byte target")
+	streamBatchLatency = flag.Duration("stream_batch_latency", 10*time.Millisecond, "maximum time vtgate keeps the rows of a streaming query before sending them, even if the batch is not full")
+)
+
+// streamBatcher re-batches the rows of a streaming query, so the
+// client receives a few large packets instead of the many small ones
+// some tablets send. Rows are sent when there are maxRows of them,
+// when they're maxBytes large, or maxLatency after the first of them
+// was received, so slow streams don't stall.
+// The packets with Fields are sent as they are, after the pending rows.
+type streamBatcher struct {
+	maxRows    int
+	maxBytes   int
+	maxLatency time.Duration
+	// maxPacketRows and maxPacketBytes bound the packets of the
+	// batched rows, see splitRows.
+	maxPacketRows  int
+	maxPacketBytes int
+	sendReply      func(*proto.QueryResult) error
+
+	mu       sync.Mutex
+	rows     [][]sqltypes.Value
+	size     int
+	packRows bool
+	// timer flushes the pending rows after maxLatency
+	timer *time.Timer
+	// err is the first error of sendReply, the stream is over then
+	err error
+}
+
+// newStreamBatcher creates a streamBatcher sending its packets with
+// sendReply, using the -stream_batch_* flags.
+func newStreamBatcher(sendReply func(*proto.QueryResult) error) *streamBatcher {
+	return &streamBatcher{
+		maxRows:        *streamBatchRows,
+		maxBytes:       *streamBatchBytes,
+		maxLatency:     *streamBatchLatency,
+		maxPacketRows:  *streamPacketRows,
+		maxPacketBytes: *streamPacketBytes,
+		sendReply:      sendReply,
+	}
+}
+
+// send adds a packet of the stream. It returns the error of a
+// previous sendReply, if any.
+func (sb *streamBatcher) send(reply *proto.QueryResult) error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.err != nil {
+		return sb.err
+	}
+	if (sb.maxRows <= 0 && sb.maxBytes <= 0) || len(reply.Fields) != 0 {
+		sb.flushLocked()
+		sb.sendLocked(reply)
+		return sb.err
+	}
+
+	sb.rows = append(sb.rows, reply.Rows...)
+	for _, row := range reply.Rows {
+		for _, value := range row {
+			sb.size += len(value.Raw())
+		}
+	}
+	sb.packRows = reply.PackRows
+	if (sb.maxRows > 0 && len(sb.rows) >= sb.maxRows) || (sb.maxBytes > 0 && sb.size >= sb.maxBytes) {
+		sb.flushLocked()
+		return sb.err
+	}
+	if sb.timer == nil && len(sb.rows) != 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(sb.maxLatency, func() {
+			sb.mu.Lock()
+			defer sb.mu.Unlock()
+			// the rows of this timer may have been sent already
+			if sb.timer == timer {
+				sb.flushLocked()
+			}
+		})
+		sb.timer = timer
+	}
+	return nil
+}
+
+// finish sends the pending rows. It returns the first error of
+// sendReply, if any.
+func (sb *streamBatcher) finish() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flushLocked()
+	return sb.err
+}
+
+// flushLocked sends the pending rows, in one packet unless that
+// packet would be larger than maxPacketRows or maxPacketBytes.
+func (sb *streamBatcher) flushLocked() {
+	if sb.timer != nil {
+		sb.timer.Stop()
+		sb.timer = nil
+	}
+	for _, rows := range splitRows(sb.rows, sb.maxPacketRows, sb.maxPacketBytes) {
+		sb.sendLocked(&proto.QueryResult{
+			Rows:     rows,
+			PackRows: sb.packRows,
+		})
+	}
+	sb.rows = nil
+	sb.size = 0
+}
+
+func (sb *streamBatcher) sendLocked(reply *proto.QueryResult) {
+	if sb.err != nil {
+		return
+	}
+	sb.err = sb.sendReply(reply)
+}
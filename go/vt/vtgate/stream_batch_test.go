@@ -0,0 +1,178 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/bson"
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// batchRecorder records the packets a streamBatcher sends.
+type batchRecorder struct {
+	mu      sync.Mutex
+	packets []*proto.QueryResult
+}
+
+func (br *batchRecorder) sendReply(reply *proto.QueryResult) error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.packets = append(br.packets, reply)
+	return nil
+}
+
+// rowCounts returns the number of rows of each packet, with an F
+// for the packets with Fields.
+func (br *batchRecorder) rowCounts() string {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	result := ""
+	for _, p := range br.packets {
+		if len(p.Fields) != 0 {
+			result += "F"
+		}
+		result += fmt.Sprintf("%v ", len(p.Rows))
+	}
+	return result
+}
+
+func rowPacket(n int) *proto.QueryResult {
+	reply := &proto.QueryResult{}
+	for i := 0; i < n; i++ {
+		reply.Rows = append(reply.Rows, []sqltypes.Value{sqltypes.MakeNumeric([]byte(strconv.Itoa(i % 10)))})
+	}
+	return reply
+}
+
+func newTestStreamBatcher(maxRows, maxBytes int, maxLatency time.Duration) (*streamBatcher, *batchRecorder) {
+	br := &batchRecorder{}
+	sb := newStreamBatcher(br.sendReply)
+	sb.maxRows = maxRows
+	sb.maxBytes = maxBytes
+	sb.maxLatency = maxLatency
+	return sb, br
+}
+
+func TestStreamBatcher(t *testing.T) {
+	// no target, packets are forwarded as they are
+	sb, br := newTestStreamBatcher(0, 0, time.Hour)
+	for _, n := range []int{0, 1, 2} {
+		if err := sb.send(rowPacket(n)); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+	if err := sb.finish(); err != nil {
+		t.Fatalf("finish failed: %v", err)
+	}
+	if got, want := br.rowCounts(), "0 1 2 "; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// row target, the Fields are sent after the pending rows
+	sb, br = newTestStreamBatcher(4, 0, time.Hour)
+	sb.send(&proto.QueryResult{Fields: []mproto.Field{{Name: "id"}}})
+	for i := 0; i < 5; i++ {
+		sb.send(rowPacket(1))
+	}
+	sb.send(&proto.QueryResult{Fields: []mproto.Field{{Name: "id"}}})
+	for i := 0; i < 3; i++ {
+		sb.send(rowPacket(2))
+	}
+	sb.finish()
+	if got, want := br.rowCounts(), "F0 4 1 F0 4 2 "; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// byte target, each row is 1 byte
+	sb, br = newTestStreamBatcher(0, 3, time.Hour)
+	for i := 0; i < 4; i++ {
+		sb.send(rowPacket(2))
+	}
+	sb.finish()
+	if got, want := br.rowCounts(), "4 4 "; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStreamBatcherLatency(t *testing.T) {
+	sb, br := newTestStreamBatcher(100, 0, 10*time.Millisecond)
+	sb.send(rowPacket(1))
+	sb.send(rowPacket(1))
+	time.Sleep(100 * time.Millisecond)
+	if got, want := br.rowCounts(), "2 "; got != want {
+		t.Errorf("slow stream: want %q, got %q", want, got)
+	}
+	sb.send(rowPacket(1))
+	sb.finish()
+	time.Sleep(20 * time.Millisecond)
+	if got, want := br.rowCounts(), "2 1 "; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestStreamBatcherError(t *testing.T) {
+	sendErr := fmt.Errorf("client gone")
+	sends := 0
+	sb := newStreamBatcher(func(*proto.QueryResult) error {
+		sends++
+		return sendErr
+	})
+	sb.maxRows = 2
+	sb.send(rowPacket(1))
+	if err := sb.send(rowPacket(1)); err != sendErr {
+		t.Errorf("want %v, got %v", sendErr, err)
+	}
+	if err := sb.send(rowPacket(5)); err != sendErr {
+		t.Errorf("want %v, got %v", sendErr, err)
+	}
+	if err := sb.finish(); err != sendErr {
+		t.Errorf("want %v, got %v", sendErr, err)
+	}
+	if sends != 1 {
+		t.Errorf("want 1 send, got %v", sends)
+	}
+}
+
+// benchmarkStreamForward forwards a stream of b.N single row packets
+// through a streamBatcher, encoding the packets it sends like the
+// rpc layer does.
+func benchmarkStreamForward(b *testing.B, maxRows int) {
+	packets := 0
+	sb, _ := newTestStreamBatcher(maxRows, 0, time.Hour)
+	sb.sendReply = func(reply *proto.QueryResult) error {
+		packets++
+		_, err := bson.Marshal(reply)
+		return err
+	}
+	packet := rowPacket(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sb.send(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := sb.finish(); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	if packets == 0 || packets > b.N {
+		b.Fatalf("unexpected packet count %v for %v rows", packets, b.N)
+	}
+}
+
+func BenchmarkStreamForwardUnbatched(b *testing.B) {
+	benchmarkStreamForward(b, 0)
+}
+
+func BenchmarkStreamForwardBatched(b *testing.B) {
+	benchmarkStreamForward(b, 1000)
+}
@@ -0,0 +1,75 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	streamPacketRows  = flag.Int("stream_packet_rows", 0, "maximum number of rows of a packet vtgate sends to a streaming client, 0 for no limit. The larger results of the tablets are split.")
+	streamPacketBytes = flag.Int("stream_packet_bytes", 0, "maximum size in bytes of the rows of a packet vtgate sends to a streaming client, 0 for no limit. A row larger than that is sent alone.")
+)
+
+// chunkQueryResult copies mreply into packets of at most maxRows rows
+// of at most maxBytes bytes, 0 meaning no limit. With a limit, the
+// first packet only has the Fields, RowsAffected and InsertId, and
+// the next ones the rows; it is sent even with no rows. Without
+// Fields, the first packet has the first rows. With no limit, mreply
+// is copied into a single packet.
+func chunkQueryResult(mreply *mproto.QueryResult, maxRows, maxBytes int) []*proto.QueryResult {
+	reply := new(proto.QueryResult)
+	proto.PopulateQueryResult(mreply, reply)
+	if maxRows <= 0 && maxBytes <= 0 {
+		return []*proto.QueryResult{reply}
+	}
+
+	chunks := splitRows(reply.Rows, maxRows, maxBytes)
+	packets := make([]*proto.QueryResult, 0, len(chunks)+1)
+	if len(reply.Fields) != 0 || len(chunks) == 0 {
+		reply.Rows = nil
+		packets = append(packets, reply)
+	} else {
+		// no Fields packet, the first rows carry the rest
+		reply.Rows = chunks[0]
+		packets = append(packets, reply)
+		chunks = chunks[1:]
+	}
+	for _, chunk := range chunks {
+		packets = append(packets, &proto.QueryResult{Rows: chunk})
+	}
+	return packets
+}
+
+// splitRows splits rows into consecutive slices of at most maxRows
+// rows of at most maxBytes bytes, 0 meaning no limit. A row larger
+// than maxBytes gets its own slice.
+func splitRows(rows [][]sqltypes.Value, maxRows, maxBytes int) [][][]sqltypes.Value {
+	if len(rows) == 0 {
+		return nil
+	}
+	if maxRows <= 0 && maxBytes <= 0 {
+		return [][][]sqltypes.Value{rows}
+	}
+	var chunks [][][]sqltypes.Value
+	start, size := 0, 0
+	for i, row := range rows {
+		rowSize := 0
+		for _, value := range row {
+			rowSize += len(value.Raw())
+		}
+		full := (maxRows > 0 && i-start >= maxRows) || (maxBytes > 0 && size+rowSize > maxBytes)
+		if full && i > start {
+			chunks = append(chunks, rows[start:i:i])
+			start, size = i, 0
+		}
+		size += rowSize
+	}
+	return append(chunks, rows[start:])
+}
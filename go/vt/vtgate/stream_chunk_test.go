@@ -0,0 +1,152 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// numberedRows returns count rows of one value, i for the i-th row,
+// padded to size bytes.
+func numberedRows(count, size int) [][]sqltypes.Value {
+	rows := make([][]sqltypes.Value, count)
+	for i := range rows {
+		s := strconv.Itoa(i)
+		if len(s) < size {
+			s = strings.Repeat("0", size-len(s)) + s
+		}
+		rows[i] = []sqltypes.Value{sqltypes.MakeString([]byte(s))}
+	}
+	return rows
+}
+
+// packetSizes returns the number of rows of each packet, with an F
+// for the packets with Fields.
+func packetSizes(packets []*proto.QueryResult) string {
+	result := ""
+	for _, p := range packets {
+		if len(p.Fields) != 0 {
+			result += "F"
+		}
+		result += fmt.Sprintf("%v ", len(p.Rows))
+	}
+	return result
+}
+
+func TestChunkQueryResult(t *testing.T) {
+	fields := []mproto.Field{{Name: "id", Type: mproto.VT_VAR_STRING}}
+	testcases := []struct {
+		desc              string
+		fields            bool
+		count, size       int
+		maxRows, maxBytes int
+		want              string
+	}{
+		{"no limit", true, 5, 1, 0, 0, "F5 "},
+		{"no limit, no fields", false, 5, 1, 0, 0, "5 "},
+		{"rows", true, 5, 1, 2, 0, "F0 2 2 1 "},
+		{"rows, exact", true, 4, 1, 2, 0, "F0 2 2 "},
+		{"rows, no fields", false, 5, 1, 2, 0, "2 2 1 "},
+		{"bytes", true, 5, 2, 0, 5, "F0 2 2 1 "},
+		{"bytes, exact", true, 6, 2, 0, 4, "F0 2 2 2 "},
+		{"rows and bytes", true, 7, 2, 3, 4, "F0 2 2 2 1 "},
+		{"large rows", true, 3, 10, 0, 4, "F0 1 1 1 "},
+		{"empty", true, 0, 1, 2, 5, "F0 "},
+		{"empty, no fields", false, 0, 1, 2, 5, "0 "},
+	}
+	for _, tcase := range testcases {
+		mreply := &mproto.QueryResult{RowsAffected: uint64(tcase.count)}
+		if tcase.fields {
+			mreply.Fields = fields
+		}
+		if tcase.count != 0 {
+			mreply.Rows = numberedRows(tcase.count, tcase.size)
+		}
+		packets := chunkQueryResult(mreply, tcase.maxRows, tcase.maxBytes)
+		if got := packetSizes(packets); got != tcase.want {
+			t.Errorf("%s: got %q, want %q", tcase.desc, got, tcase.want)
+			continue
+		}
+		if len(packets[0].Fields) != len(mreply.Fields) || packets[0].RowsAffected != mreply.RowsAffected {
+			t.Errorf("%s: the first packet is %+v", tcase.desc, packets[0])
+		}
+		// No row is dropped or duplicated.
+		var rows [][]sqltypes.Value
+		for _, p := range packets {
+			rows = append(rows, p.Rows...)
+		}
+		if !reflect.DeepEqual(rows, mreply.Rows) {
+			t.Errorf("%s: got rows %v, want %v", tcase.desc, rows, mreply.Rows)
+		}
+	}
+}
+
+func TestStreamBatcherPacketLimits(t *testing.T) {
+	sb, br := newTestStreamBatcher(10, 0, time.Hour)
+	sb.maxPacketRows = 4
+	if err := sb.send(&proto.QueryResult{Fields: []mproto.Field{{Name: "id"}}}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	for _, n := range []int{3, 3, 3, 3} {
+		if err := sb.send(rowPacket(n)); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+	if err := sb.finish(); err != nil {
+		t.Fatalf("finish failed: %v", err)
+	}
+	// the batch of 12 rows is sent in packets of 4 rows
+	if got, want := br.rowCounts(), "F0 4 4 4 "; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestVTGateStreamExecuteShardPacketLimits(t *testing.T) {
+	savedRows := *streamPacketRows
+	*streamPacketRows = 2
+	defer func() { *streamPacketRows = savedRows }()
+
+	resetSandbox()
+	want := numberedRows(5, 1)
+	sbc := &streamRowsConn{results: []*mproto.QueryResult{
+		{Fields: []mproto.Field{{Name: "id", Type: mproto.VT_VAR_STRING}}, Rows: want[:3]},
+		{Rows: want[3:]},
+	}}
+	testConns[0] = sbc
+	q := proto.StreamQueryShard{
+		Sql:        "query",
+		Keyspace:   "spl_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	var packets []*proto.QueryResult
+	err := RpcVTGate.StreamExecuteShard(nil, &q, func(r *proto.QueryResult) error {
+		packets = append(packets, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("want nil, got %v", err)
+	}
+	if got, wantSizes := packetSizes(packets), "F0 2 1 2 "; got != wantSizes {
+		t.Errorf("got %q, want %q", got, wantSizes)
+	}
+	var rows [][]sqltypes.Value
+	for _, p := range packets {
+		rows = append(rows, p.Rows...)
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v, want %v", rows, want)
+	}
+}
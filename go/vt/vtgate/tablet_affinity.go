@@ -0,0 +1,114 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var tabletAffinity = flag.Bool("tablet_affinity", false, "make the reads of each session that are not on a master nor in a transaction stick to a tablet of each shard, as if all the sessions set TabletAffinity")
+
+// pinnedConnection returns the ShardConn of the tablet the reads of
+// session stick to for the shard of sdc, see
+// proto.Session.TabletAffinity, and pins the tablet of sdc the first
+// time. It returns sdc itself, and a 0 uid, if the session doesn't
+// stick to a tablet: without affinity, on a master, or in a
+// transaction.
+func (stc *ScatterConn) pinnedConnection(context interface{}, sdc *ShardConn, keyspace, shard string, tabletType topo.TabletType, transactionId int64, session *SafeSession) (*ShardConn, uint32) {
+	if session == nil || session.Session == nil || tabletType == topo.TYPE_MASTER || transactionId != 0 || session.InTransaction() {
+		return sdc, 0
+	}
+	if !*tabletAffinity && !session.TabletAffinity() {
+		return sdc, 0
+	}
+	uid, ok := session.TabletPin(keyspace, shard, tabletType)
+	if !ok {
+		var err error
+		if uid, err = sdc.endPointUid(context); err != nil {
+			// the call fails the same way on sdc, the next one pins
+			return sdc, 0
+		}
+		session.SetTabletPin(keyspace, shard, tabletType, uid)
+	}
+	return sdc.pinned(uid), uid
+}
+
+// isTabletError returns true if err is an error of the tablet rather
+// than of the query, see errorClass: the tablet may be gone, and the
+// session is pinned to another one.
+func isTabletError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errorClass(err) {
+	case "Retry", "Fatal", "Connection":
+		return true
+	}
+	return false
+}
+
+// pinFailed is called after a tablet error on the end point uid of a
+// pinned ShardConn: the connection of sdc to the same end point, if
+// any, is marked down, so that the next pin is on another one.
+func (sdc *ShardConn) pinFailed(uid uint32) {
+	sdc.mu.Lock()
+	conn := sdc.conn
+	sdc.mu.Unlock()
+	if conn != nil && conn.EndPoint().Uid == uid {
+		sdc.markDown(conn)
+	}
+}
+
+// endPointUid returns the uid of the end point of the connection of
+// sdc, which is dialed if needed.
+func (sdc *ShardConn) endPointUid(context interface{}) (uint32, error) {
+	conn, err, _ := sdc.getConn(context, sdc.timeout)
+	if err != nil {
+		return 0, err
+	}
+	return conn.EndPoint().Uid, nil
+}
+
+// pinned returns the ShardConn of the end point uid of the shard of
+// sdc, created on demand. It only uses that end point: its calls fail
+// once the end point is gone from the serving graph. They are not
+// retried, the session picks another tablet instead.
+func (sdc *ShardConn) pinned(uid uint32) *ShardConn {
+	sdc.mu.Lock()
+	defer sdc.mu.Unlock()
+	if pinned, ok := sdc.pinnedConns[uid]; ok {
+		return pinned
+	}
+	getEndPoints := sdc.balancer.getEndPoints
+	pinned := &ShardConn{
+		keyspace:     sdc.keyspace,
+		shard:        sdc.shard,
+		tabletType:   sdc.tabletType,
+		retryDelay:   sdc.retryDelay,
+		retryTimeout: sdc.retryTimeout,
+		timeout:      sdc.timeout,
+		balancer: NewBalancer(func() (*topo.EndPoints, error) {
+			endPoints, err := getEndPoints()
+			if err != nil {
+				return nil, err
+			}
+			for _, endPoint := range endPoints.Entries {
+				if endPoint.Uid == uid {
+					return &topo.EndPoints{Entries: []topo.EndPoint{endPoint}}, nil
+				}
+			}
+			return nil, fmt.Errorf("tablet %v is no longer serving", uid)
+		}, sdc.retryDelay),
+		invalidateEndPoints: sdc.invalidateEndPoints,
+	}
+	if sdc.pinnedConns == nil {
+		sdc.pinnedConns = make(map[uint32]*ShardConn)
+	}
+	sdc.pinnedConns[uid] = pinned
+	return pinned
+}
@@ -0,0 +1,166 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+// replicasTopo is a sandboxTopo whose shards are served by the end
+// points of uids, which can be changed.
+type replicasTopo struct {
+	sandboxTopo
+
+	mu   sync.Mutex
+	uids []uint32
+}
+
+func (rt *replicasTopo) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	endPoints := &topo.EndPoints{}
+	for _, uid := range rt.uids {
+		endPoints.Entries = append(endPoints.Entries, topo.EndPoint{Uid: uid, Host: shard, NamedPortMap: map[string]int{"vt": 1}})
+	}
+	return endPoints, nil
+}
+
+func (rt *replicasTopo) setUids(uids ...uint32) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.uids = uids
+}
+
+func TestScatterConnTabletAffinity(t *testing.T) {
+	resetSandbox()
+	sbcs := map[uint32]*sandboxConn{100: {}, 101: {}}
+	for uid, sbc := range sbcs {
+		testConns[uid] = sbc
+	}
+	rt := &replicasTopo{uids: []uint32{100, 101}}
+	stc := NewScatterConn(rt, "aa", 1*time.Millisecond, 3, 10*time.Second)
+	session := NewSafeSession(&proto.Session{TabletAffinity: true})
+	execute := func(session *SafeSession, tabletType topo.TabletType) error {
+		_, err := stc.Execute(nil, "query", nil, "ks", []string{"0"}, tabletType, session, 0)
+		return err
+	}
+	pin := func() uint32 {
+		uid, ok := session.TabletPin("ks", "0", topo.TYPE_REPLICA)
+		if !ok {
+			t.Fatalf("no pin in %+v", session.Session)
+		}
+		return uid
+	}
+	// other returns the end point that is not uid
+	other := func(uid uint32) uint32 {
+		if uid == 100 {
+			return 101
+		}
+		return 100
+	}
+
+	if err := execute(session, topo.TYPE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	pinned := pin()
+	// the connection of the shard goes to the other end point once
+	// it's dialed again, the reads of the session don't
+	for i := 0; i < 4; i++ {
+		stc.getConnection("ks", "0", topo.TYPE_REPLICA).Close()
+		if err := execute(session, topo.TYPE_REPLICA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sbcs[pinned].ExecCount.Get(); got != 5 {
+		t.Errorf("want 5 reads on the pinned tablet, got %v", got)
+	}
+	if got := sbcs[other(pinned)].ExecCount.Get(); got != 0 {
+		t.Errorf("want no reads on the other tablet, got %v", got)
+	}
+
+	// the sessions without affinity, the masters and the
+	// transactions are not pinned
+	plain := NewSafeSession(&proto.Session{})
+	if err := execute(plain, topo.TYPE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	if len(plain.TabletPins) != 0 {
+		t.Errorf("want no pins without affinity, got %v", plain.TabletPins)
+	}
+	if err := execute(session, topo.TYPE_MASTER); err != nil {
+		t.Fatal(err)
+	}
+	inTransaction := NewSafeSession(&proto.Session{InTransaction: true, TabletAffinity: true})
+	if err := execute(inTransaction, topo.TYPE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.TabletPins) != 1 || len(inTransaction.TabletPins) != 0 {
+		t.Errorf("want only the replica pin, got %v and %v", session.TabletPins, inTransaction.TabletPins)
+	}
+
+	// a tablet error drops the pin, the next read pins another tablet
+	sbcs[pinned].mustFailConn = 2
+	if err := execute(session, topo.TYPE_REPLICA); err == nil {
+		t.Errorf("want an error from the pinned tablet")
+	}
+	if uid, ok := session.TabletPin("ks", "0", topo.TYPE_REPLICA); ok {
+		t.Errorf("want no pin after the error, got %v", uid)
+	}
+	if err := execute(session, topo.TYPE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	if got := pin(); got != other(pinned) {
+		t.Errorf("want a pin on %v, got %v", other(pinned), got)
+	}
+
+	// so does a tablet that is gone from the serving graph
+	pinned = pin()
+	rt.setUids(other(pinned))
+	sbcs[pinned].mustFailConn = 10
+	if err := execute(session, topo.TYPE_REPLICA); err == nil {
+		t.Errorf("want an error for the tablet that is gone")
+	}
+	if err := execute(session, topo.TYPE_REPLICA); err != nil {
+		t.Fatal(err)
+	}
+	if got := pin(); got != other(pinned) {
+		t.Errorf("want a pin on %v, got %v", other(pinned), got)
+	}
+}
+
+// TestScatterConnTabletAffinityConcurrent is meant for the race
+// detector: the shards of a query pin their tablets at once.
+func TestScatterConnTabletAffinityConcurrent(t *testing.T) {
+	resetSandbox()
+	shards := []string{"-20", "20-40", "40-60", "60-80"}
+	for _, shard := range shards {
+		mapTestConn(shard, &sandboxConn{})
+	}
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 10*time.Second)
+	session := NewSafeSession(&proto.Session{TabletAffinity: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := stc.Execute(nil, "query", nil, "ks", shards, topo.TYPE_REPLICA, session, 0); err != nil {
+					t.Errorf("Execute failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(session.TabletPins) != len(shards) {
+		t.Errorf("want a pin for each shard, got %v", session.TabletPins)
+	}
+}
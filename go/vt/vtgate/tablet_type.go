@@ -0,0 +1,68 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// InvalidTabletTypeError is returned for the requests whose tablet
+// type, or the tablet type of one of their ShardSessions, is not a
+// tablet type, or is one that doesn't serve queries. They are
+// rejected before any shard is resolved.
+type InvalidTabletTypeError struct {
+	TabletType topo.TabletType
+	// ShardSession is set if the tablet type comes from a
+	// ShardSession of the request Session.
+	ShardSession *proto.ShardSession
+}
+
+func (e *InvalidTabletTypeError) Error() string {
+	var msg string
+	if topo.IsTypeInList(e.TabletType, topo.AllTabletTypes) {
+		msg = fmt.Sprintf("tablet type %q doesn't serve queries, use master, replica, rdonly or batch", e.TabletType)
+	} else {
+		msg = fmt.Sprintf("unknown tablet type %q", e.TabletType)
+	}
+	if e.ShardSession != nil {
+		return fmt.Sprintf("vtgate: bad session for shard %v/%v: %v", e.ShardSession.Keyspace, e.ShardSession.Shard, msg)
+	}
+	return "vtgate: " + msg
+}
+
+// validateTabletType checks that the tablet type of a request is a
+// tablet type that serves queries.
+func validateTabletType(tabletType topo.TabletType) error {
+	if !topo.IsInServingGraph(tabletType) {
+		return &InvalidTabletTypeError{TabletType: tabletType}
+	}
+	return nil
+}
+
+// validateSession checks the tablet type of the ShardSessions of a
+// request Session, so a corrupted Session fails loudly.
+func validateSession(session *proto.Session) error {
+	if session == nil {
+		return nil
+	}
+	for _, shardSession := range session.ShardSessions {
+		if !topo.IsInServingGraph(shardSession.TabletType) {
+			return &InvalidTabletTypeError{TabletType: shardSession.TabletType, ShardSession: shardSession}
+		}
+	}
+	return nil
+}
+
+// validateRequestTabletTypes checks the tablet type of a request
+// and of its Session.
+func validateRequestTabletTypes(tabletType topo.TabletType, session *proto.Session) error {
+	if err := validateTabletType(tabletType); err != nil {
+		return err
+	}
+	return validateSession(session)
+}
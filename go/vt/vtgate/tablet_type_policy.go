@@ -0,0 +1,214 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var tabletTypePolicyFile = flag.String("tablet_type_policy_file", "", "JSON file of the default tablet type and the fallback tablet types of each keyspace, see TabletTypePolicyConfig. It is reloaded on SIGHUP, or by a POST to /debug/tablet_type_policy. Empty for none.")
+
+// TabletTypePolicyConfig is the content of -tablet_type_policy_file,
+// e.g.
+//
+//	{
+//	  "Keyspaces": {
+//	    "reporting": {"DefaultTabletType": "rdonly", "FallbackTabletTypes": ["replica"]},
+//	    "user_data": {"DefaultTabletType": "replica"}
+//	  }
+//	}
+//
+// The requests without tablet type query the rdonly tablets of
+// reporting, and the replica tablets of user_data. The requests on the
+// other keyspaces need a tablet type. When a shard of reporting has no
+// end points of the tablet type of a request, the replica ones are
+// used instead. The requests for master, and the ones in a
+// transaction, never fall back. The access control only checks the
+// tablet type of the request.
+type TabletTypePolicyConfig struct {
+	Keyspaces map[string]KeyspaceTabletTypePolicy
+}
+
+// KeyspaceTabletTypePolicy is the policy of a keyspace in a
+// TabletTypePolicyConfig. Both fields are optional.
+type KeyspaceTabletTypePolicy struct {
+	DefaultTabletType topo.TabletType
+	// FallbackTabletTypes are tried in order.
+	FallbackTabletTypes []topo.TabletType
+}
+
+// parseTabletTypePolicy checks a TabletTypePolicyConfig in JSON.
+func parseTabletTypePolicy(data []byte) (*TabletTypePolicyConfig, error) {
+	config := new(TabletTypePolicyConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	for keyspace, policy := range config.Keyspaces {
+		if policy.DefaultTabletType != "" && !topo.IsInServingGraph(policy.DefaultTabletType) {
+			return nil, fmt.Errorf("keyspace %v: tablet type %q doesn't serve queries", keyspace, policy.DefaultTabletType)
+		}
+		for _, tabletType := range policy.FallbackTabletTypes {
+			if !topo.IsInServingGraph(tabletType) {
+				return nil, fmt.Errorf("keyspace %v: tablet type %q doesn't serve queries", keyspace, tabletType)
+			}
+		}
+	}
+	return config, nil
+}
+
+// tabletTypePolicy applies the policies of a file, and reloads them
+// when asked to. A nil *tabletTypePolicy has no policy.
+type tabletTypePolicy struct {
+	file string
+
+	// fallbacks counts the shard queries that fell back, by
+	// "<keyspace>.<tablet type>.<fallback tablet type>"
+	fallbacks *stats.Counters
+
+	mu     sync.RWMutex
+	config *TabletTypePolicyConfig
+}
+
+// newTabletTypePolicy creates a tabletTypePolicy with the policies of
+// file, or returns nil if file is empty. If name is not empty, it
+// exports <name>Fallbacks.
+func newTabletTypePolicy(name, file string) (*tabletTypePolicy, error) {
+	if file == "" {
+		return nil, nil
+	}
+	ttp := &tabletTypePolicy{
+		file:      file,
+		fallbacks: stats.NewCounters(""),
+	}
+	if err := ttp.reload(); err != nil {
+		return nil, err
+	}
+	if name != "" {
+		stats.Publish(name+"Fallbacks", ttp.fallbacks)
+	}
+	return ttp, nil
+}
+
+// reload reads the policies of the file again. The previous policies
+// stay in effect if it fails.
+func (ttp *tabletTypePolicy) reload() error {
+	data, err := ioutil.ReadFile(ttp.file)
+	if err != nil {
+		return err
+	}
+	config, err := parseTabletTypePolicy(data)
+	if err != nil {
+		return fmt.Errorf("bad tablet type policy file %v: %v", ttp.file, err)
+	}
+	ttp.mu.Lock()
+	defer ttp.mu.Unlock()
+	ttp.config = config
+	return nil
+}
+
+// reloadOnSignal reloads the policies on each SIGHUP.
+func (ttp *tabletTypePolicy) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			if err := ttp.reload(); err != nil {
+				log.Errorf("cannot reload the tablet type policy, keeping the previous one: %v", err)
+				continue
+			}
+			log.Infof("reloaded the tablet type policy from %v", ttp.file)
+		}
+	}()
+}
+
+// policy returns the policy of keyspace.
+func (ttp *tabletTypePolicy) policy(keyspace string) KeyspaceTabletTypePolicy {
+	if ttp == nil {
+		return KeyspaceTabletTypePolicy{}
+	}
+	ttp.mu.RLock()
+	defer ttp.mu.RUnlock()
+	return ttp.config.Keyspaces[keyspace]
+}
+
+// defaultTabletType returns the tablet type of a request on keyspace:
+// tabletType, or the default one of the keyspace if it is empty.
+func (ttp *tabletTypePolicy) defaultTabletType(keyspace string, tabletType topo.TabletType) topo.TabletType {
+	if tabletType != "" {
+		return tabletType
+	}
+	if defaultTabletType := ttp.policy(keyspace).DefaultTabletType; defaultTabletType != "" {
+		return defaultTabletType
+	}
+	return tabletType
+}
+
+// fallbackTabletType returns the tablet type a query for tabletType
+// runs on in a shard: tabletType if the shard has end points of it,
+// or else the first of the fallback tablet types of the keyspace it
+// has end points of, and counts the fallback. The queries for master,
+// and the ones in a transaction, never fall back.
+func (ttp *tabletTypePolicy) fallbackTabletType(topoServer SrvTopoServer, cell, keyspace, shard string, tabletType topo.TabletType, inTransaction bool) topo.TabletType {
+	if tabletType == topo.TYPE_MASTER || inTransaction {
+		return tabletType
+	}
+	fallbacks := ttp.policy(keyspace).FallbackTabletTypes
+	if len(fallbacks) == 0 || hasEndPoints(topoServer, cell, keyspace, shard, tabletType) {
+		return tabletType
+	}
+	for _, fallback := range fallbacks {
+		if fallback != tabletType && hasEndPoints(topoServer, cell, keyspace, shard, fallback) {
+			ttp.fallbacks.Add(keyspace+"."+string(tabletType)+"."+string(fallback), 1)
+			return fallback
+		}
+	}
+	return tabletType
+}
+
+// hasEndPoints returns true if the serving graph has end points of
+// tabletType in the shard.
+func hasEndPoints(topoServer SrvTopoServer, cell, keyspace, shard string, tabletType topo.TabletType) bool {
+	endPoints, err := topoServer.GetEndPoints(cell, keyspace, shard, tabletType)
+	return err == nil && len(endPoints.Entries) > 0
+}
+
+// ServeHTTP lists the policy of each keyspace. A POST reloads the
+// file first.
+func (ttp *tabletTypePolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r != nil && r.Method == "POST" {
+		if err := ttp.reload(); err != nil {
+			http.Error(w, fmt.Sprintf("cannot reload the tablet type policy, keeping the previous one: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("reloaded the tablet type policy from %v", ttp.file)
+		fmt.Fprintf(w, "reloaded %v\n", ttp.file)
+	}
+	ttp.mu.RLock()
+	config := ttp.config
+	ttp.mu.RUnlock()
+	keyspaces := make([]string, 0, len(config.Keyspaces))
+	for keyspace := range config.Keyspaces {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Strings(keyspaces)
+	for _, keyspace := range keyspaces {
+		policy := config.Keyspaces[keyspace]
+		fmt.Fprintf(w, "%v: default %q, fallback %v\n", keyspace, policy.DefaultTabletType, policy.FallbackTabletTypes)
+	}
+}
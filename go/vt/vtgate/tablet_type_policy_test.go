@@ -0,0 +1,194 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+const testTabletTypePolicy = `{
+  "Keyspaces": {
+    "reporting": {"DefaultTabletType": "rdonly", "FallbackTabletTypes": ["batch", "replica"]},
+    "user_data": {"DefaultTabletType": "replica"}
+  }
+}`
+
+// writeTabletTypePolicy writes a tablet type policy file in dir.
+func writeTabletTypePolicy(t *testing.T, dir, policy string) string {
+	file := path.Join(dir, "tablet_type_policy.json")
+	if err := ioutil.WriteFile(file, []byte(policy), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return file
+}
+
+func TestParseTabletTypePolicy(t *testing.T) {
+	for _, bad := range []string{
+		`{"Keyspaces": `,
+		`{"Keyspaces": {"ks": {"DefaultTabletType": "spare"}}}`,
+		`{"Keyspaces": {"ks": {"FallbackTabletTypes": ["replica", "unknown"]}}}`,
+	} {
+		if _, err := parseTabletTypePolicy([]byte(bad)); err == nil {
+			t.Errorf("parseTabletTypePolicy(%v) worked", bad)
+		}
+	}
+}
+
+func TestTabletTypePolicy(t *testing.T) {
+	// no policy changes nothing
+	var nilPolicy *tabletTypePolicy
+	if got := nilPolicy.defaultTabletType("reporting", ""); got != "" {
+		t.Errorf("nil policy: want no default tablet type, got %v", got)
+	}
+	if got := nilPolicy.fallbackTabletType(nil, "cell", "reporting", "0", topo.TYPE_RDONLY, false); got != topo.TYPE_RDONLY {
+		t.Errorf("nil policy: want no fallback, got %v", got)
+	}
+	if ttp, err := newTabletTypePolicy("", ""); ttp != nil || err != nil {
+		t.Errorf("want nil policy, got %v %v", ttp, err)
+	}
+
+	dir, err := ioutil.TempDir("", "tablet_type_policy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeTabletTypePolicy(t, dir, testTabletTypePolicy)
+	ttp, err := newTabletTypePolicy("", file)
+	if err != nil {
+		t.Fatalf("newTabletTypePolicy failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		keyspace   string
+		tabletType topo.TabletType
+		want       topo.TabletType
+	}{
+		{"reporting", "", topo.TYPE_RDONLY},
+		{"reporting", topo.TYPE_MASTER, topo.TYPE_MASTER},
+		{"user_data", "", topo.TYPE_REPLICA},
+		{"other", "", ""},
+	} {
+		if got := ttp.defaultTabletType(c.keyspace, c.tabletType); got != c.want {
+			t.Errorf("defaultTabletType(%v, %q) = %q, want %q", c.keyspace, c.tabletType, got, c.want)
+		}
+	}
+
+	ht := &healthTopo{endPoints: map[string]int{
+		"reporting/-80/rdonly":  1,
+		"reporting/80-/replica": 2,
+		"reporting/80-/master":  1,
+		"user_data/0/replica":   0,
+		"user_data/0/master":    1,
+	}}
+	for _, c := range []struct {
+		keyspace, shard string
+		tabletType      topo.TabletType
+		inTransaction   bool
+		want            topo.TabletType
+	}{
+		// the shard has end points of the tablet type
+		{"reporting", "-80", topo.TYPE_RDONLY, false, topo.TYPE_RDONLY},
+		// it has none, batch is skipped for replica
+		{"reporting", "80-", topo.TYPE_RDONLY, false, topo.TYPE_REPLICA},
+		// there is no fallback in a transaction
+		{"reporting", "80-", topo.TYPE_RDONLY, true, topo.TYPE_RDONLY},
+		// nor from master
+		{"reporting", "c0-", topo.TYPE_MASTER, false, topo.TYPE_MASTER},
+		// nor without fallback tablet types
+		{"user_data", "0", topo.TYPE_REPLICA, false, topo.TYPE_REPLICA},
+		// nor if no fallback tablet type has end points
+		{"reporting", "c0-", topo.TYPE_RDONLY, false, topo.TYPE_RDONLY},
+	} {
+		if got := ttp.fallbackTabletType(ht, "cell", c.keyspace, c.shard, c.tabletType, c.inTransaction); got != c.want {
+			t.Errorf("fallbackTabletType(%v/%v, %v, %v) = %v, want %v", c.keyspace, c.shard, c.tabletType, c.inTransaction, got, c.want)
+		}
+	}
+	if counts := ttp.fallbacks.Counts(); len(counts) != 1 || counts["reporting.rdonly.replica"] != 1 {
+		t.Errorf("want 1 fallback from rdonly to replica, got %v", counts)
+	}
+
+	// a POST reloads the file, a bad file is not loaded
+	serve := func(method string) (int, string) {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(method, "/debug/tablet_type_policy", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttp.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+	want := "reporting: default \"rdonly\", fallback [batch replica]\nuser_data: default \"replica\", fallback []\n"
+	if code, page := serve("GET"); code != http.StatusOK || page != want {
+		t.Errorf("want\n%v, got %v\n%v", want, code, page)
+	}
+	writeTabletTypePolicy(t, dir, `{"Keyspaces": {"reporting": {"DefaultTabletType": "spare"}}}`)
+	if code, page := serve("POST"); code != http.StatusInternalServerError || !strings.Contains(page, "spare") {
+		t.Errorf("want an error, got %v\n%v", code, page)
+	}
+	writeTabletTypePolicy(t, dir, `{"Keyspaces": {"reporting": {"DefaultTabletType": "batch"}}}`)
+	if code, page := serve("POST"); code != http.StatusOK || !strings.HasPrefix(page, "reloaded ") {
+		t.Errorf("want a reload, got %v\n%v", code, page)
+	}
+	if got := ttp.defaultTabletType("reporting", ""); got != topo.TYPE_BATCH {
+		t.Errorf("want the reloaded default tablet type batch, got %v", got)
+	}
+	if got := ttp.defaultTabletType("user_data", ""); got != "" {
+		t.Errorf("want no default tablet type after the reload, got %v", got)
+	}
+}
+
+func TestTabletTypePolicyDefault(t *testing.T) {
+	resetSandbox()
+	dir, err := ioutil.TempDir("", "tablet_type_policy")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ttp, err := newTabletTypePolicy("", writeTabletTypePolicy(t, dir, testTabletTypePolicy))
+	if err != nil {
+		t.Fatalf("newTabletTypePolicy failed: %v", err)
+	}
+	RpcVTGate.tabletTypePolicy = ttp
+	defer func() {
+		RpcVTGate.tabletTypePolicy = nil
+	}()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+
+	q := proto.QueryShard{
+		Sql:      "query",
+		Keyspace: "reporting",
+		Shards:   []string{"0"},
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || q.TabletType != topo.TYPE_RDONLY {
+		t.Errorf("want a query on rdonly, got %v, %v", q.TabletType, qr.Error)
+	}
+
+	// the keyspaces without default still need a tablet type
+	q = proto.QueryShard{
+		Sql:      "query",
+		Keyspace: "other",
+		Shards:   []string{"0"},
+	}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if want := `vtgate: unknown tablet type ""`; qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+	if sbc.ExecCount != 1 {
+		t.Errorf("want 1 query on the tablet, got %v", sbc.ExecCount)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"testing"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func TestInvalidTabletType(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "tt_keyspace",
+		Shards:     []string{"0"},
+		TabletType: topo.TabletType("mater"),
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	want := `vtgate: unknown tablet type "mater"`
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+
+	q.TabletType = topo.TYPE_SCRAP
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	want = `vtgate: tablet type "scrap" doesn't serve queries, use master, replica, rdonly or batch`
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+
+	err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(*proto.QueryResult) error { return nil })
+	if _, ok := err.(*InvalidTabletTypeError); !ok {
+		t.Errorf("want *InvalidTabletTypeError, got %v", err)
+	}
+
+	// the tablet types of the session are checked too
+	session := &proto.Session{
+		InTransaction: true,
+		ShardSessions: []*proto.ShardSession{{
+			Keyspace:      "tt_keyspace",
+			Shard:         "0",
+			TabletType:    topo.TabletType(""),
+			TransactionId: 1,
+		}},
+	}
+	q.TabletType = topo.TYPE_MASTER
+	q.Session = session
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	want = `vtgate: bad session for shard tt_keyspace/0: unknown tablet type ""`
+	if qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+	if err := RpcVTGate.Commit(nil, session); err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	if sbc.ExecCount != 0 || sbc.CommitCount != 0 {
+		t.Errorf("rejected requests reached the tablet: %v executes, %v commits", sbc.ExecCount, sbc.CommitCount)
+	}
+}
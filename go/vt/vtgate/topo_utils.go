@@ -6,78 +6,346 @@ package vtgate
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/youtube/vitess/go/vt/key"
 	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
 
-func getShardForKeyspaceId(topoServ SrvTopoServer, cell, keyspace string, keyspaceId key.KeyspaceId, tabletType topo.TabletType) (string, error) {
+func getKeyspaceAlias(topoServ SrvTopoServer, cell, keyspace string, tabletType topo.TabletType) (string, error) {
 	srvKeyspace, err := topoServ.GetSrvKeyspace(cell, keyspace)
 	if err != nil {
 		return "", fmt.Errorf("keyspace fetch error: %v", err)
 	}
 
-	partition, ok := srvKeyspace.Partitions[tabletType]
-	if !ok {
-		return "", fmt.Errorf("No partition found for this tabletType")
+	// check if the keyspace has been redirected for this tabletType.
+	if servedFrom, ok := srvKeyspace.ServedFrom[tabletType]; ok {
+		return servedFrom, nil
 	}
 
-	allShards := partition.Shards
-	if len(allShards) == 0 {
-		return "", fmt.Errorf("No shards found for this tabletType")
+	return keyspace, nil
+}
+
+// KeyRangeNotCoveredError is returned for the key range requests
+// whose key range is not entirely covered by the serving shards of
+// their tablet type, e.g. during a gap in the serving graph, unless
+// -allow_partial_keyrange is set.
+type KeyRangeNotCoveredError struct {
+	Keyspace   string
+	TabletType topo.TabletType
+	KeyRange   key.KeyRange
+	// Uncovered are the sub-ranges of KeyRange no shard serves.
+	Uncovered []key.KeyRange
+	// Shards are the serving shards that intersect KeyRange.
+	Shards []string
+}
+
+func (e *KeyRangeNotCoveredError) Error() string {
+	uncovered := make([]string, len(e.Uncovered))
+	for i, kr := range e.Uncovered {
+		uncovered[i] = keyRangeName(kr)
 	}
+	return fmt.Sprintf("vtgate: key range %v of keyspace %v is not covered by the %v shards, missing %v, shards considered %v", keyRangeName(e.KeyRange), e.Keyspace, e.TabletType, strings.Join(uncovered, ", "), e.Shards)
+}
 
-	for _, srvShard := range allShards {
-		if srvShard.KeyRange.Contains(keyspaceId) {
-			return srvShard.ShardName(), nil
+// keyRangeName returns the hex form of a key range, as in shard names.
+func keyRangeName(kr key.KeyRange) string {
+	return fmt.Sprintf("%v-%v", string(kr.Start.Hex()), string(kr.End.Hex()))
+}
+
+// keyRangesName returns the hex form of several key ranges, separated
+// by commas.
+func keyRangesName(krs []key.KeyRange) string {
+	names := make([]string, len(krs))
+	for i, kr := range krs {
+		names[i] = keyRangeName(kr)
+	}
+	return strings.Join(names, ",")
+}
+
+// mergeKeyRanges returns the union of krs as the fewest key ranges,
+// sorted by start: the key ranges that overlap or touch are merged.
+// krs is not modified.
+func mergeKeyRanges(krs []key.KeyRange) []key.KeyRange {
+	sorted := make([]key.KeyRange, len(krs))
+	copy(sorted, krs)
+	sort.Sort(keyRangesByStart(sorted))
+	var merged []key.KeyRange
+	for _, kr := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.End == key.MaxKey || kr.Start <= last.End {
+				if last.End != key.MaxKey && (kr.End == key.MaxKey || kr.End > last.End) {
+					last.End = kr.End
+				}
+				continue
+			}
 		}
+		merged = append(merged, kr)
 	}
-	return "", fmt.Errorf("KeyspaceId didn't match any shards")
+	return merged
 }
 
-func getKeyspaceAlias(topoServ SrvTopoServer, cell, keyspace string, tabletType topo.TabletType) (string, error) {
-	srvKeyspace, err := topoServ.GetSrvKeyspace(cell, keyspace)
+// keyRangesByStart sorts key ranges by their start.
+type keyRangesByStart []key.KeyRange
+
+func (krs keyRangesByStart) Len() int           { return len(krs) }
+func (krs keyRangesByStart) Swap(i, j int)      { krs[i], krs[j] = krs[j], krs[i] }
+func (krs keyRangesByStart) Less(i, j int) bool { return krs[i].Start < krs[j].Start }
+
+// parseKeyRange parses the key range of a request, "<start>-<end>" in
+// hex like the key range shard names. "-" is the whole key space.
+func parseKeyRange(spec string) (key.KeyRange, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return key.KeyRange{}, fmt.Errorf("vtgate: malformed key range %q, want <start>-<end> in hex", spec)
+	}
+	kr, err := key.ParseKeyRangeParts(parts[0], parts[1])
 	if err != nil {
-		return "", fmt.Errorf("keyspace fetch error: %v", err)
+		return key.KeyRange{}, fmt.Errorf("vtgate: malformed key range %q: %v", spec, err)
 	}
-
-	// check if the keyspace has been redirected for this tabletType.
-	if servedFrom, ok := srvKeyspace.ServedFrom[tabletType]; ok {
-		return servedFrom, nil
+	if kr.End != key.MaxKey && kr.Start >= kr.End {
+		return key.KeyRange{}, fmt.Errorf("vtgate: empty key range %q, its start must be before its end", spec)
 	}
-
-	return keyspace, nil
+	return kr, nil
 }
 
-// This maps a list of keyranges to shard names.
-func resolveKeyRangeToShards(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, kr key.KeyRange) ([]string, error) {
+// This maps a list of keyranges to shard names. It also returns the
+// sub-ranges of kr that no shard covers.
+func resolveKeyRangeToShards(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, kr key.KeyRange) ([]string, []key.KeyRange, error) {
 	srvKeyspace, err := topoServer.GetSrvKeyspace(cell, keyspace)
 	if err != nil {
-		return nil, fmt.Errorf("Error in reading the keyspace %v", err)
+		return nil, nil, fmt.Errorf("Error in reading the keyspace %v", err)
 	}
 
 	tabletTypePartition, ok := srvKeyspace.Partitions[tabletType]
 	if !ok {
-		return nil, fmt.Errorf("No shards available for tablet type '%v' in keyspace '%v'", tabletType, keyspace)
+		return nil, nil, fmt.Errorf("No shards available for tablet type '%v' in keyspace '%v'", tabletType, keyspace)
 	}
 
-	topo.SrvShardArray(tabletTypePartition.Shards).Sort()
+	shards, uncovered := coverKeyRange(sortedShards(tabletTypePartition.Shards), kr)
+	return shards, uncovered, nil
+}
+
+// sortedShards returns a copy of shards sorted by key range. The
+// shards of the SrvKeyspaces are shared by the concurrent requests,
+// so they are not sorted in place.
+func sortedShards(shards []topo.SrvShard) []topo.SrvShard {
+	sorted := make([]topo.SrvShard, len(shards))
+	copy(sorted, shards)
+	topo.SrvShardArray(sorted).Sort()
+	return sorted
+}
 
-	shards := make([]string, 0, 1)
-	if !kr.IsPartial() {
-		for j := 0; j < len(tabletTypePartition.Shards); j++ {
-			shards = append(shards, tabletTypePartition.Shards[j].ShardName())
+// coverKeyRange returns the names of the shards that intersect kr,
+// and the sub-ranges of kr that none of them covers. shards must be
+// sorted by key range.
+func coverKeyRange(shards []topo.SrvShard, kr key.KeyRange) ([]string, []key.KeyRange) {
+	names := make([]string, 0, 1)
+	var uncovered []key.KeyRange
+	// covered is where the shards found so far end, done is set
+	// once they reach MaxKey.
+	covered, done := kr.Start, false
+	for j := 0; j < len(shards); j++ {
+		shard := shards[j]
+		if kr.End != key.MaxKey && kr.End <= shard.KeyRange.Start {
+			break
+		}
+		if !key.KeyRangesIntersect(kr, shard.KeyRange) {
+			continue
+		}
+		names = append(names, shard.ShardName())
+		if done {
+			continue
 		}
-		return shards, nil
+		if shard.KeyRange.Start > covered {
+			uncovered = append(uncovered, key.KeyRange{Start: covered, End: shard.KeyRange.Start})
+		}
+		switch {
+		case shard.KeyRange.End == key.MaxKey:
+			done = true
+		case shard.KeyRange.End > covered:
+			covered = shard.KeyRange.End
+		}
+	}
+	if !done && (kr.End == key.MaxKey || covered < kr.End) {
+		uncovered = append(uncovered, key.KeyRange{Start: covered, End: kr.End})
+	}
+	return names, uncovered
+}
+
+// mapKeyspaceIdsToShards returns the shards of a keyspace that serve
+// keyspaceIds for a tabletType, each one once, in the order of the
+// first keyspace id they serve. The shards of a keyspace served from
+// another one are looked up in that other keyspace.
+func mapKeyspaceIdsToShards(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, keyspaceIds []key.KeyspaceId) ([]string, error) {
+	if len(keyspaceIds) == 0 {
+		return nil, fmt.Errorf("vtgate: no keyspace ids in the request for keyspace %v", keyspace)
 	}
-	for j := 0; j < len(tabletTypePartition.Shards); j++ {
-		shard := tabletTypePartition.Shards[j]
-		if key.KeyRangesIntersect(kr, shard.KeyRange) {
-			shards = append(shards, shard.ShardName())
+	alias, partition, err := getServingPartition(topoServer, cell, keyspace, tabletType)
+	if err != nil {
+		return nil, err
+	}
+	var shards []string
+	seen := make(map[string]bool)
+	for _, keyspaceId := range keyspaceIds {
+		shard, err := getPartitionShard(alias, tabletType, partition, keyspaceId)
+		if err != nil {
+			return nil, err
 		}
-		if kr.End != key.MaxKey && kr.End < shard.KeyRange.Start {
-			break
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
 		}
 	}
 	return shards, nil
 }
+
+// mapEntityIdsToShards groups the external ids of entityIds by the
+// shard that serves their keyspace id for a tabletType, see
+// mapKeyspaceIdsToShards.
+func mapEntityIdsToShards(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, entityIds []proto.EntityId) (map[string][]interface{}, error) {
+	if len(entityIds) == 0 {
+		return nil, fmt.Errorf("vtgate: no entity ids in the request for keyspace %v", keyspace)
+	}
+	alias, partition, err := getServingPartition(topoServer, cell, keyspace, tabletType)
+	if err != nil {
+		return nil, err
+	}
+	shardIds := make(map[string][]interface{})
+	for _, entityId := range entityIds {
+		shard, err := getPartitionShard(alias, tabletType, partition, entityId.KeyspaceId)
+		if err != nil {
+			return nil, err
+		}
+		shardIds[shard] = append(shardIds[shard], entityId.ExternalId)
+	}
+	return shardIds, nil
+}
+
+// getServingPartition returns the keyspace that serves tabletType for
+// keyspace, itself unless it is served from another one, and its
+// partition for tabletType.
+func getServingPartition(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType) (string, *topo.KeyspacePartition, error) {
+	alias, err := getKeyspaceAlias(topoServer, cell, keyspace, tabletType)
+	if err != nil {
+		return "", nil, err
+	}
+	srvKeyspace, err := topoServer.GetSrvKeyspace(cell, alias)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error in reading the keyspace %v", err)
+	}
+	partition, ok := srvKeyspace.Partitions[tabletType]
+	if !ok {
+		return "", nil, fmt.Errorf("No shards available for tablet type '%v' in keyspace '%v'", tabletType, alias)
+	}
+	return alias, partition, nil
+}
+
+// getPartitionShard returns the shard of partition that serves
+// keyspaceId.
+func getPartitionShard(keyspace string, tabletType topo.TabletType, partition *topo.KeyspacePartition, keyspaceId key.KeyspaceId) (string, error) {
+	return getKeyspaceIdShard(keyspace, tabletType, partition.Shards, keyspaceId)
+}
+
+// KeyspaceIdNotCoveredError is returned for the keyspace ids that no
+// serving shard of their tablet type covers, e.g. during a gap in the
+// serving graph.
+type KeyspaceIdNotCoveredError struct {
+	Keyspace   string
+	TabletType topo.TabletType
+	KeyspaceId key.KeyspaceId
+	// Gap is the key range between the shards around KeyspaceId.
+	Gap key.KeyRange
+}
+
+func (e *KeyspaceIdNotCoveredError) Error() string {
+	return fmt.Sprintf("vtgate: keyspace id %v of keyspace %v is not covered by the %v shards, it falls in the gap %v between them", string(e.KeyspaceId.Hex()), e.Keyspace, e.TabletType, keyRangeName(e.Gap))
+}
+
+// getKeyspaceIdShard returns the shard that serves keyspaceId, the one
+// with the lowest start if several do, or a KeyspaceIdNotCoveredError.
+func getKeyspaceIdShard(keyspace string, tabletType topo.TabletType, shards []topo.SrvShard, keyspaceId key.KeyspaceId) (string, error) {
+	var found *topo.SrvShard
+	gap := key.KeyRange{Start: key.MinKey, End: key.MaxKey}
+	for i := range shards {
+		kr := shards[i].KeyRange
+		if kr.Contains(keyspaceId) {
+			if found == nil || kr.Start < found.KeyRange.Start {
+				found = &shards[i]
+			}
+			continue
+		}
+		// kr is either before or after keyspaceId
+		if kr.End != key.MaxKey && kr.End <= keyspaceId {
+			if kr.End > gap.Start {
+				gap.Start = kr.End
+			}
+		} else if gap.End == key.MaxKey || kr.Start < gap.End {
+			gap.End = kr.Start
+		}
+	}
+	if found == nil {
+		return "", &KeyspaceIdNotCoveredError{Keyspace: keyspace, TabletType: tabletType, KeyspaceId: keyspaceId, Gap: gap}
+	}
+	return found.ShardName(), nil
+}
+
+// UnknownShardError is returned for the requests on a key range shard
+// that isn't in the serving graph, even in its canonical form.
+type UnknownShardError struct {
+	Keyspace       string
+	Shard          string
+	CanonicalShard string
+}
+
+func (e *UnknownShardError) Error() string {
+	return fmt.Sprintf("vtgate: unknown shard %q in keyspace %v, canonical form %q", e.Shard, e.Keyspace, e.CanonicalShard)
+}
+
+// resolveShardNames returns the canonical form of the shard names of a
+// request, see topo.CanonicalShardName. Key range shards are also
+// checked against the serving graph of the tablet type, when it has
+// one. "0" and custom names can't be checked there, so they are only
+// canonicalized.
+func resolveShardNames(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType, shards []string) ([]string, error) {
+	result := make([]string, len(shards))
+	var servedShards map[string]bool
+	for i, shard := range shards {
+		result[i] = topo.CanonicalShardName(shard)
+		if !strings.Contains(result[i], "-") {
+			continue
+		}
+		if servedShards == nil {
+			servedShards = getServedShardNames(topoServer, cell, keyspace, tabletType)
+		}
+		if len(servedShards) != 0 && !servedShards[result[i]] {
+			return nil, &UnknownShardError{Keyspace: keyspace, Shard: shard, CanonicalShard: result[i]}
+		}
+	}
+	return result, nil
+}
+
+// getServedShardNames returns the names of the shards serving a
+// tablet type, or an empty map if they can't be known.
+func getServedShardNames(topoServer SrvTopoServer, cell, keyspace string, tabletType topo.TabletType) map[string]bool {
+	result := make(map[string]bool)
+	srvKeyspace, err := topoServer.GetSrvKeyspace(cell, keyspace)
+	if err != nil {
+		return result
+	}
+	if _, ok := srvKeyspace.ServedFrom[tabletType]; ok {
+		// the shards are in another keyspace
+		return result
+	}
+	partition, ok := srvKeyspace.Partitions[tabletType]
+	if !ok {
+		return result
+	}
+	for _, srvShard := range partition.Shards {
+		result[srvShard.ShardName()] = true
+	}
+	return result
+}
@@ -5,6 +5,7 @@
 package vtgate
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -46,12 +47,180 @@ func TestKeyRangeToShardMap(t *testing.T) {
 			}
 			keyRange = krArray[0]
 		}
-		gotShards, err := resolveKeyRangeToShards(ts, "", testCase.keyspace, topo.TYPE_MASTER, keyRange)
+		gotShards, uncovered, err := resolveKeyRangeToShards(ts, "", testCase.keyspace, topo.TYPE_MASTER, keyRange)
 		if err != nil {
 			t.Errorf("want nil, got %v", err)
 		}
+		if len(uncovered) != 0 {
+			t.Errorf("want no uncovered key range, got %v", uncovered)
+		}
 		if !reflect.DeepEqual(testCase.shards, gotShards) {
 			t.Errorf("want \n%#v, got \n%#v", testCase.shards, gotShards)
 		}
 	}
 }
+
+func TestResolveShardNames(t *testing.T) {
+	ts := new(sandboxTopo)
+	shards, err := resolveShardNames(ts, "", TEST_SHARDED, topo.TYPE_MASTER, []string{"80-a0", " A0-C0 ", "-20"})
+	if err != nil {
+		t.Fatalf("want nil, got %v", err)
+	}
+	if want := []string{"80-A0", "A0-C0", "-20"}; !reflect.DeepEqual(want, shards) {
+		t.Errorf("want %#v, got %#v", want, shards)
+	}
+
+	// unknown key range shards fail with both forms
+	_, err = resolveShardNames(ts, "", TEST_SHARDED, topo.TYPE_MASTER, []string{"80-c0 "})
+	want := `vtgate: unknown shard "80-c0 " in keyspace TestSharded, canonical form "80-C0"`
+	if err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	// "0" and custom names are only canonicalized, as are the shards
+	// of tablet types without a serving graph
+	shards, err = resolveShardNames(ts, "", TEST_SHARDED, topo.TYPE_MASTER, []string{" 0", "custom"})
+	if err != nil || !reflect.DeepEqual([]string{"0", "custom"}, shards) {
+		t.Errorf("want 0 and custom, got %v %v", shards, err)
+	}
+	shards, err = resolveShardNames(ts, "", TEST_SHARDED, topo.TYPE_REPLICA, []string{"80-c0"})
+	if err != nil || !reflect.DeepEqual([]string{"80-C0"}, shards) {
+		t.Errorf("want 80-C0, got %v %v", shards, err)
+	}
+}
+
+// gapTopo serves TEST_SHARDED without its 40-60 shard.
+type gapTopo struct {
+	sandboxTopo
+}
+
+func (gt *gapTopo) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	srvKeyspace, err := createShardedSrvKeyspace()
+	if err != nil {
+		return nil, err
+	}
+	partition := srvKeyspace.Partitions[topo.TYPE_MASTER]
+	shards := make([]topo.SrvShard, 0, len(partition.Shards))
+	for _, shard := range partition.Shards {
+		if shard.ShardName() != "40-60" {
+			shards = append(shards, shard)
+		}
+	}
+	partition.Shards = shards
+	return srvKeyspace, nil
+}
+
+func TestKeyRangeToShardsUncovered(t *testing.T) {
+	ts := new(gapTopo)
+	var testCases = []struct {
+		keyRange  string
+		shards    []string
+		uncovered string
+	}{
+		{keyRange: "", shards: []string{"-20", "20-40", "60-80", "80-A0", "A0-C0", "C0-E0", "E0-"}, uncovered: "[40-60]"},
+		{keyRange: "30-50", shards: []string{"20-40"}, uncovered: "[40-50]"},
+		{keyRange: "48-50", shards: []string{}, uncovered: "[48-50]"},
+		{keyRange: "60-80", shards: []string{"60-80"}, uncovered: "[]"},
+	}
+	for _, testCase := range testCases {
+		keyRange := key.KeyRange{Start: "", End: ""}
+		if testCase.keyRange != "" {
+			krArray, err := key.ParseShardingSpec(testCase.keyRange)
+			if err != nil {
+				t.Fatalf("Got error while parsing sharding spec %v", err)
+			}
+			keyRange = krArray[0]
+		}
+		shards, uncovered, err := resolveKeyRangeToShards(ts, "", TEST_SHARDED, topo.TYPE_MASTER, keyRange)
+		if err != nil {
+			t.Errorf("want nil, got %v", err)
+		}
+		if !reflect.DeepEqual(testCase.shards, shards) {
+			t.Errorf("%v: want %#v, got %#v", testCase.keyRange, testCase.shards, shards)
+		}
+		names := make([]string, len(uncovered))
+		for i, kr := range uncovered {
+			names[i] = keyRangeName(kr)
+		}
+		if got := fmt.Sprintf("%v", names); got != testCase.uncovered {
+			t.Errorf("%v: want uncovered %v, got %v", testCase.keyRange, testCase.uncovered, got)
+		}
+	}
+}
+
+func TestMapKeyspaceIdsToShards(t *testing.T) {
+	ts := new(sandboxTopo)
+	shards, err := mapKeyspaceIdsToShards(ts, "", TEST_SHARDED, topo.TYPE_MASTER, []key.KeyspaceId{"\x45", "\x10", "\x41", "\xf0"})
+	if err != nil {
+		t.Fatalf("want nil, got %v", err)
+	}
+	if want := []string{"40-60", "-20", "E0-"}; !reflect.DeepEqual(want, shards) {
+		t.Errorf("want %#v, got %#v", want, shards)
+	}
+
+	// the shards of a served from keyspace are in the other keyspace
+	shards, err = mapKeyspaceIdsToShards(ts, "", TEST_UNSHARDED_SERVED_FROM, topo.TYPE_RDONLY, []key.KeyspaceId{"\x45"})
+	if err != nil || !reflect.DeepEqual([]string{"0"}, shards) {
+		t.Errorf("want 0, got %v %v", shards, err)
+	}
+
+	_, err = mapKeyspaceIdsToShards(ts, "", TEST_SHARDED, topo.TYPE_MASTER, nil)
+	if want := "vtgate: no keyspace ids in the request for keyspace TestSharded"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	_, err = mapKeyspaceIdsToShards(ts, "", TEST_SHARDED, topo.TYPE_REPLICA, []key.KeyspaceId{"\x45"})
+	if err == nil {
+		t.Errorf("want an error for a tablet type without shards")
+	}
+}
+
+func TestParseKeyRange(t *testing.T) {
+	kr, err := parseKeyRange("10-3F")
+	if err != nil {
+		t.Fatalf("want nil, got %v", err)
+	}
+	if want := (key.KeyRange{Start: "\x10", End: "\x3f"}); kr != want {
+		t.Errorf("want %v, got %v", want, kr)
+	}
+	kr, err = parseKeyRange("-")
+	if err != nil || kr.IsPartial() {
+		t.Errorf("want the whole key space, got %v %v", kr, err)
+	}
+
+	for spec, want := range map[string]string{
+		"":      `vtgate: malformed key range "", want <start>-<end> in hex`,
+		"1-2-3": `vtgate: malformed key range "1-2-3", want <start>-<end> in hex`,
+		"40-20": `vtgate: empty key range "40-20", its start must be before its end`,
+		"40-40": `vtgate: empty key range "40-40", its start must be before its end`,
+	} {
+		if _, err := parseKeyRange(spec); err == nil || err.Error() != want {
+			t.Errorf("parseKeyRange(%q): want %v, got %v", spec, want, err)
+		}
+	}
+	if _, err := parseKeyRange("zz-40"); err == nil {
+		t.Errorf("parseKeyRange(zz-40) worked")
+	}
+}
+
+func TestMergeKeyRanges(t *testing.T) {
+	testCases := []struct {
+		in   []string
+		want string
+	}{
+		{[]string{"10-20"}, "10-20"},
+		{[]string{"30-40", "10-20"}, "10-20,30-40"},
+		{[]string{"18-28", "10-20"}, "10-28"},
+		{[]string{"10-18", "18-20"}, "10-20"},
+		{[]string{"10-30", "18-20"}, "10-30"},
+		{[]string{"c0-", "80-d0", "-10"}, "-10,80-"},
+	}
+	for _, tc := range testCases {
+		in := make([]key.KeyRange, len(tc.in))
+		for i, spec := range tc.in {
+			in[i] = mustParseKeyRange(t, spec)
+		}
+		if got := keyRangesName(mergeKeyRanges(in)); got != tc.want {
+			t.Errorf("mergeKeyRanges(%v): want %v, got %v", tc.in, tc.want, got)
+		}
+	}
+}
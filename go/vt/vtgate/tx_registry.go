@@ -0,0 +1,181 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var (
+	txRegistrySize = flag.Int("tx_registry_size", 0, "maximum number of shard transactions begun by this vtgate it keeps track of, see /debug/transactions. 0 disables the registry.")
+	txRegistryTTL  = flag.Duration("tx_registry_ttl", time.Hour, "time after which a shard transaction is dropped from the registry, in case it was finished through another vtgate")
+)
+
+// TxEntry is a shard transaction begun by this vtgate.
+type TxEntry struct {
+	Keyspace      string
+	Shard         string
+	TabletType    topo.TabletType
+	TransactionId int64
+	Caller        string
+	StartTime     time.Time
+}
+
+type txKey struct {
+	keyspace      string
+	shard         string
+	tabletType    topo.TabletType
+	transactionId int64
+}
+
+func (e *TxEntry) key() txKey {
+	return txKey{e.Keyspace, e.Shard, e.TabletType, e.TransactionId}
+}
+
+// txRegistry keeps track of the shard transactions this vtgate
+// began, until they're committed or rolled back. The Sessions live in
+// the clients, which may finish a transaction through another vtgate:
+// the entries older than ttl are dropped. The registry keeps at most
+// maxSize entries, the oldest ones are dropped to make room.
+// A nil *txRegistry doesn't record anything.
+type txRegistry struct {
+	maxSize int
+	ttl     time.Duration
+
+	// drops counts the entries dropped, by "full" or "expired"
+	drops *stats.Counters
+
+	mu sync.Mutex
+	// entries has the *TxEntry, oldest first
+	entries *list.List
+	byKey   map[txKey]*list.Element
+}
+
+// newTxRegistry creates a txRegistry, or returns nil if maxSize is 0.
+// If name is not empty, it exports <name>Size and <name>Drops.
+func newTxRegistry(name string, maxSize int, ttl time.Duration) *txRegistry {
+	if maxSize <= 0 {
+		return nil
+	}
+	txr := &txRegistry{
+		maxSize: maxSize,
+		ttl:     ttl,
+		drops:   stats.NewCounters(""),
+		entries: list.New(),
+		byKey:   make(map[txKey]*list.Element),
+	}
+	if name != "" {
+		stats.Publish(name+"Size", stats.IntFunc(txr.Size))
+		stats.Publish(name+"Drops", txr.drops)
+	}
+	return txr
+}
+
+// Size returns the number of entries.
+func (txr *txRegistry) Size() int64 {
+	txr.mu.Lock()
+	defer txr.mu.Unlock()
+	return int64(txr.entries.Len())
+}
+
+// add records a shard transaction that was just begun.
+func (txr *txRegistry) add(entry *TxEntry) {
+	if txr == nil {
+		return
+	}
+	txr.mu.Lock()
+	defer txr.mu.Unlock()
+	txr.expireLocked(entry.StartTime)
+	for txr.entries.Len() >= txr.maxSize {
+		txr.removeLocked(txr.entries.Front())
+		txr.drops.Add("full", 1)
+	}
+	txr.byKey[entry.key()] = txr.entries.PushBack(entry)
+}
+
+// remove forgets a shard transaction that was committed or rolled back.
+func (txr *txRegistry) remove(keyspace, shard string, tabletType topo.TabletType, transactionId int64) {
+	if txr == nil {
+		return
+	}
+	txr.mu.Lock()
+	defer txr.mu.Unlock()
+	if element, ok := txr.byKey[txKey{keyspace, shard, tabletType, transactionId}]; ok {
+		txr.removeLocked(element)
+	}
+}
+
+// list returns a copy of the entries, oldest first.
+func (txr *txRegistry) list() []TxEntry {
+	if txr == nil {
+		return nil
+	}
+	txr.mu.Lock()
+	defer txr.mu.Unlock()
+	txr.expireLocked(time.Now())
+	result := make([]TxEntry, 0, txr.entries.Len())
+	for element := txr.entries.Front(); element != nil; element = element.Next() {
+		result = append(result, *element.Value.(*TxEntry))
+	}
+	return result
+}
+
+// removeOlderThan removes and returns the entries that started before
+// the time, oldest first.
+func (txr *txRegistry) removeOlderThan(before time.Time) []TxEntry {
+	if txr == nil {
+		return nil
+	}
+	txr.mu.Lock()
+	defer txr.mu.Unlock()
+	txr.expireLocked(time.Now())
+	var result []TxEntry
+	for element := txr.entries.Front(); element != nil; element = txr.entries.Front() {
+		entry := element.Value.(*TxEntry)
+		if !entry.StartTime.Before(before) {
+			break
+		}
+		result = append(result, *entry)
+		txr.removeLocked(element)
+	}
+	return result
+}
+
+// expireLocked drops the entries older than the ttl.
+func (txr *txRegistry) expireLocked(now time.Time) {
+	for element := txr.entries.Front(); element != nil; element = txr.entries.Front() {
+		if now.Sub(element.Value.(*TxEntry).StartTime) < txr.ttl {
+			return
+		}
+		txr.removeLocked(element)
+		txr.drops.Add("expired", 1)
+	}
+}
+
+func (txr *txRegistry) removeLocked(element *list.Element) {
+	delete(txr.byKey, element.Value.(*TxEntry).key())
+	txr.entries.Remove(element)
+}
+
+// ServeHTTP lists the shard transactions of the registry, oldest first.
+func (txr *txRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if txr == nil {
+		fmt.Fprintf(w, "the transaction registry is disabled, see -tx_registry_size\n")
+		return
+	}
+	now := time.Now()
+	for _, entry := range txr.list() {
+		fmt.Fprintf(w, "%v/%v %v transaction %v caller %v started %v age %v\n", entry.Keyspace, entry.Shard, entry.TabletType, entry.TransactionId, entry.Caller, entry.StartTime.Format(time.RFC3339), now.Sub(entry.StartTime))
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// This file uses the sandbox_test framework.
+
+func txEntry(transactionId int64, startTime time.Time) *TxEntry {
+	return &TxEntry{Keyspace: "ks", Shard: "0", TabletType: "master", TransactionId: transactionId, StartTime: startTime}
+}
+
+func txIds(entries []TxEntry) []int64 {
+	result := make([]int64, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.TransactionId
+	}
+	return result
+}
+
+func TestTxRegistry(t *testing.T) {
+	var disabled *txRegistry
+	if newTxRegistry("", 0, time.Hour) != disabled {
+		t.Errorf("a registry of size 0 should be disabled")
+	}
+	disabled.add(txEntry(1, time.Now()))
+	disabled.remove("ks", "0", "master", 1)
+	if disabled.list() != nil || disabled.removeOlderThan(time.Now()) != nil {
+		t.Errorf("the disabled registry recorded something")
+	}
+
+	txr := newTxRegistry("", 3, time.Hour)
+	now := time.Now()
+	for i := int64(1); i <= 4; i++ {
+		txr.add(txEntry(i, now.Add(time.Duration(i-10)*time.Minute)))
+	}
+	// the registry is bounded, the oldest entry was dropped
+	if got := txIds(txr.list()); len(got) != 3 || got[0] != 2 || got[2] != 4 {
+		t.Errorf("want transactions 2, 3, 4, got %v", got)
+	}
+	if txr.drops.Counts()["full"] != 1 {
+		t.Errorf("want 1 full drop, got %v", txr.drops.Counts())
+	}
+
+	txr.remove("ks", "0", "master", 3)
+	txr.remove("ks", "0", "master", 5)
+	if got := txIds(txr.list()); len(got) != 2 || got[0] != 2 || got[1] != 4 {
+		t.Errorf("want transactions 2, 4, got %v", got)
+	}
+
+	// removeOlderThan returns the old entries, oldest first
+	got := txIds(txr.removeOlderThan(now.Add(-5 * time.Minute)))
+	if len(got) != 2 || got[0] != 2 || got[1] != 4 {
+		t.Errorf("want transactions 2, 4, got %v", got)
+	}
+	if txr.Size() != 0 {
+		t.Errorf("want an empty registry, got %v", txr.list())
+	}
+
+	// the transactions finished through another vtgate expire
+	txr = newTxRegistry("", 3, time.Minute)
+	txr.add(txEntry(1, now.Add(-2*time.Minute)))
+	txr.add(txEntry(2, now))
+	if got := txIds(txr.list()); len(got) != 1 || got[0] != 2 {
+		t.Errorf("want transaction 2, got %v", got)
+	}
+	if txr.drops.Counts()["expired"] != 1 {
+		t.Errorf("want 1 expired drop, got %v", txr.drops.Counts())
+	}
+
+	w := httptest.NewRecorder()
+	txr.ServeHTTP(w, nil)
+	if want := "ks/0 master transaction 2 caller "; !strings.HasPrefix(w.Body.String(), want) {
+		t.Errorf("want %v..., got %v", want, w.Body.String())
+	}
+}
+
+func TestScatterConnTxRegistry(t *testing.T) {
+	resetSandbox()
+	sbc0 := &sandboxConn{}
+	testConns[0] = sbc0
+	sbc1 := &sandboxConn{}
+	testConns[1] = sbc1
+	stc := NewScatterConn(new(sandboxTopo), "aa", 1*time.Millisecond, 3, 1*time.Millisecond)
+	stc.txRegistry = newTxRegistry("", 10, time.Hour)
+	context := &rpcproto.Context{Username: "alice"}
+
+	session := NewSafeSession(&proto.Session{InTransaction: true})
+	stc.Execute(context, "query1", nil, "", []string{"0", "1"}, "", session, 0)
+	entries := stc.txRegistry.list()
+	if len(entries) != 2 || entries[0].Caller != "alice" {
+		t.Fatalf("want 2 transactions of alice, got %+v", entries)
+	}
+	stc.Commit(context, session)
+	if stc.txRegistry.Size() != 0 {
+		t.Errorf("committed transactions are still registered: %+v", stc.txRegistry.list())
+	}
+
+	session = NewSafeSession(&proto.Session{InTransaction: true})
+	stc.Execute(context, "query1", nil, "", []string{"0"}, "", session, 0)
+	if count, err := stc.RollbackOldTransactions(nil, time.Hour); count != 0 || err != nil {
+		t.Errorf("want no rollback, got %v %v", count, err)
+	}
+	if count, err := stc.RollbackOldTransactions(nil, 0); count != 1 || err != nil {
+		t.Errorf("want 1 rollback, got %v %v", count, err)
+	}
+	if sbc0.RollbackCount != 1 || stc.txRegistry.Size() != 0 {
+		t.Errorf("want the transaction rolled back, got %v rollbacks, %+v", sbc0.RollbackCount, stc.txRegistry.list())
+	}
+
+	stc.txRegistry = nil
+	if _, err := stc.RollbackOldTransactions(nil, 0); err == nil {
+		t.Errorf("want an error when the registry is disabled")
+	}
+}
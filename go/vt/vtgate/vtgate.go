@@ -7,21 +7,43 @@
 package vtgate
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"time"
 
 	log "github.com/golang/glog"
 	mproto "github.com/youtube/vitess/go/mysql/proto"
 	"github.com/youtube/vitess/go/vt/key"
+	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
+	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
 
 var RpcVTGate *VTGate
 
+var allowPartialKeyRange = flag.Bool("allow_partial_keyrange", false, "run the key range queries on the shards that serve part of their key range, e.g. during a gap in the serving graph, instead of failing them. Their last result is then marked Partial.")
+
+// ErrStreamingInTransaction is returned by the streaming queries
+// whose Session is in a transaction. vttablet can't stream inside a
+// transaction, so they are rejected before any shard is contacted.
+var ErrStreamingInTransaction = errors.New("vtgate: streaming queries are not supported in a transaction")
+
 // VTGate is the rpc interface to vtgate. Only one instance
 // can be created.
 type VTGate struct {
-	scatterConn *ScatterConn
+	scatterConn   *ScatterConn
+	admission     *admissionController
+	accessControl *accessControl
+	sessions      *sessionRegistry
+	requestLog    *requestLog
+	health        *healthChecker
+
+	// tabletTypePolicy has the default tablet types of the
+	// keyspaces, it is nil if there are none.
+	tabletTypePolicy *tabletTypePolicy
 }
 
 // registration mechanism
@@ -33,96 +55,662 @@ func Init(serv SrvTopoServer, cell string, retryDelay time.Duration, retryCount
 	if RpcVTGate != nil {
 		log.Fatalf("VTGate already initialized")
 	}
+	if _, ok := balancerPolicies[*balancerPolicy]; !ok {
+		log.Fatalf("unknown -balancer_policy %v, use one of %v", *balancerPolicy, BalancerPolicyNames())
+	}
 	RpcVTGate = &VTGate{
 		scatterConn: NewScatterConn(serv, cell, retryDelay, retryCount, timeout),
+		admission:   newAdmissionController("VTGateAdmission", *maxInFlightRequests, *maxQueuedRequests),
+	}
+	accessControl, err := newAccessControl("VTGateAccessControl", *accessControlFile)
+	if err != nil {
+		log.Fatalf("cannot load the access control: %v", err)
+	}
+	if accessControl != nil {
+		accessControl.reloadOnSignal()
+	}
+	RpcVTGate.accessControl = accessControl
+	tabletTypePolicy, err := newTabletTypePolicy("VTGateTabletTypePolicy", *tabletTypePolicyFile)
+	if err != nil {
+		log.Fatalf("cannot load the tablet type policy: %v", err)
 	}
+	if tabletTypePolicy != nil {
+		tabletTypePolicy.reloadOnSignal()
+		http.Handle("/debug/tablet_type_policy", tabletTypePolicy)
+	}
+	RpcVTGate.tabletTypePolicy = tabletTypePolicy
+	RpcVTGate.scatterConn.tabletTypePolicy = tabletTypePolicy
+	RpcVTGate.sessions = newSessionRegistry("VTGateSessions", *sessionMaxAge, *sessionIdleTimeout, *sessionRollbackOnDisconnect, RpcVTGate.rollbackShardSessions)
+	go RpcVTGate.sessions.reapLoop()
+	RpcVTGate.scatterConn.concurrency = *scatterConcurrency
+	RpcVTGate.scatterConn.txRegistry = newTxRegistry("VTGateTxRegistry", *txRegistrySize, *txRegistryTTL)
+	http.Handle("/debug/transactions", RpcVTGate.scatterConn.txRegistry)
+	RpcVTGate.requestLog = newRequestLog(*requestLogSize, *requestLogBindValues)
+	http.Handle("/debug/vtgate/requests", RpcVTGate.requestLog)
+	QueryLogger.ServeLogs("/debug/querylog")
+	tabletTypes, err := parseHealthTabletTypes(*healthTabletTypes)
+	if err != nil {
+		log.Fatalf("bad -health_tablet_types: %v", err)
+	}
+	RpcVTGate.health = newHealthChecker("VTGateHealth", serv, cell, tabletTypes, *healthMinEndPoints)
+	go RpcVTGate.health.checkLoop(*healthCheckInterval)
+	http.Handle("/debug/health", RpcVTGate.health)
 	for _, f := range RegisterVTGates {
 		f(RpcVTGate)
 	}
 }
 
 // ExecuteShard executes a non-streaming query on the specified shards.
+// The shard names are canonicalized, see topo.CanonicalShardName.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
+// The SHOW statements about the serving graph are answered by vtgate
+// once the request is admitted and allowed, see introspect.
+// If the query fails on some of its shards and AllowPartialResults is
+// set, reply has the rows of the other shards, along with the error.
 func (vtg *VTGate) ExecuteShard(context interface{}, query *proto.QueryShard, reply *proto.QueryResult) error {
-	qr, err := vtg.scatterConn.Execute(
+	context = requestContext(context, query.CallerID, query.DeadlineMs)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteShard", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	defer func() { logEntry.send(int(reply.RowsAffected), reply.Error) }()
+	defer vtg.sessions.use(context, query.Session)()
+	vtg.requestLog.recordQueryShard(context, query)
+	reply.CompressMinSize = resultCompressMinSize(query.Compression)
+	if err := vtg.admission.admit(query.Workload); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	// the SHOW statements about the serving graph don't need a tablet
+	if qr, ok, err := vtg.introspect(context, query.Sql, query.Keyspace, query.TabletType); ok {
+		if err != nil {
+			setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		} else {
+			proto.PopulateQueryResult(qr, reply)
+			reply.PackRows = query.PackedRows
+		}
+		reply.Session = query.Session
+		return nil
+	}
+	if err := validateSqlSize("ExecuteShard", query.Keyspace, query.Sql); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	if err := validateBindVariables("ExecuteShard", query.Keyspace, query.BindVariables); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	shards, err := resolveShardNames(vtg.scatterConn.toposerv, vtg.scatterConn.cell, query.Keyspace, query.TabletType, query.Shards)
+	if err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	query.Shards = shards
+	session := querySession(query.Session, query.NotInTransaction)
+	if err := validateShardSessions(context, session, query.Keyspace, query.Shards, query.TabletType, query.MaxShardSessions); err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+		return nil
+	}
+	if query.PackedRows {
+		// packing the rows needs them decoded
+		var qr *mproto.QueryResult
+		qr, err = vtg.scatterConn.Execute(
+			context,
+			query.Sql,
+			query.BindVariables,
+			query.Keyspace,
+			query.Shards,
+			query.TabletType,
+			logEntry.session(session),
+			resultMaxRows(query.MaxRows))
+		if qr != nil && (err == nil || query.AllowPartialResults) {
+			proto.PopulateQueryResult(qr, reply)
+			reply.PackRows = true
+			reply.Partial = err != nil
+		}
+	} else {
+		// the rows are sent to the client as the tablets sent them
+		var qr *mproto.LazyQueryResult
+		qr, err = vtg.scatterConn.ExecuteLazy(
+			context,
+			query.Sql,
+			query.BindVariables,
+			query.Keyspace,
+			query.Shards,
+			query.TabletType,
+			logEntry.session(session),
+			resultMaxRows(query.MaxRows))
+		if qr != nil && (err == nil || query.AllowPartialResults) {
+			proto.PopulateLazyQueryResult(qr, reply)
+			reply.Partial = err != nil
+		}
+	}
+	if err != nil {
+		setQueryError(reply, query.Session, "ExecuteShard", err, context)
+	}
+	if query.IncludeLag {
+		reply.ShardLag = shardLag(query.Shards, query.TabletType)
+	}
+	reply.Session = query.Session
+	return nil
+}
+
+// ExecuteKeyspaceIds executes a non-streaming query on the shards
+// that serve the keyspace ids of the request, once per shard.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
+func (vtg *VTGate) ExecuteKeyspaceIds(context interface{}, query *proto.KeyspaceIdQuery, reply *proto.QueryResult) error {
+	context = requestContext(context, query.CallerID, 0)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteKeyspaceIds", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	defer func() { logEntry.send(int(reply.RowsAffected), reply.Error) }()
+	defer vtg.sessions.use(context, query.Session)()
+	if err := vtg.admission.admit(""); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	if err := validateSqlSize("ExecuteKeyspaceIds", query.Keyspace, query.Sql); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	if err := validateBindVariables("ExecuteKeyspaceIds", query.Keyspace, query.BindVariables); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	shards, err := mapKeyspaceIdsToShards(vtg.scatterConn.toposerv, vtg.scatterConn.cell, query.Keyspace, query.TabletType, query.KeyspaceIds)
+	if err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	session := querySession(query.Session, query.NotInTransaction)
+	if err := validateShardSessions(context, session, query.Keyspace, shards, query.TabletType, 0); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+		return nil
+	}
+	qr, err := vtg.scatterConn.ExecuteLazy(
 		context,
 		query.Sql,
 		query.BindVariables,
 		query.Keyspace,
-		query.Shards,
+		shards,
+		query.TabletType,
+		logEntry.session(session),
+		resultMaxRows(0))
+	if err == nil {
+		proto.PopulateLazyQueryResult(qr, reply)
+	} else {
+		setQueryError(reply, query.Session, "ExecuteKeyspaceIds", err, context)
+	}
+	reply.Session = query.Session
+	return nil
+}
+
+// ExecuteKeyRange executes a non-streaming query on the shards that
+// serve the KeyRange of the request, and merges their results.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
+func (vtg *VTGate) ExecuteKeyRange(context interface{}, query *proto.KeyRangeQuery, reply *proto.QueryResult) error {
+	context = requestContext(context, query.CallerID, 0)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteKeyRange", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	defer func() { logEntry.send(int(reply.RowsAffected), reply.Error) }()
+	defer vtg.sessions.use(context, query.Session)()
+	if err := vtg.admission.admit(""); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	if err := validateSqlSize("ExecuteKeyRange", query.Keyspace, query.Sql); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	if err := validateBindVariables("ExecuteKeyRange", query.Keyspace, query.BindVariables); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	shards, partial, err := vtg.mapKrToShards(query)
+	if err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	session := querySession(query.Session, query.NotInTransaction)
+	if err := validateShardSessions(context, session, query.Keyspace, shards, query.TabletType, 0); err != nil {
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
+		return nil
+	}
+	qr, err := vtg.scatterConn.ExecuteLazy(
+		context,
+		query.Sql,
+		query.BindVariables,
+		query.Keyspace,
+		shards,
 		query.TabletType,
-		NewSafeSession(query.Session))
+		logEntry.session(session),
+		resultMaxRows(0))
 	if err == nil {
-		proto.PopulateQueryResult(qr, reply)
+		proto.PopulateLazyQueryResult(qr, reply)
+		reply.Partial = partial
 	} else {
-		reply.Error = err.Error()
-		log.Errorf("ExecuteShard: %v, query: %+v", err, query)
+		setQueryError(reply, query.Session, "ExecuteKeyRange", err, context)
 	}
 	reply.Session = query.Session
 	return nil
 }
 
+// mapKrToShards returns the shards that serve the key range of a
+// query, and whether they only serve part of it, see
+// -allow_partial_keyrange.
+func (vtg *VTGate) mapKrToShards(query *proto.KeyRangeQuery) (shards []string, partial bool, err error) {
+	keyRange, err := parseKeyRange(query.KeyRange)
+	if err != nil {
+		return nil, false, err
+	}
+	shards, uncovered, err := resolveKeyRangeToShards(vtg.scatterConn.toposerv,
+		vtg.scatterConn.cell,
+		query.Keyspace,
+		query.TabletType,
+		keyRange)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(uncovered) > 0 {
+		err := &KeyRangeNotCoveredError{
+			Keyspace:   query.Keyspace,
+			TabletType: query.TabletType,
+			KeyRange:   keyRange,
+			Uncovered:  uncovered,
+			Shards:     shards,
+		}
+		if !*allowPartialKeyRange || len(shards) == 0 {
+			return nil, false, err
+		}
+		log.Warningf("ExecuteKeyRange: running on part of the key range: %v", err)
+		partial = true
+	}
+	return shards, partial, nil
+}
+
+// ExecuteEntityIds executes a non-streaming query on the shards that
+// serve the entity ids of the request, each shard with only its own
+// entity ids in the list bind variable of the entity column, and
+// merges their results.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
+func (vtg *VTGate) ExecuteEntityIds(context interface{}, query *proto.EntityIdsQuery, reply *proto.QueryResult) error {
+	context = requestContext(context, query.CallerID, 0)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteEntityIds", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	defer func() { logEntry.send(int(reply.RowsAffected), reply.Error) }()
+	defer vtg.sessions.use(context, query.Session)()
+	if err := vtg.admission.admit(""); err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	if err := validateSqlSize("ExecuteEntityIds", query.Keyspace, query.Sql); err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	shardBindVars, err := vtg.buildEntityIdsBindVariables(query)
+	if err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	shards := make([]string, 0, len(shardBindVars))
+	for shard := range shardBindVars {
+		shards = append(shards, shard)
+	}
+	if err := validateShardSessions(context, query.Session, query.Keyspace, shards, query.TabletType, 0); err != nil {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+		return nil
+	}
+	qr, err := vtg.scatterConn.ExecuteEntityIds(
+		context,
+		query.Sql,
+		shardBindVars,
+		query.Keyspace,
+		query.TabletType,
+		logEntry.session(query.Session),
+		resultMaxRows(0))
+	if err == nil {
+		proto.PopulateLazyQueryResult(qr, reply)
+	} else {
+		setQueryError(reply, query.Session, "ExecuteEntityIds", err, context)
+	}
+	reply.Session = query.Session
+	return nil
+}
+
+// buildEntityIdsBindVariables returns the bind variables of each shard
+// of an EntityIdsQuery: the bind variables of the query, and the list
+// of the entity ids of the shard, named after the entity column. They
+// are checked against the limits and normalized like the bind
+// variables of the other requests, the entity ids included.
+func (vtg *VTGate) buildEntityIdsBindVariables(query *proto.EntityIdsQuery) (map[string]map[string]interface{}, error) {
+	column := query.EntityColumnName
+	if column == "" {
+		return nil, fmt.Errorf("vtgate: no entity column name in the request for keyspace %v", query.Keyspace)
+	}
+	if _, ok := query.BindVariables[column]; ok {
+		return nil, fmt.Errorf("vtgate: bind variable %v is set by vtgate to the entity ids of each shard", column)
+	}
+	count, size := bindVariablesCount(query.BindVariables)
+	for _, entityId := range query.EntityKeyspaceIds {
+		c, s := valueCount(entityId.ExternalId)
+		count += c
+		size += s
+	}
+	if err := checkBindVariables("ExecuteEntityIds", query.Keyspace, count, size); err != nil {
+		return nil, err
+	}
+	if err := normalizeBindVariables("ExecuteEntityIds", query.Keyspace, query.BindVariables); err != nil {
+		return nil, err
+	}
+	entityIds := make([]interface{}, len(query.EntityKeyspaceIds))
+	for i, entityId := range query.EntityKeyspaceIds {
+		entityIds[i] = entityId.ExternalId
+	}
+	if err := checkBindVariableTypes("ExecuteEntityIds", query.Keyspace, map[string]interface{}{column: entityIds}); err != nil {
+		return nil, err
+	}
+
+	shardIds, err := mapEntityIdsToShards(vtg.scatterConn.toposerv, vtg.scatterConn.cell, query.Keyspace, query.TabletType, query.EntityKeyspaceIds)
+	if err != nil {
+		return nil, err
+	}
+	shardBindVars := make(map[string]map[string]interface{}, len(shardIds))
+	for shard, ids := range shardIds {
+		values, err := tproto.BindVariableToValue(ids)
+		if err != nil {
+			bindVariablesRejections.Add("ExecuteEntityIds."+query.Keyspace, 1)
+			return nil, &BadBindVariableError{Name: column, Err: err}
+		}
+		bindVars := make(map[string]interface{}, len(query.BindVariables)+1)
+		for name, value := range query.BindVariables {
+			bindVars[name] = value
+		}
+		bindVars[column] = values
+		shardBindVars[shard] = bindVars
+	}
+	return shardBindVars, nil
+}
+
 // ExecuteBatchShard executes a group of queries on the specified shards.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
 func (vtg *VTGate) ExecuteBatchShard(context interface{}, batchQuery *proto.BatchQueryShard, reply *proto.QueryResultList) error {
+	context = requestContext(context, batchQuery.CallerID, batchQuery.DeadlineMs)
+	batchQuery.TabletType = vtg.tabletTypePolicy.defaultTabletType(batchQuery.Keyspace, batchQuery.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteBatchShard", batchQuery.Keyspace, batchQuery.TabletType, batchQuery.Queries...)
+	defer func() { logEntry.send(resultListRows(reply), reply.Error) }()
+	defer vtg.sessions.use(context, batchQuery.Session)()
+	vtg.requestLog.recordBatchQueryShard(context, batchQuery)
+	if err := vtg.admission.admit(batchQuery.Workload); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(batchQuery.TabletType, batchQuery.Session); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, batchQuery.Keyspace, batchQuery.TabletType); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	if err := validateBatchSqlSize("ExecuteBatchShard", batchQuery.Keyspace, batchQuery.Queries); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	if err := validateBatchBindVariables("ExecuteBatchShard", batchQuery.Keyspace, batchQuery.Queries); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	shards, err := resolveShardNames(vtg.scatterConn.toposerv, vtg.scatterConn.cell, batchQuery.Keyspace, batchQuery.TabletType, batchQuery.Shards)
+	if err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
+	batchQuery.Shards = shards
+	if err := validateShardSessions(context, batchQuery.Session, batchQuery.Keyspace, batchQuery.Shards, batchQuery.TabletType, batchQuery.MaxShardSessions); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
+		return nil
+	}
 	qrs, err := vtg.scatterConn.ExecuteBatch(
 		context,
 		batchQuery.Queries,
 		batchQuery.Keyspace,
 		batchQuery.Shards,
 		batchQuery.TabletType,
-		NewSafeSession(batchQuery.Session))
-	if err == nil {
-		reply.List = qrs.List
-	} else {
-		reply.Error = err.Error()
-		log.Errorf("ExecuteBatchShard: %v, queries: %+v", err, batchQuery)
+		logEntry.session(batchQuery.Session))
+	if qrs != nil {
+		// the results of the shards that worked are sent even if
+		// others failed, see QueryResultList.ShardErrors
+		reply.List = make([]mproto.QueryResult, len(qrs.List))
+		for i := range qrs.List {
+			reply.List[i] = proto.CopyQueryResult(&qrs.List[i])
+		}
+	}
+	if err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchShard", err, context)
 	}
 	reply.Session = batchQuery.Session
 	return nil
 }
 
-// This function implements the restriction of handling one keyrange
-// and one shard since streaming doesn't support merge sorting the results.
-// The input/output api is generic though.
-func (vtg *VTGate) mapKrToShardsForStreaming(streamQuery *proto.StreamQueryKeyRange) ([]string, error) {
-	var keyRange key.KeyRange
-	var err error
-	if streamQuery.KeyRange == "" {
-		keyRange = key.KeyRange{Start: "", End: ""}
-	} else {
-		krArray, err := key.ParseShardingSpec(streamQuery.KeyRange)
+// ExecuteBatchKeyspaceIds executes a group of queries on the shards
+// that serve the keyspace ids of the request, once per shard. The
+// results are in the order of the queries.
+// It returns ErrOverloaded in reply if vtgate is overloaded.
+func (vtg *VTGate) ExecuteBatchKeyspaceIds(context interface{}, batchQuery *proto.KeyspaceIdBatchQuery, reply *proto.QueryResultList) error {
+	context = requestContext(context, batchQuery.CallerID, 0)
+	batchQuery.TabletType = vtg.tabletTypePolicy.defaultTabletType(batchQuery.Keyspace, batchQuery.TabletType)
+	logEntry := newQueryLogEntry(context, "ExecuteBatchKeyspaceIds", batchQuery.Keyspace, batchQuery.TabletType, batchQuery.Queries...)
+	defer func() { logEntry.send(resultListRows(reply), reply.Error) }()
+	defer vtg.sessions.use(context, batchQuery.Session)()
+	if err := vtg.admission.admit(""); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(batchQuery.TabletType, batchQuery.Session); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	if err := vtg.accessControl.check(context, batchQuery.Keyspace, batchQuery.TabletType); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	if err := validateBatchSqlSize("ExecuteBatchKeyspaceIds", batchQuery.Keyspace, batchQuery.Queries); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	if err := validateBatchBindVariables("ExecuteBatchKeyspaceIds", batchQuery.Keyspace, batchQuery.Queries); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	shards, err := mapKeyspaceIdsToShards(vtg.scatterConn.toposerv, vtg.scatterConn.cell, batchQuery.Keyspace, batchQuery.TabletType, batchQuery.KeyspaceIds)
+	if err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	if err := validateShardSessions(context, batchQuery.Session, batchQuery.Keyspace, shards, batchQuery.TabletType, 0); err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+		return nil
+	}
+	qrs, err := vtg.scatterConn.ExecuteBatch(
+		context,
+		batchQuery.Queries,
+		batchQuery.Keyspace,
+		shards,
+		batchQuery.TabletType,
+		logEntry.session(batchQuery.Session))
+	if qrs != nil {
+		// the results of the shards that worked are sent even if
+		// others failed, see QueryResultList.ShardErrors
+		reply.List = make([]mproto.QueryResult, len(qrs.List))
+		for i := range qrs.List {
+			reply.List[i] = proto.CopyQueryResult(&qrs.List[i])
+		}
+	}
+	if err != nil {
+		setQueryListError(reply, batchQuery.Session, "ExecuteBatchKeyspaceIds", err, context)
+	}
+	reply.Session = batchQuery.Session
+	return nil
+}
+
+// This function implements the restriction of mapping each keyrange
+// to one shard since streaming doesn't support merge sorting the results.
+// The shards of all the key ranges are returned once each, in the
+// order of the key ranges.
+// Each key range must be entirely covered by the serving shards, unless
+// -allow_partial_keyrange is set: partial is then set if one isn't.
+// filter drops the rows of the shards that are outside of the key
+// ranges, if they serve more.
+func (vtg *VTGate) mapKrToShardsForStreaming(streamQuery *proto.StreamQueryKeyRange) (shards []string, partial bool, filter *keyRangeFilter, err error) {
+	var keyRanges []key.KeyRange
+	seen := make(map[string]bool)
+	for _, spec := range streamQuery.AllKeyRanges() {
+		var keyRange key.KeyRange
+		if spec == "" {
+			keyRange = key.KeyRange{Start: "", End: ""}
+		} else {
+			krArray, err := key.ParseShardingSpec(spec)
+			if err != nil {
+				return nil, false, nil, err
+			}
+			keyRange = krArray[0]
+		}
+		krShards, uncovered, err := resolveKeyRangeToShards(vtg.scatterConn.toposerv,
+			vtg.scatterConn.cell,
+			streamQuery.Keyspace,
+			streamQuery.TabletType,
+			keyRange)
 		if err != nil {
-			return nil, err
+			return nil, false, nil, err
+		}
+		if len(uncovered) > 0 {
+			err := &KeyRangeNotCoveredError{
+				Keyspace:   streamQuery.Keyspace,
+				TabletType: streamQuery.TabletType,
+				KeyRange:   keyRange,
+				Uncovered:  uncovered,
+				Shards:     krShards,
+			}
+			if !*allowPartialKeyRange || len(krShards) == 0 {
+				return nil, false, nil, err
+			}
+			log.Warningf("StreamExecuteKeyRange: running on part of the key range: %v", err)
+			partial = true
+		}
+
+		if len(krShards) != 1 {
+			return nil, false, nil, fmt.Errorf("KeyRange cannot map to more than one shard")
+		}
+		keyRanges = append(keyRanges, keyRange)
+		// several key ranges may map to the same shard, it is
+		// streamed once
+		if !seen[krShards[0]] {
+			seen[krShards[0]] = true
+			shards = append(shards, krShards[0])
 		}
-		keyRange = krArray[0]
 	}
-	shards, err := resolveKeyRangeToShards(vtg.scatterConn.toposerv,
+
+	// the shards serve more than the key ranges while they are
+	// split, their other rows are dropped
+	filter, err = newKeyRangeFilter(vtg.scatterConn.toposerv,
 		vtg.scatterConn.cell,
 		streamQuery.Keyspace,
 		streamQuery.TabletType,
-		keyRange)
+		shards,
+		keyRanges)
 	if err != nil {
-		return nil, err
-	}
-
-	if len(shards) != 1 {
-		return nil, fmt.Errorf("KeyRange cannot map to more than one shard")
+		return nil, false, nil, err
 	}
-
-	return shards, nil
+	return shards, partial, filter, nil
 }
 
 // StreamExecuteKeyRange executes a streaming query on the specified KeyRange.
 // The KeyRange is resolved to shards using the serving graph.
-// This function currently temporarily enforces the restriction of executing on one keyrange
-// and one shard since it cannot merge-sort the results to guarantee ordering of
-// response which is needed for checkpointing. The api supports supplying multiple keyranges
-// to make it future proof.
-func (vtg *VTGate) StreamExecuteKeyRange(context interface{}, streamQuery *proto.StreamQueryKeyRange, sendReply func(*proto.QueryResult) error) error {
-	shards, err := vtg.mapKrToShardsForStreaming(streamQuery)
+// This function currently temporarily enforces the restriction of executing
+// each keyrange on one shard since it cannot merge-sort the results to
+// guarantee ordering of response which is needed for checkpointing.
+// The results of several KeyRanges are interleaved, each shard being
+// streamed once.
+// The results are paced to the row rate limit of the request, see
+// -max_stream_rows_per_second, re-batched, see -stream_batch_rows, and
+// split into bounded packets, see -stream_packet_rows.
+// It returns ErrStreamingInTransaction if the Session is in a transaction,
+// and ErrOverloaded if vtgate is overloaded.
+func (vtg *VTGate) StreamExecuteKeyRange(context interface{}, streamQuery *proto.StreamQueryKeyRange, sendReply func(*proto.QueryResult) error) (err error) {
+	context = requestContext(context, streamQuery.CallerID, streamQuery.DeadlineMs)
+	streamQuery.TabletType = vtg.tabletTypePolicy.defaultTabletType(streamQuery.Keyspace, streamQuery.TabletType)
+	logEntry := newQueryLogEntry(context, "StreamExecuteKeyRange", streamQuery.Keyspace, streamQuery.TabletType, tproto.BoundQuery{Sql: streamQuery.Sql, BindVariables: streamQuery.BindVariables})
+	rows := 0
+	defer func() { logEntry.send(rows, errorString(err)) }()
+	sendReply = compressReplies(streamQuery.Compression, sendReply)
+	if err := vtg.admission.admit(streamQuery.Workload); err != nil {
+		return err
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(streamQuery.TabletType, streamQuery.Session); err != nil {
+		log.Errorf("StreamExecuteKeyRange: %v, context: %v, keyspace: %v", err, context, streamQuery.Keyspace)
+		return err
+	}
+	if err := vtg.accessControl.check(context, streamQuery.Keyspace, streamQuery.TabletType); err != nil {
+		log.Errorf("StreamExecuteKeyRange: %v, context: %v", err, context)
+		return err
+	}
+	if err := validateSqlSize("StreamExecuteKeyRange", streamQuery.Keyspace, streamQuery.Sql); err != nil {
+		log.Errorf("StreamExecuteKeyRange: %v, context: %v, keyspace: %v", err, context, streamQuery.Keyspace)
+		return err
+	}
+	if err := validateBindVariables("StreamExecuteKeyRange", streamQuery.Keyspace, streamQuery.BindVariables); err != nil {
+		log.Errorf("StreamExecuteKeyRange: %v, context: %v, keyspace: %v, sql: %v", err, context, streamQuery.Keyspace, streamQuery.Sql)
+		return err
+	}
+	if streamQuery.Session != nil && streamQuery.Session.InTransaction {
+		log.Errorf("StreamExecuteKeyRange: %v, query: %+v", ErrStreamingInTransaction, streamQuery)
+		return ErrStreamingInTransaction
+	}
+	shards, partial, filter, err := vtg.mapKrToShardsForStreaming(streamQuery)
 	if err != nil {
+		log.Errorf("StreamExecuteKeyRange: %v, query: %+v", err, streamQuery)
 		return err
 	}
 
+	limiter := newRowRateLimiter(streamRowsPerSecond(streamQuery.MaxRowsPerSecond))
+	defer limiter.done()
+	batcher := newStreamBatcher(sendReply)
 	err = vtg.scatterConn.StreamExecute(
 		context,
 		streamQuery.Sql,
@@ -130,49 +718,200 @@ func (vtg *VTGate) StreamExecuteKeyRange(context interface{}, streamQuery *proto
 		streamQuery.Keyspace,
 		shards,
 		streamQuery.TabletType,
-		NewSafeSession(streamQuery.Session),
+		logEntry.session(streamQuery.Session),
 		func(mreply *mproto.QueryResult) error {
-			reply := new(proto.QueryResult)
-			proto.PopulateQueryResult(mreply, reply)
-			// Note we don't populate reply.Session here,
-			// as it may change incrementaly as responses
-			// are sent.
-			return sendReply(reply)
+			mreply, err := filter.filter(mreply)
+			if err != nil {
+				return err
+			}
+			if len(mreply.Fields) == 0 && len(mreply.Rows) == 0 {
+				return nil
+			}
+			rows += len(mreply.Rows)
+			limiter.wait(len(mreply.Rows))
+			for _, reply := range chunkQueryResult(mreply, *streamPacketRows, *streamPacketBytes) {
+				reply.PackRows = streamQuery.PackedRows
+				// Note we don't populate reply.Session here,
+				// as it may change incrementaly as responses
+				// are sent.
+				if err := batcher.send(reply); err != nil {
+					return err
+				}
+			}
+			return nil
 		})
+	if batchErr := batcher.finish(); err == nil {
+		err = batchErr
+	}
 
 	if err != nil {
 		log.Errorf("StreamExecuteKeyRange: %v, query: %+v", err, streamQuery)
 	}
-	// now we can send the final Session info.
-	if streamQuery.Session != nil {
-		sendReply(&proto.QueryResult{Session: streamQuery.Session})
+	// now we can send the final Session info, the lag, and whether
+	// the key range was only partially covered.
+	if streamQuery.Session != nil || streamQuery.IncludeLag || partial {
+		final := &proto.QueryResult{Session: streamQuery.Session, Partial: partial}
+		if streamQuery.IncludeLag {
+			final.ShardLag = shardLag(shards, streamQuery.TabletType)
+		}
+		sendReply(final)
 	}
 	return err
 }
 
 // StreamExecuteShard executes a streaming query on the specified shards.
-func (vtg *VTGate) StreamExecuteShard(context interface{}, query *proto.QueryShard, sendReply func(*proto.QueryResult) error) error {
-	err := vtg.scatterConn.StreamExecute(
+// The results are paced to the row rate limit of the request, see
+// -max_stream_rows_per_second, re-batched, see -stream_batch_rows, and
+// split into bounded packets, see -stream_packet_rows.
+// It returns ErrStreamingInTransaction if the Session is in a transaction,
+// and ErrOverloaded if vtgate is overloaded.
+func (vtg *VTGate) StreamExecuteShard(context interface{}, query *proto.StreamQueryShard, sendReply func(*proto.QueryResult) error) (err error) {
+	context = requestContext(context, query.CallerID, query.DeadlineMs)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "StreamExecuteShard", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	rows := 0
+	defer func() { logEntry.send(rows, errorString(err)) }()
+	sendReply = compressReplies(query.Compression, sendReply)
+	if err := vtg.admission.admit(query.Workload); err != nil {
+		return err
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		log.Errorf("StreamExecuteShard: %v, context: %v, keyspace: %v", err, context, query.Keyspace)
+		return err
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		log.Errorf("StreamExecuteShard: %v, context: %v", err, context)
+		return err
+	}
+	if err := validateSqlSize("StreamExecuteShard", query.Keyspace, query.Sql); err != nil {
+		log.Errorf("StreamExecuteShard: %v, context: %v, keyspace: %v", err, context, query.Keyspace)
+		return err
+	}
+	if err := validateBindVariables("StreamExecuteShard", query.Keyspace, query.BindVariables); err != nil {
+		log.Errorf("StreamExecuteShard: %v, context: %v, keyspace: %v, sql: %v", err, context, query.Keyspace, query.Sql)
+		return err
+	}
+	if query.Session != nil && query.Session.InTransaction {
+		log.Errorf("StreamExecuteShard: %v, query: %+v", ErrStreamingInTransaction, query)
+		return ErrStreamingInTransaction
+	}
+	shards, err := resolveShardNames(vtg.scatterConn.toposerv, vtg.scatterConn.cell, query.Keyspace, query.TabletType, query.Shards)
+	if err != nil {
+		log.Errorf("StreamExecuteShard: %v, query: %+v", err, query)
+		return err
+	}
+	query.Shards = shards
+	limiter := newRowRateLimiter(streamRowsPerSecond(query.MaxRowsPerSecond))
+	defer limiter.done()
+	batcher := newStreamBatcher(sendReply)
+	err = vtg.scatterConn.StreamExecute(
 		context,
 		query.Sql,
 		query.BindVariables,
 		query.Keyspace,
 		query.Shards,
 		query.TabletType,
-		NewSafeSession(query.Session),
+		logEntry.session(query.Session),
 		func(mreply *mproto.QueryResult) error {
-			reply := new(proto.QueryResult)
-			proto.PopulateQueryResult(mreply, reply)
-			// Note we don't populate reply.Session here,
-			// as it may change incrementaly as responses
-			// are sent.
-			return sendReply(reply)
+			rows += len(mreply.Rows)
+			limiter.wait(len(mreply.Rows))
+			for _, reply := range chunkQueryResult(mreply, *streamPacketRows, *streamPacketBytes) {
+				reply.PackRows = query.PackedRows
+				// Note we don't populate reply.Session here,
+				// as it may change incrementaly as responses
+				// are sent.
+				if err := batcher.send(reply); err != nil {
+					return err
+				}
+			}
+			return nil
 		})
+	if batchErr := batcher.finish(); err == nil {
+		err = batchErr
+	}
 
 	if err != nil {
 		log.Errorf("StreamExecuteShard: %v, query: %+v", err, query)
 	}
-	// now we can send the final Session info.
+	// now we can send the final Session info, and the lag.
+	if query.Session != nil || query.IncludeLag {
+		final := &proto.QueryResult{Session: query.Session}
+		if query.IncludeLag {
+			final.ShardLag = shardLag(query.Shards, query.TabletType)
+		}
+		sendReply(final)
+	}
+	return err
+}
+
+// StreamExecuteKeyspaceIds executes a streaming query on the shards
+// that serve the keyspace ids of the request, once per shard. The
+// stream ends as soon as sendReply fails.
+// It returns ErrOverloaded if vtgate is overloaded.
+func (vtg *VTGate) StreamExecuteKeyspaceIds(context interface{}, query *proto.StreamQueryKeyspaceIds, sendReply func(*proto.QueryResult) error) (err error) {
+	context = requestContext(context, query.CallerID, query.DeadlineMs)
+	query.TabletType = vtg.tabletTypePolicy.defaultTabletType(query.Keyspace, query.TabletType)
+	logEntry := newQueryLogEntry(context, "StreamExecuteKeyspaceIds", query.Keyspace, query.TabletType, tproto.BoundQuery{Sql: query.Sql, BindVariables: query.BindVariables})
+	rows := 0
+	defer func() { logEntry.send(rows, errorString(err)) }()
+	if err := vtg.admission.admit(""); err != nil {
+		return err
+	}
+	defer vtg.admission.release()
+	if err := validateRequestTabletTypes(query.TabletType, query.Session); err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, context: %v, keyspace: %v", err, context, query.Keyspace)
+		return err
+	}
+	if err := vtg.accessControl.check(context, query.Keyspace, query.TabletType); err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, context: %v", err, context)
+		return err
+	}
+	if err := validateSqlSize("StreamExecuteKeyspaceIds", query.Keyspace, query.Sql); err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, context: %v, keyspace: %v", err, context, query.Keyspace)
+		return err
+	}
+	if err := validateBindVariables("StreamExecuteKeyspaceIds", query.Keyspace, query.BindVariables); err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, context: %v, keyspace: %v, sql: %v", err, context, query.Keyspace, query.Sql)
+		return err
+	}
+	if query.Session != nil && query.Session.InTransaction {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, query: %+v", ErrStreamingInTransaction, query)
+		return ErrStreamingInTransaction
+	}
+	shards, err := mapKeyspaceIdsToShards(vtg.scatterConn.toposerv, vtg.scatterConn.cell, query.Keyspace, query.TabletType, query.KeyspaceIds)
+	if err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, query: %+v", err, query)
+		return err
+	}
+	limiter := newRowRateLimiter(streamRowsPerSecond(0))
+	defer limiter.done()
+	batcher := newStreamBatcher(sendReply)
+	err = vtg.scatterConn.StreamExecute(
+		context,
+		query.Sql,
+		query.BindVariables,
+		query.Keyspace,
+		shards,
+		query.TabletType,
+		logEntry.session(query.Session),
+		func(mreply *mproto.QueryResult) error {
+			rows += len(mreply.Rows)
+			limiter.wait(len(mreply.Rows))
+			for _, reply := range chunkQueryResult(mreply, *streamPacketRows, *streamPacketBytes) {
+				if err := batcher.send(reply); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if batchErr := batcher.finish(); err == nil {
+		err = batchErr
+	}
+
+	if err != nil {
+		log.Errorf("StreamExecuteKeyspaceIds: %v, query: %+v", err, query)
+	}
 	if query.Session != nil {
 		sendReply(&proto.QueryResult{Session: query.Session})
 	}
@@ -182,15 +921,177 @@ func (vtg *VTGate) StreamExecuteShard(context interface{}, query *proto.QuerySha
 // Begin begins a transaction. It has to be concluded by a Commit or Rollback.
 func (vtg *VTGate) Begin(context interface{}, outSession *proto.Session) error {
 	outSession.InTransaction = true
+	vtg.sessions.begin(context, outSession)
 	return nil
 }
 
-// Commit commits a transaction.
+// Commit commits a transaction. It returns an *InvalidTabletTypeError
+// without committing anything if a ShardSession has a bad tablet type,
+// and ErrSessionNotFound if the Session was already finished or
+// expired, see sessionRegistry.
 func (vtg *VTGate) Commit(context interface{}, inSession *proto.Session) error {
+	if err := validateSession(inSession); err != nil {
+		log.Errorf("Commit: %v, session: %v", err, inSession)
+		return err
+	}
+	if err := vtg.sessions.end(inSession); err != nil {
+		log.Errorf("Commit: %v, context: %v, session: %v", err, context, inSession)
+		return err
+	}
 	return vtg.scatterConn.Commit(context, NewSafeSession(inSession))
 }
 
-// Rollback rolls back a transaction.
+// Rollback rolls back a transaction. Like Commit, it returns
+// ErrSessionNotFound if the Session was already finished or expired.
 func (vtg *VTGate) Rollback(context interface{}, inSession *proto.Session) error {
+	if err := vtg.sessions.end(inSession); err != nil {
+		log.Errorf("Rollback: %v, context: %v, session: %v", err, context, inSession)
+		return err
+	}
 	return vtg.scatterConn.Rollback(context, NewSafeSession(inSession))
 }
+
+// ConnClosed cancels the streaming queries of the client connection
+// of context, which closed, and rolls back the transactions of the
+// sessions whose last request came through it, see
+// -session_rollback_on_disconnect.
+func (vtg *VTGate) ConnClosed(context interface{}) {
+	conn := clientConn(context)
+	if conn == nil {
+		return
+	}
+	vtg.scatterConn.ConnClosed(conn)
+	vtg.sessions.connClosed(conn)
+}
+
+// rollbackShardSessions rolls back the shard sessions of a session
+// whose client is gone, see sessionRegistry.
+func (vtg *VTGate) rollbackShardSessions(shardSessions []*proto.ShardSession) {
+	if err := vtg.scatterConn.RollbackShardSessions(nil, shardSessions); err != nil {
+		log.Warningf("cannot roll back the transaction of a session: %v", err)
+	}
+}
+
+// RollbackOldTransactions rolls back the shard transactions this
+// vtgate began more than minAge ago, according to its transaction
+// registry, see -tx_registry_size. It returns the number of
+// transactions rolled back.
+func (vtg *VTGate) RollbackOldTransactions(context interface{}, minAge time.Duration) (int, error) {
+	count, err := vtg.scatterConn.RollbackOldTransactions(context, minAge)
+	if err != nil {
+		log.Errorf("RollbackOldTransactions: %v, context: %v, minAge: %v", err, context, minAge)
+	}
+	return count, err
+}
+
+// Ping does nothing. It is used by clients to check a
+// connection to vtgate is still usable.
+func (vtg *VTGate) Ping(context interface{}) error {
+	return nil
+}
+
+// setQueryError sets the error of the reply to a query of the handler
+// name, along with its codes and the session, and logs it.
+func setQueryError(reply *proto.QueryResult, session *proto.Session, name string, err error, context interface{}) {
+	reply.Error = err.Error()
+	reply.Err = rpcError(err)
+	reply.ErrorCode = errorCode(err)
+	reply.Session = session
+	log.Errorf("%v: %v, context: %v", name, err, context)
+}
+
+// setQueryListError is setQueryError for the reply to a batch. The
+// errors of the shards are set too, see QueryResultList.ShardErrors.
+func setQueryListError(reply *proto.QueryResultList, session *proto.Session, name string, err error, context interface{}) {
+	reply.Error = err.Error()
+	reply.Err = rpcError(err)
+	reply.ErrorCode = errorCode(err)
+	reply.ShardErrors = shardErrors(err)
+	reply.Session = session
+	log.Errorf("%v: %v, context: %v", name, err, context)
+}
+
+// errorCode returns the tablet error code for an error
+// returned by ScatterConn, ErrOverloaded or a *PermissionDeniedError.
+func errorCode(err error) int {
+	if err == ErrOverloaded {
+		return tabletconn.ERR_OVERLOADED
+	}
+	if _, ok := err.(*PermissionDeniedError); ok {
+		return tabletconn.ERR_PERMISSION_DENIED
+	}
+	if scatterConnErr, ok := err.(*ScatterConnError); ok {
+		return scatterConnErr.Code
+	}
+	return tabletconn.ERR_NORMAL
+}
+
+// rpcError returns the RpcError of an error returned by ScatterConn,
+// ErrOverloaded or the checks of a request.
+func rpcError(err error) *proto.RpcError {
+	code := proto.ERR_NORMAL
+	if scatterConnErr, ok := err.(*ScatterConnError); ok {
+		code = scatterConnErr.RpcCode()
+	} else if err == ErrOverloaded {
+		code = proto.ERR_RETRY
+	}
+	return &proto.RpcError{Code: code, Message: err.Error()}
+}
+
+// requestContext returns the context to pass to the tablets for a
+// request that names callerID or has a deadline of deadlineMs
+// milliseconds from now, see tabletconn.RequestContext. The other
+// requests keep their context.
+func requestContext(context interface{}, callerID *proto.CallerID, deadlineMs int64) interface{} {
+	if callerID == nil && deadlineMs <= 0 {
+		return context
+	}
+	ctx := &tabletconn.RequestContext{Context: context}
+	if callerID != nil {
+		ctx.CallerID = &tproto.CallerID{
+			Principal:    callerID.Principal,
+			Component:    callerID.Component,
+			Subcomponent: callerID.Subcomponent,
+		}
+	}
+	if deadlineMs > 0 {
+		ctx.Deadline = time.Now().Add(time.Duration(deadlineMs) * time.Millisecond)
+	}
+	return ctx
+}
+
+// shardErrors returns the errors of the shards of a *ScatterConnError,
+// see QueryResultList.ShardErrors.
+func shardErrors(err error) []proto.ShardError {
+	scatterConnErr, ok := err.(*ScatterConnError)
+	if !ok {
+		return nil
+	}
+	var result []proto.ShardError
+	for _, e := range scatterConnErr.Errs {
+		if shardConnErr, ok := e.(*ShardConnError); ok {
+			result = append(result, proto.ShardError{
+				Keyspace: shardConnErr.Keyspace,
+				Shard:    shardConnErr.Shard,
+				Error:    shardConnErr.Err,
+			})
+		}
+	}
+	return result
+}
+
+// shardLag returns the replication lag in seconds of the tablets
+// serving the shards, see QueryResult.ShardLag. Masters have no lag.
+// The vttablets don't report their replication lag to vtgate, so it
+// is unknown (-1) for the other tablet types.
+func shardLag(shards []string, tabletType topo.TabletType) map[string]int64 {
+	result := make(map[string]int64, len(shards))
+	for _, shard := range shards {
+		if tabletType == topo.TYPE_MASTER {
+			result[shard] = 0
+		} else {
+			result[shard] = -1
+		}
+	}
+	return result
+}
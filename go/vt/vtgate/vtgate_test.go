@@ -5,11 +5,21 @@
 package vtgate
 
 import (
+	"bytes"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/youtube/vitess/go/bson"
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	rpcproto "github.com/youtube/vitess/go/rpcwrap/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/vt/key"
 	tproto "github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/tabletserver/tabletconn"
 	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/vtgate/proto"
 )
@@ -25,35 +35,55 @@ func TestVTGateExecuteShard(t *testing.T) {
 	sbc := &sandboxConn{}
 	testConns[0] = sbc
 	q := proto.QueryShard{
-		Sql:    "query",
-		Shards: []string{"0"},
+		Sql:        "query",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_BATCH,
 	}
 	qr := new(proto.QueryResult)
 	err := RpcVTGate.ExecuteShard(nil, &q, qr)
 	if err != nil {
 		t.Errorf("want nil, got %v", err)
 	}
+	// the rows are passed through: the reply is the same as
+	// if they had been decoded
 	wantqr := new(proto.QueryResult)
 	proto.PopulateQueryResult(singleRowResult, wantqr)
-	if !reflect.DeepEqual(wantqr, qr) {
-		t.Errorf("want \n%#v, got \n%#v", singleRowResult, qr)
+	if want, got := marshalQueryResult(t, wantqr), marshalQueryResult(t, qr); !bytes.Equal(want, got) {
+		t.Errorf("want \n%q, got \n%q", want, got)
 	}
 	if qr.Session != nil {
 		t.Errorf("want nil, got %#v\n", qr.Session)
 	}
 
+	// the tablet error code is sent along with the error
+	sbc.mustFailNotTx = 1
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "shard 0: not_in_tx: err" || qr.ErrorCode != tabletconn.ERR_NOT_IN_TX {
+		t.Errorf("want not_in_tx error, got %v (code %v)", qr.Error, qr.ErrorCode)
+	}
+	if want := (&proto.RpcError{Code: proto.ERR_NOT_IN_TX, Message: qr.Error}); !reflect.DeepEqual(want, qr.Err) {
+		t.Errorf("want %#v, got %#v", want, qr.Err)
+	}
+
 	q.Session = new(proto.Session)
 	RpcVTGate.Begin(nil, q.Session)
 	if !q.Session.InTransaction {
 		t.Errorf("want true, got false")
 	}
+	if q.Session.SessionId == 0 || q.Session.TransactionStartTime == 0 {
+		t.Errorf("want a SessionId and a TransactionStartTime, got %#v", q.Session)
+	}
 	RpcVTGate.ExecuteShard(nil, &q, qr)
 	wantSession := &proto.Session{
 		InTransaction: true,
 		ShardSessions: []*proto.ShardSession{{
 			Shard:         "0",
+			TabletType:    topo.TYPE_BATCH,
 			TransactionId: 1,
 		}},
+		SessionId:            q.Session.SessionId,
+		TransactionStartTime: q.Session.TransactionStartTime,
 	}
 	if !reflect.DeepEqual(wantSession, q.Session) {
 		t.Errorf("want \n%#v, got \n%#v", wantSession, q.Session)
@@ -77,6 +107,307 @@ func TestVTGateExecuteShard(t *testing.T) {
 	*/
 }
 
+func marshalQueryResult(t *testing.T, qr *proto.QueryResult) []byte {
+	encoded, err := bson.Marshal(qr)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return encoded
+}
+
+func TestVTGateExecuteShardRawRows(t *testing.T) {
+	resetSandbox()
+	testConns[0] = &sandboxConn{}
+	testConns[1] = &sandboxConn{}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Shards:     []string{"0", "1"},
+		TabletType: topo.TYPE_BATCH,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || qr.RawRows == nil {
+		t.Fatalf("want raw rows, got %+v", qr)
+	}
+
+	// the reply is byte-identical to the one with decoded rows
+	merged := new(mproto.QueryResult)
+	appendResult(merged, singleRowResult)
+	appendResult(merged, singleRowResult)
+	wantqr := new(proto.QueryResult)
+	proto.PopulateQueryResult(merged, wantqr)
+	want := marshalQueryResult(t, wantqr)
+	if got := marshalQueryResult(t, qr); !bytes.Equal(want, got) {
+		t.Errorf("want \n%q, got \n%q", want, got)
+	}
+
+	// packing the rows decodes them
+	q.PackedRows = true
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.RawRows != nil || !reflect.DeepEqual(qr.Rows, merged.Rows) {
+		t.Errorf("want decoded rows %v, got %+v", merged.Rows, qr)
+	}
+}
+
+func TestVTGateExecuteKeyspaceIds(t *testing.T) {
+	resetSandbox()
+	sbc1 := &sandboxConn{}
+	sbc2 := &sandboxConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	q := proto.KeyspaceIdQuery{
+		Sql:         "query",
+		Keyspace:    "ks_keyspace_ids",
+		KeyspaceIds: []key.KeyspaceId{"\x10", "\x25", "\x15"},
+		TabletType:  topo.TYPE_MASTER,
+	}
+	qr := new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteKeyspaceIds(nil, &q, qr); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	// the two keyspace ids of -20 query it once
+	if qr.RowsAffected != 2 {
+		t.Errorf("want 2, got %v", qr.RowsAffected)
+	}
+	if count := sbc1.ExecCount.Get(); count != 1 {
+		t.Errorf("want 1 query on -20, got %v", count)
+	}
+	if count := sbc2.ExecCount.Get(); count != 1 {
+		t.Errorf("want 1 query on 20-40, got %v", count)
+	}
+
+	// an empty list doesn't scatter
+	q.KeyspaceIds = nil
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteKeyspaceIds(nil, &q, qr)
+	if want := "vtgate: no keyspace ids in the request for keyspace ks_keyspace_ids"; qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+	if count := sbc1.ExecCount.Get() + sbc2.ExecCount.Get(); count != 2 {
+		t.Errorf("want no more queries, got %v", count)
+	}
+}
+
+func TestVTGateExecuteKeyRange(t *testing.T) {
+	resetSandbox()
+	sbc1 := &sandboxConn{}
+	sbc2 := &sandboxConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	q := proto.KeyRangeQuery{
+		Sql:        "query",
+		Keyspace:   "ks_key_range",
+		KeyRange:   "10-30",
+		TabletType: topo.TYPE_MASTER,
+	}
+	qr := new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteKeyRange(nil, &q, qr); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	if qr.RowsAffected != 2 || qr.Partial {
+		t.Errorf("want 2 rows from complete key range, got %v %v", qr.RowsAffected, qr.Partial)
+	}
+	if sbc1.ExecCount.Get() != 1 || sbc2.ExecCount.Get() != 1 {
+		t.Errorf("want 1 query on each shard, got %v %v", sbc1.ExecCount.Get(), sbc2.ExecCount.Get())
+	}
+
+	// each shard joins the transaction
+	q.Session = new(proto.Session)
+	RpcVTGate.Begin(nil, q.Session)
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteKeyRange(nil, &q, qr)
+	shards := make(map[string]bool)
+	for _, shardSession := range qr.Session.ShardSessions {
+		if shardSession.Keyspace != "ks_key_range" || shardSession.TabletType != topo.TYPE_MASTER {
+			t.Errorf("unexpected shard session %#v", shardSession)
+		}
+		shards[shardSession.Shard] = true
+	}
+	if want := map[string]bool{"-20": true, "20-40": true}; !qr.Session.InTransaction || !reflect.DeepEqual(want, shards) {
+		t.Errorf("want a transaction on -20 and 20-40, got %#v", qr.Session)
+	}
+	RpcVTGate.Rollback(nil, q.Session)
+
+	// bad key ranges are reported, not run
+	q.Session = nil
+	count1, count2 := sbc1.ExecCount.Get(), sbc2.ExecCount.Get()
+	for _, keyRange := range []string{"", "30-10", "20-20", "1z-30", "10-20-30"} {
+		q.KeyRange = keyRange
+		qr = new(proto.QueryResult)
+		RpcVTGate.ExecuteKeyRange(nil, &q, qr)
+		if qr.Error == "" {
+			t.Errorf("key range %q: want an error", keyRange)
+		}
+	}
+	if sbc1.ExecCount.Get() != count1 || sbc2.ExecCount.Get() != count2 {
+		t.Errorf("bad key ranges reached the tablets")
+	}
+}
+
+// bindVarsConn is a sandboxConn that keeps the bind variables of its
+// last query.
+type bindVarsConn struct {
+	sandboxConn
+	mu       sync.Mutex
+	bindVars map[string]interface{}
+}
+
+func (sbc *bindVarsConn) ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.LazyQueryResult, error) {
+	sbc.mu.Lock()
+	sbc.bindVars = bindVars
+	sbc.mu.Unlock()
+	return sbc.sandboxConn.ExecuteLazy(context, query, bindVars, transactionId)
+}
+
+func TestVTGateExecuteEntityIds(t *testing.T) {
+	resetSandbox()
+	sbc1 := &bindVarsConn{}
+	sbc2 := &bindVarsConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	q := proto.EntityIdsQuery{
+		Sql:              "select * from t where user_id in (:user_id) and a = :a",
+		BindVariables:    map[string]interface{}{"a": 5},
+		Keyspace:         "ks_entity_ids",
+		EntityColumnName: "user_id",
+		EntityKeyspaceIds: []proto.EntityId{
+			{ExternalId: 1, KeyspaceId: "\x10"},
+			{ExternalId: 2, KeyspaceId: "\x25"},
+			{ExternalId: 3, KeyspaceId: "\x15"},
+		},
+		TabletType: topo.TYPE_MASTER,
+	}
+	qr := new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteEntityIds(nil, &q, qr); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	if qr.RowsAffected != 2 || len(qr.Fields) != len(singleRowResult.Fields) {
+		t.Errorf("want the merged result of 2 shards, got %+v", qr)
+	}
+	// each shard only gets its own entity ids
+	a := sqltypes.MakeNumeric([]byte("5"))
+	want1 := map[string]interface{}{
+		"a":       a,
+		"user_id": []sqltypes.Value{sqltypes.MakeNumeric([]byte("1")), sqltypes.MakeNumeric([]byte("3"))},
+	}
+	if !reflect.DeepEqual(want1, sbc1.bindVars) {
+		t.Errorf("want %v on -20, got %v", want1, sbc1.bindVars)
+	}
+	want2 := map[string]interface{}{
+		"a":       a,
+		"user_id": []sqltypes.Value{sqltypes.MakeNumeric([]byte("2"))},
+	}
+	if !reflect.DeepEqual(want2, sbc2.bindVars) {
+		t.Errorf("want %v on 20-40, got %v", want2, sbc2.bindVars)
+	}
+
+	testCases := []struct {
+		change func(q *proto.EntityIdsQuery)
+		want   string
+	}{{
+		func(q *proto.EntityIdsQuery) { q.EntityKeyspaceIds = nil },
+		"vtgate: no entity ids in the request for keyspace ks_entity_ids",
+	}, {
+		func(q *proto.EntityIdsQuery) { q.EntityColumnName = "" },
+		"vtgate: no entity column name in the request for keyspace ks_entity_ids",
+	}, {
+		func(q *proto.EntityIdsQuery) { q.BindVariables["user_id"] = 1 },
+		"vtgate: bind variable user_id is set by vtgate to the entity ids of each shard",
+	}}
+	count1, count2 := sbc1.ExecCount.Get(), sbc2.ExecCount.Get()
+	for _, tc := range testCases {
+		bad := q
+		bad.BindVariables = map[string]interface{}{"a": 5}
+		tc.change(&bad)
+		qr = new(proto.QueryResult)
+		RpcVTGate.ExecuteEntityIds(nil, &bad, qr)
+		if qr.Error != tc.want {
+			t.Errorf("want %v, got %v", tc.want, qr.Error)
+		}
+	}
+	if sbc1.ExecCount.Get() != count1 || sbc2.ExecCount.Get() != count2 {
+		t.Errorf("bad requests reached the tablets")
+	}
+}
+
+func TestVTGateExecuteNotInTransaction(t *testing.T) {
+	resetSandbox()
+	sbc1 := &sandboxConn{}
+	sbc2 := &sandboxConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	session := new(proto.Session)
+	RpcVTGate.Begin(nil, session)
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_not_in_tx",
+		Shards:     []string{"-20"},
+		TabletType: topo.TYPE_MASTER,
+		Session:    session,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || len(session.ShardSessions) != 1 {
+		t.Fatalf("want 1 shard session, got %v %#v", qr.Error, session)
+	}
+	want := *session.ShardSessions[0]
+
+	// the reads run on the master outside of the transaction, even
+	// beyond the shard sessions limit
+	q.Shards = []string{"-20", "20-40"}
+	q.MaxShardSessions = 1
+	q.NotInTransaction = true
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || qr.RowsAffected != 2 {
+		t.Errorf("want 2 rows, got %v %v", qr.Error, qr.RowsAffected)
+	}
+	kq := proto.KeyspaceIdQuery{
+		Sql:              "query",
+		Keyspace:         "ks_not_in_tx",
+		KeyspaceIds:      []key.KeyspaceId{"\x10", "\x25"},
+		TabletType:       topo.TYPE_MASTER,
+		Session:          session,
+		NotInTransaction: true,
+	}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteKeyspaceIds(nil, &kq, qr)
+	if qr.Error != "" || qr.RowsAffected != 2 {
+		t.Errorf("want 2 rows, got %v %v", qr.Error, qr.RowsAffected)
+	}
+	rq := proto.KeyRangeQuery{
+		Sql:              "query",
+		Keyspace:         "ks_not_in_tx",
+		KeyRange:         "10-30",
+		TabletType:       topo.TYPE_MASTER,
+		Session:          session,
+		NotInTransaction: true,
+	}
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteKeyRange(nil, &rq, qr)
+	if qr.Error != "" || qr.RowsAffected != 2 {
+		t.Errorf("want 2 rows, got %v %v", qr.Error, qr.RowsAffected)
+	}
+
+	// the transaction didn't grow
+	if qr.Session != session || !session.InTransaction || len(session.ShardSessions) != 1 || *session.ShardSessions[0] != want {
+		t.Errorf("want the transaction on -20 only, got %#v", qr.Session)
+	}
+	if sbc1.BeginCount.Get() != 1 || sbc2.BeginCount.Get() != 0 {
+		t.Errorf("want 1 begin on -20, got %v %v", sbc1.BeginCount.Get(), sbc2.BeginCount.Get())
+	}
+}
+
 func TestVTGateExecuteBatchShard(t *testing.T) {
 	resetSandbox()
 	mapTestConn("-20", &sandboxConn{})
@@ -89,7 +420,8 @@ func TestVTGateExecuteBatchShard(t *testing.T) {
 			"query",
 			nil,
 		}},
-		Shards: []string{"-20", "20-40"},
+		Shards:     []string{"-20", "20-40"},
+		TabletType: topo.TYPE_BATCH,
 	}
 	qrl := new(proto.QueryResultList)
 	err := RpcVTGate.ExecuteBatchShard(nil, &q, qrl)
@@ -114,6 +446,149 @@ func TestVTGateExecuteBatchShard(t *testing.T) {
 	}
 }
 
+func TestVTGateExecuteBatchKeyspaceIds(t *testing.T) {
+	resetSandbox()
+	sbc1 := &sandboxConn{}
+	sbc2 := &sandboxConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	q := proto.KeyspaceIdBatchQuery{
+		Queries: []tproto.BoundQuery{{
+			"query1",
+			nil,
+		}, {
+			"query2",
+			nil,
+		}},
+		Keyspace:    "ks_batch_keyspace_ids",
+		KeyspaceIds: []key.KeyspaceId{"\x10", "\x25", "\x15"},
+		TabletType:  topo.TYPE_MASTER,
+	}
+	qrl := new(proto.QueryResultList)
+	if err := RpcVTGate.ExecuteBatchKeyspaceIds(nil, &q, qrl); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	if qrl.Error != "" {
+		t.Errorf("want no error, got %v", qrl.Error)
+	}
+	if len(qrl.List) != 2 {
+		t.Fatalf("want 2, got %v", len(qrl.List))
+	}
+	// the two keyspace ids of -20 send it the batch once
+	for i, qr := range qrl.List {
+		if qr.RowsAffected != 2 {
+			t.Errorf("query %v: want 2, got %v", i, qr.RowsAffected)
+		}
+	}
+	if count := sbc1.ExecCount.Get(); count != 1 {
+		t.Errorf("want 1 batch on -20, got %v", count)
+	}
+	if count := sbc2.ExecCount.Get(); count != 1 {
+		t.Errorf("want 1 batch on 20-40, got %v", count)
+	}
+
+	// an empty list doesn't scatter
+	q.KeyspaceIds = nil
+	qrl = new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchKeyspaceIds(nil, &q, qrl)
+	if want := "vtgate: no keyspace ids in the request for keyspace ks_batch_keyspace_ids"; qrl.Error != want {
+		t.Errorf("want %v, got %v", want, qrl.Error)
+	}
+	if count := sbc1.ExecCount.Get() + sbc2.ExecCount.Get(); count != 2 {
+		t.Errorf("want no more batches, got %v", count)
+	}
+}
+
+// batchIndexConn answers the i-th query of a batch with i+1 rows
+// affected.
+type batchIndexConn struct {
+	sandboxConn
+}
+
+func (sbc *batchIndexConn) ExecuteBatch(context interface{}, queries []tproto.BoundQuery, transactionId int64) (*tproto.QueryResultList, error) {
+	sbc.ExecCount.Add(1)
+	qrl := &tproto.QueryResultList{List: make([]mproto.QueryResult, len(queries))}
+	for i := range queries {
+		qrl.List[i].RowsAffected = uint64(i + 1)
+	}
+	return qrl, nil
+}
+
+func TestVTGateExecuteBatchShardErrors(t *testing.T) {
+	resetSandbox()
+	mapTestConn("-20", &batchIndexConn{})
+	mapTestConn("20-40", &sandboxConn{mustFailServer: 1})
+	mapTestConn("40-60", &batchIndexConn{})
+	q := proto.BatchQueryShard{
+		Queries: []tproto.BoundQuery{{
+			"query1",
+			nil,
+		}, {
+			"query2",
+			nil,
+		}, {
+			"query3",
+			nil,
+		}},
+		Keyspace:   "ks_batch_shard_errors",
+		Shards:     []string{"-20", "20-40", "40-60"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	qrl := new(proto.QueryResultList)
+	if err := RpcVTGate.ExecuteBatchShard(nil, &q, qrl); err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	// old clients still see the failure
+	if want := "shard ks_batch_shard_errors/20-40: error: err"; qrl.Error != want {
+		t.Errorf("want %v, got %v", want, qrl.Error)
+	}
+	// the results of the two other shards are in the order of the queries
+	if len(qrl.List) != 3 {
+		t.Fatalf("want 3 results, got %v", len(qrl.List))
+	}
+	for i, qr := range qrl.List {
+		if want := uint64(2 * (i + 1)); qr.RowsAffected != want {
+			t.Errorf("query %v: want %v, got %v", i, want, qr.RowsAffected)
+		}
+	}
+	want := []proto.ShardError{{Keyspace: "ks_batch_shard_errors", Shard: "20-40", Error: "error: err"}}
+	if !reflect.DeepEqual(want, qrl.ShardErrors) {
+		t.Errorf("want %#v, got %#v", want, qrl.ShardErrors)
+	}
+}
+
+func TestSetQueryError(t *testing.T) {
+	session := &proto.Session{InTransaction: true}
+	for _, tc := range []struct {
+		err     error
+		code    int
+		rpcCode int
+	}{
+		{ErrOverloaded, tabletconn.ERR_OVERLOADED, proto.ERR_RETRY},
+		{&SqlTooLargeError{Size: 11, MaxSize: 10}, tabletconn.ERR_NORMAL, proto.ERR_NORMAL},
+		{&InvalidTabletTypeError{TabletType: "mater"}, tabletconn.ERR_NORMAL, proto.ERR_NORMAL},
+	} {
+		// the codes of an earlier error don't stay
+		qr := &proto.QueryResult{ErrorCode: tabletconn.ERR_FATAL}
+		setQueryError(qr, session, "ExecuteShard", tc.err, nil)
+		if qr.Error != tc.err.Error() || qr.ErrorCode != tc.code || qr.Session != session {
+			t.Errorf("%v: got error %v, code %v, session %v", tc.err, qr.Error, qr.ErrorCode, qr.Session)
+		}
+		if qr.Err == nil || qr.Err.Code != tc.rpcCode || qr.Err.Message != tc.err.Error() {
+			t.Errorf("%v: want rpc code %v, got %+v", tc.err, tc.rpcCode, qr.Err)
+		}
+
+		qrl := &proto.QueryResultList{ErrorCode: tabletconn.ERR_FATAL, ShardErrors: []proto.ShardError{{Shard: "0"}}}
+		setQueryListError(qrl, session, "ExecuteBatchShard", tc.err, nil)
+		if qrl.Error != tc.err.Error() || qrl.ErrorCode != tc.code || qrl.Session != session || qrl.ShardErrors != nil {
+			t.Errorf("%v: got error %v, code %v, session %v, shard errors %v", tc.err, qrl.Error, qrl.ErrorCode, qrl.Session, qrl.ShardErrors)
+		}
+		if qrl.Err == nil || qrl.Err.Code != tc.rpcCode {
+			t.Errorf("%v: want rpc code %v, got %+v", tc.err, tc.rpcCode, qrl.Err)
+		}
+	}
+}
+
 func TestVTGateStreamExecuteKeyRange(t *testing.T) {
 	resetSandbox()
 	sbc := &sandboxConn{}
@@ -139,30 +614,41 @@ func TestVTGateStreamExecuteKeyRange(t *testing.T) {
 		t.Errorf("want \n%#v, got \n%#v", want, qrs)
 	}
 
+	// a session that is not in a transaction is sent back at the end
 	sq.Session = new(proto.Session)
 	qrs = nil
-	RpcVTGate.Begin(nil, sq.Session)
 	err = RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
 		qrs = append(qrs, r)
 		return nil
 	})
+	if err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
 	want = []*proto.QueryResult{
 		row,
 		&proto.QueryResult{
-			Session: &proto.Session{
-				InTransaction: true,
-				ShardSessions: []*proto.ShardSession{{
-					Shard:         "-20",
-					TransactionId: 1,
-					TabletType:    topo.TYPE_MASTER,
-				}},
-			},
+			Session: &proto.Session{},
 		},
 	}
 	if !reflect.DeepEqual(want, qrs) {
 		t.Errorf("want \n%#v, got \n%#v", want, qrs)
 	}
 
+	// streaming in a transaction is rejected
+	qrs = nil
+	RpcVTGate.Begin(nil, sq.Session)
+	err = RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
+		qrs = append(qrs, r)
+		return nil
+	})
+	if err != ErrStreamingInTransaction {
+		t.Errorf("want %v, got %v", ErrStreamingInTransaction, err)
+	}
+	if qrs != nil || len(sq.Session.ShardSessions) != 0 || sbc.BeginCount != 0 {
+		t.Errorf("rejected stream did some work: %#v, %#v, %v", qrs, sq.Session, sbc.BeginCount)
+	}
+	sq.Session = nil
+
 	// Test for error condition - multiple shards
 	sq.KeyRange = "10-40"
 	err = RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
@@ -183,11 +669,89 @@ func TestVTGateStreamExecuteKeyRange(t *testing.T) {
 	}
 }
 
+func TestVTGateStreamExecuteKeyRanges(t *testing.T) {
+	resetSandbox()
+	sbc1 := &streamRowsConn{results: []*mproto.QueryResult{
+		{Fields: keyRangeFilterFields},
+		{Rows: [][]sqltypes.Value{
+			uint64Row(0x1000000000000000),
+			uint64Row(0x1900000000000000),
+		}},
+	}}
+	sbc2 := &streamRowsConn{results: []*mproto.QueryResult{
+		{Fields: keyRangeFilterFields},
+		{Rows: [][]sqltypes.Value{
+			uint64Row(0x2100000000000000),
+			uint64Row(0x3000000000000000),
+		}},
+	}}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	// the key ranges straddle the 20 shard boundary, and the last
+	// one overlaps the first
+	sq := proto.StreamQueryKeyRange{
+		Sql:        "query",
+		Keyspace:   "ks_keyranges",
+		KeyRanges:  []string{"18-20", "20-28", "1c-20"},
+		TabletType: topo.TYPE_MASTER,
+	}
+	var rows [][]sqltypes.Value
+	err := RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
+		rows = append(rows, r.Rows...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamExecuteKeyRange failed: %v", err)
+	}
+	if sbc1.ExecCount.Get() != 1 || sbc2.ExecCount.Get() != 1 {
+		t.Errorf("want each shard streamed once, got %v, %v", sbc1.ExecCount.Get(), sbc2.ExecCount.Get())
+	}
+	// the rows of the shards outside of the key ranges are dropped,
+	// the shards stream in any order
+	got := make(map[string]bool)
+	for _, row := range rows {
+		got[row[1].String()] = true
+	}
+	want := map[string]bool{
+		fmt.Sprintf("%v", uint64(0x1900000000000000)): true,
+		fmt.Sprintf("%v", uint64(0x2100000000000000)): true,
+	}
+	if len(rows) != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, rows)
+	}
+
+	// each key range must still map to one shard
+	sq.KeyRanges = []string{"18-20", "10-28"}
+	err = RpcVTGate.StreamExecuteKeyRange(nil, &sq, func(r *proto.QueryResult) error {
+		t.Errorf("StreamExecuteKeyRange sent a result: %v", r)
+		return nil
+	})
+	if err == nil {
+		t.Errorf("want an error for a key range of two shards")
+	}
+}
+
+// streamQueryShard returns the StreamQueryShard of the same query as
+// q, for the tests of both the streaming and non-streaming requests.
+func streamQueryShard(q *proto.QueryShard) *proto.StreamQueryShard {
+	return &proto.StreamQueryShard{
+		Sql:           q.Sql,
+		BindVariables: q.BindVariables,
+		Keyspace:      q.Keyspace,
+		Shards:        q.Shards,
+		TabletType:    q.TabletType,
+		Session:       q.Session,
+		IncludeLag:    q.IncludeLag,
+		PackedRows:    q.PackedRows,
+		Workload:      q.Workload,
+	}
+}
+
 func TestVTGateStreamExecuteShard(t *testing.T) {
 	resetSandbox()
 	sbc := &sandboxConn{}
 	testConns[0] = sbc
-	q := proto.QueryShard{
+	q := proto.StreamQueryShard{
 		Sql:        "query",
 		Shards:     []string{"0"},
 		TabletType: topo.TYPE_MASTER,
@@ -208,28 +772,411 @@ func TestVTGateStreamExecuteShard(t *testing.T) {
 		t.Errorf("want \n%#v, got \n%#v", want, qrs)
 	}
 
+	// streaming in a transaction is rejected, on one or more shards
+	sbc1 := &sandboxConn{}
+	testConns[1] = sbc1
+	for _, shards := range [][]string{{"0"}, {"0", "1"}} {
+		q.Shards = shards
+		q.Session = new(proto.Session)
+		qrs = nil
+		RpcVTGate.Begin(nil, q.Session)
+		err = RpcVTGate.StreamExecuteShard(nil, &q, func(r *proto.QueryResult) error {
+			qrs = append(qrs, r)
+			return nil
+		})
+		if err != ErrStreamingInTransaction {
+			t.Errorf("%v: want %v, got %v", shards, ErrStreamingInTransaction, err)
+		}
+		if qrs != nil || len(q.Session.ShardSessions) != 0 {
+			t.Errorf("%v: rejected stream did some work: %#v, %#v", shards, qrs, q.Session)
+		}
+	}
+	if sbc.ExecCount != 1 || sbc.BeginCount != 0 || sbc1.ExecCount != 0 {
+		t.Errorf("rejected streams reached the tablets: %v %v %v", sbc.ExecCount, sbc.BeginCount, sbc1.ExecCount)
+	}
+}
+
+func TestVTGateStreamExecuteKeyspaceIds(t *testing.T) {
+	resetSandbox()
+	sbc1 := &sandboxConn{}
+	sbc2 := &sandboxConn{}
+	mapTestConn("-20", sbc1)
+	mapTestConn("20-40", sbc2)
+	q := proto.StreamQueryKeyspaceIds{
+		Sql:         "query",
+		Keyspace:    "ks_stream_keyspace_ids",
+		KeyspaceIds: []key.KeyspaceId{"\x10", "\x25", "\x15"},
+		TabletType:  topo.TYPE_MASTER,
+	}
+	var qrs []*proto.QueryResult
+	err := RpcVTGate.StreamExecuteKeyspaceIds(nil, &q, func(r *proto.QueryResult) error {
+		qrs = append(qrs, r)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	// the two keyspace ids of -20 stream from it once
+	if len(qrs) != 2 {
+		t.Errorf("want 2 results, got %v", len(qrs))
+	}
+	if sbc1.ExecCount.Get() != 1 || sbc2.ExecCount.Get() != 1 {
+		t.Errorf("want 1 stream on each shard, got %v %v", sbc1.ExecCount.Get(), sbc2.ExecCount.Get())
+	}
+
+	// an empty list doesn't scatter
+	q.KeyspaceIds = nil
+	err = RpcVTGate.StreamExecuteKeyspaceIds(nil, &q, func(r *proto.QueryResult) error {
+		t.Errorf("StreamExecuteKeyspaceIds sent a result")
+		return nil
+	})
+	if want := "vtgate: no keyspace ids in the request for keyspace ks_stream_keyspace_ids"; err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	// streaming in a transaction is rejected
+	q.KeyspaceIds = []key.KeyspaceId{"\x10"}
 	q.Session = new(proto.Session)
-	qrs = nil
 	RpcVTGate.Begin(nil, q.Session)
-	err = RpcVTGate.StreamExecuteShard(nil, &q, func(r *proto.QueryResult) error {
+	err = RpcVTGate.StreamExecuteKeyspaceIds(nil, &q, func(r *proto.QueryResult) error {
+		t.Errorf("StreamExecuteKeyspaceIds sent a result")
+		return nil
+	})
+	if err != ErrStreamingInTransaction {
+		t.Errorf("want %v, got %v", ErrStreamingInTransaction, err)
+	}
+	if count := sbc1.ExecCount.Get() + sbc2.ExecCount.Get(); count != 2 {
+		t.Errorf("want no more streams, got %v", count)
+	}
+}
+
+// reusingConn streams count results, reusing the same buffers for
+// all of them. It waits on next before reusing them.
+type reusingConn struct {
+	sandboxConn
+	count int
+	next  chan struct{}
+}
+
+func (rc *reusingConn) StreamExecute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (<-chan *mproto.QueryResult, tabletconn.ErrFunc) {
+	ch := make(chan *mproto.QueryResult)
+	go func() {
+		qr := &mproto.QueryResult{
+			Fields: []mproto.Field{{Name: "id", Type: 3}},
+			Rows:   [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("0"))}},
+		}
+		for i := 0; i < rc.count; i++ {
+			qr.Fields[0].Name = fmt.Sprintf("id%v", i)
+			qr.Rows[0][0].Inner.(sqltypes.Numeric)[0] = byte('0' + i)
+			ch <- qr
+			<-rc.next
+		}
+		close(ch)
+	}()
+	return ch, func() error { return nil }
+}
+
+func TestVTGateStreamExecuteShardReusedBuffers(t *testing.T) {
+	resetSandbox()
+	rc := &reusingConn{count: 10, next: make(chan struct{})}
+	testConns[0] = rc
+	// use a tablet type the other tests don't use, so vtgate
+	// doesn't reuse one of their connections
+	q := proto.StreamQueryShard{
+		Sql:        "query",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_RDONLY,
+	}
+
+	// the client decodes the replies while the tablet reuses
+	// its buffers for the next ones
+	replies := make(chan *proto.QueryResult, rc.count)
+	done := make(chan []string)
+	go func() {
+		var got []string
+		for r := range replies {
+			got = append(got, r.Fields[0].Name+"="+r.Rows[0][0].String())
+		}
+		done <- got
+	}()
+	err := RpcVTGate.StreamExecuteShard(nil, &q, func(r *proto.QueryResult) error {
+		replies <- r
+		rc.next <- struct{}{}
+		return nil
+	})
+	close(replies)
+	if err != nil {
+		t.Errorf("want nil, got %v", err)
+	}
+	got := <-done
+	var want []string
+	for i := 0; i < rc.count; i++ {
+		want = append(want, fmt.Sprintf("id%v=%v", i, i))
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestVTGateShardLag(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{}
+	testConns[0] = sbc
+	q := proto.QueryShard{
+		Sql:        "query",
+		Shards:     []string{"0"},
+		TabletType: topo.TYPE_MASTER,
+		IncludeLag: true,
+	}
+	qr := new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteShard(nil, &q, qr); err != nil {
+		t.Fatalf("ExecuteShard failed: %v", err)
+	}
+	if want := map[string]int64{"0": 0}; !reflect.DeepEqual(want, qr.ShardLag) {
+		t.Errorf("want %v, got %v", want, qr.ShardLag)
+	}
+
+	// the lag of non-master tablets is unknown, and sent
+	// with the last result when streaming
+	q.TabletType = topo.TYPE_REPLICA
+	var qrs []*proto.QueryResult
+	err := RpcVTGate.StreamExecuteShard(nil, streamQueryShard(&q), func(r *proto.QueryResult) error {
 		qrs = append(qrs, r)
 		return nil
 	})
-	want = []*proto.QueryResult{
-		row,
-		&proto.QueryResult{
-			Session: &proto.Session{
-				InTransaction: true,
-				ShardSessions: []*proto.ShardSession{{
-					Shard:         "0",
-					TransactionId: 1,
-					TabletType:    topo.TYPE_MASTER,
-				}},
-			},
+	if err != nil {
+		t.Fatalf("StreamExecuteShard failed: %v", err)
+	}
+	if len(qrs) != 2 || qrs[0].ShardLag != nil {
+		t.Fatalf("want 2 results, the first without lag, got %#v", qrs)
+	}
+	if want := map[string]int64{"0": -1}; !reflect.DeepEqual(want, qrs[1].ShardLag) {
+		t.Errorf("want %v, got %v", want, qrs[1].ShardLag)
+	}
+
+	// no lag unless asked for
+	q.IncludeLag = false
+	qr = new(proto.QueryResult)
+	if err := RpcVTGate.ExecuteShard(nil, &q, qr); err != nil {
+		t.Fatalf("ExecuteShard failed: %v", err)
+	}
+	if qr.ShardLag != nil {
+		t.Errorf("want no lag, got %v", qr.ShardLag)
+	}
+}
+
+// callerIDConn records the CallerID of the context of its queries.
+type callerIDConn struct {
+	sandboxConn
+	mu       sync.Mutex
+	callerID *tproto.CallerID
+}
+
+func (sbc *callerIDConn) Execute(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.QueryResult, error) {
+	sbc.mu.Lock()
+	sbc.callerID = tabletconn.CallerID(context)
+	sbc.mu.Unlock()
+	return sbc.sandboxConn.Execute(context, query, bindVars, transactionId)
+}
+
+func (sbc *callerIDConn) ExecuteLazy(context interface{}, query string, bindVars map[string]interface{}, transactionId int64) (*mproto.LazyQueryResult, error) {
+	qr, err := sbc.Execute(context, query, bindVars, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	return mproto.NewLazyQueryResult(qr), nil
+}
+
+func (sbc *callerIDConn) ExecuteBatch(context interface{}, queries []tproto.BoundQuery, transactionId int64) (*tproto.QueryResultList, error) {
+	sbc.mu.Lock()
+	sbc.callerID = tabletconn.CallerID(context)
+	sbc.mu.Unlock()
+	return sbc.sandboxConn.ExecuteBatch(context, queries, transactionId)
+}
+
+func (sbc *callerIDConn) lastCallerID() *tproto.CallerID {
+	sbc.mu.Lock()
+	defer sbc.mu.Unlock()
+	return sbc.callerID
+}
+
+func TestVTGateCallerID(t *testing.T) {
+	resetSandbox()
+	sbc := &callerIDConn{}
+	mapTestConn("-20", sbc)
+	want := &tproto.CallerID{
+		Principal:    "user",
+		Component:    "app",
+		Subcomponent: "report",
+	}
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_caller_id",
+		Shards:     []string{"-20"},
+		TabletType: topo.TYPE_MASTER,
+		CallerID: &proto.CallerID{
+			Principal:    "user",
+			Component:    "app",
+			Subcomponent: "report",
 		},
 	}
-	if !reflect.DeepEqual(want, qrs) {
-		t.Errorf("want \n%#v, got \n%#v", want, qrs)
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" {
+		t.Errorf("want no error, got %v", qr.Error)
+	}
+	if got := sbc.lastCallerID(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %#v, got %#v", want, got)
 	}
 
+	// without a CallerID, the tablets get none
+	q.CallerID = nil
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if got := sbc.lastCallerID(); got != nil {
+		t.Errorf("want nil, got %#v", got)
+	}
+
+	bq := proto.BatchQueryShard{
+		Queries:    []tproto.BoundQuery{{"query", nil}},
+		Keyspace:   "ks_caller_id",
+		Shards:     []string{"-20"},
+		TabletType: topo.TYPE_MASTER,
+		CallerID:   &proto.CallerID{Principal: "user"},
+	}
+	qrl := new(proto.QueryResultList)
+	RpcVTGate.ExecuteBatchShard(nil, &bq, qrl)
+	if qrl.Error != "" {
+		t.Errorf("want no error, got %v", qrl.Error)
+	}
+	if got := sbc.lastCallerID(); got == nil || got.Principal != "user" {
+		t.Errorf("want user, got %#v", got)
+	}
+}
+
+func TestCallerIDUsername(t *testing.T) {
+	context := &tabletconn.RequestContext{
+		Context:  &rpcproto.Context{Username: "user"},
+		CallerID: &tproto.CallerID{Principal: "other"},
+	}
+	if got := callerName(context); got != "user" {
+		t.Errorf("want user, got %v", got)
+	}
+}
+
+func TestVTGateExecuteShardDeadline(t *testing.T) {
+	resetSandbox()
+	sbc := &sandboxConn{mustDelay: 1 * time.Second}
+	mapTestConn("-20", sbc)
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_deadline",
+		Shards:     []string{"-20"},
+		TabletType: topo.TYPE_MASTER,
+		DeadlineMs: 1,
+	}
+	qr := new(proto.QueryResult)
+	start := time.Now()
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the query took %v", elapsed)
+	}
+	if !strings.Contains(qr.Error, "deadline exceeded") {
+		t.Errorf("want deadline exceeded, got %v", qr.Error)
+	}
+}
+
+func TestVTGateExecuteShardAllowPartialResults(t *testing.T) {
+	resetSandbox()
+	// shard -20 works, shard 20-40 fails and shard 40-60 doesn't
+	// answer before the deadline
+	mapTestConn("-20", &sandboxConn{})
+	mapTestConn("20-40", &sandboxConn{mustFailServer: 3})
+	mapTestConn("40-60", &sandboxConn{mustDelay: 1 * time.Second})
+	// the deadline of the query comes before the timeout of the
+	// tablet calls
+	defer func(timeout time.Duration) { RpcVTGate.scatterConn.timeout = timeout }(RpcVTGate.scatterConn.timeout)
+	RpcVTGate.scatterConn.timeout = 10 * time.Second
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_partial_results",
+		Shards:     []string{"-20", "20-40", "40-60"},
+		TabletType: topo.TYPE_MASTER,
+		DeadlineMs: 50,
+	}
+	wantErr := "shard ks_partial_results/20-40: error: err; shard ks_partial_results/40-60: vtgate: deadline exceeded"
+
+	// by default, the rows of shard -20 are dropped
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != wantErr || len(qr.RawRows) != 0 || qr.Partial {
+		t.Errorf("want no rows and error %v, got %v rows, error %v, partial %v", wantErr, len(qr.RawRows), qr.Error, qr.Partial)
+	}
+
+	q.AllowPartialResults = true
+	for _, packedRows := range []bool{false, true} {
+		q.PackedRows = packedRows
+		qr = new(proto.QueryResult)
+		start := time.Now()
+		RpcVTGate.ExecuteShard(nil, &q, qr)
+		if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+			t.Errorf("packed rows %v: the query took %v", packedRows, elapsed)
+		}
+		if qr.Error != wantErr || !qr.Partial {
+			t.Errorf("packed rows %v: want a partial result and error %v, got error %v, partial %v", packedRows, wantErr, qr.Error, qr.Partial)
+		}
+		if rows := len(qr.RawRows) + len(qr.Rows); rows != 1 {
+			t.Errorf("packed rows %v: want the row of shard -20, got %v rows", packedRows, rows)
+		}
+	}
+}
+
+func TestVTGateExecuteShardMaxRows(t *testing.T) {
+	resetSandbox()
+	sbc0 := &sandboxConn{}
+	mapTestConn("-20", sbc0)
+	sbc1 := &sandboxConn{}
+	mapTestConn("20-40", sbc1)
+	q := proto.QueryShard{
+		Sql:        "query",
+		Keyspace:   "ks_max_rows",
+		Shards:     []string{"-20", "20-40"},
+		TabletType: topo.TYPE_MASTER,
+		MaxRows:    2,
+	}
+	qr := new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if qr.Error != "" || len(qr.RawRows) != 2 {
+		t.Errorf("want 2 rows, got %v rows, error %v", len(qr.RawRows), qr.Error)
+	}
+
+	// one more row than the limit fails the query, but not its
+	// transaction
+	q.MaxRows = 1
+	q.Session = new(proto.Session)
+	RpcVTGate.Begin(nil, q.Session)
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if want := "vtgate: too many rows: 2 rows received, the limit is 1 rows"; qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
+	if qr.RawRows != nil {
+		t.Errorf("want no rows, got %v", qr.RawRows)
+	}
+	if !q.Session.InTransaction || len(q.Session.ShardSessions) != 2 {
+		t.Errorf("want the transaction on 2 shards, got %v", q.Session)
+	}
+	if sbc0.RollbackCount.Get() != 0 || sbc1.RollbackCount.Get() != 0 {
+		t.Errorf("want no rollback, got %v and %v", sbc0.RollbackCount.Get(), sbc1.RollbackCount.Get())
+	}
+
+	// the flag lowers the limit of the request
+	restore := setMaxResultRows(1)
+	defer restore()
+	q.MaxRows = 2
+	q.Session = nil
+	qr = new(proto.QueryResult)
+	RpcVTGate.ExecuteShard(nil, &q, qr)
+	if want := "vtgate: too many rows: 2 rows received, the limit is 1 rows"; qr.Error != want {
+		t.Errorf("want %v, got %v", want, qr.Error)
+	}
 }
@@ -0,0 +1,308 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+const (
+	dateLayout     = "2006-01-02"
+	datetimeLayout = "2006-01-02 15:04:05.999999999"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// RowToNative converts a row of sqltypes values to native go types,
+// according to the corresponding Field:
+// - nil for NULL values
+// - int64 for integer types, uint64 if the column is unsigned
+// - float64 for FLOAT and DOUBLE
+// - string for DECIMAL types, to preserve their precision
+// - time.Time in UTC for DATE, DATETIME and TIMESTAMP
+// - time.Duration for TIME, as it is an interval and not a point in time
+// - []byte for binary columns (BLOB, VARBINARY, BINARY, BIT, GEOMETRY)
+// - string for all other (text) columns
+func RowToNative(fields []mproto.Field, row []sqltypes.Value) ([]interface{}, error) {
+	if len(fields) != len(row) {
+		return nil, fmt.Errorf("row has %v values but there are %v fields", len(row), len(fields))
+	}
+	result := make([]interface{}, len(row))
+	for i, v := range row {
+		var err error
+		if result[i], err = ToNative(fields[i], v); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ToNative converts a single value according to its Field.
+// See RowToNative for the conversion rules.
+func ToNative(field mproto.Field, val sqltypes.Value) (interface{}, error) {
+	if val.IsNull() {
+		return nil, nil
+	}
+	s := val.String()
+	switch field.Type {
+	case mproto.VT_NULL:
+		return nil, nil
+	case mproto.VT_TINY, mproto.VT_SHORT, mproto.VT_LONG, mproto.VT_LONGLONG, mproto.VT_INT24, mproto.VT_YEAR:
+		if field.Flags&mproto.VT_UNSIGNED_FLAG != 0 {
+			u, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %v: %v", field.Name, err)
+			}
+			return u, nil
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", field.Name, err)
+		}
+		return i, nil
+	case mproto.VT_FLOAT, mproto.VT_DOUBLE:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", field.Name, err)
+		}
+		return f, nil
+	case mproto.VT_DECIMAL, mproto.VT_NEWDECIMAL:
+		return s, nil
+	case mproto.VT_DATE, mproto.VT_NEWDATE:
+		t, err := parseTime(dateLayout, s)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", field.Name, err)
+		}
+		return t, nil
+	case mproto.VT_DATETIME, mproto.VT_TIMESTAMP:
+		t, err := parseTime(datetimeLayout, s)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", field.Name, err)
+		}
+		return t, nil
+	case mproto.VT_TIME:
+		d, err := parseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", field.Name, err)
+		}
+		return d, nil
+	case mproto.VT_BIT, mproto.VT_GEOMETRY:
+		return copyBytes(val.Raw()), nil
+	case mproto.VT_VARCHAR, mproto.VT_TINY_BLOB, mproto.VT_MEDIUM_BLOB, mproto.VT_LONG_BLOB, mproto.VT_BLOB, mproto.VT_VAR_STRING, mproto.VT_STRING:
+		if field.Flags&mproto.VT_BINARY_FLAG != 0 {
+			return copyBytes(val.Raw()), nil
+		}
+		return s, nil
+	case mproto.VT_ENUM, mproto.VT_SET:
+		return s, nil
+	}
+	return nil, fmt.Errorf("column %v: unknown type %v", field.Name, field.Type)
+}
+
+// copyBytes makes sure the returned []byte doesn't alias
+// the buffers the value was decoded from.
+func copyBytes(b []byte) []byte {
+	result := make([]byte, len(b))
+	copy(result, b)
+	return result
+}
+
+// parseTime parses a MySQL date or datetime. MySQL uses all-zero
+// values for invalid dates, we return the zero time.Time for those.
+func parseTime(layout, s string) (time.Time, error) {
+	if strings.HasPrefix(s, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(layout, s, time.UTC)
+}
+
+// parseDuration parses a MySQL TIME value, of the form
+// [-]HHH:MM:SS[.fraction].
+func parseDuration(s string) (time.Duration, error) {
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid TIME value %v", s)
+	}
+	hours, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TIME value %v: %v", s, err)
+	}
+	minutes, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || minutes > 59 {
+		return 0, fmt.Errorf("invalid TIME value %v", s)
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || seconds >= 60 {
+		return 0, fmt.Errorf("invalid TIME value %v", s)
+	}
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+	if negative {
+		d = -d
+	}
+	return d, nil
+}
+
+// RowToStruct copies a row into the struct pointed to by dest.
+// Each column is matched with the exported struct field that has
+// a `sql:"column"` tag, or if there is no such tag, that has the
+// same name as the column (case insensitive). Columns without a
+// matching field are ignored.
+// A NULL value sets pointer and interface fields to nil. For other
+// fields, NULL is an error, unless nullAsZero is set, in which case
+// the field is set to its zero value.
+func RowToStruct(fields []mproto.Field, row []sqltypes.Value, dest interface{}, nullAsZero bool) error {
+	dv := reflect.ValueOf(dest)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() || dv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("RowToStruct needs a non-nil pointer to a struct, got %T", dest)
+	}
+	dv = dv.Elem()
+	values, err := RowToNative(fields, row)
+	if err != nil {
+		return err
+	}
+	indexes := structFieldIndexes(dv.Type())
+	for i, field := range fields {
+		index, ok := indexes[strings.ToLower(field.Name)]
+		if !ok {
+			continue
+		}
+		if err := setField(dv.Field(index), values[i], nullAsZero); err != nil {
+			return fmt.Errorf("column %v: %v", field.Name, err)
+		}
+	}
+	return nil
+}
+
+// structFieldIndexes returns a map of lower case column name to
+// field index for all the exported fields of a struct type.
+func structFieldIndexes(t reflect.Type) map[string]int {
+	indexes := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := sf.Tag.Get("sql")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		indexes[strings.ToLower(name)] = i
+	}
+	return indexes
+}
+
+// setField stores the native value val into the struct field f.
+func setField(f reflect.Value, val interface{}, nullAsZero bool) error {
+	if val == nil {
+		switch f.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			f.Set(reflect.Zero(f.Type()))
+			return nil
+		}
+		if !nullAsZero {
+			return fmt.Errorf("cannot store NULL in a field of type %v", f.Type())
+		}
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	if f.Kind() == reflect.Ptr {
+		pv := reflect.New(f.Type().Elem())
+		if err := setField(pv.Elem(), val, nullAsZero); err != nil {
+			return err
+		}
+		f.Set(pv)
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(f.Type()) {
+		f.Set(v)
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch val := val.(type) {
+		case int64:
+			i = val
+		case uint64:
+			if val > 1<<63-1 {
+				return fmt.Errorf("value %v overflows %v", val, f.Type())
+			}
+			i = int64(val)
+		default:
+			return fmt.Errorf("cannot store %T in a field of type %v", val, f.Type())
+		}
+		if f.Type() == durationType || f.OverflowInt(i) {
+			return fmt.Errorf("cannot store %v in a field of type %v", val, f.Type())
+		}
+		f.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		switch val := val.(type) {
+		case uint64:
+			u = val
+		case int64:
+			if val < 0 {
+				return fmt.Errorf("value %v overflows %v", val, f.Type())
+			}
+			u = uint64(val)
+		default:
+			return fmt.Errorf("cannot store %T in a field of type %v", val, f.Type())
+		}
+		if f.OverflowUint(u) {
+			return fmt.Errorf("value %v overflows %v", val, f.Type())
+		}
+		f.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch val := val.(type) {
+		case float64:
+			f.SetFloat(val)
+		case int64:
+			f.SetFloat(float64(val))
+		case uint64:
+			f.SetFloat(float64(val))
+		default:
+			return fmt.Errorf("cannot store %T in a field of type %v", val, f.Type())
+		}
+		return nil
+	case reflect.String:
+		switch val := val.(type) {
+		case string:
+			f.SetString(val)
+			return nil
+		case []byte:
+			f.SetString(string(val))
+			return nil
+		}
+	case reflect.Slice:
+		if f.Type().Elem().Kind() == reflect.Uint8 {
+			switch val := val.(type) {
+			case string:
+				f.SetBytes([]byte(val))
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("cannot store %T in a field of type %v", val, f.Type())
+}
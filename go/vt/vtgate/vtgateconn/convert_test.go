@@ -0,0 +1,248 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestToNative(t *testing.T) {
+	testcases := []struct {
+		typ   int64
+		flags int64
+		in    string
+		out   interface{}
+	}{
+		{mproto.VT_DECIMAL, 0, "1.25", "1.25"},
+		{mproto.VT_TINY, 0, "-128", int64(-128)},
+		{mproto.VT_TINY, mproto.VT_UNSIGNED_FLAG, "255", uint64(255)},
+		{mproto.VT_SHORT, 0, "-32768", int64(-32768)},
+		{mproto.VT_SHORT, mproto.VT_UNSIGNED_FLAG, "65535", uint64(65535)},
+		{mproto.VT_LONG, 0, "-2147483648", int64(-2147483648)},
+		{mproto.VT_LONG, mproto.VT_UNSIGNED_FLAG, "4294967295", uint64(4294967295)},
+		{mproto.VT_FLOAT, 0, "1.5", float64(1.5)},
+		{mproto.VT_DOUBLE, 0, "-2.25e10", float64(-2.25e10)},
+		{mproto.VT_NULL, 0, "", nil},
+		{mproto.VT_TIMESTAMP, 0, "2014-02-03 04:05:06", time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC)},
+		{mproto.VT_TIMESTAMP, 0, "0000-00-00 00:00:00", time.Time{}},
+		{mproto.VT_LONGLONG, 0, "-9223372036854775808", int64(-9223372036854775808)},
+		{mproto.VT_LONGLONG, mproto.VT_UNSIGNED_FLAG, "18446744073709551615", uint64(18446744073709551615)},
+		{mproto.VT_INT24, 0, "-8388608", int64(-8388608)},
+		{mproto.VT_INT24, mproto.VT_UNSIGNED_FLAG, "16777215", uint64(16777215)},
+		{mproto.VT_DATE, 0, "2014-02-03", time.Date(2014, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{mproto.VT_DATE, 0, "0000-00-00", time.Time{}},
+		{mproto.VT_TIME, 0, "12:34:56", 12*time.Hour + 34*time.Minute + 56*time.Second},
+		{mproto.VT_TIME, 0, "-838:59:59", -(838*time.Hour + 59*time.Minute + 59*time.Second)},
+		{mproto.VT_TIME, 0, "00:00:01.5", 1500 * time.Millisecond},
+		{mproto.VT_DATETIME, 0, "2014-02-03 04:05:06", time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC)},
+		{mproto.VT_DATETIME, 0, "2014-02-03 04:05:06.123456", time.Date(2014, 2, 3, 4, 5, 6, 123456000, time.UTC)},
+		{mproto.VT_YEAR, mproto.VT_UNSIGNED_FLAG, "2014", uint64(2014)},
+		{mproto.VT_NEWDATE, 0, "2014-02-03", time.Date(2014, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{mproto.VT_VARCHAR, 0, "abc", "abc"},
+		{mproto.VT_VARCHAR, mproto.VT_BINARY_FLAG, "abc", []byte("abc")},
+		{mproto.VT_BIT, 0, "\x01", []byte("\x01")},
+		{mproto.VT_NEWDECIMAL, 0, "12345678901234567890.123", "12345678901234567890.123"},
+		{mproto.VT_ENUM, 0, "a", "a"},
+		{mproto.VT_SET, 0, "a,b", "a,b"},
+		{mproto.VT_TINY_BLOB, 0, "tiny text", "tiny text"},
+		{mproto.VT_TINY_BLOB, mproto.VT_BINARY_FLAG, "tiny\x00blob", []byte("tiny\x00blob")},
+		{mproto.VT_MEDIUM_BLOB, 0, "medium text", "medium text"},
+		{mproto.VT_MEDIUM_BLOB, mproto.VT_BINARY_FLAG, "medium\x00blob", []byte("medium\x00blob")},
+		{mproto.VT_LONG_BLOB, 0, "long text", "long text"},
+		{mproto.VT_LONG_BLOB, mproto.VT_BINARY_FLAG, "long\x00blob", []byte("long\x00blob")},
+		{mproto.VT_BLOB, 0, "text", "text"},
+		{mproto.VT_BLOB, mproto.VT_BINARY_FLAG, "\xff\x00blob", []byte("\xff\x00blob")},
+		{mproto.VT_VAR_STRING, 0, "varchar", "varchar"},
+		{mproto.VT_VAR_STRING, mproto.VT_BINARY_FLAG, "varbinary", []byte("varbinary")},
+		{mproto.VT_STRING, 0, "char", "char"},
+		{mproto.VT_STRING, mproto.VT_BINARY_FLAG, "binary", []byte("binary")},
+		{mproto.VT_GEOMETRY, mproto.VT_BINARY_FLAG, "\x00\x01", []byte("\x00\x01")},
+	}
+	for _, tcase := range testcases {
+		field := mproto.Field{Name: "col", Type: tcase.typ, Flags: tcase.flags}
+		got, err := ToNative(field, sqltypes.MakeString([]byte(tcase.in)))
+		if err != nil {
+			t.Errorf("ToNative(%v, %v, %q) failed: %v", tcase.typ, tcase.flags, tcase.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tcase.out) {
+			t.Errorf("ToNative(%v, %v, %q): want %#v, got %#v", tcase.typ, tcase.flags, tcase.in, tcase.out, got)
+		}
+		if ts, ok := got.(time.Time); ok && !ts.IsZero() && ts.Location() != time.UTC {
+			t.Errorf("ToNative(%v, %v, %q): want UTC, got %v", tcase.typ, tcase.flags, tcase.in, ts.Location())
+		}
+	}
+}
+
+func TestToNativeNull(t *testing.T) {
+	for _, typ := range []int64{mproto.VT_LONG, mproto.VT_DOUBLE, mproto.VT_DATETIME, mproto.VT_BLOB, mproto.VT_VARCHAR} {
+		got, err := ToNative(mproto.Field{Name: "col", Type: typ}, sqltypes.NULL)
+		if err != nil || got != nil {
+			t.Errorf("ToNative(%v, NULL): want nil, nil, got %#v, %v", typ, got, err)
+		}
+	}
+}
+
+func TestToNativeErrors(t *testing.T) {
+	testcases := []struct {
+		typ   int64
+		flags int64
+		in    string
+	}{
+		{mproto.VT_LONG, 0, "abc"},
+		{mproto.VT_LONGLONG, 0, "18446744073709551615"},
+		{mproto.VT_LONGLONG, mproto.VT_UNSIGNED_FLAG, "-1"},
+		{mproto.VT_DOUBLE, 0, "x"},
+		{mproto.VT_DATE, 0, "2014-13-01"},
+		{mproto.VT_DATETIME, 0, "2014-02-03"},
+		{mproto.VT_TIME, 0, "12:60:00"},
+		{mproto.VT_TIME, 0, "12:00"},
+		{100, 0, "unknown type"},
+	}
+	for _, tcase := range testcases {
+		field := mproto.Field{Name: "col", Type: tcase.typ, Flags: tcase.flags}
+		if got, err := ToNative(field, sqltypes.MakeString([]byte(tcase.in))); err == nil {
+			t.Errorf("ToNative(%v, %v, %q): want error, got %#v", tcase.typ, tcase.flags, tcase.in, got)
+		}
+	}
+}
+
+func TestRowToNative(t *testing.T) {
+	fields := []mproto.Field{
+		{Name: "id", Type: mproto.VT_LONGLONG, Flags: mproto.VT_UNSIGNED_FLAG},
+		{Name: "name", Type: mproto.VT_VAR_STRING},
+		{Name: "data", Type: mproto.VT_BLOB, Flags: mproto.VT_BINARY_FLAG},
+	}
+	row := []sqltypes.Value{
+		sqltypes.MakeNumeric([]byte("1")),
+		sqltypes.MakeString([]byte("foo")),
+		sqltypes.NULL,
+	}
+	got, err := RowToNative(fields, row)
+	if err != nil {
+		t.Fatalf("RowToNative failed: %v", err)
+	}
+	want := []interface{}{uint64(1), "foo", nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RowToNative: want %#v, got %#v", want, got)
+	}
+
+	if _, err := RowToNative(fields, row[:2]); err == nil {
+		t.Errorf("RowToNative with missing values should have failed")
+	}
+}
+
+type scanned struct {
+	Id       uint64
+	Name     string
+	Nickname *string
+	Data     []byte
+	Created  time.Time `sql:"time_created"`
+	Elapsed  time.Duration
+	Score    float32
+	Small    int8
+	Ignored  string `sql:"-"`
+	internal string
+}
+
+func TestRowToStruct(t *testing.T) {
+	fields := []mproto.Field{
+		{Name: "id", Type: mproto.VT_LONGLONG, Flags: mproto.VT_UNSIGNED_FLAG},
+		{Name: "NAME", Type: mproto.VT_VAR_STRING},
+		{Name: "nickname", Type: mproto.VT_VAR_STRING},
+		{Name: "data", Type: mproto.VT_BLOB, Flags: mproto.VT_BINARY_FLAG},
+		{Name: "time_created", Type: mproto.VT_DATETIME},
+		{Name: "elapsed", Type: mproto.VT_TIME},
+		{Name: "score", Type: mproto.VT_DOUBLE},
+		{Name: "small", Type: mproto.VT_TINY},
+		{Name: "ignored", Type: mproto.VT_VAR_STRING},
+		{Name: "internal", Type: mproto.VT_VAR_STRING},
+		{Name: "unknown", Type: mproto.VT_VAR_STRING},
+	}
+	row := []sqltypes.Value{
+		sqltypes.MakeNumeric([]byte("12")),
+		sqltypes.MakeString([]byte("foo")),
+		sqltypes.MakeString([]byte("bar")),
+		sqltypes.MakeString([]byte("\x00\x01")),
+		sqltypes.MakeString([]byte("2014-02-03 04:05:06")),
+		sqltypes.MakeString([]byte("01:00:00")),
+		sqltypes.MakeFractional([]byte("0.5")),
+		sqltypes.MakeNumeric([]byte("-3")),
+		sqltypes.MakeString([]byte("ignored")),
+		sqltypes.MakeString([]byte("internal")),
+		sqltypes.MakeString([]byte("unknown")),
+	}
+	var got scanned
+	if err := RowToStruct(fields, row, &got, false); err != nil {
+		t.Fatalf("RowToStruct failed: %v", err)
+	}
+	nickname := "bar"
+	want := scanned{
+		Id:       12,
+		Name:     "foo",
+		Nickname: &nickname,
+		Data:     []byte("\x00\x01"),
+		Created:  time.Date(2014, 2, 3, 4, 5, 6, 0, time.UTC),
+		Elapsed:  time.Hour,
+		Score:    0.5,
+		Small:    -3,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RowToStruct: want %#v, got %#v", want, got)
+	}
+}
+
+func TestRowToStructNull(t *testing.T) {
+	fields := []mproto.Field{
+		{Name: "name", Type: mproto.VT_VAR_STRING},
+		{Name: "nickname", Type: mproto.VT_VAR_STRING},
+		{Name: "data", Type: mproto.VT_BLOB, Flags: mproto.VT_BINARY_FLAG},
+	}
+	row := []sqltypes.Value{sqltypes.NULL, sqltypes.NULL, sqltypes.NULL}
+
+	nickname := "bar"
+	got := scanned{Name: "foo", Nickname: &nickname, Data: []byte("x")}
+	if err := RowToStruct(fields, row, &got, false); err == nil {
+		t.Errorf("RowToStruct with NULL into a string should have failed")
+	}
+
+	got = scanned{Name: "foo", Nickname: &nickname, Data: []byte("x")}
+	if err := RowToStruct(fields, row, &got, true); err != nil {
+		t.Fatalf("RowToStruct failed: %v", err)
+	}
+	if got.Name != "" || got.Nickname != nil || got.Data != nil {
+		t.Errorf("RowToStruct with NULLs: got %#v", got)
+	}
+}
+
+func TestRowToStructErrors(t *testing.T) {
+	fields := []mproto.Field{{Name: "small", Type: mproto.VT_LONG}}
+	row := []sqltypes.Value{sqltypes.MakeNumeric([]byte("1000"))}
+	var got scanned
+	if err := RowToStruct(fields, row, &got, false); err == nil {
+		t.Errorf("RowToStruct with overflow should have failed")
+	}
+
+	fields = []mproto.Field{{Name: "id", Type: mproto.VT_LONG}}
+	row = []sqltypes.Value{sqltypes.MakeNumeric([]byte("-1"))}
+	if err := RowToStruct(fields, row, &got, false); err == nil {
+		t.Errorf("RowToStruct with negative value into unsigned should have failed")
+	}
+
+	fields = []mproto.Field{{Name: "time_created", Type: mproto.VT_VAR_STRING}}
+	row = []sqltypes.Value{sqltypes.MakeString([]byte("abc"))}
+	if err := RowToStruct(fields, row, &got, false); err == nil {
+		t.Errorf("RowToStruct with string into time should have failed")
+	}
+
+	if err := RowToStruct(fields, row, got, false); err == nil {
+		t.Errorf("RowToStruct with non-pointer should have failed")
+	}
+}
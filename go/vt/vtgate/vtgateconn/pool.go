@@ -0,0 +1,486 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/sync2"
+)
+
+var (
+	CLOSED_ERR = fmt.Errorf("ConnPool is closed")
+)
+
+// ConnPoolLimits bounds the connections of a ConnPool. The zero value
+// has no limit, with one request at a time on each connection.
+type ConnPoolLimits struct {
+	// MinConns connections are dialed in the background when the
+	// pool is created, and dialed again when some are discarded.
+	MinConns int
+
+	// MaxConns is the maximum number of connections, 0 for no
+	// limit. When they are all busy, Get waits for one.
+	MaxConns int
+
+	// MaxInFlight is the maximum number of requests sent at the
+	// same time on a connection, 1 if not set. Above 1, the
+	// VTGateConn implementation must support concurrent calls.
+	MaxInFlight int
+
+	// CheckoutTimeout is how long Get waits for a connection when
+	// MaxConns are busy, 0 for no limit.
+	CheckoutTimeout time.Duration
+}
+
+// ConnPool is a pool of VTGateConn to a single vtgate address.
+// Up to ConnPoolLimits.MaxInFlight requests can share a connection,
+// once MaxConns connections are open.
+// If keepaliveInterval is set, a background goroutine pings the
+// connections that have been idle for that long, and discards the
+// ones that fail, so they are not handed out by Get.
+// A connection is only pinged while it is idle: it is taken out of
+// the pool for the duration of the ping, so a Get can never return
+// a connection with a ping in flight, and a ping is never sent on a
+// connection that was handed out by Get.
+type ConnPool struct {
+	dialer            DialerFunc
+	address           string
+	timeout           time.Duration
+	keepaliveInterval time.Duration
+	limits            ConnPoolLimits
+
+	mu      sync.Mutex
+	conns   []*poolEntry
+	dialing int
+	filling bool
+	closed  bool
+	done    chan struct{}
+	// released is closed and replaced each time a request ends or
+	// a connection goes away, to wake up the waiting Gets
+	released chan struct{}
+
+	// stats
+	waitCount        sync2.AtomicInt64
+	waitTime         sync2.AtomicDuration
+	checkoutFailures sync2.AtomicInt64
+	pingFailures     sync2.AtomicInt64
+}
+
+type poolEntry struct {
+	conn       VTGateConn
+	inFlight   int
+	lastActive time.Time
+	pinging    bool
+}
+
+// NewConnPool creates a ConnPool that uses dialer to connect to
+// address. timeout is used both for dialing and for keepalive pings.
+// A keepaliveInterval of 0 disables the keepalive pings.
+// If name is not empty, the stats of the pool are exported with it
+// as prefix.
+func NewConnPool(name string, dialer DialerFunc, address string, timeout, keepaliveInterval time.Duration, limits ConnPoolLimits) *ConnPool {
+	if limits.MaxInFlight <= 0 {
+		limits.MaxInFlight = 1
+	}
+	cp := &ConnPool{
+		dialer:            dialer,
+		address:           address,
+		timeout:           timeout,
+		keepaliveInterval: keepaliveInterval,
+		limits:            limits,
+		done:              make(chan struct{}),
+		released:          make(chan struct{}),
+	}
+	if name != "" {
+		stats.Publish(name+"Size", stats.IntFunc(cp.Size))
+		stats.Publish(name+"InUse", stats.IntFunc(cp.InUse))
+		stats.Publish(name+"WaitCount", stats.IntFunc(cp.WaitCount))
+		stats.Publish(name+"WaitTime", stats.DurationFunc(cp.WaitTime))
+		stats.Publish(name+"CheckoutFailures", stats.IntFunc(cp.CheckoutFailures))
+		stats.Publish(name+"PingFailures", stats.IntFunc(cp.pingFailures.Get))
+	}
+	if limits.MinConns > 0 {
+		go cp.fill()
+	}
+	if keepaliveInterval > 0 {
+		go cp.keepalive()
+	}
+	return cp
+}
+
+// Get returns the most recently used idle connection, or dials a new
+// one. Once MaxConns are open, it returns the one with the fewest
+// requests in flight below MaxInFlight, or waits up to
+// CheckoutTimeout for a request to end.
+// Each successful Get must be followed by a Put, or by a Discard if
+// the connection failed.
+func (cp *ConnPool) Get(context interface{}) (VTGateConn, error) {
+	var waitStart time.Time
+	var deadline <-chan time.Time
+	cp.mu.Lock()
+	for {
+		if cp.closed {
+			cp.mu.Unlock()
+			return nil, CLOSED_ERR
+		}
+		// a connection is only shared once no more can be dialed
+		entry := cp.available()
+		canDial := cp.limits.MaxConns == 0 || len(cp.conns)+cp.dialing < cp.limits.MaxConns
+		if entry != nil && (entry.inFlight == 0 || !canDial) {
+			entry.inFlight++
+			cp.mu.Unlock()
+			cp.recordWait(waitStart)
+			return entry.conn, nil
+		}
+		if canDial {
+			cp.dialing++
+			cp.mu.Unlock()
+			cp.recordWait(waitStart)
+			return cp.dial(context)
+		}
+
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+			if cp.limits.CheckoutTimeout > 0 {
+				deadline = time.After(cp.limits.CheckoutTimeout)
+			}
+		}
+		released := cp.released
+		cp.mu.Unlock()
+		select {
+		case <-released:
+		case <-deadline:
+			cp.recordWait(waitStart)
+			cp.checkoutFailures.Add(1)
+			return nil, OperationalError(fmt.Sprintf("vtgate: no connection to %v available after %v", cp.address, cp.limits.CheckoutTimeout))
+		}
+		cp.mu.Lock()
+	}
+}
+
+// available returns the usable connection with the fewest requests
+// in flight, or nil. cp.mu must be held.
+func (cp *ConnPool) available() *poolEntry {
+	var best *poolEntry
+	for _, entry := range cp.conns {
+		if entry.pinging || entry.inFlight >= cp.limits.MaxInFlight {
+			continue
+		}
+		if best == nil || entry.inFlight < best.inFlight || (entry.inFlight == best.inFlight && entry.lastActive.After(best.lastActive)) {
+			best = entry
+		}
+	}
+	return best
+}
+
+// dial adds a new connection to the pool, with one request in flight.
+// The caller must have counted it in cp.dialing.
+func (cp *ConnPool) dial(context interface{}) (VTGateConn, error) {
+	conn, err := cp.dialer(context, cp.address, cp.timeout)
+
+	cp.mu.Lock()
+	cp.dialing--
+	if err != nil {
+		cp.notify()
+		cp.mu.Unlock()
+		cp.checkoutFailures.Add(1)
+		return nil, err
+	}
+	if cp.closed {
+		cp.mu.Unlock()
+		conn.Close()
+		return nil, CLOSED_ERR
+	}
+	cp.conns = append(cp.conns, &poolEntry{conn: conn, inFlight: 1, lastActive: time.Now()})
+	cp.mu.Unlock()
+	return conn, nil
+}
+
+// Put returns a connection obtained by Get to the pool. If the
+// connection is no longer usable, the caller should call Discard
+// instead.
+func (cp *ConnPool) Put(conn VTGateConn) {
+	cp.mu.Lock()
+	i := cp.find(conn)
+	if i == -1 {
+		// it was discarded
+		cp.mu.Unlock()
+		return
+	}
+	entry := cp.conns[i]
+	entry.inFlight--
+	entry.lastActive = time.Now()
+	closing := cp.closed && entry.inFlight == 0
+	if closing {
+		cp.remove(i)
+	}
+	cp.notify()
+	cp.mu.Unlock()
+
+	if closing {
+		conn.Close()
+	}
+}
+
+// Discard closes a connection obtained by Get that failed, and
+// removes it from the pool. The other requests in flight on it fail,
+// their Put or Discard are then ignored. A new connection replaces it
+// if there are fewer than MinConns.
+func (cp *ConnPool) Discard(conn VTGateConn) {
+	cp.mu.Lock()
+	i := cp.find(conn)
+	if i == -1 {
+		cp.mu.Unlock()
+		return
+	}
+	cp.remove(i)
+	cp.notify()
+	cp.mu.Unlock()
+
+	conn.Close()
+	if cp.limits.MinConns > 0 {
+		go cp.fill()
+	}
+}
+
+// find returns the index of conn, or -1. cp.mu must be held.
+func (cp *ConnPool) find(conn VTGateConn) int {
+	for i, entry := range cp.conns {
+		if entry.conn == conn {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the connection at index i. cp.mu must be held.
+func (cp *ConnPool) remove(i int) {
+	last := len(cp.conns) - 1
+	cp.conns[i] = cp.conns[last]
+	cp.conns[last] = nil
+	cp.conns = cp.conns[:last]
+}
+
+// notify wakes up the waiting Gets. cp.mu must be held.
+func (cp *ConnPool) notify() {
+	close(cp.released)
+	cp.released = make(chan struct{})
+}
+
+func (cp *ConnPool) recordWait(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	cp.waitCount.Add(1)
+	cp.waitTime.Add(time.Now().Sub(start))
+}
+
+// fill dials connections until there are MinConns. It gives up at the
+// first failure, the keepalive tries again later.
+func (cp *ConnPool) fill() {
+	cp.mu.Lock()
+	if cp.filling {
+		cp.mu.Unlock()
+		return
+	}
+	cp.filling = true
+	var extra VTGateConn
+	for !cp.closed && len(cp.conns)+cp.dialing < cp.limits.MinConns {
+		cp.dialing++
+		cp.mu.Unlock()
+		conn, err := cp.dialer(nil, cp.address, cp.timeout)
+		cp.mu.Lock()
+		cp.dialing--
+		if err != nil {
+			log.Warningf("cannot dial vtgate %v to keep %v connections: %v", cp.address, cp.limits.MinConns, err)
+			break
+		}
+		if cp.closed {
+			extra = conn
+			break
+		}
+		cp.conns = append(cp.conns, &poolEntry{conn: conn, lastActive: time.Now()})
+		cp.notify()
+	}
+	cp.filling = false
+	cp.mu.Unlock()
+
+	if extra != nil {
+		extra.Close()
+	}
+}
+
+// Close closes all the idle connections and stops the keepalive
+// goroutine. Connections that are in use are closed when their last
+// request is returned with Put. After a Close, Get is not allowed.
+func (cp *ConnPool) Close() {
+	cp.mu.Lock()
+	if cp.closed {
+		cp.mu.Unlock()
+		return
+	}
+	cp.closed = true
+	close(cp.done)
+	var idle []VTGateConn
+	conns := make([]*poolEntry, 0, len(cp.conns))
+	for _, entry := range cp.conns {
+		if entry.inFlight == 0 && !entry.pinging {
+			idle = append(idle, entry.conn)
+			continue
+		}
+		conns = append(conns, entry)
+	}
+	cp.conns = conns
+	cp.notify()
+	cp.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+func (cp *ConnPool) keepalive() {
+	ticker := time.NewTicker(cp.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-ticker.C:
+			cp.pingIdle()
+			if cp.limits.MinConns > 0 {
+				cp.fill()
+			}
+		}
+	}
+}
+
+// pingIdle pings all the connections that have been idle for
+// at least keepaliveInterval.
+func (cp *ConnPool) pingIdle() {
+	for {
+		entry := cp.takeStale()
+		if entry == nil {
+			return
+		}
+		err := cp.ping(entry.conn)
+		cp.mu.Lock()
+		entry.pinging = false
+		if err == nil && !cp.closed {
+			entry.lastActive = time.Now()
+			cp.notify()
+			cp.mu.Unlock()
+			continue
+		}
+		if i := cp.find(entry.conn); i != -1 {
+			cp.remove(i)
+		}
+		cp.notify()
+		cp.mu.Unlock()
+		if err != nil {
+			log.Warningf("vtgate keepalive ping to %v failed, discarding connection: %v", cp.address, err)
+			cp.pingFailures.Add(1)
+		}
+		// A conn stuck in a ping may block Close, don't wait for it.
+		go entry.conn.Close()
+	}
+}
+
+// takeStale marks the least recently used connection as being pinged
+// and returns it, if it has been idle for at least keepaliveInterval.
+func (cp *ConnPool) takeStale() *poolEntry {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.closed {
+		return nil
+	}
+	var stale *poolEntry
+	for _, entry := range cp.conns {
+		if entry.inFlight != 0 || entry.pinging || time.Now().Sub(entry.lastActive) < cp.keepaliveInterval {
+			continue
+		}
+		if stale == nil || entry.lastActive.Before(stale.lastActive) {
+			stale = entry
+		}
+	}
+	if stale != nil {
+		stale.pinging = true
+	}
+	return stale
+}
+
+// ping pings conn, and returns an error if it fails
+// or doesn't respond within timeout. The timeout is also enforced
+// here, in case the VTGateConn implementation doesn't.
+func (cp *ConnPool) ping(conn VTGateConn) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- conn.Ping(nil, cp.timeout)
+	}()
+	var timeout <-chan time.Time
+	if cp.timeout > 0 {
+		timeout = time.After(cp.timeout)
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-timeout:
+		return OperationalError(fmt.Sprintf("vtgate: ping timed out after %v", cp.timeout))
+	}
+}
+
+func (cp *ConnPool) StatsJSON() string {
+	idle, inUse, pingFailures := cp.Stats()
+	return fmt.Sprintf(`{"Size": %v, "Idle": %v, "InUse": %v, "WaitCount": %v, "WaitTime": %v, "CheckoutFailures": %v, "PingFailures": %v}`, cp.Size(), idle, inUse, cp.WaitCount(), int64(cp.WaitTime()), cp.CheckoutFailures(), pingFailures)
+}
+
+// Stats returns the number of connections without requests (including
+// the ones being pinged), of requests in flight, and of failed
+// keepalive pings.
+func (cp *ConnPool) Stats() (idle, inUse, pingFailures int64) {
+	cp.mu.Lock()
+	for _, entry := range cp.conns {
+		if entry.inFlight == 0 {
+			idle++
+		}
+		inUse += int64(entry.inFlight)
+	}
+	cp.mu.Unlock()
+	return idle, inUse, cp.pingFailures.Get()
+}
+
+// Size returns the number of open connections.
+func (cp *ConnPool) Size() int64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return int64(len(cp.conns))
+}
+
+// InUse returns the number of requests in flight.
+func (cp *ConnPool) InUse() int64 {
+	_, inUse, _ := cp.Stats()
+	return inUse
+}
+
+// WaitCount returns the number of Gets that waited for a connection.
+func (cp *ConnPool) WaitCount() int64 {
+	return cp.waitCount.Get()
+}
+
+// WaitTime returns the total time Get waited for connections.
+func (cp *ConnPool) WaitTime() time.Duration {
+	return cp.waitTime.Get()
+}
+
+// CheckoutFailures returns the number of Gets that failed to dial or
+// timed out.
+func (cp *ConnPool) CheckoutFailures() int64 {
+	return cp.checkoutFailures.Get()
+}
@@ -0,0 +1,347 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// fakeConn is a VTGateConn that counts pings, and records
+// a ping sent while a request is in flight.
+type fakeConn struct {
+	mu          sync.Mutex
+	pingErr     error
+	pings       int
+	inFlight    bool
+	pingOverlap bool
+	closed      bool
+}
+
+func (fc *fakeConn) ExecuteShard(context interface{}, timeout time.Duration, query *proto.QueryShard) (*proto.QueryResult, error) {
+	fc.mu.Lock()
+	fc.inFlight = true
+	fc.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	fc.mu.Lock()
+	fc.inFlight = false
+	fc.mu.Unlock()
+	return &proto.QueryResult{}, nil
+}
+
+func (fc *fakeConn) ExecuteBatchShard(context interface{}, timeout time.Duration, batchQuery *proto.BatchQueryShard) (*proto.QueryResultList, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (fc *fakeConn) StreamExecuteShard(context interface{}, timeout time.Duration, query *proto.StreamQueryShard) (<-chan *proto.QueryResult, ErrFunc) {
+	return nil, nil
+}
+
+func (fc *fakeConn) StreamExecuteKeyRange(context interface{}, timeout time.Duration, query *proto.StreamQueryKeyRange) (<-chan *proto.QueryResult, ErrFunc) {
+	return nil, nil
+}
+
+func (fc *fakeConn) Begin(context interface{}, timeout time.Duration) (*proto.Session, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (fc *fakeConn) Commit(context interface{}, timeout time.Duration, session *proto.Session) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (fc *fakeConn) Rollback(context interface{}, timeout time.Duration, session *proto.Session) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (fc *fakeConn) Ping(context interface{}, timeout time.Duration) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.pings++
+	if fc.inFlight {
+		fc.pingOverlap = true
+	}
+	return fc.pingErr
+}
+
+func (fc *fakeConn) Close() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.closed = true
+}
+
+func (fc *fakeConn) state() (pings int, pingOverlap, closed bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.pings, fc.pingOverlap, fc.closed
+}
+
+// fakeDialer returns the conns in order.
+func fakeDialer(conns ...*fakeConn) DialerFunc {
+	var mu sync.Mutex
+	return func(context interface{}, address string, timeout time.Duration) (VTGateConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(conns) == 0 {
+			return nil, fmt.Errorf("no more conns")
+		}
+		conn := conns[0]
+		conns = conns[1:]
+		return conn, nil
+	}
+}
+
+func TestConnPoolGetPut(t *testing.T) {
+	fc1, fc2 := &fakeConn{}, &fakeConn{}
+	cp := NewConnPool("", fakeDialer(fc1, fc2), "addr", time.Second, 0, ConnPoolLimits{})
+	c1, err := cp.Get(nil)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	c2, err := cp.Get(nil)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if idle, inUse, _ := cp.Stats(); idle != 0 || inUse != 2 {
+		t.Errorf("want 0 idle 2 in use, got %v %v", idle, inUse)
+	}
+	if _, err := cp.Get(nil); err == nil {
+		t.Errorf("want dial error, got nil")
+	}
+	if idle, inUse, _ := cp.Stats(); idle != 0 || inUse != 2 {
+		t.Errorf("want 0 idle 2 in use after failed dial, got %v %v", idle, inUse)
+	}
+	cp.Put(c1)
+	cp.Discard(c2)
+	if idle, inUse, _ := cp.Stats(); idle != 1 || inUse != 0 {
+		t.Errorf("want 1 idle 0 in use, got %v %v", idle, inUse)
+	}
+	c, err := cp.Get(nil)
+	if err != nil || c != c1 {
+		t.Errorf("want %v, got %v %v", c1, c, err)
+	}
+	cp.Close()
+	if _, err := cp.Get(nil); err != CLOSED_ERR {
+		t.Errorf("want %v, got %v", CLOSED_ERR, err)
+	}
+	cp.Put(c)
+	if _, _, closed := fc1.state(); !closed {
+		t.Errorf("want conn closed by Put after Close")
+	}
+	if _, _, closed := fc2.state(); !closed {
+		t.Errorf("want discarded conn closed")
+	}
+}
+
+func TestConnPoolKeepalive(t *testing.T) {
+	good, bad := &fakeConn{}, &fakeConn{pingErr: OperationalError("broken pipe")}
+	cp := NewConnPool("", fakeDialer(good, bad), "addr", time.Second, 10*time.Millisecond, ConnPoolLimits{})
+	defer cp.Close()
+	c1, _ := cp.Get(nil)
+	c2, _ := cp.Get(nil)
+	cp.Put(c1)
+	cp.Put(c2)
+	time.Sleep(100 * time.Millisecond)
+
+	if pings, _, closed := good.state(); pings == 0 || closed {
+		t.Errorf("want good conn pinged and kept, got %v pings, closed %v", pings, closed)
+	}
+	if _, _, closed := bad.state(); !closed {
+		t.Errorf("want bad conn closed")
+	}
+	idle, inUse, pingFailures := cp.Stats()
+	if idle != 1 || inUse != 0 || pingFailures != 1 {
+		t.Errorf("want 1 0 1, got %v %v %v", idle, inUse, pingFailures)
+	}
+	// the good conn may be out of the pool for a ping, in which
+	// case Get dials, and the dialer has no conn left
+	var c VTGateConn
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		if c, err = cp.Get(nil); err == nil {
+			break
+		}
+	}
+	if err != nil || c != good {
+		t.Fatalf("want good conn, got %v %v", c, err)
+	}
+	cp.Put(c)
+	// the Gets that found the good conn being pinged failed to dial
+	if want := fmt.Sprintf(`{"Size": 1, "Idle": 1, "InUse": 0, "WaitCount": 0, "WaitTime": 0, "CheckoutFailures": %v, "PingFailures": 1}`, cp.CheckoutFailures()); cp.StatsJSON() != want {
+		t.Errorf("want %v, got %v", want, cp.StatsJSON())
+	}
+}
+
+func TestConnPoolNoPingInUse(t *testing.T) {
+	fc := &fakeConn{}
+	cp := NewConnPool("", fakeDialer(fc), "addr", time.Second, time.Millisecond, ConnPoolLimits{})
+	defer cp.Close()
+	c, _ := cp.Get(nil)
+	for i := 0; i < 5; i++ {
+		c.ExecuteShard(nil, 0, &proto.QueryShard{})
+	}
+	if pings, _, _ := fc.state(); pings != 0 {
+		t.Errorf("want no ping on a conn in use, got %v", pings)
+	}
+	cp.Put(c)
+
+	// Keep getting and using the conn while the keepalive runs.
+	for i := 0; i < 5; i++ {
+		c, err := cp.Get(nil)
+		if err != nil {
+			// the conn is being pinged, it should come back
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		c.ExecuteShard(nil, 0, &proto.QueryShard{})
+		cp.Put(c)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, pingOverlap, _ := fc.state(); pingOverlap {
+		t.Errorf("ping sent while a request was in flight")
+	}
+}
+
+func TestConnPoolPingTimeout(t *testing.T) {
+	fc := &fakeConn{}
+	fc.mu.Lock()
+	cp := NewConnPool("", fakeDialer(fc), "addr", 10*time.Millisecond, 10*time.Millisecond, ConnPoolLimits{})
+	defer cp.Close()
+	c, _ := cp.Get(nil)
+	cp.Put(c)
+	time.Sleep(100 * time.Millisecond)
+	if idle, _, pingFailures := cp.Stats(); idle != 0 || pingFailures != 1 {
+		t.Errorf("want hung conn discarded, got %v idle, %v ping failures", idle, pingFailures)
+	}
+	fc.mu.Unlock()
+}
+
+func TestConnPoolLimits(t *testing.T) {
+	fc1, fc2 := &fakeConn{}, &fakeConn{}
+	cp := NewConnPool("", fakeDialer(fc1, fc2), "addr", time.Second, 0, ConnPoolLimits{MaxConns: 2, MaxInFlight: 2, CheckoutTimeout: 20 * time.Millisecond})
+	defer cp.Close()
+	// both conns are dialed before one is shared
+	var conns []VTGateConn
+	for i := 0; i < 4; i++ {
+		c, err := cp.Get(nil)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		conns = append(conns, c)
+	}
+	if conns[0] != fc1 || conns[1] != fc2 || conns[2] == conns[3] {
+		t.Errorf("want the 2 conns used twice, got %v", conns)
+	}
+	if idle, inUse, _ := cp.Stats(); cp.Size() != 2 || idle != 0 || inUse != 4 {
+		t.Errorf("want 2 conns, 0 idle, 4 in use, got %v %v %v", cp.Size(), idle, inUse)
+	}
+
+	// all the conns are at MaxInFlight
+	start := time.Now()
+	_, err := cp.Get(nil)
+	want := "vtgate: no connection to addr available after 20ms"
+	if err == nil || err.Error() != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if d := time.Now().Sub(start); d < 20*time.Millisecond {
+		t.Errorf("Get failed after %v, want 20ms", d)
+	}
+	if cp.CheckoutFailures() != 1 || cp.WaitCount() != 1 || cp.WaitTime() < 20*time.Millisecond {
+		t.Errorf("want 1 checkout failure and a wait, got %v %v %v", cp.CheckoutFailures(), cp.WaitCount(), cp.WaitTime())
+	}
+
+	// a waiting Get gets the conn that is put back
+	got := make(chan VTGateConn)
+	go func() {
+		c, err := cp.Get(nil)
+		if err != nil {
+			t.Errorf("Get failed: %v", err)
+		}
+		got <- c
+	}()
+	time.Sleep(5 * time.Millisecond)
+	cp.Put(conns[3])
+	if c := <-got; c != conns[3] {
+		t.Errorf("want %v, got %v", conns[3], c)
+	}
+	if cp.WaitCount() != 2 {
+		t.Errorf("want 2 waits, got %v", cp.WaitCount())
+	}
+
+	// a discarded conn makes room for a new one, the other
+	// requests on it are ignored
+	cp.Discard(fc1)
+	cp.Put(fc1)
+	if _, _, closed := fc1.state(); !closed {
+		t.Errorf("want discarded conn closed")
+	}
+	if idle, inUse, _ := cp.Stats(); cp.Size() != 1 || idle != 0 || inUse != 2 {
+		t.Errorf("want 1 conn, 0 idle, 2 in use, got %v %v %v", cp.Size(), idle, inUse)
+	}
+	if _, err := cp.Get(nil); err == nil || err.Error() != "no more conns" {
+		t.Errorf("want a new dial, got %v", err)
+	}
+}
+
+func TestConnPoolMinConns(t *testing.T) {
+	fc1, fc2, fc3 := &fakeConn{}, &fakeConn{}, &fakeConn{}
+	cp := NewConnPool("", fakeDialer(fc1, fc2, fc3), "addr", time.Second, 0, ConnPoolLimits{MinConns: 2})
+	defer cp.Close()
+	waitForSize := func(size int64) {
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if cp.Size() == size {
+				return
+			}
+		}
+		t.Fatalf("want %v conns, got %v", size, cp.Size())
+	}
+	waitForSize(2)
+
+	// a discarded conn is replaced
+	c, err := cp.Get(nil)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	cp.Discard(c)
+	waitForSize(2)
+	if idle, inUse, _ := cp.Stats(); idle != 2 || inUse != 0 {
+		t.Errorf("want 2 idle, got %v %v", idle, inUse)
+	}
+}
+
+func TestConnPoolCloseInFlight(t *testing.T) {
+	fc := &fakeConn{}
+	cp := NewConnPool("", fakeDialer(fc), "addr", time.Second, 0, ConnPoolLimits{MaxConns: 1, MaxInFlight: 2})
+	c1, _ := cp.Get(nil)
+	c2, _ := cp.Get(nil)
+	if c1 != fc || c2 != fc {
+		t.Fatalf("want the shared conn, got %v %v", c1, c2)
+	}
+
+	// a Get waiting for the conn fails when the pool is closed
+	done := make(chan error)
+	go func() {
+		_, err := cp.Get(nil)
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	cp.Close()
+	if err := <-done; err != CLOSED_ERR {
+		t.Errorf("want %v, got %v", CLOSED_ERR, err)
+	}
+
+	// the conn is closed with its last request
+	cp.Put(c1)
+	if _, _, closed := fc.state(); closed {
+		t.Errorf("conn closed with a request in flight")
+	}
+	cp.Put(c2)
+	if _, _, closed := fc.state(); !closed {
+		t.Errorf("want conn closed")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"time"
+
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// PooledConn is a VTGateConn that sends each call on a connection of
+// a ConnPool. Unlike the connections of the pool, it can be used
+// across goroutines: the calls of different goroutines don't wait for
+// each other, within the limits of the pool. A connection that fails
+// with an OperationalError is discarded.
+// Transactions don't need to stay on one connection, the Session
+// carries their state.
+type PooledConn struct {
+	pool *ConnPool
+}
+
+// NewPooledConn returns a PooledConn that uses pool. Closing it closes
+// the pool.
+func NewPooledConn(pool *ConnPool) *PooledConn {
+	return &PooledConn{pool: pool}
+}
+
+// release returns conn to the pool after a call, or discards it if the
+// call failed to talk to vtgate.
+func (pc *PooledConn) release(conn VTGateConn, err error) {
+	if _, ok := err.(OperationalError); ok {
+		pc.pool.Discard(conn)
+		return
+	}
+	pc.pool.Put(conn)
+}
+
+func (pc *PooledConn) ExecuteShard(context interface{}, timeout time.Duration, query *proto.QueryShard) (*proto.QueryResult, error) {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return nil, err
+	}
+	qr, err := conn.ExecuteShard(context, timeout, query)
+	pc.release(conn, err)
+	return qr, err
+}
+
+func (pc *PooledConn) ExecuteBatchShard(context interface{}, timeout time.Duration, batchQuery *proto.BatchQueryShard) (*proto.QueryResultList, error) {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return nil, err
+	}
+	qrl, err := conn.ExecuteBatchShard(context, timeout, batchQuery)
+	pc.release(conn, err)
+	return qrl, err
+}
+
+func (pc *PooledConn) StreamExecuteShard(context interface{}, timeout time.Duration, query *proto.StreamQueryShard) (<-chan *proto.QueryResult, ErrFunc) {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return failedStream(err)
+	}
+	sr, errFunc := conn.StreamExecuteShard(context, timeout, query)
+	return pc.stream(conn, sr, errFunc)
+}
+
+func (pc *PooledConn) StreamExecuteKeyRange(context interface{}, timeout time.Duration, query *proto.StreamQueryKeyRange) (<-chan *proto.QueryResult, ErrFunc) {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return failedStream(err)
+	}
+	sr, errFunc := conn.StreamExecuteKeyRange(context, timeout, query)
+	return pc.stream(conn, sr, errFunc)
+}
+
+// stream forwards the results of a stream, and releases conn when it
+// ends.
+func (pc *PooledConn) stream(conn VTGateConn, sr <-chan *proto.QueryResult, errFunc ErrFunc) (<-chan *proto.QueryResult, ErrFunc) {
+	out := make(chan *proto.QueryResult, 10)
+	var err error
+	go func() {
+		defer close(out)
+		for qr := range sr {
+			out <- qr
+		}
+		err = errFunc()
+		pc.release(conn, err)
+	}()
+	return out, func() error { return err }
+}
+
+// failedStream returns a stream that ends with err.
+func failedStream(err error) (<-chan *proto.QueryResult, ErrFunc) {
+	sr := make(chan *proto.QueryResult)
+	close(sr)
+	return sr, func() error { return err }
+}
+
+func (pc *PooledConn) Begin(context interface{}, timeout time.Duration) (*proto.Session, error) {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.Begin(context, timeout)
+	pc.release(conn, err)
+	return session, err
+}
+
+func (pc *PooledConn) Commit(context interface{}, timeout time.Duration, session *proto.Session) error {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return err
+	}
+	err = conn.Commit(context, timeout, session)
+	pc.release(conn, err)
+	return err
+}
+
+func (pc *PooledConn) Rollback(context interface{}, timeout time.Duration, session *proto.Session) error {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return err
+	}
+	err = conn.Rollback(context, timeout, session)
+	pc.release(conn, err)
+	return err
+}
+
+func (pc *PooledConn) Ping(context interface{}, timeout time.Duration) error {
+	conn, err := pc.pool.Get(context)
+	if err != nil {
+		return err
+	}
+	err = conn.Ping(context, timeout)
+	pc.release(conn, err)
+	return err
+}
+
+func (pc *PooledConn) Close() {
+	pc.pool.Close()
+}
@@ -0,0 +1,143 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgateconn
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+// slowConn is a connection to a slow vtgate, that answers the requests
+// of a connection one at a time. It fails with err.
+type slowConn struct {
+	fakeConn
+	server sync.Mutex
+	delay  time.Duration
+	err    error
+}
+
+func (sc *slowConn) ExecuteShard(context interface{}, timeout time.Duration, query *proto.QueryShard) (*proto.QueryResult, error) {
+	sc.server.Lock()
+	defer sc.server.Unlock()
+	time.Sleep(sc.delay)
+	return &proto.QueryResult{}, sc.err
+}
+
+func (sc *slowConn) StreamExecuteShard(context interface{}, timeout time.Duration, query *proto.StreamQueryShard) (<-chan *proto.QueryResult, ErrFunc) {
+	sr := make(chan *proto.QueryResult, 2)
+	sr <- &proto.QueryResult{}
+	sr <- &proto.QueryResult{}
+	close(sr)
+	return sr, func() error { return sc.err }
+}
+
+// slowDialer dials slowConns, and returns them on the channel.
+func slowDialer(delay time.Duration, err error, dialed chan<- *slowConn) DialerFunc {
+	return func(context interface{}, address string, timeout time.Duration) (VTGateConn, error) {
+		sc := &slowConn{delay: delay, err: err}
+		if dialed != nil {
+			dialed <- sc
+		}
+		return sc, nil
+	}
+}
+
+// timeRequests returns how long it takes to run count concurrent
+// ExecuteShard on pc.
+func timeRequests(t *testing.T, pc *PooledConn, count int) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pc.ExecuteShard(nil, 0, &proto.QueryShard{}); err != nil {
+				t.Errorf("ExecuteShard failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return time.Now().Sub(start)
+}
+
+func TestPooledConnConcurrency(t *testing.T) {
+	const count = 16
+	const delay = 20 * time.Millisecond
+
+	// one connection serializes the requests
+	pc := NewPooledConn(NewConnPool("", slowDialer(delay, nil, nil), "addr", time.Second, 0, ConnPoolLimits{MaxConns: 1}))
+	serial := timeRequests(t, pc, count)
+	if serial < count*delay {
+		t.Errorf("%v requests on one conn took %v, want at least %v", count, serial, count*delay)
+	}
+	if pc.pool.WaitCount() == 0 {
+		t.Errorf("want requests waiting for the conn")
+	}
+	pc.Close()
+
+	// independent requests use different connections
+	pc = NewPooledConn(NewConnPool("", slowDialer(delay, nil, nil), "addr", time.Second, 0, ConnPoolLimits{MaxConns: count}))
+	defer pc.Close()
+	concurrent := timeRequests(t, pc, count)
+	if concurrent > serial/4 {
+		t.Errorf("%v requests on %v conns took %v, want much less than %v", count, count, concurrent, serial)
+	}
+	if idle, inUse, _ := pc.pool.Stats(); pc.pool.Size() != count || idle != count || inUse != 0 {
+		t.Errorf("want %v idle conns, got %v %v %v", count, pc.pool.Size(), idle, inUse)
+	}
+}
+
+func TestPooledConnRelease(t *testing.T) {
+	dialed := make(chan *slowConn, 10)
+	pc := NewPooledConn(NewConnPool("", slowDialer(0, nil, dialed), "addr", time.Second, 0, ConnPoolLimits{}))
+	defer pc.Close()
+
+	// server errors keep the conn
+	if _, err := pc.ExecuteShard(nil, 0, &proto.QueryShard{}); err != nil {
+		t.Fatalf("ExecuteShard failed: %v", err)
+	}
+	sc := <-dialed
+	sc.err = &ServerError{Err: "vtgate: error"}
+	if _, err := pc.ExecuteShard(nil, 0, &proto.QueryShard{}); err != sc.err {
+		t.Errorf("want %v, got %v", sc.err, err)
+	}
+	if pc.pool.Size() != 1 {
+		t.Errorf("want the conn kept, got %v conns", pc.pool.Size())
+	}
+
+	// streams release the conn when they end
+	sr, errFunc := pc.StreamExecuteShard(nil, 0, &proto.StreamQueryShard{})
+	count := 0
+	for _ = range sr {
+		count++
+	}
+	if count != 2 || errFunc() != sc.err {
+		t.Errorf("want 2 results and %v, got %v %v", sc.err, count, errFunc())
+	}
+	if idle, inUse, _ := pc.pool.Stats(); idle != 1 || inUse != 0 {
+		t.Errorf("want the conn back, got %v idle %v in use", idle, inUse)
+	}
+
+	// connection errors discard the conn
+	sc.err = OperationalError("vtgate: connection closed")
+	sr, errFunc = pc.StreamExecuteShard(nil, 0, &proto.StreamQueryShard{})
+	for _ = range sr {
+	}
+	if errFunc() != sc.err {
+		t.Errorf("want %v, got %v", sc.err, errFunc())
+	}
+	if _, _, closed := sc.state(); !closed || pc.pool.Size() != 0 {
+		t.Errorf("want the conn discarded, got closed %v, %v conns", closed, pc.pool.Size())
+	}
+	if _, err := pc.ExecuteShard(nil, 0, &proto.QueryShard{}); err != nil {
+		t.Errorf("ExecuteShard failed: %v", err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("want a new conn, got %v", len(dialed))
+	}
+}
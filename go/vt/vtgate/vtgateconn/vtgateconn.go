@@ -0,0 +1,101 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vtgateconn contains the go client side of vtgate.
+package vtgateconn
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/vtgate/proto"
+)
+
+var (
+	vtgateProtocol = flag.String("vtgate_protocol", "gorpc", "how to talk to vtgate")
+)
+
+// ServerError represents an error that was returned from
+// a vtgate server. Code is the tablet error code of the
+// error (tabletconn.ERR_*).
+type ServerError struct {
+	Code int
+	Err  string
+}
+
+func (e *ServerError) Error() string { return e.Err }
+
+// OperationalError represents an error due to a failure to
+// communicate with vtgate.
+type OperationalError string
+
+func (e OperationalError) Error() string { return string(e) }
+
+// In all the following calls, context is an opaque structure that may
+// carry data related to the call, see tabletconn.TabletConn.
+
+// DialerFunc represents a function that will return a VTGateConn object that can communicate with a vtgate.
+type DialerFunc func(context interface{}, address string, timeout time.Duration) (VTGateConn, error)
+
+// VTGateConn defines the interface for a vtgate client. It should
+// not be concurrently used across goroutines, unless the
+// implementation supports it, see ConnPoolLimits.MaxInFlight. A
+// PooledConn can be.
+// The calls that return a QueryResult or a QueryResultList return a
+// *ServerError if the server reported an error. The result is still
+// returned along with the error, so the caller can read the updated
+// Session from it.
+// timeout is the maximum time a call waits for vtgate, 0 meaning
+// no limit. For streaming calls, it is the maximum wait for each
+// packet, not for the whole stream. A call that times out returns
+// an OperationalError and closes the connection, as it may be wedged.
+// The query requests also carry timeout as their DeadlineMs, unless
+// they have a shorter one, so vtgate gives up on them too: that one
+// bounds the whole stream of the streaming calls.
+type VTGateConn interface {
+	// ExecuteShard executes a non-streaming query on the specified shards.
+	ExecuteShard(context interface{}, timeout time.Duration, query *proto.QueryShard) (*proto.QueryResult, error)
+
+	// ExecuteBatchShard executes a group of queries on the specified shards.
+	ExecuteBatchShard(context interface{}, timeout time.Duration, batchQuery *proto.BatchQueryShard) (*proto.QueryResultList, error)
+
+	// StreamExecuteShard executes a streaming query on the specified shards.
+	// It returns a channel that will stream results, and an ErrFunc
+	// that should be called after the channel is closed.
+	StreamExecuteShard(context interface{}, timeout time.Duration, query *proto.StreamQueryShard) (<-chan *proto.QueryResult, ErrFunc)
+
+	// StreamExecuteKeyRange executes a streaming query on the specified
+	// KeyRange. The results are returned like StreamExecuteShard.
+	StreamExecuteKeyRange(context interface{}, timeout time.Duration, query *proto.StreamQueryKeyRange) (<-chan *proto.QueryResult, ErrFunc)
+
+	// Transaction support
+	Begin(context interface{}, timeout time.Duration) (*proto.Session, error)
+	Commit(context interface{}, timeout time.Duration, session *proto.Session) error
+	Rollback(context interface{}, timeout time.Duration, session *proto.Session) error
+
+	// Ping checks the connection is still usable.
+	Ping(context interface{}, timeout time.Duration) error
+
+	// Close must be called for releasing resources.
+	Close()
+}
+
+type ErrFunc func() error
+
+var dialers = make(map[string]DialerFunc)
+
+// RegisterDialer is meant to be used by DialerFunc implementations
+// to self register.
+func RegisterDialer(name string, dialer DialerFunc) {
+	if _, ok := dialers[name]; ok {
+		log.Fatalf("Dialer %s already exists", name)
+	}
+	dialers[name] = dialer
+}
+
+// GetDialer returns the dialer to use, described by the command line flag
+func GetDialer() DialerFunc {
+	return dialers[*vtgateProtocol]
+}
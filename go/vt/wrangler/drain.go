@@ -0,0 +1,148 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// queryStatsVars are the query stats of the /debug/vars of a tablet.
+type queryStatsVars struct {
+	Queries struct {
+		TotalCount int64
+	}
+}
+
+// drainingTablet is a tablet WaitForDrain waits for.
+type drainingTablet struct {
+	alias topo.TabletAlias
+
+	// count is the number of queries the tablet served, as of
+	// lastPoll, -1 until it is read. lastChange is when it last
+	// changed, or when it was first read.
+	count      int64
+	lastPoll   time.Time
+	lastChange time.Time
+
+	// qps is the query rate between the last two polls, err the
+	// error of the last poll.
+	qps float64
+	err error
+}
+
+func (dt *drainingTablet) String() string {
+	if dt.err != nil {
+		return fmt.Sprintf("%v: %v", dt.alias, dt.err)
+	}
+	return fmt.Sprintf("%v: %.2f qps, last query at most %v ago", dt.alias, dt.qps, dt.lastPoll.Sub(dt.lastChange))
+}
+
+// WaitForDrain waits until the tablets of servedType of a shard in
+// cells (all of them if empty) serve no query anymore: their query
+// count, read from their /debug/vars every retryDelay, has to stay the
+// same for dwellTime. It is meant to be used after removing a served
+// type from a shard, as the clients with a cached serving graph keep
+// sending queries for a while. The tablets that disappear, or change
+// type, are not waited for anymore. After timeout, it returns an error
+// with the current rate of each tablet still serving.
+func (wr *Wrangler) WaitForDrain(keyspace, shard string, servedType topo.TabletType, cells []string, timeout, retryDelay, dwellTime time.Duration) (err error) {
+	defer recordAction("WaitForDrain", keyspace, time.Now(), &err)
+
+	deadline := time.Now().Add(timeout)
+	tablets := make(map[topo.TabletAlias]*drainingTablet)
+	for {
+		tabletMap, err := GetTabletMapForShardByCell(wr.ts, keyspace, shard, cells)
+		switch err {
+		case nil:
+		case topo.ErrPartialResult:
+			log.Warningf("WaitForDrain(%v/%v): cannot read all the tablets, the missing ones are still waited for", keyspace, shard)
+		default:
+			return err
+		}
+
+		for alias, dt := range tablets {
+			ti, ok := tabletMap[alias]
+			switch {
+			case ok && ti.Type != servedType:
+				log.Infof("Tablet %v is now %v, not waiting for it anymore", alias, ti.Type)
+				delete(tablets, alias)
+			case !ok && err == nil:
+				log.Infof("Tablet %v disappeared, not waiting for it anymore", alias)
+				delete(tablets, alias)
+			case !ok:
+				dt.err = fmt.Errorf("cannot read the tablet record")
+			}
+		}
+
+		now := time.Now()
+		for alias, ti := range tabletMap {
+			if ti.Type != servedType {
+				continue
+			}
+			dt, ok := tablets[alias]
+			if !ok {
+				dt = &drainingTablet{alias: alias, count: -1}
+				tablets[alias] = dt
+			}
+			vars := queryStatsVars{}
+			if dt.err = getDebugVars(ti, &vars); dt.err != nil {
+				continue
+			}
+			count := vars.Queries.TotalCount
+			switch {
+			case dt.count < 0:
+				dt.qps = 0
+				dt.lastChange = now
+			case count != dt.count:
+				dt.qps = float64(count-dt.count) / now.Sub(dt.lastPoll).Seconds()
+				dt.lastChange = now
+			default:
+				dt.qps = 0
+			}
+			dt.count = count
+			dt.lastPoll = now
+		}
+
+		var serving []*drainingTablet
+		for _, dt := range tablets {
+			if dt.err != nil || dt.count < 0 || now.Sub(dt.lastChange) < dwellTime {
+				serving = append(serving, dt)
+			}
+		}
+		if len(serving) == 0 {
+			wr.logger.Infof("The %v tablets of %v/%v are drained", servedType, keyspace, shard)
+			return nil
+		}
+		if !now.Before(deadline) {
+			sort.Sort(drainingTabletsByAlias(serving))
+			lines := make([]string, len(serving))
+			for i, dt := range serving {
+				lines[i] = dt.String()
+			}
+			return fmt.Errorf("timed out waiting for %v %v tablet(s) of %v/%v to drain:\n%v", len(serving), servedType, keyspace, shard, strings.Join(lines, "\n"))
+		}
+
+		delay := retryDelay
+		if remaining := deadline.Sub(now); remaining < delay {
+			delay = remaining
+		}
+		time.Sleep(delay)
+	}
+}
+
+// drainingTabletsByAlias sorts drainingTablets by cell and uid.
+type drainingTabletsByAlias []*drainingTablet
+
+func (s drainingTabletsByAlias) Len() int      { return len(s) }
+func (s drainingTabletsByAlias) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s drainingTabletsByAlias) Less(i, j int) bool {
+	return topo.TabletAliasList{s[i].alias, s[j].alias}.Less(0, 1)
+}
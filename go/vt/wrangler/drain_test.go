@@ -0,0 +1,121 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// queryCountServer serves the /debug/vars of a tablet. The query count
+// goes up on each read while it is busy.
+type queryCountServer struct {
+	mu    sync.Mutex
+	count int64
+	busy  bool
+}
+
+func (qcs *queryCountServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	qcs.mu.Lock()
+	defer qcs.mu.Unlock()
+	if qcs.busy {
+		qcs.count += 10
+	}
+	fmt.Fprintf(w, `{"Queries": {"TotalCount": %v, "TotalTime": 0}}`, qcs.count)
+}
+
+func (qcs *queryCountServer) setBusy(busy bool) {
+	qcs.mu.Lock()
+	defer qcs.mu.Unlock()
+	qcs.busy = busy
+}
+
+func TestWaitForDrain(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	// two rdonly tablets in cell1, a busy replica in cell1 and a busy
+	// rdonly tablet in cell2 that are not waited for
+	busy := topo.TabletAlias{Cell: "cell1", Uid: 2}
+	idle := topo.TabletAlias{Cell: "cell1", Uid: 3}
+	servers := make(map[topo.TabletAlias]*queryCountServer)
+	for _, tablet := range []*topo.Tablet{
+		{Alias: busy, Type: topo.TYPE_RDONLY},
+		{Alias: idle, Type: topo.TYPE_RDONLY},
+		{Alias: topo.TabletAlias{Cell: "cell1", Uid: 4}, Type: topo.TYPE_REPLICA},
+		{Alias: topo.TabletAlias{Cell: "cell2", Uid: 5}, Type: topo.TYPE_RDONLY},
+	} {
+		qcs := &queryCountServer{busy: tablet.Alias != idle}
+		servers[tablet.Alias] = qcs
+		server := httptest.NewServer(qcs)
+		defer server.Close()
+		host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("SplitHostPort failed: %v", err)
+		}
+		tablet.Hostname = host
+		tablet.Portmap = map[string]int{"vt": 0}
+		if tablet.Portmap["vt"], err = strconv.Atoi(port); err != nil {
+			t.Fatalf("Atoi failed: %v", err)
+		}
+		tablet.Keyspace = "test_keyspace"
+		tablet.Shard = "0"
+		tablet.Parent = master
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+
+	// the busy tablet times out, with its rate
+	err = wr.WaitForDrain("test_keyspace", "0", topo.TYPE_RDONLY, []string{"cell1"}, 100*time.Millisecond, 10*time.Millisecond, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "1 rdonly tablet(s)") || !strings.Contains(err.Error(), "cell1-0000000002: ") || !strings.Contains(err.Error(), " qps") {
+		t.Errorf("want a timeout on %v, got %v", busy, err)
+	}
+
+	// it drains once idle
+	servers[busy].setBusy(false)
+	if err := wr.WaitForDrain("test_keyspace", "0", topo.TYPE_RDONLY, []string{"cell1"}, 5*time.Second, 10*time.Millisecond, 50*time.Millisecond); err != nil {
+		t.Errorf("WaitForDrain failed: %v", err)
+	}
+
+	// a tablet that disappears isn't waited for anymore
+	servers[busy].setBusy(true)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := ts.DeleteTablet(busy); err != nil {
+			t.Errorf("DeleteTablet failed: %v", err)
+		}
+	}()
+	if err := wr.WaitForDrain("test_keyspace", "0", topo.TYPE_RDONLY, []string{"cell1"}, 5*time.Second, 10*time.Millisecond, 20*time.Millisecond); err != nil {
+		t.Errorf("WaitForDrain failed: %v", err)
+	}
+}
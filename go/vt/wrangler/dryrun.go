@@ -0,0 +1,604 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/tabletmanager/initiator"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// DryRunAction is a change to the topology a dry run would have made.
+type DryRunAction struct {
+	// Action is the topo.Server method, e.g. "DeleteShard".
+	Action string
+
+	// Object is what it changes, e.g. "shard test_keyspace/0".
+	Object string
+}
+
+func (dra DryRunAction) String() string {
+	return dra.Action + " " + dra.Object
+}
+
+// DryRunPlan is what a wrangler returned by DryRun would have done:
+// the changes to the topology, in order, and the assumptions they rely
+// on. Everything a real run reads from the topology can change before
+// it happens, so the plan is only valid for the topology as it was.
+type DryRunPlan struct {
+	mu      sync.Mutex
+	Actions []DryRunAction
+	Notes   []string
+}
+
+func (plan *DryRunPlan) record(action, object string) {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	plan.Actions = append(plan.Actions, DryRunAction{Action: action, Object: object})
+}
+
+func (plan *DryRunPlan) note(note string) {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	plan.Notes = append(plan.Notes, note)
+}
+
+func (plan *DryRunPlan) String() string {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	lines := make([]string, 0, len(plan.Actions)+len(plan.Notes)+2)
+	if len(plan.Actions) == 0 {
+		lines = append(lines, "no change to the topology")
+	}
+	for i, action := range plan.Actions {
+		lines = append(lines, fmt.Sprintf("%v. %v", i+1, action))
+	}
+	if len(plan.Notes) > 0 {
+		lines = append(lines, "assuming:")
+		for _, note := range plan.Notes {
+			lines = append(lines, "- "+note)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DryRun returns a copy of the wrangler that records the changes it
+// would make to the topology in a DryRunPlan instead of making them.
+// Its reads see the changes it recorded, so later steps of an
+// operation plan from the topology as the earlier ones left it. The
+// locks are not taken, and the tablet actions fail. It is meant for the
+// destructive operations that only change the topology, e.g.
+// DeleteShard, RemoveShardCell or DeleteKeyspace: the RPCs to the
+// tablets are not intercepted.
+func (wr *Wrangler) DryRun() (*Wrangler, *DryRunPlan) {
+	plan := &DryRunPlan{}
+	dry := *wr
+	dry.ts = newDryRunServer(wr.ts, plan)
+	dry.ai = initiator.NewActionInitiator(dry.ts, *tabletManagerProtocol)
+	dry.plan = plan
+	return &dry, plan
+}
+
+// dryRunNote adds an assumption to the plan of a dry run, and does
+// nothing otherwise.
+func (wr *Wrangler) dryRunNote(format string, args ...interface{}) {
+	if wr.plan != nil {
+		wr.plan.note(fmt.Sprintf(format, args...))
+	}
+}
+
+// errDryRun is returned by the actions a dry run cannot plan.
+var errDryRun = fmt.Errorf("not supported in a dry run")
+
+// dryRunServer is the topo.Server of a dry run: it records the changes
+// in its plan, keeps the updated shards, tablets and replication graphs
+// in memory, and the objects it deletes, to serve them to the later
+// reads. The other reads go to the real server.
+type dryRunServer struct {
+	topo.Server
+	plan *DryRunPlan
+
+	mu sync.Mutex
+	// deleted has the deleted objects, as recorded in the plan
+	deleted      map[string]bool
+	shards       map[string]*topo.Shard
+	tablets      map[topo.TabletAlias]*topo.Tablet
+	replications map[string]*topo.ShardReplication
+}
+
+func newDryRunServer(ts topo.Server, plan *DryRunPlan) *dryRunServer {
+	return &dryRunServer{
+		Server:       ts,
+		plan:         plan,
+		deleted:      make(map[string]bool),
+		shards:       make(map[string]*topo.Shard),
+		tablets:      make(map[topo.TabletAlias]*topo.Tablet),
+		replications: make(map[string]*topo.ShardReplication),
+	}
+}
+
+// copyValue deep copies from into to, which is a pointer to the same
+// type.
+func copyValue(from, to interface{}) {
+	data, err := json.Marshal(from)
+	if err != nil {
+		panic(fmt.Errorf("cannot copy %#v: %v", from, err))
+	}
+	if err := json.Unmarshal(data, to); err != nil {
+		panic(fmt.Errorf("cannot copy %#v: %v", from, err))
+	}
+}
+
+func (s *dryRunServer) isDeleted(object string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleted[object]
+}
+
+// recordDelete records the deletion of object, if exists finds it.
+func (s *dryRunServer) recordDelete(action, object string, exists func() error) error {
+	if err := exists(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.deleted[object] = true
+	s.mu.Unlock()
+	s.plan.record(action, object)
+	return nil
+}
+
+func keyspaceObject(keyspace string) string {
+	return "keyspace " + keyspace
+}
+
+func shardObject(keyspace, shard string) string {
+	return "shard " + keyspace + "/" + shard
+}
+
+func tabletObject(alias topo.TabletAlias) string {
+	return "tablet " + alias.String()
+}
+
+func shardReplicationObject(cell, keyspace, shard string) string {
+	return fmt.Sprintf("ShardReplication %v/%v in cell %v", keyspace, shard, cell)
+}
+
+func endPointsObject(cell, keyspace, shard string, tabletType topo.TabletType) string {
+	return fmt.Sprintf("EndPoints %v/%v/%v in cell %v", keyspace, shard, tabletType, cell)
+}
+
+func srvShardObject(cell, keyspace, shard string) string {
+	return fmt.Sprintf("SrvShard %v/%v in cell %v", keyspace, shard, cell)
+}
+
+func srvKeyspaceObject(cell, keyspace string) string {
+	return fmt.Sprintf("SrvKeyspace %v in cell %v", keyspace, cell)
+}
+
+//
+// Keyspaces
+//
+
+func (s *dryRunServer) CreateKeyspace(keyspace string, value *topo.Keyspace) error {
+	s.plan.record("CreateKeyspace", keyspaceObject(keyspace))
+	return nil
+}
+
+func (s *dryRunServer) UpdateKeyspace(ki *topo.KeyspaceInfo) error {
+	s.plan.record("UpdateKeyspace", keyspaceObject(ki.KeyspaceName()))
+	return nil
+}
+
+func (s *dryRunServer) GetKeyspace(keyspace string) (*topo.KeyspaceInfo, error) {
+	if s.isDeleted(keyspaceObject(keyspace)) {
+		return nil, topo.ErrNoNode
+	}
+	return s.Server.GetKeyspace(keyspace)
+}
+
+func (s *dryRunServer) GetKeyspaces() ([]string, error) {
+	keyspaces, err := s.Server.GetKeyspaces()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		if !s.isDeleted(keyspaceObject(keyspace)) {
+			result = append(result, keyspace)
+		}
+	}
+	return result, nil
+}
+
+func (s *dryRunServer) DeleteKeyspaceShards(keyspace string) error {
+	shards, err := s.GetShardNames(keyspace)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, shard := range shards {
+		s.deleted[shardObject(keyspace, shard)] = true
+	}
+	s.mu.Unlock()
+	s.plan.record("DeleteKeyspaceShards", keyspaceObject(keyspace))
+	return nil
+}
+
+func (s *dryRunServer) DeleteKeyspace(keyspace string) error {
+	return s.recordDelete("DeleteKeyspace", keyspaceObject(keyspace), func() error {
+		_, err := s.GetKeyspace(keyspace)
+		return err
+	})
+}
+
+//
+// Shards
+//
+
+func (s *dryRunServer) CreateShard(keyspace, shard string, value *topo.Shard) error {
+	s.plan.record("CreateShard", shardObject(keyspace, shard))
+	return nil
+}
+
+func (s *dryRunServer) UpdateShard(si *topo.ShardInfo) error {
+	object := shardObject(si.Keyspace(), si.ShardName())
+	value := &topo.Shard{}
+	copyValue(si.Shard, value)
+	s.mu.Lock()
+	s.shards[object] = value
+	delete(s.deleted, object)
+	s.mu.Unlock()
+	s.plan.record("UpdateShard", object)
+	return nil
+}
+
+func (s *dryRunServer) getShard(keyspace, shard string, get func(keyspace, shard string) (*topo.ShardInfo, error)) (*topo.ShardInfo, error) {
+	object := shardObject(keyspace, shard)
+	s.mu.Lock()
+	deleted, value := s.deleted[object], s.shards[object]
+	s.mu.Unlock()
+	switch {
+	case deleted:
+		return nil, topo.ErrNoNode
+	case value != nil:
+		copied := &topo.Shard{}
+		copyValue(value, copied)
+		return topo.NewShardInfo(keyspace, shard, copied), nil
+	}
+	return get(keyspace, shard)
+}
+
+func (s *dryRunServer) GetShard(keyspace, shard string) (*topo.ShardInfo, error) {
+	return s.getShard(keyspace, shard, s.Server.GetShard)
+}
+
+func (s *dryRunServer) GetShardCritical(keyspace, shard string) (*topo.ShardInfo, error) {
+	return s.getShard(keyspace, shard, s.Server.GetShardCritical)
+}
+
+func (s *dryRunServer) GetShardNames(keyspace string) ([]string, error) {
+	shards, err := s.Server.GetShardNames(keyspace)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		if !s.isDeleted(shardObject(keyspace, shard)) {
+			result = append(result, shard)
+		}
+	}
+	return result, nil
+}
+
+func (s *dryRunServer) DeleteShard(keyspace, shard string) error {
+	return s.recordDelete("DeleteShard", shardObject(keyspace, shard), func() error {
+		_, err := s.GetShard(keyspace, shard)
+		return err
+	})
+}
+
+//
+// Tablets
+//
+
+func (s *dryRunServer) CreateTablet(tablet *topo.Tablet) error {
+	s.plan.record("CreateTablet", tabletObject(tablet.Alias))
+	return nil
+}
+
+func (s *dryRunServer) storeTablet(action string, tablet *topo.Tablet) {
+	value := &topo.Tablet{}
+	copyValue(tablet, value)
+	object := tabletObject(tablet.Alias)
+	s.mu.Lock()
+	s.tablets[tablet.Alias] = value
+	delete(s.deleted, object)
+	s.mu.Unlock()
+	s.plan.record(action, object)
+}
+
+func (s *dryRunServer) UpdateTablet(tablet *topo.TabletInfo, existingVersion int64) (int64, error) {
+	s.storeTablet("UpdateTablet", tablet.Tablet)
+	return existingVersion + 1, nil
+}
+
+func (s *dryRunServer) UpdateTabletFields(tabletAlias topo.TabletAlias, update func(*topo.Tablet) error) error {
+	ti, err := s.GetTablet(tabletAlias)
+	if err != nil {
+		return err
+	}
+	if err := update(ti.Tablet); err != nil {
+		return err
+	}
+	s.storeTablet("UpdateTabletFields", ti.Tablet)
+	return nil
+}
+
+func (s *dryRunServer) GetTablet(alias topo.TabletAlias) (*topo.TabletInfo, error) {
+	s.mu.Lock()
+	deleted, value := s.deleted[tabletObject(alias)], s.tablets[alias]
+	s.mu.Unlock()
+	switch {
+	case deleted:
+		return nil, topo.ErrNoNode
+	case value != nil:
+		copied := &topo.Tablet{}
+		copyValue(value, copied)
+		return topo.NewTabletInfo(copied, 0), nil
+	}
+	return s.Server.GetTablet(alias)
+}
+
+func (s *dryRunServer) GetTabletsByCell(cell string) ([]topo.TabletAlias, error) {
+	aliases, err := s.Server.GetTabletsByCell(cell)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]topo.TabletAlias, 0, len(aliases))
+	for _, alias := range aliases {
+		if !s.isDeleted(tabletObject(alias)) {
+			result = append(result, alias)
+		}
+	}
+	return result, nil
+}
+
+func (s *dryRunServer) DeleteTablet(alias topo.TabletAlias) error {
+	return s.recordDelete("DeleteTablet", tabletObject(alias), func() error {
+		_, err := s.GetTablet(alias)
+		return err
+	})
+}
+
+//
+// Replication graph
+//
+
+func (s *dryRunServer) CreateShardReplication(cell, keyspace, shard string, sr *topo.ShardReplication) error {
+	s.plan.record("CreateShardReplication", shardReplicationObject(cell, keyspace, shard))
+	return nil
+}
+
+func (s *dryRunServer) UpdateShardReplicationFields(cell, keyspace, shard string, update func(*topo.ShardReplication) error) error {
+	sr := &topo.ShardReplication{}
+	sri, err := s.GetShardReplication(cell, keyspace, shard)
+	switch err {
+	case nil:
+		sr = sri.ShardReplication
+	case topo.ErrNoNode:
+	default:
+		return err
+	}
+	if err := update(sr); err != nil {
+		return err
+	}
+	value := &topo.ShardReplication{}
+	copyValue(sr, value)
+	object := shardReplicationObject(cell, keyspace, shard)
+	s.mu.Lock()
+	s.replications[object] = value
+	delete(s.deleted, object)
+	s.mu.Unlock()
+	s.plan.record("UpdateShardReplicationFields", object)
+	return nil
+}
+
+func (s *dryRunServer) GetShardReplication(cell, keyspace, shard string) (*topo.ShardReplicationInfo, error) {
+	object := shardReplicationObject(cell, keyspace, shard)
+	s.mu.Lock()
+	deleted, value := s.deleted[object], s.replications[object]
+	s.mu.Unlock()
+	switch {
+	case deleted:
+		return nil, topo.ErrNoNode
+	case value != nil:
+		copied := &topo.ShardReplication{}
+		copyValue(value, copied)
+		return topo.NewShardReplicationInfo(copied, cell, keyspace, shard), nil
+	}
+	return s.Server.GetShardReplication(cell, keyspace, shard)
+}
+
+func (s *dryRunServer) DeleteShardReplication(cell, keyspace, shard string) error {
+	return s.recordDelete("DeleteShardReplication", shardReplicationObject(cell, keyspace, shard), func() error {
+		_, err := s.GetShardReplication(cell, keyspace, shard)
+		return err
+	})
+}
+
+//
+// Serving graph
+//
+
+func (s *dryRunServer) GetSrvTabletTypesPerShard(cell, keyspace, shard string) ([]topo.TabletType, error) {
+	tabletTypes, err := s.Server.GetSrvTabletTypesPerShard(cell, keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]topo.TabletType, 0, len(tabletTypes))
+	for _, tabletType := range tabletTypes {
+		if !s.isDeleted(endPointsObject(cell, keyspace, shard, tabletType)) {
+			result = append(result, tabletType)
+		}
+	}
+	return result, nil
+}
+
+func (s *dryRunServer) UpdateEndPoints(cell, keyspace, shard string, tabletType topo.TabletType, addrs *topo.EndPoints) error {
+	s.plan.record("UpdateEndPoints", endPointsObject(cell, keyspace, shard, tabletType))
+	return nil
+}
+
+func (s *dryRunServer) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	if s.isDeleted(endPointsObject(cell, keyspace, shard, tabletType)) {
+		return nil, topo.ErrNoNode
+	}
+	return s.Server.GetEndPoints(cell, keyspace, shard, tabletType)
+}
+
+func (s *dryRunServer) DeleteSrvTabletType(cell, keyspace, shard string, tabletType topo.TabletType) error {
+	return s.recordDelete("DeleteSrvTabletType", endPointsObject(cell, keyspace, shard, tabletType), func() error {
+		_, err := s.GetEndPoints(cell, keyspace, shard, tabletType)
+		return err
+	})
+}
+
+func (s *dryRunServer) UpdateSrvShard(cell, keyspace, shard string, srvShard *topo.SrvShard) error {
+	s.plan.record("UpdateSrvShard", srvShardObject(cell, keyspace, shard))
+	return nil
+}
+
+func (s *dryRunServer) GetSrvShard(cell, keyspace, shard string) (*topo.SrvShard, error) {
+	if s.isDeleted(srvShardObject(cell, keyspace, shard)) {
+		return nil, topo.ErrNoNode
+	}
+	return s.Server.GetSrvShard(cell, keyspace, shard)
+}
+
+func (s *dryRunServer) DeleteSrvShard(cell, keyspace, shard string) error {
+	return s.recordDelete("DeleteSrvShard", srvShardObject(cell, keyspace, shard), func() error {
+		_, err := s.GetSrvShard(cell, keyspace, shard)
+		return err
+	})
+}
+
+func (s *dryRunServer) UpdateSrvKeyspace(cell, keyspace string, srvKeyspace *topo.SrvKeyspace) error {
+	s.plan.record("UpdateSrvKeyspace", srvKeyspaceObject(cell, keyspace))
+	return nil
+}
+
+func (s *dryRunServer) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	if s.isDeleted(srvKeyspaceObject(cell, keyspace)) {
+		return nil, topo.ErrNoNode
+	}
+	return s.Server.GetSrvKeyspace(cell, keyspace)
+}
+
+func (s *dryRunServer) DeleteSrvKeyspace(cell, keyspace string) error {
+	return s.recordDelete("DeleteSrvKeyspace", srvKeyspaceObject(cell, keyspace), func() error {
+		_, err := s.GetSrvKeyspace(cell, keyspace)
+		return err
+	})
+}
+
+func (s *dryRunServer) GetSrvKeyspaceNames(cell string) ([]string, error) {
+	keyspaces, err := s.Server.GetSrvKeyspaceNames(cell)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(keyspaces))
+	for _, keyspace := range keyspaces {
+		if !s.isDeleted(srvKeyspaceObject(cell, keyspace)) {
+			result = append(result, keyspace)
+		}
+	}
+	return result, nil
+}
+
+func (s *dryRunServer) UpdateTabletEndpoint(cell, keyspace, shard string, tabletType topo.TabletType, addr *topo.EndPoint) error {
+	s.plan.record("UpdateTabletEndpoint", endPointsObject(cell, keyspace, shard, tabletType))
+	return nil
+}
+
+//
+// Locks and action logs: a dry run doesn't lock anything, nor log its
+// actions.
+//
+
+const dryRunLockPath = "dry-run"
+
+func (s *dryRunServer) LockKeyspaceForAction(keyspace, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
+	return dryRunLockPath, nil
+}
+
+func (s *dryRunServer) UnlockKeyspaceForAction(keyspace, lockPath, results string) error {
+	return nil
+}
+
+func (s *dryRunServer) LockShardForAction(keyspace, shard, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
+	return dryRunLockPath, nil
+}
+
+func (s *dryRunServer) UpdateShardActionLock(keyspace, shard, lockPath, contents string) error {
+	return nil
+}
+
+func (s *dryRunServer) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
+	return nil
+}
+
+func (s *dryRunServer) ForceUnlockShard(keyspace, shard, contents string) error {
+	s.plan.record("ForceUnlockShard", shardObject(keyspace, shard))
+	return nil
+}
+
+func (s *dryRunServer) AppendKeyspaceActionLog(keyspace, contents string, maxEntries int) error {
+	return nil
+}
+
+func (s *dryRunServer) AppendShardActionLog(keyspace, shard, contents string, maxEntries int) error {
+	return nil
+}
+
+//
+// Tablet actions: a dry run cannot have a tablet run anything.
+//
+
+func (s *dryRunServer) WriteTabletAction(tabletAlias topo.TabletAlias, contents string) (string, error) {
+	return "", errDryRun
+}
+
+func (s *dryRunServer) WaitForTabletAction(actionPath string, waitTime time.Duration, interrupted chan struct{}) (string, error) {
+	return "", errDryRun
+}
+
+func (s *dryRunServer) PurgeTabletActions(tabletAlias topo.TabletAlias, canBePurged func(data string) bool) error {
+	s.plan.record("PurgeTabletActions", tabletObject(tabletAlias))
+	return nil
+}
+
+func (s *dryRunServer) CreateTabletPidNode(tabletAlias topo.TabletAlias, contents string, done chan struct{}) error {
+	return errDryRun
+}
+
+func (s *dryRunServer) ActionEventLoop(tabletAlias topo.TabletAlias, dispatchAction func(actionPath, data string) error, done chan struct{}) {
+}
+
+func (s *dryRunServer) UpdateTabletAction(actionPath, data string, version int64) error {
+	return errDryRun
+}
+
+func (s *dryRunServer) StoreTabletActionResponse(actionPath, data string) error {
+	return errDryRun
+}
+
+func (s *dryRunServer) UnblockTabletAction(actionPath string) error {
+	return errDryRun
+}
@@ -0,0 +1,207 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// topoSnapshot returns everything a keyspace has in the topology, to
+// check it didn't change.
+func topoSnapshot(t *testing.T, ts topo.Server, keyspace string, cells []string) string {
+	var lines []string
+	add := func(name string, value interface{}, err error) {
+		data, jsonErr := json.Marshal(value)
+		if jsonErr != nil {
+			t.Fatalf("cannot marshal %v: %v", name, jsonErr)
+		}
+		lines = append(lines, fmt.Sprintf("%v: %s %v", name, data, err))
+	}
+	ki, err := ts.GetKeyspace(keyspace)
+	add("keyspace", ki, err)
+	shards, err := ts.GetShardNames(keyspace)
+	add("shards", shards, err)
+	for _, shard := range shards {
+		si, err := ts.GetShard(keyspace, shard)
+		add("shard "+shard, si, err)
+		for _, cell := range cells {
+			sri, err := ts.GetShardReplication(cell, keyspace, shard)
+			add("ShardReplication "+shard+" "+cell, sri, err)
+			srvShard, err := ts.GetSrvShard(cell, keyspace, shard)
+			add("SrvShard "+shard+" "+cell, srvShard, err)
+			tabletTypes, err := ts.GetSrvTabletTypesPerShard(cell, keyspace, shard)
+			add("tablet types "+shard+" "+cell, tabletTypes, err)
+			for _, tabletType := range tabletTypes {
+				endPoints, err := ts.GetEndPoints(cell, keyspace, shard, tabletType)
+				add("EndPoints "+shard+" "+cell+" "+string(tabletType), endPoints, err)
+			}
+		}
+	}
+	for _, cell := range cells {
+		srvKeyspace, err := ts.GetSrvKeyspace(cell, keyspace)
+		add("SrvKeyspace "+cell, srvKeyspace, err)
+		aliases, err := ts.GetTabletsByCell(cell)
+		add("tablets "+cell, aliases, err)
+		for _, alias := range aliases {
+			ti, err := ts.GetTablet(alias)
+			add("tablet "+alias.String(), ti, err)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestDryRun(t *testing.T) {
+	cells := []string{"cell1", "cell2"}
+	ts := zktopo.NewTestServer(t, cells)
+	wr := New(ts, time.Minute, time.Second)
+
+	// shard -80 has a master in cell1 and a replica in cell2, shard
+	// 80- only a master in cell1, both are served in both cells
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for i, shard := range []string{"-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		master := topo.TabletAlias{Cell: "cell1", Uid: uint32(10*i + 1)}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = cells
+		si.MasterAlias = master
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+		tablets := []*topo.Tablet{{Alias: master, Type: topo.TYPE_MASTER}}
+		if shard == "-80" {
+			tablets = append(tablets, &topo.Tablet{Alias: topo.TabletAlias{Cell: "cell2", Uid: 2}, Type: topo.TYPE_REPLICA, Parent: master})
+		}
+		for _, tablet := range tablets {
+			tablet.Keyspace = "test_keyspace"
+			tablet.Shard = shard
+			if err := topo.CreateTablet(ts, tablet); err != nil {
+				t.Fatalf("CreateTablet failed: %v", err)
+			}
+		}
+		for _, cell := range cells {
+			if err := ts.CreateShardReplication(cell, "test_keyspace", shard, &topo.ShardReplication{}); err != nil && err != topo.ErrNodeExists {
+				t.Fatalf("CreateShardReplication failed: %v", err)
+			}
+			if err := ts.UpdateEndPoints(cell, "test_keyspace", shard, topo.TYPE_MASTER, &topo.EndPoints{}); err != nil {
+				t.Fatalf("UpdateEndPoints failed: %v", err)
+			}
+			if err := ts.UpdateSrvShard(cell, "test_keyspace", shard, &topo.SrvShard{}); err != nil {
+				t.Fatalf("UpdateSrvShard failed: %v", err)
+			}
+		}
+	}
+	for _, cell := range cells {
+		if err := ts.UpdateSrvKeyspace(cell, "test_keyspace", &topo.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace failed: %v", err)
+		}
+	}
+	before := topoSnapshot(t, ts, "test_keyspace", cells)
+
+	checkPlan := func(name string, plan *DryRunPlan, want, notes []string) {
+		if after := topoSnapshot(t, ts, "test_keyspace", cells); after != before {
+			t.Errorf("%v changed the topology:\n%v\nwant:\n%v", name, after, before)
+		}
+		var actions []string
+		for _, action := range plan.Actions {
+			actions = append(actions, action.String())
+		}
+		all := strings.Join(actions, "\n")
+		for _, w := range want {
+			if !strings.Contains(all, w) {
+				t.Errorf("%v: want %q in the plan:\n%v", name, w, plan)
+			}
+		}
+		for _, w := range notes {
+			if !strings.Contains(strings.Join(plan.Notes, "\n"), w) {
+				t.Errorf("%v: want the note %q in the plan:\n%v", name, w, plan)
+			}
+		}
+	}
+
+	// the recursive deletion of a shard, whose later steps see the
+	// deleted tablets and graphs
+	dry, plan := wr.DryRun()
+	if _, err := dry.DeleteShard("test_keyspace", "-80", DeleteShardOptions{Recursive: true, EvenIfServing: true}); err != nil {
+		t.Fatalf("DeleteShard failed: %v", err)
+	}
+	checkPlan("DeleteShard", plan, []string{
+		"UpdateTablet tablet cell1-0000000001",
+		"DeleteTablet tablet cell1-0000000001",
+		"DeleteTablet tablet cell2-0000000002",
+		"DeleteShardReplication ShardReplication test_keyspace/-80 in cell cell2",
+		"DeleteSrvTabletType EndPoints test_keyspace/-80/master in cell cell1",
+		"DeleteSrvShard SrvShard test_keyspace/-80 in cell cell2",
+		"DeleteShard shard test_keyspace/-80",
+	}, []string{"no tablet is added to test_keyspace/-80 before the deletion, only its 2 tablet(s) found are deleted"})
+	if last := plan.Actions[len(plan.Actions)-1].String(); last != "DeleteShard shard test_keyspace/-80" {
+		t.Errorf("want the shard deleted last, got %v", last)
+	}
+	if _, err := dry.TopoServer().GetShard("test_keyspace", "-80"); err != topo.ErrNoNode {
+		t.Errorf("want the shard deleted in the dry run, got %v", err)
+	}
+	if !strings.HasPrefix(plan.String(), "1. UpdateTablet tablet ") || !strings.Contains(plan.String(), "\nassuming:\n- no tablet is added") {
+		t.Errorf("unexpected plan:\n%v", plan)
+	}
+
+	// the replication graph of a cell is only checked as the dry run
+	// left it
+	dry, plan = wr.DryRun()
+	if err := dry.RemoveShardCell("test_keyspace", "-80", "cell2", false, nil); err == nil {
+		t.Errorf("RemoveShardCell worked with a tablet in the cell")
+	}
+	if len(plan.Actions) != 0 || plan.String() != "no change to the topology" {
+		t.Errorf("want an empty plan, got:\n%v", plan)
+	}
+	dry, plan = wr.DryRun()
+	if err := dry.RemoveShardCell("test_keyspace", "80-", "cell2", false, nil); err != nil {
+		t.Fatalf("RemoveShardCell failed: %v", err)
+	}
+	checkPlan("RemoveShardCell", plan, []string{
+		"DeleteShardReplication ShardReplication test_keyspace/80- in cell cell2",
+		"DeleteSrvTabletType EndPoints test_keyspace/80-/master in cell cell2",
+		"DeleteSrvShard SrvShard test_keyspace/80- in cell cell2",
+		"UpdateShard shard test_keyspace/80-",
+	}, []string{"no tablet of test_keyspace/80- is added in cell cell2 before the removal"})
+	si, err := dry.TopoServer().GetShard("test_keyspace", "80-")
+	if err != nil || len(si.Cells) != 1 || si.Cells[0] != "cell1" {
+		t.Errorf("want the cell removed in the dry run, got %v %v", si, err)
+	}
+
+	// the deletion of the keyspace
+	dry, plan = wr.DryRun()
+	if _, err := dry.DeleteKeyspace("test_keyspace", true, true, false); err != nil {
+		t.Fatalf("DeleteKeyspace failed: %v", err)
+	}
+	checkPlan("DeleteKeyspace", plan, []string{
+		"DeleteTablet tablet cell1-0000000011",
+		"DeleteShard shard test_keyspace/-80",
+		"DeleteShard shard test_keyspace/80-",
+		"DeleteSrvKeyspace SrvKeyspace test_keyspace in cell cell1",
+		"DeleteSrvKeyspace SrvKeyspace test_keyspace in cell cell2",
+		"DeleteKeyspace keyspace test_keyspace",
+	}, []string{"no shard is added to keyspace test_keyspace before the deletion, only its 2 shard(s) found are deleted"})
+
+	// the real deletion still works
+	if _, err := wr.DeleteKeyspace("test_keyspace", true, true, false); err != nil {
+		t.Fatalf("DeleteKeyspace failed: %v", err)
+	}
+	if _, err := ts.GetKeyspace("test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("want the keyspace deleted, got %v", err)
+	}
+}
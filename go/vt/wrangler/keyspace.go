@@ -6,7 +6,10 @@ package wrangler
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/youtube/vitess/go/vt/concurrency"
@@ -20,7 +23,22 @@ import (
 
 func (wr *Wrangler) lockKeyspace(keyspace string, actionNode *actionnode.ActionNode) (lockPath string, err error) {
 	log.Infof("Locking keyspace %v for action %v", keyspace, actionNode.Action)
-	return wr.ts.LockKeyspaceForAction(keyspace, actionNode.ToJson(), wr.lockTimeout, interrupted)
+	// the topology server doesn't list the keyspace action nodes
+	holder := func() string {
+		return "unknown"
+	}
+	stop := wr.warnSlowLockWait("keyspace "+keyspace, actionNode, holder)
+	startTime := time.Now()
+	lockPath, err = wr.ts.LockKeyspaceForAction(keyspace, actionNode.ToJson(), wr.lockTimeout, wr.interrupted)
+	stop()
+	recordLockWait(actionNode.Action, keyspace, startTime, err)
+	if err == topo.ErrTimeout {
+		wr.logger.Warningf("lock wait timed out: lock=keyspace %v action=%v waited=%v holder=%v", keyspace, actionNode.Action, time.Now().Sub(startTime), holder())
+	}
+	if err == nil {
+		actionNode.StartTime = time.Now()
+	}
+	return lockPath, err
 }
 
 func (wr *Wrangler) unlockKeyspace(keyspace string, actionNode *actionnode.ActionNode, lockPath string, actionError error) error {
@@ -34,18 +52,38 @@ func (wr *Wrangler) unlockKeyspace(keyspace string, actionNode *actionnode.Actio
 		actionNode.Error = ""
 		actionNode.State = actionnode.ACTION_STATE_DONE
 	}
-	err := wr.ts.UnlockKeyspaceForAction(keyspace, lockPath, actionNode.ToJson())
-	if actionError != nil {
-		if err != nil {
-			// this will be masked
-			log.Warningf("UnlockKeyspaceForAction failed: %v", err)
+
+	recordLockHold(keyspace, actionNode)
+
+	// record the action while we still hold the lock, so the
+	// action log is in order. This is best effort.
+	if err := wr.ts.AppendKeyspaceActionLog(keyspace, actionNode.LogEntry().ToJson(), wr.ActionLogMaxEntries); err != nil {
+		log.Warningf("AppendKeyspaceActionLog(%v) failed: %v", keyspace, err)
+	}
+
+	if err := wr.ts.UnlockKeyspaceForAction(keyspace, lockPath, actionNode.ToJson()); err != nil {
+		log.Warningf("UnlockKeyspaceForAction(%v) failed: %v", keyspace, err)
+		if actionError == nil {
+			return err
 		}
-		return actionError
+		return &UnlockError{Lock: "keyspace " + keyspace, ActionError: actionError, UnlockError: err}
+	}
+	return actionError
+}
+
+// GetKeyspaceActionLog returns the most recent entries of the action
+// log of a keyspace, most recent first. A limit of 0 returns all of them.
+func (wr *Wrangler) GetKeyspaceActionLog(keyspace string, limit int) ([]*actionnode.ActionLogEntry, error) {
+	entries, err := wr.ts.GetKeyspaceActionLog(keyspace)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	return parseActionLog(entries, limit), nil
 }
 
-func (wr *Wrangler) SetKeyspaceShardingInfo(keyspace, shardingColumnName string, shardingColumnType key.KeyspaceIdType, force bool) error {
+func (wr *Wrangler) SetKeyspaceShardingInfo(keyspace, shardingColumnName string, shardingColumnType key.KeyspaceIdType, force bool) (err error) {
+	defer recordAction("SetKeyspaceShardingInfo", keyspace, time.Now(), &err)
+
 	actionNode := actionnode.SetKeyspaceShardingInfo()
 	lockPath, err := wr.lockKeyspace(keyspace, actionNode)
 	if err != nil {
@@ -89,7 +127,20 @@ func (wr *Wrangler) setKeyspaceShardingInfo(keyspace, shardingColumnName string,
 	return wr.ts.UpdateKeyspace(ki)
 }
 
-func (wr *Wrangler) MigrateServedTypes(keyspace, shard string, servedType topo.TabletType, reverse bool) error {
+// MigrateServedTypes moves the serving of servedType from a source
+// shard to the shards replicating from it, or back from them with
+// reverse, and rebuilds the serving graph in the cells of the shards.
+// The destination shards have to cover the key range of the source
+// shard. The migration of master makes the source masters read-only,
+// and waits for filtered replication to catch up first. It can't be
+// reversed.
+//
+// The shards that gain servedType are updated before the ones that
+// lose it, so after a partial failure, the same MigrateServedTypes can
+// be run again to finish the migration.
+func (wr *Wrangler) MigrateServedTypes(keyspace, shard string, servedType topo.TabletType, reverse bool) (err error) {
+	defer recordAction("MigrateServedTypes", keyspace, time.Now(), &err)
+
 	// we cannot migrate a master back, since when master migration
 	// is done, the source shards are dead
 	if reverse && servedType == topo.TYPE_MASTER {
@@ -102,7 +153,7 @@ func (wr *Wrangler) MigrateServedTypes(keyspace, shard string, servedType topo.T
 	// an extra command line parameter?
 	shardNames, err := wr.ts.GetShardNames(keyspace)
 	if err != nil {
-		return nil
+		return err
 	}
 	destinationShards := make([]*topo.ShardInfo, 0, 0)
 	for _, shardName := range shardNames {
@@ -129,20 +180,14 @@ func (wr *Wrangler) MigrateServedTypes(keyspace, shard string, servedType topo.T
 	// still use a list of sources to not have to change the code later.
 	sourceShards := make([]*topo.ShardInfo, 0, 0)
 
-	// Verify the source has the type we're migrating
+	// Verify the destinations cover the source. Whether the shards
+	// serve the type is checked once they're locked.
 	si, err := wr.ts.GetShard(keyspace, shard)
 	if err != nil {
 		return err
 	}
-	foundType := topo.IsTypeInList(servedType, si.ServedTypes)
-	if reverse {
-		if foundType {
-			return fmt.Errorf("Source shard %v/%v is already serving type %v", keyspace, shard, servedType)
-		}
-	} else {
-		if !foundType {
-			return fmt.Errorf("Source shard %v/%v is not serving type %v", keyspace, shard, servedType)
-		}
+	if err := checkKeyRangeCoverage(si, destinationShards); err != nil {
+		return err
 	}
 	if servedType == topo.TYPE_MASTER && len(si.ServedTypes) > 1 {
 		return fmt.Errorf("Cannot migrate master out of %v/%v until everything else is migrated out", keyspace, shard)
@@ -152,47 +197,83 @@ func (wr *Wrangler) MigrateServedTypes(keyspace, shard string, servedType topo.T
 	// lock the shards: sources, then destinations
 	// (note they're all ordered by shard name)
 	actionNode := actionnode.MigrateServedTypes(servedType)
-	sourceLockPath := make([]string, len(sourceShards))
-	for i, si := range sourceShards {
-		sourceLockPath[i], err = wr.lockShard(si.Keyspace(), si.ShardName(), actionNode)
-		if err != nil {
-			log.Errorf("Failed to lock source shard %v/%v, may need to unlock other shards manually", si.Keyspace(), si.ShardName())
-			return err
+	shards := append(append([]*topo.ShardInfo{}, sourceShards...), destinationShards...)
+	lockPaths := make([]string, 0, len(shards))
+	unlock := func(actionError error) error {
+		rec := concurrency.AllErrorRecorder{}
+		for i := len(lockPaths) - 1; i >= 0; i-- {
+			rec.RecordError(wr.unlockShard(shards[i].Keyspace(), shards[i].ShardName(), actionNode, lockPaths[i], actionError))
 		}
+		return rec.Error()
 	}
-	destinationLockPath := make([]string, len(destinationShards))
-	for i, si := range destinationShards {
-		destinationLockPath[i], err = wr.lockShard(si.Keyspace(), si.ShardName(), actionNode)
+	for _, si := range shards {
+		lockPath, err := wr.lockShard(si.Keyspace(), si.ShardName(), actionNode)
 		if err != nil {
-			log.Errorf("Failed to lock destination shard %v/%v, may need to unlock other shards manually", si.Keyspace(), si.ShardName())
+			err = fmt.Errorf("cannot lock shard %v/%v: %v", si.Keyspace(), si.ShardName(), err)
+			if unlockErr := unlock(err); unlockErr != nil {
+				log.Errorf("Failed to unlock the shards locked before %v/%v, may need to unlock them manually: %v", si.Keyspace(), si.ShardName(), unlockErr)
+			}
 			return err
 		}
+		lockPaths = append(lockPaths, lockPath)
 	}
 
-	// record the action error and all unlock errors
-	rec := concurrency.AllErrorRecorder{}
-
-	// execute the migration
-	rec.RecordError(wr.migrateServedTypes(sourceShards, destinationShards, servedType, reverse))
+	// execute the migration, and unlock the shards, we're done
+	// (the action errors are recorded in the action log of each
+	// shard)
+	migrateErr := wr.migrateServedTypes(sourceShards, destinationShards, servedType, reverse)
+	unlockErr := unlock(migrateErr)
+	if migrateErr != nil {
+		return migrateErr
+	}
 
-	// unlock the shards, we're done
-	for i := len(destinationShards) - 1; i >= 0; i-- {
-		rec.RecordError(wr.unlockShard(destinationShards[i].Keyspace(), destinationShards[i].ShardName(), actionNode, destinationLockPath[i], nil))
+	// rebuild the serving graph in the cells of the shards, even if
+	// they couldn't be unlocked
+	cellMap := make(map[string]bool)
+	for _, si := range shards {
+		for _, cell := range si.Cells {
+			cellMap[cell] = true
+		}
 	}
-	for i := len(sourceShards) - 1; i >= 0; i-- {
-		rec.RecordError(wr.unlockShard(sourceShards[i].Keyspace(), sourceShards[i].ShardName(), actionNode, sourceLockPath[i], nil))
+	cells := make([]string, 0, len(cellMap))
+	for cell := range cellMap {
+		cells = append(cells, cell)
 	}
-
-	// rebuild the keyspace serving graph if there was no error
-	if rec.Error() == nil {
-		rec.RecordError(wr.RebuildKeyspaceGraph(keyspace, nil))
+	sort.Strings(cells)
+	if err := wr.RebuildKeyspaceGraph(keyspace, cells); err != nil {
+		return fmt.Errorf("%v of %v/%v was migrated, but the serving graph couldn't be rebuilt in cells %v, run RebuildKeyspaceGraph: %v", servedType, keyspace, shard, strings.Join(cells, ","), err)
 	}
+	return unlockErr
+}
 
-	return rec.Error()
+// checkKeyRangeCoverage checks the key ranges of the destination
+// shards cover exactly the key range of the source shard, without
+// gaps or overlaps.
+func checkKeyRangeCoverage(source *topo.ShardInfo, destinations []*topo.ShardInfo) error {
+	keyRanges := make(key.KeyRangeArray, len(destinations))
+	names := make([]string, len(destinations))
+	for i, si := range destinations {
+		keyRanges[i] = si.KeyRange
+		names[i] = si.ShardName()
+	}
+	keyRanges.Sort()
+	start := source.KeyRange.Start
+	covered := true
+	for i, kr := range keyRanges {
+		if kr.Start != start || (i > 0 && start == key.MaxKey) {
+			covered = false
+			break
+		}
+		start = kr.End
+	}
+	if !covered || start != source.KeyRange.End {
+		return fmt.Errorf("The destination shards %v don't exactly cover the key range of %v/%v", strings.Join(names, ","), source.Keyspace(), source.ShardName())
+	}
+	return nil
 }
 
 func removeType(tabletType topo.TabletType, types []topo.TabletType) ([]topo.TabletType, bool) {
-	result := make([]topo.TabletType, 0, len(types)-1)
+	result := make([]topo.TabletType, 0, len(types))
 	found := false
 	for _, t := range types {
 		if t == tabletType {
@@ -342,88 +423,137 @@ func (wr *Wrangler) migrateServedTypes(sourceShards, destinationShards []*topo.S
 		}
 	}
 
-	// check and update all shard records, in memory only
-	for _, si := range sourceShards {
-		if reverse {
-			// need to add to source
-			if topo.IsTypeInList(servedType, si.ServedTypes) {
-				return fmt.Errorf("Source shard %v/%v is already serving type %v", si.Keyspace(), si.ShardName(), servedType)
-			}
-			si.ServedTypes = append(si.ServedTypes, servedType)
-		} else {
-			// need to remove from source
-			var found bool
-			if si.ServedTypes, found = removeType(servedType, si.ServedTypes); !found {
-				return fmt.Errorf("Source shard %v/%v is not serving type %v", si.Keyspace(), si.ShardName(), servedType)
-			}
+	// the losing shards stop serving the type, the gaining shards
+	// start
+	losingShards, gainingShards := sourceShards, destinationShards
+	if reverse {
+		losingShards, gainingShards = destinationShards, sourceShards
+	}
+	losing := 0
+	for _, si := range losingShards {
+		if topo.IsTypeInList(servedType, si.ServedTypes) {
+			losing++
 		}
 	}
-	for _, si := range destinationShards {
-		if reverse {
-			// need to remove from destination
-			var found bool
-			if si.ServedTypes, found = removeType(servedType, si.ServedTypes); !found {
-				return fmt.Errorf("Destination shard %v/%v is not serving type %v", si.Keyspace(), si.ShardName(), servedType)
-			}
-		} else {
-			// need to add to destination
-			if topo.IsTypeInList(servedType, si.ServedTypes) {
-				return fmt.Errorf("Destination shard %v/%v is already serving type %v", si.Keyspace(), si.ShardName(), servedType)
-			}
-			si.ServedTypes = append(si.ServedTypes, servedType)
+	gaining := 0
+	for _, si := range gainingShards {
+		if !topo.IsTypeInList(servedType, si.ServedTypes) {
+			gaining++
 		}
 	}
 
+	// A previous attempt may have updated some shards already: the
+	// gaining ones first, then the losing ones.
+	switch {
+	case losing == len(losingShards):
+		if gaining < len(gainingShards) {
+			log.Warningf("%v of %v gaining shards already serve %v, from a previous attempt", len(gainingShards)-gaining, len(gainingShards), servedType)
+		}
+	case gaining == 0:
+		log.Warningf("The gaining shards already serve %v from a previous attempt, finishing the migration", servedType)
+	default:
+		return fmt.Errorf("Cannot migrate %v: %v of %v shards losing it still serve it, and %v of %v shards gaining it don't, fix the served types with SetShardServedTypes", servedType, losing, len(losingShards), gaining, len(gainingShards))
+	}
+
 	// For master type migration, need to:
 	// - switch the source shards to read-only
 	// - gather all replication points
 	// - wait for filtered replication to catch up before we continue
 	// - disable filtered replication after the fact
-	if servedType == topo.TYPE_MASTER {
-		err := wr.makeMastersReadOnly(sourceShards)
-		if err != nil {
+	if servedType == topo.TYPE_MASTER && losing > 0 {
+		if err := wr.makeMastersReadOnly(sourceShards); err != nil {
 			return err
 		}
 
 		masterPositions, err := wr.getMastersPosition(sourceShards)
 		if err != nil {
-			return err
+			return fmt.Errorf("The source masters were made read-only, but their position couldn't be read, run MigrateServedTypes again to retry: %v", err)
 		}
 
 		if err := wr.waitForFilteredReplication(masterPositions, destinationShards); err != nil {
-			return err
-		}
-
-		for _, si := range destinationShards {
-			si.SourceShards = nil
+			return fmt.Errorf("The source masters were made read-only, but filtered replication didn't catch up, run MigrateServedTypes again to retry: %v", err)
 		}
 	}
 
-	// All is good, we can save the shards now
-	for _, si := range sourceShards {
+	// All is good, we can save the shards now: the gaining ones
+	// first, then the losing ones
+	var updated []string
+	save := func(si *topo.ShardInfo) error {
 		if err := wr.ts.UpdateShard(si); err != nil {
+			if len(updated) == 0 {
+				return err
+			}
+			return fmt.Errorf("Cannot update shard %v/%v after updating %v, run MigrateServedTypes again to finish the migration: %v", si.Keyspace(), si.ShardName(), strings.Join(updated, ","), err)
+		}
+		updated = append(updated, si.Keyspace()+"/"+si.ShardName())
+		return nil
+	}
+	for _, si := range gainingShards {
+		if topo.IsTypeInList(servedType, si.ServedTypes) {
+			continue
+		}
+		si.ServedTypes = append(si.ServedTypes, servedType)
+		if err := save(si); err != nil {
 			return err
 		}
 	}
-	for _, si := range destinationShards {
-		if err := wr.ts.UpdateShard(si); err != nil {
+	for _, si := range losingShards {
+		var found bool
+		if si.ServedTypes, found = removeType(servedType, si.ServedTypes); !found {
+			continue
+		}
+		if err := save(si); err != nil {
 			return err
 		}
 	}
 
 	// And tell the new shards masters they can now be read-write.
 	// Invoking a remote action will also make the tablet stop filtered
-	// replication.
+	// replication, as its shard has no source shards anymore. A retry
+	// finds the destination shards by their source shards, so they are
+	// restored if this fails.
 	if servedType == topo.TYPE_MASTER {
+		cleared := make(map[*topo.ShardInfo][]topo.SourceShard)
+		for _, si := range destinationShards {
+			if len(si.SourceShards) == 0 {
+				continue
+			}
+			sourceShards := si.SourceShards
+			si.SourceShards = nil
+			if err := wr.ts.UpdateShard(si); err != nil {
+				si.SourceShards = sourceShards
+				return wr.restoreSourceShards(cleared, fmt.Errorf("The shards were migrated, but the source shards of %v/%v couldn't be cleared: %v", si.Keyspace(), si.ShardName(), err))
+			}
+			cleared[si] = sourceShards
+		}
 		if err := wr.makeMastersReadWrite(destinationShards); err != nil {
-			return err
+			return wr.restoreSourceShards(cleared, fmt.Errorf("The shards were migrated, but the destination masters couldn't be made read-write: %v", err))
 		}
 	}
 
 	return nil
 }
 
-func (wr *Wrangler) MigrateServedFrom(keyspace, shard string, servedType topo.TabletType, reverse bool) error {
+// restoreSourceShards puts back the source shards migrateServedTypes
+// cleared before failing with migrateErr, so MigrateServedTypes can
+// find the destination shards again.
+func (wr *Wrangler) restoreSourceShards(cleared map[*topo.ShardInfo][]topo.SourceShard, migrateErr error) error {
+	rec := concurrency.AllErrorRecorder{}
+	for si, sourceShards := range cleared {
+		si.SourceShards = sourceShards
+		if err := wr.ts.UpdateShard(si); err != nil {
+			rec.RecordError(fmt.Errorf("%v/%v: %v", si.Keyspace(), si.ShardName(), err))
+		}
+	}
+	if rec.HasErrors() {
+		return fmt.Errorf("%v, and the source shards of the destinations couldn't be restored (%v): delete them with SourceShardDelete, then Ping the destination masters to finish the migration", migrateErr, rec.Error())
+	}
+	return fmt.Errorf("%v, run MigrateServedTypes again to retry", migrateErr)
+}
+
+func (wr *Wrangler) MigrateServedFrom(keyspace, shard string, servedType topo.TabletType, reverse bool) (err error) {
+	defer recordAction("MigrateServedFrom", keyspace, time.Now(), &err)
+
 	// we cannot migrate a master back
 	if reverse && servedType == topo.TYPE_MASTER {
 		return fmt.Errorf("Cannot migrate master back to %v/%v", keyspace, shard)
@@ -638,3 +768,139 @@ func (wr *Wrangler) SetBlacklistedTablesByShard(keyspace, shard string, tabletTy
 
 	return nil
 }
+
+// DeleteKeyspaceResult is what DeleteKeyspace deleted, and what it
+// didn't.
+type DeleteKeyspaceResult struct {
+	Keyspace string
+
+	// DeletedShards are the deleted shards, FailedShards has the
+	// error of each shard that couldn't be deleted.
+	DeletedShards []string
+	FailedShards  map[string]error
+
+	// DeletedSrvKeyspaceCells are the cells whose SrvKeyspace was
+	// deleted, FailedSrvKeyspaceCells has the error of each cell
+	// whose SrvKeyspace couldn't be deleted.
+	DeletedSrvKeyspaceCells []string
+	FailedSrvKeyspaceCells  map[string]error
+
+	// KeyspaceDeleted is true if the keyspace record was deleted.
+	KeyspaceDeleted bool
+}
+
+func (r *DeleteKeyspaceResult) String() string {
+	lines := []string{fmt.Sprintf("keyspace %v deleted: %v", r.Keyspace, r.KeyspaceDeleted)}
+	if len(r.DeletedShards) > 0 {
+		lines = append(lines, "deleted shards: "+strings.Join(r.DeletedShards, ", "))
+	}
+	lines = append(lines, errorLines("shard not deleted", r.FailedShards)...)
+	if len(r.DeletedSrvKeyspaceCells) > 0 {
+		lines = append(lines, "deleted SrvKeyspace in cells: "+strings.Join(r.DeletedSrvKeyspaceCells, ", "))
+	}
+	lines = append(lines, errorLines("SrvKeyspace not deleted in cell", r.FailedSrvKeyspaceCells)...)
+	return strings.Join(lines, "\n")
+}
+
+// errorLines returns "<prefix> <name>: <error>" for each error of
+// errs, sorted by name.
+func errorLines(prefix string, errs map[string]error) []string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("%v %v: %v", prefix, name, errs[name])
+	}
+	return lines
+}
+
+// DeleteKeyspace deletes a keyspace: each of its shards with
+// DeleteShard, then its SrvKeyspace in each cell, then its record.
+// Without recursive, it refuses to do anything if a shard still has
+// tablets. With recursive, the tablets are deleted with their shard,
+// and the master tablets only with evenIfServing.
+// It stops at the first shard or cell that fails, unless force is
+// set: the keyspace record is then deleted anyway, with the records of
+// the shards that failed. The result reports what was deleted and
+// what wasn't in both cases.
+func (wr *Wrangler) DeleteKeyspace(keyspace string, recursive, evenIfServing, force bool) (result *DeleteKeyspaceResult, err error) {
+	defer recordAction("DeleteKeyspace", keyspace, time.Now(), &err)
+
+	if _, err := wr.ts.GetKeyspace(keyspace); err != nil {
+		return nil, err
+	}
+	shards, err := wr.ts.GetShardNames(keyspace)
+	if err != nil && err != topo.ErrNoNode {
+		return nil, err
+	}
+	result = &DeleteKeyspaceResult{
+		Keyspace:               keyspace,
+		FailedShards:           make(map[string]error),
+		FailedSrvKeyspaceCells: make(map[string]error),
+	}
+
+	// a shard with tablets blocks the deletion before anything is
+	// deleted
+	if !recursive && !force {
+		for _, shard := range shards {
+			aliases, err := topo.FindAllTabletAliasesInShard(wr.ts, keyspace, shard)
+			if err != nil && err != topo.ErrPartialResult {
+				return result, err
+			}
+			if len(aliases) > 0 {
+				result.FailedShards[shard] = fmt.Errorf("shard %v/%v still has %v tablets", keyspace, shard, len(aliases))
+				return result, fmt.Errorf("shard %v/%v still has %v tablets, use -recursive to delete them, nothing was deleted", keyspace, shard, len(aliases))
+			}
+		}
+	}
+
+	wr.dryRunNote("no shard is added to keyspace %v before the deletion, only its %v shard(s) found are deleted", keyspace, len(shards))
+	for i, shard := range shards {
+		wr.logger.Progress(&ProgressEvent{
+			Operation: "DeleteKeyspace",
+			Keyspace:  keyspace,
+			Shard:     shard,
+			Step:      "delete shard " + shard,
+			Current:   i + 1,
+			Total:     len(shards),
+		})
+		if _, err := wr.DeleteShard(keyspace, shard, DeleteShardOptions{Force: force, Recursive: recursive, EvenIfServing: evenIfServing}); err != nil {
+			result.FailedShards[shard] = err
+			if !force {
+				return result, fmt.Errorf("cannot delete shard %v/%v, stopping the deletion of keyspace %v, use -force to delete it anyway: %v", keyspace, shard, keyspace, err)
+			}
+			wr.logger.Warningf("Cannot delete shard %v/%v, forcing the deletion of keyspace %v: %v", keyspace, shard, keyspace, err)
+			continue
+		}
+		result.DeletedShards = append(result.DeletedShards, shard)
+	}
+
+	cells, err := wr.ts.GetKnownCells()
+	if err != nil {
+		return result, err
+	}
+	for _, cell := range cells {
+		switch err := wr.ts.DeleteSrvKeyspace(cell, keyspace); err {
+		case nil:
+			result.DeletedSrvKeyspaceCells = append(result.DeletedSrvKeyspaceCells, cell)
+		case topo.ErrNoNode:
+			// the keyspace was never served in this cell
+		default:
+			result.FailedSrvKeyspaceCells[cell] = err
+			wr.logger.Warningf("Cannot delete the SrvKeyspace of %v in cell %v: %v", keyspace, cell, err)
+		}
+	}
+	if len(result.FailedSrvKeyspaceCells) > 0 && !force {
+		return result, fmt.Errorf("cannot delete the SrvKeyspace of %v in %v cell(s), use -force to delete the keyspace anyway", keyspace, len(result.FailedSrvKeyspaceCells))
+	}
+
+	wr.logger.Infof("Deleting keyspace %v", keyspace)
+	if err := wr.ts.DeleteKeyspace(keyspace); err != nil {
+		return result, err
+	}
+	result.KeyspaceDeleted = true
+	return result, nil
+}
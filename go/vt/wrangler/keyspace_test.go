@@ -0,0 +1,398 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// deleteRecordingServer is a topo.Server that records the deletions
+// of shards, SrvKeyspaces and keyspaces, and can't delete some shards.
+type deleteRecordingServer struct {
+	topo.Server
+
+	mu      sync.Mutex
+	calls   []string
+	failing map[string]bool
+}
+
+func (s *deleteRecordingServer) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *deleteRecordingServer) DeleteShard(keyspace, shard string) error {
+	if s.failing[shard] {
+		return fmt.Errorf("delete failed")
+	}
+	s.record("DeleteShard " + keyspace + "/" + shard)
+	return s.Server.DeleteShard(keyspace, shard)
+}
+
+func (s *deleteRecordingServer) DeleteSrvKeyspace(cell, keyspace string) error {
+	s.record("DeleteSrvKeyspace " + cell + " " + keyspace)
+	return s.Server.DeleteSrvKeyspace(cell, keyspace)
+}
+
+func (s *deleteRecordingServer) DeleteKeyspace(keyspace string) error {
+	s.record("DeleteKeyspace " + keyspace)
+	return s.Server.DeleteKeyspace(keyspace)
+}
+
+// createDeleteKeyspaceTest creates a keyspace with the shards -80 and
+// 80-, served in cell1 and cell2, and a master and a replica tablet
+// in 80-.
+func createDeleteKeyspaceTest(t *testing.T, ts topo.Server) {
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+	}
+	for _, cell := range []string{"cell1", "cell2"} {
+		if err := ts.UpdateEndPoints(cell, "test_keyspace", "-80", topo.TYPE_MASTER, &topo.EndPoints{}); err != nil {
+			t.Fatalf("UpdateEndPoints failed: %v", err)
+		}
+		if err := ts.UpdateSrvKeyspace(cell, "test_keyspace", &topo.SrvKeyspace{}); err != nil {
+			t.Fatalf("UpdateSrvKeyspace failed: %v", err)
+		}
+	}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	tablets := []*topo.Tablet{
+		{Alias: master, Type: topo.TYPE_MASTER},
+		{Alias: topo.TabletAlias{Cell: "cell1", Uid: 2}, Type: topo.TYPE_REPLICA, Parent: master},
+	}
+	for _, tablet := range tablets {
+		tablet.Keyspace = "test_keyspace"
+		tablet.Shard = "80-"
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+	}
+	si, err := ts.GetShard("test_keyspace", "80-")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1"}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+}
+
+func TestDeleteKeyspace(t *testing.T) {
+	ts := &deleteRecordingServer{Server: zktopo.NewTestServer(t, []string{"cell1", "cell2"})}
+	wr := New(ts, time.Minute, time.Second)
+	createDeleteKeyspaceTest(t, ts)
+
+	// the shard with a tablet blocks everything
+	result, err := wr.DeleteKeyspace("test_keyspace", false, false, false)
+	if err == nil || !strings.Contains(err.Error(), "shard test_keyspace/80- still has 2 tablets") {
+		t.Errorf("DeleteKeyspace returned %v, want a tablets error", err)
+	}
+	if result == nil || result.KeyspaceDeleted || len(result.DeletedShards) != 0 || result.FailedShards["80-"] == nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(ts.calls) != 0 {
+		t.Errorf("want nothing deleted, got %v", ts.calls)
+	}
+	if shards, err := ts.GetShardNames("test_keyspace"); err != nil || len(shards) != 2 {
+		t.Errorf("want the 2 shards kept, got %v %v", shards, err)
+	}
+
+	// the shards go first, the keyspace record last
+	result, err = wr.DeleteKeyspace("test_keyspace", true, true, false)
+	if err != nil {
+		t.Fatalf("DeleteKeyspace failed: %v", err)
+	}
+	wantCalls := []string{
+		"DeleteShard test_keyspace/-80",
+		"DeleteShard test_keyspace/80-",
+		"DeleteSrvKeyspace cell1 test_keyspace",
+		"DeleteSrvKeyspace cell2 test_keyspace",
+		"DeleteKeyspace test_keyspace",
+	}
+	if !reflect.DeepEqual(ts.calls, wantCalls) {
+		t.Errorf("want calls:\n%v\ngot:\n%v", wantCalls, ts.calls)
+	}
+	want := "keyspace test_keyspace deleted: true\ndeleted shards: -80, 80-\ndeleted SrvKeyspace in cells: cell1, cell2"
+	if result.String() != want {
+		t.Errorf("want result:\n%v\ngot:\n%v", want, result)
+	}
+	if _, err := ts.GetKeyspace("test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetKeyspace(deleted): %v", err)
+	}
+	if _, err := ts.GetSrvKeyspace("cell2", "test_keyspace"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvKeyspace(deleted): %v", err)
+	}
+	if _, err := ts.GetTablet(topo.TabletAlias{Cell: "cell1", Uid: 2}); err != topo.ErrNoNode {
+		t.Errorf("GetTablet(deleted): %v", err)
+	}
+}
+
+func TestDeleteKeyspaceFailingShard(t *testing.T) {
+	ts := &deleteRecordingServer{
+		Server:  zktopo.NewTestServer(t, []string{"cell1", "cell2"}),
+		failing: map[string]bool{"-80": true},
+	}
+	wr := New(ts, time.Minute, time.Second)
+	createDeleteKeyspaceTest(t, ts)
+
+	// a failing shard stops the deletion
+	result, err := wr.DeleteKeyspace("test_keyspace", true, true, false)
+	if err == nil || !strings.Contains(err.Error(), "cannot delete shard test_keyspace/-80") {
+		t.Errorf("DeleteKeyspace returned %v, want a shard error", err)
+	}
+	if result.KeyspaceDeleted || len(ts.calls) != 0 {
+		t.Errorf("want nothing deleted, got %+v and %v", result, ts.calls)
+	}
+
+	// with force, the keyspace is deleted anyway
+	result, err = wr.DeleteKeyspace("test_keyspace", true, true, true)
+	if err != nil {
+		t.Fatalf("DeleteKeyspace failed: %v", err)
+	}
+	want := "keyspace test_keyspace deleted: true\ndeleted shards: 80-\nshard not deleted -80: delete failed\ndeleted SrvKeyspace in cells: cell1, cell2"
+	if result.String() != want {
+		t.Errorf("want result:\n%v\ngot:\n%v", want, result)
+	}
+	if _, err := ts.GetShard("test_keyspace", "-80"); err != topo.ErrNoNode {
+		t.Errorf("GetShard(deleted with the keyspace): %v", err)
+	}
+}
+
+// setServedTypes sets the served types, the cells and the source
+// shards of a shard.
+func setServedTypes(t *testing.T, ts topo.Server, shard string, servedTypes []topo.TabletType, sourceShards []topo.SourceShard) {
+	si, err := ts.GetShard("test_keyspace", shard)
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.ServedTypes = servedTypes
+	si.SourceShards = sourceShards
+	si.Cells = []string{"cell1"}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+}
+
+// checkServedTypes checks the served types of each shard.
+func checkServedTypes(t *testing.T, ts topo.Server, want map[string][]topo.TabletType) {
+	for shard, servedTypes := range want {
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		if len(si.ServedTypes) != len(servedTypes) {
+			t.Errorf("shard %v: want served types %v, got %v", shard, servedTypes, si.ServedTypes)
+			continue
+		}
+		for _, servedType := range servedTypes {
+			if !topo.IsTypeInList(servedType, si.ServedTypes) {
+				t.Errorf("shard %v: want served types %v, got %v", shard, servedTypes, si.ServedTypes)
+				break
+			}
+		}
+	}
+}
+
+// pingServer is a topo.Server answering the tablet actions, as the
+// pings of makeMastersReadWrite, in place of the tablets. It fails as
+// many actions as failures first, and counts the actions done while a
+// destination shard still has source shards.
+type pingServer struct {
+	topo.Server
+
+	mu           sync.Mutex
+	failures     int
+	pings        int
+	replicating  int
+	destinations []string
+}
+
+func (s *pingServer) WaitForTabletAction(actionPath string, waitTime time.Duration, interrupted chan struct{}) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pings++
+	for _, shard := range s.destinations {
+		if si, err := s.GetShard("test_keyspace", shard); err == nil && len(si.SourceShards) > 0 {
+			s.replicating++
+		}
+	}
+	if s.failures > 0 {
+		s.failures--
+		return "", fmt.Errorf("tablet unreachable")
+	}
+	return (&actionnode.ActionNode{Action: actionnode.TABLET_ACTION_PING}).ToJson(), nil
+}
+
+func TestMigrateServedTypes(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"0", "-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+	}
+	// each shard has a master in cell1, so its serving graph is
+	// rebuilt there
+	for i, shard := range []string{"0", "-80", "80-"} {
+		master := topo.TabletAlias{Cell: "cell1", Uid: uint32(i + 1)}
+		if err := topo.CreateTablet(ts, &topo.Tablet{Alias: master, Keyspace: "test_keyspace", Shard: shard, Type: topo.TYPE_MASTER}); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.MasterAlias = master
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+	}
+	allTypes := []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_RDONLY}
+	sourceShards := []topo.SourceShard{{Uid: 0, Keyspace: "test_keyspace", Shard: "0"}}
+	setServedTypes(t, ts, "0", allTypes, nil)
+	setServedTypes(t, ts, "-80", nil, sourceShards)
+	setServedTypes(t, ts, "80-", nil, nil)
+
+	// -80 alone doesn't cover the source
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_RDONLY, false); err == nil || !strings.Contains(err.Error(), "don't exactly cover the key range of test_keyspace/0") {
+		t.Errorf("MigrateServedTypes returned %v, want a coverage error", err)
+	}
+	setServedTypes(t, ts, "80-", nil, sourceShards)
+
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_MASTER, true); err == nil {
+		t.Errorf("MigrateServedTypes(master, reverse) worked")
+	}
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_MASTER, false); err == nil || !strings.Contains(err.Error(), "until everything else is migrated out") {
+		t.Errorf("MigrateServedTypes(master) returned %v", err)
+	}
+
+	// rdonly goes to the destinations, and back
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_RDONLY, false); err != nil {
+		t.Fatalf("MigrateServedTypes(rdonly) failed: %v", err)
+	}
+	checkServedTypes(t, ts, map[string][]topo.TabletType{
+		"0":   {topo.TYPE_MASTER, topo.TYPE_REPLICA},
+		"-80": {topo.TYPE_RDONLY},
+		"80-": {topo.TYPE_RDONLY},
+	})
+	if srvKeyspace, err := ts.GetSrvKeyspace("cell1", "test_keyspace"); err != nil || len(srvKeyspace.Partitions[topo.TYPE_RDONLY].Shards) != 2 {
+		t.Errorf("want the serving graph of cell1 rebuilt with 2 rdonly shards: %v %v", srvKeyspace, err)
+	}
+	if _, err := ts.GetSrvShard("cell2", "test_keyspace", "-80"); err != topo.ErrNoNode {
+		t.Errorf("want the serving graph of cell2 untouched: %v", err)
+	}
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_RDONLY, true); err != nil {
+		t.Fatalf("MigrateServedTypes(rdonly, reverse) failed: %v", err)
+	}
+	checkServedTypes(t, ts, map[string][]topo.TabletType{
+		"0":   allTypes,
+		"-80": nil,
+		"80-": nil,
+	})
+
+	// a previous attempt stopped after updating -80: the migration
+	// can be run again
+	setServedTypes(t, ts, "-80", []topo.TabletType{topo.TYPE_REPLICA}, sourceShards)
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_REPLICA, false); err != nil {
+		t.Fatalf("MigrateServedTypes(replica) failed: %v", err)
+	}
+	checkServedTypes(t, ts, map[string][]topo.TabletType{
+		"0":   {topo.TYPE_MASTER, topo.TYPE_RDONLY},
+		"-80": {topo.TYPE_REPLICA},
+		"80-": {topo.TYPE_REPLICA},
+	})
+
+	// the served types of the shards are inconsistent
+	setServedTypes(t, ts, "80-", []topo.TabletType{topo.TYPE_REPLICA, topo.TYPE_RDONLY}, sourceShards)
+	setServedTypes(t, ts, "0", []topo.TabletType{topo.TYPE_MASTER}, nil)
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_RDONLY, false); err == nil || !strings.Contains(err.Error(), "0 of 1 shards losing it still serve it, and 1 of 2 shards gaining it don't") {
+		t.Errorf("MigrateServedTypes returned %v, want an inconsistency error", err)
+	}
+}
+
+func TestMigrateServedTypesMasterRetry(t *testing.T) {
+	ts := &pingServer{
+		Server:       zktopo.NewTestServer(t, []string{"cell1"}),
+		failures:     1,
+		destinations: []string{"-80", "80-"},
+	}
+	wr := New(ts, time.Minute, time.Second)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for i, shard := range []string{"0", "-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		master := topo.TabletAlias{Cell: "cell1", Uid: uint32(i + 1)}
+		if err := topo.CreateTablet(ts, &topo.Tablet{Alias: master, Keyspace: "test_keyspace", Shard: shard, Type: topo.TYPE_MASTER}); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.MasterAlias = master
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+	}
+	// the served types were migrated by a previous attempt, the
+	// destinations still replicate from the source
+	allTypes := []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_RDONLY}
+	sourceShards := []topo.SourceShard{{Uid: 0, Keyspace: "test_keyspace", Shard: "0"}}
+	setServedTypes(t, ts, "0", nil, nil)
+	setServedTypes(t, ts, "-80", allTypes, sourceShards)
+	setServedTypes(t, ts, "80-", allTypes, sourceShards)
+
+	// a master can't be made read-write: the destinations are kept
+	// replicating, so the migration can be retried
+	err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_MASTER, false)
+	if err == nil || !strings.Contains(err.Error(), "couldn't be made read-write: tablet unreachable") || !strings.HasSuffix(err.Error(), "run MigrateServedTypes again to retry") {
+		t.Errorf("MigrateServedTypes returned %v, want a read-write error", err)
+	}
+	for _, shard := range ts.destinations {
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil || !reflect.DeepEqual(si.SourceShards, sourceShards) {
+			t.Errorf("want the source shards of %v restored, got %v %v", shard, si, err)
+		}
+	}
+
+	if err := wr.MigrateServedTypes("test_keyspace", "0", topo.TYPE_MASTER, false); err != nil {
+		t.Fatalf("MigrateServedTypes retry failed: %v", err)
+	}
+	for _, shard := range ts.destinations {
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil || len(si.SourceShards) != 0 {
+			t.Errorf("want the source shards of %v cleared, got %v %v", shard, si, err)
+		}
+	}
+	checkServedTypes(t, ts, map[string][]topo.TabletType{
+		"0":   nil,
+		"-80": allTypes,
+		"80-": allTypes,
+	})
+	if ts.pings != 4 || ts.replicating != 0 {
+		t.Errorf("want 4 pings of the masters without source shards, got %v pings, %v with source shards", ts.pings, ts.replicating)
+	}
+}
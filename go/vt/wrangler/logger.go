@@ -0,0 +1,95 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// Logger is the interface the Wrangler uses to report what its
+// operations are doing, so programs embedding a Wrangler can capture
+// the messages and show progress to their users.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+
+	// Progress reports a step of a long running operation.
+	Progress(event *ProgressEvent)
+}
+
+// ProgressEvent describes a step of a long running operation,
+// for instance 'DeleteShard ks/0: delete serving graph in cell1 (1/3)'.
+// Current and Total can be used to display a progress bar.
+type ProgressEvent struct {
+	Operation string
+	Keyspace  string
+	Shard     string
+	Step      string
+	Current   int
+	Total     int
+}
+
+func (e *ProgressEvent) String() string {
+	return fmt.Sprintf("%v %v/%v: %v (%v/%v)", e.Operation, e.Keyspace, e.Shard, e.Step, e.Current, e.Total)
+}
+
+// glogLogger is the default Logger, that sends everything to glog.
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	log.Infof(format, args...)
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	log.Warningf(format, args...)
+}
+
+func (glogLogger) Progress(event *ProgressEvent) {
+	log.Infof("%v", event)
+}
+
+// RecordingLogger is a Logger that remembers everything it is sent,
+// so tests can check what an operation reported.
+type RecordingLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+// NewRecordingLogger returns an empty RecordingLogger.
+func NewRecordingLogger() *RecordingLogger {
+	return &RecordingLogger{}
+}
+
+func (rl *RecordingLogger) record(event string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.events = append(rl.events, event)
+}
+
+func (rl *RecordingLogger) Infof(format string, args ...interface{}) {
+	rl.record("I " + fmt.Sprintf(format, args...))
+}
+
+func (rl *RecordingLogger) Warningf(format string, args ...interface{}) {
+	rl.record("W " + fmt.Sprintf(format, args...))
+}
+
+func (rl *RecordingLogger) Progress(event *ProgressEvent) {
+	rl.record("P " + event.String())
+}
+
+// Events returns the recorded events, in order. Info messages
+// are prefixed with 'I ', warnings with 'W ' and progress events
+// with 'P '.
+func (rl *RecordingLogger) Events() []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	result := make([]string, len(rl.events))
+	copy(result, rl.events)
+	return result
+}
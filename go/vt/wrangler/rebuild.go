@@ -7,6 +7,7 @@ package wrangler
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/youtube/vitess/go/vt/concurrency"
@@ -18,7 +19,9 @@ import (
 
 // Rebuild the serving and replication rollup data data while locking
 // out other changes.
-func (wr *Wrangler) RebuildShardGraph(keyspace, shard string, cells []string) error {
+func (wr *Wrangler) RebuildShardGraph(keyspace, shard string, cells []string) (err error) {
+	defer recordAction("RebuildShardGraph", keyspace, time.Now(), &err)
+
 	actionNode := actionnode.RebuildShard()
 	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
 	if err != nil {
@@ -282,8 +285,94 @@ func (wr *Wrangler) rebuildShardSrvGraph(shardInfo *topo.ShardInfo, tablets []*t
 	return rec.Error()
 }
 
+// MasterServingResult is the outcome of refreshing the master
+// EndPoints of a shard in one cell.
+type MasterServingResult struct {
+	Cell string
+	// Updated is false if the cell doesn't serve the master type,
+	// or couldn't be updated.
+	Updated bool
+	Error   error
+}
+
+// RefreshShardMasterServing rewrites the master EndPoints of a shard
+// in all its cells from the tablet record of its current master,
+// while locking out other changes. The cells that can't be updated
+// are skipped with a warning, and reported in the results.
+func (wr *Wrangler) RefreshShardMasterServing(keyspace, shard string) (results []MasterServingResult, err error) {
+	defer recordAction("RefreshShardMasterServing", keyspace, time.Now(), &err)
+
+	actionNode := actionnode.RebuildShard()
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err = wr.refreshShardMasterServing(keyspace, shard)
+	return results, wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+// refreshShardMasterServing is RefreshShardMasterServing for the
+// actions that already hold the shard lock.
+func (wr *Wrangler) refreshShardMasterServing(keyspace, shard string) ([]MasterServingResult, error) {
+	si, err := wr.ts.GetShardCritical(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	if si.MasterAlias.IsZero() {
+		return nil, fmt.Errorf("shard %v/%v has no master", keyspace, shard)
+	}
+	ti, err := wr.ts.GetTablet(si.MasterAlias)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := tabletmanager.EndPointForTablet(ti.Tablet)
+	if err != nil {
+		return nil, err
+	}
+	addrs := topo.NewEndPoints()
+	addrs.Entries = append(addrs.Entries, *entry)
+
+	results := make([]MasterServingResult, len(si.Cells))
+	wg := sync.WaitGroup{}
+	for i, cell := range si.Cells {
+		results[i].Cell = cell
+		wg.Add(1)
+		go func(result *MasterServingResult) {
+			defer wg.Done()
+			result.Updated, result.Error = wr.refreshMasterEndPoints(result.Cell, keyspace, shard, addrs)
+			if result.Error != nil {
+				wr.logger.Warningf("Cannot refresh master EndPoints in cell %v for %v/%v: %v", result.Cell, keyspace, shard, result.Error)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// refreshMasterEndPoints writes the master EndPoints of a shard in a
+// cell, if the cell serves the master type. It returns true if it did.
+func (wr *Wrangler) refreshMasterEndPoints(cell, keyspace, shard string, addrs *topo.EndPoints) (bool, error) {
+	tabletTypes, err := wr.ts.GetSrvTabletTypesPerShard(cell, keyspace, shard)
+	if err == topo.ErrNoNode {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !topo.IsTypeInList(topo.TYPE_MASTER, tabletTypes) {
+		return false, nil
+	}
+	if err := wr.ts.UpdateEndPoints(cell, keyspace, shard, topo.TYPE_MASTER, addrs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Rebuild the serving graph data while locking out other changes.
-func (wr *Wrangler) RebuildKeyspaceGraph(keyspace string, cells []string) error {
+func (wr *Wrangler) RebuildKeyspaceGraph(keyspace string, cells []string) (err error) {
+	defer recordAction("RebuildKeyspaceGraph", keyspace, time.Now(), &err)
+
 	actionNode := actionnode.RebuildKeyspace()
 	lockPath, err := wr.lockKeyspace(keyspace, actionNode)
 	if err != nil {
@@ -408,20 +497,8 @@ func (wr *Wrangler) rebuildKeyspace(keyspace string, cells []string) error {
 
 		first := true
 		for tabletType, partition := range srvKeyspace.Partitions {
-			topo.SrvShardArray(partition.Shards).Sort()
-
-			// check the first Start is MinKey, the last End is MaxKey,
-			// and the values in between match: End[i] == Start[i+1]
-			if partition.Shards[0].KeyRange.Start != key.MinKey {
-				return fmt.Errorf("Keyspace partition for %v does not start with %v", tabletType, key.MinKey)
-			}
-			if partition.Shards[len(partition.Shards)-1].KeyRange.End != key.MaxKey {
-				return fmt.Errorf("Keyspace partition for %v does not end with %v", tabletType, key.MaxKey)
-			}
-			for i := range partition.Shards[0 : len(partition.Shards)-1] {
-				if partition.Shards[i].KeyRange.End != partition.Shards[i+1].KeyRange.Start {
-					return fmt.Errorf("Non-contiguous KeyRange values for %v at shard %v to %v: %v != %v", tabletType, i, i+1, partition.Shards[i].KeyRange.End.Hex(), partition.Shards[i+1].KeyRange.Start.Hex())
-				}
+			if err := checkPartitionCoverage(tabletType, partition.Shards); err != nil {
+				return err
 			}
 
 			// backfill Shards
@@ -528,3 +605,24 @@ func (wr *Wrangler) RebuildReplicationGraph(cells []string, keyspaces []string)
 	}
 	return nil
 }
+
+// checkPartitionCoverage sorts the shards serving a tablet type, and
+// checks they cover the whole keyspace: the first Start is MinKey, the
+// last End is MaxKey, and the values in between match:
+// End[i] == Start[i+1]
+func checkPartitionCoverage(tabletType topo.TabletType, shards []topo.SrvShard) error {
+	topo.SrvShardArray(shards).Sort()
+
+	if shards[0].KeyRange.Start != key.MinKey {
+		return fmt.Errorf("Keyspace partition for %v does not start with %v", tabletType, key.MinKey)
+	}
+	if shards[len(shards)-1].KeyRange.End != key.MaxKey {
+		return fmt.Errorf("Keyspace partition for %v does not end with %v", tabletType, key.MaxKey)
+	}
+	for i := range shards[0 : len(shards)-1] {
+		if shards[i].KeyRange.End != shards[i+1].KeyRange.Start {
+			return fmt.Errorf("Non-contiguous KeyRange values for %v at shard %v to %v: %v != %v", tabletType, i, i+1, shards[i].KeyRange.End.Hex(), shards[i+1].KeyRange.Start.Hex())
+		}
+	}
+	return nil
+}
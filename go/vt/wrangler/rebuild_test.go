@@ -0,0 +1,124 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/tabletmanager"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// unreachableCellServer is a topo.Server that fails all the serving
+// and replication graph calls to one cell.
+type unreachableCellServer struct {
+	topo.Server
+	cell string
+}
+
+func (s unreachableCellServer) GetSrvTabletTypesPerShard(cell, keyspace, shard string) ([]topo.TabletType, error) {
+	if cell == s.cell {
+		return nil, fmt.Errorf("cell %v is unreachable", cell)
+	}
+	return s.Server.GetSrvTabletTypesPerShard(cell, keyspace, shard)
+}
+
+func (s unreachableCellServer) UpdateEndPoints(cell, keyspace, shard string, tabletType topo.TabletType, addrs *topo.EndPoints) error {
+	if cell == s.cell {
+		return fmt.Errorf("cell %v is unreachable", cell)
+	}
+	return s.Server.UpdateEndPoints(cell, keyspace, shard, tabletType, addrs)
+}
+
+func (s unreachableCellServer) DeleteShardReplication(cell, keyspace, shard string) error {
+	if cell == s.cell {
+		return topo.ErrUnreachable
+	}
+	return s.Server.DeleteShardReplication(cell, keyspace, shard)
+}
+
+func (s unreachableCellServer) DeleteSrvTabletType(cell, keyspace, shard string, tabletType topo.TabletType) error {
+	if cell == s.cell {
+		return topo.ErrUnreachable
+	}
+	return s.Server.DeleteSrvTabletType(cell, keyspace, shard, tabletType)
+}
+
+func (s unreachableCellServer) DeleteSrvShard(cell, keyspace, shard string) error {
+	if cell == s.cell {
+		return topo.ErrUnreachable
+	}
+	return s.Server.DeleteSrvShard(cell, keyspace, shard)
+}
+
+func TestRefreshShardMasterServing(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2", "cell3", "cell4"})
+	wr := New(ts, time.Minute, time.Second)
+
+	master := createTestTablet(t, wr, "cell1", 0, topo.TYPE_MASTER, topo.TabletAlias{})
+	for i, cell := range []string{"cell2", "cell3", "cell4"} {
+		createTestTablet(t, wr, cell, uint32(i+1), topo.TYPE_REPLICA, master)
+	}
+	if err := wr.RebuildShardGraph("test_keyspace", "0", nil); err != nil {
+		t.Fatalf("RebuildShardGraph failed: %v", err)
+	}
+
+	// cell1, cell2 and cell4 serve a stale master, cell3 doesn't serve it
+	stale := &topo.EndPoints{Entries: []topo.EndPoint{{Uid: 99, Host: "oldmaster"}}}
+	for _, cell := range []string{"cell1", "cell2", "cell4"} {
+		if err := ts.UpdateEndPoints(cell, "test_keyspace", "0", topo.TYPE_MASTER, stale); err != nil {
+			t.Fatalf("UpdateEndPoints(%v) failed: %v", cell, err)
+		}
+	}
+
+	wr = New(unreachableCellServer{Server: ts, cell: "cell4"}, time.Minute, time.Second)
+	results, err := wr.RefreshShardMasterServing("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("RefreshShardMasterServing failed: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("want 4 results, got %+v", results)
+	}
+	for i, want := range []MasterServingResult{
+		{Cell: "cell1", Updated: true},
+		{Cell: "cell2", Updated: true},
+		{Cell: "cell3"},
+	} {
+		if results[i] != want {
+			t.Errorf("result %v: want %+v, got %+v", i, want, results[i])
+		}
+	}
+	if r := results[3]; r.Cell != "cell4" || r.Updated || r.Error == nil {
+		t.Errorf("want an error for cell4, got %+v", r)
+	}
+
+	ti, err := ts.GetTablet(master)
+	if err != nil {
+		t.Fatalf("GetTablet failed: %v", err)
+	}
+	entry, err := tabletmanager.EndPointForTablet(ti.Tablet)
+	if err != nil {
+		t.Fatalf("EndPointForTablet failed: %v", err)
+	}
+	for _, cell := range []string{"cell1", "cell2"} {
+		addrs, err := ts.GetEndPoints(cell, "test_keyspace", "0", topo.TYPE_MASTER)
+		if err != nil {
+			t.Fatalf("GetEndPoints(%v) failed: %v", cell, err)
+		}
+		if !reflect.DeepEqual(addrs.Entries, []topo.EndPoint{*entry}) {
+			t.Errorf("master EndPoints in %v: want %v, got %v", cell, entry, addrs.Entries)
+		}
+	}
+	if _, err := ts.GetEndPoints("cell3", "test_keyspace", "0", topo.TYPE_MASTER); err != topo.ErrNoNode {
+		t.Errorf("master EndPoints in cell3: want ErrNoNode, got %v", err)
+	}
+	if addrs, err := ts.GetEndPoints("cell4", "test_keyspace", "0", topo.TYPE_MASTER); err != nil || !reflect.DeepEqual(addrs, stale) {
+		t.Errorf("master EndPoints in cell4 were changed: %v %v", addrs, err)
+	}
+}
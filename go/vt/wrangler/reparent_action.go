@@ -373,7 +373,13 @@ func (wr *Wrangler) finishReparent(si *topo.ShardInfo, masterElect *topo.TabletI
 	// We rebuild all the cells, as we may have taken tablets in and
 	// out of the graph.
 	log.Infof("rebuilding shard serving graph data")
-	return wr.rebuildShard(masterElect.Keyspace, masterElect.Shard, rebuildShardOptions{IgnorePartialResult: false, Critical: true})
+	if err := wr.rebuildShard(masterElect.Keyspace, masterElect.Shard, rebuildShardOptions{IgnorePartialResult: false, Critical: true}); err != nil {
+		return err
+	}
+
+	// and point the master EndPoints of all cells to the new master
+	_, err := wr.refreshShardMasterServing(masterElect.Keyspace, masterElect.Shard)
+	return err
 }
 
 func (wr *Wrangler) breakReplication(slaveMap map[topo.TabletAlias]*topo.TabletInfo, masterElect *topo.TabletInfo) error {
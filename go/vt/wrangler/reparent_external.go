@@ -82,8 +82,16 @@ func (wr *Wrangler) shardExternallyReparentedLocked(keyspace, shard string, mast
 	// and rebuild the shard serving graph (but do not change the
 	// master record, we already did it)
 	log.Infof("Rebuilding shard serving graph data")
-	return wr.rebuildShard(masterElectTablet.Keyspace, masterElectTablet.Shard,
-		rebuildShardOptions{IgnorePartialResult: partialTopology, Critical: true})
+	if err = wr.rebuildShard(masterElectTablet.Keyspace, masterElectTablet.Shard,
+		rebuildShardOptions{IgnorePartialResult: partialTopology, Critical: true}); err != nil {
+		return err
+	}
+
+	// and point the master EndPoints of all cells to the new
+	// master, the unreachable cells are only logged
+	log.Infof("Refreshing master serving graph data")
+	_, err = wr.refreshShardMasterServing(masterElectTablet.Keyspace, masterElectTablet.Shard)
+	return err
 }
 
 func (wr *Wrangler) reparentShardExternal(slaveTabletMap, masterTabletMap map[topo.TabletAlias]*topo.TabletInfo, masterElectTablet *topo.TabletInfo, scrapStragglers, continueOnUnexpectedMaster bool, acceptSuccessPercents int) error {
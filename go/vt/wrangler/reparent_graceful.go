@@ -42,7 +42,10 @@ func (wr *Wrangler) reparentShardGraceful(si *topo.ShardInfo, slaveTabletMap, ma
 		return fmt.Errorf("master elect tablet not in replication graph %v %v/%v %v", masterElectTablet.Alias, masterTablet.Keyspace, masterTablet.Shard, mapKeys(slaveTabletMap))
 	}
 
-	if err := wr.ValidateShard(masterTablet.Keyspace, masterTablet.Shard, true); err != nil {
+	if sv, err := wr.ValidateShard(masterTablet.Keyspace, masterTablet.Shard, true); err != nil {
+		if sv != nil {
+			err = fmt.Errorf("%v", sv)
+		}
 		return fmt.Errorf("ValidateShard verification failed: %v, if the master is dead, run: vtctl ScrapTablet -force %v", err, masterTablet.Alias)
 	}
 
@@ -5,18 +5,25 @@
 package wrangler
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/sync2"
 	"github.com/youtube/vitess/go/vt/concurrency"
 	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
 	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+var applySchemaKeyspaceConcurrency = flag.Int("apply_schema_keyspace_concurrency", 1, "number of shards ApplySchemaKeyspace changes at the same time")
+
 func (wr *Wrangler) GetSchema(tabletAlias topo.TabletAlias, tables []string, includeViews bool) (*myproto.SchemaDefinition, error) {
 	ti, err := wr.ts.GetTablet(tabletAlias)
 	if err != nil {
@@ -172,28 +179,23 @@ func (wr *Wrangler) ValidateSchemaKeyspace(keyspace string, includeViews bool) e
 }
 
 func (wr *Wrangler) PreflightSchema(tabletAlias topo.TabletAlias, change string) (*myproto.SchemaChangeResult, error) {
-	actionPath, err := wr.ai.PreflightSchema(tabletAlias, change)
+	ti, err := wr.ts.GetTablet(tabletAlias)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := wr.ai.WaitForCompletionReply(actionPath, wr.actionTimeout())
-	if err != nil {
-		return nil, err
-	}
-	return result.(*myproto.SchemaChangeResult), nil
+	return wr.ai.RpcPreflightSchema(ti, change, wr.actionTimeout())
 }
 
 func (wr *Wrangler) ApplySchema(tabletAlias topo.TabletAlias, sc *myproto.SchemaChange) (*myproto.SchemaChangeResult, error) {
-	actionPath, err := wr.ai.ApplySchema(tabletAlias, sc)
-
-	// the timeout is for the entire action, so it might be too big
-	// for an individual tablet
-	results, err := wr.ai.WaitForCompletionReply(actionPath, wr.actionTimeout())
+	ti, err := wr.ts.GetTablet(tabletAlias)
 	if err != nil {
 		return nil, err
 	}
-	return results.(*myproto.SchemaChangeResult), nil
+
+	// the timeout is for the entire action, so it might be too big
+	// for an individual tablet
+	return wr.ai.RpcApplySchema(ti, sc, wr.actionTimeout())
 }
 
 // Note for 'complex' mode (the 'simple' mode is easy enough that we
@@ -226,17 +228,47 @@ func (wr *Wrangler) ApplySchemaShard(keyspace, shard, change string, newParentTa
 }
 
 func (wr *Wrangler) lockAndApplySchemaShard(shardInfo *topo.ShardInfo, preflight *myproto.SchemaChangeResult, keyspace, shard string, masterTabletAlias topo.TabletAlias, change string, newParentTabletAlias topo.TabletAlias, simple, force bool) (*myproto.SchemaChangeResult, error) {
-	// get a shard lock
-	actionNode := actionnode.ApplySchemaShard(masterTabletAlias, change, simple)
+	// the lock only describes the change, the full text may be huge
+	actionNode := actionnode.ApplySchemaShard(masterTabletAlias, summarizeSchemaChange(change), simple)
+	return wr.runSchemaChangeWithShardLock(keyspace, shard, actionNode, func() (*myproto.SchemaChangeResult, error) {
+		return wr.applySchemaShard(shardInfo, preflight, masterTabletAlias, change, newParentTabletAlias, simple, force)
+	})
+}
+
+// runSchemaChangeWithShardLock runs apply while holding the shard
+// lock, so other shard actions wait for the schema change to finish.
+// The lock is heartbeated, as schema changes can take hours. If
+// wr.SchemaChangeShardLock is false, apply runs without the lock.
+func (wr *Wrangler) runSchemaChangeWithShardLock(keyspace, shard string, actionNode *actionnode.ActionNode, apply func() (*myproto.SchemaChangeResult, error)) (*myproto.SchemaChangeResult, error) {
+	if !wr.SchemaChangeShardLock {
+		wr.logger.Warningf("Applying schema change to shard %v/%v without the shard lock", keyspace, shard)
+		return apply()
+	}
+
 	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
 	if err != nil {
 		return nil, err
 	}
-
-	scr, err := wr.applySchemaShard(shardInfo, preflight, masterTabletAlias, change, newParentTabletAlias, simple, force)
+	stopHeartbeat := wr.heartbeatShardLock(keyspace, shard, actionNode, lockPath)
+	scr, err := apply()
+	stopHeartbeat()
 	return scr, wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
 }
 
+// maxSchemaChangeSummaryLen is the maximum length of the summary of a
+// schema change in its ActionNode.
+const maxSchemaChangeSummaryLen = 100
+
+// summarizeSchemaChange returns the beginning of change, with its
+// whitespace collapsed, and its size if it is truncated.
+func summarizeSchemaChange(change string) string {
+	summary := strings.Join(strings.Fields(change), " ")
+	if len(summary) <= maxSchemaChangeSummaryLen {
+		return summary
+	}
+	return fmt.Sprintf("%v... (%v bytes)", summary[:maxSchemaChangeSummaryLen], len(change))
+}
+
 // local structure used to keep track of what we're doing
 type TabletStatus struct {
 	ti           *topo.TabletInfo
@@ -408,117 +440,407 @@ func (wr *Wrangler) applySchemaShardComplex(statusArray []*TabletStatus, shardIn
 	return &myproto.SchemaChangeResult{BeforeSchema: preflight.BeforeSchema, AfterSchema: preflight.AfterSchema}, nil
 }
 
-// apply a schema change to an entire keyspace.
-// take a keyspace lock to do this.
-// first we will validate the Preflight works the same on all shard masters
-// and fail if not (unless force is specified)
-// if simple, we just do it on all masters.
-// if complex, we do the shell game in parallel on all shards
-func (wr *Wrangler) ApplySchemaKeyspace(keyspace string, change string, simple, force bool) (*myproto.SchemaChangeResult, error) {
+// The Status of a shard in an ApplySchemaKeyspaceResult.
+const (
+	// SchemaChangeApplied: the change was applied to the shard.
+	SchemaChangeApplied = "applied"
+	// SchemaChangeSkipped: the master already had the schema after
+	// the change.
+	SchemaChangeSkipped = "skipped"
+	// SchemaChangeFailed: the shard is in the way of the change, or
+	// the change failed on it.
+	SchemaChangeFailed = "failed"
+	// SchemaChangeNotApplied: the change stopped before the shard.
+	SchemaChangeNotApplied = "not applied"
+	// SchemaChangeChecked: the change can be applied to the shard, in
+	// a dry run.
+	SchemaChangeChecked = "checked"
+)
+
+// ApplySchemaKeyspaceResult reports a schema change of a keyspace.
+type ApplySchemaKeyspaceResult struct {
+	Keyspace string
+	DryRun   bool
+
+	// BeforeSchema and AfterSchema are the schema of the shard
+	// masters before and after the change, as preflighted.
+	BeforeSchema *myproto.SchemaDefinition
+	AfterSchema  *myproto.SchemaDefinition
+
+	// Shards has the outcome of the change on each shard, sorted by
+	// shard name.
+	Shards []ShardSchemaChange
+}
+
+// ShardSchemaChange is the outcome of a keyspace schema change on one
+// of its shards. Error is set if the Status is SchemaChangeFailed.
+type ShardSchemaChange struct {
+	Shard  string
+	Status string
+	Error  error
+}
+
+// FailedShards returns the shards the change failed on.
+func (r *ApplySchemaKeyspaceResult) FailedShards() []string {
+	var failed []string
+	for _, shard := range r.Shards {
+		if shard.Status == SchemaChangeFailed {
+			failed = append(failed, shard.Shard)
+		}
+	}
+	return failed
+}
+
+func (r *ApplySchemaKeyspaceResult) String() string {
+	lines := []string{fmt.Sprintf("schema change of keyspace %v", r.Keyspace)}
+	if r.DryRun {
+		lines[0] += " (dry run)"
+	}
+	for _, shard := range r.Shards {
+		line := fmt.Sprintf("shard %v: %v", shard.Shard, shard.Status)
+		if shard.Error != nil {
+			line += ": " + shard.Error.Error()
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ApplySchemaKeyspace applies a schema change to all the shards of a
+// keyspace, with the keyspace locked.
+//
+// The change is first preflighted on the master of the last shard, to
+// know the schema before and after it. The shards whose master already
+// has the schema after the change are skipped, so a change that failed
+// on some shards can be retried. Unless force, nothing is applied if
+// the master of another shard doesn't have the schema before the
+// change. With dryRun, ApplySchemaKeyspace stops there.
+//
+// The change is then applied to -apply_schema_keyspace_concurrency
+// shards at a time, in order, as ApplySchemaShard does. No other shard
+// is started after a failure. If simple, the change is only applied to
+// the masters, and ApplySchemaKeyspace waits up to waitSlaveTimeout for
+// their slaves to replicate it (not at all if 0). Finally the schema of
+// the masters is checked against the one expected after the change.
+//
+// The result reports the outcome on each shard, even with an error.
+func (wr *Wrangler) ApplySchemaKeyspace(keyspace, change string, simple, force, dryRun bool, waitSlaveTimeout time.Duration) (*ApplySchemaKeyspaceResult, error) {
 	actionNode := actionnode.ApplySchemaKeyspace(change, simple)
 	lockPath, err := wr.lockKeyspace(keyspace, actionNode)
 	if err != nil {
 		return nil, err
 	}
 
-	scr, err := wr.applySchemaKeyspace(keyspace, change, simple, force)
-	return scr, wr.unlockKeyspace(keyspace, actionNode, lockPath, err)
+	result, err := wr.applySchemaKeyspace(keyspace, change, simple, force, dryRun, waitSlaveTimeout)
+	return result, wr.unlockKeyspace(keyspace, actionNode, lockPath, err)
 }
 
-func (wr *Wrangler) applySchemaKeyspace(keyspace string, change string, simple, force bool) (*myproto.SchemaChangeResult, error) {
+func (wr *Wrangler) applySchemaKeyspace(keyspace, change string, simple, force, dryRun bool, waitSlaveTimeout time.Duration) (*ApplySchemaKeyspaceResult, error) {
 	shards, err := wr.ts.GetShardNames(keyspace)
 	if err != nil {
 		return nil, err
 	}
-
-	// corner cases
 	if len(shards) == 0 {
 		return nil, fmt.Errorf("No shards in keyspace %v", keyspace)
 	}
-	if len(shards) == 1 {
-		log.Infof("Only one shard in keyspace %v, using ApplySchemaShard", keyspace)
-		return wr.ApplySchemaShard(keyspace, shards[0], change, topo.TabletAlias{}, simple, force)
-	}
+	sort.Strings(shards)
 
 	// Get schema on all shard masters in parallel
 	log.Infof("Getting schema on all shards")
 	beforeSchemas := make([]*myproto.SchemaDefinition, len(shards))
 	shardInfos := make([]*topo.ShardInfo, len(shards))
 	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	getErrs := make([]string, 0, 5)
+	rec := concurrency.AllErrorRecorder{}
 	for i, shard := range shards {
 		wg.Add(1)
 		go func(i int, shard string) {
-			var err error
-			defer func() {
-				if err != nil {
-					mu.Lock()
-					getErrs = append(getErrs, err.Error())
-					mu.Unlock()
-				}
-				wg.Done()
-			}()
-
-			shardInfos[i], err = wr.ts.GetShard(keyspace, shard)
+			defer wg.Done()
+			si, err := wr.ts.GetShard(keyspace, shard)
 			if err != nil {
+				rec.RecordError(err)
 				return
 			}
-
-			beforeSchemas[i], err = wr.GetSchema(shardInfos[i].MasterAlias, nil, false)
+			shardInfos[i] = si
+			if beforeSchemas[i], err = wr.GetSchema(si.MasterAlias, nil, false); err != nil {
+				rec.RecordError(fmt.Errorf("shard %v: %v", shard, err))
+			}
 		}(i, shard)
 	}
 	wg.Wait()
-	if len(getErrs) > 0 {
-		return nil, fmt.Errorf("Error(s) getting schema: %v", strings.Join(getErrs, ", "))
+	if rec.HasErrors() {
+		return nil, fmt.Errorf("Error(s) getting schema: %v", rec.Error())
 	}
 
-	// check they all match, or use the force flag
+	// Preflight on the master of the last shard, to get the baseline.
+	// The shards are changed in order, so after a partial failure it
+	// is the least likely to have the change already, which would make
+	// the preflight fail.
+	last := shards[len(shards)-1]
+	log.Infof("Running Preflight on the master of shard %v", last)
+	preflight, err := wr.PreflightSchema(shardInfos[len(shards)-1].MasterAlias, change)
+	if err != nil {
+		return nil, err
+	}
+	result := &ApplySchemaKeyspaceResult{
+		Keyspace:     keyspace,
+		DryRun:       dryRun,
+		BeforeSchema: preflight.BeforeSchema,
+		AfterSchema:  preflight.AfterSchema,
+		Shards:       make([]ShardSchemaChange, len(shards)),
+	}
+
+	// check the starting schema of each master, or use the force flag
 	log.Infof("Checking starting schemas match on all shards")
+	var toApply []int
+	inconsistent := 0
 	for i, beforeSchema := range beforeSchemas {
-		if i == 0 {
+		shardChange := &result.Shards[i]
+		shardChange.Shard = shards[i]
+		shardChange.Status = SchemaChangeNotApplied
+		if len(myproto.DiffSchemaToArray("after", preflight.AfterSchema, shards[i], beforeSchema)) == 0 {
+			log.Infof("Shard %v already has the schema change, skipping it", shards[i])
+			shardChange.Status = SchemaChangeSkipped
 			continue
 		}
-		diffs := myproto.DiffSchemaToArray("shard 0", beforeSchemas[0], fmt.Sprintf("shard %v", i), beforeSchema)
-		if len(diffs) > 0 {
-			if force {
-				log.Warningf("Shard %v has inconsistent schema, ignoring: %v", i, strings.Join(diffs, "\n"))
-			} else {
-				return nil, fmt.Errorf("Shard %v has inconsistent schema: %v", i, strings.Join(diffs, "\n"))
-			}
+		toApply = append(toApply, i)
+		diffs := myproto.DiffSchemaToArray("shard "+last, preflight.BeforeSchema, "shard "+shards[i], beforeSchema)
+		if len(diffs) == 0 {
+			continue
 		}
+		if force {
+			log.Warningf("Shard %v has inconsistent schema, ignoring: %v", shards[i], strings.Join(diffs, "\n"))
+			continue
+		}
+		shardChange.Status = SchemaChangeFailed
+		shardChange.Error = fmt.Errorf("inconsistent schema: %v", strings.Join(diffs, ", "))
+		inconsistent++
 	}
-
-	// preflight on shard 0 master, to get baseline
-	// this assumes shard 0 master doesn't have the schema upgrade applied
-	// if it does, we'll have to fix the slaves and other shards manually.
-	log.Infof("Running Preflight on Shard 0 Master")
-	preflight, err := wr.PreflightSchema(shardInfos[0].MasterAlias, change)
-	if err != nil {
-		return nil, err
+	if inconsistent > 0 {
+		return result, fmt.Errorf("%v shard(s) of %v don't have the schema the change expects, nothing was applied (use -force to apply it anyway)", inconsistent, keyspace)
+	}
+	if dryRun {
+		for _, i := range toApply {
+			result.Shards[i].Status = SchemaChangeChecked
+		}
+		return result, nil
 	}
 
-	// for each shard, apply the change
-	log.Infof("Applying change on all shards")
-	var applyErr error
-	for i, shard := range shards {
+	// for each shard, apply the change, in order
+	log.Infof("Applying change on %v shard(s)", len(toApply))
+	mu := sync.Mutex{}
+	failed := false
+	parallel := *applySchemaKeyspaceConcurrency
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := sync2.NewSemaphore(parallel, 0)
+	for _, i := range toApply {
+		sem.Acquire()
+		mu.Lock()
+		stop := failed
+		mu.Unlock()
+		if stop {
+			sem.Release()
+			continue
+		}
+
 		wg.Add(1)
-		go func(i int, shard string) {
+		go func(shardChange *ShardSchemaChange, si *topo.ShardInfo) {
 			defer wg.Done()
+			defer sem.Release()
 
-			_, err := wr.lockAndApplySchemaShard(shardInfos[i], preflight, keyspace, shard, shardInfos[i].MasterAlias, change, topo.TabletAlias{}, simple, force)
+			_, err := wr.lockAndApplySchemaShard(si, preflight, keyspace, si.ShardName(), si.MasterAlias, change, topo.TabletAlias{}, simple, force)
+			if err == nil && simple && waitSlaveTimeout > 0 {
+				var master *topo.TabletInfo
+				if master, err = wr.ts.GetTablet(si.MasterAlias); err == nil {
+					err = wr.waitForSlavesToCatchUp(si, master, waitSlaveTimeout)
+				}
+			}
 			if err != nil {
+				log.Warningf("Schema change failed on shard %v: %v", si.ShardName(), err)
 				mu.Lock()
-				applyErr = err
+				failed = true
 				mu.Unlock()
+				shardChange.Status = SchemaChangeFailed
+				shardChange.Error = err
 				return
 			}
-		}(i, shard)
+
+			// check the master converged on the expected schema
+			sd, err := wr.GetSchema(si.MasterAlias, nil, false)
+			if err != nil {
+				err = fmt.Errorf("cannot check the schema after the change: %v", err)
+			} else if diffs := myproto.DiffSchemaToArray("expected", preflight.AfterSchema, "shard "+si.ShardName(), sd); len(diffs) > 0 {
+				err = fmt.Errorf("unexpected schema after the change: %v", strings.Join(diffs, ", "))
+			}
+			if err != nil {
+				log.Warningf("Schema of shard %v diverged: %v", si.ShardName(), err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+				shardChange.Status = SchemaChangeFailed
+				shardChange.Error = err
+				return
+			}
+			shardChange.Status = SchemaChangeApplied
+		}(&result.Shards[i], shardInfos[i])
 	}
 	wg.Wait()
-	if applyErr != nil {
-		return nil, applyErr
+
+	if failedShards := result.FailedShards(); len(failedShards) > 0 {
+		return result, fmt.Errorf("Schema change of %v failed on shard(s) %v, run it again to apply it to the remaining shards", keyspace, strings.Join(failedShards, ", "))
 	}
+	return result, nil
+}
 
-	return &myproto.SchemaChangeResult{BeforeSchema: preflight.BeforeSchema, AfterSchema: preflight.AfterSchema}, nil
+// CopySchemaShard copies the schema of the tables of a source tablet,
+// all of them if tables is empty, except excludeTables, to the master
+// of the destination shard, with the shard locked. The tables the
+// master already has with the same definition are skipped, and nothing
+// is applied if one has a different definition. The change replicates
+// to the slaves of the shard, with waitForSlaves CopySchemaShard waits
+// until they have it.
+func (wr *Wrangler) CopySchemaShard(srcTabletAlias topo.TabletAlias, tables, excludeTables []string, includeViews bool, destKeyspace, destShard string, waitForSlaves bool) (err error) {
+	defer recordAction("CopySchemaShard", destKeyspace, time.Now(), &err)
+
+	sd, err := wr.GetSchema(srcTabletAlias, tables, includeViews)
+	if err != nil {
+		return fmt.Errorf("cannot get the schema of %v: %v", srcTabletAlias, err)
+	}
+	sd = excludeTableDefinitions(sd, excludeTables)
+
+	actionNode := actionnode.CopySchemaShard(srcTabletAlias, tables, excludeTables, includeViews)
+	_, err = wr.runSchemaChangeWithShardLock(destKeyspace, destShard, actionNode, func() (*myproto.SchemaChangeResult, error) {
+		return wr.copySchemaShard(srcTabletAlias, sd, destKeyspace, destShard, waitForSlaves)
+	})
+	return err
+}
+
+// excludeTableDefinitions returns sd without the tables of
+// excludeTables.
+func excludeTableDefinitions(sd *myproto.SchemaDefinition, excludeTables []string) *myproto.SchemaDefinition {
+	if len(excludeTables) == 0 {
+		return sd
+	}
+	result := *sd
+	result.TableDefinitions = make([]myproto.TableDefinition, 0, len(sd.TableDefinitions))
+	for _, td := range sd.TableDefinitions {
+		if !strInList(excludeTables, td.Name) {
+			result.TableDefinitions = append(result.TableDefinitions, td)
+		}
+	}
+	return &result
+}
+
+func (wr *Wrangler) copySchemaShard(srcTabletAlias topo.TabletAlias, sd *myproto.SchemaDefinition, destKeyspace, destShard string, waitForSlaves bool) (*myproto.SchemaChangeResult, error) {
+	si, err := wr.ts.GetShard(destKeyspace, destShard)
+	if err != nil {
+		return nil, err
+	}
+	if si.MasterAlias.IsZero() {
+		return nil, fmt.Errorf("No master in shard %v/%v", destKeyspace, destShard)
+	}
+	master, err := wr.ts.GetTablet(si.MasterAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare with the tables the master already has
+	tableNames := make([]string, len(sd.TableDefinitions))
+	for i, td := range sd.TableDefinitions {
+		tableNames[i] = td.Name
+	}
+	destSd, err := wr.ai.GetSchema(master, tableNames, true, wr.actionTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the schema of master %v: %v", master.Alias, err)
+	}
+	var statements, views, diffs []string
+	for _, td := range sd.TableDefinitions {
+		if destTd, ok := destSd.GetTable(td.Name); ok {
+			if destTd.Schema != td.Schema {
+				diffs = append(diffs, fmt.Sprintf("%v on %v:\n%v\ndiffers on %v:\n%v", td.Name, srcTabletAlias, td.Schema, master.Alias, destTd.Schema))
+			} else {
+				log.Infof("Table %v already exists on %v, skipping it", td.Name, master.Alias)
+			}
+			continue
+		}
+
+		// views have the database name in them, and are created
+		// after the tables they probably depend on
+		if td.Type != myproto.TABLE_VIEW {
+			statements = append(statements, td.Schema)
+			continue
+		}
+		statement, err := fillSchemaTemplate(td.Schema, master.DbName())
+		if err != nil {
+			return nil, fmt.Errorf("cannot render the schema of view %v: %v", td.Name, err)
+		}
+		views = append(views, statement)
+	}
+	if len(diffs) > 0 {
+		return nil, fmt.Errorf("Tables of %v/%v have a different schema than on %v, nothing was copied:\n%v", destKeyspace, destShard, srcTabletAlias, strings.Join(diffs, "\n"))
+	}
+	statements = append(statements, views...)
+	if len(statements) == 0 {
+		log.Infof("Shard %v/%v already has the schema of %v", destKeyspace, destShard, srcTabletAlias)
+		return &myproto.SchemaChangeResult{BeforeSchema: destSd, AfterSchema: destSd}, nil
+	}
+
+	log.Infof("Applying %v statements on %v", len(statements), master.Alias)
+	sc := &myproto.SchemaChange{Sql: strings.Join(statements, ";\n"), AllowReplication: true}
+	scr, err := wr.ai.RpcApplySchema(master, sc, wr.actionTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("cannot apply the schema on master %v: %v", master.Alias, err)
+	}
+
+	if waitForSlaves {
+		if err := wr.waitForSlavesToCatchUp(si, master, wr.actionTimeout()); err != nil {
+			return nil, fmt.Errorf("the schema was applied on master %v, but the slaves didn't replicate it: %v", master.Alias, err)
+		}
+	}
+	return scr, nil
+}
+
+// fillSchemaTemplate substitutes dbName in a statement of a
+// SchemaDefinition.
+func fillSchemaTemplate(statement, dbName string) (string, error) {
+	tmpl, err := template.New("").Parse(statement)
+	if err != nil {
+		return "", err
+	}
+	data := new(bytes.Buffer)
+	if err := tmpl.Execute(data, map[string]string{"DatabaseName": dbName}); err != nil {
+		return "", err
+	}
+	return data.String(), nil
+}
+
+// waitForSlavesToCatchUp waits until the slaves of the shard reach the
+// current position of its master, up to waitTime.
+func (wr *Wrangler) waitForSlavesToCatchUp(si *topo.ShardInfo, master *topo.TabletInfo, waitTime time.Duration) error {
+	pos, err := wr.ai.MasterPosition(master, waitTime)
+	if err != nil {
+		return err
+	}
+	tabletMap, err := GetTabletMapForShard(wr.ts, si.Keyspace(), si.ShardName())
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	rec := concurrency.AllErrorRecorder{}
+	for _, ti := range tabletMap {
+		if ti.Alias == master.Alias || !ti.IsSlaveType() {
+			continue
+		}
+		wg.Add(1)
+		go func(ti *topo.TabletInfo) {
+			defer wg.Done()
+			if _, err := wr.ai.WaitSlavePosition(ti, pos, waitTime); err != nil {
+				rec.RecordError(fmt.Errorf("%v: %v", ti.Alias, err))
+			}
+		}(ti)
+	}
+	wg.Wait()
+	return rec.Error()
 }
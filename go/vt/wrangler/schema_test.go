@@ -0,0 +1,453 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
+	"github.com/youtube/vitess/go/vt/tabletmanager/initiator"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+func TestSummarizeSchemaChange(t *testing.T) {
+	if got := summarizeSchemaChange("ALTER TABLE t\n  ADD COLUMN c INT"); got != "ALTER TABLE t ADD COLUMN c INT" {
+		t.Errorf("unexpected summary: %v", got)
+	}
+	change := "ALTER TABLE t " + strings.Repeat("ADD COLUMN c INT, ", 20)
+	got := summarizeSchemaChange(change)
+	if !strings.HasPrefix(got, "ALTER TABLE t ADD COLUMN c INT, ") || !strings.HasSuffix(got, "... (374 bytes)") || len(got) != maxSchemaChangeSummaryLen+len("... (374 bytes)") {
+		t.Errorf("unexpected summary: %v", got)
+	}
+}
+
+// startSchemaChange runs a fake schema change on test_keyspace/0 with
+// runSchemaChangeWithShardLock. The change runs until release is
+// closed, the returned channel is closed when it is done.
+func startSchemaChange(t *testing.T, wr *Wrangler, release chan struct{}) chan struct{} {
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		actionNode := actionnode.ApplySchemaShard(topo.TabletAlias{Cell: "cell1", Uid: 1}, summarizeSchemaChange("ALTER TABLE t ADD COLUMN c INT"), true)
+		_, err := wr.runSchemaChangeWithShardLock("test_keyspace", "0", actionNode, func() (*myproto.SchemaChangeResult, error) {
+			close(started)
+			<-release
+			return &myproto.SchemaChangeResult{}, nil
+		})
+		if err != nil {
+			t.Errorf("runSchemaChangeWithShardLock failed: %v", err)
+		}
+	}()
+	<-started
+	return done
+}
+
+func TestSchemaChangeShardLock(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Minute)
+	wr.ShardLockHeartbeat = 10 * time.Millisecond
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	release := make(chan struct{})
+	schemaDone := startSchemaChange(t, wr, release)
+
+	servedTypesDone := make(chan error)
+	go func() {
+		servedTypesDone <- wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, nil)
+	}()
+	select {
+	case err := <-servedTypesDone:
+		t.Fatalf("SetShardServedTypes didn't wait for the schema change: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the lock describes the schema change, and is heartbeated
+	zconn := ts.(zktopo.TestServer).Server.(*zktopo.Server).GetZConn()
+	actionDir := "/zk/global/vt/keyspaces/test_keyspace/shards/0/action"
+	children, _, err := zconn.Children(actionDir)
+	if err != nil || len(children) == 0 {
+		t.Fatalf("Children(%v) failed: %v %v", actionDir, children, err)
+	}
+	first := children[0]
+	for _, child := range children {
+		if child < first {
+			first = child
+		}
+	}
+	data, _, err := zconn.Get(path.Join(actionDir, first))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	for _, want := range []string{actionnode.SHARD_ACTION_APPLY_SCHEMA, "ALTER TABLE t ADD COLUMN c INT", "HeartbeatTime"} {
+		if !strings.Contains(data, want) {
+			t.Errorf("lock doesn't contain %v: %v", want, data)
+		}
+	}
+
+	close(release)
+	<-schemaDone
+	if err := <-servedTypesDone; err != nil {
+		t.Fatalf("SetShardServedTypes failed: %v", err)
+	}
+
+	entries, err := wr.GetShardActionLog("test_keyspace", "0", 0)
+	if err != nil {
+		t.Fatalf("GetShardActionLog failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != actionnode.SHARD_ACTION_SET_SERVED_TYPES || entries[1].Action != actionnode.SHARD_ACTION_APPLY_SCHEMA {
+		t.Errorf("SetShardServedTypes didn't run after the schema change: %+v", entries)
+	}
+}
+
+func TestSchemaChangeWithoutShardLock(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Minute)
+	wr.SchemaChangeShardLock = false
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	release := make(chan struct{})
+	schemaDone := startSchemaChange(t, wr, release)
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, nil); err != nil {
+		t.Errorf("SetShardServedTypes failed: %v", err)
+	}
+	close(release)
+	<-schemaDone
+}
+
+// fakeSchemaConn is a TabletManagerConn that serves the schemas of
+// some tablets, records the changes applied on them and the tablets
+// waited for. A change with an AfterSchema replaces the schema of the
+// tablet, the changes fail on the tablets of failApply, and leave the
+// schema as it was on the tablets of ignoreApply.
+type fakeSchemaConn struct {
+	initiator.TabletManagerConn
+
+	mu          sync.Mutex
+	schemas     map[topo.TabletAlias]*myproto.SchemaDefinition
+	applied     map[topo.TabletAlias][]string
+	failApply   map[topo.TabletAlias]bool
+	ignoreApply map[topo.TabletAlias]bool
+	waited      []topo.TabletAlias
+}
+
+// testSchemaConn is the fakeSchemaConn of the "fake_schema" protocol.
+var testSchemaConn *fakeSchemaConn
+
+func init() {
+	initiator.RegisterTabletManagerConnFactory("fake_schema", func(topo.Server) initiator.TabletManagerConn {
+		return testSchemaConn
+	})
+}
+
+func (conn *fakeSchemaConn) GetSchema(tablet *topo.TabletInfo, tables []string, includeViews bool, waitTime time.Duration) (*myproto.SchemaDefinition, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	sd := &myproto.SchemaDefinition{DatabaseSchema: "CREATE DATABASE `{{.DatabaseName}}`"}
+	for _, td := range conn.schemas[tablet.Alias].TableDefinitions {
+		if (len(tables) == 0 || strInList(tables, td.Name)) && (includeViews || td.Type == myproto.TABLE_BASE_TABLE) {
+			sd.TableDefinitions = append(sd.TableDefinitions, td)
+		}
+	}
+	return sd, nil
+}
+
+// PreflightSchema returns the schema of the tablet, and the same
+// schema with a table named after the change.
+func (conn *fakeSchemaConn) PreflightSchema(tablet *topo.TabletInfo, change string, waitTime time.Duration) (*myproto.SchemaChangeResult, error) {
+	before, _ := conn.GetSchema(tablet, nil, true, waitTime)
+	after := *before
+	after.TableDefinitions = append(append([]myproto.TableDefinition(nil), before.TableDefinitions...), myproto.TableDefinition{Name: change, Schema: change, Type: myproto.TABLE_BASE_TABLE})
+	return &myproto.SchemaChangeResult{BeforeSchema: before, AfterSchema: &after}, nil
+}
+
+func (conn *fakeSchemaConn) ApplySchema(tablet *topo.TabletInfo, change *myproto.SchemaChange, waitTime time.Duration) (*myproto.SchemaChangeResult, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.failApply[tablet.Alias] {
+		return nil, fmt.Errorf("cannot apply %v", change.Sql)
+	}
+	conn.applied[tablet.Alias] = append(conn.applied[tablet.Alias], change.Sql)
+	if change.AfterSchema != nil && !conn.ignoreApply[tablet.Alias] {
+		conn.schemas[tablet.Alias] = change.AfterSchema
+	}
+	return &myproto.SchemaChangeResult{BeforeSchema: change.BeforeSchema, AfterSchema: change.AfterSchema}, nil
+}
+
+func (conn *fakeSchemaConn) MasterPosition(tablet *topo.TabletInfo, waitTime time.Duration) (*myproto.ReplicationPosition, error) {
+	return &myproto.ReplicationPosition{MasterLogGroupId: 12}, nil
+}
+
+func (conn *fakeSchemaConn) WaitSlavePosition(tablet *topo.TabletInfo, replicationPosition *myproto.ReplicationPosition, waitTime time.Duration) (*myproto.ReplicationPosition, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.waited = append(conn.waited, tablet.Alias)
+	return replicationPosition, nil
+}
+
+func TestCopySchemaShard(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	source := topo.TabletAlias{Cell: "cell1", Uid: 10}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	replica := topo.TabletAlias{Cell: "cell1", Uid: 2}
+	t1 := myproto.TableDefinition{Name: "t1", Schema: "CREATE TABLE `t1` (`id` int)", Type: myproto.TABLE_BASE_TABLE}
+	t2 := myproto.TableDefinition{Name: "t2", Schema: "CREATE TABLE `t2` (`id` int)", Type: myproto.TABLE_BASE_TABLE}
+	t3 := myproto.TableDefinition{Name: "t3", Schema: "CREATE TABLE `t3` (`id` int)", Type: myproto.TABLE_BASE_TABLE}
+	v1 := myproto.TableDefinition{Name: "v1", Schema: "CREATE VIEW `{{.DatabaseName}}`.`v1` AS SELECT `id` FROM `{{.DatabaseName}}`.`t2`", Type: myproto.TABLE_VIEW}
+	testSchemaConn = &fakeSchemaConn{
+		schemas: map[topo.TabletAlias]*myproto.SchemaDefinition{
+			source: {TableDefinitions: []myproto.TableDefinition{t1, t2, t3, v1}},
+			master: {TableDefinitions: []myproto.TableDefinition{t1}},
+		},
+		applied: make(map[topo.TabletAlias][]string),
+	}
+	saved := *tabletManagerProtocol
+	*tabletManagerProtocol = "fake_schema"
+	wr := New(ts, time.Minute, time.Second)
+	*tabletManagerProtocol = saved
+
+	for _, keyspace := range []string{"source_keyspace", "dest_keyspace"} {
+		if err := ts.CreateKeyspace(keyspace, &topo.Keyspace{}); err != nil {
+			t.Fatalf("CreateKeyspace failed: %v", err)
+		}
+	}
+	if err := topo.CreateShard(ts, "dest_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	tablets := []*topo.Tablet{
+		{Alias: source, Keyspace: "source_keyspace", Shard: "0", Type: topo.TYPE_RDONLY},
+		{Alias: master, Keyspace: "dest_keyspace", Shard: "0", Type: topo.TYPE_MASTER},
+		{Alias: replica, Keyspace: "dest_keyspace", Shard: "0", Type: topo.TYPE_REPLICA, Parent: master},
+	}
+	for _, tablet := range tablets {
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+	}
+	si, err := ts.GetShard("dest_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1"}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	// t1 is already there, t3 is excluded, the view comes last with
+	// the database name of the master
+	if err := wr.CopySchemaShard(source, nil, []string{"t3"}, true, "dest_keyspace", "0", true); err != nil {
+		t.Fatalf("CopySchemaShard failed: %v", err)
+	}
+	want := []string{"CREATE TABLE `t2` (`id` int);\nCREATE VIEW `vt_dest_keyspace`.`v1` AS SELECT `id` FROM `vt_dest_keyspace`.`t2`"}
+	if !reflect.DeepEqual(testSchemaConn.applied[master], want) {
+		t.Errorf("want applied on the master:\n%v\ngot:\n%v", want, testSchemaConn.applied[master])
+	}
+	if len(testSchemaConn.applied) != 1 {
+		t.Errorf("want a change on the master only, got %v", testSchemaConn.applied)
+	}
+	if want := []topo.TabletAlias{replica}; !reflect.DeepEqual(testSchemaConn.waited, want) {
+		t.Errorf("want to wait for %v, got %v", want, testSchemaConn.waited)
+	}
+
+	// a table with a different schema fails the copy
+	testSchemaConn.applied = make(map[topo.TabletAlias][]string)
+	testSchemaConn.schemas[master].TableDefinitions[0].Schema = "CREATE TABLE `t1` (`id` bigint)"
+	if err := wr.CopySchemaShard(source, []string{"t1", "t3"}, nil, false, "dest_keyspace", "0", false); err == nil || !strings.Contains(err.Error(), "t1 on cell1-0000000010") {
+		t.Errorf("CopySchemaShard returned %v, want a schema difference", err)
+	}
+	if len(testSchemaConn.applied) != 0 {
+		t.Errorf("want nothing applied, got %v", testSchemaConn.applied)
+	}
+
+	entries, err := wr.GetShardActionLog("dest_keyspace", "0", 0)
+	if err != nil {
+		t.Fatalf("GetShardActionLog failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != actionnode.SHARD_ACTION_COPY_SCHEMA {
+		t.Errorf("want 2 CopySchemaShard actions, got %+v", entries)
+	}
+}
+
+// shardStatuses returns the status of each shard of result.
+func shardStatuses(result *ApplySchemaKeyspaceResult) []string {
+	var statuses []string
+	for _, shard := range result.Shards {
+		statuses = append(statuses, shard.Shard+":"+shard.Status)
+	}
+	return statuses
+}
+
+func TestApplySchemaKeyspace(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	masters := map[string]topo.TabletAlias{"-80": {Cell: "cell1", Uid: 1}, "80-": {Cell: "cell1", Uid: 3}}
+	replicas := map[string]topo.TabletAlias{"-80": {Cell: "cell1", Uid: 2}, "80-": {Cell: "cell1", Uid: 4}}
+	t1 := myproto.TableDefinition{Name: "t1", Schema: "CREATE TABLE `t1` (`id` int)", Type: myproto.TABLE_BASE_TABLE}
+	testSchemaConn = &fakeSchemaConn{
+		schemas:   make(map[topo.TabletAlias]*myproto.SchemaDefinition),
+		applied:   make(map[topo.TabletAlias][]string),
+		failApply: make(map[topo.TabletAlias]bool),
+	}
+	saved := *tabletManagerProtocol
+	*tabletManagerProtocol = "fake_schema"
+	wr := New(ts, time.Minute, time.Second)
+	*tabletManagerProtocol = saved
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		tablets := []*topo.Tablet{
+			{Alias: masters[shard], Keyspace: "test_keyspace", Shard: shard, Type: topo.TYPE_MASTER},
+			{Alias: replicas[shard], Keyspace: "test_keyspace", Shard: shard, Type: topo.TYPE_REPLICA, Parent: masters[shard]},
+		}
+		for _, tablet := range tablets {
+			if err := topo.CreateTablet(ts, tablet); err != nil {
+				t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+			}
+			testSchemaConn.schemas[tablet.Alias] = &myproto.SchemaDefinition{TableDefinitions: []myproto.TableDefinition{t1}}
+		}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = []string{"cell1"}
+		si.MasterAlias = masters[shard]
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+	}
+	change := "CREATE TABLE `t2` (`id` int)"
+
+	// a dry run only checks
+	result, err := wr.ApplySchemaKeyspace("test_keyspace", change, true, false, true, 0)
+	if want := []string{"-80:checked", "80-:checked"}; err != nil || !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v, %v", want, result, err)
+	}
+	if len(testSchemaConn.applied) != 0 {
+		t.Errorf("want nothing applied, got %v", testSchemaConn.applied)
+	}
+
+	// a master with another schema stops the change, unless force
+	testSchemaConn.schemas[masters["-80"]] = &myproto.SchemaDefinition{}
+	result, err = wr.ApplySchemaKeyspace("test_keyspace", change, true, false, false, 0)
+	if err == nil || !strings.Contains(err.Error(), "nothing was applied") {
+		t.Errorf("want an inconsistent schema error, got %v", err)
+	}
+	if want := []string{"-80:failed", "80-:not applied"}; !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v", want, result)
+	}
+	if len(testSchemaConn.applied) != 0 {
+		t.Errorf("want nothing applied, got %v", testSchemaConn.applied)
+	}
+	testSchemaConn.schemas[masters["-80"]] = &myproto.SchemaDefinition{TableDefinitions: []myproto.TableDefinition{t1}}
+
+	// no shard is started after a failure
+	testSchemaConn.failApply[masters["-80"]] = true
+	result, err = wr.ApplySchemaKeyspace("test_keyspace", change, true, false, false, 0)
+	if err == nil || !strings.Contains(err.Error(), "failed on shard(s) -80") {
+		t.Errorf("want a failure on -80, got %v", err)
+	}
+	if want := []string{"-80:failed", "80-:not applied"}; !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v", want, result)
+	}
+	testSchemaConn.failApply[masters["-80"]] = false
+
+	// a partial change can be retried
+	testSchemaConn.failApply[masters["80-"]] = true
+	result, err = wr.ApplySchemaKeyspace("test_keyspace", change, true, false, false, 0)
+	if want := []string{"-80:applied", "80-:failed"}; err == nil || !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v, %v", want, result, err)
+	}
+	testSchemaConn.failApply[masters["80-"]] = false
+	result, err = wr.ApplySchemaKeyspace("test_keyspace", change, true, false, false, time.Second)
+	if want := []string{"-80:skipped", "80-:applied"}; err != nil || !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v, %v", want, result, err)
+	}
+	for _, shard := range []string{"-80", "80-"} {
+		if applied := testSchemaConn.applied[masters[shard]]; len(applied) != 1 || applied[0] != change {
+			t.Errorf("want the change applied once on the master of %v, got %v", shard, applied)
+		}
+	}
+	if want := []topo.TabletAlias{replicas["80-"]}; !reflect.DeepEqual(testSchemaConn.waited, want) {
+		t.Errorf("want to wait for %v, got %v", want, testSchemaConn.waited)
+	}
+}
+
+func TestApplySchemaKeyspaceDiverged(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	shards := []string{"-40", "40-80", "80-"}
+	masters := map[string]topo.TabletAlias{"-40": {Cell: "cell1", Uid: 1}, "40-80": {Cell: "cell1", Uid: 2}, "80-": {Cell: "cell1", Uid: 3}}
+	t1 := myproto.TableDefinition{Name: "t1", Schema: "CREATE TABLE `t1` (`id` int)", Type: myproto.TABLE_BASE_TABLE}
+	testSchemaConn = &fakeSchemaConn{
+		schemas:     make(map[topo.TabletAlias]*myproto.SchemaDefinition),
+		applied:     make(map[topo.TabletAlias][]string),
+		failApply:   make(map[topo.TabletAlias]bool),
+		ignoreApply: map[topo.TabletAlias]bool{masters["40-80"]: true},
+	}
+	saved := *tabletManagerProtocol
+	*tabletManagerProtocol = "fake_schema"
+	wr := New(ts, time.Minute, time.Second)
+	*tabletManagerProtocol = saved
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range shards {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		tablet := &topo.Tablet{Alias: masters[shard], Keyspace: "test_keyspace", Shard: shard, Type: topo.TYPE_MASTER}
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+		testSchemaConn.schemas[tablet.Alias] = &myproto.SchemaDefinition{TableDefinitions: []myproto.TableDefinition{t1}}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = []string{"cell1"}
+		si.MasterAlias = masters[shard]
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+	}
+
+	// the master of 40-80 doesn't have the expected schema after the
+	// change, so 80- is not changed
+	result, err := wr.ApplySchemaKeyspace("test_keyspace", "CREATE TABLE `t2` (`id` int)", true, false, false, 0)
+	if err == nil || !strings.Contains(err.Error(), "failed on shard(s) 40-80") {
+		t.Errorf("want a failure on 40-80, got %v", err)
+	}
+	if want := []string{"-40:applied", "40-80:failed", "80-:not applied"}; !reflect.DeepEqual(shardStatuses(result), want) {
+		t.Errorf("want %v, got %v", want, result)
+	}
+	if applied := testSchemaConn.applied[masters["80-"]]; len(applied) != 0 {
+		t.Errorf("want nothing applied on 80-, got %v", applied)
+	}
+}
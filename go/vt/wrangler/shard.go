@@ -6,8 +6,15 @@ package wrangler
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/concurrency"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/tabletmanager"
 	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
 	"github.com/youtube/vitess/go/vt/topo"
 )
@@ -15,105 +22,973 @@ import (
 // shard related methods for Wrangler
 
 func (wr *Wrangler) lockShard(keyspace, shard string, actionNode *actionnode.ActionNode) (lockPath string, err error) {
-	log.Infof("Locking shard %v/%v for action %v", keyspace, shard, actionNode.Action)
-	return wr.ts.LockShardForAction(keyspace, shard, actionNode.ToJson(), wr.lockTimeout, interrupted)
+	return wr.lockShardWithOptions(keyspace, shard, actionNode, nil)
+}
+
+// ShardLockOptions control how an operation waits for the lock of a
+// shard. A nil *ShardLockOptions waits up to the lock timeout of the
+// wrangler.
+type ShardLockOptions struct {
+	// Timeout replaces the lock timeout of the wrangler, if not 0.
+	Timeout time.Duration
+
+	// TryLock makes the operation fail right away with a
+	// *ShardLockedError if another action holds the lock. Timeout
+	// is then ignored: the lock is taken with a 0 timeout, which
+	// doesn't wait if another action took it since it was checked.
+	TryLock bool
+}
+
+// lockShardWithOptions is lockShard, waiting for the lock as
+// lockOptions say. The wait can still be interrupted.
+func (wr *Wrangler) lockShardWithOptions(keyspace, shard string, actionNode *actionnode.ActionNode, lockOptions *ShardLockOptions) (lockPath string, err error) {
+	timeout := wr.lockTimeout
+	tryLock := false
+	if lockOptions != nil {
+		if lockOptions.Timeout > 0 {
+			timeout = lockOptions.Timeout
+		}
+		tryLock = lockOptions.TryLock
+	}
+	if tryLock {
+		if err := wr.checkShardUnlocked(keyspace, shard); err != nil {
+			return "", err
+		}
+		timeout = 0
+	}
+
+	wr.logger.Infof("Locking shard %v/%v for action %v", keyspace, shard, actionNode.Action)
+	startTime := time.Now()
+	actionNode.LockTime = startTime.Unix()
+	// the holder runs in the timer of warnSlowLockWait, it only sees
+	// the content of the lock, not actionNode that is changed once
+	// the lock is taken
+	contents := actionNode.ToJson()
+	holder := func() string {
+		return wr.shardLockHolder(keyspace, shard, contents)
+	}
+	stop := wr.warnSlowLockWait("shard "+keyspace+"/"+shard, actionNode, holder)
+	lockPath, err = wr.ts.LockShardForAction(keyspace, shard, contents, timeout, wr.interrupted)
+	stop()
+	recordLockWait(actionNode.Action, keyspace, startTime, err)
+	if err == topo.ErrTimeout {
+		wr.logger.Warningf("lock wait timed out: lock=shard %v/%v action=%v waited=%v holder=%v", keyspace, shard, actionNode.Action, time.Now().Sub(startTime), holder())
+		if tryLock {
+			if lockedErr := wr.checkShardUnlocked(keyspace, shard); lockedErr != nil {
+				return "", lockedErr
+			}
+		}
+	}
+	if err == nil {
+		actionNode.StartTime = time.Now()
+	}
+	return lockPath, err
+}
+
+// checkShardUnlocked returns a *ShardLockedError if an action holds
+// the lock of a shard.
+func (wr *Wrangler) checkShardUnlocked(keyspace, shard string) error {
+	nodes, err := wr.ts.GetShardActionNodes(keyspace, shard)
+	switch {
+	case err == topo.ErrNoNode:
+		return nil
+	case err != nil:
+		return err
+	case len(nodes) == 0:
+		return nil
+	}
+	return &ShardLockedError{Keyspace: keyspace, Shard: shard, Node: findActionNode(nodes[:1], "")}
+}
+
+// warnSlowLockWait logs a warning if the lock is still waited for
+// after wr.LockWaitWarning, with the action holding it as returned by
+// holder. The returned function stops it, and must be called when the
+// wait is over.
+func (wr *Wrangler) warnSlowLockWait(lock string, actionNode *actionnode.ActionNode, holder func() string) (stop func()) {
+	if wr.LockWaitWarning <= 0 {
+		return func() {}
+	}
+	var mu sync.Mutex
+	done := false
+	timer := time.AfterFunc(wr.LockWaitWarning, func() {
+		h := holder()
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			wr.logger.Warningf("slow lock wait: lock=%v action=%v waited=%v holder=%v", lock, actionNode.Action, wr.LockWaitWarning, h)
+		}
+	})
+	return func() {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+	}
+}
+
+// shardLockHolder describes the action holding the lock of a shard,
+// for the lock wait warnings of the action whose lock has the given
+// contents. The nodes are compared by content: the guids of the
+// actions of a process started in the same second are the same.
+func (wr *Wrangler) shardLockHolder(keyspace, shard, contents string) string {
+	nodes, err := wr.ts.GetShardActionNodes(keyspace, shard)
+	if err != nil {
+		return fmt.Sprintf("unknown (%v)", err)
+	}
+	if len(nodes) == 0 || nodes[0] == contents {
+		return "none"
+	}
+	holder := findActionNode(nodes[:1], "")
+	return fmt.Sprintf("%v (%v) of %v", holder.Action, holder.ActionGuid, holder.Initiator())
+}
+
+// heartbeatShardLock updates the lock of a long running shard action
+// every wr.ShardLockHeartbeat, with the time of the heartbeat, so the
+// lock shows the action is still alive. The returned function stops
+// it, and must be called before unlockShard.
+func (wr *Wrangler) heartbeatShardLock(keyspace, shard string, actionNode *actionnode.ActionNode, lockPath string) (stop func()) {
+	if wr.ShardLockHeartbeat <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(wr.ShardLockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				actionNode.HeartbeatTime = now.Unix()
+				if err := wr.ts.UpdateShardActionLock(keyspace, shard, lockPath, actionNode.ToJson()); err != nil {
+					wr.logger.Warningf("UpdateShardActionLock(%v/%v) failed: %v", keyspace, shard, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
 }
 
 func (wr *Wrangler) unlockShard(keyspace, shard string, actionNode *actionnode.ActionNode, lockPath string, actionError error) error {
 	// first update the actionNode
 	if actionError != nil {
-		log.Infof("Unlocking shard %v/%v for action %v with error %v", keyspace, shard, actionNode.Action, actionError)
+		wr.logger.Infof("Unlocking shard %v/%v for action %v with error %v", keyspace, shard, actionNode.Action, actionError)
 		actionNode.Error = actionError.Error()
 		actionNode.State = actionnode.ACTION_STATE_FAILED
 	} else {
-		log.Infof("Unlocking shard %v/%v for successful action %v", keyspace, shard, actionNode.Action)
+		wr.logger.Infof("Unlocking shard %v/%v for successful action %v", keyspace, shard, actionNode.Action)
 		actionNode.Error = ""
 		actionNode.State = actionnode.ACTION_STATE_DONE
 	}
+
+	recordLockHold(keyspace, actionNode)
+
+	// record the action while we still hold the lock, so the
+	// action log is in order. This is best effort.
+	if err := wr.ts.AppendShardActionLog(keyspace, shard, actionNode.LogEntry().ToJson(), wr.ActionLogMaxEntries); err != nil {
+		wr.logger.Warningf("AppendShardActionLog(%v/%v) failed: %v", keyspace, shard, err)
+	}
+
+	// a transient failure would leave the shard locked until
+	// ForceUnlockShard, retry it
 	err := wr.ts.UnlockShardForAction(keyspace, shard, lockPath, actionNode.ToJson())
-	if actionError != nil {
+	delay := wr.UnlockRetryDelay
+retries:
+	for i := 0; i < unlockRetries && err != nil && isTransientTopoError(err); i++ {
+		wr.logger.Warningf("UnlockShardForAction(%v/%v) failed, retrying in %v: %v", keyspace, shard, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-wr.interrupted:
+			wr.logger.Warningf("Interrupted, not retrying UnlockShardForAction(%v/%v)", keyspace, shard)
+			break retries
+		}
+		delay *= 2
+		err = wr.ts.UnlockShardForAction(keyspace, shard, lockPath, actionNode.ToJson())
+		if err == topo.ErrNoNode {
+			// the failed attempt released the lock anyway
+			wr.logger.Infof("Lock %v of shard %v/%v is already released", lockPath, keyspace, shard)
+			err = nil
+		}
+	}
+	if err != nil {
+		wr.logger.Warningf("UnlockShardForAction(%v/%v) failed: %v", keyspace, shard, err)
+		if actionError == nil {
+			return err
+		}
+		return &UnlockError{Lock: "shard " + keyspace + "/" + shard, ActionError: actionError, UnlockError: err}
+	}
+	return actionError
+}
+
+// UnlockError is returned when a failed action couldn't release its
+// lock either, with both errors. The lock may still be held, see
+// ForceUnlockShard.
+type UnlockError struct {
+	Lock        string
+	ActionError error
+	UnlockError error
+}
+
+func (e *UnlockError) Error() string {
+	return fmt.Sprintf("%v, and unlocking %v failed: %v", e.ActionError, e.Lock, e.UnlockError)
+}
+
+// Unwrap returns the error of the action, the primary one. The error
+// unlocking is in UnlockError.
+func (e *UnlockError) Unwrap() error {
+	return e.ActionError
+}
+
+// unlockShard retries an unlock that failed on a transient error
+// unlockRetries times, waiting wr.UnlockRetryDelay the first time,
+// twice as long each following time.
+const unlockRetries = 3
+
+// isTransientTopoError returns true if an error of the topology server
+// may not happen again: the server couldn't be reached or didn't
+// answer in time.
+func isTransientTopoError(err error) bool {
+	return err == topo.ErrUnreachable || err == topo.ErrTimeout
+}
+
+// GetShardLockHolders returns the actions holding or waiting for the
+// lock of a shard, the one holding it first, with the user, host and
+// pid of their process and the time they asked for the lock. It is
+// empty if the shard is not locked. The nodes that cannot be parsed
+// are returned as an "unknown" action.
+func (wr *Wrangler) GetShardLockHolders(keyspace, shard string) ([]*actionnode.ActionNode, error) {
+	nodes, err := wr.ts.GetShardActionNodes(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*actionnode.ActionNode, len(nodes))
+	for i, data := range nodes {
+		result[i] = findActionNode([]string{data}, "")
+	}
+	return result, nil
+}
+
+// ForceUnlockShard breaks the lock of a shard, for when the process
+// of the action holding it died. If action is not empty, the lock must
+// be held by an action of that name. The lock is only removed if its
+// holder didn't change since it was checked. The broken action is
+// recorded as failed in the shard action log, with who broke the
+// lock, and returned.
+func (wr *Wrangler) ForceUnlockShard(keyspace, shard, action string) (holder *actionnode.ActionNode, err error) {
+	defer recordAction("ForceUnlockShard", keyspace, time.Now(), &err)
+
+	nodes, err := wr.ts.GetShardActionNodes(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("shard %v/%v is not locked", keyspace, shard)
+	}
+	holder = findActionNode(nodes[:1], "")
+	if action != "" && holder.Action != action {
+		return nil, fmt.Errorf("shard %v/%v is locked by action %v (%v) of %v, not %v", keyspace, shard, holder.Action, holder.ActionGuid, holder.Initiator(), action)
+	}
+	if err := wr.ts.ForceUnlockShard(keyspace, shard, nodes[0]); err != nil {
+		if err == topo.ErrBadVersion || err == topo.ErrNoNode {
+			return nil, fmt.Errorf("the lock of shard %v/%v changed since it was checked, check it again", keyspace, shard)
+		}
+		return nil, err
+	}
+
+	breaker := (&actionnode.ActionNode{}).SetGuid()
+	wr.logger.Warningf("Broke the lock of shard %v/%v held by action %v (%v) of %v", keyspace, shard, holder.Action, holder.ActionGuid, holder.Initiator())
+	holder.State = actionnode.ACTION_STATE_FAILED
+	holder.Error = fmt.Sprintf("lock broken by %v", breaker.Initiator())
+	if holder.LockTime != 0 {
+		holder.StartTime = time.Unix(holder.LockTime, 0)
+	}
+	if err := wr.ts.AppendShardActionLog(keyspace, shard, holder.LogEntry().ToJson(), wr.ActionLogMaxEntries); err != nil {
+		wr.logger.Warningf("AppendShardActionLog(%v/%v) failed: %v", keyspace, shard, err)
+	}
+	return holder, nil
+}
+
+// GetShardActionLog returns the most recent entries of the action
+// log of a shard, most recent first. A limit of 0 returns all of them.
+func (wr *Wrangler) GetShardActionLog(keyspace, shard string, limit int) ([]*actionnode.ActionLogEntry, error) {
+	entries, err := wr.ts.GetShardActionLog(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	return parseActionLog(entries, limit), nil
+}
+
+// parseActionLog parses at most limit action log entries (0 for no
+// limit). Entries that cannot be parsed, like the ones written by
+// older versions, are skipped.
+func parseActionLog(entries []string, limit int) []*actionnode.ActionLogEntry {
+	result := make([]*actionnode.ActionLogEntry, 0, len(entries))
+	for _, data := range entries {
+		if limit > 0 && len(result) == limit {
+			break
+		}
+		entry, err := actionnode.ActionLogEntryFromJson(data)
+		if err != nil {
+			log.Warningf("skipping bad action log entry: %v %#v", err, data)
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// shardLockPollInterval is how often WaitForShardLockRelease and
+// WaitForShardAction check the shard lock.
+var shardLockPollInterval = time.Second
+
+// ShardLockedError is returned when waiting for a shard lock times
+// out, or when trying it, see ShardLockOptions.TryLock. Node is the
+// action that was still in the way: the one holding the lock for
+// WaitForShardLockRelease and the tries, the awaited one for
+// WaitForShardAction.
+type ShardLockedError struct {
+	Keyspace string
+	Shard    string
+	Node     *actionnode.ActionNode
+}
+
+func (e *ShardLockedError) Error() string {
+	return fmt.Sprintf("shard %v/%v is still locked by action %v (%v) of %v", e.Keyspace, e.Shard, e.Node.Action, e.Node.ActionGuid, e.Node.Initiator())
+}
+
+// WaitForShardLockRelease waits until no action holds the lock of a
+// shard, for at most timeout. It doesn't take the lock, so another
+// action may take it right after. It returns a *ShardLockedError on
+// timeout.
+func (wr *Wrangler) WaitForShardLockRelease(keyspace, shard string, timeout time.Duration) error {
+	return wr.waitForShardActionNodes(keyspace, shard, timeout, "")
+}
+
+// WaitForShardAction waits until no action named action (see
+// ActionNode.Action) holds or waits for the lock of a shard, for at
+// most timeout. It doesn't take the lock. It returns a
+// *ShardLockedError on timeout.
+func (wr *Wrangler) WaitForShardAction(keyspace, shard, action string, timeout time.Duration) error {
+	return wr.waitForShardActionNodes(keyspace, shard, timeout, action)
+}
+
+// waitForShardActionNodes polls the action nodes of a shard until
+// none of them is named action, or until the shard lock is free if
+// action is empty.
+func (wr *Wrangler) waitForShardActionNodes(keyspace, shard string, timeout time.Duration, action string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		nodes, err := wr.ts.GetShardActionNodes(keyspace, shard)
+		if err != nil {
+			return err
+		}
+		blocking := findActionNode(nodes, action)
+		if blocking == nil {
+			return nil
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return &ShardLockedError{Keyspace: keyspace, Shard: shard, Node: blocking}
+		}
+		if wait > shardLockPollInterval {
+			wait = shardLockPollInterval
+		}
+		wr.logger.Infof("Waiting for action %v on shard %v/%v", blocking.Action, keyspace, shard)
+		time.Sleep(wait)
+	}
+}
+
+// findActionNode returns the first of the action nodes named action,
+// or the first one if action is empty, nil if there is none. Nodes
+// that cannot be parsed are returned as an "unknown" action.
+func findActionNode(nodes []string, action string) *actionnode.ActionNode {
+	for _, data := range nodes {
+		node, err := actionnode.ActionNodeFromJson(data, "")
 		if err != nil {
-			// this will be masked
-			log.Warningf("UnlockShardForAction failed: %v", err)
+			log.Warningf("bad action node: %v %#v", err, data)
+			node = &actionnode.ActionNode{Action: "unknown"}
+		}
+		if action == "" || node.Action == action {
+			return node
 		}
-		return actionError
 	}
-	return err
+	return nil
 }
 
 // SetShardServedTypes changes the ServedTypes parameter of a shard.
-// It does not rebuild any serving graph or do any consistency check (yet).
-func (wr *Wrangler) SetShardServedTypes(keyspace, shard string, servedTypes []topo.TabletType) error {
+// The types must be known and not repeated, and master can only be
+// removed from a shard that has a master with force.
+// If rebuild is set, the serving graph of each cell of the shard is
+// then rebuilt, with the shard still locked. The cells that can't be
+// rebuilt are reported in a *ServingGraphRebuildError, the shard
+// record is updated anyway.
+// lockOptions control the wait for the lock of the shard, nil for the
+// defaults.
+func (wr *Wrangler) SetShardServedTypes(keyspace, shard string, servedTypes []topo.TabletType, force, rebuild bool, lockOptions *ShardLockOptions) (err error) {
+	defer recordAction("SetShardServedTypes", keyspace, time.Now(), &err)
 
 	actionNode := actionnode.SetShardServedTypes(servedTypes)
-	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	lockPath, err := wr.lockShardWithOptions(keyspace, shard, actionNode, lockOptions)
 	if err != nil {
 		return err
 	}
 
-	err = wr.setShardServedTypes(keyspace, shard, servedTypes)
+	err = wr.setShardServedTypes(keyspace, shard, servedTypes, force, rebuild)
 	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
 }
 
-func (wr *Wrangler) setShardServedTypes(keyspace, shard string, servedTypes []topo.TabletType) error {
+func (wr *Wrangler) setShardServedTypes(keyspace, shard string, servedTypes []topo.TabletType, force, rebuild bool) error {
 	shardInfo, err := wr.ts.GetShard(keyspace, shard)
 	if err != nil {
 		return err
 	}
+	if err := checkShardServedTypes(shardInfo, servedTypes, force); err != nil {
+		return err
+	}
 
 	shardInfo.ServedTypes = servedTypes
+	if err := wr.ts.UpdateShard(shardInfo); err != nil {
+		return err
+	}
+	if !rebuild {
+		return nil
+	}
+	return wr.rebuildShardCells(shardInfo)
+}
+
+// checkShardServedTypes returns an error if servedTypes has an unknown
+// or a repeated type, or removes master from a shard that has a
+// master, unless force is set.
+func checkShardServedTypes(shardInfo *topo.ShardInfo, servedTypes []topo.TabletType, force bool) error {
+	seen := make(map[topo.TabletType]bool, len(servedTypes))
+	for _, servedType := range servedTypes {
+		if !topo.IsTypeInList(servedType, topo.AllTabletTypes) {
+			return fmt.Errorf("unknown served type %v", servedType)
+		}
+		if seen[servedType] {
+			return fmt.Errorf("served type %v is listed twice", servedType)
+		}
+		seen[servedType] = true
+	}
+	if !force && !shardInfo.MasterAlias.IsZero() && topo.IsTypeInList(topo.TYPE_MASTER, shardInfo.ServedTypes) && !seen[topo.TYPE_MASTER] {
+		return fmt.Errorf("shard %v/%v has the master %v, use -force to stop serving master", shardInfo.Keyspace(), shardInfo.ShardName(), shardInfo.MasterAlias)
+	}
+	return nil
+}
+
+// SetShardTabletControl changes the TabletControl of a tablet type in
+// a shard, see topo.ShardInfo.UpdateTabletControl: the control is
+// merged with the existing one, or removed from cells with remove.
+// The tablets read it from the shard record.
+func (wr *Wrangler) SetShardTabletControl(keyspace, shard string, tabletType topo.TabletType, cells []string, remove, disableQueryService bool, tables []string) (err error) {
+	defer recordAction("SetShardTabletControl", keyspace, time.Now(), &err)
+
+	actionNode := actionnode.SetShardTabletControl(tabletType, cells, remove, disableQueryService, tables)
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.setShardTabletControl(keyspace, shard, tabletType, cells, remove, disableQueryService, tables)
+	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) setShardTabletControl(keyspace, shard string, tabletType topo.TabletType, cells []string, remove, disableQueryService bool, tables []string) error {
+	shardInfo, err := wr.ts.GetShard(keyspace, shard)
+	if err != nil {
+		return err
+	}
+	if err := shardInfo.UpdateTabletControl(tabletType, cells, remove, disableQueryService, tables); err != nil {
+		return fmt.Errorf("shard %v/%v: %v", keyspace, shard, err)
+	}
 	return wr.ts.UpdateShard(shardInfo)
 }
 
-// DeleteShard will do all the necessary changes in the topology server
-// to entirely remove a shard. It can only work if there are no tablets
-// in that shard.
-func (wr *Wrangler) DeleteShard(keyspace, shard string) error {
+// SourceShardAdd adds a SourceShard to a shard, for its master to
+// replicate from sourceKeyspace/sourceShard. The uid must not be used
+// by another SourceShard of the shard, and the source shard must
+// exist. A partial keyRange can't have tables.
+func (wr *Wrangler) SourceShardAdd(keyspace, shard string, uid uint32, sourceKeyspace, sourceShard string, keyRange key.KeyRange, tables []string) (err error) {
+	defer recordAction("SourceShardAdd", keyspace, time.Now(), &err)
+
+	if keyRange.IsPartial() && len(tables) > 0 {
+		return fmt.Errorf("a SourceShard can't have both a partial key range and tables")
+	}
+	if _, err := wr.ts.GetShard(sourceKeyspace, sourceShard); err != nil {
+		return fmt.Errorf("cannot read the source shard %v/%v: %v", sourceKeyspace, sourceShard, err)
+	}
+
+	source := topo.SourceShard{
+		Uid:      uid,
+		Keyspace: sourceKeyspace,
+		Shard:    sourceShard,
+		KeyRange: keyRange,
+		Tables:   tables,
+	}
+	actionNode := actionnode.SourceShardAdd(source)
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.sourceShardAdd(keyspace, shard, source)
+	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) sourceShardAdd(keyspace, shard string, source topo.SourceShard) error {
 	shardInfo, err := wr.ts.GetShard(keyspace, shard)
 	if err != nil {
 		return err
 	}
+	for _, ss := range shardInfo.SourceShards {
+		if ss.Uid == source.Uid {
+			return fmt.Errorf("shard %v/%v already has the SourceShard %v", keyspace, shard, ss.String())
+		}
+	}
 
-	tabletMap, err := GetTabletMapForShard(wr.ts, keyspace, shard)
+	shardInfo.SourceShards = append(shardInfo.SourceShards, source)
+	return wr.ts.UpdateShard(shardInfo)
+}
+
+// SourceShardDelete removes the SourceShard with uid from a shard.
+func (wr *Wrangler) SourceShardDelete(keyspace, shard string, uid uint32) (err error) {
+	defer recordAction("SourceShardDelete", keyspace, time.Now(), &err)
+
+	actionNode := actionnode.SourceShardDelete(uid)
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.sourceShardDelete(keyspace, shard, uid)
+	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) sourceShardDelete(keyspace, shard string, uid uint32) error {
+	shardInfo, err := wr.ts.GetShard(keyspace, shard)
+	if err != nil {
+		return err
+	}
+	for i, ss := range shardInfo.SourceShards {
+		if ss.Uid == uid {
+			shardInfo.SourceShards = append(shardInfo.SourceShards[:i], shardInfo.SourceShards[i+1:]...)
+			return wr.ts.UpdateShard(shardInfo)
+		}
+	}
+	return fmt.Errorf("shard %v/%v has no SourceShard with uid %v", keyspace, shard, uid)
+}
+
+// ServingGraphRebuildError is returned when a shard record was
+// updated, but its serving graph couldn't be rebuilt in some cells.
+// RebuildShardGraph can be run again for them.
+type ServingGraphRebuildError struct {
+	Keyspace string
+	Shard    string
+	// Errors has the rebuild error of each failed cell.
+	Errors map[string]error
+}
+
+func (e *ServingGraphRebuildError) Error() string {
+	cells := make([]string, 0, len(e.Errors))
+	for cell := range e.Errors {
+		cells = append(cells, cell)
+	}
+	sort.Strings(cells)
+	msgs := make([]string, len(cells))
+	for i, cell := range cells {
+		msgs[i] = fmt.Sprintf("cell %v: %v", cell, e.Errors[cell])
+	}
+	return fmt.Sprintf("shard %v/%v was updated, but its serving graph couldn't be rebuilt in %v:\n%v", e.Keyspace, e.Shard, strings.Join(cells, ","), strings.Join(msgs, "\n"))
+}
+
+// rebuildShardCells rebuilds the serving graph of each cell of a
+// locked shard, one cell at a time so the errors are known per cell.
+func (wr *Wrangler) rebuildShardCells(shardInfo *topo.ShardInfo) error {
+	errs := make(map[string]error)
+	for _, cell := range shardInfo.Cells {
+		if err := wr.rebuildShard(shardInfo.Keyspace(), shardInfo.ShardName(), rebuildShardOptions{Cells: []string{cell}}); err != nil {
+			errs[cell] = err
+		}
+	}
+	if len(errs) > 0 {
+		return &ServingGraphRebuildError{Keyspace: shardInfo.Keyspace(), Shard: shardInfo.ShardName(), Errors: errs}
+	}
+	return nil
+}
+
+// CreateShard creates a shard, and its keyspace if it doesn't exist.
+// The shard name is a key range like "80-c0", or an unsharded name
+// like "0" that covers the whole keyspace, as "-" does. Unless force,
+// the shard can't overlap the key range of another shard of the
+// keyspace. The keyspace is locked, so concurrent creations can't
+// overlap. The shard has no cells and no master, it serves the types
+// no overlapping shard serves. topo.ErrNodeExists is returned if the
+// shard exists.
+func (wr *Wrangler) CreateShard(keyspace, shard string, force bool) (err error) {
+	defer recordAction("CreateShard", keyspace, time.Now(), &err)
+
+	if _, _, err := topo.ValidateShardName(shard); err != nil {
+		return err
+	}
+	if err := wr.ts.CreateKeyspace(keyspace, &topo.Keyspace{}); err != nil && err != topo.ErrNodeExists {
+		return err
+	}
+
+	actionNode := actionnode.CreateShard(shard, force)
+	lockPath, err := wr.lockKeyspace(keyspace, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.createShard(keyspace, shard, force)
+	return wr.unlockKeyspace(keyspace, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) createShard(keyspace, shard string, force bool) error {
+	name, keyRange, err := topo.ValidateShardName(shard)
 	if err != nil {
 		return err
 	}
+	sis, err := topo.FindAllShardsInKeyspace(wr.ts, keyspace)
+	if err != nil && err != topo.ErrNoNode {
+		return err
+	}
+	if _, ok := sis[name]; ok {
+		return topo.ErrNodeExists
+	}
+
+	var overlapping []string
+	for other, si := range sis {
+		if key.KeyRangesIntersect(si.KeyRange, keyRange) {
+			overlapping = append(overlapping, other)
+		}
+	}
+	if len(overlapping) > 0 {
+		sort.Strings(overlapping)
+		if !force {
+			return fmt.Errorf("shard %v/%v would overlap shard(s) %v, use -force to create it anyway", keyspace, name, strings.Join(overlapping, ", "))
+		}
+		wr.logger.Warningf("Creating shard %v/%v overlapping shard(s) %v", keyspace, name, strings.Join(overlapping, ", "))
+	}
+
+	wr.logger.Infof("Creating shard %v/%v", keyspace, name)
+	return topo.CreateShard(wr.ts, keyspace, name)
+}
+
+// DeleteShardOptions are the options of DeleteShard. The zero value
+// only deletes a shard without tablets whose cells are all reachable,
+// and doesn't rebuild the keyspace graph.
+type DeleteShardOptions struct {
+	// RebuildKeyspace first checks the other shards still cover the
+	// whole keyspace for the types they serve, before any tablet is
+	// deleted, and rebuilds the SrvKeyspace in the cells of the shard
+	// once it is deleted. Otherwise, DeleteShard warns about the
+	// cells whose SrvKeyspace still references the shard: vtgate
+	// would keep routing queries to it until the keyspace graph is
+	// rebuilt.
+	RebuildKeyspace bool
+
+	// Force deletes the shard even if the topology servers of some
+	// of its cells are unreachable.
+	Force bool
+
+	// Recursive scraps and deletes the tablets of the shard first,
+	// see deleteShardTablets.
+	Recursive bool
+
+	// EvenIfServing deletes the master tablet too, with Recursive.
+	EvenIfServing bool
+}
+
+// DeleteShard will do all the necessary changes in the topology server
+// to entirely remove a shard. It can only work if there are no tablets
+// in that shard, unless options.Recursive is set.
+// A cell whose topology server is unreachable is skipped as soon as it
+// is detected, and blocks the deletion of the shard unless
+// options.Force is set. The skipped cells are returned in both cases.
+func (wr *Wrangler) DeleteShard(keyspace, shard string, options DeleteShardOptions) (skipped []SkippedShardCell, err error) {
+	defer recordAction("DeleteShard", keyspace, time.Now(), &err)
+
+	shardInfo, err := wr.ts.GetShard(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+
+	tabletMap, err := GetTabletMapForShard(wr.ts, keyspace, shard)
+	switch err {
+	case nil:
+	case topo.ErrPartialResult:
+		// some cells couldn't be read, they're reported below
+		if !options.Force {
+			return nil, fmt.Errorf("cannot check shard %v/%v has no tablets, some cells are unreachable, use -force to delete it anyway", keyspace, shard)
+		}
+		wr.logger.Warningf("Cannot read the tablets of %v/%v in all cells, forcing the deletion", keyspace, shard)
+	default:
+		return nil, err
+	}
+	if len(tabletMap) > 0 && !options.Recursive {
+		return nil, fmt.Errorf("shard %v/%v still has %v tablets, use -recursive to delete them", keyspace, shard, len(tabletMap))
+	}
+
+	// the checks that can refuse the deletion are done before any
+	// tablet is deleted
+	otherShards := 0
+	if options.RebuildKeyspace {
+		if otherShards, err = wr.checkRemainingShardsCoverage(keyspace, shard); err != nil {
+			return nil, err
+		}
+	}
 	if len(tabletMap) > 0 {
-		return fmt.Errorf("shard %v/%v still has %v tablets", keyspace, shard, len(tabletMap))
+		wr.dryRunNote("no tablet is added to %v/%v before the deletion, only its %v tablet(s) found are deleted", keyspace, shard, len(tabletMap))
+		if err := wr.deleteShardTablets(keyspace, shard, tabletMap, options.EvenIfServing); err != nil {
+			return nil, err
+		}
 	}
 
 	// remove the replication graph and serving graph in each cell
-	for _, cell := range shardInfo.Cells {
-		if err := wr.ts.DeleteShardReplication(cell, keyspace, shard); err != nil {
-			log.Warningf("Cannot delete ShardReplication in cell %v for %v/%v: %v", cell, keyspace, shard, err)
+	var reachableCells []string
+	for i, cell := range shardInfo.Cells {
+		wr.logger.Progress(&ProgressEvent{
+			Operation: "DeleteShard",
+			Keyspace:  keyspace,
+			Shard:     shard,
+			Step:      "delete replication and serving graphs in cell " + cell,
+			Current:   i + 1,
+			Total:     len(shardInfo.Cells),
+		})
+		if left, _ := wr.deleteShardCellGraphs(cell, keyspace, shard, false); len(left) > 0 {
+			wr.logger.Warningf("Cell %v is unreachable, skipping the deletion of %v for %v/%v there", cell, strings.Join(left, ", "), keyspace, shard)
+			skipped = append(skipped, SkippedShardCell{Cell: cell, Objects: left})
+			continue
+		}
+		reachableCells = append(reachableCells, cell)
+	}
+	if len(skipped) > 0 {
+		if !options.Force {
+			return skipped, fmt.Errorf("cannot delete shard %v/%v, %v cell(s) are unreachable, use -force to delete it anyway", keyspace, shard, len(skipped))
 		}
+		wr.logger.Warningf("Deleting shard %v/%v with %v unreachable cell(s), their objects need to be deleted once they are back: %v", keyspace, shard, len(skipped), skipped)
+	}
+
+	wr.logger.Infof("Deleting shard %v/%v", keyspace, shard)
+	if err := wr.ts.DeleteShard(keyspace, shard); err != nil {
+		return skipped, err
+	}
+
+	if options.RebuildKeyspace && otherShards > 0 && (len(reachableCells) > 0 || len(shardInfo.Cells) == 0) {
+		wr.logger.Infof("Rebuilding keyspace %v in cells %v", keyspace, reachableCells)
+		if err := wr.RebuildKeyspaceGraph(keyspace, reachableCells); err != nil {
+			return skipped, fmt.Errorf("shard %v/%v was deleted, but rebuilding keyspace %v failed, run RebuildKeyspaceGraph: %v", keyspace, shard, keyspace, err)
+		}
+		return skipped, nil
+	}
+	wr.warnStaleSrvKeyspaces(keyspace, shard, shardInfo, skipped)
+	return skipped, nil
+}
 
-		for _, t := range topo.AllTabletTypes {
-			if !topo.IsInServingGraph(t) {
-				continue
+// deleteShardTablets scraps and deletes the tablets of a shard, for
+// DeleteShard. Unless evenIfServing is set, it refuses to do anything
+// if one of them is a master. A tablet that fails doesn't stop the
+// others: the returned error lists all the failures. A scrapped tablet
+// is not in the replication graph anymore, so the ones that couldn't
+// be deleted need to be deleted by hand.
+func (wr *Wrangler) deleteShardTablets(keyspace, shard string, tabletMap map[topo.TabletAlias]*topo.TabletInfo, evenIfServing bool) error {
+	aliases := make([]topo.TabletAlias, 0, len(tabletMap))
+	for alias := range tabletMap {
+		aliases = append(aliases, alias)
+	}
+	sort.Sort(topo.TabletAliasList(aliases))
+	if !evenIfServing {
+		for _, alias := range aliases {
+			if tabletMap[alias].Type == topo.TYPE_MASTER {
+				return fmt.Errorf("shard %v/%v has the master tablet %v, use -even_if_serving to delete it", keyspace, shard, alias)
 			}
+		}
+	}
+
+	rec := concurrency.AllErrorRecorder{}
+	for i, alias := range aliases {
+		wr.logger.Progress(&ProgressEvent{
+			Operation: "DeleteShard",
+			Keyspace:  keyspace,
+			Shard:     shard,
+			Step:      "delete tablet " + alias.String(),
+			Current:   i + 1,
+			Total:     len(aliases),
+		})
+		if err := tabletmanager.Scrap(wr.ts, alias, true); err != nil && err != topo.ErrNoNode {
+			rec.RecordError(fmt.Errorf("cannot scrap tablet %v: %v", alias, err))
+			continue
+		}
+		if err := wr.ts.DeleteTablet(alias); err != nil && err != topo.ErrNoNode {
+			rec.RecordError(fmt.Errorf("cannot delete tablet %v, it is scrapped but still exists: %v", alias, err))
+		}
+	}
+	if rec.HasErrors() {
+		return fmt.Errorf("cannot delete %v of the %v tablets of shard %v/%v:\n%v", len(rec.Errors), len(aliases), keyspace, shard, rec.Error())
+	}
+	return nil
+}
+
+// SkippedShardCell is a cell where DeleteShard couldn't delete the
+// replication and serving graphs of the shard, because its topology
+// server was unreachable.
+type SkippedShardCell struct {
+	Cell string
+
+	// Objects are what is left of the shard in the cell, e.g.
+	// "SrvShard". They need to be deleted once the cell is back.
+	Objects []string
+}
+
+func (ssc SkippedShardCell) String() string {
+	return fmt.Sprintf("%v: %v", ssc.Cell, strings.Join(ssc.Objects, ", "))
+}
 
-			if err := wr.ts.DeleteSrvTabletType(cell, keyspace, shard, t); err != nil && err != topo.ErrNoNode {
-				log.Warningf("Cannot delete EndPoints in cell %v for %v/%v/%v: %v", cell, keyspace, shard, t, err)
+// deleteShardCellGraphs removes the replication graph and serving graph
+// of a shard in a cell. If the topology server of the cell is
+// unreachable, it stops right away, and returns the objects left.
+// The other errors are returned if strict is set, and only logged
+// otherwise.
+func (wr *Wrangler) deleteShardCellGraphs(cell, keyspace, shard string, strict bool) ([]string, error) {
+	type step struct {
+		object string
+		delete func() error
+	}
+	steps := []step{
+		step{"ShardReplication", func() error { return wr.ts.DeleteShardReplication(cell, keyspace, shard) }},
+	}
+	for _, t := range topo.AllTabletTypes {
+		if !topo.IsInServingGraph(t) {
+			continue
+		}
+		tabletType := t
+		steps = append(steps, step{"EndPoints " + string(tabletType), func() error { return wr.ts.DeleteSrvTabletType(cell, keyspace, shard, tabletType) }})
+	}
+	steps = append(steps, step{"SrvShard", func() error { return wr.ts.DeleteSrvShard(cell, keyspace, shard) }})
+
+	for i, s := range steps {
+		switch err := s.delete(); err {
+		case nil, topo.ErrNoNode:
+		case topo.ErrUnreachable:
+			left := make([]string, 0, len(steps)-i)
+			for _, s := range steps[i:] {
+				left = append(left, s.object)
+			}
+			return left, nil
+		default:
+			if strict {
+				return nil, fmt.Errorf("error deleting %v object in cell %v: %v", s.object, cell, err)
 			}
+			wr.logger.Warningf("Cannot delete %v in cell %v for %v/%v: %v", s.object, cell, keyspace, shard, err)
+		}
+	}
+	return nil, nil
+}
+
+// checkRemainingShardsCoverage checks that the shards of a keyspace,
+// other than the one about to be deleted, still cover the whole
+// keyspace for each type they serve. It returns how many they are.
+func (wr *Wrangler) checkRemainingShardsCoverage(keyspace, deletedShard string) (int, error) {
+	shards, err := wr.ts.GetShardNames(keyspace)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	partitions := make(map[topo.TabletType][]topo.SrvShard)
+	for _, shard := range shards {
+		if shard == deletedShard {
+			continue
+		}
+		count++
+		si, err := wr.ts.GetShard(keyspace, shard)
+		if err != nil {
+			return 0, err
+		}
+		for _, tabletType := range si.ServedTypes {
+			partitions[tabletType] = append(partitions[tabletType], topo.SrvShard{KeyRange: si.KeyRange, ServedTypes: si.ServedTypes})
+		}
+	}
+	for tabletType, partition := range partitions {
+		if err := checkPartitionCoverage(tabletType, partition); err != nil {
+			return 0, fmt.Errorf("cannot delete shard %v/%v, the other shards wouldn't cover the keyspace: %v", keyspace, deletedShard, err)
 		}
+	}
+	return count, nil
+}
 
-		if err := wr.ts.DeleteSrvShard(cell, keyspace, shard); err != nil && err != topo.ErrNoNode {
-			log.Warningf("Cannot delete SrvShard in cell %v for %v/%v: %v", cell, keyspace, shard, err)
+// warnStaleSrvKeyspaces logs a warning listing the cells whose
+// SrvKeyspace still references a deleted shard, except the skipped
+// ones.
+func (wr *Wrangler) warnStaleSrvKeyspaces(keyspace, shard string, shardInfo *topo.ShardInfo, skipped []SkippedShardCell) {
+	cells, err := wr.ts.GetKnownCells()
+	if err != nil {
+		wr.logger.Warningf("Cannot check the SrvKeyspace of %v still references deleted shard %v, run RebuildKeyspaceGraph: %v", keyspace, shard, err)
+		return
+	}
+	skippedCells := make(map[string]bool)
+	for _, ssc := range skipped {
+		skippedCells[ssc.Cell] = true
+	}
+	var staleCells []string
+	for _, cell := range cells {
+		if skippedCells[cell] {
+			continue
 		}
+		srvKeyspace, err := wr.ts.GetSrvKeyspace(cell, keyspace)
+		if err != nil {
+			if err != topo.ErrNoNode {
+				wr.logger.Warningf("Cannot read SrvKeyspace in cell %v for %v: %v", cell, keyspace, err)
+			}
+			continue
+		}
+		if srvKeyspaceHasShard(srvKeyspace, shardInfo.KeyRange) {
+			staleCells = append(staleCells, cell)
+		}
+	}
+	if len(staleCells) > 0 {
+		wr.logger.Warningf("SrvKeyspace of %v in cells %v still references deleted shard %v, vtgate will keep sending queries to it: run RebuildKeyspaceGraph %v", keyspace, staleCells, shard, keyspace)
 	}
+}
 
-	return wr.ts.DeleteShard(keyspace, shard)
+// srvKeyspaceHasShard returns true if one of the partitions of a
+// SrvKeyspace has a shard with the KeyRange.
+func srvKeyspaceHasShard(srvKeyspace *topo.SrvKeyspace, keyRange key.KeyRange) bool {
+	for _, partition := range srvKeyspace.Partitions {
+		for _, srvShard := range partition.Shards {
+			if srvShard.KeyRange == keyRange {
+				return true
+			}
+		}
+	}
+	for _, srvShard := range srvKeyspace.Shards {
+		if srvShard.KeyRange == keyRange {
+			return true
+		}
+	}
+	return false
 }
 
 // RemoveShardCell will remove a cell from the Cells list in a shard.
-// It will first check the shard has no tablets there.  if 'force' is
-// specified, it will remove the cell even when the tablet map cannot
-// be retrieved. This is intended to be used when a cell is completely
-// down and its topology server cannot even be reached.
-func (wr *Wrangler) RemoveShardCell(keyspace, shard, cell string, force bool) error {
+// It will first check the shard has no tablets there, and then delete
+// the replication and serving graphs of the shard in the cell, as
+// DeleteShard does.  if 'force' is specified, it will remove the cell
+// even when the tablet map cannot be retrieved, or the graphs cannot
+// be deleted, and log what is left in the cell. This is intended to be
+// used when a cell is completely down and its topology server cannot
+// even be reached. lockOptions control the wait for the lock of the
+// shard, nil for the defaults.
+func (wr *Wrangler) RemoveShardCell(keyspace, shard, cell string, force bool, lockOptions *ShardLockOptions) (err error) {
+	defer recordAction("RemoveShardCell", keyspace, time.Now(), &err)
+
 	actionNode := actionnode.UpdateShard()
-	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	lockPath, err := wr.lockShardWithOptions(keyspace, shard, actionNode, lockOptions)
 	if err != nil {
 		return err
 	}
@@ -133,45 +1008,385 @@ func (wr *Wrangler) removeShardCell(keyspace, shard, cell string, force bool) er
 		return fmt.Errorf("cell %v in not in shard info", cell)
 	}
 
+	unreachable, err := wr.checkShardCellEmpty(shardInfo, cell)
+	switch {
+	case err == nil:
+		if err := wr.deleteRemovedShardCellGraphs(cell, keyspace, shard, force); err != nil {
+			return err
+		}
+	case unreachable:
+		// we can't get the object, assume topo server is down there,
+		// so we look at force flag
+		if !force {
+			return err
+		}
+		wr.warnUnreachableShardCell(cell, keyspace, shard)
+	default:
+		return err
+	}
+
+	// now we can update the shard
+	wr.logger.Infof("Removing cell %v from shard %v/%v", cell, keyspace, shard)
+	newCells := make([]string, 0, len(shardInfo.Cells)-1)
+	for _, c := range shardInfo.Cells {
+		if c != cell {
+			newCells = append(newCells, c)
+		}
+	}
+	shardInfo.Cells = newCells
+
+	return wr.ts.UpdateShard(shardInfo)
+}
+
+// deleteRemovedShardCellGraphs deletes the replication and serving
+// graphs of a shard in a cell removed from its Cells, once
+// checkShardCellEmpty checked it. They are now useless, and vtgate
+// stops routing to the cell. If the cell is unreachable, what is left
+// there is logged with force, and an error otherwise. The other errors
+// are always returned.
+func (wr *Wrangler) deleteRemovedShardCellGraphs(cell, keyspace, shard string, force bool) error {
+	wr.dryRunNote("no tablet of %v/%v is added in cell %v before the removal", keyspace, shard, cell)
+	left, err := wr.deleteShardCellGraphs(cell, keyspace, shard, true)
+	if err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		if !force {
+			return fmt.Errorf("cell %v is unreachable, cannot delete %v for %v/%v there, use -force to remove the cell anyway", cell, strings.Join(left, ", "), keyspace, shard)
+		}
+		wr.logger.Warningf("Cell %v is unreachable, skipping the deletion of %v for %v/%v there, they need to be deleted once it is back", cell, strings.Join(left, ", "), keyspace, shard)
+	}
+	return nil
+}
+
+// warnUnreachableShardCell logs that a cell is removed from a shard
+// with force, while its ShardReplication couldn't be read.
+func (wr *Wrangler) warnUnreachableShardCell(cell, keyspace, shard string) {
+	wr.logger.Warningf("Cannot get ShardReplication from cell %v, assuming cell topo server is down, and forcing the removal. The ShardReplication, SrvShard and EndPoints of %v/%v in cell %v need to be deleted once it is back", cell, keyspace, shard, cell)
+}
+
+// checkShardCellEmpty checks a cell can be removed from the Cells of a
+// shard: the master of the shard is not in the cell, and the
+// ShardReplication of the shard there has no links. No
+// ShardReplication means no tablets. If it cannot be read, unreachable
+// is set with the error, as the cell can then be removed with force.
+func (wr *Wrangler) checkShardCellEmpty(shardInfo *topo.ShardInfo, cell string) (unreachable bool, err error) {
 	// check the master alias is not in the cell
 	if shardInfo.MasterAlias.Cell == cell {
-		return fmt.Errorf("master %v is in the cell '%v' we want to remove", shardInfo.MasterAlias, cell)
+		return false, fmt.Errorf("master %v is in the cell '%v' we want to remove", shardInfo.MasterAlias, cell)
 	}
 
 	// get the ShardReplication object in the cell
-	sri, err := wr.ts.GetShardReplication(cell, keyspace, shard)
+	sri, err := wr.ts.GetShardReplication(cell, shardInfo.Keyspace(), shardInfo.ShardName())
 	switch err {
 	case nil:
 		if len(sri.ReplicationLinks) > 0 {
-			return fmt.Errorf("cell %v has %v possible tablets in replication graph", cell, len(sri.ReplicationLinks))
+			return false, fmt.Errorf("cell %v has %v possible tablets in replication graph", cell, len(sri.ReplicationLinks))
+		}
+	case topo.ErrNoNode:
+	default:
+		return true, err
+	}
+	return false, nil
+}
+
+// hasCell returns true if cells has cell. Unlike topo.InCellList, an
+// empty list has no cell.
+func hasCell(cell string, cells []string) bool {
+	for _, c := range cells {
+		if c == cell {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKnownCells checks the cells are known to the topology server,
+// and not repeated.
+func (wr *Wrangler) checkKnownCells(cells []string) error {
+	knownCells, err := wr.ts.GetKnownCells()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, cell := range cells {
+		if !hasCell(cell, knownCells) {
+			return fmt.Errorf("unknown cell %v, the known cells are %v", cell, strings.Join(knownCells, ","))
+		}
+		if seen[cell] {
+			return fmt.Errorf("cell %v is listed twice", cell)
+		}
+		seen[cell] = true
+	}
+	return nil
+}
+
+// AddShardCell adds a known cell to the Cells list of a shard, before
+// any tablet of the shard registers there. It does nothing if the cell
+// is in the list already.
+func (wr *Wrangler) AddShardCell(keyspace, shard, cell string) (err error) {
+	defer recordAction("AddShardCell", keyspace, time.Now(), &err)
+
+	if err := wr.checkKnownCells([]string{cell}); err != nil {
+		return err
+	}
+
+	actionNode := actionnode.UpdateShard()
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.addShardCell(keyspace, shard, cell)
+	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) addShardCell(keyspace, shard, cell string) error {
+	shardInfo, err := wr.ts.GetShardCritical(keyspace, shard)
+	if err != nil {
+		return err
+	}
+	if hasCell(cell, shardInfo.Cells) {
+		wr.logger.Infof("Cell %v is already in shard %v/%v", cell, keyspace, shard)
+		return nil
+	}
+
+	wr.logger.Infof("Adding cell %v to shard %v/%v", cell, keyspace, shard)
+	shardInfo.Cells = append(shardInfo.Cells, cell)
+	return wr.ts.UpdateShard(shardInfo)
+}
+
+// SetShardCells replaces the Cells list of a shard. The cells must be
+// known and not repeated. A cell can only be removed from the list if
+// the master of the shard is not there, and the replication graph of
+// the shard there has no tablets, as RemoveShardCell checks. All the
+// removed cells are checked before the replication and serving graphs
+// of the shard are deleted in them. force works as for
+// RemoveShardCell, for the removed cells whose topology server is
+// unreachable.
+// The shard is only updated if the list changes, the order of the
+// cells doesn't matter.
+func (wr *Wrangler) SetShardCells(keyspace, shard string, cells []string, force bool) (err error) {
+	defer recordAction("SetShardCells", keyspace, time.Now(), &err)
+
+	if err := wr.checkKnownCells(cells); err != nil {
+		return err
+	}
+
+	actionNode := actionnode.UpdateShard()
+	lockPath, err := wr.lockShard(keyspace, shard, actionNode)
+	if err != nil {
+		return err
+	}
+
+	err = wr.setShardCells(keyspace, shard, cells, force)
+	return wr.unlockShard(keyspace, shard, actionNode, lockPath, err)
+}
+
+func (wr *Wrangler) setShardCells(keyspace, shard string, cells []string, force bool) error {
+	shardInfo, err := wr.ts.GetShardCritical(keyspace, shard)
+	if err != nil {
+		return err
+	}
+
+	changed := len(cells) != len(shardInfo.Cells)
+	for _, cell := range cells {
+		if !hasCell(cell, shardInfo.Cells) {
+			changed = true
+		}
+	}
+	if !changed {
+		wr.logger.Infof("Shard %v/%v already has cells %v", keyspace, shard, shardInfo.Cells)
+		return nil
+	}
+
+	var removed []string
+	for _, cell := range shardInfo.Cells {
+		if hasCell(cell, cells) {
+			continue
+		}
+		unreachable, err := wr.checkShardCellEmpty(shardInfo, cell)
+		switch {
+		case err == nil:
+			removed = append(removed, cell)
+		case unreachable && force:
+			wr.warnUnreachableShardCell(cell, keyspace, shard)
+		default:
+			return fmt.Errorf("cannot remove cell %v from shard %v/%v: %v", cell, keyspace, shard, err)
+		}
+	}
+	for _, cell := range removed {
+		if err := wr.deleteRemovedShardCellGraphs(cell, keyspace, shard, force); err != nil {
+			return err
+		}
+	}
+
+	wr.logger.Infof("Changing the cells of shard %v/%v from %v to %v", keyspace, shard, shardInfo.Cells, cells)
+	shardInfo.Cells = cells
+	return wr.ts.UpdateShard(shardInfo)
+}
+
+// ShardCellRemoval is what RemoveCellFromShards did, or would do in a
+// dry run, for one shard.
+type ShardCellRemoval struct {
+	Shard string
+
+	// Skipped is set if the cell is not in the Cells of the shard.
+	Skipped bool
+
+	// Tablets are the tablets of the shard in the cell. With
+	// recursive, they are deleted before the cell is removed.
+	Tablets []topo.TabletAlias
+
+	// Err is why the cell couldn't be removed from the shard, or in
+	// a dry run, what blocks the removal.
+	Err error
+}
+
+// Removed returns true if the cell was removed from the shard, or in a
+// dry run, if it can be.
+func (scr *ShardCellRemoval) Removed() bool {
+	return !scr.Skipped && scr.Err == nil
+}
+
+func (scr *ShardCellRemoval) String() string {
+	switch {
+	case scr.Skipped:
+		return fmt.Sprintf("%v: skipped, not in the cell", scr.Shard)
+	case scr.Err != nil:
+		return fmt.Sprintf("%v: failed: %v", scr.Shard, scr.Err)
+	case len(scr.Tablets) > 0:
+		return fmt.Sprintf("%v: removed, with tablets %v", scr.Shard, scr.Tablets)
+	}
+	return fmt.Sprintf("%v: removed", scr.Shard)
+}
+
+// RemoveCellFromShards removes a cell from the Cells list of several
+// shards of a keyspace, all of them if shards is empty or "all". Each
+// shard is updated under its own lock, at most concurrency shards at a
+// time, by the same logic as RemoveShardCell. With recursive, the
+// tablets of a shard in the cell are scrapped and deleted first,
+// otherwise they block the removal. A master in the cell always does.
+// With dryRun, nothing is changed: the results list the shards that
+// would be updated, and what blocks the others.
+// It returns the results sorted by shard, and an error listing the
+// shards the cell couldn't be removed from.
+func (wr *Wrangler) RemoveCellFromShards(keyspace, cell string, shards []string, force, recursive, dryRun bool, concurrency int) (results []ShardCellRemoval, err error) {
+	defer recordAction("RemoveCellFromShards", keyspace, time.Now(), &err)
+
+	if len(shards) == 0 || (len(shards) == 1 && shards[0] == "all") {
+		if shards, err = wr.ts.GetShardNames(keyspace); err != nil {
+			return nil, err
+		}
+	}
+	shards = append([]string(nil), shards...)
+	sort.Strings(shards)
+
+	results = make([]ShardCellRemoval, len(shards))
+	for i, shard := range shards {
+		results[i].Shard = shard
+	}
+	runConcurrently(len(shards), concurrency, func(i int) {
+		if dryRun {
+			wr.checkShardCellRemoval(keyspace, cell, force, recursive, &results[i])
+		} else {
+			wr.removeCellFromShard(keyspace, cell, force, recursive, &results[i])
+		}
+	})
+
+	var failed []string
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.Shard)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("cannot remove cell %v from %v shard(s) of %v: %v", cell, len(failed), keyspace, strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// removeCellFromShard removes a cell from a shard under the shard lock,
+// after deleting its tablets there with recursive.
+func (wr *Wrangler) removeCellFromShard(keyspace, cell string, force, recursive bool, result *ShardCellRemoval) {
+	actionNode := actionnode.UpdateShard()
+	lockPath, err := wr.lockShard(keyspace, result.Shard, actionNode)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	wr.checkShardCellRemoval(keyspace, cell, force, recursive, result)
+	if result.Err == nil && !result.Skipped {
+		result.Err = wr.deleteShardCellTablets(keyspace, result.Shard, result.Tablets)
+		if result.Err == nil {
+			result.Err = wr.removeShardCell(keyspace, result.Shard, cell, force)
 		}
+	}
+	result.Err = wr.unlockShard(keyspace, result.Shard, actionNode, lockPath, result.Err)
+}
 
-		// ShardReplication object is now useless, remove it
-		if err := wr.ts.DeleteShardReplication(cell, keyspace, shard); err != nil {
-			return fmt.Errorf("error deleting ShardReplication object in cell %v: %v", cell, err)
+// checkShardCellRemoval fills in a ShardCellRemoval without changing
+// anything: whether the shard is in the cell, its tablets there, and
+// what blocks the removal of the cell.
+func (wr *Wrangler) checkShardCellRemoval(keyspace, cell string, force, recursive bool, result *ShardCellRemoval) {
+	shardInfo, err := wr.ts.GetShard(keyspace, result.Shard)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	inCell := false
+	for _, c := range shardInfo.Cells {
+		if c == cell {
+			inCell = true
 		}
+	}
+	if !inCell {
+		result.Skipped = true
+		return
+	}
+
+	if shardInfo.MasterAlias.Cell == cell {
+		result.Err = fmt.Errorf("master %v is in the cell '%v' we want to remove", shardInfo.MasterAlias, cell)
+		return
+	}
 
-		// we keep going
+	sri, err := wr.ts.GetShardReplication(cell, keyspace, result.Shard)
+	switch err {
+	case nil:
+		result.Tablets = nil
+		for _, link := range sri.ReplicationLinks {
+			result.Tablets = append(result.Tablets, link.TabletAlias)
+		}
+		if len(result.Tablets) > 0 && !recursive {
+			result.Err = fmt.Errorf("cell %v has %v possible tablets in replication graph", cell, len(result.Tablets))
+		}
 	case topo.ErrNoNode:
-		// no ShardReplication object, we keep going
+		// no ShardReplication object, no tablets
 	default:
 		// we can't get the object, assume topo server is down there,
-		// so we look at force flag
+		// removeShardCell looks at the force flag
 		if !force {
-			return err
+			result.Err = err
 		}
-		log.Warningf("Cannot get ShardReplication from cell %v, assuming cell topo server is down, and forcing the removal", cell)
 	}
+}
 
-	// now we can update the shard
-	log.Infof("Removing cell %v from shard %v/%v", cell, keyspace, shard)
-	newCells := make([]string, 0, len(shardInfo.Cells)-1)
-	for _, c := range shardInfo.Cells {
-		if c != cell {
-			newCells = append(newCells, c)
+// deleteShardCellTablets scraps and deletes the tablets of a shard, and
+// removes them from its replication graph.
+func (wr *Wrangler) deleteShardCellTablets(keyspace, shard string, tablets []topo.TabletAlias) error {
+	for _, alias := range tablets {
+		wr.logger.Infof("Deleting tablet %v of shard %v/%v", alias, keyspace, shard)
+		if err := tabletmanager.Scrap(wr.ts, alias, true); err != nil && err != topo.ErrNoNode {
+			return fmt.Errorf("cannot scrap tablet %v: %v", alias, err)
+		}
+		if err := wr.ts.DeleteTablet(alias); err != nil && err != topo.ErrNoNode {
+			return fmt.Errorf("cannot delete tablet %v: %v", alias, err)
+		}
+		if err := topo.RemoveShardReplicationRecord(wr.ts, keyspace, shard, alias); err != nil && err != topo.ErrNoNode {
+			return fmt.Errorf("cannot remove tablet %v from the replication graph: %v", alias, err)
 		}
 	}
-	shardInfo.Cells = newCells
-
-	return wr.ts.UpdateShard(shardInfo)
+	return nil
 }
@@ -0,0 +1,1695 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+func TestShardActionLog(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+	wr.ActionLogMaxEntries = 2
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	start := time.Now()
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, nil); err != nil {
+		t.Fatalf("SetShardServedTypes failed: %v", err)
+	}
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA}, false, false, nil); err != nil {
+		t.Fatalf("SetShardServedTypes failed: %v", err)
+	}
+
+	// a failing action is logged too
+	actionNode := actionnode.SetShardServedTypes(nil)
+	lockPath, err := wr.lockShard("test_keyspace", "0", actionNode)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+	if err := wr.unlockShard("test_keyspace", "0", actionNode, lockPath, topo.ErrBadVersion); err != topo.ErrBadVersion {
+		t.Errorf("unlockShard: want %v, got %v", topo.ErrBadVersion, err)
+	}
+
+	entries, err := wr.GetShardActionLog("test_keyspace", "0", 0)
+	if err != nil {
+		t.Fatalf("GetShardActionLog failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("want 2 entries, got %v", len(entries))
+	}
+	if e := entries[0]; e.Action != actionnode.SHARD_ACTION_SET_SERVED_TYPES || e.State != actionnode.ACTION_STATE_FAILED || e.Error != topo.ErrBadVersion.Error() {
+		t.Errorf("unexpected first entry: %+v", e)
+	}
+	e := entries[1]
+	if e.State != actionnode.ACTION_STATE_DONE || e.Error != "" || !strings.Contains(e.Params, "replica") {
+		t.Errorf("unexpected second entry: %+v", e)
+	}
+	if e.StartTime.Before(start) || e.EndTime.Before(e.StartTime) || e.User == "" || e.Host == "" {
+		t.Errorf("unexpected second entry: %+v", e)
+	}
+
+	if entries, err := wr.GetShardActionLog("test_keyspace", "0", 1); err != nil || len(entries) != 1 {
+		t.Errorf("GetShardActionLog(limit 1): %v %v", entries, err)
+	}
+}
+
+func TestDeleteShardLogger(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+	logger := NewRecordingLogger()
+	wr.SetLogger(logger)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	for _, cell := range si.Cells {
+		if err := ts.CreateShardReplication(cell, "test_keyspace", "0", &topo.ShardReplication{}); err != nil {
+			t.Fatalf("CreateShardReplication failed: %v", err)
+		}
+	}
+
+	if _, err := wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{RebuildKeyspace: true}); err != nil {
+		t.Fatalf("DeleteShard failed: %v", err)
+	}
+	want := []string{
+		"P DeleteShard test_keyspace/0: delete replication and serving graphs in cell cell1 (1/2)",
+		"P DeleteShard test_keyspace/0: delete replication and serving graphs in cell cell2 (2/2)",
+		"I Deleting shard test_keyspace/0",
+	}
+	got := logger.Events()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected events:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDeleteShardRebuild(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard(%v) failed: %v", shard, err)
+		}
+	}
+	si, err := ts.GetShard("test_keyspace", "-80")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	// the serving graph of -80 in cell1 creates the SrvKeyspace node
+	if err := ts.UpdateEndPoints("cell1", "test_keyspace", "-80", topo.TYPE_MASTER, &topo.EndPoints{}); err != nil {
+		t.Fatalf("UpdateEndPoints failed: %v", err)
+	}
+	if err := ts.UpdateSrvKeyspace("cell1", "test_keyspace", &topo.SrvKeyspace{
+		Partitions: map[topo.TabletType]*topo.KeyspacePartition{
+			topo.TYPE_MASTER: &topo.KeyspacePartition{
+				Shards: []topo.SrvShard{
+					topo.SrvShard{KeyRange: si.KeyRange},
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("UpdateSrvKeyspace failed: %v", err)
+	}
+
+	// -80 is the only shard serving its half of the keyspace
+	_, err = wr.DeleteShard("test_keyspace", "-80", DeleteShardOptions{RebuildKeyspace: true})
+	if err == nil || !strings.Contains(err.Error(), "wouldn't cover the keyspace") {
+		t.Errorf("DeleteShard(-80) returned %v, want a coverage error", err)
+	}
+	if _, err := ts.GetShard("test_keyspace", "-80"); err != nil {
+		t.Errorf("GetShard(-80) after a failed DeleteShard: %v", err)
+	}
+
+	// without the rebuild, the stale SrvKeyspace is reported
+	logger := NewRecordingLogger()
+	wr.SetLogger(logger)
+	if _, err := wr.DeleteShard("test_keyspace", "-80", DeleteShardOptions{}); err != nil {
+		t.Fatalf("DeleteShard(-80) failed: %v", err)
+	}
+	want := "W SrvKeyspace of test_keyspace in cells [cell1] still references deleted shard -80"
+	if got := strings.Join(logger.Events(), "\n"); !strings.Contains(got, want) {
+		t.Errorf("unexpected events:\n%v\nwant:\n%v", got, want)
+	}
+
+	// 0 serves the whole keyspace, 80- can go
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard(0) failed: %v", err)
+	}
+	si, err = ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.ServedTypes = []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_RDONLY}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	if _, err := wr.DeleteShard("test_keyspace", "80-", DeleteShardOptions{RebuildKeyspace: true}); err != nil {
+		t.Errorf("DeleteShard(80-) failed: %v", err)
+	}
+}
+
+func TestDeleteShardUnreachableCell(t *testing.T) {
+	ts := unreachableCellServer{
+		Server: zktopo.NewTestServer(t, []string{"cell1", "cell2"}),
+		cell:   "cell2",
+	}
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	for _, cell := range si.Cells {
+		if err := ts.CreateShardReplication(cell, "test_keyspace", "0", &topo.ShardReplication{}); err != nil {
+			t.Fatalf("CreateShardReplication failed: %v", err)
+		}
+	}
+
+	// without force, the shard is kept, and cell2 is skipped from
+	// its first deletion
+	skipped, err := wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("DeleteShard returned %v, want an unreachable cell error", err)
+	}
+	want := "cell2: ShardReplication, EndPoints master, EndPoints replica, EndPoints rdonly, EndPoints batch, SrvShard"
+	if len(skipped) != 1 || skipped[0].String() != want {
+		t.Errorf("DeleteShard skipped %v, want [%v]", skipped, want)
+	}
+	if _, err := ts.GetShard("test_keyspace", "0"); err != nil {
+		t.Errorf("GetShard after DeleteShard without force: %v", err)
+	}
+	if _, err := ts.GetShardReplication("cell1", "test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("ShardReplication in cell1 wasn't deleted: %v", err)
+	}
+
+	// with force, the shard is deleted, and cell2 is still reported
+	skipped, err = wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{Force: true})
+	if err != nil {
+		t.Errorf("DeleteShard with force failed: %v", err)
+	}
+	if len(skipped) != 1 || skipped[0].Cell != "cell2" {
+		t.Errorf("DeleteShard with force skipped %v, want cell2", skipped)
+	}
+	if _, err := ts.GetShard("test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("GetShard after DeleteShard with force: %v", err)
+	}
+}
+
+// failingDeleteTabletServer is a topo.Server that can't delete some
+// tablets.
+type failingDeleteTabletServer struct {
+	topo.Server
+	failing map[topo.TabletAlias]bool
+}
+
+func (s failingDeleteTabletServer) DeleteTablet(alias topo.TabletAlias) error {
+	if s.failing[alias] {
+		return fmt.Errorf("delete failed")
+	}
+	return s.Server.DeleteTablet(alias)
+}
+
+func TestDeleteShardRecursive(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	tablets := []*topo.Tablet{
+		{Alias: master, Type: topo.TYPE_MASTER},
+		{Alias: topo.TabletAlias{Cell: "cell1", Uid: 2}, Type: topo.TYPE_REPLICA, Parent: master},
+		{Alias: topo.TabletAlias{Cell: "cell2", Uid: 3}, Type: topo.TYPE_RDONLY, Parent: master},
+	}
+	for _, tablet := range tablets {
+		tablet.Keyspace = "test_keyspace"
+		tablet.Shard = "0"
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	// the tablets are kept by default, and the master without
+	// evenIfServing
+	if _, err := wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{}); err == nil || !strings.Contains(err.Error(), "still has 3 tablets") {
+		t.Errorf("DeleteShard returned %v, want a tablets error", err)
+	}
+	if _, err := wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{Recursive: true}); err == nil || !strings.Contains(err.Error(), "master tablet cell1-0000000001") {
+		t.Errorf("DeleteShard returned %v, want a master error", err)
+	}
+	if tabletMap, err := GetTabletMapForShard(ts, "test_keyspace", "0"); err != nil || len(tabletMap) != 3 {
+		t.Errorf("want 3 tablets, got %v %v", len(tabletMap), err)
+	}
+
+	// the failures are reported together, the shard is kept
+	failingWr := New(failingDeleteTabletServer{
+		Server: ts,
+		failing: map[topo.TabletAlias]bool{
+			master:                  true,
+			{Cell: "cell2", Uid: 3}: true,
+		},
+	}, time.Minute, time.Second)
+	_, err = failingWr.DeleteShard("test_keyspace", "0", DeleteShardOptions{Recursive: true, EvenIfServing: true})
+	want := "cannot delete 2 of the 3 tablets of shard test_keyspace/0:\ncannot delete tablet cell1-0000000001, it is scrapped but still exists: delete failed\ncannot delete tablet cell2-0000000003, it is scrapped but still exists: delete failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("DeleteShard returned %v, want:\n%v", err, want)
+	}
+	if _, err := ts.GetShard("test_keyspace", "0"); err != nil {
+		t.Errorf("GetShard after a failed DeleteShard: %v", err)
+	}
+	for i, tablet := range tablets {
+		ti, err := ts.GetTablet(tablet.Alias)
+		if i == 1 {
+			if err != topo.ErrNoNode {
+				t.Errorf("GetTablet(%v) after DeleteShard returned %v", tablet.Alias, err)
+			}
+			continue
+		}
+		if err != nil || ti.Type != topo.TYPE_SCRAP {
+			t.Errorf("want tablet %v scrapped, got %v %v", tablet.Alias, ti, err)
+		}
+	}
+
+	if _, err := wr.DeleteShard("test_keyspace", "0", DeleteShardOptions{Recursive: true, EvenIfServing: true}); err != nil {
+		t.Fatalf("DeleteShard failed: %v", err)
+	}
+	if _, err := ts.GetShard("test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("GetShard after DeleteShard returned %v", err)
+	}
+}
+
+func TestDeleteShardRecursiveCoverage(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	var tablets []*topo.Tablet
+	for i, shard := range []string{"-80", "80-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard(%v) failed: %v", shard, err)
+		}
+		master := topo.TabletAlias{Cell: "cell1", Uid: uint32(10*i + 1)}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = []string{"cell1"}
+		si.MasterAlias = master
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+		for _, tablet := range []*topo.Tablet{
+			{Alias: master, Type: topo.TYPE_MASTER},
+			{Alias: topo.TabletAlias{Cell: "cell1", Uid: uint32(10*i + 2)}, Type: topo.TYPE_REPLICA, Parent: master},
+		} {
+			tablet.Keyspace = "test_keyspace"
+			tablet.Shard = shard
+			if err := topo.CreateTablet(ts, tablet); err != nil {
+				t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+			}
+			tablets = append(tablets, tablet)
+		}
+	}
+
+	// 80- doesn't cover the keyspace alone, -80 and its tablets are
+	// kept
+	_, err := wr.DeleteShard("test_keyspace", "-80", DeleteShardOptions{RebuildKeyspace: true, Recursive: true, EvenIfServing: true})
+	if err == nil || !strings.Contains(err.Error(), "wouldn't cover the keyspace") {
+		t.Errorf("DeleteShard(-80) returned %v, want a coverage error", err)
+	}
+	if _, err := ts.GetShard("test_keyspace", "-80"); err != nil {
+		t.Errorf("GetShard(-80) after a failed DeleteShard: %v", err)
+	}
+	for _, tablet := range tablets {
+		ti, err := ts.GetTablet(tablet.Alias)
+		if err != nil || ti.Type != tablet.Type {
+			t.Errorf("want tablet %v untouched, got %v %v", tablet.Alias, ti, err)
+		}
+	}
+}
+
+// failingSrvShardServer is a topo.Server that can't write the
+// SrvShard objects of some cells.
+type failingSrvShardServer struct {
+	topo.Server
+	failing map[string]bool
+}
+
+func (s failingSrvShardServer) UpdateSrvShard(cell, keyspace, shard string, srvShard *topo.SrvShard) error {
+	if s.failing[cell] {
+		return fmt.Errorf("cell down")
+	}
+	return s.Server.UpdateSrvShard(cell, keyspace, shard, srvShard)
+}
+
+func TestSetShardServedTypes(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	for _, tablet := range []*topo.Tablet{
+		{Alias: master, Type: topo.TYPE_MASTER},
+		{Alias: topo.TabletAlias{Cell: "cell2", Uid: 2}, Type: topo.TYPE_REPLICA, Parent: master},
+	} {
+		tablet.Keyspace = "test_keyspace"
+		tablet.Shard = "0"
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	si.MasterAlias = master
+	si.ServedTypes = []topo.TabletType{topo.TYPE_MASTER}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		servedTypes []topo.TabletType
+		want        string
+	}{
+		{[]topo.TabletType{topo.TYPE_MASTER, "unknown"}, "unknown served type unknown"},
+		{[]topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA, topo.TYPE_MASTER}, "served type master is listed twice"},
+		{[]topo.TabletType{topo.TYPE_REPLICA}, "shard test_keyspace/0 has the master cell1-0000000001, use -force to stop serving master"},
+	} {
+		if err := wr.SetShardServedTypes("test_keyspace", "0", c.servedTypes, false, false, nil); err == nil || err.Error() != c.want {
+			t.Errorf("SetShardServedTypes(%v) returned %v, want %v", c.servedTypes, err, c.want)
+		}
+	}
+	if si, err := ts.GetShard("test_keyspace", "0"); err != nil || len(si.ServedTypes) != 1 {
+		t.Errorf("want the shard unchanged, got %v %v", si, err)
+	}
+
+	// the serving graph is rebuilt in each cell
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER, topo.TYPE_REPLICA}, false, true, nil); err != nil {
+		t.Fatalf("SetShardServedTypes failed: %v", err)
+	}
+	for _, cell := range si.Cells {
+		srvShard, err := ts.GetSrvShard(cell, "test_keyspace", "0")
+		if err != nil || len(srvShard.ServedTypes) != 2 {
+			t.Errorf("want the new served types in cell %v, got %v %v", cell, srvShard, err)
+		}
+	}
+
+	// the cells that can't be rebuilt are reported, the shard is
+	// updated anyway
+	failingWr := New(failingSrvShardServer{Server: ts, failing: map[string]bool{"cell2": true}}, time.Minute, time.Second)
+	err = failingWr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_REPLICA}, true, true, nil)
+	rebuildErr, ok := err.(*ServingGraphRebuildError)
+	if !ok || len(rebuildErr.Errors) != 1 || rebuildErr.Errors["cell2"] == nil {
+		t.Fatalf("want a rebuild error in cell2, got %v", err)
+	}
+	if want := "shard test_keyspace/0 was updated, but its serving graph couldn't be rebuilt in cell2:\ncell cell2: "; !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), "cell down") {
+		t.Errorf("want an error starting with %q, got %v", want, err)
+	}
+	if si, err := ts.GetShard("test_keyspace", "0"); err != nil || len(si.ServedTypes) != 1 || si.ServedTypes[0] != topo.TYPE_REPLICA {
+		t.Errorf("want the shard updated, got %v %v", si, err)
+	}
+	if srvShard, err := ts.GetSrvShard("cell1", "test_keyspace", "0"); err != nil || len(srvShard.ServedTypes) != 1 {
+		t.Errorf("want the new served types in cell1, got %v %v", srvShard, err)
+	}
+}
+
+func TestSetShardTabletControl(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	tables := []string{"moving1", "moving2"}
+	for _, cell := range []string{"cell1", "cell2"} {
+		if err := wr.SetShardTabletControl("test_keyspace", "0", topo.TYPE_RDONLY, []string{cell}, false, false, tables); err != nil {
+			t.Fatalf("SetShardTabletControl(%v) failed: %v", cell, err)
+		}
+	}
+	if err := wr.SetShardTabletControl("test_keyspace", "0", topo.TYPE_RDONLY, nil, false, true, tables); err == nil || !strings.HasPrefix(err.Error(), "shard test_keyspace/0: cannot both disable") {
+		t.Errorf("SetShardTabletControl returned %v, want an error", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	tc := si.GetTabletControl(topo.TYPE_RDONLY)
+	if tc == nil || len(tc.Cells) != 2 || tc.DisableQueryService || len(tc.BlacklistedTables) != 2 {
+		t.Errorf("want the tables blacklisted in both cells, got %+v", tc)
+	}
+
+	if err := wr.SetShardTabletControl("test_keyspace", "0", topo.TYPE_RDONLY, nil, true, false, nil); err != nil {
+		t.Fatalf("SetShardTabletControl failed: %v", err)
+	}
+	if si, err = ts.GetShard("test_keyspace", "0"); err != nil || si.GetTabletControl(topo.TYPE_RDONLY) != nil {
+		t.Errorf("want no control left, got %v %v", si, err)
+	}
+	entries, err := wr.GetShardActionLog("test_keyspace", "0", 0)
+	if err != nil || len(entries) == 0 || entries[0].Action != actionnode.SHARD_ACTION_SET_TABLET_CONTROL {
+		t.Errorf("want the action in the shard action log, got %+v %v", entries, err)
+	}
+}
+
+func TestRemoveCellFromShards(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"-40", "40-80", "80-C0", "C0-"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard(%v) failed: %v", shard, err)
+		}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = []string{"cell1", "cell2"}
+		switch shard {
+		case "-40":
+			si.MasterAlias = topo.TabletAlias{Cell: "cell2", Uid: 1}
+		case "C0-":
+			si.Cells = []string{"cell1"}
+		}
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+	}
+	replica := topo.TabletAlias{Cell: "cell2", Uid: 2}
+	if err := topo.CreateTablet(ts, &topo.Tablet{
+		Alias:    replica,
+		Keyspace: "test_keyspace",
+		Shard:    "40-80",
+		Type:     topo.TYPE_REPLICA,
+		Parent:   topo.TabletAlias{Cell: "cell1", Uid: 1},
+	}); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	checkResults := func(results []ShardCellRemoval, want []string) {
+		var got []string
+		for _, result := range results {
+			got = append(got, result.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("unexpected results:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	// the dry run reports the blockers, and changes nothing
+	results, err := wr.RemoveCellFromShards("test_keyspace", "cell2", []string{"all"}, false, false, true, 2)
+	if err == nil || !strings.Contains(err.Error(), "2 shard(s)") {
+		t.Errorf("dry run returned %v, want 2 failed shards", err)
+	}
+	checkResults(results, []string{
+		"-40: failed: master cell2-0000000001 is in the cell 'cell2' we want to remove",
+		"40-80: failed: cell cell2 has 1 possible tablets in replication graph",
+		"80-C0: removed",
+		"C0-: skipped, not in the cell",
+	})
+	if si, err := ts.GetShard("test_keyspace", "80-C0"); err != nil || len(si.Cells) != 2 {
+		t.Errorf("dry run changed shard 80-C0: %v %v", si, err)
+	}
+
+	// recursive deletes the replica
+	results, err = wr.RemoveCellFromShards("test_keyspace", "cell2", []string{"40-80", "80-C0"}, false, true, false, 2)
+	if err != nil {
+		t.Errorf("RemoveCellFromShards failed: %v", err)
+	}
+	checkResults(results, []string{
+		"40-80: removed, with tablets [cell2-0000000002]",
+		"80-C0: removed",
+	})
+	for _, shard := range []string{"40-80", "80-C0"} {
+		if si, err := ts.GetShard("test_keyspace", shard); err != nil || len(si.Cells) != 1 || si.Cells[0] != "cell1" {
+			t.Errorf("cell2 wasn't removed from shard %v: %v %v", shard, si, err)
+		}
+	}
+	if _, err := ts.GetTablet(replica); err != topo.ErrNoNode {
+		t.Errorf("GetTablet(%v) after a recursive removal returned %v", replica, err)
+	}
+}
+
+func TestRemoveShardCellServingGraph(t *testing.T) {
+	ts := unreachableCellServer{
+		Server: zktopo.NewTestServer(t, []string{"cell1", "cell2", "cell3"}),
+		cell:   "cell3",
+	}
+	wr := New(ts, time.Minute, time.Second)
+	logger := NewRecordingLogger()
+	wr.SetLogger(logger)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2", "cell3"}
+	si.MasterAlias = topo.TabletAlias{Cell: "cell1", Uid: 1}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	for _, cell := range si.Cells {
+		if err := ts.CreateShardReplication(cell, "test_keyspace", "0", &topo.ShardReplication{}); err != nil {
+			t.Fatalf("CreateShardReplication failed: %v", err)
+		}
+		if cell == "cell3" {
+			continue
+		}
+		if err := ts.UpdateEndPoints(cell, "test_keyspace", "0", topo.TYPE_REPLICA, &topo.EndPoints{}); err != nil {
+			t.Fatalf("UpdateEndPoints failed: %v", err)
+		}
+		if err := ts.UpdateSrvShard(cell, "test_keyspace", "0", &topo.SrvShard{}); err != nil {
+			t.Fatalf("UpdateSrvShard failed: %v", err)
+		}
+	}
+	checkCells := func(want ...string) {
+		si, err := ts.GetShard("test_keyspace", "0")
+		if err != nil || !reflect.DeepEqual(si.Cells, want) {
+			t.Errorf("want cells %v, got %v %v", want, si, err)
+		}
+	}
+
+	// the serving graph of cell2 is deleted, not the one of cell1
+	if err := wr.RemoveShardCell("test_keyspace", "0", "cell2", false, nil); err != nil {
+		t.Fatalf("RemoveShardCell(cell2) failed: %v", err)
+	}
+	checkCells("cell1", "cell3")
+	if _, err := ts.GetSrvShard("cell2", "test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("GetSrvShard(cell2) after the removal: %v", err)
+	}
+	if _, err := ts.GetEndPoints("cell2", "test_keyspace", "0", topo.TYPE_REPLICA); err != topo.ErrNoNode {
+		t.Errorf("GetEndPoints(cell2) after the removal: %v", err)
+	}
+	if _, err := ts.GetSrvShard("cell1", "test_keyspace", "0"); err != nil {
+		t.Errorf("GetSrvShard(cell1) after the removal of cell2: %v", err)
+	}
+	if _, err := ts.GetEndPoints("cell1", "test_keyspace", "0", topo.TYPE_REPLICA); err != nil {
+		t.Errorf("GetEndPoints(cell1) after the removal of cell2: %v", err)
+	}
+
+	// an unreachable cell is only removed with force, and what is
+	// left there is logged
+	if err := wr.RemoveShardCell("test_keyspace", "0", "cell3", false, nil); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("RemoveShardCell(cell3) returned %v, want an unreachable cell error", err)
+	}
+	checkCells("cell1", "cell3")
+	if err := wr.RemoveShardCell("test_keyspace", "0", "cell3", true, nil); err != nil {
+		t.Fatalf("RemoveShardCell(cell3) with force failed: %v", err)
+	}
+	checkCells("cell1")
+	want := "W Cell cell3 is unreachable, skipping the deletion of ShardReplication, EndPoints master, EndPoints replica, EndPoints rdonly, EndPoints batch, SrvShard for test_keyspace/0 there"
+	if got := strings.Join(logger.Events(), "\n"); !strings.Contains(got, want) {
+		t.Errorf("unexpected events:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+// failingDeleteSrvShardServer is a topo.Server that can't delete the
+// SrvShard objects.
+type failingDeleteSrvShardServer struct {
+	topo.Server
+}
+
+func (s failingDeleteSrvShardServer) DeleteSrvShard(cell, keyspace, shard string) error {
+	return fmt.Errorf("delete failed")
+}
+
+func TestRemoveShardCellDeleteError(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(failingDeleteSrvShardServer{ts}, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	si.MasterAlias = topo.TabletAlias{Cell: "cell1", Uid: 1}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	if err := ts.CreateShardReplication("cell2", "test_keyspace", "0", &topo.ShardReplication{}); err != nil {
+		t.Fatalf("CreateShardReplication failed: %v", err)
+	}
+	if err := ts.UpdateEndPoints("cell2", "test_keyspace", "0", topo.TYPE_REPLICA, &topo.EndPoints{}); err != nil {
+		t.Fatalf("UpdateEndPoints failed: %v", err)
+	}
+	if err := ts.UpdateSrvShard("cell2", "test_keyspace", "0", &topo.SrvShard{}); err != nil {
+		t.Fatalf("UpdateSrvShard failed: %v", err)
+	}
+
+	// the failed deletion is returned, even with force, and the
+	// cell stays in the shard
+	for _, force := range []bool{false, true} {
+		err := wr.RemoveShardCell("test_keyspace", "0", "cell2", force, nil)
+		if want := "error deleting SrvShard object in cell cell2: delete failed"; err == nil || err.Error() != want {
+			t.Errorf("RemoveShardCell(force=%v): want %v, got %v", force, want, err)
+		}
+		si, err := ts.GetShard("test_keyspace", "0")
+		if err != nil || !reflect.DeepEqual(si.Cells, []string{"cell1", "cell2"}) {
+			t.Errorf("RemoveShardCell(force=%v) changed the cells: %v %v", force, si, err)
+		}
+	}
+	if _, err := ts.GetSrvShard("cell2", "test_keyspace", "0"); err != nil {
+		t.Errorf("GetSrvShard(cell2): %v", err)
+	}
+}
+
+// shardUpdateCountingServer is a topo.Server that counts the shard
+// updates.
+type shardUpdateCountingServer struct {
+	topo.Server
+	updates int
+}
+
+func (sucs *shardUpdateCountingServer) UpdateShard(si *topo.ShardInfo) error {
+	sucs.updates++
+	return sucs.Server.UpdateShard(si)
+}
+
+func TestShardCells(t *testing.T) {
+	ts := &shardUpdateCountingServer{Server: zktopo.NewTestServer(t, []string{"cell1", "cell2", "cell3"})}
+	wr := New(ts, time.Minute, time.Second)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	checkCells := func(updates int, want ...string) {
+		si, err := ts.GetShard("test_keyspace", "0")
+		if err != nil || !reflect.DeepEqual(si.Cells, want) {
+			t.Errorf("want cells %v, got %v %v", want, si, err)
+		}
+		if ts.updates != updates {
+			t.Errorf("want %v shard updates, got %v", updates, ts.updates)
+		}
+	}
+	ts.updates = 0
+
+	// unknown cells are refused
+	if err := wr.AddShardCell("test_keyspace", "0", "cell4"); err == nil || !strings.Contains(err.Error(), "unknown cell cell4") {
+		t.Errorf("AddShardCell(cell4) returned %v, want an unknown cell error", err)
+	}
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell1", "cell4"}, false); err == nil || !strings.Contains(err.Error(), "unknown cell cell4") {
+		t.Errorf("SetShardCells(cell1,cell4) returned %v, want an unknown cell error", err)
+	}
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell1", "cell1"}, false); err == nil || !strings.Contains(err.Error(), "listed twice") {
+		t.Errorf("SetShardCells(cell1,cell1) returned %v, want a duplicate cell error", err)
+	}
+	checkCells(0)
+
+	// a cell is only added once
+	for i := 0; i < 2; i++ {
+		if err := wr.AddShardCell("test_keyspace", "0", "cell2"); err != nil {
+			t.Fatalf("AddShardCell(cell2) failed: %v", err)
+		}
+	}
+	checkCells(1, "cell2")
+
+	// setting the same cells, in any order, changes nothing
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell1", "cell2", "cell3"}, false); err != nil {
+		t.Fatalf("SetShardCells failed: %v", err)
+	}
+	checkCells(2, "cell1", "cell2", "cell3")
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell3", "cell1", "cell2"}, false); err != nil {
+		t.Fatalf("SetShardCells failed: %v", err)
+	}
+	checkCells(2, "cell1", "cell2", "cell3")
+
+	// a cell with tablets, or the master, can't be removed
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	if err := topo.CreateTablet(ts, &topo.Tablet{Alias: topo.TabletAlias{Cell: "cell2", Uid: 2}, Keyspace: "test_keyspace", Shard: "0", Type: topo.TYPE_REPLICA, Parent: master}); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	if err := ts.CreateShardReplication("cell3", "test_keyspace", "0", &topo.ShardReplication{}); err != nil {
+		t.Fatalf("CreateShardReplication failed: %v", err)
+	}
+	if err := ts.UpdateEndPoints("cell3", "test_keyspace", "0", topo.TYPE_REPLICA, &topo.EndPoints{}); err != nil {
+		t.Fatalf("UpdateEndPoints failed: %v", err)
+	}
+	if err := ts.UpdateSrvShard("cell3", "test_keyspace", "0", &topo.SrvShard{}); err != nil {
+		t.Fatalf("UpdateSrvShard failed: %v", err)
+	}
+	ts.updates = 0
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell1"}, false); err == nil || !strings.Contains(err.Error(), "cannot remove cell cell2 from shard test_keyspace/0: cell cell2 has 1 possible tablets") {
+		t.Errorf("SetShardCells(cell1) returned %v, want a tablets in cell2 error", err)
+	}
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell2", "cell3"}, false); err == nil || !strings.Contains(err.Error(), "master cell1-0000000001 is in the cell") {
+		t.Errorf("SetShardCells(cell2,cell3) returned %v, want a master in cell1 error", err)
+	}
+	checkCells(0, "cell1", "cell2", "cell3")
+	if _, err := ts.GetSrvShard("cell3", "test_keyspace", "0"); err != nil {
+		t.Errorf("want the SrvShard of cell3 kept by a refused change: %v", err)
+	}
+
+	// a cell without tablets can be, its graphs are deleted
+	if err := wr.SetShardCells("test_keyspace", "0", []string{"cell2", "cell1"}, false); err != nil {
+		t.Fatalf("SetShardCells(cell2,cell1) failed: %v", err)
+	}
+	checkCells(1, "cell2", "cell1")
+	if _, err := ts.GetShardReplication("cell3", "test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("want the ShardReplication of cell3 deleted, got %v", err)
+	}
+	if _, err := ts.GetSrvShard("cell3", "test_keyspace", "0"); err != topo.ErrNoNode {
+		t.Errorf("want the SrvShard of cell3 deleted, got %v", err)
+	}
+	if _, err := ts.GetEndPoints("cell3", "test_keyspace", "0", topo.TYPE_REPLICA); err != topo.ErrNoNode {
+		t.Errorf("want the EndPoints of cell3 deleted, got %v", err)
+	}
+
+	// a cell whose replication graph can't be read is only removed
+	// with force
+	unreachableWr := New(unreachableReplicationServer{Server: ts, cell: "cell2"}, time.Minute, time.Second)
+	ts.updates = 0
+	if err := unreachableWr.SetShardCells("test_keyspace", "0", []string{"cell1"}, false); err == nil || !strings.Contains(err.Error(), "cannot remove cell cell2 from shard test_keyspace/0: "+topo.ErrUnreachable.Error()) {
+		t.Errorf("SetShardCells(cell1) returned %v, want an unreachable cell2 error", err)
+	}
+	checkCells(0, "cell2", "cell1")
+	if err := unreachableWr.SetShardCells("test_keyspace", "0", []string{"cell1"}, true); err != nil {
+		t.Fatalf("SetShardCells(cell1) with force failed: %v", err)
+	}
+	checkCells(1, "cell1")
+}
+
+// unreachableReplicationServer is a topo.Server that can't read the
+// ShardReplication objects of a cell.
+type unreachableReplicationServer struct {
+	topo.Server
+	cell string
+}
+
+func (s unreachableReplicationServer) GetShardReplication(cell, keyspace, shard string) (*topo.ShardReplicationInfo, error) {
+	if cell == s.cell {
+		return nil, topo.ErrUnreachable
+	}
+	return s.Server.GetShardReplication(cell, keyspace, shard)
+}
+
+func TestCreateShard(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+
+	// the keyspace is created with the first shard
+	if err := wr.CreateShard("test_keyspace", "-80", false); err != nil {
+		t.Fatalf("CreateShard(-80) failed: %v", err)
+	}
+	if _, err := ts.GetKeyspace("test_keyspace"); err != nil {
+		t.Errorf("GetKeyspace failed: %v", err)
+	}
+	si, err := ts.GetShard("test_keyspace", "-80")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	if len(si.Cells) != 0 || !si.MasterAlias.IsZero() || len(si.ServedTypes) != 3 {
+		t.Errorf("want a shard serving all types, without cells and master, got %+v", si.Shard)
+	}
+
+	// adjacent shards don't overlap, duplicates and overlapping
+	// shards need force
+	if err := wr.CreateShard("test_keyspace", "80-", false); err != nil {
+		t.Errorf("CreateShard(80-) failed: %v", err)
+	}
+	if err := wr.CreateShard("test_keyspace", "-80", true); err != topo.ErrNodeExists {
+		t.Errorf("CreateShard(-80) again returned %v, want topo.ErrNodeExists", err)
+	}
+	for _, shard := range []string{"40-c0", "0", "-"} {
+		if err := wr.CreateShard("test_keyspace", shard, false); err == nil || !strings.Contains(err.Error(), "overlap shard(s) -80, 80-") {
+			t.Errorf("CreateShard(%v) returned %v, want an overlap error", shard, err)
+		}
+	}
+	if err := wr.CreateShard("test_keyspace", "40-c0", true); err != nil {
+		t.Errorf("CreateShard(40-c0) with force failed: %v", err)
+	}
+	if si, err := ts.GetShard("test_keyspace", "40-C0"); err != nil || len(si.ServedTypes) != 0 {
+		t.Errorf("want 40-C0 serving nothing, got %v %v", si, err)
+	}
+
+	for _, shard := range []string{"80-40", "zz-80", "-40-80"} {
+		if err := wr.CreateShard("test_keyspace", shard, true); err == nil {
+			t.Errorf("CreateShard(%v) worked", shard)
+		}
+	}
+	shards, err := ts.GetShardNames("test_keyspace")
+	if err != nil || len(shards) != 3 {
+		t.Errorf("want 3 shards, got %v %v", shards, err)
+	}
+}
+
+func TestShardActionStats(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("stats_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "stats_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	si, err := ts.GetShard("stats_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1"}
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	// removing a cell the shard is not in fails
+	if err := wr.RemoveShardCell("stats_keyspace", "0", "cell2", false, nil); err == nil {
+		t.Fatalf("RemoveShardCell worked for a missing cell")
+	}
+	if err := wr.SetShardServedTypes("stats_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, nil); err != nil {
+		t.Fatalf("SetShardServedTypes failed: %v", err)
+	}
+
+	results := actionResults.Counts()
+	for _, name := range []string{"RemoveShardCell.stats_keyspace.Error", "SetShardServedTypes.stats_keyspace.OK"} {
+		if results[name] != 1 {
+			t.Errorf("want 1 %v, got %v", name, results[name])
+		}
+	}
+	if n := results["RemoveShardCell.stats_keyspace.OK"]; n != 0 {
+		t.Errorf("want 0 RemoveShardCell.stats_keyspace.OK, got %v", n)
+	}
+	timings := actionTimings.Counts()
+	for _, name := range []string{"RemoveShardCell.stats_keyspace", "SetShardServedTypes.stats_keyspace"} {
+		if timings[name] != 1 {
+			t.Errorf("want 1 %v timing, got %v", name, timings[name])
+		}
+	}
+	lockWaits := lockWaitTimings.Counts()
+	if n := lockWaits[actionnode.SHARD_ACTION_UPDATE_SHARD+".stats_keyspace"]; n != 1 {
+		t.Errorf("want 1 lock wait for RemoveShardCell, got %v", n)
+	}
+	if n := lockWaits[actionnode.SHARD_ACTION_SET_SERVED_TYPES+".stats_keyspace"]; n != 1 {
+		t.Errorf("want 1 lock wait for SetShardServedTypes, got %v", n)
+	}
+}
+
+// TestConcurrentShardOperations runs operations on different shards
+// from multiple goroutines, with and without per-operation copies of
+// the wrangler. It is meant to be run with -race.
+func TestConcurrentShardOperations(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	shards := []string{"-40", "40-80", "80-C0", "C0-"}
+	for _, shard := range shards {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		si.Cells = []string{"cell1"}
+		if err := ts.UpdateShard(si); err != nil {
+			t.Fatalf("UpdateShard failed: %v", err)
+		}
+		if err := ts.CreateShardReplication("cell1", "test_keyspace", shard, &topo.ShardReplication{}); err != nil {
+			t.Fatalf("CreateShardReplication failed: %v", err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 3*len(shards))
+	for i, shard := range shards {
+		opWr := wr
+		if i%2 == 1 {
+			opWr = wr.ForOperation(time.Minute, make(chan struct{}))
+		}
+		wg.Add(3)
+		go func(wr *Wrangler, shard string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := wr.SetShardServedTypes("test_keyspace", shard, []topo.TabletType{topo.TYPE_MASTER}, false, false, nil); err != nil {
+					errs <- fmt.Errorf("SetShardServedTypes(%v): %v", shard, err)
+					return
+				}
+			}
+		}(opWr, shard)
+		go func(wr *Wrangler, shard string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				// the shards have no master, which ValidateShard
+				// reports as a validation error
+				if _, err := wr.ValidateShard("test_keyspace", shard, false); err == nil || !strings.Contains(err.Error(), "problems") {
+					errs <- fmt.Errorf("ValidateShard(%v): %v", shard, err)
+					return
+				}
+			}
+		}(opWr, shard)
+		// DeleteShard runs on a shard of its own, so it doesn't
+		// remove the shard under the other operations.
+		deleted := fmt.Sprintf("deleted%v", i)
+		if err := topo.CreateShard(ts, "test_keyspace", deleted); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+		go func(wr *Wrangler, shard string) {
+			defer wg.Done()
+			if _, err := wr.DeleteShard("test_keyspace", shard, DeleteShardOptions{}); err != nil {
+				errs <- fmt.Errorf("DeleteShard(%v): %v", shard, err)
+			}
+		}(opWr, deleted)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i, shard := range shards {
+		si, err := ts.GetShard("test_keyspace", shard)
+		if err != nil {
+			t.Fatalf("GetShard failed: %v", err)
+		}
+		if len(si.ServedTypes) != 1 || si.ServedTypes[0] != topo.TYPE_MASTER {
+			t.Errorf("unexpected served types for %v: %v", shard, si.ServedTypes)
+		}
+		if _, err := ts.GetShard("test_keyspace", fmt.Sprintf("deleted%v", i)); err != topo.ErrNoNode {
+			t.Errorf("shard deleted%v was not deleted: %v", i, err)
+		}
+	}
+}
+
+func TestWaitForShardLockRelease(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+	defer func(saved time.Duration) {
+		shardLockPollInterval = saved
+	}(shardLockPollInterval)
+	shardLockPollInterval = 10 * time.Millisecond
+
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	if err := wr.WaitForShardLockRelease("test_keyspace", "0", time.Second); err != nil {
+		t.Errorf("WaitForShardLockRelease(unlocked) failed: %v", err)
+	}
+
+	actionNode := actionnode.MigrateServedTypes(topo.TYPE_RDONLY)
+	lockPath, err := wr.lockShard("test_keyspace", "0", actionNode)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+
+	// the holder is reported on timeout
+	err = wr.WaitForShardLockRelease("test_keyspace", "0", 50*time.Millisecond)
+	lockedErr, ok := err.(*ShardLockedError)
+	if !ok || lockedErr.Node.Action != actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES || lockedErr.Node.ActionGuid != actionNode.ActionGuid {
+		t.Errorf("want a ShardLockedError for %v, got %v", actionNode.ActionGuid, err)
+	}
+	if err := wr.WaitForShardAction("test_keyspace", "0", actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES, 50*time.Millisecond); err == nil {
+		t.Errorf("WaitForShardAction(%v) didn't time out", actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES)
+	}
+	// other actions don't matter
+	if err := wr.WaitForShardAction("test_keyspace", "0", actionnode.SHARD_ACTION_REPARENT, 50*time.Millisecond); err != nil {
+		t.Errorf("WaitForShardAction(%v) failed: %v", actionnode.SHARD_ACTION_REPARENT, err)
+	}
+
+	if ok && !strings.Contains(err.Error(), actionNode.Initiator()) {
+		t.Errorf("the initiator is missing from %v", err)
+	}
+
+	// the waits don't take the lock
+	nodes, err := ts.GetShardActionNodes("test_keyspace", "0")
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("want only the lock holder, got %v %v", nodes, err)
+	}
+	// the lock says who holds it
+	for _, field := range []string{"Username", "Hostname", "ProcessId"} {
+		if !strings.Contains(nodes[0], `"`+field+`"`) {
+			t.Errorf("%v is missing from the lock: %v", field, nodes[0])
+		}
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := wr.unlockShard("test_keyspace", "0", actionNode, lockPath, nil); err != nil {
+			t.Errorf("unlockShard failed: %v", err)
+		}
+	}()
+	if err := wr.WaitForShardAction("test_keyspace", "0", actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES, 5*time.Second); err != nil {
+		t.Errorf("WaitForShardAction failed: %v", err)
+	}
+	if err := wr.WaitForShardLockRelease("test_keyspace", "0", 5*time.Second); err != nil {
+		t.Errorf("WaitForShardLockRelease failed: %v", err)
+	}
+
+	if err := wr.WaitForShardLockRelease("test_keyspace", "666", time.Second); err != topo.ErrNoNode {
+		t.Errorf("WaitForShardLockRelease(missing shard): want ErrNoNode, got %v", err)
+	}
+}
+
+// contendedLockServer is a topo.Server whose shard lock is held by
+// another action until release is closed.
+type contendedLockServer struct {
+	topo.Server
+	holder  *actionnode.ActionNode
+	release chan struct{}
+}
+
+func (cls *contendedLockServer) LockShardForAction(keyspace, shard, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
+	select {
+	case <-cls.release:
+		return cls.Server.LockShardForAction(keyspace, shard, contents, timeout, interrupted)
+	case <-time.After(timeout):
+		return "", topo.ErrTimeout
+	}
+}
+
+func (cls *contendedLockServer) GetShardActionNodes(keyspace, shard string) ([]string, error) {
+	return []string{cls.holder.ToJson()}, nil
+}
+
+func TestShardLockContention(t *testing.T) {
+	holder := actionnode.ApplySchemaShard(topo.TabletAlias{Cell: "cell1", Uid: 1}, "alter", false)
+	cls := &contendedLockServer{
+		Server:  zktopo.NewTestServer(t, []string{"cell1"}),
+		holder:  holder,
+		release: make(chan struct{}),
+	}
+	if err := cls.CreateKeyspace("contended_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(cls, "contended_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	logger := NewRecordingLogger()
+	wr := New(cls, time.Minute, 100*time.Millisecond)
+	wr.SetLogger(logger)
+	wr.LockWaitWarning = 20 * time.Millisecond
+	name := actionnode.SHARD_ACTION_UPDATE_SHARD + ".contended_keyspace"
+
+	// the lock is never released: the wait times out
+	if _, err := wr.lockShard("contended_keyspace", "0", actionnode.UpdateShard()); err != topo.ErrTimeout {
+		t.Fatalf("want ErrTimeout, got %v", err)
+	}
+	if n := lockResults.Counts()[name+".Timeout"]; n != 1 {
+		t.Errorf("want 1 lock timeout, got %v", n)
+	}
+	if n := lockResults.Counts()[name+".OK"]; n != 0 {
+		t.Errorf("want no lock obtained, got %v", n)
+	}
+	want := fmt.Sprintf("holder=%v (%v) of %v", holder.Action, holder.ActionGuid, holder.Initiator())
+	var slow, timedOut bool
+	for _, event := range logger.Events() {
+		if strings.HasPrefix(event, "W slow lock wait: lock=shard contended_keyspace/0 action=UpdateShard") && strings.HasSuffix(event, want) {
+			slow = true
+		}
+		if strings.HasPrefix(event, "W lock wait timed out: lock=shard contended_keyspace/0") && strings.HasSuffix(event, want) {
+			timedOut = true
+		}
+	}
+	if !slow || !timedOut {
+		t.Errorf("missing lock wait warnings: %v", logger.Events())
+	}
+
+	// the lock is released after a while: the wait is recorded
+	// apart from the time the lock is then held for
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cls.release)
+	}()
+	wr = New(cls, time.Minute, 5*time.Second)
+	actionNode := actionnode.UpdateShard()
+	lockPath, err := wr.lockShard("contended_keyspace", "0", actionNode)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := wr.unlockShard("contended_keyspace", "0", actionNode, lockPath, nil); err != nil {
+		t.Fatalf("unlockShard failed: %v", err)
+	}
+	if n := lockResults.Counts()[name+".OK"]; n != 1 {
+		t.Errorf("want 1 lock obtained, got %v", n)
+	}
+	if n := lockWaitTimings.Counts()[name]; n != 2 {
+		t.Errorf("want 2 lock waits, got %v", n)
+	}
+	hold := lockHoldTimings.Histograms()[name]
+	if hold == nil || hold.Count() != 1 || time.Duration(hold.Total()) < 100*time.Millisecond {
+		t.Errorf("want 1 lock hold of at least 100ms, got %v", hold)
+	}
+	// the second wait lasted about 50ms, less than the hold
+	wait := lockWaitTimings.Histograms()[name]
+	if secondWait := time.Duration(wait.Total()) - 100*time.Millisecond; secondWait >= time.Duration(hold.Total()) {
+		t.Errorf("the lock wait includes the hold: %v", wait)
+	}
+}
+
+func TestShardLockOptions(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2"})
+	wr := New(ts, time.Minute, time.Minute)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+
+	holder := actionnode.SetShardServedTypes(nil)
+	lockPath, err := wr.lockShard("test_keyspace", "0", holder)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+
+	// a try fails right away, with the holder
+	start := time.Now()
+	tryLock := &ShardLockOptions{TryLock: true}
+	for _, try := range []func() error{
+		func() error {
+			return wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, tryLock)
+		},
+		func() error {
+			return wr.RemoveShardCell("test_keyspace", "0", "cell2", false, tryLock)
+		},
+	} {
+		err := try()
+		locked, ok := err.(*ShardLockedError)
+		if !ok || locked.Node.Action != actionnode.SHARD_ACTION_SET_SERVED_TYPES || locked.Node.ActionGuid != holder.ActionGuid {
+			t.Errorf("want a ShardLockedError by %v, got %v", holder.Action, err)
+		}
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 10*time.Second {
+		t.Errorf("the tries waited for %v", elapsed)
+	}
+
+	// the timeout of the wrangler can be shortened
+	start = time.Now()
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, &ShardLockOptions{Timeout: 50 * time.Millisecond}); err != topo.ErrTimeout {
+		t.Errorf("want ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 10*time.Second {
+		t.Errorf("the wait lasted %v", elapsed)
+	}
+
+	// the wait can still be interrupted
+	interrupted := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(interrupted)
+	}()
+	op := wr.ForOperation(time.Minute, interrupted)
+	if err := op.RemoveShardCell("test_keyspace", "0", "cell2", false, &ShardLockOptions{Timeout: time.Minute}); err != topo.ErrInterrupted {
+		t.Errorf("want ErrInterrupted, got %v", err)
+	}
+
+	// a free lock is taken
+	if err := wr.unlockShard("test_keyspace", "0", holder, lockPath, nil); err != nil {
+		t.Fatalf("unlockShard failed: %v", err)
+	}
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, tryLock); err != nil {
+		t.Errorf("SetShardServedTypes failed: %v", err)
+	}
+}
+
+// racingLockServer is a topo.Server whose first GetShardActionNodes
+// doesn't see the lock holder, as if it took the lock right after,
+// and that records the timeouts of the shard locks.
+type racingLockServer struct {
+	topo.Server
+
+	mu       sync.Mutex
+	hidden   bool
+	timeouts []time.Duration
+}
+
+func (rls *racingLockServer) GetShardActionNodes(keyspace, shard string) ([]string, error) {
+	rls.mu.Lock()
+	defer rls.mu.Unlock()
+	if !rls.hidden {
+		rls.hidden = true
+		return nil, nil
+	}
+	return rls.Server.GetShardActionNodes(keyspace, shard)
+}
+
+func (rls *racingLockServer) LockShardForAction(keyspace, shard, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
+	rls.mu.Lock()
+	rls.timeouts = append(rls.timeouts, timeout)
+	rls.mu.Unlock()
+	return rls.Server.LockShardForAction(keyspace, shard, contents, timeout, interrupted)
+}
+
+func TestShardTryLockRace(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	holder := actionnode.SetShardServedTypes(nil)
+	lockPath, err := New(ts, time.Minute, time.Second).lockShard("test_keyspace", "0", holder)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+
+	// a try that found the lock free doesn't wait for it once it is
+	// taken, even with a long timeout
+	rls := &racingLockServer{Server: ts}
+	wr := New(rls, time.Minute, time.Minute)
+	start := time.Now()
+	_, err = wr.lockShardWithOptions("test_keyspace", "0", actionnode.UpdateShard(), &ShardLockOptions{Timeout: time.Minute, TryLock: true})
+	if locked, ok := err.(*ShardLockedError); !ok || locked.Node.ActionGuid != holder.ActionGuid {
+		t.Errorf("want a ShardLockedError by %v, got %v", holder.Action, err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the try waited for %v", elapsed)
+	}
+	if want := []time.Duration{0}; !reflect.DeepEqual(rls.timeouts, want) {
+		t.Errorf("want the lock timeouts %v, got %v", want, rls.timeouts)
+	}
+
+	if err := wr.unlockShard("test_keyspace", "0", holder, lockPath, nil); err != nil {
+		t.Errorf("unlockShard failed: %v", err)
+	}
+}
+
+// lockCheckingServer is a topo.Server that records the actions that
+// lock a shard, and counts the shard updates done without the lock.
+type lockCheckingServer struct {
+	topo.Server
+
+	mu              sync.Mutex
+	locked          map[string]bool
+	actions         []string
+	unlockedUpdates int
+}
+
+func (lcs *lockCheckingServer) LockShardForAction(keyspace, shard, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
+	lockPath, err := lcs.Server.LockShardForAction(keyspace, shard, contents, timeout, interrupted)
+	if err != nil {
+		return "", err
+	}
+	node, err := actionnode.ActionNodeFromJson(contents, "")
+	if err != nil {
+		return "", err
+	}
+	lcs.mu.Lock()
+	defer lcs.mu.Unlock()
+	lcs.locked[keyspace+"/"+shard] = true
+	lcs.actions = append(lcs.actions, node.Action)
+	return lockPath, nil
+}
+
+func (lcs *lockCheckingServer) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
+	lcs.mu.Lock()
+	delete(lcs.locked, keyspace+"/"+shard)
+	lcs.mu.Unlock()
+	return lcs.Server.UnlockShardForAction(keyspace, shard, lockPath, results)
+}
+
+func (lcs *lockCheckingServer) UpdateShard(si *topo.ShardInfo) error {
+	lcs.mu.Lock()
+	if !lcs.locked[si.Keyspace()+"/"+si.ShardName()] {
+		lcs.unlockedUpdates++
+	}
+	lcs.mu.Unlock()
+	return lcs.Server.UpdateShard(si)
+}
+
+func TestSourceShardAddDelete(t *testing.T) {
+	lcs := &lockCheckingServer{
+		Server: zktopo.NewTestServer(t, []string{"cell1"}),
+		locked: make(map[string]bool),
+	}
+	wr := New(lcs, time.Minute, time.Second)
+	for _, keyspace := range []string{"source_keyspace", "destination_keyspace"} {
+		if err := lcs.CreateKeyspace(keyspace, &topo.Keyspace{}); err != nil {
+			t.Fatalf("CreateKeyspace failed: %v", err)
+		}
+		if err := topo.CreateShard(lcs, keyspace, "0"); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+	}
+
+	if err := wr.SourceShardAdd("destination_keyspace", "0", 1, "source_keyspace", "0", key.KeyRange{}, []string{"t1", "t2"}); err != nil {
+		t.Fatalf("SourceShardAdd failed: %v", err)
+	}
+	if err := wr.SourceShardAdd("destination_keyspace", "0", 2, "source_keyspace", "0", key.KeyRange{}, []string{"t3"}); err != nil {
+		t.Fatalf("SourceShardAdd failed: %v", err)
+	}
+	partial := key.KeyRange{Start: key.MinKey, End: key.KeyspaceId("\x80")}
+	for _, c := range []struct {
+		uid                         uint32
+		sourceKeyspace, sourceShard string
+		keyRange                    key.KeyRange
+		tables                      []string
+		want                        string
+	}{
+		{1, "source_keyspace", "0", key.KeyRange{}, nil, "shard destination_keyspace/0 already has the SourceShard SourceShard(1,source_keyspace/0)"},
+		{3, "source_keyspace", "80-", key.KeyRange{}, nil, "cannot read the source shard source_keyspace/80-: node doesn't exist"},
+		{3, "source_keyspace", "0", partial, []string{"t1"}, "a SourceShard can't have both a partial key range and tables"},
+	} {
+		if err := wr.SourceShardAdd("destination_keyspace", "0", c.uid, c.sourceKeyspace, c.sourceShard, c.keyRange, c.tables); err == nil || err.Error() != c.want {
+			t.Errorf("SourceShardAdd(%v, %v/%v) returned %v, want %v", c.uid, c.sourceKeyspace, c.sourceShard, err, c.want)
+		}
+	}
+
+	if err := wr.SourceShardDelete("destination_keyspace", "0", 1); err != nil {
+		t.Fatalf("SourceShardDelete failed: %v", err)
+	}
+	if err := wr.SourceShardDelete("destination_keyspace", "0", 1); err == nil || err.Error() != "shard destination_keyspace/0 has no SourceShard with uid 1" {
+		t.Errorf("SourceShardDelete of a missing uid returned %v", err)
+	}
+
+	si, err := lcs.GetShard("destination_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	if len(si.SourceShards) != 1 || si.SourceShards[0].Uid != 2 || si.SourceShards[0].Keyspace != "source_keyspace" || si.SourceShards[0].Shard != "0" || len(si.SourceShards[0].Tables) != 1 || si.SourceShards[0].Tables[0] != "t3" {
+		t.Errorf("unexpected SourceShards: %+v", si.SourceShards)
+	}
+
+	// the shard is locked by each action that reaches it, and only
+	// updated with the lock
+	wantActions := []string{
+		actionnode.SHARD_ACTION_SOURCE_SHARD_ADD,
+		actionnode.SHARD_ACTION_SOURCE_SHARD_ADD,
+		actionnode.SHARD_ACTION_SOURCE_SHARD_ADD,
+		actionnode.SHARD_ACTION_SOURCE_SHARD_DELETE,
+		actionnode.SHARD_ACTION_SOURCE_SHARD_DELETE,
+	}
+	if !reflect.DeepEqual(lcs.actions, wantActions) {
+		t.Errorf("want locks by %v, got %v", wantActions, lcs.actions)
+	}
+	if lcs.unlockedUpdates != 0 || len(lcs.locked) != 0 {
+		t.Errorf("want no update without the lock and no lock left, got %v updates and %v locks", lcs.unlockedUpdates, lcs.locked)
+	}
+}
+
+func TestForceUnlockShard(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := New(ts, time.Minute, time.Second)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	if _, err := wr.ForceUnlockShard("test_keyspace", "0", ""); err == nil || err.Error() != "shard test_keyspace/0 is not locked" {
+		t.Errorf("ForceUnlockShard(unlocked) returned %v", err)
+	}
+
+	// the process holding the lock dies without unlocking
+	before := time.Now().Unix()
+	if _, err := wr.lockShard("test_keyspace", "0", actionnode.MigrateServedTypes(topo.TYPE_RDONLY)); err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+	holders, err := wr.GetShardLockHolders("test_keyspace", "0")
+	if err != nil || len(holders) != 1 {
+		t.Fatalf("want 1 lock holder, got %v %v", holders, err)
+	}
+	if h := holders[0]; h.Action != actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES || h.Hostname == "" || h.Username == "" || h.ProcessId == 0 || h.LockTime < before {
+		t.Errorf("unexpected lock holder %+v", h)
+	}
+
+	if _, err := wr.ForceUnlockShard("test_keyspace", "0", actionnode.SHARD_ACTION_SET_SERVED_TYPES); err == nil || !strings.Contains(err.Error(), "is locked by action MigrateServedTypes") {
+		t.Errorf("ForceUnlockShard(other action) returned %v", err)
+	}
+	holder, err := wr.ForceUnlockShard("test_keyspace", "0", actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES)
+	if err != nil || holder.Action != actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES {
+		t.Fatalf("ForceUnlockShard returned %v %v", holder, err)
+	}
+	if holders, err := wr.GetShardLockHolders("test_keyspace", "0"); err != nil || len(holders) != 0 {
+		t.Errorf("want no lock holder, got %v %v", holders, err)
+	}
+	entries, err := wr.GetShardActionLog("test_keyspace", "0", 1)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("GetShardActionLog returned %v %v", entries, err)
+	}
+	if e := entries[0]; e.Action != actionnode.SHARD_ACTION_MIGRATE_SERVED_TYPES || e.State != actionnode.ACTION_STATE_FAILED || !strings.HasPrefix(e.Error, "lock broken by ") || e.StartTime.Unix() < before {
+		t.Errorf("unexpected action log entry %+v", e)
+	}
+
+	// the shard can be locked again
+	if err := wr.SetShardServedTypes("test_keyspace", "0", []topo.TabletType{topo.TYPE_MASTER}, false, false, nil); err != nil {
+		t.Errorf("SetShardServedTypes failed: %v", err)
+	}
+}
+
+// failingUnlockServer is a topo.Server that can't unlock shards.
+type failingUnlockServer struct {
+	topo.Server
+}
+
+func (s failingUnlockServer) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
+	return fmt.Errorf("unlock failed")
+}
+
+func TestUnlockShardErrors(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	wr := New(failingUnlockServer{ts}, time.Minute, time.Second)
+	wr.UnlockRetryDelay = time.Millisecond
+	for _, actionError := range []error{nil, fmt.Errorf("action failed")} {
+		actionNode := actionnode.UpdateShard()
+		lockPath, err := wr.lockShard("test_keyspace", "0", actionNode)
+		if err != nil {
+			t.Fatalf("lockShard failed: %v", err)
+		}
+		err = wr.unlockShard("test_keyspace", "0", actionNode, lockPath, actionError)
+		if actionError == nil {
+			if err == nil || err.Error() != "unlock failed" {
+				t.Errorf("want the unlock error, got %v", err)
+			}
+		} else {
+			unlockErr, ok := err.(*UnlockError)
+			if !ok || unlockErr.ActionError != actionError || unlockErr.UnlockError.Error() != "unlock failed" {
+				t.Errorf("want both errors, got %v", err)
+			}
+			if want := "action failed, and unlocking shard test_keyspace/0 failed: unlock failed"; err.Error() != want {
+				t.Errorf("want %v, got %v", want, err)
+			}
+			if ok && unlockErr.Unwrap() != actionError {
+				t.Errorf("want the action error first, got %v", unlockErr.Unwrap())
+			}
+		}
+		if _, err := wr.ForceUnlockShard("test_keyspace", "0", actionnode.SHARD_ACTION_UPDATE_SHARD); err != nil {
+			t.Errorf("ForceUnlockShard failed: %v", err)
+		}
+	}
+}
+
+// flakyUnlockServer is a topo.Server whose next shard unlocks fail
+// with the errors of failures.
+type flakyUnlockServer struct {
+	topo.Server
+
+	mu       sync.Mutex
+	failures []error
+	attempts int
+}
+
+func (fus *flakyUnlockServer) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
+	fus.mu.Lock()
+	fus.attempts++
+	if len(fus.failures) > 0 {
+		err := fus.failures[0]
+		fus.failures = fus.failures[1:]
+		fus.mu.Unlock()
+		return err
+	}
+	fus.mu.Unlock()
+	return fus.Server.UnlockShardForAction(keyspace, shard, lockPath, results)
+}
+
+func TestUnlockShardRetries(t *testing.T) {
+	fus := &flakyUnlockServer{Server: zktopo.NewTestServer(t, []string{"cell1"})}
+	if err := fus.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(fus, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	wr := New(fus, time.Minute, time.Second)
+	wr.UnlockRetryDelay = time.Millisecond
+	actionError := fmt.Errorf("action failed")
+
+	for _, c := range []struct {
+		failures    []error
+		actionError error
+		attempts    int
+		want        string
+		locked      bool
+	}{
+		// a transient failure is retried
+		{[]error{topo.ErrUnreachable}, nil, 2, "<nil>", false},
+		{[]error{topo.ErrUnreachable}, actionError, 2, "action failed", false},
+		{[]error{topo.ErrTimeout}, nil, 2, "<nil>", false},
+		// up to unlockRetries times
+		{[]error{topo.ErrTimeout, topo.ErrTimeout, topo.ErrTimeout, topo.ErrTimeout}, actionError, 4, "action failed, and unlocking shard test_keyspace/0 failed: deadline exceeded", true},
+		// a retry finding no lock means the failed unlock released it
+		{[]error{topo.ErrUnreachable, topo.ErrNoNode}, nil, 2, "<nil>", true},
+		// the other errors are not retried
+		{[]error{topo.ErrBadVersion}, nil, 1, topo.ErrBadVersion.Error(), true},
+		{[]error{fmt.Errorf("connection lost")}, nil, 1, "connection lost", true},
+	} {
+		actionNode := actionnode.UpdateShard()
+		lockPath, err := wr.lockShard("test_keyspace", "0", actionNode)
+		if err != nil {
+			t.Fatalf("lockShard failed: %v", err)
+		}
+		fus.failures = c.failures
+		fus.attempts = 0
+		err = wr.unlockShard("test_keyspace", "0", actionNode, lockPath, c.actionError)
+		if got := fmt.Sprintf("%v", err); got != c.want {
+			t.Errorf("failures %v: want %v, got %v", c.failures, c.want, got)
+		}
+		if c.actionError != nil && c.want == c.actionError.Error() && err != c.actionError {
+			t.Errorf("failures %v: want the action error itself, got %#v", c.failures, err)
+		}
+		if fus.attempts != c.attempts {
+			t.Errorf("failures %v: want %v unlock attempts, got %v", c.failures, c.attempts, fus.attempts)
+		}
+		if c.locked {
+			if _, err := wr.ForceUnlockShard("test_keyspace", "0", actionnode.SHARD_ACTION_UPDATE_SHARD); err != nil {
+				t.Errorf("ForceUnlockShard failed: %v", err)
+			}
+		}
+		if holders, err := wr.GetShardLockHolders("test_keyspace", "0"); err != nil || len(holders) != 0 {
+			t.Errorf("failures %v: want the shard unlocked, got %v %v", c.failures, holders, err)
+		}
+	}
+}
+
+func TestUnlockShardInterrupted(t *testing.T) {
+	fus := &flakyUnlockServer{Server: zktopo.NewTestServer(t, []string{"cell1"})}
+	if err := fus.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(fus, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	interrupted := make(chan struct{})
+	wr := New(fus, time.Minute, time.Second).ForOperation(time.Minute, interrupted)
+	wr.UnlockRetryDelay = time.Hour
+
+	actionNode := actionnode.UpdateShard()
+	lockPath, err := wr.lockShard("test_keyspace", "0", actionNode)
+	if err != nil {
+		t.Fatalf("lockShard failed: %v", err)
+	}
+	close(interrupted)
+	fus.failures = []error{topo.ErrUnreachable}
+	done := make(chan error)
+	go func() {
+		done <- wr.unlockShard("test_keyspace", "0", actionNode, lockPath, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != topo.ErrUnreachable {
+			t.Errorf("want the unlock error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("an interrupted unlockShard still waited to retry")
+	}
+	if fus.attempts != 1 {
+		t.Errorf("want 1 unlock attempt, got %v", fus.attempts)
+	}
+	if _, err := wr.ForceUnlockShard("test_keyspace", "0", actionnode.SHARD_ACTION_UPDATE_SHARD); err != nil {
+		t.Errorf("ForceUnlockShard failed: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"time"
+
+	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+var (
+	// actionTimings records the duration of the wrangler
+	// operations, by "<operation>.<keyspace>".
+	actionTimings = stats.NewTimings("WranglerActions")
+
+	// actionResults counts the outcome of the wrangler operations,
+	// by "<operation>.<keyspace>.<OK|Error>".
+	actionResults = stats.NewCounters("WranglerActionResults")
+
+	// lockWaitTimings records how long the keyspace and shard
+	// locks were waited for, by "<action>.<keyspace>", whether they
+	// were obtained or not. The time they're then held for is in
+	// lockHoldTimings.
+	lockWaitTimings = stats.NewTimings("WranglerLockWait")
+
+	// lockResults counts the outcome of the keyspace and shard lock
+	// waits, by "<action>.<keyspace>.<OK|Timeout|Interrupted|Error>".
+	lockResults = stats.NewCounters("WranglerLockResults")
+
+	// lockHoldTimings records how long the keyspace and shard locks
+	// were held for, by "<action>.<keyspace>".
+	lockHoldTimings = stats.NewTimings("WranglerLockHold")
+)
+
+// recordAction records the duration and outcome of an operation
+// started at startTime, that returned *err. It is meant to be
+// deferred by the exported entry points only, so an operation is
+// counted once, however many retries or internal steps it has.
+func recordAction(operation, keyspace string, startTime time.Time, err *error) {
+	name := operation + "." + keyspace
+	actionTimings.Record(name, startTime)
+	if *err != nil {
+		actionResults.Add(name+".Error", 1)
+	} else {
+		actionResults.Add(name+".OK", 1)
+	}
+}
+
+// recordLockWait records a wait for a keyspace or shard lock, started
+// at startTime, that returned err.
+func recordLockWait(action, keyspace string, startTime time.Time, err error) {
+	name := action + "." + keyspace
+	lockWaitTimings.Record(name, startTime)
+	switch err {
+	case nil:
+		lockResults.Add(name+".OK", 1)
+	case topo.ErrTimeout:
+		lockResults.Add(name+".Timeout", 1)
+	case topo.ErrInterrupted:
+		lockResults.Add(name+".Interrupted", 1)
+	default:
+		lockResults.Add(name+".Error", 1)
+	}
+}
+
+// recordLockHold records the time a keyspace or shard lock was held
+// for, since the action got it.
+func recordLockHold(keyspace string, actionNode *actionnode.ActionNode) {
+	if !actionNode.StartTime.IsZero() {
+		lockHoldTimings.Record(actionNode.Action+"."+keyspace, actionNode.StartTime)
+	}
+}
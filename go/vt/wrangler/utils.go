@@ -5,45 +5,197 @@
 package wrangler
 
 import (
+	"flag"
+	"fmt"
 	"reflect"
 	"sort"
 	"sync"
 
 	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/sync2"
+	"github.com/youtube/vitess/go/vt/concurrency"
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
+var tabletReadConcurrency = flag.Int("tablet_read_concurrency", 8, "maximum number of tablet records read at the same time from each cell")
+
+// runConcurrently calls f for each index from 0 to count-1, at most
+// concurrency of them at a time (at least one), and waits for all of
+// them.
+func runConcurrently(count, concurrency int, f func(i int)) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := sync2.NewSemaphore(concurrency, 0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem.Acquire()
+			defer sem.Release()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
 // GetTabletMap tries to read all the tablets in the provided list,
-// and returns them all in a map.
+// and returns them all in a map. The tablets of each cell are read
+// -tablet_read_concurrency at a time.
 // If error is topo.ErrPartialResult, the results in the dictionary are
 // incomplete, meaning some tablets couldn't be read.
 func GetTabletMap(ts topo.Server, tabletAliases []topo.TabletAlias) (map[topo.TabletAlias]*topo.TabletInfo, error) {
+	return getTabletMap(ts, tabletAliases, *tabletReadConcurrency)
+}
+
+func getTabletMap(ts topo.Server, tabletAliases []topo.TabletAlias, concurrency int) (map[topo.TabletAlias]*topo.TabletInfo, error) {
+	tabletMap, errs := readTablets(ts, tabletAliases, concurrency)
+	if len(errs) > 0 {
+		return tabletMap, topo.ErrPartialResult
+	}
+	return tabletMap, nil
+}
+
+// readTablets reads the tablets of tabletAliases, the ones of each
+// cell concurrency at a time. It returns the tablets it read, and the
+// error of each other one. The tablets that don't exist are skipped.
+func readTablets(ts topo.Server, tabletAliases []topo.TabletAlias, concurrency int) (map[topo.TabletAlias]*topo.TabletInfo, map[topo.TabletAlias]error) {
+	byCell := make(map[string][]topo.TabletAlias)
+	for _, tabletAlias := range tabletAliases {
+		byCell[tabletAlias.Cell] = append(byCell[tabletAlias.Cell], tabletAlias)
+	}
+
 	wg := sync.WaitGroup{}
 	mutex := sync.Mutex{}
 
 	tabletMap := make(map[topo.TabletAlias]*topo.TabletInfo)
-	var someError error
+	errs := make(map[topo.TabletAlias]error)
 
-	for _, tabletAlias := range tabletAliases {
+	for _, aliases := range byCell {
 		wg.Add(1)
-		go func(tabletAlias topo.TabletAlias) {
+		go func(aliases []topo.TabletAlias) {
 			defer wg.Done()
-			tabletInfo, err := ts.GetTablet(tabletAlias)
-			mutex.Lock()
+			runConcurrently(len(aliases), concurrency, func(i int) {
+				tabletInfo, err := ts.GetTablet(aliases[i])
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err != nil {
+					log.Warningf("%v: %v", aliases[i], err)
+					// There can be data races removing nodes - ignore them for now.
+					if err != topo.ErrNoNode {
+						errs[aliases[i]] = err
+					}
+				} else {
+					tabletMap[aliases[i]] = tabletInfo
+				}
+			})
+		}(aliases)
+	}
+	wg.Wait()
+	return tabletMap, errs
+}
+
+// CellError is the error of a cell whose topology couldn't be read
+// completely.
+type CellError struct {
+	Cell string
+	Err  error
+}
+
+func (ce CellError) Error() string {
+	return fmt.Sprintf("cell %v: %v", ce.Cell, ce.Err)
+}
+
+// ListShardTablets returns the tablets of a shard, sorted by cell and
+// uid: its master, and the tablets of the replication graph of each of
+// its cells. The cells are read concurrently, and the tablets of each
+// cell -tablet_read_concurrency at a time. If a cell can't be read
+// completely, the tablets that could be read are still returned, with
+// an error for the cell. The cell errors are sorted by cell. The error
+// is only set if the shard couldn't be read.
+func ListShardTablets(ts topo.Server, keyspace, shard string) ([]*topo.TabletInfo, []CellError, error) {
+	return listShardTabletsByCell(ts, keyspace, shard, nil)
+}
+
+// listShardTabletsByCell is ListShardTablets for the tablets of cells
+// only, all of them if empty.
+func listShardTabletsByCell(ts topo.Server, keyspace, shard string, cells []string) ([]*topo.TabletInfo, []CellError, error) {
+	si, err := ts.GetShard(keyspace, shard)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	mutex := sync.Mutex{}
+	aliasMap := make(map[topo.TabletAlias]bool)
+	cellErrors := make(map[string]*concurrency.AllErrorRecorder)
+	recordError := func(cell string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if cellErrors[cell] == nil {
+			cellErrors[cell] = &concurrency.AllErrorRecorder{}
+		}
+		cellErrors[cell].RecordError(err)
+	}
+
+	// read the replication graph in each cell
+	if !si.MasterAlias.IsZero() && topo.InCellList(si.MasterAlias.Cell, cells) {
+		aliasMap[si.MasterAlias] = true
+	}
+	for _, cell := range si.Cells {
+		if !topo.InCellList(cell, cells) {
+			continue
+		}
+		wg.Add(1)
+		go func(cell string) {
+			defer wg.Done()
+			sri, err := ts.GetShardReplication(cell, keyspace, shard)
 			if err != nil {
-				log.Warningf("%v: %v", tabletAlias, err)
-				// There can be data races removing nodes - ignore them for now.
-				if err != topo.ErrNoNode {
-					someError = topo.ErrPartialResult
+				recordError(cell, fmt.Errorf("GetShardReplication(%v, %v, %v) failed: %v", cell, keyspace, shard, err))
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, rl := range sri.ReplicationLinks {
+				aliasMap[rl.TabletAlias] = true
+				if topo.InCellList(rl.Parent.Cell, cells) {
+					aliasMap[rl.Parent] = true
 				}
-			} else {
-				tabletMap[tabletAlias] = tabletInfo
 			}
-			mutex.Unlock()
-		}(tabletAlias)
+		}(cell)
 	}
 	wg.Wait()
-	return tabletMap, someError
+
+	// and the tablets
+	aliases := make([]topo.TabletAlias, 0, len(aliasMap))
+	for alias := range aliasMap {
+		aliases = append(aliases, alias)
+	}
+	sort.Sort(topo.TabletAliasList(aliases))
+	tabletMap, errs := readTablets(ts, aliases, *tabletReadConcurrency)
+	for alias, err := range errs {
+		recordError(alias.Cell, fmt.Errorf("GetTablet(%v) failed: %v", alias, err))
+	}
+
+	tablets := make([]*topo.TabletInfo, 0, len(tabletMap))
+	for _, alias := range aliases {
+		if ti, ok := tabletMap[alias]; ok {
+			tablets = append(tablets, ti)
+		}
+	}
+	errorCells := make([]string, 0, len(cellErrors))
+	for cell := range cellErrors {
+		errorCells = append(errorCells, cell)
+	}
+	sort.Strings(errorCells)
+	result := make([]CellError, 0, len(errorCells))
+	for _, cell := range errorCells {
+		log.Warningf("ListShardTablets(%v, %v): cell %v not read completely: %v", keyspace, shard, cell, cellErrors[cell].Error())
+		result = append(result, CellError{Cell: cell, Err: cellErrors[cell].Error()})
+	}
+	return tablets, result, nil
 }
 
 // GetTabletMapForShard returns the tablets for a shard. It can return
@@ -59,18 +211,18 @@ func GetTabletMapForShard(ts topo.Server, keyspace, shard string) (map[topo.Tabl
 func GetTabletMapForShardByCell(ts topo.Server, keyspace, shard string, cells []string) (map[topo.TabletAlias]*topo.TabletInfo, error) {
 	// if we get a partial result, we keep going. It most likely means
 	// a cell is out of commission.
-	aliases, err := topo.FindAllTabletAliasesInShardByCell(ts, keyspace, shard, cells)
-	if err != nil && err != topo.ErrPartialResult {
+	tablets, cellErrors, err := listShardTabletsByCell(ts, keyspace, shard, cells)
+	if err != nil {
 		return nil, err
 	}
-
-	// get the tablets for the cells we were able to reach, forward
-	// topo.ErrPartialResult from FindAllTabletAliasesInShard
-	result, gerr := GetTabletMap(ts, aliases)
-	if gerr == nil && err != nil {
-		gerr = err
+	result := make(map[topo.TabletAlias]*topo.TabletInfo, len(tablets))
+	for _, ti := range tablets {
+		result[ti.Alias] = ti
+	}
+	if len(cellErrors) > 0 {
+		return result, topo.ErrPartialResult
 	}
-	return result, gerr
+	return result, nil
 }
 
 // Search within a tablet map for tablets
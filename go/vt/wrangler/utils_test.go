@@ -0,0 +1,257 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// slowTabletServer is a topo.Server whose tablet reads take delay. It
+// keeps track of the most reads in flight in each cell. The tablet
+// reads in brokenCell, and the replication graph of
+// brokenReplicationCell, fail.
+type slowTabletServer struct {
+	topo.Server
+	delay                 time.Duration
+	brokenCell            string
+	brokenReplicationCell string
+
+	mu          sync.Mutex
+	inFlight    map[string]int
+	maxInFlight map[string]int
+}
+
+func newSlowTabletServer(ts topo.Server, delay time.Duration) *slowTabletServer {
+	return &slowTabletServer{
+		Server:      ts,
+		delay:       delay,
+		inFlight:    make(map[string]int),
+		maxInFlight: make(map[string]int),
+	}
+}
+
+func (sts *slowTabletServer) GetTablet(alias topo.TabletAlias) (*topo.TabletInfo, error) {
+	sts.mu.Lock()
+	sts.inFlight[alias.Cell]++
+	if sts.inFlight[alias.Cell] > sts.maxInFlight[alias.Cell] {
+		sts.maxInFlight[alias.Cell] = sts.inFlight[alias.Cell]
+	}
+	sts.mu.Unlock()
+	defer func() {
+		sts.mu.Lock()
+		sts.inFlight[alias.Cell]--
+		sts.mu.Unlock()
+	}()
+	time.Sleep(sts.delay)
+	if alias.Cell == sts.brokenCell {
+		return nil, fmt.Errorf("cannot read %v", alias)
+	}
+	return sts.Server.GetTablet(alias)
+}
+
+func (sts *slowTabletServer) GetShardReplication(cell, keyspace, shard string) (*topo.ShardReplicationInfo, error) {
+	if cell == sts.brokenReplicationCell {
+		return nil, fmt.Errorf("cannot read the replication graph of %v", cell)
+	}
+	return sts.Server.GetShardReplication(cell, keyspace, shard)
+}
+
+// createTabletMapShard creates test_keyspace/0 with a master in the
+// first cell, and tabletsPerCell replicas in each cell.
+func createTabletMapShard(t testing.TB, ts topo.Server, cells []string, tabletsPerCell int) {
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	master := topo.TabletAlias{Cell: cells[0], Uid: 1}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = cells
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+	if err := topo.CreateTablet(ts, &topo.Tablet{
+		Alias:    master,
+		Keyspace: "test_keyspace",
+		Shard:    "0",
+		Type:     topo.TYPE_MASTER,
+	}); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+	uid := uint32(100)
+	for _, cell := range cells {
+		for i := 0; i < tabletsPerCell; i++ {
+			uid++
+			if err := topo.CreateTablet(ts, &topo.Tablet{
+				Alias:    topo.TabletAlias{Cell: cell, Uid: uid},
+				Keyspace: "test_keyspace",
+				Shard:    "0",
+				Type:     topo.TYPE_REPLICA,
+				Parent:   master,
+			}); err != nil {
+				t.Fatalf("CreateTablet failed: %v", err)
+			}
+		}
+	}
+}
+
+// TestGetTabletMapForShardConcurrency is meant to be run with -race.
+func TestGetTabletMapForShardConcurrency(t *testing.T) {
+	cells := []string{"cell1", "cell2", "cell3"}
+	sts := newSlowTabletServer(zktopo.NewTestServer(t, cells), time.Millisecond)
+	createTabletMapShard(t, sts, cells, 10)
+	defer func(saved int) {
+		*tabletReadConcurrency = saved
+	}(*tabletReadConcurrency)
+	*tabletReadConcurrency = 4
+
+	tabletMap, err := GetTabletMapForShard(sts, "test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetTabletMapForShard failed: %v", err)
+	}
+	if len(tabletMap) != 31 {
+		t.Errorf("want 31 tablets, got %v", len(tabletMap))
+	}
+	for alias, ti := range tabletMap {
+		if ti.Alias != alias {
+			t.Errorf("tablet %v mapped to %v", ti.Alias, alias)
+		}
+	}
+	for _, cell := range cells {
+		if n := sts.maxInFlight[cell]; n < 1 || n > 4 {
+			t.Errorf("want at most 4 tablet reads at a time in %v, got %v", cell, n)
+		}
+	}
+
+	// a missing tablet is skipped, other errors make the map partial
+	aliases := []topo.TabletAlias{{Cell: "cell1", Uid: 1}, {Cell: "cell1", Uid: 666}}
+	if tabletMap, err := GetTabletMap(sts, aliases); err != nil || len(tabletMap) != 1 {
+		t.Errorf("GetTabletMap(missing tablet): %v %v", tabletMap, err)
+	}
+	sts.brokenCell = "cell2"
+	aliases = append(aliases, topo.TabletAlias{Cell: "cell2", Uid: 101})
+	if tabletMap, err := GetTabletMap(sts, aliases); err != topo.ErrPartialResult || len(tabletMap) != 1 {
+		t.Errorf("GetTabletMap(broken cell): %v %v", tabletMap, err)
+	}
+}
+
+func TestRunConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	done := make([]bool, 20)
+	runConcurrently(len(done), 3, func(i int) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inFlight--
+		done[i] = true
+		mu.Unlock()
+	})
+	if maxInFlight > 3 {
+		t.Errorf("want at most 3 calls at a time, got %v", maxInFlight)
+	}
+	for i, d := range done {
+		if !d {
+			t.Errorf("%v was not run", i)
+		}
+	}
+	// a concurrency of 0 still runs them, one at a time
+	count := 0
+	runConcurrently(5, 0, func(i int) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+	})
+	if count != 5 {
+		t.Errorf("want 5 calls, got %v", count)
+	}
+}
+
+func benchmarkGetTabletMapForShard(b *testing.B, concurrency int) {
+	var cells []string
+	for i := 1; i <= 5; i++ {
+		cells = append(cells, fmt.Sprintf("cell%v", i))
+	}
+	sts := newSlowTabletServer(zktopo.NewTestServer(b, cells), time.Millisecond)
+	createTabletMapShard(b, sts, cells, 8)
+	defer func(saved int) {
+		*tabletReadConcurrency = saved
+	}(*tabletReadConcurrency)
+	*tabletReadConcurrency = concurrency
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetTabletMapForShard(sts, "test_keyspace", "0"); err != nil {
+			b.Fatalf("GetTabletMapForShard failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkGetTabletMapForShardSerial reads the 41 tablets of a shard
+// in 5 cells one at a time in each cell, 1ms each.
+func BenchmarkGetTabletMapForShardSerial(b *testing.B) {
+	benchmarkGetTabletMapForShard(b, 1)
+}
+
+// BenchmarkGetTabletMapForShardConcurrent reads them 8 at a time in
+// each cell.
+func BenchmarkGetTabletMapForShardConcurrent(b *testing.B) {
+	benchmarkGetTabletMapForShard(b, 8)
+}
+
+func TestListShardTablets(t *testing.T) {
+	cells := []string{"cell1", "cell2", "cell3"}
+	sts := newSlowTabletServer(zktopo.NewTestServer(t, cells), 0)
+	createTabletMapShard(t, sts, cells, 2)
+	listed := func() []string {
+		tablets, cellErrors, err := ListShardTablets(sts, "test_keyspace", "0")
+		if err != nil {
+			t.Fatalf("ListShardTablets failed: %v", err)
+		}
+		var result []string
+		for _, ti := range tablets {
+			result = append(result, ti.Alias.String())
+		}
+		for _, cellError := range cellErrors {
+			result = append(result, "error in "+cellError.Cell)
+		}
+		return result
+	}
+
+	want := []string{"cell1-0000000001", "cell1-0000000101", "cell1-0000000102", "cell2-0000000103", "cell2-0000000104", "cell3-0000000105", "cell3-0000000106"}
+	if got := listed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// the tablets of the other cells are still listed
+	sts.brokenCell = "cell2"
+	sts.brokenReplicationCell = "cell3"
+	want = []string{"cell1-0000000001", "cell1-0000000101", "cell1-0000000102", "error in cell2", "error in cell3"}
+	if got := listed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if tabletMap, err := GetTabletMapForShard(sts, "test_keyspace", "0"); err != topo.ErrPartialResult || len(tabletMap) != 3 {
+		t.Errorf("GetTabletMapForShard(broken cells): %v %v", tabletMap, err)
+	}
+	if _, _, err := ListShardTablets(sts, "test_keyspace", "1"); err == nil {
+		t.Errorf("ListShardTablets(unknown shard) worked")
+	}
+}
@@ -6,6 +6,8 @@ package wrangler
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -244,24 +246,29 @@ func (wr *Wrangler) pingTablets(tabletMap map[topo.TabletAlias]*topo.TabletInfo,
 		wg.Add(1)
 		go func(tabletAlias topo.TabletAlias, tabletInfo *topo.TabletInfo) {
 			defer wg.Done()
-
-			if err := wr.ts.ValidateTabletPidNode(tabletAlias); err != nil {
-				results <- vresult{tabletAlias.String(), fmt.Errorf("no pid node on %v: %v", tabletInfo.Hostname, err)}
-				return
+			if err := wr.pingTablet(tabletAlias, tabletInfo); err != nil {
+				results <- vresult{tabletAlias.String(), err}
 			}
+		}(tabletAlias, tabletInfo)
+	}
+}
 
-			actionPath, err := wr.ai.Ping(tabletAlias)
-			if err != nil {
-				results <- vresult{tabletAlias.String(), fmt.Errorf("%v: %v %v", actionPath, err, tabletInfo.Hostname)}
-				return
-			}
+// pingTablet checks the tablet has a pid node, and runs a Ping action
+// on it.
+func (wr *Wrangler) pingTablet(tabletAlias topo.TabletAlias, tabletInfo *topo.TabletInfo) error {
+	if err := wr.ts.ValidateTabletPidNode(tabletAlias); err != nil {
+		return fmt.Errorf("no pid node on %v: %v", tabletInfo.Hostname, err)
+	}
 
-			err = wr.ai.WaitForCompletion(actionPath, wr.actionTimeout())
-			if err != nil {
-				results <- vresult{tabletAlias.String(), fmt.Errorf("%v: %v %v", actionPath, err, tabletInfo.Hostname)}
-			}
-		}(tabletAlias, tabletInfo)
+	actionPath, err := wr.ai.Ping(tabletAlias)
+	if err != nil {
+		return fmt.Errorf("%v: %v %v", actionPath, err, tabletInfo.Hostname)
+	}
+
+	if err := wr.ai.WaitForCompletion(actionPath, wr.actionTimeout()); err != nil {
+		return fmt.Errorf("%v: %v %v", actionPath, err, tabletInfo.Hostname)
 	}
+	return nil
 }
 
 // Validate a whole TopologyServer tree
@@ -305,13 +312,261 @@ func (wr *Wrangler) ValidateKeyspace(keyspace string, pingTablets bool) error {
 	return wr.waitForResults(wg, results)
 }
 
-func (wr *Wrangler) ValidateShard(keyspace, shard string, pingTablets bool) error {
-	wg := &sync.WaitGroup{}
-	results := make(chan vresult, 16)
-	wg.Add(1)
-	go func() {
-		wr.validateShard(keyspace, shard, pingTablets, wg, results)
-		wg.Done()
-	}()
-	return wr.waitForResults(wg, results)
+// ShardValidation is the report of ValidateShard. The shard is valid
+// if it has no problem of any kind.
+type ShardValidation struct {
+	Keyspace string
+	Shard    string
+	// DanglingLinks are the links of the replication graph to tablets
+	// that don't exist, or that are not in the shard, with the reason.
+	DanglingLinks map[topo.TabletAlias]string
+	// MissingFromGraph are the tablets of the shard that are not in
+	// the replication graph of their cell.
+	MissingFromGraph []topo.TabletAlias
+	// MasterProblem is set if the shard has no master, or if its
+	// MasterAlias is not a master tablet.
+	MasterProblem string
+	// CellsWithoutReplication are the cells of the shard that have no
+	// replication data.
+	CellsWithoutReplication []string
+	// Unreachable are the tablets that didn't answer a Ping action.
+	Unreachable map[topo.TabletAlias]error
+	// Errors are the other problems: the records that couldn't be
+	// read, the tablet records that are not valid, and the slaves
+	// that don't replicate from the master.
+	Errors []string
+}
+
+// ProblemCount returns the number of problems of the shard.
+func (sv *ShardValidation) ProblemCount() int {
+	count := len(sv.DanglingLinks) + len(sv.MissingFromGraph) + len(sv.CellsWithoutReplication) + len(sv.Unreachable) + len(sv.Errors)
+	if sv.MasterProblem != "" {
+		count++
+	}
+	return count
+}
+
+// Valid returns true if the shard has no problem.
+func (sv *ShardValidation) Valid() bool {
+	return sv.ProblemCount() == 0
+}
+
+// String lists the problems of the shard, one per line.
+func (sv *ShardValidation) String() string {
+	if sv.Valid() {
+		return fmt.Sprintf("shard %v/%v is valid", sv.Keyspace, sv.Shard)
+	}
+	lines := []string{fmt.Sprintf("shard %v/%v has %v problems:", sv.Keyspace, sv.Shard, sv.ProblemCount())}
+	if sv.MasterProblem != "" {
+		lines = append(lines, "master: "+sv.MasterProblem)
+	}
+	for _, cell := range sv.CellsWithoutReplication {
+		lines = append(lines, "no replication data in cell "+cell)
+	}
+	for _, alias := range sortedAliases(sv.DanglingLinks) {
+		lines = append(lines, fmt.Sprintf("dangling replication link to %v: %v", alias, sv.DanglingLinks[alias]))
+	}
+	for _, alias := range sv.MissingFromGraph {
+		lines = append(lines, fmt.Sprintf("tablet %v is not in the replication graph", alias))
+	}
+	unreachable := make(map[topo.TabletAlias]string, len(sv.Unreachable))
+	for alias, err := range sv.Unreachable {
+		unreachable[alias] = err.Error()
+	}
+	for _, alias := range sortedAliases(unreachable) {
+		lines = append(lines, fmt.Sprintf("tablet %v is unreachable: %v", alias, unreachable[alias]))
+	}
+	lines = append(lines, sv.Errors...)
+	return strings.Join(lines, "\n")
+}
+
+// sortedAliases returns the tablet aliases of m, sorted.
+func sortedAliases(m map[topo.TabletAlias]string) []topo.TabletAlias {
+	aliases := make([]topo.TabletAlias, 0, len(m))
+	for alias := range m {
+		aliases = append(aliases, alias)
+	}
+	sort.Sort(topo.TabletAliasList(aliases))
+	return aliases
+}
+
+// ValidateShard cross-checks the shard record, the replication graph
+// of each cell of the shard, and the tablet records of those cells.
+// With pingTablets, it also pings the tablets of the replication
+// graph, and checks their slaves replicate from the master. It returns
+// an error if the shard can't be read, or if it is not valid, in which
+// case the ShardValidation lists the problems.
+func (wr *Wrangler) ValidateShard(keyspace, shard string, pingTablets bool) (*ShardValidation, error) {
+	shardInfo, err := wr.ts.GetShard(keyspace, shard)
+	if err != nil {
+		return nil, err
+	}
+	sv := &ShardValidation{
+		Keyspace:      keyspace,
+		Shard:         shard,
+		DanglingLinks: make(map[topo.TabletAlias]string),
+		Unreachable:   make(map[topo.TabletAlias]error),
+	}
+	mu := sync.Mutex{}
+	addError := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		sv.Errors = append(sv.Errors, fmt.Sprintf(format, args...))
+	}
+
+	// read the replication graph and the tablets of each cell
+	var links []topo.ReplicationLink
+	var cellAliases []topo.TabletAlias
+	wg := sync.WaitGroup{}
+	for _, cell := range shardInfo.Cells {
+		wg.Add(1)
+		go func(cell string) {
+			defer wg.Done()
+			sri, err := wr.ts.GetShardReplication(cell, keyspace, shard)
+			// the master is only in the shard record, its cell may
+			// have no links
+			switch {
+			case err == topo.ErrNoNode || (err == nil && len(sri.ReplicationLinks) == 0 && cell != shardInfo.MasterAlias.Cell):
+				mu.Lock()
+				sv.CellsWithoutReplication = append(sv.CellsWithoutReplication, cell)
+				mu.Unlock()
+			case err != nil:
+				addError("cannot read the replication graph of cell %v: %v", cell, err)
+			default:
+				mu.Lock()
+				links = append(links, sri.ReplicationLinks...)
+				mu.Unlock()
+			}
+
+			aliases, err := wr.ts.GetTabletsByCell(cell)
+			if err != nil && err != topo.ErrNoNode {
+				addError("cannot list the tablets of cell %v: %v", cell, err)
+				return
+			}
+			mu.Lock()
+			cellAliases = append(cellAliases, aliases...)
+			mu.Unlock()
+		}(cell)
+	}
+	wg.Wait()
+	sort.Strings(sv.CellsWithoutReplication)
+
+	// read every tablet, the ones of the replication graph may be in
+	// other cells. The master is part of the graph through the shard
+	// record.
+	aliasSet := make(map[topo.TabletAlias]bool)
+	for _, alias := range cellAliases {
+		aliasSet[alias] = true
+	}
+	inGraph := make(map[topo.TabletAlias]bool)
+	for _, link := range links {
+		aliasSet[link.TabletAlias] = true
+		inGraph[link.TabletAlias] = true
+	}
+	if !shardInfo.MasterAlias.IsZero() {
+		aliasSet[shardInfo.MasterAlias] = true
+	}
+	aliases := make([]topo.TabletAlias, 0, len(aliasSet))
+	for alias := range aliasSet {
+		aliases = append(aliases, alias)
+	}
+	sort.Sort(topo.TabletAliasList(aliases))
+	tablets := make([]*topo.TabletInfo, len(aliases))
+	tabletErrors := make([]error, len(aliases))
+	runConcurrently(len(aliases), *tabletReadConcurrency, func(i int) {
+		tablets[i], tabletErrors[i] = wr.ts.GetTablet(aliases[i])
+	})
+
+	tabletMap := make(map[topo.TabletAlias]*topo.TabletInfo)
+	for i, alias := range aliases {
+		tablet, err := tablets[i], tabletErrors[i]
+		inShard := err == nil && tablet.Keyspace == keyspace && tablet.Shard == shard
+		if inGraph[alias] {
+			switch {
+			case err == topo.ErrNoNode:
+				sv.DanglingLinks[alias] = "the tablet doesn't exist"
+			case err != nil:
+				addError("cannot read tablet %v: %v", alias, err)
+			case !inShard:
+				sv.DanglingLinks[alias] = fmt.Sprintf("the tablet is in shard %v/%v", tablet.Keyspace, tablet.Shard)
+			default:
+				tabletMap[alias] = tablet
+			}
+			continue
+		}
+		if alias == shardInfo.MasterAlias {
+			if inShard {
+				tabletMap[alias] = tablet
+			}
+			continue
+		}
+		if inShard && topo.IsInReplicationGraph(tablet.Type) {
+			sv.MissingFromGraph = append(sv.MissingFromGraph, alias)
+		}
+	}
+
+	// check the master
+	if shardInfo.MasterAlias.IsZero() {
+		sv.MasterProblem = "the shard has no master"
+	} else {
+		for i, alias := range aliases {
+			if alias != shardInfo.MasterAlias {
+				continue
+			}
+			switch tablet, err := tablets[i], tabletErrors[i]; {
+			case err == topo.ErrNoNode:
+				sv.MasterProblem = fmt.Sprintf("the master %v doesn't exist", alias)
+			case err != nil:
+				sv.MasterProblem = fmt.Sprintf("cannot read the master %v: %v", alias, err)
+			case tablet.Keyspace != keyspace || tablet.Shard != shard:
+				sv.MasterProblem = fmt.Sprintf("the master %v is in shard %v/%v", alias, tablet.Keyspace, tablet.Shard)
+			case tablet.Type != topo.TYPE_MASTER:
+				sv.MasterProblem = fmt.Sprintf("the master %v is a %v tablet", alias, tablet.Type)
+			}
+		}
+	}
+
+	// validate the tablet records of the replication graph
+	for alias := range tabletMap {
+		wg.Add(1)
+		go func(alias topo.TabletAlias) {
+			defer wg.Done()
+			if err := topo.Validate(wr.ts, alias); err != nil {
+				addError("tablet %v is not valid: %v", alias, err)
+			}
+		}(alias)
+	}
+	wg.Wait()
+
+	if pingTablets {
+		results := make(chan vresult, 16)
+		go func() {
+			if sv.MasterProblem == "" {
+				wr.validateReplication(shardInfo, tabletMap, results)
+			}
+			close(results)
+		}()
+		for vd := range results {
+			addError("%v: %v", vd.name, vd.err)
+		}
+
+		for alias, tablet := range tabletMap {
+			wg.Add(1)
+			go func(alias topo.TabletAlias, tablet *topo.TabletInfo) {
+				defer wg.Done()
+				if err := wr.pingTablet(alias, tablet); err != nil {
+					mu.Lock()
+					sv.Unreachable[alias] = err
+					mu.Unlock()
+				}
+			}(alias, tablet)
+		}
+		wg.Wait()
+	}
+	sort.Strings(sv.Errors)
+
+	if !sv.Valid() {
+		return sv, fmt.Errorf("shard %v/%v has %v problems", keyspace, shard, sv.ProblemCount())
+	}
+	return sv, nil
 }
@@ -0,0 +1,120 @@
+// Copyright 2014, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+func TestValidateShard(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1", "cell2", "cell3"})
+	wr := New(ts, time.Minute, time.Second)
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace failed: %v", err)
+	}
+	for _, shard := range []string{"0", "1"} {
+		if err := topo.CreateShard(ts, "test_keyspace", shard); err != nil {
+			t.Fatalf("CreateShard failed: %v", err)
+		}
+	}
+	master := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	replica := topo.TabletAlias{Cell: "cell1", Uid: 2}
+	deleted := topo.TabletAlias{Cell: "cell2", Uid: 3}
+	missing := topo.TabletAlias{Cell: "cell2", Uid: 4}
+	moved := topo.TabletAlias{Cell: "cell2", Uid: 5}
+	tablets := []*topo.Tablet{
+		{Alias: master, Shard: "0", Type: topo.TYPE_MASTER},
+		{Alias: replica, Shard: "0", Type: topo.TYPE_REPLICA, Parent: master},
+		{Alias: deleted, Shard: "0", Type: topo.TYPE_REPLICA, Parent: master},
+		{Alias: missing, Shard: "0", Type: topo.TYPE_RDONLY, Parent: master},
+		{Alias: moved, Shard: "1", Type: topo.TYPE_REPLICA},
+	}
+	for _, tablet := range tablets {
+		tablet.Keyspace = "test_keyspace"
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet(%v) failed: %v", tablet.Alias, err)
+		}
+	}
+	si, err := ts.GetShard("test_keyspace", "0")
+	if err != nil {
+		t.Fatalf("GetShard failed: %v", err)
+	}
+	si.Cells = []string{"cell1", "cell2"}
+	si.MasterAlias = master
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	sv, err := wr.ValidateShard("test_keyspace", "0", false)
+	if err != nil || !sv.Valid() {
+		t.Fatalf("ValidateShard failed: %v\n%v", err, sv)
+	}
+
+	// break the shard the ways crashed operations do
+	if err := ts.DeleteTablet(deleted); err != nil {
+		t.Fatalf("DeleteTablet failed: %v", err)
+	}
+	if err := topo.RemoveShardReplicationRecord(ts, "test_keyspace", "0", missing); err != nil {
+		t.Fatalf("RemoveShardReplicationRecord failed: %v", err)
+	}
+	if err := topo.AddShardReplicationRecord(ts, "test_keyspace", "0", moved, master); err != nil {
+		t.Fatalf("AddShardReplicationRecord failed: %v", err)
+	}
+	si.Cells = append(si.Cells, "cell3")
+	si.MasterAlias = replica
+	if err := ts.UpdateShard(si); err != nil {
+		t.Fatalf("UpdateShard failed: %v", err)
+	}
+
+	sv, err = wr.ValidateShard("test_keyspace", "0", false)
+	if err == nil || err.Error() != "shard test_keyspace/0 has 6 problems" {
+		t.Errorf("ValidateShard returned %v, want 6 problems", err)
+	}
+	wantDangling := map[topo.TabletAlias]string{
+		deleted: "the tablet doesn't exist",
+		moved:   "the tablet is in shard test_keyspace/1",
+	}
+	if !reflect.DeepEqual(sv.DanglingLinks, wantDangling) {
+		t.Errorf("want dangling links %v, got %v", wantDangling, sv.DanglingLinks)
+	}
+	// the old master is no longer referenced by the shard
+	if want := []topo.TabletAlias{master, missing}; !reflect.DeepEqual(sv.MissingFromGraph, want) {
+		t.Errorf("want %v missing from the graph, got %v", want, sv.MissingFromGraph)
+	}
+	if want := "the master cell1-0000000002 is a replica tablet"; sv.MasterProblem != want {
+		t.Errorf("want master problem %q, got %q", want, sv.MasterProblem)
+	}
+	if want := []string{"cell3"}; !reflect.DeepEqual(sv.CellsWithoutReplication, want) {
+		t.Errorf("want cells without replication %v, got %v", want, sv.CellsWithoutReplication)
+	}
+	if len(sv.Unreachable) != 0 || len(sv.Errors) != 0 {
+		t.Errorf("unexpected problems %v %v", sv.Unreachable, sv.Errors)
+	}
+	want := `shard test_keyspace/0 has 6 problems:
+master: the master cell1-0000000002 is a replica tablet
+no replication data in cell cell3
+dangling replication link to cell2-0000000003: the tablet doesn't exist
+dangling replication link to cell2-0000000005: the tablet is in shard test_keyspace/1
+tablet cell1-0000000001 is not in the replication graph
+tablet cell2-0000000004 is not in the replication graph`
+	if sv.String() != want {
+		t.Errorf("want report:\n%v\ngot:\n%v", want, sv)
+	}
+
+	// the tablets have no vttablet running, they don't answer
+	sv, err = wr.ValidateShard("test_keyspace", "0", true)
+	if err == nil || len(sv.Unreachable) != 1 {
+		t.Fatalf("want 1 unreachable tablet, got %v\n%v", err, sv)
+	}
+	if err := sv.Unreachable[replica]; err == nil || !strings.Contains(err.Error(), "no pid node") {
+		t.Errorf("unexpected ping error %v", err)
+	}
+}
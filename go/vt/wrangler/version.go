@@ -22,31 +22,35 @@ type debugVars struct {
 	Version string
 }
 
-func (wr *Wrangler) GetVersion(tabletAlias topo.TabletAlias) (string, error) {
-	// read the tablet from TopologyServer to get the address to connect to
-	tablet, err := wr.ts.GetTablet(tabletAlias)
-	if err != nil {
-		return "", err
-	}
-
+// getDebugVars reads the /debug/vars of a tablet into vars.
+func getDebugVars(tablet *topo.TabletInfo, vars interface{}) error {
 	// build the url, get debug/vars
 	resp, err := http.Get("http://" + tablet.GetAddr() + "/debug/vars")
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	// convert json
-	vars := debugVars{}
-	err = json.Unmarshal(body, &vars)
+	return json.Unmarshal(body, vars)
+}
+
+func (wr *Wrangler) GetVersion(tabletAlias topo.TabletAlias) (string, error) {
+	// read the tablet from TopologyServer to get the address to connect to
+	tablet, err := wr.ts.GetTablet(tabletAlias)
 	if err != nil {
 		return "", err
 	}
 
+	vars := debugVars{}
+	if err := getDebugVars(tablet, &vars); err != nil {
+		return "", err
+	}
+
 	// split the version into date and md5
 	parts := strings.Split(vars.Version, " ")
 	if len(parts) != 2 {
@@ -17,13 +17,26 @@ const (
 	DefaultLockTimeout   = 30 * time.Second
 )
 
-var tabletManagerProtocol = flag.String("tablet_manager_protocol", "bson", "the protocol to use to talk to vttablet")
+var (
+	tabletManagerProtocol = flag.String("tablet_manager_protocol", "bson", "the protocol to use to talk to vttablet")
+	actionLogMaxEntries   = flag.Int("action_log_max_entries", 100, "how many entries to keep in the action log of each keyspace and shard (0 for no limit)")
+	schemaChangeShardLock = flag.Bool("schema_change_shard_lock", true, "hold the shard lock while applying a schema change to a shard. Only disable it if the lock can't be obtained, and nothing else runs on the shard")
+	shardLockHeartbeat    = flag.Duration("shard_lock_heartbeat", time.Minute, "how often long running shard actions, like schema changes, update their shard lock (0 to disable)")
+	lockWaitWarning       = flag.Duration("lock_wait_warning", 10*time.Second, "log a warning, with the action holding the lock, when waiting for a keyspace or shard lock takes longer than this (0 to disable)")
+)
 
+// Wrangler is safe for concurrent use from multiple goroutines:
+// operations on different shards are independent, and operations on
+// the same shard serialize on the shard lock. All the operations of a
+// Wrangler share its action deadline and interrupt channel, use
+// ForOperation to give each operation its own.
 type Wrangler struct {
 	ts          topo.Server
 	ai          *initiator.ActionInitiator
 	deadline    time.Time
 	lockTimeout time.Duration
+	interrupted chan struct{}
+	logger      Logger
 
 	// Configuration parameters, mostly for tests.
 
@@ -31,6 +44,31 @@ type Wrangler struct {
 	// remote actions. It is faster in production, as we don't
 	// fork a vtaction. However, unit tests don't support it.
 	UseRPCs bool
+
+	// ActionLogMaxEntries is the number of entries to keep in the
+	// action log of each keyspace and shard, 0 meaning no limit.
+	ActionLogMaxEntries int
+
+	// SchemaChangeShardLock makes ApplySchemaShard and
+	// ApplySchemaKeyspace hold the lock of each shard while
+	// they change its schema.
+	SchemaChangeShardLock bool
+
+	// ShardLockHeartbeat is how often long running shard
+	// actions update their lock, 0 meaning never.
+	ShardLockHeartbeat time.Duration
+
+	// LockWaitWarning is how long a keyspace or shard lock can be
+	// waited for before a warning is logged, 0 meaning never.
+	LockWaitWarning time.Duration
+
+	// UnlockRetryDelay is how long the first retry of a shard unlock
+	// that failed on a transient error waits, see unlockShard.
+	UnlockRetryDelay time.Duration
+
+	// plan is where a wrangler returned by DryRun records its
+	// assumptions, nil otherwise.
+	plan *DryRunPlan
 }
 
 // actionTimeout: how long should we wait for an action to complete?
@@ -39,7 +77,21 @@ type Wrangler struct {
 //   know that out action will fail. However, automated action will need some time to
 //   arbitrate the locks.
 func New(ts topo.Server, actionTimeout, lockTimeout time.Duration) *Wrangler {
-	return &Wrangler{ts, initiator.NewActionInitiator(ts, *tabletManagerProtocol), time.Now().Add(actionTimeout), lockTimeout, true}
+	return &Wrangler{
+		ts:                  ts,
+		ai:                  initiator.NewActionInitiator(ts, *tabletManagerProtocol),
+		deadline:            time.Now().Add(actionTimeout),
+		lockTimeout:         lockTimeout,
+		interrupted:         interrupted,
+		logger:              glogLogger{},
+		UseRPCs:             true,
+		ActionLogMaxEntries: *actionLogMaxEntries,
+
+		SchemaChangeShardLock: *schemaChangeShardLock,
+		ShardLockHeartbeat:    *shardLockHeartbeat,
+		LockWaitWarning:       *lockWaitWarning,
+		UnlockRetryDelay:      100 * time.Millisecond,
+	}
 }
 
 func (wr *Wrangler) actionTimeout() time.Duration {
@@ -54,17 +106,46 @@ func (wr *Wrangler) ActionInitiator() *initiator.ActionInitiator {
 	return wr.ai
 }
 
+// SetLogger changes where the wrangler operations report
+// their progress. The default is to log to glog.
+func (wr *Wrangler) SetLogger(logger Logger) {
+	wr.logger = logger
+}
+
+// Logger returns the Logger used by the wrangler operations.
+func (wr *Wrangler) Logger() Logger {
+	return wr.logger
+}
+
 // ResetActionTimeout should be used before every action on a wrangler
 // object that is going to be re-used:
 // - vtctl will not call this, as it does one action
 // - vtctld will call this, as it re-uses the same wrangler for actions
+// It must not be called while operations are running on the
+// wrangler, use ForOperation for concurrent operations instead.
 func (wr *Wrangler) ResetActionTimeout(actionTimeout time.Duration) {
 	wr.deadline = time.Now().Add(actionTimeout)
 }
 
+// ForOperation returns a copy of the wrangler to run one operation
+// with its own action timeout. If interrupted is not nil, closing it
+// interrupts the lock waits of that operation, instead of
+// SignalInterrupt. The copy shares the topo server, the action
+// initiator and the logger with the original.
+func (wr *Wrangler) ForOperation(actionTimeout time.Duration, interrupted chan struct{}) *Wrangler {
+	result := *wr
+	result.deadline = time.Now().Add(actionTimeout)
+	if interrupted != nil {
+		result.interrupted = interrupted
+	}
+	return &result
+}
+
 // signal handling
 var interrupted = make(chan struct{})
 
+// SignalInterrupt interrupts the lock waits of all the wranglers,
+// except the ones created by ForOperation with their own channel.
 func SignalInterrupt() {
 	close(interrupted)
 }
@@ -113,3 +113,14 @@ func (zkts *Server) DeleteKeyspaceShards(keyspace string) error {
 	}
 	return nil
 }
+
+func (zkts *Server) DeleteKeyspace(keyspace string) error {
+	keyspacePath := path.Join(globalKeyspacesPath, keyspace)
+	if err := zk.DeleteRecursive(zkts.zconn, keyspacePath, -1); err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return topo.ErrNoNode
+		}
+		return err
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package zktopo
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -72,16 +73,112 @@ func (zkts *Server) lockForAction(actionDir, contents string, timeout time.Durat
 	return actionPath, nil
 }
 
+// unlockForAction stores the results in the actionlog, and deletes
+// the action node. The errors of ZooKeeper are converted as the
+// deletes do, so the callers can retry on topo.ErrUnreachable, and
+// know that a retry returning topo.ErrNoNode found the lock released.
 func (zkts *Server) unlockForAction(lockPath, results string) error {
-	// Write the data to the actionlog
+	// Write the data to the actionlog. It already exists if a
+	// previous unlock stored it, and failed afterwards.
 	actionLogPath := strings.Replace(lockPath, "/action/", "/actionlog/", 1)
-	if _, err := zk.CreateRecursive(zkts.zconn, actionLogPath, results, 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+	if _, err := zk.CreateRecursive(zkts.zconn, actionLogPath, results, 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil && !zookeeper.IsError(err, zookeeper.ZNODEEXISTS) {
 		log.Warningf("Cannot create actionlog path %v (check the permissions with 'zk stat'), will keep the lock, use 'zk rm' to clear the lock", actionLogPath)
-		return err
+		return convertDeleteError(err)
 	}
 
 	// and delete the action
-	return zk.DeleteRecursive(zkts.zconn, lockPath, -1)
+	if err := zk.DeleteRecursive(zkts.zconn, lockPath, -1); err != nil {
+		return convertDeleteError(err)
+	}
+	return nil
+}
+
+// getActionNodes returns the contents of the action nodes in
+// actionDir, in lock queue order.
+func (zkts *Server) getActionNodes(actionDir string) ([]string, error) {
+	children, _, err := zkts.zconn.Children(actionDir)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return nil, topo.ErrNoNode
+		}
+		return nil, err
+	}
+	sort.Strings(children)
+
+	result := make([]string, 0, len(children))
+	for _, child := range children {
+		data, _, err := zkts.zconn.Get(path.Join(actionDir, child))
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				// the action ended since we listed it
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, data)
+	}
+	return result, nil
+}
+
+// appendAuditLog adds a sequential node to auditLogPath, and prunes
+// the oldest ones beyond maxEntries. auditLogPath is created with
+// its first entry, its parent must exist.
+func (zkts *Server) appendAuditLog(auditLogPath, contents string, maxEntries int) error {
+	// Trailing slash so the sequential node is created as a child.
+	_, err := zkts.zconn.Create(auditLogPath+"/", contents, zookeeper.SEQUENCE, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	if zookeeper.IsError(err, zookeeper.ZNONODE) {
+		_, err = zkts.zconn.Create(auditLogPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+		if err == nil || zookeeper.IsError(err, zookeeper.ZNODEEXISTS) {
+			_, err = zkts.zconn.Create(auditLogPath+"/", contents, zookeeper.SEQUENCE, zookeeper.WorldACL(zookeeper.PERM_ALL))
+		}
+	}
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return topo.ErrNoNode
+		}
+		return err
+	}
+	if maxEntries > 0 {
+		if _, err := zkts.pruneChildren(auditLogPath, maxEntries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAuditLog returns the contents of the nodes in auditLogPath,
+// most recent first. It is empty if nothing was logged yet, and
+// ErrNoNode if the parent of auditLogPath doesn't exist.
+func (zkts *Server) getAuditLog(auditLogPath string) ([]string, error) {
+	children, _, err := zkts.zconn.Children(auditLogPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			stat, err := zkts.zconn.Exists(path.Dir(auditLogPath))
+			if err != nil {
+				return nil, err
+			}
+			if stat == nil {
+				return nil, topo.ErrNoNode
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(children)))
+
+	result := make([]string, 0, len(children))
+	for _, child := range children {
+		data, _, err := zkts.zconn.Get(path.Join(auditLogPath, child))
+		if err != nil {
+			if zookeeper.IsError(err, zookeeper.ZNONODE) {
+				// pruned since we listed it
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, data)
+	}
+	return result, nil
 }
 
 func (zkts *Server) LockKeyspaceForAction(keyspace, contents string, timeout time.Duration, interrupted chan struct{}) (string, error) {
@@ -102,6 +199,75 @@ func (zkts *Server) LockShardForAction(keyspace, shard, contents string, timeout
 	return zkts.lockForAction(actionDir, contents, timeout, interrupted)
 }
 
+func (zkts *Server) UpdateShardActionLock(keyspace, shard, lockPath, contents string) error {
+	if _, err := zkts.zconn.Set(lockPath, contents, -1); err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return topo.ErrNoNode
+		}
+		return err
+	}
+	return nil
+}
+
 func (zkts *Server) UnlockShardForAction(keyspace, shard, lockPath, results string) error {
 	return zkts.unlockForAction(lockPath, results)
 }
+
+func (zkts *Server) ForceUnlockShard(keyspace, shard, contents string) error {
+	actionDir := path.Join(globalKeyspacesPath, keyspace, "shards", shard, "action")
+	children, _, err := zkts.zconn.Children(actionDir)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			return topo.ErrNoNode
+		}
+		return err
+	}
+	if len(children) == 0 {
+		return topo.ErrNoNode
+	}
+	sort.Strings(children)
+
+	// the version check makes sure the holder didn't change since
+	// its contents were compared
+	lockPath := path.Join(actionDir, children[0])
+	data, stat, err := zkts.zconn.Get(lockPath)
+	if err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) {
+			// the action ended since we listed it
+			return topo.ErrBadVersion
+		}
+		return err
+	}
+	if data != contents {
+		return topo.ErrBadVersion
+	}
+	if err := zkts.zconn.Delete(lockPath, stat.Version()); err != nil {
+		if zookeeper.IsError(err, zookeeper.ZNONODE) || zookeeper.IsError(err, zookeeper.ZBADVERSION) {
+			return topo.ErrBadVersion
+		}
+		return err
+	}
+	return nil
+}
+
+func (zkts *Server) GetShardActionNodes(keyspace, shard string) ([]string, error) {
+	return zkts.getActionNodes(path.Join(globalKeyspacesPath, keyspace, "shards", shard, "action"))
+}
+
+func (zkts *Server) AppendKeyspaceActionLog(keyspace, contents string, maxEntries int) error {
+	auditLogPath := path.Join(globalKeyspacesPath, keyspace, "auditlog")
+	return zkts.appendAuditLog(auditLogPath, contents, maxEntries)
+}
+
+func (zkts *Server) GetKeyspaceActionLog(keyspace string) ([]string, error) {
+	return zkts.getAuditLog(path.Join(globalKeyspacesPath, keyspace, "auditlog"))
+}
+
+func (zkts *Server) AppendShardActionLog(keyspace, shard, contents string, maxEntries int) error {
+	auditLogPath := path.Join(globalKeyspacesPath, keyspace, "shards", shard, "auditlog")
+	return zkts.appendAuditLog(auditLogPath, contents, maxEntries)
+}
+
+func (zkts *Server) GetShardActionLog(keyspace, shard string) ([]string, error) {
+	return zkts.getAuditLog(path.Join(globalKeyspacesPath, keyspace, "shards", shard, "auditlog"))
+}
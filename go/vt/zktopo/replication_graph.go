@@ -83,10 +83,7 @@ func (zkts *Server) DeleteShardReplication(cell, keyspace, shard string) error {
 	zkPath := shardReplicationPath(cell, keyspace, shard)
 	err := zkts.zconn.Delete(zkPath, -1)
 	if err != nil {
-		if zookeeper.IsError(err, zookeeper.ZNONODE) {
-			err = topo.ErrNoNode
-		}
-		return err
+		return convertDeleteError(err)
 	}
 	return nil
 }
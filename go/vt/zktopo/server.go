@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/youtube/vitess/go/stats"
@@ -21,6 +22,25 @@ type Server struct {
 	zconn zk.Conn
 }
 
+// convertDeleteError translates the zookeeper errors of a Delete that
+// have a topo equivalent: a missing node, and a cell that can't be
+// reached, see topo.ErrUnreachable.
+func convertDeleteError(err error) error {
+	switch {
+	case zookeeper.IsError(err, zookeeper.ZNONODE):
+		return topo.ErrNoNode
+	case zookeeper.IsError(err, zookeeper.ZCONNECTIONLOSS),
+		zookeeper.IsError(err, zookeeper.ZOPERATIONTIMEOUT),
+		zookeeper.IsError(err, zookeeper.ZSESSIONEXPIRED),
+		zookeeper.IsError(err, zookeeper.ZCLOSING):
+		return topo.ErrUnreachable
+	case strings.HasPrefix(err.Error(), "zk connect"):
+		// the dial errors of zk.ConnCache
+		return topo.ErrUnreachable
+	}
+	return err
+}
+
 func (zkts *Server) Close() {
 	zkts.zconn.Close()
 }
@@ -127,9 +147,14 @@ func (zkts *Server) PruneActionLogs(zkActionLogPath string, keepCount int) (prun
 	if path.Base(zkActionLogPath) != "actionlog" {
 		return 0, fmt.Errorf("not actionlog path: %v", zkActionLogPath)
 	}
+	return zkts.pruneChildren(zkActionLogPath, keepCount)
+}
 
+// pruneChildren deletes the children of zkPath, but the keepCount
+// last ones in sort order.
+func (zkts *Server) pruneChildren(zkPath string, keepCount int) (prunedCount int, err error) {
 	// get sorted list of children
-	children, _, err := zkts.zconn.Children(zkActionLogPath)
+	children, _, err := zkts.zconn.Children(zkPath)
 	if err != nil {
 		return 0, err
 	}
@@ -141,7 +166,7 @@ func (zkts *Server) PruneActionLogs(zkActionLogPath string, keepCount int) (prun
 	}
 
 	for i := 0; i < len(children)-keepCount; i++ {
-		actionPath := path.Join(zkActionLogPath, children[i])
+		actionPath := path.Join(zkPath, children[i])
 		err = zk.DeleteRecursive(zkts.zconn, actionPath, -1)
 		if err != nil {
 			return prunedCount, fmt.Errorf("purge action err: %v", err)
@@ -90,10 +90,7 @@ func (zkts *Server) DeleteSrvTabletType(cell, keyspace, shard string, tabletType
 	path := zkPathForVtName(cell, keyspace, shard, tabletType)
 	err := zkts.zconn.Delete(path, -1)
 	if err != nil {
-		if zookeeper.IsError(err, zookeeper.ZNONODE) {
-			err = topo.ErrNoNode
-		}
-		return err
+		return convertDeleteError(err)
 	}
 	return nil
 }
@@ -127,10 +124,7 @@ func (zkts *Server) DeleteSrvShard(cell, keyspace, shard string) error {
 	path := zkPathForVtShard(cell, keyspace, shard)
 	err := zkts.zconn.Delete(path, -1)
 	if err != nil {
-		if zookeeper.IsError(err, zookeeper.ZNONODE) {
-			err = topo.ErrNoNode
-		}
-		return err
+		return convertDeleteError(err)
 	}
 	return nil
 }
@@ -160,6 +154,14 @@ func (zkts *Server) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, er
 	return srvKeyspace, nil
 }
 
+func (zkts *Server) DeleteSrvKeyspace(cell, keyspace string) error {
+	path := zkPathForVtKeyspace(cell, keyspace)
+	if err := zk.DeleteRecursive(zkts.zconn, path, -1); err != nil {
+		return convertDeleteError(err)
+	}
+	return nil
+}
+
 func (zkts *Server) GetSrvKeyspaceNames(cell string) ([]string, error) {
 	children, _, err := zkts.zconn.Children(zkPathForCell(cell))
 	if err != nil {
@@ -15,7 +15,7 @@ type TestServer struct {
 	localCells []string
 }
 
-func NewTestServer(t *testing.T, cells []string) topo.Server {
+func NewTestServer(t testing.TB, cells []string) topo.Server {
 	zconn := fakezk.NewConn()
 
 	// create the toplevel zk paths
@@ -1,9 +1,15 @@
 package zktopo
 
 import (
+	"errors"
+	"path"
 	"testing"
+	"time"
 
+	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/topo/test"
+	"github.com/youtube/vitess/go/zk"
+	"launchpad.net/gozk/zookeeper"
 )
 
 func TestKeyspace(t *testing.T) {
@@ -50,3 +56,114 @@ func TestActions(t *testing.T) {
 	ts := NewTestServer(t, []string{"test"})
 	test.CheckActions(t, ts)
 }
+
+func TestActionLog(t *testing.T) {
+	ts := NewTestServer(t, []string{"test"})
+	test.CheckActionLog(t, ts)
+}
+
+func TestConvertDeleteError(t *testing.T) {
+	other := errors.New("other")
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{&zookeeper.Error{Op: "delete", Code: zookeeper.ZNONODE}, topo.ErrNoNode},
+		{&zookeeper.Error{Op: "delete", Code: zookeeper.ZCONNECTIONLOSS}, topo.ErrUnreachable},
+		{&zookeeper.Error{Op: "delete", Code: zookeeper.ZOPERATIONTIMEOUT}, topo.ErrUnreachable},
+		{&zookeeper.Error{Op: "dial", Code: zookeeper.ZCLOSING}, topo.ErrUnreachable},
+		{errors.New("zk connect timed out"), topo.ErrUnreachable},
+		{other, other},
+	} {
+		if got := convertDeleteError(c.err); got != c.want {
+			t.Errorf("convertDeleteError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// noCreateConn is a zk.Conn that can't create nodes.
+type noCreateConn struct {
+	zk.Conn
+}
+
+func (conn noCreateConn) Create(path, value string, flags int, aclv []zookeeper.ACL) (string, error) {
+	return "", &zookeeper.Error{Op: "create", Code: zookeeper.ZNOAUTH}
+}
+
+func TestUnlockResultsAndAuditLog(t *testing.T) {
+	ts := NewTestServer(t, []string{"test"})
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard: %v", err)
+	}
+	zconn := ts.(TestServer).Server.(*Server).GetZConn()
+	shardPath := path.Join(globalKeyspacesPath, "test_keyspace", "shards", "0")
+
+	// the results are stored in actionlog/, under the name of the
+	// action node, as they always were
+	lockPath, err := ts.LockShardForAction("test_keyspace", "0", "contents", time.Second, nil)
+	if err != nil {
+		t.Fatalf("LockShardForAction: %v", err)
+	}
+	if err := ts.UnlockShardForAction("test_keyspace", "0", lockPath, "results"); err != nil {
+		t.Fatalf("UnlockShardForAction: %v", err)
+	}
+	resultsPath := path.Join(shardPath, "actionlog", path.Base(lockPath))
+	if data, _, err := zconn.Get(resultsPath); err != nil || data != "results" {
+		t.Errorf("Get(%v): %v %v", resultsPath, data, err)
+	}
+
+	// the audit log is kept apart: it doesn't see the results, and
+	// its entries can't collide with them
+	if entries, err := ts.GetShardActionLog("test_keyspace", "0"); err != nil || len(entries) != 0 {
+		t.Errorf("GetShardActionLog(empty): %v %v", entries, err)
+	}
+	for _, entry := range []string{"entry1", "entry2"} {
+		if err := ts.AppendShardActionLog("test_keyspace", "0", entry, 0); err != nil {
+			t.Fatalf("AppendShardActionLog(%v): %v", entry, err)
+		}
+	}
+	if entries, err := ts.GetShardActionLog("test_keyspace", "0"); err != nil || len(entries) != 2 || entries[0] != "entry2" || entries[1] != "entry1" {
+		t.Errorf("GetShardActionLog: want [entry2 entry1], got %v %v", entries, err)
+	}
+	if children, _, err := zconn.Children(path.Join(shardPath, "actionlog")); err != nil || len(children) != 1 {
+		t.Errorf("want only the results in actionlog/, got %v %v", children, err)
+	}
+
+	// if the results can't be stored, the lock is kept
+	lockPath, err = ts.LockShardForAction("test_keyspace", "0", "contents", time.Second, nil)
+	if err != nil {
+		t.Fatalf("LockShardForAction: %v", err)
+	}
+	if err := NewServer(noCreateConn{zconn}).UnlockShardForAction("test_keyspace", "0", lockPath, "results"); err == nil {
+		t.Errorf("UnlockShardForAction worked without storing the results")
+	}
+	if nodes, err := ts.GetShardActionNodes("test_keyspace", "0"); err != nil || len(nodes) != 1 {
+		t.Errorf("want the lock kept, got %v %v", nodes, err)
+	}
+}
+
+func TestUnlockAgain(t *testing.T) {
+	ts := NewTestServer(t, []string{"test"})
+	if err := ts.CreateKeyspace("test_keyspace", &topo.Keyspace{}); err != nil {
+		t.Fatalf("CreateKeyspace: %v", err)
+	}
+	if err := topo.CreateShard(ts, "test_keyspace", "0"); err != nil {
+		t.Fatalf("CreateShard: %v", err)
+	}
+	lockPath, err := ts.LockShardForAction("test_keyspace", "0", "contents", time.Second, nil)
+	if err != nil {
+		t.Fatalf("LockShardForAction: %v", err)
+	}
+	if err := ts.UnlockShardForAction("test_keyspace", "0", lockPath, "results"); err != nil {
+		t.Fatalf("UnlockShardForAction: %v", err)
+	}
+
+	// an unlock retried after the first one worked, but its answer
+	// was lost, finds the lock released
+	if err := ts.UnlockShardForAction("test_keyspace", "0", lockPath, "results"); err != topo.ErrNoNode {
+		t.Errorf("UnlockShardForAction(again): want %v, got %v", topo.ErrNoNode, err)
+	}
+}